@@ -0,0 +1,1165 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/auth"
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/drift"
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/health"
+	"github.com/incrementventures/govr/inventory"
+	"github.com/incrementventures/govr/logging"
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/provision"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/rtsp"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/speaker"
+	"github.com/incrementventures/govr/stream"
+	"github.com/incrementventures/govr/syslog"
+)
+
+// by default recordings are queried for the last day
+const defaultRecordingRange = 24 * time.Hour
+
+const defaultStreamTokenTTL = time.Hour
+
+// Config configures the API server
+type Config struct {
+	// where our live streams are served, each camera's streams are found under these, any left empty aren't linked
+	HLSPrefix      string
+	WebRTCPrefix   string
+	SnapshotPrefix string
+
+	// the port our RTSP server restreams cameras on, on the same host as the API, zero if it isn't running
+	RTSPPort int
+
+	// the ffmpeg binary used to export clips, defaults to ffmpeg on our path
+	FFmpegPath string
+
+	// how long the tokens in links to our live streams last, which bounds how long a player can keep watching from a
+	// single link as HLS players reload their playlist with the token they were given, defaults to an hour
+	StreamTokenTTL time.Duration
+}
+
+// Server serves a JSON API over the devices found by a monitor and the recordings in an index
+type Server struct {
+	log     *slog.Logger
+	cfg     Config
+	monitor *scan.Monitor
+	cameras *registry.Cameras
+	changes *provision.Queue
+	index   *record.Index
+	events  *record.Events
+
+	// if set, returns the health of each camera being recorded, keyed by recording name
+	Health func() map[string]map[health.Check]health.CheckStatus
+
+	// if set, clients can talk through the speakers of cameras with an audio backchannel
+	Speaker *speaker.Player
+
+	// if set, cameras pending adoption can be adopted by declaring them with the passed in name, group, credentials
+	// and policies, which is needed before they are recorded
+	Adopt func(id string, a config.Adoption) error
+
+	// if set, returns the name the passed in camera is declared with, empty if it isn't declared, which is what its
+	// recordings are named after
+	NameOf func(c registry.Camera) string
+
+	// if set, what devices log to us over syslog can be read, kept by their registry IDs or by their addresses
+	Logs *syslog.Store
+
+	// if set, log levels can be changed and debug logging traced at runtime
+	Levels *logging.Levels
+
+	// if set, called with each event once it has been added, such as to act on people being detected
+	OnEvent func(record.Event)
+
+	// if set, scans can be run on demand with their own parameters, otherwise asking for a scan just brings forward
+	// the monitor's next rescan
+	Scans *scan.Jobs
+
+	// if set, users must be logged in with a role allowing what they ask for, otherwise anyone who can reach us can
+	// do anything
+	Sessions *auth.Sessions
+
+	// if set, admin routes are only served to addresses in the allowlist and rate limited per address
+	AdminAllowlist *auth.Allowlist
+	AdminLimiter   *auth.RateLimiter
+
+	// if set, links to our live streams carry tokens signed by this, which our stream handlers then require
+	Signer *auth.Signer
+
+	// if set, live views and event clips can be shared with people without accounts through links which can be
+	// revoked and limited to a number of views
+	Shares *auth.ShareStore
+}
+
+// New creates a new API server, index and events may be nil if we aren't recording. Devices are addressed by the
+// stable IDs assigned to them by the passed in registry, or by their monitor keys. Configuration changes are queued on
+// the passed in queue until their camera is online.
+func New(log *slog.Logger, cfg Config, monitor *scan.Monitor, cameras *registry.Cameras, changes *provision.Queue, index *record.Index, events *record.Events) *Server {
+	return &Server{log: log.With("subsystem", "api"), cfg: cfg, monitor: monitor, cameras: cameras, changes: changes, index: index, events: events}
+}
+
+// Handler returns the handler for our API, which serves paths under /api/ and shared links under /share/. With
+// sessions, reading about cameras and their recordings needs a viewer and everything else an admin.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	viewer := func(pattern string, h http.HandlerFunc) { mux.Handle(pattern, s.require(auth.RoleViewer, h)) }
+	admin := func(pattern string, h http.HandlerFunc) { mux.Handle(pattern, s.admin(h)) }
+
+	viewer("GET /api/devices", s.listDevices)
+	viewer("GET /api/devices/{id}", s.getDevice)
+	viewer("GET /api/devices/{id}/streams", s.getStreams)
+	viewer("GET /api/devices/{id}/snapshot", s.getSnapshot)
+	admin("POST /api/devices/{id}/talk", s.talk)
+	viewer("GET /api/devices/{id}/recordings", s.listDeviceRecordings)
+	admin("GET /api/devices/{id}/logs", s.listDeviceLogs)
+	admin("GET /api/devices/{id}/dot1x", s.getDot1X)
+	admin("POST /api/devices/{id}/adopt", s.adoptDevice)
+	admin("POST /api/devices/{id}/reject", s.rejectDevice)
+	admin("GET /api/pending", s.listPending)
+	admin("PUT /api/devices/{id}/asset", s.setAsset)
+	admin("GET /api/devices/{id}/changes", s.listChanges)
+	admin("POST /api/devices/{id}/changes", s.submitChange)
+	admin("GET /api/changes/{id}", s.getChange)
+	admin("DELETE /api/changes/{id}", s.cancelChange)
+	admin("POST /api/scan", s.triggerScan)
+	admin("GET /api/scans", s.listScans)
+	admin("GET /api/scans/{id}", s.getScan)
+	viewer("GET /api/health", s.getHealth)
+	viewer("GET /api/conflicts", s.listConflicts)
+	admin("GET /api/inventory", s.getInventory)
+	viewer("GET /api/recordings", s.listRecordings)
+	viewer("GET /api/recordings/{camera}", s.getRecordings)
+	viewer("GET /api/events", s.listEvents)
+	admin("POST /api/events", s.addEvent)
+	viewer("GET /api/events/{id}", s.getEvent)
+	viewer("GET /api/events/{id}/clip", s.getEventClip)
+	admin("GET /api/levels", s.serveLevels)
+	admin("POST /api/levels", s.serveLevels)
+	admin("DELETE /api/levels", s.serveLevels)
+	admin("GET /api/shares", s.listShares)
+	admin("POST /api/shares", s.createShare)
+	admin("DELETE /api/shares/{id}", s.revokeShare)
+
+	// share links are for people without accounts, their tokens are all they need
+	mux.HandleFunc("GET /share/{token}", s.redeemShare)
+	return mux
+}
+
+// wraps the passed in handler so that it needs an admin session, from an allowed address which isn't making too many
+// requests
+func (s *Server) admin(h http.Handler) http.Handler {
+	h = s.require(auth.RoleAdmin, h)
+	if s.AdminLimiter != nil {
+		h = s.AdminLimiter.Wrap(auth.RemoteIP, h)
+	}
+	if s.AdminAllowlist != nil {
+		h = s.AdminAllowlist.Wrap(h)
+	}
+	return h
+}
+
+// wraps the passed in handler so that it needs a session of at least the passed in role, if we have sessions
+func (s *Server) require(role auth.Role, h http.Handler) http.Handler {
+	if s.Sessions == nil {
+		return h
+	}
+	return s.Sessions.Require(role, h)
+}
+
+// Resolve returns the stream URL, with credentials, of the first profile of the device with the passed in ID or key,
+// requesting a fresh stream URI from the device if the one we have can't be used, suitable for use as the
+// stream.Resolver of our live streams
+func (s *Server) Resolve(camera string) (*creds.URL, error) {
+	key := s.keyOf(camera)
+	result, found := s.monitor.Result(key)
+	if !found {
+		return nil, stream.ErrUnknownCamera
+	}
+
+	// the device may have moved to a new address, in which case discovery will find it there
+	if !s.monitor.Online(key) {
+		s.monitor.Rescan()
+	}
+
+	// the stream URI we probed may only have been good for a single connection, or until the device rebooted, and
+	// credentials are passed however the camera wants them
+	resolver, err := scan.NewStreamResolver(s.log, result, "", s.monitor.Options())
+	if err != nil {
+		return nil, err
+	}
+	return resolver.Resolve(nil)
+}
+
+// returns the monitor key of the device with the passed in ID, or the passed in value if it isn't one of our IDs
+func (s *Server) keyOf(camera string) string {
+	if s.cameras != nil {
+		if c, found := s.cameras.Get(camera); found {
+			return c.Key
+		}
+	}
+	return camera
+}
+
+// returns the stable ID of the device with the passed in key, or its key if it hasn't been assigned one
+func (s *Server) idOf(key string) string {
+	if s.cameras != nil {
+		if c, found := s.cameras.ByKey(key); found {
+			return c.ID
+		}
+	}
+	return key
+}
+
+type device struct {
+	ID string `json:"id"`
+	scan.Record
+	Online   bool `json:"online"`
+	Pending  bool `json:"pending,omitempty"`
+	Rejected bool `json:"rejected,omitempty"`
+
+	Asset *registry.Asset `json:"asset,omitempty"`
+
+	// the firmware versions the device has run, oldest first
+	FirmwareHistory []registry.FirmwareVersion `json:"firmware_history,omitempty"`
+}
+
+func (s *Server) deviceOf(record scan.Record) device {
+	d := device{ID: record.Key, Record: record, Online: s.monitor.Online(record.Key)}
+	if s.cameras != nil {
+		if c, found := s.cameras.ByKey(record.Key); found {
+			d.ID, d.Pending, d.Rejected, d.Asset = c.ID, c.Pending, c.Rejected, c.Asset
+			d.FirmwareHistory = c.Firmware
+		}
+	}
+	return d
+}
+
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	records := s.monitor.Devices()
+	devices := make([]device, len(records))
+	for i, record := range records {
+		devices[i] = s.deviceOf(record)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request) {
+	key := s.keyOf(r.PathValue("id"))
+	result, found := s.monitor.Result(key)
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.deviceOf(scan.NewRecord(result)))
+}
+
+// returns the registry camera with the passed in ID or monitor key
+func (s *Server) cameraOf(id string) (registry.Camera, bool) {
+	if s.cameras == nil {
+		return registry.Camera{}, false
+	}
+	if c, found := s.cameras.Get(id); found {
+		return c, true
+	}
+	return s.cameras.ByKey(id)
+}
+
+// lists the cameras waiting to be adopted, including those which aren't currently online
+func (s *Server) listPending(w http.ResponseWriter, r *http.Request) {
+	if s.cameras == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"cameras": []registry.Camera{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cameras": s.cameras.Pending()})
+}
+
+// adopts a pending or rejected camera, declaring it as described in the body so that it can be recorded
+func (s *Server) adoptDevice(w http.ResponseWriter, r *http.Request) {
+	if s.Adopt == nil {
+		writeError(w, http.StatusNotFound, "adopting cameras requires a config file")
+		return
+	}
+	camera, found := s.cameraOf(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if camera.Adopted() {
+		writeError(w, http.StatusConflict, "device has already been adopted")
+		return
+	}
+
+	adoption := config.Adoption{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&adoption); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid adoption: "+err.Error())
+		return
+	}
+	if adoption.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid adoption: a name is required")
+		return
+	}
+
+	if err := s.Adopt(camera.ID, adoption); err != nil {
+		if errors.Is(err, config.ErrInvalidAdoption) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	camera, _ = s.cameras.Get(camera.ID)
+	writeJSON(w, http.StatusOK, camera)
+}
+
+// rejects a pending camera, such as a neighbor's which answers discovery, so that it is never used, adopted cameras
+// are instead removed from the config file
+func (s *Server) rejectDevice(w http.ResponseWriter, r *http.Request) {
+	camera, found := s.cameraOf(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if camera.Adopted() {
+		writeError(w, http.StatusConflict, "device has already been adopted")
+		return
+	}
+	if _, err := s.cameras.Reject(camera.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	camera, _ = s.cameras.Get(camera.ID)
+	writeJSON(w, http.StatusOK, camera)
+}
+
+// replaces the asset details of a camera, such as where it is installed and until when it is under warranty, which
+// can be set whether or not it is online or adopted
+func (s *Server) setAsset(w http.ResponseWriter, r *http.Request) {
+	camera, found := s.cameraOf(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+
+	asset := registry.Asset{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&asset); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid asset: "+err.Error())
+		return
+	}
+
+	if _, err := s.cameras.SetAsset(camera.ID, asset); err != nil {
+		if errors.Is(err, registry.ErrInvalidAsset) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	camera, _ = s.cameras.Get(camera.ID)
+	writeJSON(w, http.StatusOK, camera)
+}
+
+type streamLinks struct {
+	Profile string    `json:"profile,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Source  string    `json:"source"`
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+	Live    liveLinks `json:"live"`
+}
+
+type liveLinks struct {
+	HLS      string `json:"hls,omitempty"`
+	WebRTC   string `json:"webrtc,omitempty"`
+	RTSP     string `json:"rtsp,omitempty"`
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// returns the stream URLs of a device, only the first of these is restreamed live by us
+func (s *Server) getStreams(w http.ResponseWriter, r *http.Request) {
+	key := s.keyOf(r.PathValue("id"))
+	result, found := s.monitor.Result(key)
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+
+	streams := []streamLinks{}
+	if d := result.Device; d != nil {
+		for _, p := range d.Profiles {
+			link := streamLinks{Profile: p.Token, Name: p.Name, Source: creds.Redact(p.URI)}
+			if p.VideoEncoderConfiguration != nil {
+				link.Width, link.Height = p.VideoEncoderConfiguration.Resolution.Width, p.VideoEncoderConfiguration.Resolution.Height
+			}
+			streams = append(streams, link)
+		}
+	} else if src := result.Source; src != nil {
+		streams = append(streams, streamLinks{Source: creds.Redact(src.URL)})
+	}
+	if len(streams) > 0 {
+		streams[0].Live = s.liveLinks(r, s.idOf(key))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"streams": streams})
+}
+
+// returns the links to our live streams of the camera with the passed in ID, as reached by the passed in request
+func (s *Server) liveLinks(r *http.Request, id string) liveLinks {
+	camera := url.PathEscape(id)
+	links := liveLinks{}
+	if s.cfg.HLSPrefix != "" {
+		links.HLS = s.signLink(s.cfg.HLSPrefix+camera+"/index.m3u8", id, auth.StreamHLS)
+	}
+	if s.cfg.WebRTCPrefix != "" {
+		links.WebRTC = s.signLink(s.cfg.WebRTCPrefix+camera, id, auth.StreamWebRTC)
+	}
+	if s.cfg.SnapshotPrefix != "" {
+		links.Snapshot = s.signLink(s.cfg.SnapshotPrefix+camera+"/snapshot.jpg", id, auth.StreamSnapshot)
+	}
+	if s.cfg.RTSPPort != 0 {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		links.RTSP = s.signLink("rtsp://"+net.JoinHostPort(host, strconv.Itoa(s.cfg.RTSPPort))+"/"+camera, id, auth.StreamRTSP)
+	}
+	return links
+}
+
+// returns the passed in link with a token for the passed in camera and kind of stream added, if we sign our links,
+// or empty if it can't be signed
+func (s *Server) signLink(link string, camera string, kind auth.StreamKind) string {
+	if s.Signer == nil {
+		return link
+	}
+	token, err := s.Signer.StreamToken(camera, kind, cmp.Or(s.cfg.StreamTokenTTL, defaultStreamTokenTTL))
+	if err != nil {
+		s.log.Error("error signing stream token", slog.String("camera", camera), slog.String("error", err.Error()))
+		return ""
+	}
+	return link + "?" + url.Values{auth.StreamTokenParam: {token}}.Encode()
+}
+
+// returns a JPEG snapshot from the device, from the profile in the profile query parameter or the first one
+func (s *Server) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	result, found := s.monitor.Result(s.keyOf(r.PathValue("id")))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if result.Device == nil || len(result.Device.Profiles) == 0 {
+		writeError(w, http.StatusNotFound, "device doesn't support snapshots")
+		return
+	}
+
+	profile := r.URL.Query().Get("profile")
+	if profile == "" {
+		profile = result.Device.Profiles[0].Token
+	}
+
+	jpeg, err := result.Device.Snapshot(r.Context(), s.log, profile)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(jpeg)
+}
+
+type deviceRecording struct {
+	onvif.Recording
+	ReplayURI string `json:"replay_uri,omitempty"`
+}
+
+// lists the recordings the device holds on its own storage, such as an SD card, along with where each can be
+// replayed from
+func (s *Server) listDeviceRecordings(w http.ResponseWriter, r *http.Request) {
+	result, found := s.monitor.Result(s.keyOf(r.PathValue("id")))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if result.Device == nil {
+		writeError(w, http.StatusNotFound, "device doesn't record to its own storage")
+		return
+	}
+
+	// searching tells us what each recording holds, devices without a search service can only list them
+	d := result.Device
+	recordings, err := d.FindRecordings(s.log)
+	if errors.Is(err, onvif.ErrNoRecordingService) {
+		recordings, err = d.GetRecordings(s.log)
+	}
+	if errors.Is(err, onvif.ErrNoRecordingService) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	items := make([]deviceRecording, 0, len(recordings))
+	for _, recording := range recordings {
+		item := deviceRecording{Recording: recording}
+		if uri, err := d.GetReplayURI(s.log, recording.Token); err == nil {
+			item.ReplayURI = uri
+		} else if !errors.Is(err, onvif.ErrNoRecordingService) {
+			s.log.Warn("error getting replay uri", slog.String("recording", recording.Token), slog.String("error", err.Error()))
+		}
+		items = append(items, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"recordings": items})
+}
+
+// returns the 802.1X configurations of the device, the network interfaces which use them and the certificates it
+// holds for them, which are changed by submitting a change with the desired configuration
+func (s *Server) getDot1X(w http.ResponseWriter, r *http.Request) {
+	result, found := s.monitor.Result(s.keyOf(r.PathValue("id")))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if result.Device == nil {
+		writeError(w, http.StatusNotFound, "device isn't an onvif device")
+		return
+	}
+
+	d := result.Device
+	configs, err := d.GetDot1XConfigurations(s.log)
+	if errors.Is(err, onvif.ErrNoDot1X) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	ifaces, err := d.GetNetworkInterfaces(s.log)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	// not every device lets us see its certificates, which only leaves us unable to upload any
+	response := map[string]any{"configurations": configs, "interfaces": ifaces}
+	for key, get := range map[string]func(*slog.Logger) ([]onvif.Certificate, error){"certificates": d.GetCertificates, "ca_certificates": d.GetCACertificates} {
+		certs, err := get(s.log)
+		if err != nil && !errors.Is(err, onvif.ErrNoCertificates) {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if err == nil {
+			response[key] = certs
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// gets, sets or clears the global log level and its per subsystem or camera overrides, see logging.Levels
+func (s *Server) serveLevels(w http.ResponseWriter, r *http.Request) {
+	if s.Levels == nil {
+		writeError(w, http.StatusNotFound, "runtime log levels are not enabled")
+		return
+	}
+	s.Levels.ServeHTTP(w, r)
+}
+
+// returns what the device logged to us over syslog between the from and to query parameters, RFC3339 times which
+// default to the last day, at least as serious as the severity query parameter which defaults to debug. Devices we
+// don't know are looked up by the address they log from.
+func (s *Server) listDeviceLogs(w http.ResponseWriter, r *http.Request) {
+	if s.Logs == nil {
+		writeError(w, http.StatusNotFound, "syslog is not enabled")
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := parseTime(r.URL.Query().Get("from"), to.Add(-defaultRecordingRange))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	severity := syslog.SeverityDebug
+	if v := r.URL.Query().Get("severity"); v != "" {
+		if err := severity.UnmarshalText([]byte(v)); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	device := r.PathValue("id")
+	if camera, found := s.cameraOf(device); found {
+		device = camera.ID
+	}
+	messages, err := s.Logs.Messages(device, from, to, severity)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": to, "messages": messages})
+}
+
+// plays the audio in the request body through the speaker of the device as it arrives, responding once the body
+// ends. The body is raw G.711 (audio/basic or audio/PCMA at 8kHz), raw 16 bit PCM (audio/L16 with rate and channels
+// parameters), or any container ffmpeg recognizes, such as audio/webm from a browser's MediaRecorder.
+func (s *Server) talk(w http.ResponseWriter, r *http.Request) {
+	if s.Speaker == nil {
+		writeError(w, http.StatusNotFound, "talkback isn't enabled")
+		return
+	}
+	url, err := s.Resolve(r.PathValue("id"))
+	if errors.Is(err, stream.ErrUnknownCamera) {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	err = s.Speaker.Talk(r.Context(), url, r.Body, talkFormat(r.Header.Get("Content-Type")))
+	switch {
+	case errors.Is(err, rtsp.ErrNoBackchannel):
+		writeError(w, http.StatusNotFound, "device has no audio backchannel")
+	case errors.Is(err, speaker.ErrBusy):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// returns the format of talkback audio sent with the passed in content type
+func talkFormat(contentType string) speaker.TalkFormat {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	rate := func(def int) int {
+		if v, err := strconv.Atoi(params["rate"]); err == nil && v > 0 {
+			return v
+		}
+		return def
+	}
+	channels, err := strconv.Atoi(params["channels"])
+	if err != nil || channels <= 0 {
+		channels = 1
+	}
+
+	switch strings.ToLower(mediaType) {
+	case "audio/basic", "audio/pcmu":
+		return speaker.TalkFormat{Name: ffmpeg.FormatMulaw, SampleRate: rate(8000), Channels: channels}
+	case "audio/pcma":
+		return speaker.TalkFormat{Name: ffmpeg.FormatAlaw, SampleRate: rate(8000), Channels: channels}
+	case "audio/l16":
+		// L16 is network byte order
+		return speaker.TalkFormat{Name: "s16be", SampleRate: rate(8000), Channels: channels}
+	default:
+		return speaker.TalkFormat{}
+	}
+}
+
+func (s *Server) listChanges(w http.ResponseWriter, r *http.Request) {
+	key := s.keyOf(r.PathValue("id"))
+	if _, found := s.monitor.Result(key); !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"changes": s.changes.Changes(s.idOf(key))})
+}
+
+// queues the encoder, OSD, NTP or user changes in the body for the device, applying them right away if the device is
+// online and otherwise when it next comes online
+func (s *Server) submitChange(w http.ResponseWriter, r *http.Request) {
+	key := s.keyOf(r.PathValue("id"))
+	result, found := s.monitor.Result(key)
+	if !found {
+		writeError(w, http.StatusNotFound, "no such device")
+		return
+	}
+	if result.Device == nil {
+		writeError(w, http.StatusBadRequest, "device isn't an onvif device")
+		return
+	}
+
+	state := drift.DesiredState{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&state); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid change: "+err.Error())
+		return
+	}
+
+	id := s.idOf(key)
+	change, err := s.changes.Submit(id, state, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if s.monitor.Online(key) {
+		go s.changes.Apply(s.log, id, result.Device)
+	}
+	writeJSON(w, http.StatusAccepted, change)
+}
+
+func (s *Server) getChange(w http.ResponseWriter, r *http.Request) {
+	change, found := s.changes.Get(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such change")
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+// cancels a change which is still waiting for its camera
+func (s *Server) cancelChange(w http.ResponseWriter, r *http.Request) {
+	if _, found := s.changes.Get(r.PathValue("id")); !found {
+		writeError(w, http.StatusNotFound, "no such change")
+		return
+	}
+	cancelled, err := s.changes.Cancel(r.PathValue("id"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !cancelled {
+		writeError(w, http.StatusConflict, "change is no longer pending")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": provision.ChangeCancelled})
+}
+
+// scanRequest is the parameters of an on demand scan, anything left unset is as for the monitor's rescans
+type scanRequest struct {
+	// networks to scan in addition to those of our interfaces, and device addresses to probe directly
+	Networks  []string `json:"networks"`
+	Addresses []string `json:"addresses"`
+
+	// if set, the only interfaces to scan from, such as eth0.20 for a VLAN sub-interface
+	Interfaces []string `json:"interfaces"`
+
+	// the ports to check when port scanning
+	Ports []int `json:"ports"`
+
+	WSDiscovery *bool `json:"ws_discovery"`
+	PortScan    *bool `json:"port_scan"`
+	RTSPScan    *bool `json:"rtsp_scan"`
+}
+
+// returns the monitor's current options with this request's parameters applied
+func (req *scanRequest) options(opts scan.Options) (scan.Options, error) {
+	for _, n := range req.Networks {
+		if _, err := network.ParsePrefix(network.CIDR(n)); err != nil {
+			return opts, err
+		}
+		opts.IncludeCIDRs = append(slices.Clone(opts.IncludeCIDRs), network.CIDR(n))
+	}
+	if len(req.Addresses) > 0 {
+		opts.Addresses = append(slices.Clone(opts.Addresses), req.Addresses...)
+	}
+	if len(req.Interfaces) > 0 {
+		opts.Interfaces = make([]network.IFace, len(req.Interfaces))
+		for i, iface := range req.Interfaces {
+			opts.Interfaces[i] = network.IFace(iface)
+		}
+	}
+	for _, port := range req.Ports {
+		if port <= 0 || port > 65535 {
+			return opts, fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if len(req.Ports) > 0 {
+		opts.Ports = req.Ports
+	}
+	if req.WSDiscovery != nil {
+		opts.WSDiscovery = *req.WSDiscovery
+	}
+	if req.PortScan != nil {
+		opts.PortScan = *req.PortScan
+	}
+	if req.RTSPScan != nil {
+		opts.RTSPScan = *req.RTSPScan
+	}
+	return opts, nil
+}
+
+// starts a scan in the background, with the parameters in the body if any, returning the job to follow its progress
+// with. Devices it finds which we haven't seen before are added as pending adoption.
+func (s *Server) triggerScan(w http.ResponseWriter, r *http.Request) {
+	if s.Scans == nil {
+		s.monitor.Rescan()
+		writeJSON(w, http.StatusAccepted, map[string]any{"status": "scan requested"})
+		return
+	}
+
+	req := scanRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid scan: "+err.Error())
+		return
+	}
+	opts, err := req.options(s.monitor.Options())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid scan: "+err.Error())
+		return
+	}
+
+	job, err := s.Scans.Start(opts)
+	if errors.Is(err, scan.ErrJobRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/scans/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *Server) listScans(w http.ResponseWriter, r *http.Request) {
+	if s.Scans == nil {
+		writeError(w, http.StatusNotFound, "on demand scans are not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"scans": s.Scans.All()})
+}
+
+func (s *Server) getScan(w http.ResponseWriter, r *http.Request) {
+	if s.Scans == nil {
+		writeError(w, http.StatusNotFound, "on demand scans are not enabled")
+		return
+	}
+	job, found := s.Scans.Job(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such scan")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	if s.Health == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cameras": s.Health()})
+}
+
+// returns every camera in the registry along with its device details, health, storage use and asset details, as JSON
+// or, for reporting and importing elsewhere, as CSV or an Excel workbook if the format query parameter is csv or xlsx
+func (s *Server) getInventory(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" && format != "xlsx" {
+		writeError(w, http.StatusBadRequest, "invalid format, must be json, csv or xlsx")
+		return
+	}
+
+	items := s.inventory()
+	now := time.Now()
+	filename := "inventory-" + now.Format("20060102")
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".csv"}))
+		if err := inventory.WriteCSV(w, items, now); err != nil {
+			s.log.Error("error writing inventory", slog.String("error", err.Error()))
+		}
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".xlsx"}))
+		if err := inventory.WriteXLSX(w, items, now); err != nil {
+			s.log.Error("error writing inventory", slog.String("error", err.Error()))
+		}
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"cameras": items})
+	}
+}
+
+// builds the inventory of every camera in the registry, including those which aren't currently online
+func (s *Server) inventory() []inventory.Item {
+	if s.cameras == nil {
+		return []inventory.Item{}
+	}
+	cameras := s.cameras.All()
+
+	names := make([]string, len(cameras))
+	declared := map[string]bool{}
+	for i, c := range cameras {
+		if s.NameOf != nil {
+			names[i] = s.NameOf(c)
+			declared[names[i]] = true
+		}
+	}
+
+	var status map[string]map[health.Check]health.CheckStatus
+	if s.Health != nil {
+		status = s.Health()
+	}
+	var recorded []string
+	if s.index != nil {
+		recorded = s.index.Cameras()
+	}
+
+	items := make([]inventory.Item, len(cameras))
+	for i, c := range cameras {
+		item := inventory.Item{
+			ID:        c.ID,
+			Name:      names[i],
+			Status:    inventory.Status(c),
+			Online:    s.monitor.Online(c.Key),
+			Address:   c.Address,
+			MAC:       c.MAC,
+			Serial:    c.Serial,
+			FirstSeen: c.FirstSeen,
+			LastSeen:  c.LastSeen,
+		}
+		if result, found := s.monitor.Result(c.Key); found {
+			record := scan.NewRecord(result)
+			item.Address = record.Address
+			item.MAC = cmp.Or(record.MAC, item.MAC)
+			item.Vendor, item.Manufacturer, item.Model = record.Vendor, record.Manufacturer, record.Model
+			item.Firmware, item.Hardware = record.Firmware, record.Hardware
+			item.Serial = cmp.Or(record.Serial, item.Serial)
+			for _, stream := range record.Streams {
+				item.Streams = append(item.Streams, creds.Redact(stream))
+			}
+		}
+		if c.Asset != nil {
+			item.Asset = *c.Asset
+		}
+
+		// recordings are named after their camera, with the profile appended for any after the first
+		if item.Name != "" {
+			isOurs := func(recording string) bool {
+				return recording == item.Name || (strings.HasPrefix(recording, item.Name+"-") && !declared[recording])
+			}
+			for recording, checks := range status {
+				if isOurs(recording) {
+					if item.Health == nil {
+						item.Health = map[string]map[health.Check]health.CheckStatus{}
+					}
+					item.Health[recording] = checks
+				}
+			}
+			for _, recording := range recorded {
+				if !isOurs(recording) {
+					continue
+				}
+				for _, segment := range s.index.Segments(recording, time.Time{}, time.Now()) {
+					item.RecordedBytes += segment.Bytes
+					if item.RecordedFrom.IsZero() || segment.Start.Before(item.RecordedFrom) {
+						item.RecordedFrom = segment.Start
+					}
+					if segment.End.After(item.RecordedTo) {
+						item.RecordedTo = segment.End
+					}
+				}
+			}
+		}
+		items[i] = item
+	}
+	inventory.Sort(items)
+	return items
+}
+
+// lists the devices currently conflicting over an address, such as two cameras given the same static IP
+func (s *Server) listConflicts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"conflicts": s.monitor.Conflicts()})
+}
+
+func (s *Server) listRecordings(w http.ResponseWriter, r *http.Request) {
+	if s.index == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cameras": s.index.Cameras()})
+}
+
+// returns the segments and gaps of a camera between the from and to query parameters, RFC3339 times which default
+// to the last day
+func (s *Server) getRecordings(w http.ResponseWriter, r *http.Request) {
+	if s.index == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := parseTime(r.URL.Query().Get("from"), to.Add(-defaultRecordingRange))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	if !to.After(from) {
+		writeError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+
+	camera := r.PathValue("camera")
+	segments := s.index.Segments(camera, from, to)
+	gaps := s.index.Gaps(camera, from, to)
+	if segments == nil {
+		segments = []record.IndexedSegment{}
+	}
+	if gaps == nil {
+		gaps = []record.Gap{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": to, "segments": segments, "gaps": gaps})
+}
+
+// returns the events between the from and to query parameters, of the camera in the camera query parameter if set,
+// along with the segments each overlaps
+func (s *Server) listEvents(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err := parseTime(r.URL.Query().Get("from"), to.Add(-defaultRecordingRange))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": to, "events": s.events.List(r.URL.Query().Get("camera"), from, to)})
+}
+
+// records an event from another system, such as an alarm panel, against a camera's recording
+func (s *Server) addEvent(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+
+	event := record.Event{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&event); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid event: "+err.Error())
+		return
+	}
+	if event.ID != "" {
+		if _, found := s.events.Get(event.ID); found {
+			writeError(w, http.StatusConflict, "event already exists")
+			return
+		}
+	}
+
+	event, err := s.events.Add(event)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.OnEvent != nil {
+		s.OnEvent(event)
+	}
+	writeJSON(w, http.StatusCreated, event)
+}
+
+func (s *Server) getEvent(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+	event, found := s.events.Get(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "no such event")
+		return
+	}
+	writeJSON(w, http.StatusOK, event)
+}
+
+// returns an MP4 of the footage of an event, with the recording time burned in if the timestamp query parameter is set
+func (s *Server) getEventClip(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "recording is not enabled")
+		return
+	}
+	id := r.PathValue("id")
+	if _, found := s.events.Get(id); !found {
+		writeError(w, http.StatusNotFound, "no such event")
+		return
+	}
+	s.serveClip(w, r, id)
+}
+
+// exports and serves the footage of the event with the passed in ID
+func (s *Server) serveClip(w http.ResponseWriter, r *http.Request, id string) {
+	dir, err := os.MkdirTemp("", "govr-clip-*")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "error creating clip directory")
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	req := record.ExportRequest{Output: filepath.Join(dir, "clip.mp4"), Timestamp: r.URL.Query().Has("timestamp")}
+	err = record.ExportEvent(r.Context(), s.log, s.events, s.cfg.FFmpegPath, id, req)
+	if errors.Is(err, record.ErrNoRecording) {
+		writeError(w, http.StatusNotFound, "event has no recording")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="event-`+id+`.mp4"`)
+	http.ServeFile(w, r, req.Output)
+}
+
+// parses the passed in RFC3339 time, returning the passed in default if it is empty
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{"error": msg})
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/auth"
+	"github.com/incrementventures/govr/logging"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/rtsp"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/stream"
+)
+
+// returns an API server whose monitor knows a single RTSP camera, along with that camera's key
+func testServer(t *testing.T) (*Server, string) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	monitor := scan.NewMonitor(log, scan.DefaultOptions(), time.Hour, time.Hour)
+	monitor.Track(context.Background(), scan.DeviceResult{Source: &scan.StreamSource{Address: "192.168.1.10:554", URL: "rtsp://192.168.1.10:554/stream1"}})
+	devices := monitor.Devices()
+	if len(devices) != 1 {
+		t.Fatalf("expected a device, got %d", len(devices))
+	}
+	return New(log, Config{HLSPrefix: "/hls/", SnapshotPrefix: "/snapshots/"}, monitor, nil, nil, nil, nil), devices[0].Key
+}
+
+func serve(h http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestStreamLinks(t *testing.T) {
+	s, camera := testServer(t)
+	s.cfg.WebRTCPrefix, s.cfg.RTSPPort = "/webrtc/", 8554
+	signer := auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+
+	streams := func() liveLinks {
+		w := serve(s.Handler(), http.MethodGet, "/api/devices/"+url.PathEscape(camera)+"/streams", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		resp := struct {
+			Streams []struct {
+				Live liveLinks `json:"live"`
+			} `json:"streams"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Streams) != 1 {
+			t.Fatalf("expected a stream, got %d", len(resp.Streams))
+		}
+		return resp.Streams[0].Live
+	}
+
+	// without a signer links are left as they are
+	if links := streams(); strings.Contains(links.HLS, "?") {
+		t.Errorf("expected unsigned links, got %+v", links)
+	}
+
+	s.Signer = signer
+	links := streams()
+	tcs := []struct {
+		name string
+		link string
+		kind auth.StreamKind
+	}{
+		{name: "hls", link: links.HLS, kind: auth.StreamHLS},
+		{name: "webrtc", link: links.WebRTC, kind: auth.StreamWebRTC},
+		{name: "snapshot", link: links.Snapshot, kind: auth.StreamSnapshot},
+		{name: "rtsp", link: links.RTSP, kind: auth.StreamRTSP},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := u.Query().Get(auth.StreamTokenParam)
+			if err := signer.VerifyStreamToken(token, camera, tc.kind); err != nil {
+				t.Errorf("expected a token for %s in %q, got %v", tc.kind, tc.link, err)
+			}
+			if err := signer.VerifyStreamToken(token, camera, auth.StreamKind("other")); err == nil {
+				t.Errorf("expected the token in %q to be only for %s", tc.link, tc.kind)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	s, camera := testServer(t)
+	signer := auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	s.Sessions = auth.NewSessions(nil, signer, time.Hour, false)
+	s.Levels = logging.NewLevels(slog.LevelInfo, 10)
+	h := s.Handler()
+
+	session := func(role auth.Role) *http.Cookie {
+		token, err := signer.Sign(auth.Claims{Subject: "user-1", Scope: "session:" + string(role), Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: auth.SessionCookie, Value: token}
+	}
+
+	tcs := []struct {
+		name   string
+		method string
+		target string
+		role   auth.Role
+		status int
+	}{
+		{name: "devices without a session", method: http.MethodGet, target: "/api/devices", status: http.StatusUnauthorized},
+		{name: "devices as viewer", method: http.MethodGet, target: "/api/devices", role: auth.RoleViewer, status: http.StatusOK},
+		{name: "streams as viewer", method: http.MethodGet, target: "/api/devices/" + url.PathEscape(camera) + "/streams", role: auth.RoleViewer, status: http.StatusOK},
+		{name: "pending as viewer", method: http.MethodGet, target: "/api/pending", role: auth.RoleViewer, status: http.StatusForbidden},
+		{name: "pending as admin", method: http.MethodGet, target: "/api/pending", role: auth.RoleAdmin, status: http.StatusOK},
+		{name: "scan as viewer", method: http.MethodPost, target: "/api/scan", role: auth.RoleViewer, status: http.StatusForbidden},
+		{name: "shares as viewer", method: http.MethodGet, target: "/api/shares", role: auth.RoleViewer, status: http.StatusForbidden},
+		{name: "levels as viewer", method: http.MethodGet, target: "/api/levels", role: auth.RoleViewer, status: http.StatusForbidden},
+		{name: "levels as admin", method: http.MethodGet, target: "/api/levels", role: auth.RoleAdmin, status: http.StatusOK},
+		{name: "clear level as viewer", method: http.MethodDelete, target: "/api/levels?key=camera=abc123", role: auth.RoleViewer, status: http.StatusForbidden},
+		{name: "clear level as admin", method: http.MethodDelete, target: "/api/levels?key=camera=abc123", role: auth.RoleAdmin, status: http.StatusNoContent},
+		{name: "share link without a session", method: http.MethodGet, target: "/share/invalid", status: http.StatusNotFound},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, nil)
+			if tc.role != auth.RoleNone {
+				r.AddCookie(session(tc.role))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s, _ := testServer(t)
+	allowlist, err := auth.NewAllowlist([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AdminAllowlist = allowlist
+	s.AdminLimiter = auth.NewRateLimiter(0.001, 2)
+	h := s.Handler()
+
+	request := func(target string, remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tcs := []struct {
+		name       string
+		target     string
+		remoteAddr string
+		status     int
+	}{
+		{name: "admin from allowed address", target: "/api/pending", remoteAddr: "192.168.1.20:5000", status: http.StatusOK},
+		{name: "admin from other address", target: "/api/pending", remoteAddr: "10.0.0.20:5000", status: http.StatusForbidden},
+		{name: "viewer from other address", target: "/api/devices", remoteAddr: "10.0.0.20:5000", status: http.StatusOK},
+		{name: "admin again from allowed address", target: "/api/inventory", remoteAddr: "192.168.1.20:5001", status: http.StatusOK},
+		{name: "admin past rate limit", target: "/api/pending", remoteAddr: "192.168.1.20:5002", status: http.StatusTooManyRequests},
+		{name: "viewer past admin rate limit", target: "/api/devices", remoteAddr: "192.168.1.20:5003", status: http.StatusOK},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := request(tc.target, tc.remoteAddr); status != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestAddEvent(t *testing.T) {
+	dir := t.TempDir()
+	index, err := record.OpenIndex(filepath.Join(dir, "index.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	events, err := record.OpenEvents(filepath.Join(dir, "events.jsonl"), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)), Config{}, nil, nil, nil, index, events)
+	added := []record.Event{}
+	s.OnEvent = func(e record.Event) { added = append(added, e) }
+	h := s.Handler()
+
+	tcs := []struct {
+		name   string
+		body   string
+		status int
+		added  int
+	}{
+		{name: "person", body: `{"camera": "front", "type": "person", "start": "2024-06-01T22:00:00Z"}`, status: http.StatusCreated, added: 1},
+		{name: "no start", body: `{"camera": "front", "type": "person"}`, status: http.StatusBadRequest, added: 1},
+		{name: "invalid", body: `{`, status: http.StatusBadRequest, added: 1},
+		{name: "vehicle", body: `{"camera": "drive", "type": "vehicle", "start": "2024-06-01T22:00:00Z"}`, status: http.StatusCreated, added: 2},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(h, http.MethodPost, "/api/events", tc.body); w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+			if len(added) != tc.added {
+				t.Fatalf("expected %d events passed to the hook, got %d", tc.added, len(added))
+			}
+		})
+	}
+
+	if added[0].ID == "" || added[0].Camera != "front" || added[0].Type != "person" {
+		t.Errorf("expected the added event with its id, got %+v", added[0])
+	}
+}
+
+func TestResolve(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// a camera we've found wants its credentials in the query
+	opts := scan.DefaultOptions()
+	opts.RTSPStrategies.Set("192.168.1.10:554", rtsp.StrategyQuery)
+	monitor := scan.NewMonitor(log, opts, time.Hour, time.Hour)
+	monitor.Track(context.Background(), scan.DeviceResult{
+		Source:     &scan.StreamSource{Address: "192.168.1.10:554", URL: "rtsp://192.168.1.10:554/stream1"},
+		Credential: scan.Credential{Username: "admin", Password: "secret"},
+	})
+	s := New(log, Config{}, monitor, nil, nil, nil, nil)
+
+	url, err := s.Resolve(monitor.Devices()[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "rtsp://192.168.1.10:554/stream1?password=secret&user=admin"; url.Secret() != expected {
+		t.Errorf("expected %s, got %s", expected, url.Secret())
+	}
+
+	if _, err := s.Resolve("unknown"); !errors.Is(err, stream.ErrUnknownCamera) {
+		t.Errorf("expected an unknown camera, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/incrementventures/govr/auth"
+)
+
+const (
+	// shares last a day unless asked otherwise, and never longer than a month
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+type shareRequest struct {
+	Kind auth.ShareKind `json:"kind"`
+
+	// the camera whose live view is shared, or the event whose clip is shared
+	Camera string `json:"camera,omitempty"`
+	Clip   string `json:"clip,omitempty"`
+
+	// how many seconds the share lasts and how many times it can be viewed, zero for any number
+	TTL      int `json:"ttl,omitempty"`
+	MaxViews int `json:"max_views,omitempty"`
+}
+
+// lists the shares which haven't expired, including those which have been revoked, newest first
+func (s *Server) listShares(w http.ResponseWriter, r *http.Request) {
+	if s.Shares == nil {
+		writeError(w, http.StatusNotFound, "sharing is not enabled")
+		return
+	}
+	shares := s.Shares.List()
+	slices.SortFunc(shares, func(a, b auth.Share) int { return b.Created.Compare(a.Created) })
+	writeJSON(w, http.StatusOK, map[string]any{"shares": shares})
+}
+
+// creates a share of a camera's live view or an event's clip, returning it along with the link to give out, which is
+// the only time its token is available
+func (s *Server) createShare(w http.ResponseWriter, r *http.Request) {
+	if s.Shares == nil {
+		writeError(w, http.StatusNotFound, "sharing is not enabled")
+		return
+	}
+
+	req := shareRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid share: "+err.Error())
+		return
+	}
+
+	ttl := cmp.Or(time.Duration(req.TTL)*time.Second, defaultShareTTL)
+	if req.TTL < 0 || ttl > maxShareTTL {
+		writeError(w, http.StatusBadRequest, "invalid share: ttl must be at most "+maxShareTTL.String())
+		return
+	}
+	if req.MaxViews < 0 {
+		writeError(w, http.StatusBadRequest, "invalid share: max_views can't be negative")
+		return
+	}
+
+	camera := ""
+	switch req.Kind {
+	case auth.ShareLive:
+		key := s.keyOf(req.Camera)
+		if _, found := s.monitor.Result(key); !found || req.Clip != "" {
+			writeError(w, http.StatusBadRequest, "invalid share: live shares need a known camera and no clip")
+			return
+		}
+		camera = s.idOf(key)
+	case auth.ShareClip:
+		if s.events == nil {
+			writeError(w, http.StatusNotFound, "recording is not enabled")
+			return
+		}
+		event, found := s.events.Get(req.Clip)
+		if !found {
+			writeError(w, http.StatusBadRequest, "invalid share: clip shares need a known event")
+			return
+		}
+		camera = event.Camera
+	default:
+		writeError(w, http.StatusBadRequest, "invalid share: kind must be live or clip")
+		return
+	}
+
+	share, token, err := s.Shares.Create(req.Kind, camera, req.Clip, ttl, req.MaxViews)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link, err := auth.ShareURL(scheme+"://"+r.Host, token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"share": share, "token": token, "url": link})
+}
+
+// revokes a share so that its link stops working before it expires
+func (s *Server) revokeShare(w http.ResponseWriter, r *http.Request) {
+	if s.Shares == nil {
+		writeError(w, http.StatusNotFound, "sharing is not enabled")
+		return
+	}
+	err := s.Shares.Revoke(r.PathValue("id"))
+	if errors.Is(err, auth.ErrShareNotFound) {
+		writeError(w, http.StatusNotFound, "no such share")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redeems a share link, counting a view against it, live shares are answered with the links to the camera's live
+// streams and clip shares with the clip itself
+func (s *Server) redeemShare(w http.ResponseWriter, r *http.Request) {
+	if s.Shares == nil {
+		writeError(w, http.StatusNotFound, "sharing is not enabled")
+		return
+	}
+
+	share, err := s.Shares.Redeem(r.PathValue("token"))
+	switch {
+	case errors.Is(err, auth.ErrShareRevoked), errors.Is(err, auth.ErrShareViewsLimit), errors.Is(err, auth.ErrExpiredToken):
+		writeError(w, http.StatusGone, err.Error())
+		return
+	case errors.Is(err, auth.ErrShareNotFound), errors.Is(err, auth.ErrNotShare), errors.Is(err, auth.ErrInvalidToken):
+		writeError(w, http.StatusNotFound, "no such share")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if share.Kind == auth.ShareClip {
+		if s.events == nil {
+			writeError(w, http.StatusNotFound, "recording is not enabled")
+			return
+		}
+		s.serveClip(w, r, share.Clip)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"share": share, "live": s.liveLinks(r, share.Camera)})
+}
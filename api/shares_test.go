@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/incrementventures/govr/auth"
+)
+
+func TestShares(t *testing.T) {
+	s, camera := testServer(t)
+	s.Shares = auth.NewShareStore(auth.NewSigner([]byte("0123456789abcdef0123456789abcdef")))
+	h := s.Handler()
+
+	w := serve(h, http.MethodPost, "/api/shares", `{"kind": "live", "camera": "`+camera+`", "max_views": 1}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 creating share, got %d: %s", w.Code, w.Body)
+	}
+	created := struct {
+		Share auth.Share `json:"share"`
+		URL   string     `json:"url"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	link, err := url.Parse(created.URL)
+	if err != nil || !strings.HasPrefix(link.Path, "/share/") {
+		t.Fatalf("expected a share link, got %q", created.URL)
+	}
+
+	w = serve(h, http.MethodGet, link.Path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 redeeming share, got %d: %s", w.Code, w.Body)
+	}
+	redeemed := struct {
+		Live liveLinks `json:"live"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &redeemed); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(redeemed.Live.HLS, "/hls/") {
+		t.Errorf("expected hls link, got %+v", redeemed.Live)
+	}
+
+	// the share only allows one view
+	if w := serve(h, http.MethodGet, link.Path, ""); w.Code != http.StatusGone {
+		t.Errorf("expected 410 redeeming share past its views, got %d", w.Code)
+	}
+
+	w = serve(h, http.MethodPost, "/api/shares", `{"kind": "live", "camera": "`+camera+`"}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, http.MethodDelete, "/api/shares/"+created.Share.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 revoking share, got %d", w.Code)
+	}
+	link, _ = url.Parse(created.URL)
+	if w := serve(h, http.MethodGet, link.Path, ""); w.Code != http.StatusGone {
+		t.Errorf("expected 410 redeeming revoked share, got %d", w.Code)
+	}
+	if w := serve(h, http.MethodDelete, "/api/shares/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 revoking unknown share, got %d", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/share/invalid", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 redeeming invalid share, got %d", w.Code)
+	}
+
+	w = serve(h, http.MethodGet, "/api/shares", "")
+	listed := struct {
+		Shares []auth.Share `json:"shares"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Shares) != 2 {
+		t.Fatalf("expected both shares, got %+v", listed.Shares)
+	}
+	for _, share := range listed.Shares {
+		if share.Revoked != (share.ID == created.Share.ID) {
+			t.Errorf("expected only the second share to be revoked, got %+v", share)
+		}
+	}
+}
+
+func TestCreateShareInvalid(t *testing.T) {
+	s, camera := testServer(t)
+	s.Shares = auth.NewShareStore(auth.NewSigner([]byte("0123456789abcdef0123456789abcdef")))
+	h := s.Handler()
+
+	tcs := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "unknown camera", body: `{"kind": "live", "camera": "unknown"}`, status: http.StatusBadRequest},
+		{name: "live with clip", body: `{"kind": "live", "camera": "` + camera + `", "clip": "event-1"}`, status: http.StatusBadRequest},
+		{name: "unknown kind", body: `{"kind": "admin", "camera": "` + camera + `"}`, status: http.StatusBadRequest},
+		{name: "too long", body: `{"kind": "live", "camera": "` + camera + `", "ttl": 31536000}`, status: http.StatusBadRequest},
+		{name: "negative ttl", body: `{"kind": "live", "camera": "` + camera + `", "ttl": -1}`, status: http.StatusBadRequest},
+		{name: "negative views", body: `{"kind": "live", "camera": "` + camera + `", "max_views": -1}`, status: http.StatusBadRequest},
+		{name: "unknown field", body: `{"kind": "live", "camera": "` + camera + `", "scope": "admin"}`, status: http.StatusBadRequest},
+		{name: "clip without recording", body: `{"kind": "clip", "clip": "event-1"}`, status: http.StatusNotFound},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(h, http.MethodPost, "/api/shares", tc.body); w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+
+	s.Shares = nil
+	if w := serve(s.Handler(), http.MethodGet, "/api/shares", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without sharing, got %d", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig configures which separately hosted frontends may call our API
+type CORSConfig struct {
+	// origins allowed to make cross origin requests, "*" allows any origin but never with credentials
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, origin) || slices.Contains(c.AllowedOrigins, "*")
+}
+
+// CORS adds CORS headers to responses for allowed origins and answers preflight requests
+func CORS(config CORSConfig, next http.Handler) http.Handler {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = []string{"Authorization", "Content-Type", CSRFHeader}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !config.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		// frontends on other origins can't read our CSRF cookie so they need to be able to read its header
+		h.Set("Access-Control-Expose-Headers", CSRFHeader)
+
+		// wildcard origins can't be combined with credentials so we echo the specific origin only when configured
+		if config.AllowCredentials && slices.Contains(config.AllowedOrigins, origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		} else if slices.Contains(config.AllowedOrigins, "*") {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+			if config.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	CSRFCookie = "govr_csrf"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// CSRFConfig configures cross site request forgery protection for cookie authenticated requests
+type CSRFConfig struct {
+	Disabled bool
+
+	// origins other than our own which may make state changing requests
+	TrustedOrigins []string
+
+	// whether the CSRF cookie should be marked secure, should be true whenever served over TLS
+	Secure bool
+}
+
+// CSRF protects unsafe requests using a double submit cookie, whose token is also returned in a header of every
+// response. Requests authenticated with a bearer token aren't vulnerable to CSRF and are let through.
+func CSRF(config CSRFConfig, next http.Handler) http.Handler {
+	if config.Disabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(CSRFCookie)
+		if err != nil || cookie.Value == "" {
+			cookie = &http.Cookie{
+				Name:     CSRFCookie,
+				Value:    randomToken(),
+				Path:     "/",
+				Secure:   config.Secure,
+				SameSite: http.SameSiteStrictMode,
+			}
+			http.SetCookie(w, cookie)
+		}
+
+		// the token is also in a header of every response, for clients which can't read our cookies
+		w.Header().Set(CSRFHeader, cookie.Value)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) && !slices.Contains(config.TrustedOrigins, origin) {
+			http.Error(w, "cross origin request denied", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get(CSRFHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+// returns a random URL safe token, suitable for CSRF tokens or login state
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
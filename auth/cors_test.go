@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tcs := []struct {
+		name        string
+		config      CORSConfig
+		method      string
+		origin      string
+		preflight   bool
+		status      int
+		allowOrigin string
+		credentials bool
+	}{
+		{
+			name:        "allowed origin with credentials",
+			config:      CORSConfig{AllowedOrigins: []string{"https://nvr.example.com"}, AllowCredentials: true},
+			method:      http.MethodGet,
+			origin:      "https://nvr.example.com",
+			status:      http.StatusOK,
+			allowOrigin: "https://nvr.example.com",
+			credentials: true,
+		},
+		{
+			name:        "wildcard never with credentials",
+			config:      CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			method:      http.MethodGet,
+			origin:      "https://nvr.example.com",
+			status:      http.StatusOK,
+			allowOrigin: "*",
+		},
+		{
+			name:   "other origin",
+			config: CORSConfig{AllowedOrigins: []string{"https://nvr.example.com"}, AllowCredentials: true},
+			method: http.MethodGet,
+			origin: "https://evil.example.com",
+			status: http.StatusOK,
+		},
+		{
+			name:   "same origin",
+			config: CORSConfig{AllowedOrigins: []string{"https://nvr.example.com"}},
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:        "preflight",
+			config:      CORSConfig{AllowedOrigins: []string{"https://nvr.example.com"}, AllowCredentials: true, MaxAge: 600},
+			method:      http.MethodOptions,
+			origin:      "https://nvr.example.com",
+			preflight:   true,
+			status:      http.StatusNoContent,
+			allowOrigin: "https://nvr.example.com",
+			credentials: true,
+		},
+		{
+			name:      "preflight from other origin",
+			config:    CORSConfig{AllowedOrigins: []string{"https://nvr.example.com"}},
+			method:    http.MethodOptions,
+			origin:    "https://evil.example.com",
+			preflight: true,
+			status:    http.StatusOK,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/api/devices", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			CORS(tc.config, ok).ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+			h := w.Header()
+			if h.Get("Access-Control-Allow-Origin") != tc.allowOrigin {
+				t.Errorf("expected allowed origin %q, got %q", tc.allowOrigin, h.Get("Access-Control-Allow-Origin"))
+			}
+			if (h.Get("Access-Control-Allow-Credentials") == "true") != tc.credentials {
+				t.Errorf("expected credentials %t, got %q", tc.credentials, h.Get("Access-Control-Allow-Credentials"))
+			}
+			if tc.allowOrigin != "" && h.Get("Access-Control-Expose-Headers") != CSRFHeader {
+				t.Errorf("expected the csrf header to be exposed, got %q", h.Get("Access-Control-Expose-Headers"))
+			}
+			if tc.preflight && tc.allowOrigin != "" && (h.Get("Access-Control-Allow-Methods") == "" || h.Get("Access-Control-Max-Age") != "600") {
+				t.Errorf("expected allowed methods and max age, got %v", h)
+			}
+		})
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	h := CSRF(CSRFConfig{TrustedOrigins: []string{"https://nvr.example.com"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// a first request is given a token in both a cookie and a header
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/devices", nil))
+	cookie := responseCookie(w, CSRFCookie)
+	if cookie == nil || cookie.Value == "" || w.Header().Get(CSRFHeader) != cookie.Value {
+		t.Fatalf("expected the csrf token in a cookie and header, got %+v and %q", cookie, w.Header().Get(CSRFHeader))
+	}
+
+	tcs := []struct {
+		name    string
+		method  string
+		origin  string
+		token   string
+		cookie  bool
+		headers map[string]string
+		status  int
+	}{
+		{name: "get without token", method: http.MethodGet, status: http.StatusOK},
+		{name: "post with token", method: http.MethodPost, cookie: true, token: cookie.Value, status: http.StatusOK},
+		{name: "post without token", method: http.MethodPost, cookie: true, status: http.StatusForbidden},
+		{name: "post with wrong token", method: http.MethodPost, cookie: true, token: "guess", status: http.StatusForbidden},
+		{name: "post without cookie", method: http.MethodPost, token: cookie.Value, status: http.StatusForbidden},
+		{name: "delete without token", method: http.MethodDelete, cookie: true, status: http.StatusForbidden},
+		{name: "post from same origin", method: http.MethodPost, origin: "http://example.com", cookie: true, token: cookie.Value, status: http.StatusOK},
+		{name: "post from trusted origin", method: http.MethodPost, origin: "https://nvr.example.com", cookie: true, token: cookie.Value, status: http.StatusOK},
+		{name: "post from other origin", method: http.MethodPost, origin: "https://evil.example.com", cookie: true, token: cookie.Value, status: http.StatusForbidden},
+		{name: "post with bearer token", method: http.MethodPost, headers: map[string]string{"Authorization": "Bearer abc"}, status: http.StatusOK},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/api/scan", nil)
+			if tc.cookie {
+				r.AddCookie(cookie)
+			}
+			if tc.token != "" {
+				r.Header.Set(CSRFHeader, tc.token)
+			}
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+			if tc.cookie && w.Header().Get(CSRFHeader) != cookie.Value {
+				t.Errorf("expected the existing token in the header, got %q", w.Header().Get(CSRFHeader))
+			}
+		})
+	}
+
+	disabled := CSRF(CSRFConfig{Disabled: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/scan", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with csrf disabled, got %d", w.Code)
+	}
+}
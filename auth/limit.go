@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowlist restricts access to requests coming from a set of networks
+type Allowlist struct {
+	prefixes []netip.Prefix
+}
+
+// NewAllowlist creates an allowlist from a list of IPs and CIDRs, an empty list allows everything
+func NewAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist ip %q: %w", entry, err)
+			}
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist cidr %q: %w", entry, err)
+		}
+		a.prefixes = append(a.prefixes, prefix.Masked())
+	}
+	return a, nil
+}
+
+// Allows returns whether the passed in address is allowed
+func (a *Allowlist) Allows(addr netip.Addr) bool {
+	if len(a.prefixes) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap rejects any request whose source address isn't in the allowlist
+func (a *Allowlist) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := RemoteAddr(r)
+		if !ok || !a.Allows(addr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RemoteAddr returns the source IP of the passed in request, we deliberately ignore forwarding headers
+func RemoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone(""), true
+}
+
+// RemoteIP returns the source IP of the passed in request as a string, suitable as the key of a rate limiter or lockout
+func RemoteIP(r *http.Request) string {
+	addr, ok := RemoteAddr(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
+
+// RateLimiter is a token bucket rate limiter keyed by an arbitrary string such as an API token or IP
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing perSecond requests with bursts of up to burst requests
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket for the passed in key, returning false if there are none left
+func (l *RateLimiter) Allow(key string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Prune removes buckets which have been idle long enough to have refilled completely
+func (l *RateLimiter) Prune() {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Wrap rate limits requests using the key returned by the key func, for example the bearer token or source IP
+func (l *RateLimiter) Wrap(key func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(key(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lockout tracks failed logins and locks out a key (username or IP) after too many failures within a window
+type Lockout struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+}
+
+func NewLockout(maxFailures int, window time.Duration, duration time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		failures:    make(map[string][]time.Time),
+		locked:      make(map[string]time.Time),
+	}
+}
+
+// Locked returns whether the passed in key is currently locked out and if so until when
+func (l *Lockout) Locked(key string) (bool, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, found := l.locked[key]
+	if !found {
+		return false, time.Time{}
+	}
+	if time.Now().After(until) {
+		delete(l.locked, key)
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// Fail records a failed login for the passed in key, locking it out if it has failed too many times
+func (l *Lockout) Fail(key string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := []time.Time{}
+	for _, t := range l.failures[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= l.maxFailures {
+		l.locked[key] = now.Add(l.duration)
+		delete(l.failures, key)
+		return
+	}
+	l.failures[key] = recent
+}
+
+// Succeed clears any failures recorded against the passed in key
+func (l *Lockout) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, key)
+}
+
+// Prune removes failures which have fallen out of our window and lockouts which have ended
+func (l *Lockout) Prune() {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, failures := range l.failures {
+		if len(failures) == 0 || now.Sub(failures[len(failures)-1]) >= l.window {
+			delete(l.failures, key)
+		}
+	}
+	for key, until := range l.locked {
+		if now.After(until) {
+			delete(l.locked, key)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := NewAllowlist([]string{"192.168.1.0/24", " 10.0.0.5 ", "", "fd00::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := allowlist.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		status     int
+	}{
+		{name: "in cidr", remoteAddr: "192.168.1.20:5000", status: http.StatusOK},
+		{name: "single ip", remoteAddr: "10.0.0.5:5000", status: http.StatusOK},
+		{name: "next to single ip", remoteAddr: "10.0.0.6:5000", status: http.StatusForbidden},
+		{name: "outside cidr", remoteAddr: "192.168.2.20:5000", status: http.StatusForbidden},
+		{name: "mapped ipv4", remoteAddr: "[::ffff:192.168.1.20]:5000", status: http.StatusOK},
+		{name: "ipv6", remoteAddr: "[fd00::20]:5000", status: http.StatusOK},
+		{name: "ipv6 with zone", remoteAddr: "[fd00::20%eth0]:5000", status: http.StatusOK},
+		{name: "unparseable", remoteAddr: "unix", status: http.StatusForbidden},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/pending", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set("X-Forwarded-For", "192.168.1.20")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+
+	empty, err := NewAllowlist(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty.Allows(netip.MustParseAddr("203.0.113.5")) {
+		t.Error("expected an empty allowlist to allow everything")
+	}
+	for _, invalid := range []string{"192.168.1.300", "192.168.1.0/33", "camera.local"} {
+		if _, err := NewAllowlist([]string{invalid}); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(0.001, 3)
+	h := limiter.Wrap(RemoteIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// each address gets its own burst, and different ports are the same address
+	for i := range 3 {
+		if status := request("192.168.1.20:" + strconv.Itoa(5000+i)); status != http.StatusOK {
+			t.Errorf("request %d: expected 200, got %d", i, status)
+		}
+	}
+	if status := request("192.168.1.20:5000"); status != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the burst, got %d", status)
+	}
+	if status := request("192.168.1.21:5000"); status != http.StatusOK {
+		t.Errorf("expected 200 for another address, got %d", status)
+	}
+
+	refilled := NewRateLimiter(1000, 1)
+	refilled.Allow("a")
+	time.Sleep(5 * time.Millisecond)
+	refilled.Prune()
+	if len(refilled.buckets) != 0 {
+		t.Errorf("expected refilled buckets to be pruned, got %d", len(refilled.buckets))
+	}
+}
+
+func TestLockout(t *testing.T) {
+	lockout := NewLockout(3, time.Minute, time.Minute)
+
+	lockout.Fail("192.168.1.20")
+	lockout.Fail("192.168.1.20")
+	if locked, _ := lockout.Locked("192.168.1.20"); locked {
+		t.Error("expected no lockout before the maximum failures")
+	}
+
+	// succeeding clears failures so they don't count towards a lockout
+	lockout.Succeed("192.168.1.20")
+	lockout.Fail("192.168.1.20")
+	lockout.Fail("192.168.1.20")
+	if locked, _ := lockout.Locked("192.168.1.20"); locked {
+		t.Error("expected no lockout after failures were cleared")
+	}
+	lockout.Fail("192.168.1.20")
+	locked, until := lockout.Locked("192.168.1.20")
+	if !locked || time.Until(until) <= 0 {
+		t.Errorf("expected a lockout, got %t until %v", locked, until)
+	}
+	if locked, _ := lockout.Locked("192.168.1.21"); locked {
+		t.Error("expected other addresses not to be locked out")
+	}
+
+	expired := NewLockout(2, time.Millisecond, time.Millisecond)
+	expired.Fail("a")
+	expired.Fail("b")
+	expired.Fail("b")
+	time.Sleep(5 * time.Millisecond)
+	expired.Prune()
+	if len(expired.failures) != 0 || len(expired.locked) != 0 {
+		t.Errorf("expected stale failures and lockouts to be pruned, got %v and %v", expired.failures, expired.locked)
+	}
+}
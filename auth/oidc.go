@@ -0,0 +1,362 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoRole = errors.New("user is not a member of any group with access")
+
+type Role string
+
+const (
+	RoleNone   Role = ""
+	RoleViewer Role = "viewer"
+	RoleAdmin  Role = "admin"
+)
+
+// returns whether this role grants at least the access of the passed in role
+func (r Role) Includes(other Role) bool {
+	return roleRank[r] >= roleRank[other]
+}
+
+var roleRank = map[Role]int{RoleNone: 0, RoleViewer: 1, RoleAdmin: 2}
+
+// OIDCConfig configures login via an external OpenID Connect identity provider
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// the claim in the ID token which lists the user's groups, defaults to "groups"
+	GroupsClaim string
+
+	// maps identity provider groups to our roles, users get the highest role of any of their groups
+	GroupRoles map[string]Role
+
+	// the role given to users who aren't in any mapped group, RoleNone denies them access
+	DefaultRole Role
+}
+
+// Identity is an authenticated user as asserted by the identity provider
+type Identity struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+	Role    Role
+}
+
+// OIDCProvider performs the authorization code flow against an OpenID Connect provider
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	// unknown key IDs make us refresh our key set, but no more often than this so that tokens with made up key IDs
+	// can't have us hammer the identity provider
+	keyRefresh time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	refreshed time.Time
+}
+
+// NewOIDCProvider loads the discovery document for the configured issuer
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if _, known := roleRank[config.DefaultRole]; !known {
+		return nil, fmt.Errorf("unknown default role %q", config.DefaultRole)
+	}
+
+	p := &OIDCProvider{
+		config:     config,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		keyRefresh: time.Minute,
+		keys:       make(map[string]*rsa.PublicKey),
+	}
+
+	discovery := struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}{}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("error loading oidc discovery document: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(config.Issuer, "/") {
+		return nil, fmt.Errorf("oidc issuer mismatch, expected %q got %q", config.Issuer, discovery.Issuer)
+	}
+
+	p.authURL = discovery.AuthURL
+	p.tokenURL = discovery.TokenURL
+	p.jwksURL = discovery.JWKSURL
+	return p, nil
+}
+
+// AuthCodeURL returns the URL to redirect users to in order to log in
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string) string {
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"scope":         {strings.Join(p.config.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	return p.authURL + "?" + params.Encode()
+}
+
+// Exchange trades the authorization code from the callback for a verified identity
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, nonce string) (*Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("error reading token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 status %d exchanging code: %s", resp.StatusCode, body)
+	}
+
+	token := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("error unmarshalling token response: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	claims, err := p.verifyIDToken(ctx, token.IDToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.Groups = stringsClaim(claims[p.config.GroupsClaim])
+	identity.Role = p.roleForGroups(identity.Groups)
+
+	if identity.Role == RoleNone {
+		return identity, ErrNoRole
+	}
+	return identity, nil
+}
+
+// returns the highest role granted by any of the passed in groups
+func (p *OIDCProvider) roleForGroups(groups []string) Role {
+	role := p.config.DefaultRole
+	for _, group := range groups {
+		if mapped, found := p.config.GroupRoles[group]; found && mapped.Includes(role) {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// verifies the signature and standard claims of an RS256 signed ID token
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := make(map[string]any)
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return nil, fmt.Errorf("id token issuer mismatch: %q", iss)
+	}
+
+	audienceOK := false
+	for _, aud := range stringsClaim(claims["aud"]) {
+		if aud == p.config.ClientID {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("id token audience mismatch")
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0)) {
+		return nil, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+// returns the signing key with the passed in id, refreshing our key set if we don't have it and haven't refreshed it
+// recently
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	if !p.refreshed.IsZero() && time.Since(p.refreshed) < p.keyRefresh {
+		return nil, fmt.Errorf("unknown id token signing key %q", kid)
+	}
+	p.refreshed = time.Now()
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, p.jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("error loading oidc signing keys: %w", err)
+	}
+
+	// keys which have been rotated out of the set are dropped
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+
+	key, found := p.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown id token signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non 200 status %d for %q", resp.StatusCode, url)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(v)
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// claims like aud and groups can be either a single string or a list of strings
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
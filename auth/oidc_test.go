@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// generating keys is slow so every provider signs with the same one
+var testIdPKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// testIdP is an OpenID Connect provider which answers every code with an ID token for a single user
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu          sync.Mutex
+	claims      map[string]any
+	kid         string
+	jwksFetches int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key := testIdPKey()
+	idp := &testIdP{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.jwksFetches++
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code-1" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(t)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	idp.claims = map[string]any{"iss": idp.URL, "aud": "govr", "sub": "user-1", "nonce": "nonce-1", "groups": []string{"viewers"}}
+	return idp
+}
+
+// sets the passed in claims of the ID tokens we issue, nil values removing them
+func (idp *testIdP) set(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	for k, v := range claims {
+		if v == nil {
+			delete(idp.claims, k)
+		} else {
+			idp.claims[k] = v
+		}
+	}
+}
+
+func (idp *testIdP) idToken(t *testing.T) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	claims := map[string]any{"exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": idp.kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *testIdP) provider(t *testing.T) *OIDCProvider {
+	p, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "govr",
+		RedirectURL: "http://govr.local/auth/callback",
+		GroupRoles:  map[string]Role{"viewers": RoleViewer, "admins": RoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider(t)
+
+	tcs := []struct {
+		name   string
+		claims map[string]any
+		code   string
+		role   Role
+		err    error
+	}{
+		{name: "viewer", claims: map[string]any{}, role: RoleViewer},
+		{name: "admin", claims: map[string]any{"groups": []string{"viewers", "admins"}}, role: RoleAdmin},
+		{name: "single group", claims: map[string]any{"groups": "admins"}, role: RoleAdmin},
+		{name: "no mapped group", claims: map[string]any{"groups": []string{"staff"}}, err: ErrNoRole},
+		{name: "no groups", claims: map[string]any{"groups": nil}, err: ErrNoRole},
+		{name: "nonce mismatch", claims: map[string]any{"nonce": "nonce-2"}},
+		{name: "audience mismatch", claims: map[string]any{"aud": []string{"other"}}},
+		{name: "issuer mismatch", claims: map[string]any{"iss": "https://other.example.com"}},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Minute).Unix()}, err: ErrExpiredToken},
+		{name: "invalid code", claims: map[string]any{}, code: "code-2"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.set(tc.claims)
+			p := idp.provider(t)
+
+			identity, err := p.Exchange(context.Background(), cmp.Or(tc.code, "code-1"), "nonce-1")
+			if tc.role == RoleNone {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", identity)
+				}
+				if tc.err != nil && !errors.Is(err, tc.err) {
+					t.Errorf("expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if identity.Subject != "user-1" || identity.Role != tc.role {
+				t.Errorf("expected user-1 as %s, got %+v", tc.role, identity)
+			}
+		})
+	}
+
+	if _, err := NewOIDCProvider(context.Background(), OIDCConfig{Issuer: idp.URL, DefaultRole: "owner"}); err == nil {
+		t.Error("expected error with an unknown default role")
+	}
+	if _, err := p.Exchange(context.Background(), "code-1", "nonce-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestKeyRefresh(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider(t)
+
+	exchange := func(kid string) error {
+		idp.mu.Lock()
+		idp.kid = kid
+		idp.mu.Unlock()
+		_, err := p.Exchange(context.Background(), "code-1", "nonce-1")
+		return err
+	}
+	fetches := func() int {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		return idp.jwksFetches
+	}
+
+	if err := exchange("key-1"); err != nil || fetches() != 1 {
+		t.Fatalf("expected a fetch of the key set, got %d fetches and %v", fetches(), err)
+	}
+	if err := exchange("key-1"); err != nil || fetches() != 1 {
+		t.Errorf("expected known keys to be reused, got %d fetches and %v", fetches(), err)
+	}
+
+	// tokens with made up key IDs don't have us fetch the key set again until a while has passed
+	for range 5 {
+		if err := exchange("key-2"); err == nil {
+			t.Error("expected error with an unknown key")
+		}
+	}
+	if fetches() != 1 {
+		t.Errorf("expected unknown keys to be rate limited, got %d fetches", fetches())
+	}
+
+	p.keyRefresh = 0
+	if err := exchange("key-2"); err == nil || fetches() != 2 {
+		t.Errorf("expected the key set to be refetched, got %d fetches and %v", fetches(), err)
+	}
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookie = "govr_session"
+
+	// holds the state and nonce of a login in progress, only for as long as a user might take to log in
+	loginCookie = "govr_login"
+	loginTTL    = 10 * time.Minute
+)
+
+// Sessions logs users in with an OpenID Connect provider and keeps them logged in with a cookie holding a token signed
+// by us which carries their role
+type Sessions struct {
+	provider *OIDCProvider
+	signer   *Signer
+	ttl      time.Duration
+	secure   bool
+
+	// if set, addresses which keep failing to log in are locked out of the callback for a while
+	Lockout *Lockout
+}
+
+// NewSessions creates sessions lasting ttl for users logged in with the passed in provider, secure should be true
+// whenever we're served over TLS
+func NewSessions(provider *OIDCProvider, signer *Signer, ttl time.Duration, secure bool) *Sessions {
+	return &Sessions{provider: provider, signer: signer, ttl: ttl, secure: secure}
+}
+
+// Role returns the role of the user logged in with the passed in request, RoleNone if there is no valid session
+func (s *Sessions) Role(r *http.Request) Role {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return RoleNone
+	}
+	claims, err := s.signer.Verify(cookie.Value, time.Now())
+	if err != nil || claims.Expires.IsZero() {
+		return RoleNone
+	}
+	role, found := strings.CutPrefix(claims.Scope, "session:")
+	if !found {
+		return RoleNone
+	}
+	if _, known := roleRank[Role(role)]; !known {
+		return RoleNone
+	}
+	return Role(role)
+}
+
+// Require wraps the passed in handler, rejecting any request without a session of at least the passed in role
+func (s *Sessions) Require(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual := s.Role(r)
+		if actual == RoleNone {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if !actual.Includes(role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireBearer wraps the passed in handler, rejecting any request without the passed in bearer token, for clients
+// such as metrics scrapers which can't log in. If set, requests with no bearer token at all are passed to the fallback
+// instead, such as one requiring a session, so that either can be used.
+func RequireBearer(token string, fallback http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found && fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Login redirects users to the identity provider to log in, remembering the state and nonce the callback checks
+func (s *Sessions) Login() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, nonce := randomToken(), randomToken()
+		token, err := s.signer.Sign(Claims{ID: state, Subject: nonce, Scope: "login", Expires: time.Now().Add(loginTTL)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginCookie,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(loginTTL.Seconds()),
+			Secure:   s.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, s.provider.AuthCodeURL(state, nonce), http.StatusFound)
+	})
+}
+
+// Callback completes a login, checking the state matches the login we started and exchanging the code for the user's
+// identity, whose role is kept in a new session
+func (s *Sessions) Callback() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := RemoteIP(r)
+		if s.Lockout != nil {
+			if locked, until := s.Lockout.Locked(ip); locked {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+				http.Error(w, "too many failed logins", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		identity, err := s.callback(w, r)
+		if errors.Is(err, ErrNoRole) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			if s.Lockout != nil {
+				s.Lockout.Fail(ip)
+			}
+			http.Error(w, "login failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if s.Lockout != nil {
+			s.Lockout.Succeed(ip)
+		}
+
+		token, err := s.signer.Sign(Claims{Subject: identity.Subject, Scope: "session:" + string(identity.Role), Expires: time.Now().Add(s.ttl)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     SessionCookie,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(s.ttl.Seconds()),
+			Secure:   s.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+// checks the state of the passed in callback against our login cookie, which is cleared, and exchanges its code
+func (s *Sessions) callback(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1, Secure: s.secure, HttpOnly: true})
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return nil, errors.New(e)
+	}
+
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		return nil, errors.New("no login in progress")
+	}
+	login, err := s.signer.Verify(cookie.Value, time.Now())
+	if err != nil || login.Scope != "login" {
+		return nil, errors.New("no login in progress")
+	}
+	state := query.Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.ID)) != 1 {
+		return nil, errors.New("state mismatch")
+	}
+
+	return s.provider.Exchange(r.Context(), query.Get("code"), login.Subject)
+}
+
+// Logout ends the session of the user making the request
+func (s *Sessions) Logout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, Secure: s.secure, HttpOnly: true})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
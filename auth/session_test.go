@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// returns the cookie with the passed in name set by the passed in response
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	sessions := NewSessions(idp.provider(t), NewSigner([]byte("0123456789abcdef0123456789abcdef")), time.Hour, true)
+
+	w := httptest.NewRecorder()
+	sessions.Login().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the identity provider, got %d", w.Code)
+	}
+	login := responseCookie(w, loginCookie)
+	if login == nil || !login.HttpOnly || !login.Secure {
+		t.Fatalf("expected a secure http only login cookie, got %+v", login)
+	}
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, nonce := redirect.Query().Get("state"), redirect.Query().Get("nonce")
+	if state == "" || nonce == "" || state == nonce {
+		t.Fatalf("expected a distinct state and nonce, got %q and %q", state, nonce)
+	}
+	idp.set(map[string]any{"nonce": nonce})
+
+	other := httptest.NewRecorder()
+	sessions.Login().ServeHTTP(other, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	otherLogin := responseCookie(other, loginCookie)
+
+	tcs := []struct {
+		name   string
+		query  string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "no login cookie", query: "code=code-1&state=" + state, status: http.StatusUnauthorized},
+		{name: "no state", query: "code=code-1", cookie: login, status: http.StatusUnauthorized},
+		{name: "wrong state", query: "code=code-1&state=other", cookie: login, status: http.StatusUnauthorized},
+		{name: "another login's cookie", query: "code=code-1&state=" + state, cookie: otherLogin, status: http.StatusUnauthorized},
+		{name: "error from provider", query: "error=access_denied&state=" + state, cookie: login, status: http.StatusUnauthorized},
+		{name: "invalid code", query: "code=code-2&state=" + state, cookie: login, status: http.StatusUnauthorized},
+		{name: "valid", query: "code=code-1&state=" + state, cookie: login, status: http.StatusFound},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/auth/callback?"+tc.query, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			w := httptest.NewRecorder()
+			sessions.Callback().ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+			if cleared := responseCookie(w, loginCookie); cleared == nil || cleared.MaxAge >= 0 {
+				t.Errorf("expected the login cookie to be cleared, got %+v", cleared)
+			}
+
+			session := responseCookie(w, SessionCookie)
+			if tc.status != http.StatusFound {
+				if session != nil {
+					t.Errorf("expected no session, got %+v", session)
+				}
+				return
+			}
+			if session == nil || !session.HttpOnly || !session.Secure {
+				t.Fatalf("expected a secure http only session cookie, got %+v", session)
+			}
+			r = httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+			r.AddCookie(session)
+			if role := sessions.Role(r); role != RoleViewer {
+				t.Errorf("expected a viewer session, got %q", role)
+			}
+		})
+	}
+
+	// users in no group with access aren't given a session
+	idp.set(map[string]any{"groups": []string{"staff"}})
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=code-1&state="+state, nil)
+	r.AddCookie(login)
+	w = httptest.NewRecorder()
+	sessions.Callback().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || responseCookie(w, SessionCookie) != nil {
+		t.Errorf("expected 403 without a session, got %d", w.Code)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	signer := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	sessions := NewSessions(nil, signer, time.Hour, false)
+
+	session := func(claims Claims) *http.Cookie {
+		token, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: SessionCookie, Value: token}
+	}
+	expires := time.Now().Add(time.Hour)
+	viewer := session(Claims{Subject: "user-1", Scope: "session:viewer", Expires: expires})
+	admin := session(Claims{Subject: "user-1", Scope: "session:admin", Expires: expires})
+
+	tcs := []struct {
+		name   string
+		role   Role
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "viewer as viewer", role: RoleViewer, cookie: viewer, status: http.StatusOK},
+		{name: "admin as viewer", role: RoleViewer, cookie: admin, status: http.StatusOK},
+		{name: "admin as admin", role: RoleAdmin, cookie: admin, status: http.StatusOK},
+		{name: "viewer as admin", role: RoleAdmin, cookie: viewer, status: http.StatusForbidden},
+		{name: "no session", role: RoleViewer, status: http.StatusUnauthorized},
+		{name: "expired", role: RoleViewer, cookie: session(Claims{Scope: "session:admin", Expires: time.Now().Add(-time.Second)}), status: http.StatusUnauthorized},
+		{name: "never expires", role: RoleViewer, cookie: session(Claims{Scope: "session:admin"}), status: http.StatusUnauthorized},
+		{name: "unknown role", role: RoleViewer, cookie: session(Claims{Scope: "session:owner", Expires: expires}), status: http.StatusUnauthorized},
+		{name: "stream token", role: RoleViewer, cookie: session(Claims{Subject: "camera-1", Scope: "stream:hls", Expires: expires}), status: http.StatusUnauthorized},
+		{name: "login", role: RoleViewer, cookie: session(Claims{ID: "state", Scope: "login", Expires: expires}), status: http.StatusUnauthorized},
+		{name: "other key", role: RoleViewer, cookie: &http.Cookie{Name: SessionCookie, Value: func() string {
+			token, _ := NewSigner([]byte("fedcba9876543210fedcba9876543210")).Sign(Claims{Scope: "session:admin", Expires: expires})
+			return token
+		}()}, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h := sessions.Require(tc.role, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestRequireBearer(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+
+	tcs := []struct {
+		name          string
+		fallback      http.Handler
+		authorization string
+		status        int
+	}{
+		{name: "token", authorization: "Bearer scraper-1", status: http.StatusOK},
+		{name: "wrong token", authorization: "Bearer scraper-2", status: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic c2NyYXBlcg==", status: http.StatusUnauthorized},
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "token with fallback", fallback: fallback, authorization: "Bearer scraper-1", status: http.StatusOK},
+		{name: "wrong token with fallback", fallback: fallback, authorization: "Bearer scraper-2", status: http.StatusUnauthorized},
+		{name: "no token with fallback", fallback: fallback, status: http.StatusAccepted},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			RequireBearer("scraper-1", tc.fallback, ok).ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestCallbackLockout(t *testing.T) {
+	idp := newTestIdP(t)
+	sessions := NewSessions(idp.provider(t), NewSigner([]byte("0123456789abcdef0123456789abcdef")), time.Hour, false)
+	sessions.Lockout = NewLockout(2, time.Minute, time.Minute)
+
+	callback := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=code-1&state=guess", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		sessions.Callback().ServeHTTP(w, r)
+		return w
+	}
+
+	for range 2 {
+		if w := callback("192.168.1.20:5000"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for a failed login, got %d", w.Code)
+		}
+	}
+	w := callback("192.168.1.20:5001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with a retry after once locked out, got %d", w.Code)
+	}
+	if w := callback("192.168.1.21:5000"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected other addresses not to be locked out, got %d", w.Code)
+	}
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrShareNotFound   = errors.New("share not found")
+	ErrShareRevoked    = errors.New("share revoked")
+	ErrShareViewsLimit = errors.New("share view limit reached")
+	ErrNotShare        = errors.New("token is not a share")
+)
+
+type ShareKind string
+
+const (
+	ShareLive ShareKind = "live"
+	ShareClip ShareKind = "clip"
+)
+
+// Share is a read-only grant to view a camera's live stream or a single clip without an account
+type Share struct {
+	ID       string    `json:"id"`
+	Kind     ShareKind `json:"kind"`
+	Camera   string    `json:"camera"`
+	Clip     string    `json:"clip,omitempty"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	MaxViews int       `json:"max_views,omitempty"`
+	Views    int       `json:"views"`
+	Revoked  bool      `json:"revoked,omitempty"`
+}
+
+// ShareStore keeps track of issued shares so they can be revoked and view counted
+type ShareStore struct {
+	signer *Signer
+	path   string
+
+	mu     sync.Mutex
+	shares map[string]*Share
+}
+
+// NewShareStore creates a share store which only keeps shares in memory, so they are forgotten when we restart
+func NewShareStore(signer *Signer) *ShareStore {
+	return &ShareStore{
+		signer: signer,
+		shares: make(map[string]*Share),
+	}
+}
+
+// OpenShareStore opens the share store persisted at the passed in path, which is created on the first share, so that
+// revocations and view counts survive restarts
+func OpenShareStore(path string, signer *Signer) (*ShareStore, error) {
+	s := NewShareStore(signer)
+	s.path = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading shares %q: %w", path, err)
+	}
+
+	shares := []*Share{}
+	if err := json.Unmarshal(b, &shares); err != nil {
+		return nil, fmt.Errorf("error unmarshalling shares %q: %w", path, err)
+	}
+	for _, share := range shares {
+		s.shares[share.ID] = share
+	}
+	return s, nil
+}
+
+// Create issues a new share for the passed in camera (and optional clip), returning the share and its token. A
+// maxViews of zero means the share can be viewed any number of times until it expires.
+func (s *ShareStore) Create(kind ShareKind, camera string, clip string, ttl time.Duration, maxViews int) (*Share, string, error) {
+	now := time.Now()
+	share := &Share{
+		ID:       uuid.NewString(),
+		Kind:     kind,
+		Camera:   camera,
+		Clip:     clip,
+		Created:  now,
+		Expires:  now.Add(ttl),
+		MaxViews: maxViews,
+	}
+
+	token, err := s.signer.Sign(Claims{ID: share.ID, Subject: camera, Scope: "share:" + string(kind), Expires: share.Expires})
+	if err != nil {
+		return nil, "", fmt.Errorf("error signing share: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shares[share.ID] = share
+	if err := s.save(); err != nil {
+		delete(s.shares, share.ID)
+		return nil, "", err
+	}
+
+	created := *share
+	return &created, token, nil
+}
+
+// Revoke marks the share with the passed in id as revoked, any further redemptions will fail
+func (s *ShareStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share, found := s.shares[id]
+	if !found {
+		return ErrShareNotFound
+	}
+	share.Revoked = true
+	return s.save()
+}
+
+// List returns a copy of all the shares currently known
+func (s *ShareStore) List() []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shares := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, *share)
+	}
+	return shares
+}
+
+// Redeem validates the passed in token and counts a view against the share it refers to
+func (s *ShareStore) Redeem(token string) (*Share, error) {
+	now := time.Now()
+	claims, err := s.signer.Verify(token, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens signed for anything else, such as streams or sessions, are never shares
+	if claims.ID == "" || !strings.HasPrefix(claims.Scope, "share:") {
+		return nil, ErrNotShare
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share, found := s.shares[claims.ID]
+	if !found {
+		return nil, ErrShareNotFound
+	}
+	if claims.Scope != "share:"+string(share.Kind) || claims.Subject != share.Camera {
+		return nil, ErrNotShare
+	}
+	if share.Revoked {
+		return nil, ErrShareRevoked
+	}
+	if share.MaxViews > 0 && share.Views >= share.MaxViews {
+		return nil, ErrShareViewsLimit
+	}
+	share.Views++
+	if err := s.save(); err != nil {
+		share.Views--
+		return nil, err
+	}
+
+	redeemed := *share
+	return &redeemed, nil
+}
+
+// Prune removes all shares which have expired
+func (s *ShareStore) Prune() error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := false
+	for id, share := range s.shares {
+		if !now.Before(share.Expires) {
+			delete(s.shares, id)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return s.save()
+}
+
+// writes our shares to our path, if we have one, replacing it atomically, must be called with our lock held
+func (s *ShareStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	shares := make([]*Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	b, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling shares: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".shares-*")
+	if err != nil {
+		return fmt.Errorf("error creating shares temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing shares: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing shares: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// ShareURL builds the public URL for a share token relative to the passed in base URL
+func ShareURL(base string, token string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base url %q: %w", base, err)
+	}
+	u = u.JoinPath("share", token)
+	return u.String(), nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShareStore(t *testing.T) {
+	signer := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	path := filepath.Join(t.TempDir(), "shares.json")
+
+	shares, err := OpenShareStore(path, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, liveToken, err := shares.Create(ShareLive, "camera-1", "", time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clipToken, err := shares.Create(ShareClip, "camera-1", "event-1", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := shares.Create(ShareLive, "camera-2", "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.Revoke(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.Revoke("unknown"); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("expected share not found revoking an unknown share, got %v", err)
+	}
+
+	// tokens for anything other than a share, or claiming a different camera or kind, are refused
+	streamToken, _ := signer.StreamToken("camera-1", StreamHLS, time.Minute)
+	otherCamera, _ := signer.Sign(Claims{ID: live.ID, Subject: "camera-2", Scope: "share:live", Expires: live.Expires})
+	otherKind, _ := signer.Sign(Claims{ID: live.ID, Subject: "camera-1", Scope: "share:clip", Expires: live.Expires})
+	unknown, _ := signer.Sign(Claims{ID: "unknown", Subject: "camera-1", Scope: "share:live", Expires: live.Expires})
+
+	// shares are reopened between redemptions so each is checked against what was persisted
+	tcs := []struct {
+		name  string
+		token string
+		views int
+		err   error
+	}{
+		{name: "live", token: liveToken, views: 1},
+		{name: "live again", token: liveToken, views: 2},
+		{name: "live past its views", token: liveToken, err: ErrShareViewsLimit},
+		{name: "clip without a view limit", token: clipToken, views: 1},
+		{name: "revoked", token: revokedToken, err: ErrShareRevoked},
+		{name: "stream token", token: streamToken, err: ErrNotShare},
+		{name: "other camera", token: otherCamera, err: ErrNotShare},
+		{name: "other kind", token: otherKind, err: ErrNotShare},
+		{name: "unknown", token: unknown, err: ErrShareNotFound},
+		{name: "invalid", token: "invalid", err: ErrInvalidToken},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			shares, err := OpenShareStore(path, signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			share, err := shares.Redeem(tc.token)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if share.Views != tc.views {
+				t.Errorf("expected %d views, got %d", tc.views, share.Views)
+			}
+		})
+	}
+}
+
+func TestShareStorePrune(t *testing.T) {
+	signer := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	path := filepath.Join(t.TempDir(), "shares.json")
+
+	shares, err := OpenShareStore(path, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := shares.Create(ShareLive, "camera-1", "", -time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := shares.Create(ShareLive, "camera-1", "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.Prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err = OpenShareStore(path, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := shares.List()
+	if len(listed) != 1 || listed[0].ID != kept.ID {
+		t.Errorf("expected only the unexpired share, got %+v", listed)
+	}
+}
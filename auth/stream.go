@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrTokenScope = errors.New("token not valid for this stream")
+
+type StreamKind string
+
+const (
+	StreamHLS      StreamKind = "hls"
+	StreamWebRTC   StreamKind = "webrtc"
+	StreamSnapshot StreamKind = "snapshot"
+	StreamRTSP     StreamKind = "rtsp"
+)
+
+// StreamTokenParam is the query parameter stream handlers read tokens from
+const StreamTokenParam = "token"
+
+// StreamToken issues a short lived token granting access to a single kind of stream for a single camera
+func (s *Signer) StreamToken(camera string, kind StreamKind, ttl time.Duration) (string, error) {
+	return s.Sign(Claims{Subject: camera, Scope: "stream:" + string(kind), Expires: time.Now().Add(ttl)})
+}
+
+// VerifyStreamToken checks that the passed in token is valid for the passed in camera and stream kind
+func (s *Signer) VerifyStreamToken(token string, camera string, kind StreamKind) error {
+	claims, err := s.Verify(token, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// tokens without an expiration are never valid for streams, they must be short lived
+	if claims.Expires.IsZero() {
+		return ErrInvalidToken
+	}
+	if claims.Subject != camera || claims.Scope != "stream:"+string(kind) {
+		return ErrTokenScope
+	}
+	return nil
+}
+
+// RequireStreamToken wraps a streaming handler, rejecting any request without a valid token for the camera returned
+// by the camera func
+func (s *Signer) RequireStreamToken(kind StreamKind, camera func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(StreamTokenParam)
+		if token == "" {
+			http.Error(w, "missing stream token", http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.VerifyStreamToken(token, camera(r), kind); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
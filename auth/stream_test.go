@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireStreamToken(t *testing.T) {
+	signer := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+
+	token := func(claims Claims) string {
+		token, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	hls, _ := signer.StreamToken("camera-1", StreamHLS, time.Minute)
+	webrtc, _ := signer.StreamToken("camera-1", StreamWebRTC, time.Minute)
+	otherCamera, _ := signer.StreamToken("camera-2", StreamHLS, time.Minute)
+
+	tcs := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "valid", token: hls, status: http.StatusOK},
+		{name: "missing", token: "", status: http.StatusUnauthorized},
+		{name: "other kind", token: webrtc, status: http.StatusForbidden},
+		{name: "other camera", token: otherCamera, status: http.StatusForbidden},
+		{name: "never expires", token: token(Claims{Subject: "camera-1", Scope: "stream:hls"}), status: http.StatusForbidden},
+		{name: "expired", token: token(Claims{Subject: "camera-1", Scope: "stream:hls", Expires: time.Now().Add(-time.Second)}), status: http.StatusForbidden},
+		{name: "share", token: token(Claims{ID: "1", Subject: "camera-1", Scope: "share:live", Expires: time.Now().Add(time.Minute)}), status: http.StatusForbidden},
+		{name: "invalid", token: "invalid", status: http.StatusForbidden},
+	}
+
+	camera := func(r *http.Request) string {
+		camera, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		return camera
+	}
+	h := signer.RequireStreamToken(StreamHLS, camera, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/camera-1/index.m3u8?"+StreamTokenParam+"="+tc.token, nil))
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	signer := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	other := NewSigner([]byte("fedcba9876543210fedcba9876543210"))
+
+	sign := func(s *Signer, claims Claims) string {
+		token, err := s.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(signer, Claims{ID: "1", Subject: "camera-1", Scope: "stream:hls", Expires: now.Add(time.Minute)})
+	payload, sig, _ := strings.Cut(valid, ".")
+
+	tcs := []struct {
+		name    string
+		token   string
+		subject string
+		err     error
+	}{
+		{name: "valid", token: valid, subject: "camera-1"},
+		{name: "without expiry", token: sign(signer, Claims{Subject: "camera-2"}), subject: "camera-2"},
+		{name: "expired", token: sign(signer, Claims{Subject: "camera-1", Expires: now}), err: ErrExpiredToken},
+		{name: "other key", token: sign(other, Claims{Subject: "camera-1", Expires: now.Add(time.Minute)}), err: ErrInvalidToken},
+		{name: "tampered payload", token: payload[:len(payload)-2] + "AA." + sig, err: ErrInvalidToken},
+		{name: "tampered signature", token: payload + "." + sig[:len(sig)-2] + "AA", err: ErrInvalidToken},
+		{name: "no signature", token: payload, err: ErrInvalidToken},
+		{name: "invalid base64", token: "!!." + sig, err: ErrInvalidToken},
+		{name: "empty", token: "", err: ErrInvalidToken},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := signer.Verify(tc.token, now)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claims.Subject != tc.subject {
+				t.Errorf("expected subject %s, got %s", tc.subject, claims.Subject)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "signing.key")
+
+	key, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keyLength {
+		t.Errorf("expected a %d byte key, got %d bytes", keyLength, len(key))
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a key only we can read, got %v %v", info, err)
+	}
+
+	again, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Error("expected the same key when loaded again")
+	}
+
+	short := filepath.Join(dir, "short.key")
+	os.WriteFile(short, []byte("secret"), 0600)
+	if _, err := LoadKey(short); err == nil {
+		t.Error("expected error loading a short key")
+	}
+}
@@ -0,0 +1,229 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/record"
+)
+
+// errNoFootage is returned when a replay has nothing within the span we asked for, such as for cameras which only
+// record to their storage on motion
+var errNoFootage = errors.New("camera has no footage for this span")
+
+// Device is the Profile G side of a camera, as implemented by onvif.Device
+type Device interface {
+	FindRecordings(log *slog.Logger, sourceTokens ...string) ([]onvif.Recording, error)
+	GetReplayURI(log *slog.Logger, recordingToken string) (string, error)
+}
+
+// Config configures backfilling of a single camera
+type Config struct {
+	// the camera whose gaps we fill, its device and the credentials to replay its recordings with
+	Camera   string
+	Device   Device
+	Username string
+	Password string
+
+	// the recording directory segments are placed in and the index of what is already there
+	Dir   string
+	Index *record.Index
+
+	// how far back to look for gaps and how often, gaps more recent than settle are left alone as the recorder may
+	// be about to fill them, and gaps shorter than min gap aren't worth a replay
+	Window   time.Duration
+	Interval time.Duration
+	Settle   time.Duration
+	MinGap   time.Duration
+
+	// how long each backfilled segment is at most, each is a replay of its own
+	Chunk time.Duration
+
+	// how many times faster than real time we relay footage to ffmpeg, cameras send replays as fast as they can
+	Speed float64
+
+	// how long to wait for the camera to answer
+	Timeout time.Duration
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+}
+
+// Backfiller finds gaps in the recording of a camera, such as while we were down or it was unreachable, and fills
+// them with footage replayed from the camera's own storage
+type Backfiller struct {
+	log *slog.Logger
+	cfg Config
+
+	// if set, called with each segment once it is in place
+	OnSegment func(record.Segment)
+
+	// gaps the camera had no footage for, which we don't ask about again
+	unfillable map[record.Gap]bool
+}
+
+func NewBackfiller(log *slog.Logger, cfg Config) (*Backfiller, error) {
+	if cfg.Camera == "" || cfg.Device == nil || cfg.Index == nil {
+		return nil, errors.New("backfilling needs a camera, its device and a recording index")
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 24 * time.Hour
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Minute
+	}
+	if cfg.Settle <= 0 {
+		cfg.Settle = 5 * time.Minute
+	}
+	if cfg.MinGap <= 0 {
+		cfg.MinGap = 10 * time.Second
+	}
+	if cfg.Chunk <= 0 {
+		cfg.Chunk = 5 * time.Minute
+	}
+	if cfg.Speed <= 0 {
+		cfg.Speed = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+
+	return &Backfiller{
+		log:        log.With("subsystem", "backfill", "camera", cfg.Camera),
+		cfg:        cfg,
+		unfillable: make(map[record.Gap]bool),
+	}, nil
+}
+
+// Run looks for gaps to fill now and then on our interval until the passed in context is done
+func (b *Backfiller) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.fill(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			b.log.Error("error backfilling", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fills what we can of the gaps within our window as of the passed in time
+func (b *Backfiller) fill(ctx context.Context, now time.Time) error {
+	gaps := []record.Gap{}
+	for _, gap := range b.cfg.Index.Gaps(b.cfg.Camera, now.Add(-b.cfg.Window), now.Add(-b.cfg.Settle)) {
+		if gap.End.Sub(gap.Start) >= b.cfg.MinGap && !b.unfillable[gap] {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	recordings, err := b.cfg.Device.FindRecordings(b.log)
+	if err != nil {
+		return err
+	}
+
+	for _, gap := range gaps {
+		if ctx.Err() != nil {
+			return nil
+		}
+		filled, failed := false, false
+		for _, r := range recordings {
+			from, to := spanOf(r)
+			from, to = later(from, gap.Start), earlier(to, gap.End)
+			if to.Sub(from) < b.cfg.MinGap {
+				continue
+			}
+
+			n, err := b.replay(ctx, r.Token, from, to)
+			if err != nil {
+				failed = true
+				b.log.Warn("error backfilling gap", slog.Time("start", from), slog.Time("end", to), slog.String("error", err.Error()))
+			}
+			filled = filled || n > 0
+		}
+
+		// gaps which can't be filled just yet are tried again next time
+		if !filled && !failed {
+			b.unfillable[gap] = true
+		}
+	}
+	return nil
+}
+
+// replays the recording with the passed in token between the passed in times into segments, a chunk at a time,
+// returning how many segments were placed
+func (b *Backfiller) replay(ctx context.Context, token string, from, to time.Time) (int, error) {
+	uri, err := b.cfg.Device.GetReplayURI(b.log, token)
+	if err != nil {
+		return 0, err
+	}
+	url, err := creds.NewURL(uri, b.cfg.Username, b.cfg.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	placed := 0
+	for start := from; to.Sub(start) >= b.cfg.MinGap && ctx.Err() == nil; {
+		end := earlier(start.Add(b.cfg.Chunk), to)
+		segment, err := b.download(ctx, url, start, end)
+		if errors.Is(err, errNoFootage) {
+			return placed, nil
+		}
+		if err != nil {
+			return placed, err
+		}
+
+		placed++
+		b.log.Info("backfilled segment", slog.Time("start", segment.Start), slog.Time("end", segment.End))
+		if b.OnSegment != nil {
+			b.OnSegment(segment)
+		}
+
+		// replays start on the keyframe before where we asked so the next chunk picks up from where this one ended
+		if !segment.End.After(start) {
+			return placed, fmt.Errorf("replay from %s didn't move on", start.Format(time.RFC3339))
+		}
+		start = segment.End
+	}
+	return placed, nil
+}
+
+// returns the span of time a recording holds, that of its video track if it has one
+func spanOf(r onvif.Recording) (time.Time, time.Time) {
+	for _, t := range r.Tracks {
+		if t.Type == "Video" && !t.To.IsZero() {
+			return t.From, t.To
+		}
+	}
+	return r.Earliest, r.Latest
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,207 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// how long ffmpeg is given to open its ports before we start relaying, the camera waits for us meanwhile
+const ffmpegStartup = time.Second
+
+// downloads the footage between the passed in times from the replay at the passed in URL into a segment. ffmpeg
+// can't send the headers a replay needs so we play it ourselves, relaying its RTP over loopback UDP to an ffmpeg
+// reading an SDP which describes the same streams.
+func (b *Backfiller) download(ctx context.Context, url *creds.URL, from, to time.Time) (record.Segment, error) {
+	playback, err := rtsp.OpenReplay(url.Secret(), b.cfg.Timeout, from)
+	if err != nil {
+		return record.Segment{}, err
+	}
+	defer playback.Close()
+
+	ports, err := freePorts(len(playback.Media))
+	if err != nil {
+		return record.Segment{}, err
+	}
+	conns := make([]*net.UDPConn, 0, 2*len(ports))
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for _, port := range ports {
+		for _, p := range []int{port, port + 1} {
+			c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p})
+			if err != nil {
+				return record.Segment{}, fmt.Errorf("error dialing ffmpeg: %w", err)
+			}
+			conns = append(conns, c)
+		}
+	}
+
+	dir := filepath.Join(b.cfg.Dir, b.cfg.Camera)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return record.Segment{}, fmt.Errorf("error creating recording directory: %w", err)
+	}
+
+	// hidden until complete, as the recorder's partial directory is its own
+	tmp := filepath.Join(dir, "."+strconv.FormatInt(from.Unix(), 10)+".backfill")
+	defer os.Remove(tmp)
+	sdp := tmp + ".sdp"
+	if err := os.WriteFile(sdp, []byte(localSDP(playback.SDP, ports)), 0644); err != nil {
+		return record.Segment{}, fmt.Errorf("error writing sdp: %w", err)
+	}
+	defer os.Remove(sdp)
+
+	ffmpegCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	cmd := exec.CommandContext(ffmpegCtx, b.cfg.FFmpegPath, "-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-protocol_whitelist", "file,udp,rtp", "-i", sdp, "-map", "0", "-c", "copy", "-f", "matroska", tmp)
+
+	// ffmpeg never sees the end of a UDP stream, so is interrupted once we're done which has it finish the file
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return record.Segment{}, fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(ffmpegStartup):
+	}
+	start, end, relayErr := b.relay(ctx, playback, conns, to)
+
+	stop()
+	cmd.Wait()
+	if relayErr != nil {
+		return record.Segment{}, relayErr
+	}
+	if start.IsZero() {
+		return record.Segment{}, errNoFootage
+	}
+	if info, err := os.Stat(tmp); err != nil || info.Size() == 0 {
+		return record.Segment{}, fmt.Errorf("ffmpeg wrote nothing: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return record.PlaceSegment(b.cfg.Dir, b.cfg.Camera, tmp, "."+record.FormatMKV, start, end)
+}
+
+// relays packets of the passed in replay to the passed in connections, those of each media's RTP and RTCP in turn,
+// until they were recorded at or after the passed in time or the replay ends. Packets are paced at our speed by when
+// they were recorded, returning the times of the first and last.
+func (b *Backfiller) relay(ctx context.Context, playback *rtsp.Playback, conns []*net.UDPConn, to time.Time) (time.Time, time.Time, error) {
+	var first, last time.Time
+	var began time.Time
+	for ctx.Err() == nil {
+		channel, packet, err := playback.ReadPacket()
+		if err != nil {
+			// cameras end the session when they run out of footage
+			if !first.IsZero() {
+				return first, last, nil
+			}
+			return first, last, err
+		}
+		if channel >= len(conns) {
+			continue
+		}
+
+		if channel%2 == 0 {
+			if at, found := rtsp.ReplayTime(packet); found {
+				if !at.Before(to) {
+					return first, last, nil
+				}
+				if first.IsZero() {
+					first, began = at, time.Now()
+				}
+				last = at
+
+				due := began.Add(time.Duration(float64(at.Sub(first)) / b.cfg.Speed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-ctx.Done():
+					case <-time.After(wait):
+					}
+				}
+			}
+		}
+
+		// ffmpeg just drops what it can't make sense of, so there's nothing to be done about a failed write
+		conns[channel].Write(packet)
+	}
+	return first, last, ctx.Err()
+}
+
+// returns the passed in SDP with its audio and video media, those a playback sets up, sent to the passed in local
+// ports in turn with RTCP on the port after each, and any other media left out
+func localSDP(sdp string, ports []int) string {
+	lines := []string{}
+	media, skipping := 0, false
+	for _, line := range strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		key, value, _ := strings.Cut(line, "=")
+		switch {
+		case line == "":
+			continue
+		case key == "m":
+			fields := strings.Fields(value)
+			skipping = len(fields) < 3 || (fields[0] != "video" && fields[0] != "audio") || media >= len(ports)
+			if skipping {
+				continue
+			}
+			fields[1], fields[2] = strconv.Itoa(ports[media]), "RTP/AVP"
+			media++
+			lines = append(lines, "m="+strings.Join(fields, " "), "c=IN IP4 127.0.0.1")
+			continue
+		case skipping:
+			continue
+		case key == "c" || (key == "a" && (strings.HasPrefix(value, "control:") || strings.HasPrefix(value, "range:"))):
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// returns the passed in number of pairs of free local UDP ports, the first of each even as RTP expects
+func freePorts(n int) ([]int, error) {
+	ports := []int{}
+	for attempt := 0; len(ports) < n && attempt < 20*n; attempt++ {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("error finding free ports: %w", err)
+		}
+		port := c.LocalAddr().(*net.UDPAddr).Port &^ 1
+		c.Close()
+
+		free := !slices.Contains(ports, port)
+		for _, p := range []int{port, port + 1} {
+			c, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(p))
+			if err != nil {
+				free = false
+				break
+			}
+			c.Close()
+		}
+		if free {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) < n {
+		return nil, fmt.Errorf("unable to find %d free port pairs", n)
+	}
+	return ports, nil
+}
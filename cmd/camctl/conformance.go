@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/incrementventures/govr/conformance"
+	"github.com/incrementventures/govr/scan"
+	"github.com/lmittmann/tint"
+	"github.com/nyaruka/ezconf"
+)
+
+type ConformanceConfig struct {
+	Address  string     `help:"the camera to test, an IP, host:port or device service URL"`
+	Username string     `help:"the username to connect with"`
+	Password string     `help:"the password to connect with"`
+	JSON     bool       `help:"whether to write the report as JSON rather than a table"`
+	Level    slog.Level `help:"the log level to use (optional)"`
+}
+
+func runConformance() {
+	config := &ConformanceConfig{
+		Level: slog.LevelWarn,
+	}
+	loader := ezconf.NewLoader(
+		config,
+		"camctl-conformance", "camctl conformance - exercise the main ONVIF operations against a camera and report what works",
+		[]string{},
+	)
+	loader.MustLoad()
+
+	log := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: config.Level}))
+
+	address, err := scan.DeviceServiceURL(config.Address)
+	if err != nil {
+		log.Error("invalid address", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if u, _ := url.Parse(address); u.Path == "" {
+		address += "/onvif/device_service"
+	}
+
+	report := conformance.Run(log, address, config.Username, config.Password)
+
+	if config.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		info := report.DeviceInformation
+		fmt.Printf("%s %s %s (firmware %s)\n\n", address, info.Manufacturer, info.Model, info.FirmwareVersion)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tOPERATION\tSTATUS\tTIME\tDETAIL")
+		for _, c := range report.Checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Service, c.Operation, c.Status, c.Duration.Round(time.Millisecond), c.Detail)
+		}
+		w.Flush()
+
+		counts := report.Counts()
+		fmt.Printf("\n%d passed, %d failed, %d faulted, %d skipped\n",
+			counts[conformance.StatusPass], counts[conformance.StatusFail], counts[conformance.StatusFault], counts[conformance.StatusSkipped])
+	}
+
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func()
+}
+
+var commands = []command{
+	{"conformance", "exercise the main ONVIF operations against a camera and report what works", runConformance},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			// remove the command name so that config loading only sees its flags
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			c.run()
+			return
+		}
+	}
+	usage()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: camctl <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.description)
+	}
+	os.Exit(1)
+}
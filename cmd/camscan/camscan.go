@@ -1,25 +1,77 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/onvif"
 	"github.com/incrementventures/govr/scan"
 	"github.com/lmittmann/tint"
 	"github.com/nyaruka/ezconf"
 )
 
 type Config struct {
-	Port     int        `help:"the port to use when connecting to cameras"`
-	Username string     `help:"the username to use when connecting to cameras (optional)"`
-	Password string     `help:"the password to use when connecting to cameras (optional)"`
-	Level    slog.Level `help:"the log level to use (optional)"`
+	Ports               string     `help:"comma separated ports to scan for cameras"`
+	Username            string     `help:"the username to use when connecting to cameras (optional)"`
+	Password            string     `help:"the password to use when connecting to cameras (optional)"`
+	Credentials         string     `help:"comma separated username:password pairs to try in addition to username and password (optional)"`
+	Level               slog.Level `help:"the log level to use (optional)"`
+	Output              string     `help:"the format to print found devices to stdout in, one of json, yaml, csv or table, otherwise they are only logged (optional)"`
+	Probe               string     `help:"comma separated IPs or CIDRs to send unicast discovery probes to (optional)"`
+	DiscoveryGroup      string     `help:"the IPv4 multicast group to send ws-discovery probes to, defaults to 239.255.255.250 (optional)"`
+	DiscoveryGroup6     string     `help:"the IPv6 multicast group to send ws-discovery probes to, defaults to ff02::c (optional)"`
+	DiscoveryPort       int        `help:"the port to send ws-discovery probes to, defaults to 3702 (optional)"`
+	DiscoverySourcePort int        `help:"the port to send ws-discovery probes from, for ACLs which only allow a specific port, defaults to any (optional)"`
+	Discovery           bool       `help:"whether to find cameras using ws-discovery"`
+	SSDP                bool       `help:"whether to find cameras that answer ssdp searches"`
+	MDNS                bool       `help:"whether to find cameras announcing themselves via mdns"`
+	RTSPScan            bool       `help:"whether to also find cameras exposing RTSP without ONVIF"`
+	FFprobe             bool       `help:"whether to fall back to ffprobe for streams that can't be described natively"`
+	FFprobePath         string     `help:"the ffprobe binary to fall back to, defaults to GOVR_FFPROBE_PATH or ffprobe on our path (optional)"`
+	ARPSweep            bool       `help:"whether to only port scan hosts which answer an arp sweep"`
+	PortScan            bool       `help:"whether to find cameras by scanning for open ports"`
+	Ping                bool       `help:"whether to ping sweep networks to port scan responsive hosts first and measure device latency"`
+	TimeoutMS           int        `help:"milliseconds to wait for each host when port scanning"`
+	Workers             int        `help:"how many hosts to port scan in parallel"`
+	Probers             int        `help:"how many candidate devices to probe in parallel"`
+	MaxHosts            int        `help:"networks with more hosts than this are not port scanned unless included, at most 65536"`
+	Rate                int        `help:"maximum packets per second to send when sweeping and port scanning, 0 for unlimited"`
+	Include             string     `help:"comma separated CIDRs to port scan in addition to local networks (optional)"`
+	Device              string     `help:"comma separated device addresses to probe directly, skipping discovery (optional)"`
+	Fixtures            string     `help:"a directory of canned discovery and device responses to scan instead of the network (optional)"`
+	Store               string     `help:"directory to save scan results to and compare against the previous scan (optional)"`
+	Exclude             string     `help:"comma separated IPs or CIDRs never to touch while scanning (optional)"`
+	Allow               string     `help:"comma separated IPs or CIDRs which, if set, are the only ones touched while scanning (optional)"`
+	Interfaces          string     `help:"comma separated interfaces to scan from, such as eth0.20 for VLAN 20 on eth0, defaults to all (optional)"`
+	VLANs               string     `help:"comma separated VLAN interfaces to create for the scan with their address, such as eth0.20=192.168.20.250/24, needs root (optional)"`
 }
 
 func main() {
+	defaults := scan.DefaultOptions()
 	config := &Config{
-		Port:  80,
-		Level: slog.LevelInfo,
+		Ports:     joinInts(defaults.Ports),
+		Level:     slog.LevelInfo,
+		Discovery: defaults.WSDiscovery,
+		PortScan:  defaults.PortScan,
+		ARPSweep:  defaults.ARPSweep,
+		Ping:      defaults.PingSweep,
+		RTSPScan:  defaults.RTSPScan,
+		FFprobe:   defaults.FFprobe,
+		MDNS:      defaults.MDNS,
+		SSDP:      defaults.SSDP,
+		TimeoutMS: int(defaults.DialTimeout / time.Millisecond),
+		Workers:   defaults.Workers,
+		Probers:   defaults.ProbeWorkers,
+		MaxHosts:  defaults.MaxHostsPerNetwork,
+		Rate:      defaults.ScanRate,
 	}
 	// create our loader object, configured with configuration struct (must be a pointer), our name
 	// and description, as well as any files we want to search for
@@ -32,8 +84,231 @@ func main() {
 
 	log := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: config.Level}))
 
-	_, err := scan.GetDevicesOnNetwork(log, config.Port, config.Username, config.Password)
+	if config.Output != "" && !slices.Contains(outputFormats, config.Output) {
+		panic(fmt.Errorf("unknown output format %q, must be one of %s", config.Output, strings.Join(outputFormats, ", ")))
+	}
+
+	ports, err := parseInts(config.Ports)
+	if err != nil {
+		panic(err)
+	}
+
+	credentials := []scan.Credential{}
+	if config.Username != "" {
+		credentials = append(credentials, scan.Credential{Username: config.Username, Password: config.Password})
+	}
+	for _, pair := range splitList(config.Credentials) {
+		username, password, _ := strings.Cut(pair, ":")
+		credentials = append(credentials, scan.Credential{Username: username, Password: password})
+	}
+
+	vlans := []network.VLAN{}
+	for _, v := range splitList(config.VLANs) {
+		vlan, err := network.ParseVLAN(v)
+		if err != nil {
+			panic(err)
+		}
+		vlans = append(vlans, vlan)
+	}
+
+	discovery := onvif.DiscoveryConfig{Group: config.DiscoveryGroup, Group6: config.DiscoveryGroup6, Port: config.DiscoveryPort, SourcePort: config.DiscoverySourcePort}
+	if err := discovery.Validate(); err != nil {
+		panic(err)
+	}
+
+	opts := scan.Options{
+		Credentials:        credentials,
+		WSDiscovery:        config.Discovery,
+		PortScan:           config.PortScan,
+		ARPSweep:           config.ARPSweep,
+		ARPWait:            defaults.ARPWait,
+		PingSweep:          config.Ping,
+		PingTimeout:        defaults.PingTimeout,
+		RTSPScan:           config.RTSPScan,
+		MDNS:               config.MDNS,
+		SSDP:               config.SSDP,
+		SSDPDeviceTypes:    defaults.SSDPDeviceTypes,
+		SSDPTimeout:        defaults.SSDPTimeout,
+		MDNSTimeout:        defaults.MDNSTimeout,
+		RTSPPorts:          defaults.RTSPPorts,
+		RTSPPaths:          defaults.RTSPPaths,
+		RTSPTimeout:        defaults.RTSPTimeout,
+		RTSPStrategies:     defaults.RTSPStrategies,
+		FFprobe:            config.FFprobe,
+		Prober:             &ffmpeg.Prober{BinaryPath: config.FFprobePath},
+		Ports:              ports,
+		DialTimeout:        time.Duration(config.TimeoutMS) * time.Millisecond,
+		Workers:            config.Workers,
+		ProbeWorkers:       config.Probers,
+		StreamWorkers:      defaults.StreamWorkers,
+		MaxHostsPerNetwork: config.MaxHosts,
+		ScanRate:           config.Rate,
+		IncludeCIDRs:       toCIDRs(splitList(config.Include)),
+		ExcludeCIDRs:       toCIDRs(splitList(config.Exclude)),
+		AllowCIDRs:         toCIDRs(splitList(config.Allow)),
+		ProbeTargets:       splitList(config.Probe),
+		Interfaces:         toIFaces(splitList(config.Interfaces)),
+		VLANs:              vlans,
+		Discovery:          discovery,
+	}
+
+	if config.Fixtures != "" {
+		fixtures, err := scan.NewFixtures(config.Fixtures)
+		if err != nil {
+			panic(err)
+		}
+		opts.Fixtures = fixtures
+	}
+
+	// if we were given devices, probe just those
+	if devices := splitList(config.Device); len(devices) > 0 {
+		results := []scan.DeviceResult{}
+		for _, device := range devices {
+			result, err := scan.ProbeDevice(log, device, opts)
+			if err != nil {
+				log.Error("unable to probe device", slog.String("device", device), slog.String("error", err.Error()))
+				continue
+			}
+			results = append(results, *result)
+		}
+		printResults(config.Output, results)
+		return
+	}
+
+	results := []scan.DeviceResult{}
+	summary, err := scan.Scan(context.Background(), log, opts, func(result scan.DeviceResult) {
+		results = append(results, result)
+	})
+	if err != nil {
+		panic(err)
+	}
+	scan.SortResults(results)
+
+	if config.Ping {
+		for _, result := range results {
+			if result.Latency > 0 {
+				log.Info("device latency", slog.String("address", resultAddress(result)), slog.Duration("latency", result.Latency))
+			}
+		}
+	}
+
+	if config.Store != "" {
+		if err := saveAndDiff(log, config.Store, summary.Started, results); err != nil {
+			panic(err)
+		}
+	}
+
+	// devices we couldn't probe but whose vendor we know are most likely cameras we don't have credentials for
+	for _, failure := range summary.Failures {
+		if failure.Vendor != "" {
+			log.Warn("unable to probe device",
+				slog.String("candidate", failure.Candidate),
+				slog.String("mac", failure.MAC),
+				slog.String("vendor", failure.Vendor),
+				slog.String("error", failure.Error))
+		}
+	}
+
+	printResults(config.Output, results)
+
+	log.Info("scan complete",
+		slog.Int("candidates", summary.Candidates),
+		slog.Int("found", summary.Found),
+		slog.Int("rtsp_sources", summary.StreamSources),
+		slog.Int("failures", len(summary.Failures)),
+		slog.Duration("duration", summary.Duration))
+}
+
+// saves the results of this scan to the store and logs what changed since the previous scan
+func saveAndDiff(log *slog.Logger, dir string, started time.Time, results []scan.DeviceResult) error {
+	store, err := scan.NewStore(dir)
+	if err != nil {
+		return err
+	}
+
+	previous, err := store.Latest()
 	if err != nil {
+		return err
+	}
+
+	current := scan.NewSnapshot(started, results)
+	if err := store.Save(current); err != nil {
+		return err
+	}
+
+	diff := scan.DiffSnapshots(previous, current)
+	for _, r := range diff.New {
+		log.Info("new device", slog.String("key", r.Key), slog.String("address", r.Address))
+	}
+	for _, r := range diff.Missing {
+		log.Warn("missing device", slog.String("key", r.Key), slog.String("address", r.Address))
+	}
+	for _, c := range diff.Changed {
+		log.Info("changed device", slog.String("key", c.Key), slog.String("field", c.Field), slog.String("old", c.Old), slog.String("new", c.New))
+	}
+	return nil
+}
+
+// prints the passed in results to stdout in the passed in format, doing nothing if it is empty
+func printResults(format string, results []scan.DeviceResult) {
+	if format == "" {
+		return
+	}
+	if err := writeResults(os.Stdout, format, results); err != nil {
 		panic(err)
 	}
 }
+
+// returns the address of the device or stream source in the passed in result
+func resultAddress(result scan.DeviceResult) string {
+	if result.Device != nil {
+		return result.Device.Address
+	}
+	return result.Source.Address
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func toCIDRs(items []string) []network.CIDR {
+	cidrs := make([]network.CIDR, len(items))
+	for i, item := range items {
+		cidrs[i] = network.CIDR(item)
+	}
+	return cidrs
+}
+
+func toIFaces(items []string) []network.IFace {
+	ifaces := make([]network.IFace, len(items))
+	for i, item := range items {
+		ifaces[i] = network.IFace(item)
+	}
+	return ifaces
+}
+
+func parseInts(s string) ([]int, error) {
+	ints := []int{}
+	for _, item := range splitList(s) {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q: %w", item, err)
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
+
+func joinInts(ints []int) string {
+	items := make([]string, len(ints))
+	for i, v := range ints {
+		items[i] = strconv.Itoa(v)
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/incrementventures/govr/scan"
+	"gopkg.in/yaml.v3"
+)
+
+// the formats we can print scan results to stdout in, none only logs them
+var outputFormats = []string{"json", "yaml", "csv", "table"}
+
+// device is a single device found by a scan as we print it
+type device struct {
+	Key          string  `json:"key" yaml:"key"`
+	Address      string  `json:"address" yaml:"address"`
+	MAC          string  `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Vendor       string  `json:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Manufacturer string  `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty"`
+	Model        string  `json:"model,omitempty" yaml:"model,omitempty"`
+	Firmware     string  `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	Serial       string  `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Hardware     string  `json:"hardware,omitempty" yaml:"hardware,omitempty"`
+	Endpoint     string  `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Username     string  `json:"username,omitempty" yaml:"username,omitempty"`
+	LatencyMS    float64 `json:"latency_ms,omitempty" yaml:"latency_ms,omitempty"`
+
+	// whether the device speaks ONVIF, devices found by RTSP scanning have a single profile for the stream we found
+	ONVIF    bool      `json:"onvif" yaml:"onvif"`
+	Profiles []profile `json:"profiles" yaml:"profiles"`
+	Failures []string  `json:"failures,omitempty" yaml:"failures,omitempty"`
+}
+
+// profile is a media profile of a device and the stream it gives us
+type profile struct {
+	Token    string   `json:"token,omitempty" yaml:"token,omitempty"`
+	Name     string   `json:"name,omitempty" yaml:"name,omitempty"`
+	URI      string   `json:"uri" yaml:"uri"`
+	Encoding string   `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	Width    int      `json:"width,omitempty" yaml:"width,omitempty"`
+	Height   int      `json:"height,omitempty" yaml:"height,omitempty"`
+	FPS      float64  `json:"fps,omitempty" yaml:"fps,omitempty"`
+	Codecs   []string `json:"codecs,omitempty" yaml:"codecs,omitempty"`
+}
+
+// builds the devices we print from the passed in scan results
+func newDevices(results []scan.DeviceResult) []device {
+	devices := make([]device, 0, len(results))
+	for _, result := range results {
+		r := scan.NewRecord(result)
+		d := device{
+			Key:          r.Key,
+			Address:      r.Address,
+			MAC:          r.MAC,
+			Vendor:       r.Vendor,
+			Manufacturer: r.Manufacturer,
+			Model:        r.Model,
+			Firmware:     r.Firmware,
+			Serial:       r.Serial,
+			Hardware:     r.Hardware,
+			Endpoint:     r.Endpoint,
+			Username:     result.Credential.Username,
+			LatencyMS:    float64(result.Latency.Microseconds()) / 1000,
+			ONVIF:        result.Device != nil,
+			Profiles:     []profile{},
+		}
+
+		if result.Device != nil {
+			for _, p := range result.Device.Profiles {
+				out := profile{Token: p.Token, Name: p.Name, URI: p.URI}
+				if enc := p.VideoEncoderConfiguration; enc != nil {
+					out.Encoding = enc.Encoding
+					out.Width, out.Height = enc.Resolution.Width, enc.Resolution.Height
+				}
+				for _, s := range p.Streams {
+					out.Codecs = append(out.Codecs, s.CodecName)
+					if s.CodecType == "video" {
+						if s.Width > 0 {
+							out.Width, out.Height = s.Width, s.Height
+						}
+						if !s.FrameRate.IsZero() {
+							out.FPS = math.Round(s.FrameRate.FPS()*100) / 100
+						}
+					}
+				}
+				d.Profiles = append(d.Profiles, out)
+			}
+		} else if result.Source != nil {
+			d.Profiles = append(d.Profiles, profile{URI: result.Source.URL})
+		}
+
+		for _, f := range result.Failures {
+			d.Failures = append(d.Failures, fmt.Sprintf("%s: %s", f.Stage, f.Error))
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// writes the passed in scan results to w in the passed in format
+func writeResults(w io.Writer, format string, results []scan.DeviceResult) error {
+	devices := newDevices(results)
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(devices)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(devices); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "csv":
+		return writeCSV(w, devices)
+	case "table":
+		return writeTable(w, devices)
+	}
+	return fmt.Errorf("unknown output format %q, must be one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+// writes a row for each stream of each device, devices without any streams still get a row of their own
+func writeCSV(w io.Writer, devices []device) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"key", "address", "mac", "vendor", "manufacturer", "model", "firmware", "serial", "onvif", "username",
+		"profile", "profile_name", "uri", "encoding", "width", "height", "fps", "codecs",
+	})
+	for _, d := range devices {
+		for _, p := range profilesOf(d) {
+			out.Write([]string{
+				d.Key, d.Address, d.MAC, d.Vendor, d.Manufacturer, d.Model, d.Firmware, d.Serial,
+				strconv.FormatBool(d.ONVIF), d.Username, p.Token, p.Name, p.URI, p.Encoding, formatInt(p.Width),
+				formatInt(p.Height), formatFPS(p.FPS), strings.Join(p.Codecs, " "),
+			})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writes an aligned table with a row for each stream of each device, for people rather than tooling
+func writeTable(w io.Writer, devices []device) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tMANUFACTURER\tMODEL\tMAC\tPROFILE\tRESOLUTION\tFPS\tCODECS\tURI")
+	for _, d := range devices {
+		manufacturer := cmp.Or(d.Manufacturer, d.Vendor, "-")
+		for _, p := range profilesOf(d) {
+			resolution := "-"
+			if p.Width > 0 {
+				resolution = fmt.Sprintf("%dx%d", p.Width, p.Height)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				d.Address, manufacturer, cmp.Or(d.Model, "-"), cmp.Or(d.MAC, "-"), cmp.Or(p.Name, p.Token, "-"), resolution,
+				cmp.Or(formatFPS(p.FPS), "-"), cmp.Or(strings.Join(p.Codecs, ","), p.Encoding, "-"), cmp.Or(p.URI, "-"))
+		}
+	}
+	return tw.Flush()
+}
+
+// returns the profiles of the passed in device, or a single empty one if it has none so it still gets a row
+func profilesOf(d device) []profile {
+	if len(d.Profiles) == 0 {
+		return []profile{{}}
+	}
+	return d.Profiles
+}
+
+func formatInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+func formatFPS(fps float64) string {
+	if fps == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(fps, 'f', -1, 64)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os/exec"
+	"time"
+
+	"github.com/incrementventures/govr/health"
+)
+
+// how long an alert command is given to run
+const alertTimeout = 30 * time.Second
+
+// returns an alert hook which runs the passed in shell command with each alert as JSON on its stdin, so that alerts
+// can be mailed or forwarded by a script of the user's choosing
+func alertCommand(log *slog.Logger, command string) func(health.Alert) {
+	return func(alert health.Alert) {
+		b, err := json.Marshal(alert)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+
+			cmd := exec.CommandContext(ctx, "sh", "-c", command)
+			cmd.Stdin = bytes.NewReader(b)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Error("alert command failed", slog.String("camera", alert.Camera), slog.String("error", err.Error()), slog.String("output", string(bytes.TrimSpace(out))))
+			}
+		}()
+	}
+}
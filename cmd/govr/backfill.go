@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/backfill"
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/supervisor"
+)
+
+// backfills runs a backfiller for each declared camera which has one, starting them once the camera has been found
+// and restarting them as the configuration or the camera's address changes
+type backfills struct {
+	log        *slog.Logger
+	supervisor *supervisor.Supervisor
+	dir        string
+	index      *record.Index
+	monitor    *scan.Monitor
+	cameras    *registry.Cameras
+	onSegment  func(record.Segment)
+
+	mu      sync.Mutex
+	running map[string]*runningBackfill
+	wg      sync.WaitGroup
+}
+
+type runningBackfill struct {
+	cfg     config.Backfill
+	address string
+	cancel  context.CancelFunc
+}
+
+func newBackfills(log *slog.Logger, supervisor *supervisor.Supervisor, dir string, index *record.Index, monitor *scan.Monitor, cameras *registry.Cameras, onSegment func(record.Segment)) *backfills {
+	return &backfills{log: log, supervisor: supervisor, dir: dir, index: index, monitor: monitor, cameras: cameras, onSegment: onSegment, running: make(map[string]*runningBackfill)}
+}
+
+// starts and stops backfillers to match the passed in configuration and the devices currently known
+func (b *backfills) apply(ctx context.Context, cfg *config.Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wanted := map[string]bool{}
+	for i := range cfg.Cameras {
+		camera := &cfg.Cameras[i]
+		if camera.Backfill == nil || !camera.Record || ctx.Err() != nil {
+			continue
+		}
+		result, found := findDevice(b.monitor, b.cameras, cfg, camera)
+		if !found {
+			continue
+		}
+		wanted[camera.Name] = true
+
+		address := result.Device.Address
+		if running, found := b.running[camera.Name]; found {
+			if running.cfg == *camera.Backfill && running.address == address {
+				continue
+			}
+			running.cancel()
+			delete(b.running, camera.Name)
+		}
+
+		backfiller, err := backfill.NewBackfiller(b.log, backfill.Config{
+			Camera:   camera.Name,
+			Device:   result.Device,
+			Username: result.Credential.Username,
+			Password: result.Credential.Password,
+			Dir:      b.dir,
+			Index:    b.index,
+			Window:   time.Duration(camera.Backfill.Window),
+			Interval: time.Duration(camera.Backfill.Interval),
+		})
+		if err != nil {
+			b.log.Error("unable to backfill", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			continue
+		}
+		backfiller.OnSegment = b.onSegment
+
+		backfillCtx, cancel := context.WithCancel(ctx)
+		b.running[camera.Name] = &runningBackfill{cfg: *camera.Backfill, address: address, cancel: cancel}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.supervisor.Run(backfillCtx, "backfill:"+camera.Name, func(ctx context.Context) error {
+				backfiller.Run(ctx)
+				return nil
+			})
+		}()
+	}
+
+	for name, running := range b.running {
+		if !wanted[name] {
+			running.cancel()
+			delete(b.running, name)
+		}
+	}
+}
+
+// waits for every backfiller to stop, which they do once the context they were applied with is done
+func (b *backfills) wait() {
+	b.wg.Wait()
+}
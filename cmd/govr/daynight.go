@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/schedule"
+)
+
+// dayNights runs a day/night controller for each declared camera in a group which switches between day and night,
+// starting them once the camera has been found and restarting them as the configuration or its address changes
+type dayNights struct {
+	log     *slog.Logger
+	monitor *scan.Monitor
+	cameras *registry.Cameras
+
+	mu      sync.Mutex
+	running map[string]*runningDayNight
+	wg      sync.WaitGroup
+}
+
+type runningDayNight struct {
+	cfg        schedule.DayNight
+	address    string
+	controller *schedule.DayNightController
+	cancel     context.CancelFunc
+}
+
+func newDayNights(log *slog.Logger, monitor *scan.Monitor, cameras *registry.Cameras) *dayNights {
+	return &dayNights{log: log, monitor: monitor, cameras: cameras, running: make(map[string]*runningDayNight)}
+}
+
+// starts and stops controllers to match the passed in configuration and the devices currently known
+func (n *dayNights) apply(ctx context.Context, cfg *config.Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wanted := map[string]bool{}
+	for i := range cfg.Cameras {
+		camera := &cfg.Cameras[i]
+		dn, found := cfg.DayNight(camera.Name)
+		if !found || ctx.Err() != nil {
+			continue
+		}
+		result, found := findDevice(n.monitor, n.cameras, cfg, camera)
+		if !found {
+			continue
+		}
+		wanted[camera.Name] = true
+
+		if running, found := n.running[camera.Name]; found {
+			if running.cfg == dn && running.address == result.Device.Address {
+				continue
+			}
+			running.cancel()
+			delete(n.running, camera.Name)
+		}
+
+		controller, err := schedule.NewDayNightController(n.log, camera.Name, result.Device, dn)
+		if err != nil {
+			n.log.Error("unable to switch camera between day and night", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			continue
+		}
+
+		controllerCtx, cancel := context.WithCancel(ctx)
+		n.running[camera.Name] = &runningDayNight{cfg: dn, address: result.Device.Address, controller: controller, cancel: cancel}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			controller.Run(controllerCtx)
+		}()
+	}
+
+	for name, running := range n.running {
+		if !wanted[name] {
+			running.cancel()
+			delete(n.running, name)
+		}
+	}
+}
+
+// waits for every controller to stop, which they do once the context they were applied with is done
+func (n *dayNights) wait() {
+	n.wg.Wait()
+}
+
+// returns the phase the passed in camera was last switched to, false if it isn't being switched or hasn't been yet
+func (n *dayNights) phase(name string) (schedule.Phase, bool) {
+	if n == nil {
+		return "", false
+	}
+	n.mu.Lock()
+	running, found := n.running[name]
+	n.mu.Unlock()
+	if !found {
+		return "", false
+	}
+	phase, _ := running.controller.Status()
+	return phase, phase != ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/illuminator"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/schedule"
+)
+
+// deterrents flashes the white light of declared cameras with a deterrent when events which set it off, such as a
+// person being detected, are added for them at night
+type deterrents struct {
+	log      *slog.Logger
+	monitor  *scan.Monitor
+	cameras  *registry.Cameras
+	dayNight *dayNights
+
+	mu       sync.Mutex
+	ctx      context.Context
+	cfg      *config.Config
+	flashing map[string]bool
+	wg       sync.WaitGroup
+}
+
+func newDeterrents(log *slog.Logger, monitor *scan.Monitor, cameras *registry.Cameras, dayNight *dayNights) *deterrents {
+	return &deterrents{log: log, monitor: monitor, cameras: cameras, dayNight: dayNight, flashing: make(map[string]bool)}
+}
+
+// sets the configuration events are acted on with, flashes run until the passed in context is done
+func (d *deterrents) apply(ctx context.Context, cfg *config.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.ctx, d.cfg = ctx, cfg
+}
+
+// flashes the white light of the event's camera if the event sets off its deterrent and it is night there at the
+// passed in time, returning whether we started flashing. A camera already flashing isn't flashed again until it is
+// done.
+func (d *deterrents) onEvent(event record.Event, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cfg == nil || d.ctx.Err() != nil || d.flashing[event.Camera] {
+		return false
+	}
+	camera := d.cfg.Camera(event.Camera)
+	if camera == nil || camera.Deterrent == nil || !camera.Deterrent.Triggers(event.Type) {
+		return false
+	}
+	if !d.night(d.cfg, camera.Name, now) {
+		d.log.Debug("not flashing light by day", slog.String("camera", camera.Name), slog.String("event", event.Type))
+		return false
+	}
+	result, found := findDevice(d.monitor, d.cameras, d.cfg, camera)
+	if !found {
+		d.log.Warn("unable to flash light of camera which hasn't been found", slog.String("camera", camera.Name))
+		return false
+	}
+
+	action := illuminator.FlashAction{
+		Camera:     camera.Name,
+		Times:      camera.Deterrent.Times,
+		IntervalMS: int(time.Duration(camera.Deterrent.Interval) / time.Millisecond),
+	}
+	quirks := camera.Deterrent.Quirks()
+	ctx := d.ctx
+	d.flashing[camera.Name] = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.log.Info("flashing light", slog.String("camera", camera.Name), slog.String("event", event.Type))
+		if err := illuminator.Flash(ctx, d.log, result.Device, quirks, action, now); err != nil {
+			d.log.Error("error flashing light", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+		}
+
+		d.mu.Lock()
+		delete(d.flashing, camera.Name)
+		d.mu.Unlock()
+	}()
+	return true
+}
+
+// returns whether it is night at the passed in camera, going by the phase its day/night controller last switched it
+// to if it has one which decides for itself, otherwise by the sun at its site
+func (d *deterrents) night(cfg *config.Config, camera string, now time.Time) bool {
+	dn, switched := cfg.DayNight(camera)
+	if switched && dn.Mode != schedule.DayNightCamera {
+		if phase, found := d.dayNight.phase(camera); found {
+			return phase == schedule.PhaseNight
+		}
+	}
+	if !switched {
+		dn = schedule.DayNight{Site: *cfg.SiteOf(camera)}
+	}
+	if dn.Site.IsZero() {
+		return false
+	}
+	return dn.SunPhase(now) == schedule.PhaseNight
+}
+
+// waits for every flash to finish, which they do once the context they were applied with is done
+func (d *deterrents) wait() {
+	d.wg.Wait()
+}
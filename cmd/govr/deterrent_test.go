@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/schedule"
+)
+
+var (
+	london = schedule.Site{Latitude: 51.5, Longitude: -0.12}
+	noon   = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	night  = time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+)
+
+func TestDeterrentNight(t *testing.T) {
+	d := newDeterrents(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, nil, nil)
+
+	tcs := []struct {
+		name  string
+		cfg   *config.Config
+		now   time.Time
+		night bool
+	}{
+		{name: "site by day", cfg: &config.Config{Site: london}, now: noon},
+		{name: "site at night", cfg: &config.Config{Site: london}, now: night, night: true},
+		{name: "no site", cfg: &config.Config{}, now: night},
+		{
+			name:  "day/night switching not yet switched",
+			cfg:   &config.Config{Site: london, Groups: []config.Group{{Name: "yard", Cameras: []string{"front"}, DayNight: &config.DayNight{Mode: "sun"}}}},
+			now:   night,
+			night: true,
+		},
+		{
+			name: "day/night switching with sunset offset",
+			cfg: &config.Config{Site: london, Groups: []config.Group{{
+				Name: "yard", Cameras: []string{"front"}, DayNight: &config.DayNight{Mode: "sun", SunsetOffset: config.Duration(6 * time.Hour)},
+			}}},
+			now: night,
+		},
+		{
+			name:  "camera mode goes by the sun at the group site",
+			cfg:   &config.Config{Groups: []config.Group{{Name: "yard", Cameras: []string{"front"}, Site: &london, DayNight: &config.DayNight{Mode: "camera"}}}},
+			now:   night,
+			night: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if night := d.night(tc.cfg, "front", tc.now); night != tc.night {
+				t.Errorf("expected night %t, got %t", tc.night, night)
+			}
+		})
+	}
+}
+
+func TestDeterrentEvents(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// a camera whose white light is turned on and off with auxiliary commands
+	mu := sync.Mutex{}
+	commands := []string{}
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, command := range []string{"light-on", "light-off"} {
+			if strings.Contains(string(body), command) {
+				commands = append(commands, command)
+			}
+		}
+		w.Header().Set("Content-Type", "application/soap+xml")
+		io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body/></s:Envelope>`)
+	}))
+	defer device.Close()
+
+	monitor := scan.NewMonitor(log, scan.DefaultOptions(), time.Hour, time.Hour)
+	result := scan.DeviceResult{Device: &onvif.Device{Address: device.URL + "/onvif/device_service"}}
+	monitor.Track(context.Background(), result)
+	cameras, err := registry.OpenCameras(filepath.Join(t.TempDir(), "cameras.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	camera, err := cameras.Observe(scan.NewRecord(result), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cameras.Adopt(camera.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Site: london, Cameras: []config.Camera{
+		{Name: "front", ID: camera.ID, Deterrent: &config.Deterrent{Times: 2, Interval: config.Duration(time.Millisecond), WhiteLightOn: "light-on", WhiteLightOff: "light-off"}},
+		{Name: "drive", Deterrent: &config.Deterrent{Events: []string{"vehicle"}, WhiteLightRelay: "relay-1"}},
+		{Name: "back"},
+	}}
+
+	d := newDeterrents(log, monitor, cameras, nil)
+	if d.onEvent(record.Event{Camera: "front", Type: config.EventPerson}, night) {
+		t.Error("expected no flash before a configuration is applied")
+	}
+	d.apply(context.Background(), cfg)
+
+	tcs := []struct {
+		name    string
+		event   record.Event
+		now     time.Time
+		flashed bool
+	}{
+		{name: "person by day", event: record.Event{Camera: "front", Type: config.EventPerson}, now: noon},
+		{name: "vehicle at night", event: record.Event{Camera: "front", Type: "vehicle"}, now: night},
+		{name: "camera without deterrent", event: record.Event{Camera: "back", Type: config.EventPerson}, now: night},
+		{name: "undeclared camera", event: record.Event{Camera: "side", Type: config.EventPerson}, now: night},
+		{name: "camera which hasn't been found", event: record.Event{Camera: "drive", Type: "vehicle"}, now: night},
+		{name: "person at night", event: record.Event{Camera: "front", Type: config.EventPerson}, now: night, flashed: true},
+		{name: "person while flashing", event: record.Event{Camera: "front", Type: config.EventPerson}, now: night},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if flashed := d.onEvent(tc.event, tc.now); flashed != tc.flashed {
+				t.Errorf("expected flashed %t, got %t", tc.flashed, flashed)
+			}
+		})
+	}
+
+	d.wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(commands, ",") != "light-on,light-off,light-on,light-off" {
+		t.Errorf("expected the light flashed twice, got %v", commands)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/incrementventures/govr/diag"
+	"github.com/lmittmann/tint"
+	"github.com/nyaruka/ezconf"
+)
+
+type DiagConfig struct {
+	DataDir  string     `help:"the govr data directory"`
+	LogFile  string     `help:"the govr log file to include recent lines from (optional)"`
+	LogLines int        `help:"how many recent log lines to include"`
+	FFmpeg   string     `help:"the ffmpeg binary to report the version of"`
+	FFprobe  string     `help:"the ffprobe binary to report the version of"`
+	Output   string     `help:"where to write the bundle, defaults to govr-diag-<time>.tar.gz"`
+	Level    slog.Level `help:"the log level to use (optional)"`
+}
+
+func runDiag() {
+	config := &DiagConfig{
+		DataDir:  "data",
+		LogLines: 1000,
+		FFmpeg:   "ffmpeg",
+		FFprobe:  "ffprobe",
+		Level:    slog.LevelInfo,
+	}
+	loader := ezconf.NewLoader(
+		config,
+		"govr-diag", "govr diag - collect a diagnostics bundle for bug reports",
+		[]string{},
+	)
+	loader.MustLoad()
+
+	log := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: config.Level}))
+
+	output := config.Output
+	if output == "" {
+		output = fmt.Sprintf("govr-diag-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		log.Error("unable to create bundle", slog.String("output", output), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	err = diag.WriteBundle(f, diag.Options{
+		Config:      config,
+		LogFile:     config.LogFile,
+		LogLines:    config.LogLines,
+		DataDir:     config.DataDir,
+		FFmpegPath:  config.FFmpeg,
+		FFprobePath: config.FFprobe,
+	})
+	if err != nil {
+		log.Error("unable to write bundle", slog.String("output", output), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	abs, _ := filepath.Abs(output)
+	log.Info("diagnostics bundle written", slog.String("output", abs))
+}
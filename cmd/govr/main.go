@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func()
+}
+
+var commands = []command{
+	{"diag", "collect a diagnostics bundle for bug reports", runDiag},
+	{"provision", "apply provisioning templates to cameras and report compliance", runProvision},
+	{"scan", "scan for cameras, or with --push have a running server scan and adopt what it finds", runScan},
+	{"serve", "run a headless NVR serving a JSON API and live streams", runServe},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			// remove the command name so that config loading only sees its flags
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			c.run()
+			return
+		}
+	}
+	usage()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: govr <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+// each crash restarts the task which panicked, labelled by the task such as recorder:<camera> or hls:<camera>
+var taskCrashes = metrics.NewCounter("govr_task_crashes_total", "Panics in supervised tasks, each of which restarted the task.", "task")
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/health"
+	"github.com/incrementventures/govr/motion"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/schedule"
+	"github.com/incrementventures/govr/supervisor"
+)
+
+// detectors runs a motion detector for each declared camera with motion detection, starting them once the camera
+// has been found and restarting them as the configuration or the camera's address changes
+type detectors struct {
+	log        *slog.Logger
+	supervisor *supervisor.Supervisor
+	monitor    *scan.Monitor
+	cameras    *registry.Cameras
+
+	// called when motion starts and stops on a camera, keyed by camera name
+	onMotion func(camera string, active bool, at time.Time)
+
+	// if set, the circuit breakers snapshots are fetched through so that failing cameras are left alone for a while
+	breakers *health.Breakers
+
+	mu      sync.Mutex
+	running map[string]*runningDetector
+	wg      sync.WaitGroup
+}
+
+type runningDetector struct {
+	cfg     *config.Motion
+	site    schedule.Site
+	address string
+	cancel  context.CancelFunc
+}
+
+func newDetectors(log *slog.Logger, supervisor *supervisor.Supervisor, monitor *scan.Monitor, cameras *registry.Cameras, onMotion func(string, bool, time.Time)) *detectors {
+	return &detectors{log: log, supervisor: supervisor, monitor: monitor, cameras: cameras, onMotion: onMotion, running: make(map[string]*runningDetector)}
+}
+
+// starts and stops detectors to match the passed in configuration and the devices currently known
+func (d *detectors) apply(ctx context.Context, cfg *config.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wanted := map[string]bool{}
+	for i := range cfg.Cameras {
+		camera := &cfg.Cameras[i]
+		if camera.Motion == nil || ctx.Err() != nil {
+			continue
+		}
+		source, address, err := d.sourceOf(cfg, camera)
+		if err != nil {
+			d.log.Error("unable to detect motion", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if source == nil {
+			continue
+		}
+		wanted[camera.Name] = true
+
+		if running, found := d.running[camera.Name]; found {
+			if running.cfg.Equal(camera.Motion) && running.site == *cfg.SiteOf(camera.Name) && running.address == address {
+				continue
+			}
+			running.cancel()
+			delete(d.running, camera.Name)
+		}
+
+		name, during, site := camera.Name, camera.Motion.During, cfg.SiteOf(camera.Name)
+		detector, err := motion.NewDetector(d.log, motion.Config{
+			Camera:    name,
+			Source:    source,
+			Interval:  time.Duration(camera.Motion.Interval),
+			Threshold: camera.Motion.Threshold,
+			MinArea:   camera.Motion.MinArea,
+			Hold:      time.Duration(camera.Motion.Hold),
+			Regions:   camera.Motion.Regions,
+			Active: func(t time.Time) bool {
+				return during.Contains(t, site)
+			},
+		})
+		if err != nil {
+			d.log.Error("unable to detect motion", slog.String("camera", name), slog.String("error", err.Error()))
+			continue
+		}
+		detector.OnMotion = func(active bool, at time.Time) {
+			d.onMotion(name, active, at)
+		}
+
+		detectorCtx, cancel := context.WithCancel(ctx)
+		d.running[name] = &runningDetector{cfg: camera.Motion, site: *site, address: address, cancel: cancel}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.supervisor.Run(detectorCtx, "motion:"+name, detector.Run)
+		}()
+	}
+
+	for name, running := range d.running {
+		if !wanted[name] {
+			running.cancel()
+			delete(d.running, name)
+		}
+	}
+}
+
+// waits for every detector to stop, which they do once the context they were applied with is done
+func (d *detectors) wait() {
+	d.wg.Wait()
+}
+
+// returns the source of frames for the passed in camera and the address they come from, nil if it is an ONVIF
+// camera which hasn't been found yet
+func (d *detectors) sourceOf(cfg *config.Config, camera *config.Camera) (motion.Source, string, error) {
+	if camera.URL != "" {
+		url, err := creds.NewURL(camera.URL, camera.Username, camera.Password)
+		if err != nil {
+			return nil, "", err
+		}
+		return &motion.StreamSource{URL: url}, camera.URL, nil
+	}
+
+	result, found := findDevice(d.monitor, d.cameras, cfg, camera)
+	if !found {
+		return nil, "", nil
+	}
+	device := result.Device
+	if len(device.Profiles) == 0 {
+		return nil, "", errors.New("device has no profiles")
+	}
+
+	// the last profile is usually the smallest substream, which is all motion detection needs
+	profile := &device.Profiles[len(device.Profiles)-1]
+	if camera.Motion.Profile != "" {
+		profile = nil
+		for i, p := range device.Profiles {
+			if p.Token == camera.Motion.Profile || p.Name == camera.Motion.Profile {
+				profile = &device.Profiles[i]
+				break
+			}
+		}
+		if profile == nil {
+			return nil, "", fmt.Errorf("no profile %q", camera.Motion.Profile)
+		}
+	}
+
+	if camera.MotionSource() == config.MotionStream {
+		url, err := creds.NewURL(profile.URI, result.Credential.Username, result.Credential.Password)
+		if err != nil {
+			return nil, "", err
+		}
+		return &motion.StreamSource{URL: url}, device.Address, nil
+	}
+
+	name, token := camera.Name, profile.Token
+	return &motion.SnapshotSource{Fetch: func(ctx context.Context) ([]byte, error) {
+		if d.breakers == nil {
+			return device.Snapshot(ctx, d.log, token)
+		}
+		var jpeg []byte
+		err := d.breakers.Do(name, "snapshot", func() (err error) {
+			jpeg, err = device.Snapshot(ctx, d.log, token)
+			return err
+		})
+		return jpeg, err
+	}}, device.Address, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/incrementventures/govr/provision"
+	"github.com/incrementventures/govr/registry"
+	"github.com/lmittmann/tint"
+	"github.com/nyaruka/ezconf"
+)
+
+type ProvisionConfig struct {
+	DataDir   string     `help:"the govr data directory"`
+	Templates string     `help:"the JSON file of provisioning templates"`
+	Username  string     `help:"the username to connect to cameras with, defaults to the one they were probed with"`
+	Password  string     `help:"the password to connect to cameras with"`
+	All       bool       `help:"whether to provision every known camera rather than only newly adopted ones"`
+	DryRun    bool       `help:"whether to only report compliance without changing any settings"`
+	Level     slog.Level `help:"the log level to use (optional)"`
+}
+
+func runProvision() {
+	config := &ProvisionConfig{
+		DataDir:   "data",
+		Templates: "templates.json",
+		Level:     slog.LevelWarn,
+	}
+	loader := ezconf.NewLoader(
+		config,
+		"govr-provision", "govr provision - apply provisioning templates to cameras and report compliance",
+		[]string{},
+	)
+	loader.MustLoad()
+
+	log := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: config.Level}))
+	fail := func(msg string, err error) {
+		log.Error(msg, slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	templates, err := provision.LoadTemplates(config.Templates)
+	if err != nil {
+		fail("unable to load templates", err)
+	}
+	probes, err := registry.OpenProbeStore(filepath.Join(config.DataDir, "probes.json"))
+	if err != nil {
+		fail("unable to open probe store", err)
+	}
+	ledger, err := provision.OpenLedger(filepath.Join(config.DataDir, "provisioned.json"))
+	if err != nil {
+		fail("unable to open provisioning ledger", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tTEMPLATE\tSTATUS\tDETAIL")
+
+	compliant, total := 0, 0
+	for _, record := range probes.Records() {
+		if record.LastError != "" {
+			fmt.Fprintf(w, "%s\t-\tskipped\tlast probe failed: %s\n", record.Address, record.LastError)
+			continue
+		}
+		if !config.All && ledger.Provisioned(record.Address) {
+			continue
+		}
+
+		d := record.Device
+		tmpl := templates.For(&d)
+		if tmpl == nil {
+			fmt.Fprintf(w, "%s\t-\tskipped\tno matching template\n", record.Address)
+			continue
+		}
+
+		if config.Username != "" {
+			d.Username = config.Username
+		}
+		d.Password = config.Password
+
+		total++
+		result := provision.Provision(log, &d, tmpl, !config.DryRun)
+		if !config.DryRun {
+			if err := ledger.Record(result, time.Now()); err != nil {
+				fail("unable to update provisioning ledger", err)
+			}
+		}
+
+		switch {
+		case result.Error != "":
+			fmt.Fprintf(w, "%s\t%s\terror\t%s\n", record.Address, tmpl.Name, result.Error)
+		case len(result.Remaining) > 0:
+			for i, drift := range result.Remaining {
+				status := ""
+				if i == 0 {
+					status = "non-compliant"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", record.Address, tmpl.Name, status, drift)
+			}
+		default:
+			compliant++
+			fmt.Fprintf(w, "%s\t%s\tcompliant\t%d settings corrected\n", record.Address, tmpl.Name, len(result.Found))
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d of %d cameras compliant\n", compliant, total)
+	if compliant < total {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/health"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/supervisor"
+	"github.com/incrementventures/govr/syslog"
+)
+
+// recordings runs a recorder for each stream of a declared camera which is set to record, starting them once the
+// camera has been found and restarting them as the configuration or the camera changes. Cameras recorded only at
+// certain times of day are started and stopped as they are applied.
+type recordings struct {
+	log     *slog.Logger
+	dir     string
+	monitor *scan.Monitor
+	cameras *registry.Cameras
+
+	// recorders run under this so that one which panics is restarted without taking down the others
+	supervisor *supervisor.Supervisor
+
+	// called with each segment once it is complete, and with each change in the health of a camera
+	onSegment func(record.Segment)
+	onAlert   func(health.Alert)
+
+	// if set, what cameras log to us is attached to alerts of them becoming unhealthy
+	logs *syslog.Store
+
+	// if set, the circuit breakers requests to cameras go through, shared with everything else which makes them
+	breakers *health.Breakers
+
+	// the configuration last applied, which watchdogs check firmware against without waiting on recorders
+	cfg atomic.Pointer[config.Config]
+
+	mu      sync.Mutex
+	running map[string]*runningRecorder
+	wg      sync.WaitGroup
+}
+
+// the most lines of what a camera logged which are attached to an alert
+const maxCameraLog = 20
+
+type runningRecorder struct {
+	cfg      record.Config
+	watchdog *health.Watchdog
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newRecordings(log *slog.Logger, supervisor *supervisor.Supervisor, dir string, monitor *scan.Monitor, cameras *registry.Cameras, onSegment func(record.Segment), onAlert func(health.Alert)) *recordings {
+	return &recordings{log: log, supervisor: supervisor, dir: dir, monitor: monitor, cameras: cameras, onSegment: onSegment, onAlert: onAlert, running: make(map[string]*runningRecorder)}
+}
+
+// starts and stops recorders to match the passed in configuration and the devices currently known
+func (r *recordings) apply(ctx context.Context, cfg *config.Config) {
+	wanted := map[string]record.Config{}
+	devices := map[string]*onvif.Device{}
+	now := time.Now()
+	for i := range cfg.Cameras {
+		camera := &cfg.Cameras[i]
+		if !camera.Record || !camera.RecordDuring.Contains(now, cfg.SiteOf(camera.Name)) {
+			continue
+		}
+		streams, device := r.streamsOf(cfg, camera)
+		for name, stream := range streams {
+			wanted[name] = record.Config{
+				Camera:          name,
+				URL:             stream.url,
+				Resolve:         stream.resolve,
+				Dir:             r.dir,
+				SegmentDuration: time.Duration(cfg.Recording.SegmentDuration),
+				Format:          camera.RecordingFormat(cfg.Recording),
+			}
+		}
+
+		// the device itself is only watched along with the camera's first stream
+		if device != nil {
+			devices[camera.Name] = device
+		}
+	}
+
+	r.cfg.Store(cfg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, running := range r.running {
+		if want, found := wanted[name]; !found || !sameRecording(want, running.cfg) {
+			r.log.Info("stopping recording", slog.String("camera", name))
+			running.cancel()
+			delete(r.running, name)
+
+			// a replacement writes to the same directory so can't start until this one has finished
+			<-running.done
+		}
+	}
+
+	for name, want := range wanted {
+		if _, found := r.running[name]; found || ctx.Err() != nil {
+			continue
+		}
+
+		recorder, err := record.NewRecorder(r.log, want)
+		if err != nil {
+			r.log.Error("unable to create recorder", slog.String("camera", name), slog.String("error", err.Error()))
+			continue
+		}
+		recorder.OnSegment = r.onSegment
+
+		watchdogCfg := health.Config{Camera: name, Device: devices[name], Stream: recorder, Breakers: r.breakers}
+		if device := devices[name]; device != nil {
+			watchdogCfg.Firmware = func() (bool, string) { return r.checkFirmware(device) }
+		}
+		if r.logs != nil {
+			host := want.URL.Host()
+			if device := devices[name]; device != nil {
+				host = device.Address
+			}
+			watchdogCfg.CameraLog = func(from, to time.Time) []string { return r.cameraLog(host, from, to) }
+		}
+		watchdog := health.NewWatchdog(r.log, watchdogCfg)
+		watchdog.OnAlert = r.onAlert
+
+		recorderCtx, cancel := context.WithCancel(ctx)
+		running := &runningRecorder{cfg: want, watchdog: watchdog, cancel: cancel, done: make(chan struct{})}
+		r.running[name] = running
+		r.wg.Add(2)
+		go func() {
+			defer r.wg.Done()
+			watchdog.Run(recorderCtx)
+		}()
+		go func() {
+			defer r.wg.Done()
+			defer close(running.done)
+
+			// recorders restart their own streams, so those which fail to start at all aren't restarted, only panics are
+			r.supervisor.Run(recorderCtx, "recorder:"+name, func(ctx context.Context) error {
+				if err := recorder.Run(ctx); err != nil {
+					r.log.Error("recording failed", slog.String("camera", name), slog.String("error", err.Error()))
+				}
+				return nil
+			})
+		}()
+	}
+}
+
+// returns the health of each camera being recorded, keyed by recording name
+func (r *recordings) health() map[string]map[health.Check]health.CheckStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := make(map[string]map[health.Check]health.CheckStatus, len(r.running))
+	for name, running := range r.running {
+		status[name] = running.watchdog.Status()
+	}
+	return status
+}
+
+// returns whether the firmware of the passed in device is free of known problems according to the advisories of our
+// current configuration, and if not why. Unverified firmware is only noted as cameras are often updated before the
+// advisories are.
+func (r *recordings) checkFirmware(device *onvif.Device) (bool, string) {
+	cfg := r.cfg.Load()
+	// the registry has the version the camera last reported, which it may have been updated to since we found it
+	info := device.DeviceInformation
+	version := info.FirmwareVersion
+	if camera, found := r.cameras.AtHost(device.Address); found && camera.CurrentFirmware() != "" {
+		version = camera.CurrentFirmware()
+	}
+
+	verdict, detail := cfg.CheckFirmware(info.Manufacturer, info.Model, version)
+	return verdict != config.FirmwareBad, detail
+}
+
+// returns the warnings and errors the camera at the passed in host logged between the passed in times, the most
+// recent of them if there are many
+func (r *recordings) cameraLog(host string, from time.Time, to time.Time) []string {
+	messages, err := r.logs.Messages(syslogDevice(r.cameras, host), from, to, syslog.SeverityWarning)
+	if err != nil {
+		r.log.Error("error reading camera syslog", slog.String("host", host), slog.String("error", err.Error()))
+		return nil
+	}
+	messages = messages[max(len(messages)-maxCameraLog, 0):]
+
+	lines := make([]string, len(messages))
+	for i, m := range messages {
+		text := m.Text
+		if m.App != "" {
+			text = m.App + ": " + text
+		}
+		lines[i] = fmt.Sprintf("%s %s %s", m.Received.Format(time.RFC3339), m.Severity, text)
+	}
+	return lines
+}
+
+// waits for every recorder to stop, which they do once the context they were applied with is done
+func (r *recordings) wait() {
+	r.wg.Wait()
+}
+
+// a stream to record, the URL it was configured or probed with and how to resolve the URL to connect to each time
+// recording starts
+type recordedStream struct {
+	url     *creds.URL
+	resolve func(failed error) (*creds.URL, error)
+}
+
+// returns the streams to record for the passed in camera keyed by recording name, the first is recorded under the
+// name of the camera and any others under the camera name and profile token, along with its device if it is an ONVIF
+// camera. ONVIF cameras have no streams until they have been found.
+func (r *recordings) streamsOf(cfg *config.Config, camera *config.Camera) (map[string]recordedStream, *onvif.Device) {
+	streams := map[string]recordedStream{}
+	if camera.URL != "" {
+		url, err := creds.NewURL(camera.URL, camera.Username, camera.Password)
+		if err != nil {
+			r.log.Error("invalid camera url", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			return nil, nil
+		}
+		resolver := scan.NewURLResolver(r.log, camera.URL, scan.Credential{Username: camera.Username, Password: camera.Password}, r.monitor.Options())
+		streams[camera.Name] = recordedStream{url: url, resolve: resolver.Resolve}
+		return streams, nil
+	}
+
+	result, found := findDevice(r.monitor, r.cameras, cfg, camera)
+	if !found || len(result.Device.Profiles) == 0 {
+		return nil, nil
+	}
+
+	profiles := result.Device.Profiles
+	for i, p := range profiles {
+		if p.URI == "" {
+			continue
+		}
+		if len(camera.Profiles) == 0 && i > 0 {
+			break
+		}
+		if len(camera.Profiles) > 0 && !slices.Contains(camera.Profiles, p.Token) && !slices.Contains(camera.Profiles, p.Name) {
+			continue
+		}
+
+		url, err := creds.NewURL(p.URI, result.Credential.Username, result.Credential.Password)
+		if err != nil {
+			r.log.Error("invalid stream url", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			continue
+		}
+		resolver, err := scan.NewStreamResolver(r.log, result, p.Token, r.monitor.Options())
+		if err != nil {
+			r.log.Error("unable to resolve stream", slog.String("camera", camera.Name), slog.String("error", err.Error()))
+			continue
+		}
+		name := camera.Name
+		if len(streams) > 0 {
+			name = camera.Name + "-" + p.Token
+		}
+		streams[name] = recordedStream{url: url, resolve: resolver.Resolve}
+	}
+	return streams, result.Device
+}
+
+// returns the probe result of the device which is the passed in declared camera, false if it hasn't been found,
+// couldn't be probed or hasn't been adopted
+func findDevice(monitor *scan.Monitor, cameras *registry.Cameras, cfg *config.Config, camera *config.Camera) (scan.DeviceResult, bool) {
+	for _, device := range monitor.Devices() {
+		c, found := cameras.ByKey(device.Key)
+		if !found || !c.Adopted() || cfg.Match(device, c.ID) != camera {
+			continue
+		}
+		result, found := monitor.Result(device.Key)
+		return result, found && result.Device != nil
+	}
+	return scan.DeviceResult{}, false
+}
+
+// returns whether two recorder configurations record the same stream the same way
+func sameRecording(a, b record.Config) bool {
+	return a.URL.Secret() == b.URL.Secret() && a.SegmentDuration == b.SegmentDuration && a.Format == b.Format
+}
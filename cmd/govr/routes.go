@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/incrementventures/govr/api"
+	"github.com/incrementventures/govr/auth"
+	"github.com/incrementventures/govr/stream"
+)
+
+// routes are the handlers we serve over HTTP and the checks requests to each of them go through
+type routes struct {
+	server    *api.Server
+	sessions  *auth.Sessions
+	signer    *auth.Signer
+	hls       http.Handler
+	webrtc    http.Handler
+	snapshots http.Handler
+
+	// nil if we aren't ingesting footage or serving metrics
+	ingest  http.Handler
+	metrics http.Handler
+
+	// if set, let metrics be scraped and footage be uploaded with these bearer tokens rather than an admin session
+	metricsToken string
+	ingestToken  string
+
+	// every request must come from an address in the allowlist and is rate limited per address, admin routes have
+	// their own tighter allowlist and rate limit
+	allowlist      *auth.Allowlist
+	limiter        *auth.RateLimiter
+	adminAllowlist *auth.Allowlist
+	adminLimiter   *auth.RateLimiter
+	loginLimiter   *auth.RateLimiter
+
+	cors auth.CORSConfig
+	csrf auth.CSRFConfig
+}
+
+// handler returns the handler of all our routes
+func (rt *routes) handler() http.Handler {
+	mux := http.NewServeMux()
+	handler := rt.server.Handler()
+	mux.Handle("/api/", auth.CSRF(rt.csrf, handler))
+	mux.Handle("/share/", handler)
+	if rt.sessions != nil {
+		mux.Handle("GET /auth/login", rt.sessions.Login())
+		mux.Handle("GET /auth/callback", rt.loginLimiter.Wrap(auth.RemoteIP, rt.sessions.Callback()))
+		mux.Handle("POST /auth/logout", auth.CSRF(rt.csrf, rt.sessions.Logout()))
+	}
+
+	// live streams are only served to those holding a token from the links the API hands out to viewers and shares
+	mux.Handle("/hls/", http.StripPrefix("/hls", rt.signer.RequireStreamToken(auth.StreamHLS, stream.Camera, rt.hls)))
+	mux.Handle("/webrtc/", http.StripPrefix("/webrtc", rt.signer.RequireStreamToken(auth.StreamWebRTC, stream.Camera, rt.webrtc)))
+	mux.Handle("/snapshots/", http.StripPrefix("/snapshots", rt.signer.RequireStreamToken(auth.StreamSnapshot, stream.Camera, rt.snapshots)))
+
+	if rt.ingest != nil {
+		mux.Handle("/ingest/", rt.admin(rt.ingestToken, auth.CSRF(rt.csrf, http.StripPrefix("/ingest", rt.ingest))))
+	}
+	if rt.metrics != nil {
+		mux.Handle("GET /metrics", rt.admin(rt.metricsToken, rt.metrics))
+	}
+
+	h := rt.limiter.Wrap(auth.RemoteIP, mux)
+	h = rt.allowlist.Wrap(h)
+	return auth.CORS(rt.cors, h)
+}
+
+// wraps the passed in handler with the allowlist and rate limit of our admin routes and so that it needs an admin
+// session or, if set, the passed in bearer token for clients such as scrapers and upload scripts which can't log in
+func (rt *routes) admin(token string, h http.Handler) http.Handler {
+	switch {
+	case token == "":
+		h = rt.require(auth.RoleAdmin, h)
+	case rt.sessions == nil:
+		h = auth.RequireBearer(token, nil, h)
+	default:
+		h = auth.RequireBearer(token, rt.sessions.Require(auth.RoleAdmin, h), h)
+	}
+	h = rt.adminLimiter.Wrap(auth.RemoteIP, h)
+	return rt.adminAllowlist.Wrap(h)
+}
+
+// wraps the passed in handler so that it needs a session of at least the passed in role, if we have sessions
+func (rt *routes) require(role auth.Role, h http.Handler) http.Handler {
+	if rt.sessions == nil {
+		return h
+	}
+	return rt.sessions.Require(role, h)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/api"
+	"github.com/incrementventures/govr/auth"
+	"github.com/incrementventures/govr/scan"
+)
+
+// returns routes serving an API without any devices and stub handlers for everything else, with 192.168.1.0/24
+// allowed and only 192.168.1.5 allowed admin routes
+func testRoutes(t *testing.T) *routes {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	monitor := scan.NewMonitor(log, scan.DefaultOptions(), time.Hour, time.Hour)
+	signer := auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	sessions := auth.NewSessions(nil, signer, time.Hour, false)
+	server := api.New(log, api.Config{}, monitor, nil, nil, nil, nil)
+	server.Sessions = sessions
+
+	allowlist, err := auth.NewAllowlist([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAllowlist, err := auth.NewAllowlist([]string{"192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminLimiter := auth.NewRateLimiter(1000, 1000)
+	server.AdminAllowlist, server.AdminLimiter = adminAllowlist, adminLimiter
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	return &routes{
+		server:         server,
+		sessions:       sessions,
+		signer:         signer,
+		hls:            ok,
+		webrtc:         ok,
+		snapshots:      ok,
+		ingest:         ok,
+		metrics:        ok,
+		allowlist:      allowlist,
+		limiter:        auth.NewRateLimiter(1000, 1000),
+		adminAllowlist: adminAllowlist,
+		adminLimiter:   adminLimiter,
+		loginLimiter:   auth.NewRateLimiter(1000, 1000),
+		csrf:           auth.CSRFConfig{Disabled: true},
+	}
+}
+
+// returns a session cookie for a user with the passed in role
+func sessionCookie(t *testing.T, rt *routes, role auth.Role) *http.Cookie {
+	token, err := rt.signer.Sign(auth.Claims{Subject: "user-1", Scope: "session:" + string(role), Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: auth.SessionCookie, Value: token}
+}
+
+func TestRoutes(t *testing.T) {
+	rt := testRoutes(t)
+	h := rt.handler()
+	viewer, admin := sessionCookie(t, rt, auth.RoleViewer), sessionCookie(t, rt, auth.RoleAdmin)
+	hlsToken, err := rt.signer.StreamToken("camera-1", auth.StreamHLS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotToken, err := rt.signer.StreamToken("camera-1", auth.StreamSnapshot, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		target     string
+		cookie     *http.Cookie
+		status     int
+	}{
+		{name: "api as viewer", remoteAddr: "192.168.1.20:5000", target: "/api/devices", cookie: viewer, status: http.StatusOK},
+		{name: "api without session", remoteAddr: "192.168.1.20:5000", target: "/api/devices", status: http.StatusUnauthorized},
+		{name: "api outside allowlist", remoteAddr: "10.0.0.20:5000", target: "/api/devices", cookie: admin, status: http.StatusForbidden},
+		{name: "admin api outside admin allowlist", remoteAddr: "192.168.1.20:5000", target: "/api/pending", cookie: admin, status: http.StatusForbidden},
+		{name: "hls with token", remoteAddr: "192.168.1.20:5000", target: "/hls/camera-1/index.m3u8?token=" + hlsToken, status: http.StatusOK},
+		{name: "hls without token", remoteAddr: "192.168.1.20:5000", target: "/hls/camera-1/index.m3u8", cookie: admin, status: http.StatusUnauthorized},
+		{name: "hls with another camera's token", remoteAddr: "192.168.1.20:5000", target: "/hls/camera-2/index.m3u8?token=" + hlsToken, status: http.StatusForbidden},
+		{name: "hls outside allowlist", remoteAddr: "10.0.0.20:5000", target: "/hls/camera-1/index.m3u8?token=" + hlsToken, status: http.StatusForbidden},
+		{name: "webrtc with another kind's token", remoteAddr: "192.168.1.20:5000", target: "/webrtc/camera-1?token=" + hlsToken, status: http.StatusForbidden},
+		{name: "snapshot with token", remoteAddr: "192.168.1.20:5000", target: "/snapshots/camera-1?token=" + snapshotToken, status: http.StatusOK},
+		{name: "snapshot outside allowlist", remoteAddr: "10.0.0.20:5000", target: "/snapshots/camera-1?token=" + snapshotToken, status: http.StatusForbidden},
+		{name: "ingest outside allowlist", remoteAddr: "10.0.0.20:5000", target: "/ingest/", cookie: admin, status: http.StatusForbidden},
+		{name: "metrics as admin", remoteAddr: "192.168.1.5:5000", target: "/metrics", cookie: admin, status: http.StatusOK},
+		{name: "metrics as viewer", remoteAddr: "192.168.1.5:5000", target: "/metrics", cookie: viewer, status: http.StatusForbidden},
+		{name: "metrics without session", remoteAddr: "192.168.1.5:5000", target: "/metrics", status: http.StatusUnauthorized},
+		{name: "metrics outside admin allowlist", remoteAddr: "192.168.1.20:5000", target: "/metrics", cookie: admin, status: http.StatusForbidden},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestRoutesIngest(t *testing.T) {
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		cookie     auth.Role
+		csrf       string
+		status     int
+	}{
+		{name: "admin", remoteAddr: "192.168.1.5:5000", cookie: auth.RoleAdmin, csrf: "csrf-1", status: http.StatusOK},
+		{name: "admin without csrf token", remoteAddr: "192.168.1.5:5000", cookie: auth.RoleAdmin, status: http.StatusForbidden},
+		{name: "viewer", remoteAddr: "192.168.1.5:5000", cookie: auth.RoleViewer, csrf: "csrf-1", status: http.StatusForbidden},
+		{name: "no session", remoteAddr: "192.168.1.5:5000", csrf: "csrf-1", status: http.StatusUnauthorized},
+		{name: "admin outside admin allowlist", remoteAddr: "192.168.1.20:5000", cookie: auth.RoleAdmin, csrf: "csrf-1", status: http.StatusForbidden},
+	}
+
+	// sessions work the same whether or not upload scripts are also given a token
+	for _, token := range []string{"", "uploader-1"} {
+		rt := testRoutes(t)
+		rt.csrf = auth.CSRFConfig{}
+		rt.ingestToken = token
+		h := rt.handler()
+		csrf := &http.Cookie{Name: auth.CSRFCookie, Value: "csrf-1"}
+
+		for _, tc := range tcs {
+			t.Run(fmt.Sprintf("%s with token %q", tc.name, token), func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodPut, "/ingest/camera-1/clip.mp4", nil)
+				r.RemoteAddr = tc.remoteAddr
+				r.AddCookie(csrf)
+				if tc.cookie != auth.RoleNone {
+					r.AddCookie(sessionCookie(t, rt, tc.cookie))
+				}
+				if tc.csrf != "" {
+					r.Header.Set(auth.CSRFHeader, tc.csrf)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tc.status {
+					t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestRoutesTokens(t *testing.T) {
+	rt := testRoutes(t)
+	rt.csrf = auth.CSRFConfig{}
+	rt.metricsToken, rt.ingestToken = "scraper-1", "uploader-1"
+	h := rt.handler()
+	viewer, admin := sessionCookie(t, rt, auth.RoleViewer), sessionCookie(t, rt, auth.RoleAdmin)
+
+	tcs := []struct {
+		name          string
+		method        string
+		target        string
+		remoteAddr    string
+		authorization string
+		cookie        *http.Cookie
+		status        int
+	}{
+		{name: "metrics with token", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", authorization: "Bearer scraper-1", status: http.StatusOK},
+		{name: "metrics with wrong token", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", authorization: "Bearer scraper-2", status: http.StatusUnauthorized},
+		{name: "metrics with ingest token", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", authorization: "Bearer uploader-1", status: http.StatusUnauthorized},
+		{name: "metrics with admin session", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", cookie: admin, status: http.StatusOK},
+		{name: "metrics with viewer session", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", cookie: viewer, status: http.StatusForbidden},
+		{name: "metrics with admin session and wrong token", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", authorization: "Bearer scraper-2", cookie: admin, status: http.StatusUnauthorized},
+		{name: "metrics without token or session", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.5:5000", status: http.StatusUnauthorized},
+		{name: "metrics with admin session outside admin allowlist", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.20:5000", cookie: admin, status: http.StatusForbidden},
+		{name: "metrics with token outside admin allowlist", method: http.MethodGet, target: "/metrics", remoteAddr: "192.168.1.20:5000", authorization: "Bearer scraper-1", status: http.StatusForbidden},
+		{name: "ingest with token", method: http.MethodPut, target: "/ingest/camera-1/clip.mp4", remoteAddr: "192.168.1.5:5000", authorization: "Bearer uploader-1", status: http.StatusOK},
+		{name: "ingest with wrong token", method: http.MethodPut, target: "/ingest/camera-1/clip.mp4", remoteAddr: "192.168.1.5:5000", authorization: "Bearer scraper-1", status: http.StatusUnauthorized},
+		{name: "ingest with token outside admin allowlist", method: http.MethodPut, target: "/ingest/camera-1/clip.mp4", remoteAddr: "192.168.1.20:5000", authorization: "Bearer uploader-1", status: http.StatusForbidden},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestRoutesTokensWithoutSessions(t *testing.T) {
+	rt := testRoutes(t)
+	rt.sessions, rt.server.Sessions = nil, nil
+	rt.metricsToken = "scraper-1"
+	h := rt.handler()
+
+	// without sessions a token is the only way in, rather than the route being open to anyone
+	tcs := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{name: "with token", authorization: "Bearer scraper-1", status: http.StatusOK},
+		{name: "with wrong token", authorization: "Bearer scraper-2", status: http.StatusUnauthorized},
+		{name: "without token", status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = "192.168.1.5:5000"
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestRoutesRateLimit(t *testing.T) {
+	rt := testRoutes(t)
+	rt.limiter = auth.NewRateLimiter(0.001, 2)
+	h := rt.handler()
+	token, err := rt.signer.StreamToken("camera-1", auth.StreamHLS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every route counts against the same limit for an address
+	request := func(remoteAddr string, target string) int {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remoteAddr
+		r.AddCookie(sessionCookie(t, rt, auth.RoleViewer))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if status := request("192.168.1.20:5000", "/api/devices"); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+	if status := request("192.168.1.20:5000", "/hls/camera-1/index.m3u8?token="+token); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+	if status := request("192.168.1.20:5000", "/api/devices"); status != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the burst, got %d", status)
+	}
+	if status := request("192.168.1.21:5000", "/api/devices"); status != http.StatusOK {
+		t.Errorf("expected 200 for another address, got %d", status)
+	}
+}
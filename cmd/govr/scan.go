@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/scan"
+	"github.com/lmittmann/tint"
+	"github.com/nyaruka/ezconf"
+)
+
+// how often we check on the progress of a scan pushed to a server
+const scanPollInterval = time.Second
+
+type ScanConfig struct {
+	Push      bool       `help:"whether to run the scan on a running govr serve, adding new devices to its registry as pending adoption"`
+	Server    string     `help:"the URL of the govr serve to push the scan to"`
+	Include   string     `help:"comma separated CIDRs to scan in addition to local networks (optional)"`
+	Device    string     `help:"comma separated device addresses to probe directly (optional)"`
+	Interface string     `help:"comma separated interfaces to scan from, such as eth0.20 for VLAN 20 on eth0, defaults to all (optional)"`
+	VLAN      string     `help:"comma separated VLAN interfaces to create for the scan with their address, such as eth0.20=192.168.20.250/24, needs root and is ignored when pushing (optional)"`
+	Ports     string     `help:"comma separated ports to scan for cameras"`
+	MaxHosts  int        `help:"networks with more hosts than this are not port scanned unless included, at most 65536, ignored when pushing"`
+	Discovery bool       `help:"whether to find cameras using ws-discovery"`
+	PortScan  bool       `help:"whether to find cameras by scanning for open ports"`
+	RTSPScan  bool       `help:"whether to also find cameras exposing RTSP without ONVIF"`
+	Username  string     `help:"the username to use when connecting to cameras, ignored when pushing (optional)"`
+	Password  string     `help:"the password to use when connecting to cameras, ignored when pushing (optional)"`
+	Fixtures  string     `help:"a directory of canned discovery and device responses to scan instead of the network, ignored when pushing (optional)"`
+	Level     slog.Level `help:"the log level to use (optional)"`
+}
+
+// the parameters of a scan pushed to a server, as accepted by POST /api/scan
+type scanParams struct {
+	Networks    []string `json:"networks,omitempty"`
+	Addresses   []string `json:"addresses,omitempty"`
+	Interfaces  []string `json:"interfaces,omitempty"`
+	Ports       []int    `json:"ports,omitempty"`
+	WSDiscovery bool     `json:"ws_discovery"`
+	PortScan    bool     `json:"port_scan"`
+	RTSPScan    bool     `json:"rtsp_scan"`
+}
+
+func runScan() {
+	defaults := scan.DefaultOptions()
+	ports := make([]string, len(defaults.Ports))
+	for i, port := range defaults.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+	config := &ScanConfig{
+		Server:    "http://localhost:8080",
+		Ports:     strings.Join(ports, ","),
+		Discovery: defaults.WSDiscovery,
+		PortScan:  defaults.PortScan,
+		RTSPScan:  defaults.RTSPScan,
+		MaxHosts:  defaults.MaxHostsPerNetwork,
+		Level:     slog.LevelInfo,
+	}
+	loader := ezconf.NewLoader(
+		config,
+		"govr-scan", "govr scan - scan for cameras, here or on a running server",
+		[]string{},
+	)
+	loader.MustLoad()
+
+	log := slog.New(tint.NewHandler(os.Stderr, &tint.Options{Level: config.Level}))
+	fail := func(msg string, err error) {
+		log.Error(msg, slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	params := scanParams{
+		Networks:    splitList(config.Include),
+		Addresses:   splitList(config.Device),
+		Interfaces:  splitList(config.Interface),
+		WSDiscovery: config.Discovery,
+		PortScan:    config.PortScan,
+		RTSPScan:    config.RTSPScan,
+	}
+	for _, p := range splitList(config.Ports) {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			fail("invalid ports", err)
+		}
+		params.Ports = append(params.Ports, port)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.Push {
+		job, err := pushScan(ctx, log, strings.TrimSuffix(config.Server, "/"), params)
+		if err != nil {
+			fail("unable to scan", err)
+		}
+		if job.Status == scan.JobFailed {
+			log.Error("scan failed", slog.String("error", job.Error))
+			os.Exit(1)
+		}
+		log.Info("scan done", slog.Int("found", job.Found), slog.Int("failures", job.Failures), slog.Any("pending", job.New))
+		return
+	}
+
+	opts := defaults
+	opts.Ports = params.Ports
+	opts.WSDiscovery, opts.PortScan, opts.RTSPScan = params.WSDiscovery, params.PortScan, params.RTSPScan
+	opts.Addresses = params.Addresses
+	opts.MaxHostsPerNetwork = config.MaxHosts
+	for _, cidr := range params.Networks {
+		opts.IncludeCIDRs = append(opts.IncludeCIDRs, network.CIDR(cidr))
+	}
+	for _, iface := range params.Interfaces {
+		opts.Interfaces = append(opts.Interfaces, network.IFace(iface))
+	}
+	for _, v := range splitList(config.VLAN) {
+		vlan, err := network.ParseVLAN(v)
+		if err != nil {
+			fail("invalid vlan", err)
+		}
+		opts.VLANs = append(opts.VLANs, vlan)
+	}
+	if config.Username != "" {
+		opts.Credentials = []scan.Credential{{Username: config.Username, Password: config.Password}}
+	}
+	if config.Fixtures != "" {
+		fixtures, err := scan.NewFixtures(config.Fixtures)
+		if err != nil {
+			fail("unable to load fixtures", err)
+		}
+		opts.Fixtures = fixtures
+	}
+
+	summary, err := scan.Scan(ctx, log, opts, func(result scan.DeviceResult) {
+		r := scan.NewRecord(result)
+		log.Info("found device", slog.String("key", r.Key), slog.String("address", r.Address), slog.String("manufacturer", r.Manufacturer), slog.String("model", r.Model))
+	})
+	if err != nil {
+		fail("unable to scan", err)
+	}
+	log.Info("scan done", slog.Int("found", summary.Found+summary.StreamSources), slog.Int("failures", len(summary.Failures)), slog.Duration("duration", summary.Duration))
+}
+
+// starts a scan on the server at the passed in URL and follows its progress until it finishes
+func pushScan(ctx context.Context, log *slog.Logger, server string, params scanParams) (*scan.Job, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &scan.Job{}
+	if err := scanRequest(ctx, http.MethodPost, server+"/api/scan", body, http.StatusAccepted, job); err != nil {
+		return nil, err
+	}
+	log.Info("scan started", slog.String("id", job.ID))
+
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+
+	probed := -1
+	for job.Status == scan.JobRunning {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		if err := scanRequest(ctx, http.MethodGet, server+"/api/scans/"+job.ID, nil, http.StatusOK, job); err != nil {
+			return nil, err
+		}
+		if job.Candidates > 0 && job.Probed != probed {
+			probed = job.Probed
+			log.Info("scanning", slog.Int("probed", job.Probed), slog.Int("candidates", job.Candidates), slog.Int("found", job.Found))
+		}
+	}
+	return job, nil
+}
+
+// makes a request to the API of a server, decoding its response into the passed in value if it has the expected status
+func scanRequest(ctx context.Context, method string, url string, body []byte, expected int, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		apiErr := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s returned %s: %s", method, url, resp.Status, apiErr.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
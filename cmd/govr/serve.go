@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/incrementventures/govr/api"
+	"github.com/incrementventures/govr/auth"
+	cfgfile "github.com/incrementventures/govr/config"
+	"github.com/incrementventures/govr/dhcp"
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/health"
+	"github.com/incrementventures/govr/logging"
+	"github.com/incrementventures/govr/metrics"
+	"github.com/incrementventures/govr/mqtt"
+	"github.com/incrementventures/govr/notify"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/provision"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/registry"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/speaker"
+	"github.com/incrementventures/govr/stream"
+	"github.com/incrementventures/govr/supervisor"
+	"github.com/incrementventures/govr/syslog"
+	"github.com/lmittmann/tint"
+	"github.com/nyaruka/ezconf"
+)
+
+type ServeConfig struct {
+	Address             string     `help:"the address to serve the API and live streams on"`
+	RTSPPort            int        `help:"the port to restream cameras over RTSP on, 0 to disable"`
+	DataDir             string     `help:"the govr data directory"`
+	Config              string     `help:"a YAML file declaring cameras, credentials and recording policies, reloaded on SIGHUP (optional)"`
+	RecordDir           string     `help:"the directory recordings are indexed in, empty if not recording"`
+	IngestDir           string     `help:"the directory watched for external footage to add to recordings, empty if not ingesting"`
+	IngestMaxMB         int        `help:"the largest footage upload accepted in megabytes"`
+	IngestToken         string     `help:"a bearer token footage can be uploaded to /ingest/ with as well as an admin session (optional)"`
+	Username            string     `help:"the username to use when connecting to cameras (optional)"`
+	Password            string     `help:"the password to use when connecting to cameras (optional)"`
+	Rescan              int        `help:"seconds between full network rescans"`
+	Liveness            int        `help:"seconds between checks that known devices are still alive"`
+	MaxHosts            int        `help:"networks with more hosts than this are not port scanned unless included, at most 65536"`
+	Fixtures            string     `help:"a directory of canned discovery and device responses to scan instead of the network, for demos and testing (optional)"`
+	DiscoveryGroup      string     `help:"the IPv4 multicast group to send ws-discovery probes to, defaults to 239.255.255.250 (optional)"`
+	DiscoveryGroup6     string     `help:"the IPv6 multicast group to send ws-discovery probes to, defaults to ff02::c (optional)"`
+	DiscoveryPort       int        `help:"the port to send ws-discovery probes to, defaults to 3702 (optional)"`
+	DiscoverySourcePort int        `help:"the port to send ws-discovery probes from, for ACLs which only allow a specific port, defaults to any (optional)"`
+	STUN                string     `help:"comma separated STUN servers used to gather WebRTC candidates (optional)"`
+	StreamTokenTTL      int        `help:"seconds the tokens in links to live streams last, how long a player can watch from one link"`
+	Transcode           bool       `help:"whether to transcode H.265 cameras to H.264 for HLS, with hardware encoding where available"`
+	NativeHLS           bool       `help:"whether to package H.264 and H.265 cameras as HLS without ffmpeg, which leaves out their audio"`
+	DHCPLeases          string     `help:"comma separated DHCP lease files from dnsmasq, Kea or exported from Windows, used to follow cameras as their addresses change (optional)"`
+	DHCPListen          string     `help:"the address to listen for DHCP traffic on to follow cameras as their addresses change, such as :67 (optional)"`
+	Syslog              string     `help:"the address to receive syslog from cameras on, such as :514 (optional)"`
+	Metrics             bool       `help:"whether to serve Prometheus metrics at /metrics, to admins"`
+	MetricsToken        string     `help:"a bearer token Prometheus can scrape /metrics with as well as an admin session (optional)"`
+	OIDCIssuer          string     `help:"the issuer URL of an OpenID Connect provider users must log in with, anyone who can reach us can do anything without one (optional)"`
+	OIDCClientID        string     `help:"the client ID we are registered with at the OpenID Connect provider"`
+	OIDCClientSecret    string     `help:"the client secret we are registered with at the OpenID Connect provider"`
+	OIDCRedirectURL     string     `help:"our /auth/callback URL as registered with the OpenID Connect provider"`
+	OIDCAdminGroups     string     `help:"comma separated groups whose members are admins"`
+	OIDCViewerGroups    string     `help:"comma separated groups whose members are viewers"`
+	OIDCDefaultRole     string     `help:"the role of users in none of the above groups, viewer, admin or empty to deny them (optional)"`
+	SessionTTL          int        `help:"seconds users stay logged in for"`
+	SecureCookies       bool       `help:"whether our cookies are only sent over HTTPS, set when served behind a TLS proxy"`
+	Allowlist           string     `help:"comma separated IPs and CIDRs allowed to use any route, empty allows any (optional)"`
+	AdminAllowlist      string     `help:"comma separated IPs and CIDRs allowed to use admin routes, empty allows any (optional)"`
+	CORSOrigins         string     `help:"comma separated origins of separately hosted frontends allowed to call the API, * for any without credentials (optional)"`
+	Alert               string     `help:"a shell command run with each camera health alert as JSON on its stdin (optional)"`
+	Level               slog.Level `help:"the log level to use (optional)"`
+}
+
+func runServe() {
+	config := &ServeConfig{
+		Address:        ":8080",
+		RTSPPort:       8554,
+		DataDir:        "data",
+		Rescan:         300,
+		Liveness:       30,
+		MaxHosts:       scan.DefaultMaxHosts,
+		IngestMaxMB:    4096,
+		StreamTokenTTL: 3600,
+		SessionTTL:     43200,
+		Level:          slog.LevelInfo,
+	}
+	loader := ezconf.NewLoader(
+		config,
+		"govr-serve", "govr serve - run a headless NVR serving a JSON API and live streams",
+		[]string{},
+	)
+	loader.MustLoad()
+
+	// our log levels can be changed at runtime through the API, so they do the filtering rather than tint
+	levels := logging.NewLevels(config.Level, 1000)
+	log := slog.New(logging.NewHandler(tint.NewHandler(os.Stderr, &tint.Options{Level: slog.LevelDebug}), levels))
+	fail := func(msg string, err error) {
+		log.Error(msg, slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		fail("unable to create data directory", err)
+	}
+	cameras, err := registry.OpenCameras(filepath.Join(config.DataDir, "cameras.json"))
+	if err != nil {
+		fail("unable to open camera registry", err)
+	}
+
+	opts := scan.DefaultOptions()
+	opts.MaxHostsPerNetwork = config.MaxHosts
+	if config.Username != "" {
+		opts.Credentials = []scan.Credential{{Username: config.Username, Password: config.Password}}
+	}
+	opts.Discovery = onvif.DiscoveryConfig{Group: config.DiscoveryGroup, Group6: config.DiscoveryGroup6, Port: config.DiscoveryPort, SourcePort: config.DiscoverySourcePort}
+	if err := opts.Discovery.Validate(); err != nil {
+		fail("invalid discovery options", err)
+	}
+	if config.Fixtures != "" {
+		if opts.Fixtures, err = scan.NewFixtures(config.Fixtures); err != nil {
+			fail("unable to load fixtures", err)
+		}
+		log.Warn("scanning fixtures rather than the network", slog.String("fixtures", config.Fixtures))
+	}
+
+	// DHCP leases give us the MACs of cameras beyond our neighbor table, and tell us as soon as cameras move
+	var leases *dhcp.Table
+	if config.DHCPLeases != "" || config.DHCPListen != "" {
+		leases = dhcp.NewTable(log, splitList(config.DHCPLeases), 10*time.Second)
+		opts.MACFor = leases.MACOf
+	}
+
+	// cameras declared by their registry ID have their credentials tried wherever the registry last saw them
+	optionsOf := func(c *cfgfile.Config) scan.Options {
+		o := c.Apply(opts)
+		o.CredentialsFor = func(host string) []scan.Credential {
+			camera, _ := cameras.AtHost(host)
+			return c.CredentialsForCamera(camera.ID, host)
+		}
+		return o
+	}
+
+	var watcher *cfgfile.Watcher
+	monitorOpts := opts
+	if config.Config != "" {
+		var err error
+		if watcher, err = cfgfile.NewWatcher(log, config.Config); err != nil {
+			fail("unable to load config", err)
+		}
+		monitorOpts = optionsOf(watcher.Current())
+		adoptDeclared(log, cameras, watcher.Current())
+	}
+	monitor := scan.NewMonitor(log, monitorOpts, time.Duration(config.Rescan)*time.Second, time.Duration(config.Liveness)*time.Second)
+
+	// devices we've probed before are known as soon as we start, and only probed again once their results need
+	// refreshing or their stream URIs may not have survived them rebooting
+	probes, err := registry.OpenProbeStore(filepath.Join(config.DataDir, "probes.json"))
+	if err != nil {
+		fail("unable to open probe store", err)
+	}
+	monitor.Probes = probes.Cache(registry.DefaultReprobePolicy)
+	if leases != nil {
+		leases.OnLease = func(lease dhcp.Lease) { relocate(ctx, log, cameras, monitor, lease) }
+	}
+	changes, err := provision.OpenQueue(filepath.Join(config.DataDir, "changes.json"))
+	if err != nil {
+		fail("unable to open change queue", err)
+	}
+
+	// the tokens we issue, such as those of share links, are signed with a key kept alongside our registry so that
+	// they stay valid when we restart
+	key, err := auth.LoadKey(filepath.Join(config.DataDir, "signing.key"))
+	if err != nil {
+		fail("unable to load signing key", err)
+	}
+	signer := auth.NewSigner(key)
+	shares, err := auth.OpenShareStore(filepath.Join(config.DataDir, "shares.json"), signer)
+	if err != nil {
+		fail("unable to open shares", err)
+	}
+
+	// we only serve the addresses we allow, with admin routes allowed to fewer, and rate limit every address with
+	// admin routes and logins limited further and addresses which keep failing to log in locked out for a while
+	allowlist, err := auth.NewAllowlist(splitList(config.Allowlist))
+	if err != nil {
+		fail("invalid allowlist", err)
+	}
+	adminAllowlist, err := auth.NewAllowlist(splitList(config.AdminAllowlist))
+	if err != nil {
+		fail("invalid admin allowlist", err)
+	}
+	limiter := auth.NewRateLimiter(50, 200)
+	adminLimiter := auth.NewRateLimiter(10, 50)
+	loginLimiter := auth.NewRateLimiter(1, 5)
+	lockout := auth.NewLockout(5, 15*time.Minute, 15*time.Minute)
+
+	// users log in with an OpenID Connect provider whose groups give them their roles, if we have one
+	var sessions *auth.Sessions
+	if config.OIDCIssuer != "" {
+		oidcConfig := auth.OIDCConfig{
+			Issuer:       config.OIDCIssuer,
+			ClientID:     config.OIDCClientID,
+			ClientSecret: config.OIDCClientSecret,
+			RedirectURL:  config.OIDCRedirectURL,
+			GroupRoles:   map[string]auth.Role{},
+			DefaultRole:  auth.Role(config.OIDCDefaultRole),
+		}
+		for _, group := range splitList(config.OIDCViewerGroups) {
+			oidcConfig.GroupRoles[group] = auth.RoleViewer
+		}
+		for _, group := range splitList(config.OIDCAdminGroups) {
+			oidcConfig.GroupRoles[group] = auth.RoleAdmin
+		}
+		provider, err := auth.NewOIDCProvider(ctx, oidcConfig)
+		if err != nil {
+			fail("unable to load oidc provider", err)
+		}
+		sessions = auth.NewSessions(provider, signer, time.Duration(config.SessionTTL)*time.Second, config.SecureCookies)
+		sessions.Lockout = lockout
+	} else {
+		log.Warn("no oidc issuer configured, anyone who can reach the api can do anything")
+	}
+
+	// cameras pointed at our syslog receiver have what they log kept per camera
+	var logs *syslog.Store
+	if config.Syslog != "" {
+		var err error
+		if logs, err = syslog.OpenStore(filepath.Join(config.DataDir, "syslog"), 0); err != nil {
+			fail("unable to open syslog store", err)
+		}
+		defer logs.Close()
+	}
+
+	// each camera's recorders, live streams, motion detection and backfill run under a supervisor so that a panic in
+	// one restarts only it rather than taking us down
+	tasks := newSupervisor(log)
+
+	// requests we repeat against cameras, such as health checks and snapshots for motion detection, go through a
+	// breaker per camera so those which keep failing are left alone for a while
+	breakers := health.NewBreakers(health.BreakerConfig{})
+
+	var index *record.Index
+	var events *record.Events
+	if config.RecordDir != "" {
+		var err error
+		if index, err = record.OpenIndex(filepath.Join(config.RecordDir, "index.jsonl")); err != nil {
+			fail("unable to open recording index", err)
+		}
+		defer index.Close()
+		if events, err = record.OpenEvents(filepath.Join(config.RecordDir, "events.jsonl"), index); err != nil {
+			fail("unable to open events", err)
+		}
+		defer events.Close()
+	}
+
+	// notifications are sent to the webhooks in our config, if we have one
+	dispatcher := notify.NewDispatcher(log, notify.Config{})
+	if watcher != nil {
+		dispatcher.SetWebhooks(watcher.Current().Notifications.Webhooks)
+	}
+
+	// and published to MQTT along with the state of each camera
+	var publisher *mqtt.Publisher
+	if watcher != nil && watcher.Current().Notifications.MQTT != nil {
+		var err error
+		if publisher, err = mqtt.NewPublisher(log, *watcher.Current().Notifications.MQTT); err != nil {
+			fail("unable to create mqtt publisher", err)
+		}
+		dispatcher.OnNotification = publisher.Notify
+	}
+
+	// completed segments are indexed and linked to the events they cover, with any gap since the last segment of
+	// their camera notified
+	onSegment := func(s record.Segment) {
+		if last, found := index.Last(s.Camera); found && s.Start.Sub(last.End) > index.GapTolerance {
+			dispatcher.Notify(notify.TypeRecordingGap, s.Camera, s.Start, record.Gap{Start: last.End, End: s.Start})
+		}
+		if err := index.Add(s); err != nil {
+			log.Error("error indexing segment", slog.String("path", s.Path), slog.String("error", err.Error()))
+		}
+		if err := events.Link(s); err != nil {
+			log.Error("error linking segment to events", slog.String("path", s.Path), slog.String("error", err.Error()))
+		}
+	}
+
+	// declared cameras are recorded and have their retention enforced when we have somewhere to record them
+	var recorders *recordings
+	var retention *record.Retention
+	if watcher != nil && config.RecordDir != "" {
+		var command func(health.Alert)
+		if config.Alert != "" {
+			command = alertCommand(log, config.Alert)
+		}
+		onAlert := func(alert health.Alert) {
+			dispatcher.Notify(notify.TypeCameraHealth, alert.Camera, alert.Time, alert)
+			if command != nil {
+				command(alert)
+			}
+		}
+		recorders = newRecordings(log, tasks, config.RecordDir, monitor, cameras, onSegment, onAlert)
+		recorders.logs = logs
+		recorders.breakers = breakers
+		retention = record.NewRetention(log, watcher.Current().RetentionConfig(config.RecordDir))
+		retention.OnRemove = func(s record.Segment) {
+			if err := index.Remove(s); err != nil {
+				log.Error("error removing segment from index", slog.String("path", s.Path), slog.String("error", err.Error()))
+			}
+			if err := events.Unlink(s); err != nil {
+				log.Error("error unlinking segment from events", slog.String("path", s.Path), slog.String("error", err.Error()))
+			}
+		}
+	}
+	// recorded cameras which keep their own recordings have gaps in ours filled from them
+	var backfillers *backfills
+	if recorders != nil {
+		backfillers = newBackfills(log, tasks, config.RecordDir, index, monitor, cameras, onSegment)
+	}
+
+	// cameras in groups which switch between day and night are switched once they've been found
+	var dayNight *dayNights
+	if watcher != nil {
+		dayNight = newDayNights(log, monitor, cameras)
+	}
+
+	// cameras with a deterrent flash their white light when a person is detected on them at night, by their day/night
+	// switching if they have any
+	var deterrent *deterrents
+	if watcher != nil {
+		deterrent = newDeterrents(log, monitor, cameras, dayNight)
+	}
+
+	// cameras with motion detection send the same notifications whichever way their motion is detected
+	var motions *detectors
+	if watcher != nil {
+		motions = newDetectors(log, tasks, monitor, cameras, func(camera string, active bool, at time.Time) {
+			if active {
+				dispatcher.Notify(notify.TypeMotionStart, camera, at, nil)
+			} else {
+				dispatcher.Notify(notify.TypeMotionStop, camera, at, nil)
+			}
+		})
+		motions.breakers = breakers
+	}
+
+	if watcher != nil {
+		watcher.OnReload = func(c *cfgfile.Config) {
+			dispatcher.SetWebhooks(c.Notifications.Webhooks)
+			adoptDeclared(log, cameras, c)
+			monitor.SetOptions(optionsOf(c))
+			monitor.Rescan()
+			dayNight.apply(ctx, c)
+			deterrent.apply(ctx, c)
+			motions.apply(ctx, c)
+			if recorders != nil {
+				recorders.apply(ctx, c)
+				backfillers.apply(ctx, c)
+				rc := c.RetentionConfig(config.RecordDir)
+				retention.SetQuotas(rc.Global, rc.Cameras)
+			}
+		}
+	}
+
+	var ingester *record.Ingester
+	if config.IngestDir != "" {
+		if config.RecordDir == "" {
+			fail("unable to ingest footage", errors.New("ingesting footage requires a record directory"))
+		}
+		var err error
+		if ingester, err = record.NewIngester(log, record.IngestConfig{Dir: config.IngestDir, RecordDir: config.RecordDir, MaxUploadBytes: int64(config.IngestMaxMB) << 20}); err != nil {
+			fail("unable to create ingester", err)
+		}
+		ingester.OnSegment = onSegment
+	}
+
+	apiConfig := api.Config{
+		HLSPrefix:      "/hls/",
+		WebRTCPrefix:   "/webrtc/",
+		SnapshotPrefix: "/snapshots/",
+		RTSPPort:       config.RTSPPort,
+		StreamTokenTTL: time.Duration(config.StreamTokenTTL) * time.Second,
+	}
+	server := api.New(log, apiConfig, monitor, cameras, changes, index, events)
+	if recorders != nil {
+		server.Health = recorders.health
+	}
+	server.Logs = logs
+	server.Levels = levels
+	server.Sessions = sessions
+	server.AdminAllowlist = adminAllowlist
+	server.AdminLimiter = adminLimiter
+	server.Signer = signer
+	server.Shares = shares
+	server.Speaker = speaker.NewPlayer(log, 10*time.Second)
+	if watcher != nil {
+		server.OnEvent = func(e record.Event) { deterrent.onEvent(e, time.Now()) }
+		server.Adopt = watcher.Adopt
+		server.NameOf = func(c registry.Camera) string {
+			if declared := watcher.Current().Match(scan.Record{Key: c.Key, Address: c.Address}, c.ID); declared != nil {
+				return declared.Name
+			}
+			return ""
+		}
+	}
+
+	// devices found by on demand scans which we haven't seen before wait to be adopted, the monitor keeps track of
+	// them meanwhile as its own rescans may not reach them
+	server.Scans = scan.NewJobs(ctx, log, func(result scan.DeviceResult) (string, bool) {
+		record := scan.NewRecord(result)
+		camera, added, err := cameras.AddPending(record, time.Now())
+		if err != nil {
+			log.Error("error adding pending camera", slog.String("key", record.Key), slog.String("error", err.Error()))
+		}
+		if added {
+			monitor.Track(ctx, result)
+		}
+		return camera.ID, added
+	})
+
+	hlsConfig := stream.HLSConfig{Dir: filepath.Join(config.DataDir, "hls"), Native: config.NativeHLS}
+	if config.Transcode {
+		hlsConfig.Transcoder = ffmpeg.NewTranscoder(log, "")
+	}
+	hls := stream.NewHLS(log, hlsConfig, server.Resolve)
+	hls.Supervisor = tasks
+	snapshots := stream.NewSnapshots(log, stream.SnapshotConfig{}, server.Resolve)
+	iceServers := []stream.ICEServer{}
+	for _, url := range strings.Split(config.STUN, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			iceServers = append(iceServers, stream.ICEServer{URLs: []string{url}})
+		}
+	}
+	webrtc, err := stream.NewWebRTC(log, stream.WebRTCConfig{ICEServers: iceServers}, server.Resolve)
+	if err != nil {
+		fail("unable to create webrtc gateway", err)
+	}
+
+	// frontends on the origins we allow may call us from browsers, with state changing requests needing the CSRF
+	// token we return in a header of every response as sessions are kept in cookies
+	corsOrigins := splitList(config.CORSOrigins)
+	corsConfig := auth.CORSConfig{AllowedOrigins: corsOrigins, AllowCredentials: !slices.Contains(corsOrigins, "*")}
+	csrfConfig := auth.CSRFConfig{TrustedOrigins: corsOrigins, Secure: config.SecureCookies}
+
+	rt := &routes{
+		server:         server,
+		sessions:       sessions,
+		signer:         signer,
+		hls:            hls,
+		webrtc:         webrtc,
+		snapshots:      snapshots,
+		metricsToken:   config.MetricsToken,
+		ingestToken:    config.IngestToken,
+		allowlist:      allowlist,
+		limiter:        limiter,
+		adminAllowlist: adminAllowlist,
+		adminLimiter:   adminLimiter,
+		loginLimiter:   loginLimiter,
+		cors:           corsConfig,
+		csrf:           csrfConfig,
+	}
+	if ingester != nil {
+		rt.ingest = ingester
+	}
+	if config.Metrics {
+		rt.metrics = metrics.Handler()
+	}
+	httpServer := &http.Server{Addr: config.Address, Handler: rt.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	wg := sync.WaitGroup{}
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	run(func() { monitor.Run(ctx) })
+	run(func() {
+		<-ctx.Done()
+		server.Scans.Wait()
+	})
+	run(func() { dispatcher.Run(ctx) })
+	run(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := shares.Prune(); err != nil {
+					log.Error("error pruning expired shares", slog.String("error", err.Error()))
+				}
+				limiter.Prune()
+				adminLimiter.Prune()
+				loginLimiter.Prune()
+				lockout.Prune()
+			}
+		}
+	})
+	if publisher != nil {
+		run(func() { publisher.Run(ctx) })
+	}
+	run(func() {
+		for e := range monitor.Events() {
+			log.Info("device "+string(e.Type), slog.String("key", e.Record.Key), slog.String("address", e.Record.Address))
+			if e.Type == scan.EventOnline || e.Type == scan.EventChanged {
+				camera, err := cameras.Observe(e.Record, e.Time)
+				if err != nil {
+					log.Error("error updating camera registry", slog.String("key", e.Record.Key), slog.String("error", err.Error()))
+				}
+				if watcher != nil && !camera.Adopted() {
+					adoptDeclared(log, cameras, watcher.Current())
+				}
+
+				// changes requested while the camera was away are applied now it is back
+				if result, found := monitor.Result(e.Record.Key); found && result.Device != nil && changes.Pending(camera.ID) {
+					go changes.Apply(log, camera.ID, result.Device)
+				}
+			}
+
+			// new devices are only assigned their ID once observed above
+			switch e.Type {
+			case scan.EventOnline:
+				dispatcher.Notify(notify.TypeDeviceOnline, cameraID(cameras, e.Record.Key), e.Time, e.Record)
+			case scan.EventOffline:
+				dispatcher.Notify(notify.TypeDeviceOffline, cameraID(cameras, e.Record.Key), e.Time, e.Record)
+			case scan.EventChanged:
+				if publisher != nil {
+					publisher.Device(cameraID(cameras, e.Record.Key), e.Record, true)
+				}
+			case scan.EventConflict:
+				dispatcher.Notify(notify.TypeConflict, "", e.Time, e.Conflict)
+			case scan.EventConflictResolved:
+				dispatcher.Notify(notify.TypeConflictResolved, "", e.Time, e.Conflict)
+			}
+			if recorders != nil && (e.Type == scan.EventOnline || e.Type == scan.EventChanged) {
+				recorders.apply(ctx, watcher.Current())
+				backfillers.apply(ctx, watcher.Current())
+			}
+			if watcher != nil && (e.Type == scan.EventOnline || e.Type == scan.EventChanged) {
+				dayNight.apply(ctx, watcher.Current())
+				motions.apply(ctx, watcher.Current())
+			}
+		}
+	})
+	if watcher != nil {
+		run(func() { watcher.Run(ctx) })
+		dayNight.apply(ctx, watcher.Current())
+		deterrent.apply(ctx, watcher.Current())
+		motions.apply(ctx, watcher.Current())
+		run(func() {
+			<-ctx.Done()
+			dayNight.wait()
+			deterrent.wait()
+			motions.wait()
+		})
+	}
+	if recorders != nil {
+		recorders.apply(ctx, watcher.Current())
+		backfillers.apply(ctx, watcher.Current())
+		run(func() {
+			retention.Run(ctx)
+			recorders.wait()
+			backfillers.wait()
+		})
+
+		// cameras recorded only at certain times of day are started and stopped as those times come around
+		run(func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					recorders.apply(ctx, watcher.Current())
+				}
+			}
+		})
+	}
+	if leases != nil {
+		run(func() { leases.Run(ctx) })
+	}
+	if config.DHCPListen != "" {
+		run(func() {
+			if err := dhcp.Listen(ctx, config.DHCPListen, leases.Add); err != nil {
+				fail("dhcp listener failed", err)
+			}
+		})
+	}
+	if config.Syslog != "" {
+		run(func() {
+			err := syslog.Listen(ctx, config.Syslog, func(m syslog.Message) {
+				if err := logs.Add(syslogDevice(cameras, m.Host), m); err != nil {
+					log.Error("error storing syslog message", slog.String("host", m.Host), slog.String("error", err.Error()))
+				}
+			})
+			if err != nil {
+				fail("syslog receiver failed", err)
+			}
+		})
+	}
+	run(func() { hls.Run(ctx) })
+	run(func() {
+		<-ctx.Done()
+		tasks.Wait()
+	})
+	run(func() { snapshots.Run(ctx) })
+	run(func() { webrtc.Run(ctx) })
+	if ingester != nil {
+		run(func() {
+			if err := ingester.Run(ctx); err != nil {
+				fail("ingest failed", err)
+			}
+		})
+	}
+	if config.RTSPPort != 0 {
+		rtspConfig := stream.RTSPConfig{
+			Addr: ":" + strconv.Itoa(config.RTSPPort),
+			Authorize: func(camera string, token string) error {
+				return signer.VerifyStreamToken(token, camera, auth.StreamRTSP)
+			},
+		}
+		rtspServer := stream.NewRTSPServer(log, rtspConfig, server.Resolve)
+		run(func() {
+			if err := rtspServer.Run(ctx); err != nil {
+				fail("rtsp server failed", err)
+			}
+		})
+	}
+	run(func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdown)
+	})
+
+	log.Info("serving", slog.String("address", config.Address))
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fail("http server failed", err)
+	}
+	wg.Wait()
+}
+
+// adopts any cameras pending adoption, or rejected, which the passed in config declares, declaring a camera being
+// how it is approved
+func adoptDeclared(log *slog.Logger, cameras *registry.Cameras, cfg *cfgfile.Config) {
+	for _, camera := range cameras.All() {
+		if camera.Adopted() || cfg.Match(scan.Record{Key: camera.Key, Address: camera.Address}, camera.ID) == nil {
+			continue
+		}
+		if _, err := cameras.Adopt(camera.ID); err != nil {
+			log.Error("error adopting declared camera", slog.String("id", camera.ID), slog.String("error", err.Error()))
+			continue
+		}
+		log.Info("declared camera adopted", slog.String("id", camera.ID), slog.String("address", camera.Address))
+	}
+}
+
+// returns a supervisor which counts the crashes of its tasks in our metrics
+func newSupervisor(log *slog.Logger) *supervisor.Supervisor {
+	s := supervisor.New(log)
+	s.OnCrash = func(report supervisor.CrashReport) {
+		taskCrashes.With(report.Task).Inc()
+	}
+	return s
+}
+
+// returns the registry ID of the device with the passed in key, or its key if it hasn't been assigned one
+func cameraID(cameras *registry.Cameras, key string) string {
+	if c, found := cameras.ByKey(key); found {
+		return c.ID
+	}
+	return key
+}
+
+// returns the device the syslog of the passed in host is kept under, which may be given as an address or URL, the ID
+// of the camera there if we know it so that its log follows it when its address changes, otherwise the host itself
+func syslogDevice(cameras *registry.Cameras, host string) string {
+	if camera, found := cameras.AtHost(host); found {
+		return camera.ID
+	}
+	if u, err := url.Parse(host); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// moves the camera with the MAC of the passed in lease to its leased address, probing it there so that the monitor
+// follows it without waiting for its next rescan
+func relocate(ctx context.Context, log *slog.Logger, cameras *registry.Cameras, monitor *scan.Monitor, lease dhcp.Lease) {
+	camera, moved, err := cameras.Relocate(lease.MAC, lease.IP, lease.Seen)
+	if err != nil {
+		log.Error("error relocating camera", slog.String("id", camera.ID), slog.String("error", err.Error()))
+	}
+	if !moved {
+		return
+	}
+	log.Info("camera address leased", slog.String("id", camera.ID), slog.String("mac", lease.MAC), slog.String("address", camera.Address))
+
+	// only ONVIF devices can be probed at a single address, anything else is found again by a rescan
+	if camera.Endpoint == "" && !strings.HasPrefix(camera.Address, "http") {
+		monitor.Rescan()
+		return
+	}
+	go func() {
+		result, err := scan.ProbeDevice(log, camera.Address, monitor.Options())
+		if err != nil {
+			log.Warn("unable to probe relocated camera, rescanning", slog.String("id", camera.ID), slog.String("error", err.Error()))
+			monitor.Rescan()
+			return
+		}
+		monitor.Track(ctx, *result)
+	}()
+}
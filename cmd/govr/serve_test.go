@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestSupervisorCrashes(t *testing.T) {
+	tasks := newSupervisor(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tasks.MinBackoff = 0
+
+	runs := 0
+	tasks.Run(context.Background(), "recorder:crashy", func(ctx context.Context) error {
+		runs++
+		if runs < 3 {
+			panic("bad frame")
+		}
+		return nil
+	})
+	if crashes := taskCrashes.With("recorder:crashy").Value(); crashes != 2 {
+		t.Errorf("expected 2 crashes counted, got %v", crashes)
+	}
+	if crashes := taskCrashes.With("recorder:other").Value(); crashes != 0 {
+		t.Errorf("expected no crashes counted for other tasks, got %v", crashes)
+	}
+}
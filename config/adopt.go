@@ -0,0 +1,188 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/incrementventures/govr/schedule"
+)
+
+// ErrInvalidAdoption is returned when an adoption can't be declared as asked, such as for a name already taken
+var ErrInvalidAdoption = errors.New("invalid adoption")
+
+// Adoption is how a discovered camera is declared once it has been approved, with the same meaning as the fields of
+// a declared Camera, and the group it joins if any
+type Adoption struct {
+	Name     string   `json:"name"`
+	Group    string   `json:"group,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Profiles []string `json:"profiles,omitempty"`
+
+	Record       bool             `json:"record"`
+	Format       string           `json:"format,omitempty"`
+	RecordDuring schedule.Periods `json:"record_during,omitempty"`
+
+	// how much of its recording to keep, in the same form as the config file such as 30d or 500GB
+	MaxAge   string `json:"max_age,omitempty"`
+	MaxBytes string `json:"max_bytes,omitempty"`
+}
+
+// the YAML an adopted camera is declared with, leaving out anything not set so it reads as if written by hand
+type adoptedCamera struct {
+	Name         string           `yaml:"name"`
+	ID           string           `yaml:"id"`
+	Username     string           `yaml:"username,omitempty"`
+	Password     string           `yaml:"password,omitempty"`
+	Profiles     []string         `yaml:"profiles,omitempty"`
+	Record       bool             `yaml:"record,omitempty"`
+	Format       string           `yaml:"format,omitempty"`
+	Retention    *adoptedQuota    `yaml:"retention,omitempty"`
+	RecordDuring schedule.Periods `yaml:"record_during,omitempty"`
+}
+
+type adoptedQuota struct {
+	MaxAge   string `yaml:"max_age,omitempty"`
+	MaxBytes string `yaml:"max_bytes,omitempty"`
+}
+
+// Adopt declares the discovered camera with the passed in registry ID in the config file at the passed in path, as
+// described by the passed in adoption. Comments in the file are kept, though it is reformatted, and it is only
+// written if the result is valid.
+func Adopt(path string, id string, a Adoption) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config %q: %w", path, err)
+	}
+	current, err := parse(path, b)
+	if err != nil {
+		return err
+	}
+	for _, camera := range current.Cameras {
+		if camera.ID == id {
+			return fmt.Errorf("%w: %s is already declared as %q", ErrInvalidAdoption, id, camera.Name)
+		}
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return fmt.Errorf("error parsing config %q: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc.Kind = yaml.DocumentNode
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("error parsing config %q: expected a mapping", path)
+	}
+
+	declared := adoptedCamera{
+		Name:         a.Name,
+		ID:           id,
+		Username:     a.Username,
+		Password:     a.Password,
+		Profiles:     a.Profiles,
+		Record:       a.Record,
+		Format:       a.Format,
+		RecordDuring: a.RecordDuring,
+	}
+	if a.MaxAge != "" || a.MaxBytes != "" {
+		declared.Retention = &adoptedQuota{MaxAge: a.MaxAge, MaxBytes: a.MaxBytes}
+	}
+	camera := &yaml.Node{}
+	if err := camera.Encode(declared); err != nil {
+		return fmt.Errorf("error encoding camera: %w", err)
+	}
+	cameras := sequenceOf(root, "cameras")
+	cameras.Content = append(cameras.Content, camera)
+
+	// flow style such as [] reads badly once it holds mappings
+	cameras.Style &^= yaml.FlowStyle
+
+	if a.Group != "" {
+		var group *yaml.Node
+		for _, g := range sequenceOf(root, "groups").Content {
+			if name := valueOf(g, "name"); name != nil && name.Value == a.Group {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			return fmt.Errorf("%w: no group %q", ErrInvalidAdoption, a.Group)
+		}
+		members := sequenceOf(group, "cameras")
+		members.Content = append(members.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: a.Name})
+	}
+
+	out := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+	if _, err := parse(path, out.Bytes()); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidAdoption, err)
+	}
+	return writeFile(path, out.Bytes())
+}
+
+// returns the value of the passed in key of a mapping node, nil if it doesn't have one
+func valueOf(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// returns the sequence which is the value of the passed in key of a mapping node, adding it if it is missing or null
+func sequenceOf(mapping *yaml.Node, key string) *yaml.Node {
+	value := valueOf(mapping, key)
+	if value == nil {
+		value = &yaml.Node{}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	}
+	if value.Kind != yaml.SequenceNode {
+		*value = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	return value
+}
+
+// writes the passed in contents to the file at the passed in path atomically, keeping its permissions
+func writeFile(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error writing config %q: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return fmt.Errorf("error creating config temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing config %q: %w", path, err)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing config %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing config %q: %w", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,622 @@
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/incrementventures/govr/motion"
+	"github.com/incrementventures/govr/mqtt"
+	"github.com/incrementventures/govr/notify"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/record"
+	"github.com/incrementventures/govr/scan"
+	"github.com/incrementventures/govr/schedule"
+)
+
+// Config is the cameras, credentials and recording policies declared in a YAML file
+type Config struct {
+	// credentials to try, in order, with any camera not declared with its own
+	Credentials []scan.Credential `yaml:"credentials"`
+
+	// whether to also discover cameras on the network, when false only declared cameras are used
+	Discover *bool `yaml:"discover"`
+
+	// where the cameras are, used to work out sunrise and sunset
+	Site schedule.Site `yaml:"site"`
+
+	Recording     Recording     `yaml:"recording"`
+	Cameras       []Camera      `yaml:"cameras"`
+	Groups        []Group       `yaml:"groups"`
+	Notifications Notifications `yaml:"notifications"`
+
+	// known good and bad firmware of camera models, cameras running bad firmware are flagged in their health
+	Firmware []FirmwareAdvisory `yaml:"firmware"`
+}
+
+// Group is a set of declared cameras which share settings
+type Group struct {
+	Name string `yaml:"name"`
+
+	// the names of the cameras in this group
+	Cameras []string `yaml:"cameras"`
+
+	// where the cameras in this group are if not at the site
+	Site *schedule.Site `yaml:"site"`
+
+	// how the cameras in this group switch between day and night, they are left alone if nil
+	DayNight *DayNight `yaml:"day_night"`
+}
+
+// DayNight is how a group of cameras switches between day and night, see schedule.DayNight
+type DayNight struct {
+	// one of auto, which goes by the gain the camera's exposure settles on falling back to the sun, sun or camera,
+	// defaults to auto
+	Mode string `yaml:"mode"`
+
+	SunriseOffset Duration `yaml:"sunrise_offset"`
+	SunsetOffset  Duration `yaml:"sunset_offset"`
+	NightGain     float64  `yaml:"night_gain"`
+	DayGain       float64  `yaml:"day_gain"`
+	DayExposure   string   `yaml:"day_exposure"`
+	NightExposure string   `yaml:"night_exposure"`
+	Autofocus     bool     `yaml:"autofocus"`
+}
+
+// Notifications is where notifications of device, motion and recording events are sent
+type Notifications struct {
+	Webhooks []notify.Webhook `yaml:"webhooks"`
+
+	// the MQTT broker camera state and notifications are published to, only read at startup
+	MQTT *mqtt.Config `yaml:"mqtt"`
+}
+
+// Recording is the recording policy applied to every camera which doesn't override it
+type Recording struct {
+	SegmentDuration Duration `yaml:"segment_duration"`
+	Format          string   `yaml:"format"`
+
+	// the limit across all cameras, its max age is also the default for each camera
+	Retention Retention `yaml:"retention"`
+}
+
+// Retention limits how much recording is kept, zero fields are unlimited
+type Retention struct {
+	MaxAge   Duration `yaml:"max_age"`
+	MaxBytes ByteSize `yaml:"max_bytes"`
+}
+
+// Quota returns this retention as a recording quota
+func (r Retention) Quota() record.Quota {
+	return record.Quota{MaxAge: time.Duration(r.MaxAge), MaxBytes: int64(r.MaxBytes)}
+}
+
+// Camera is a camera declared in the configuration, either an ONVIF device at an address or a bare RTSP stream
+type Camera struct {
+	// the name of the camera, used as the name of its recording directory
+	Name string `yaml:"name"`
+
+	// the registry ID of a discovered camera, which follows it as its address changes
+	ID string `yaml:"id"`
+
+	// the ONVIF device, as an IP, host:port or device service URL
+	Address string `yaml:"address"`
+
+	// the stream of a camera which doesn't speak ONVIF
+	URL string `yaml:"url"`
+
+	// credentials for this camera, tried ahead of the global ones
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// the tokens or names of the profiles to record, the first profile is recorded if empty
+	Profiles []string `yaml:"profiles"`
+
+	// whether to record this camera, the container to record it in if not the default, and how much of its
+	// recording to keep
+	Record    bool      `yaml:"record"`
+	Format    string    `yaml:"format"`
+	Retention Retention `yaml:"retention"`
+
+	// the times of day this camera is recorded, such as from sunset-30m to sunrise+30m, all day if empty
+	RecordDuring schedule.Periods `yaml:"record_during"`
+
+	// motion detection by comparing frames, for cameras whose own motion events can't be used
+	Motion *Motion `yaml:"motion"`
+
+	// filling gaps in this camera's recording with footage from its own storage
+	Backfill *Backfill `yaml:"backfill"`
+
+	// flashing this camera's white light when a person is detected on it at night
+	Deterrent *Deterrent `yaml:"deterrent"`
+}
+
+// EventPerson is the type of event for a person being detected
+const EventPerson = "person"
+
+// Deterrent is flashing the white light of a camera when events are added for it at night, see
+// illuminator.FlashAction. It is night going by the camera's day/night switching if it has any, otherwise by the sun at
+// its site.
+type Deterrent struct {
+	// the types of event which set it off, person if empty
+	Events []string `yaml:"events"`
+
+	// how many times to flash and how long each flash and gap lasts
+	Times    int      `yaml:"times"`
+	Interval Duration `yaml:"interval"`
+
+	// the relay output wired to the white light, or the auxiliary commands which turn it on and off, see
+	// onvif.IlluminatorQuirks
+	WhiteLightRelay string `yaml:"white_light_relay"`
+	WhiteLightOn    string `yaml:"white_light_on"`
+	WhiteLightOff   string `yaml:"white_light_off"`
+}
+
+// Triggers returns whether an event of the passed in type sets off this deterrent
+func (d *Deterrent) Triggers(eventType string) bool {
+	if len(d.Events) == 0 {
+		return eventType == EventPerson
+	}
+	return slices.Contains(d.Events, eventType)
+}
+
+// Quirks returns how the white light of the camera is controlled
+func (d *Deterrent) Quirks() onvif.IlluminatorQuirks {
+	return onvif.IlluminatorQuirks{WhiteLightRelay: d.WhiteLightRelay, WhiteLightOn: d.WhiteLightOn, WhiteLightOff: d.WhiteLightOff}
+}
+
+// Backfill is filling gaps in a camera's recording from its own storage over Profile G, see backfill.Config
+type Backfill struct {
+	// how far back to look for gaps and how often
+	Window   Duration `yaml:"window"`
+	Interval Duration `yaml:"interval"`
+}
+
+// the sources frames for motion detection can come from
+const (
+	MotionSnapshot = "snapshot"
+	MotionStream   = "stream"
+)
+
+// Motion is motion detection by comparing frames of a camera, see motion.Config
+type Motion struct {
+	// snapshot, which polls the camera's snapshot URI, or stream, which decodes a stream with ffmpeg. Defaults to
+	// snapshot for ONVIF cameras, cameras declared by URL only have a stream.
+	Source string `yaml:"source"`
+
+	// the token or name of the profile frames come from, the last profile, usually the smallest, if empty
+	Profile string `yaml:"profile"`
+
+	Interval  Duration        `yaml:"interval"`
+	Threshold int             `yaml:"threshold"`
+	MinArea   float64         `yaml:"min_area"`
+	Hold      Duration        `yaml:"hold"`
+	Regions   []motion.Region `yaml:"regions"`
+
+	// the times of day motion is detected, all day if empty
+	During schedule.Periods `yaml:"during"`
+}
+
+// Equal returns whether two motion configurations are the same
+func (m *Motion) Equal(other *Motion) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.Source == other.Source && m.Profile == other.Profile && m.Interval == other.Interval &&
+		m.Threshold == other.Threshold && m.MinArea == other.MinArea && m.Hold == other.Hold &&
+		slices.Equal(m.Regions, other.Regions) && slices.Equal(m.During, other.During)
+}
+
+// MotionSource returns where frames for motion detection of this camera come from
+func (c *Camera) MotionSource() string {
+	if c.Motion == nil {
+		return ""
+	}
+	if c.URL != "" {
+		return MotionStream
+	}
+	return cmp.Or(c.Motion.Source, MotionSnapshot)
+}
+
+// RecordingFormat returns the container this camera is recorded in under the passed in recording policy
+func (c *Camera) RecordingFormat(policy Recording) string {
+	return cmp.Or(c.Format, policy.Format)
+}
+
+// Host returns the host of this camera, which is how it is matched with discovered devices
+func (c *Camera) Host() string {
+	address := c.Address
+	if address == "" {
+		address = c.URL
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Load reads and validates the configuration in the YAML file at the passed in path
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %q: %w", path, err)
+	}
+	return parse(path, b)
+}
+
+// parses and validates the passed in YAML, read from the passed in path
+func parse(path string, b []byte) (*Config, error) {
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing config %q: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if !validFormat(c.Recording.Format) {
+		return fmt.Errorf("unsupported recording format %q", c.Recording.Format)
+	}
+
+	for i, webhook := range c.Notifications.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %d has an invalid url", i+1)
+		}
+	}
+
+	if m := c.Notifications.MQTT; m != nil {
+		if u, err := url.Parse(m.Broker); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("mqtt has an invalid broker, expected a url such as tcp://localhost:1883")
+		}
+	}
+
+	names := map[string]bool{}
+	for i, camera := range c.Cameras {
+		if camera.Name == "" || strings.ContainsAny(camera.Name, `/\`) || strings.HasPrefix(camera.Name, ".") {
+			return fmt.Errorf("camera %d has an invalid name %q", i+1, camera.Name)
+		}
+		if names[camera.Name] {
+			return fmt.Errorf("camera %q is declared twice", camera.Name)
+		}
+		names[camera.Name] = true
+
+		declared := 0
+		for _, v := range []string{camera.ID, camera.Address, camera.URL} {
+			if v != "" {
+				declared++
+			}
+		}
+		if declared != 1 {
+			return fmt.Errorf("camera %q must have exactly one of an id, an address or a url", camera.Name)
+		}
+		if camera.Address != "" {
+			if _, err := scan.DeviceServiceURL(camera.Address); err != nil {
+				return fmt.Errorf("camera %q: %w", camera.Name, err)
+			}
+		}
+		if !validFormat(camera.Format) {
+			return fmt.Errorf("camera %q has an unsupported recording format %q", camera.Name, camera.Format)
+		}
+		if camera.URL != "" {
+			if u, err := url.Parse(camera.URL); err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Host == "" {
+				return fmt.Errorf("camera %q has an invalid rtsp url", camera.Name)
+			}
+		}
+		if err := camera.Motion.validate(camera.URL != ""); err != nil {
+			return fmt.Errorf("camera %q: %w", camera.Name, err)
+		}
+		if camera.Backfill != nil && (camera.URL != "" || !camera.Record) {
+			return fmt.Errorf("camera %q can only be backfilled if it is an onvif camera which is recorded", camera.Name)
+		}
+		if err := camera.Deterrent.validate(camera.URL != ""); err != nil {
+			return fmt.Errorf("camera %q deterrent: %w", camera.Name, err)
+		}
+	}
+
+	groups := map[string]bool{}
+	switched := map[string]string{}
+	for i, group := range c.Groups {
+		if group.Name == "" || groups[group.Name] {
+			return fmt.Errorf("group %d has a missing or duplicate name", i+1)
+		}
+		groups[group.Name] = true
+
+		for _, camera := range group.Cameras {
+			if !names[camera] {
+				return fmt.Errorf("group %q has undeclared camera %q", group.Name, camera)
+			}
+			if group.DayNight == nil {
+				continue
+			}
+			if other, found := switched[camera]; found {
+				return fmt.Errorf("camera %q switches day and night in both group %q and group %q", camera, other, group.Name)
+			}
+			switched[camera] = group.Name
+		}
+		if group.Site != nil {
+			if err := group.Site.Validate(); err != nil {
+				return fmt.Errorf("group %q: %w", group.Name, err)
+			}
+		}
+	}
+
+	// periods can depend on the site of a camera's group so are checked once groups are
+	if err := c.Site.Validate(); err != nil {
+		return err
+	}
+	for _, camera := range c.Cameras {
+		if dn, found := c.DayNight(camera.Name); found {
+			if err := dn.Validate(); err != nil {
+				return fmt.Errorf("camera %q day_night: %w", camera.Name, err)
+			}
+		}
+		site := c.SiteOf(camera.Name)
+		if err := camera.RecordDuring.Validate(site); err != nil {
+			return fmt.Errorf("camera %q record_during: %w", camera.Name, err)
+		}
+		if camera.Motion != nil {
+			if err := camera.Motion.During.Validate(site); err != nil {
+				return fmt.Errorf("camera %q motion: %w", camera.Name, err)
+			}
+		}
+		if camera.Deterrent != nil {
+			dn, found := c.DayNight(camera.Name)
+			if (!found || dn.Mode == schedule.DayNightCamera) && site.IsZero() {
+				return fmt.Errorf("camera %q deterrent needs a site or day/night switching to know when it is night", camera.Name)
+			}
+		}
+	}
+
+	for i := range c.Firmware {
+		if err := c.Firmware[i].validate(); err != nil {
+			return fmt.Errorf("firmware advisory %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// SiteOf returns where the camera with the passed in name is, the site of the first group it is in which has one
+// and otherwise our site
+func (c *Config) SiteOf(camera string) *schedule.Site {
+	for _, group := range c.Groups {
+		if group.Site != nil && slices.Contains(group.Cameras, camera) {
+			return group.Site
+		}
+	}
+	return &c.Site
+}
+
+// DayNight returns how the camera with the passed in name switches between day and night, false if it doesn't
+func (c *Config) DayNight(camera string) (schedule.DayNight, bool) {
+	for i := range c.Groups {
+		group := &c.Groups[i]
+		if group.DayNight != nil && slices.Contains(group.Cameras, camera) {
+			return c.dayNight(group, camera), true
+		}
+	}
+	return schedule.DayNight{}, false
+}
+
+// returns the day/night switching of the passed in group, which must have one, for the passed in camera in it at the
+// site of the group or otherwise that of the camera
+func (c *Config) dayNight(group *Group, camera string) schedule.DayNight {
+	site := c.SiteOf(camera)
+	if group.Site != nil {
+		site = group.Site
+	}
+	dn := group.DayNight
+	return schedule.DayNight{
+		Mode:          schedule.DayNightMode(cmp.Or(dn.Mode, string(schedule.DayNightAuto))),
+		Site:          *site,
+		SunriseOffset: time.Duration(dn.SunriseOffset),
+		SunsetOffset:  time.Duration(dn.SunsetOffset),
+		NightGain:     dn.NightGain,
+		DayGain:       dn.DayGain,
+		DayExposure:   dn.DayExposure,
+		NightExposure: dn.NightExposure,
+		Autofocus:     dn.Autofocus,
+	}
+}
+
+func (m *Motion) validate(streamOnly bool) error {
+	if m == nil {
+		return nil
+	}
+	if m.Source != "" && m.Source != MotionSnapshot && m.Source != MotionStream {
+		return fmt.Errorf("unknown motion source %q", m.Source)
+	}
+	if streamOnly && m.Source == MotionSnapshot {
+		return errors.New("cameras declared by url have no snapshots for motion detection")
+	}
+	if m.Threshold < 0 || m.Threshold > 255 {
+		return errors.New("motion threshold must be between 0 and 255")
+	}
+	if m.MinArea < 0 || m.MinArea > 1 {
+		return errors.New("motion min area must be between 0 and 1")
+	}
+	for _, r := range m.Regions {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Deterrent) validate(streamOnly bool) error {
+	if d == nil {
+		return nil
+	}
+	if streamOnly {
+		return errors.New("cameras declared by url have no white light we can control")
+	}
+	if d.Times < 0 || d.Interval < 0 {
+		return errors.New("times and interval can't be negative")
+	}
+	if d.WhiteLightRelay == "" && (d.WhiteLightOn == "" || d.WhiteLightOff == "") {
+		return errors.New("a white light relay or white light on and off commands are required")
+	}
+	return nil
+}
+
+func validFormat(format string) bool {
+	return format == "" || format == record.FormatMP4 || format == record.FormatFMP4 || format == record.FormatMKV
+}
+
+// Camera returns the camera with the passed in name, nil if there isn't one
+func (c *Config) Camera(name string) *Camera {
+	for i := range c.Cameras {
+		if c.Cameras[i].Name == name {
+			return &c.Cameras[i]
+		}
+	}
+	return nil
+}
+
+// Match returns the declared camera a discovered device is, matched by the passed in registry ID if it was declared
+// with one and otherwise by host, nil if it wasn't declared
+func (c *Config) Match(record scan.Record, id string) *Camera {
+	host := hostOf(record.Address)
+	for i := range c.Cameras {
+		camera := &c.Cameras[i]
+		if camera.ID != "" {
+			if camera.ID == id {
+				return camera
+			}
+			continue
+		}
+		if h := camera.Host(); h != "" && h == host {
+			return camera
+		}
+	}
+	return nil
+}
+
+// CredentialsFor returns the credentials to try for the passed in host, those of a camera declared at that host
+// followed by the global ones, suitable for use as scan.Options.CredentialsFor
+func (c *Config) CredentialsFor(host string) []scan.Credential {
+	return c.CredentialsForCamera("", host)
+}
+
+// CredentialsForCamera is CredentialsFor for a host where the camera with the passed in registry ID was last seen,
+// which also tries the credentials of that camera if it was declared by its ID
+func (c *Config) CredentialsForCamera(id string, host string) []scan.Credential {
+	credentials := []scan.Credential{}
+	for i := range c.Cameras {
+		camera := &c.Cameras[i]
+		if camera.Username != "" && ((id != "" && camera.ID == id) || camera.Host() == hostOf(host)) {
+			credentials = append(credentials, scan.Credential{Username: camera.Username, Password: camera.Password})
+		}
+	}
+	if len(credentials) == 0 {
+		return nil
+	}
+	return append(credentials, c.Credentials...)
+}
+
+// Apply merges our cameras and credentials into the passed in scan options, declared cameras are always probed and,
+// unless discovery is turned off, scanned for alongside any others on the network
+func (c *Config) Apply(opts scan.Options) scan.Options {
+	if c.Discover != nil && !*c.Discover {
+		opts.WSDiscovery, opts.PortScan, opts.SSDP, opts.MDNS, opts.RTSPScan = false, false, false, false, false
+	}
+	if len(c.Credentials) > 0 {
+		opts.Credentials = slices.Clone(c.Credentials)
+	}
+	opts.CredentialsFor = c.CredentialsFor
+
+	opts.Addresses, opts.Sources = nil, nil
+	for _, camera := range c.Cameras {
+		switch {
+		case camera.Address != "":
+			opts.Addresses = append(opts.Addresses, camera.Address)
+		case camera.URL != "":
+			opts.Sources = append(opts.Sources, scan.StreamSource{Address: camera.Host(), URL: camera.URL})
+		}
+	}
+	return opts
+}
+
+// RetentionConfig returns the retention of recordings in the passed in directory under our policies
+func (c *Config) RetentionConfig(dir string) record.RetentionConfig {
+	cfg := record.RetentionConfig{Dir: dir, Global: c.Recording.Retention.Quota(), Cameras: map[string]record.Quota{}}
+	for _, camera := range c.Cameras {
+		if quota := camera.Retention.Quota(); quota != (record.Quota{}) {
+			cfg.Cameras[camera.Name] = quota
+		}
+	}
+	return cfg
+}
+
+// returns the host of an address which may be a URL, host:port or bare host
+func hostOf(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// Duration is a duration written the way Go writes them, such as 90s or 1h30m, with d for days also allowed
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	s := strings.TrimSpace(node.Value)
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(n * float64(24*time.Hour))
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ByteSize is a size in bytes which can be written with a K, M, G or T suffix, in powers of 1024
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	s := strings.ToUpper(strings.TrimSpace(node.Value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := int64(1)
+	if len(s) > 0 {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			multiplier = 1 << (10 * (i + 1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", node.Value)
+	}
+	*b = ByteSize(n * float64(multiplier))
+	return nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// FirmwareAdvisory is what we know of the firmware of a camera model, versions are matched exactly or by a pattern
+// such as V5.4.* and manufacturers and models are matched regardless of case
+type FirmwareAdvisory struct {
+	// the manufacturer is optional as models are rarely shared between them
+	Manufacturer string `yaml:"manufacturer"`
+	Model        string `yaml:"model"`
+
+	// versions known to work well, if any are listed then cameras running others are flagged as unverified
+	Good []string `yaml:"good"`
+
+	// versions with known problems, such as broken RTSP or authentication
+	Bad []BadFirmware `yaml:"bad"`
+}
+
+// BadFirmware is a firmware version with a known problem
+type BadFirmware struct {
+	Version string `yaml:"version"`
+	Reason  string `yaml:"reason"`
+}
+
+// FirmwareVerdict is what our advisories say of the firmware a camera is running
+type FirmwareVerdict string
+
+const (
+	// the version is known good, or there's nothing known against it
+	FirmwareOK FirmwareVerdict = "ok"
+
+	// the version isn't among the known good versions of the model
+	FirmwareUnverified FirmwareVerdict = "unverified"
+
+	// the version has a known problem
+	FirmwareBad FirmwareVerdict = "bad"
+)
+
+// CheckFirmware returns what our advisories say of the passed in firmware version of the passed in model, along with
+// why if it isn't ok
+func (c *Config) CheckFirmware(manufacturer, model, version string) (FirmwareVerdict, string) {
+	if version == "" {
+		return FirmwareOK, ""
+	}
+	for _, advisory := range c.Firmware {
+		if !strings.EqualFold(advisory.Model, model) {
+			continue
+		}
+		if advisory.Manufacturer != "" && !strings.EqualFold(advisory.Manufacturer, manufacturer) {
+			continue
+		}
+
+		for _, bad := range advisory.Bad {
+			if versionMatches(bad.Version, version) {
+				if bad.Reason == "" {
+					return FirmwareBad, fmt.Sprintf("firmware %s has known problems", version)
+				}
+				return FirmwareBad, fmt.Sprintf("firmware %s: %s", version, bad.Reason)
+			}
+		}
+		if len(advisory.Good) == 0 {
+			continue
+		}
+		for _, good := range advisory.Good {
+			if versionMatches(good, version) {
+				return FirmwareOK, ""
+			}
+		}
+		return FirmwareUnverified, fmt.Sprintf("firmware %s isn't a known good version for the %s", version, advisory.Model)
+	}
+	return FirmwareOK, ""
+}
+
+// returns whether the passed in version matches the passed in pattern, cameras aren't consistent about the case of
+// the letters in their versions
+func versionMatches(pattern string, version string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(version))
+	return err == nil && matched
+}
+
+func (a *FirmwareAdvisory) validate() error {
+	if a.Model == "" {
+		return errors.New("a model is required")
+	}
+	versions := append([]string{}, a.Good...)
+	for _, bad := range a.Bad {
+		versions = append(versions, bad.Version)
+	}
+	for _, version := range versions {
+		if _, err := path.Match(version, ""); version == "" || err != nil {
+			return fmt.Errorf("invalid version %q", version)
+		}
+	}
+	return nil
+}
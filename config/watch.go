@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Watcher holds the configuration loaded from a file, reloading it whenever we get a SIGHUP
+type Watcher struct {
+	log  *slog.Logger
+	path string
+
+	// if set, called with the new configuration each time it is reloaded, a configuration which fails to load is
+	// logged and the previous one kept
+	OnReload func(*Config)
+
+	mu      sync.Mutex
+	current *Config
+
+	// held while we write to our file
+	writeMu sync.Mutex
+}
+
+// NewWatcher loads the configuration at the passed in path
+func NewWatcher(log *slog.Logger, path string) (*Watcher, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{log: log.With("subsystem", "config"), path: path, current: c}, nil
+}
+
+// Current returns the most recently loaded configuration, which must not be modified
+func (w *Watcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current
+}
+
+// Reload loads the configuration again, keeping the current one if it can't be
+func (w *Watcher) Reload() error {
+	c, err := Load(w.path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.current = c
+	w.mu.Unlock()
+
+	w.log.Info("config reloaded", slog.String("path", w.path), slog.Int("cameras", len(c.Cameras)))
+	if w.OnReload != nil {
+		w.OnReload(c)
+	}
+	return nil
+}
+
+// Adopt declares the discovered camera with the passed in registry ID in our file, see Adopt, and reloads it
+func (w *Watcher) Adopt(id string, a Adoption) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if err := Adopt(w.path, id, a); err != nil {
+		return err
+	}
+	w.log.Info("camera adopted", slog.String("id", id), slog.String("name", a.Name))
+	return w.Reload()
+}
+
+// Run reloads the configuration on each SIGHUP until the passed in context is done
+func (w *Watcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := w.Reload(); err != nil {
+				w.log.Error("error reloading config, keeping previous", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
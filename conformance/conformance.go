@@ -0,0 +1,257 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// outcomes of a single check
+const (
+	StatusPass    = "pass"
+	StatusFail    = "fail"
+	StatusFault   = "fault"
+	StatusSkipped = "skipped"
+)
+
+// Check is the outcome of exercising a single operation against a device
+type Check struct {
+	Service   string        `json:"service"`
+	Operation string        `json:"operation"`
+	Status    string        `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	Detail    string        `json:"detail,omitempty"`
+}
+
+// Report is the outcome of every check run against a device
+type Report struct {
+	Address           string                  `json:"address"`
+	DeviceInformation onvif.DeviceInformation `json:"device_information"`
+	Started           time.Time               `json:"started"`
+	Checks            []Check                 `json:"checks"`
+}
+
+// Counts returns how many of our checks had each status
+func (r *Report) Counts() map[string]int {
+	counts := map[string]int{}
+	for _, c := range r.Checks {
+		counts[c.Status]++
+	}
+	return counts
+}
+
+// Passed returns whether no check failed or faulted, skipped checks are for services the device doesn't advertise
+func (r *Report) Passed() bool {
+	counts := r.Counts()
+	return counts[StatusFail] == 0 && counts[StatusFault] == 0
+}
+
+// errSkipped is returned by checks which can't run, either as the device doesn't advertise the service or as a
+// check they depend on failed
+type errSkipped struct{ reason string }
+
+func (e errSkipped) Error() string { return e.reason }
+
+func skip(format string, args ...any) error {
+	return errSkipped{reason: fmt.Sprintf(format, args...)}
+}
+
+// Run exercises the main ONVIF operations against the device at the passed in address, each read only, stopping
+// early only if we can't get the device's capabilities
+func Run(log *slog.Logger, address string, username string, password string) *Report {
+	d := onvif.NewDevice(address, username, password)
+	report := &Report{Address: address, Started: time.Now()}
+
+	run := func(service, operation string, fn func() (string, error)) bool {
+		start := time.Now()
+		detail, err := fn()
+		check := Check{Service: service, Operation: operation, Status: StatusPass, Duration: time.Since(start), Detail: detail}
+
+		var fault *onvif.Fault
+		var skipped errSkipped
+		switch {
+		case errors.As(err, &skipped):
+			check.Status, check.Detail, check.Duration = StatusSkipped, skipped.reason, 0
+		case errors.As(err, &fault):
+			check.Status, check.Detail = StatusFault, fault.Error()
+		case err != nil:
+			check.Status, check.Detail = StatusFail, err.Error()
+		}
+
+		log.Debug("conformance check", slog.String("operation", operation), slog.String("status", check.Status), slog.Duration("duration", check.Duration))
+		report.Checks = append(report.Checks, check)
+		return check.Status == StatusPass
+	}
+
+	// unauthenticated, and needed before anything else to work out the clock offset for auth
+	run("device", "GetSystemDateAndTime", func() (string, error) {
+		t, err := d.GetSystemDateAndTime(log)
+		if err != nil {
+			return "", err
+		}
+		d.ClockOffset = -time.Since(t)
+		return fmt.Sprintf("clock offset %s", d.ClockOffset.Round(time.Second)), nil
+	})
+
+	if !run("device", "GetCapabilities", func() (string, error) {
+		capabilities, err := d.GetCapabilities(log)
+		if err != nil {
+			return "", err
+		}
+		d.Capabilities = *capabilities
+		return "", nil
+	}) {
+		return report
+	}
+
+	run("device", "GetDeviceInformation", func() (string, error) {
+		info, err := d.GetDeviceInformation(log)
+		if err != nil {
+			return "", err
+		}
+		d.DeviceInformation = *info
+		report.DeviceInformation = *info
+		return fmt.Sprintf("%s %s firmware %s", info.Manufacturer, info.Model, info.FirmwareVersion), nil
+	})
+
+	run("device", "GetNTP", func() (string, error) {
+		ntp, err := d.GetNTP(log)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("from dhcp %v, %d servers", ntp.FromDHCP, len(ntp.Servers)), nil
+	})
+
+	run("device", "GetUsers", func() (string, error) {
+		users, err := d.GetUsers(log)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d users", len(users)), nil
+	})
+
+	hasMedia := d.Capabilities.Media.Address != ""
+	hasProfiles := run("media", "GetProfiles", func() (string, error) {
+		if !hasMedia {
+			return "", skip("no media service")
+		}
+		profiles, err := d.GetProfiles(log)
+		if err != nil {
+			return "", err
+		}
+		d.Profiles = profiles
+		if len(profiles) == 0 {
+			return "", errors.New("no profiles")
+		}
+		return fmt.Sprintf("%d profiles", len(profiles)), nil
+	})
+
+	// the remaining checks work on the first profile
+	needsProfile := func() (*onvif.Profile, error) {
+		if !hasProfiles {
+			return nil, skip("no profiles")
+		}
+		return &d.Profiles[0], nil
+	}
+
+	streamURI := ""
+	run("media", "GetStreamUri", func() (string, error) {
+		profile, err := needsProfile()
+		if err != nil {
+			return "", err
+		}
+		streamURI, err = d.StreamURI(log, profile.Token)
+		return creds.Redact(streamURI), err
+	})
+
+	run("media", "GetVideoEncoderConfiguration", func() (string, error) {
+		profile, err := needsProfile()
+		if err != nil {
+			return "", err
+		}
+		if profile.VideoEncoderConfiguration == nil {
+			return "", skip("profile has no video encoder")
+		}
+		cfg, err := d.GetVideoEncoderConfiguration(log, profile.VideoEncoderConfiguration.Token)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %dx%d", cfg.Encoding, cfg.Resolution.Width, cfg.Resolution.Height), nil
+	})
+
+	run("media", "GetGuaranteedNumberOfVideoEncoderInstances", func() (string, error) {
+		profile, err := needsProfile()
+		if err != nil {
+			return "", err
+		}
+		limits, err := d.GetGuaranteedNumberOfVideoEncoderInstances(log, profile.VideoSourceConfiguration.Token)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d total", limits.Total), nil
+	})
+
+	run("media", "GetOSDs", func() (string, error) {
+		profile, err := needsProfile()
+		if err != nil {
+			return "", err
+		}
+		osds, err := d.GetOSDs(log, profile.VideoSourceConfiguration.Token)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d osds", len(osds)), nil
+	})
+
+	run("media", "GetAudioOutputs", func() (string, error) {
+		if !hasMedia {
+			return "", skip("no media service")
+		}
+		outputs, err := d.GetAudioOutputs(log)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d outputs", len(outputs)), nil
+	})
+
+	run("imaging", "GetImagingSettings", func() (string, error) {
+		if d.Capabilities.Imaging.Address == "" {
+			return "", skip("no imaging service")
+		}
+		profile, err := needsProfile()
+		if err != nil {
+			return "", err
+		}
+		_, err = d.GetImagingSettings(log, profile.VideoSourceConfiguration.SourceToken)
+		return "", err
+	})
+
+	run("rtsp", "DESCRIBE", func() (string, error) {
+		if streamURI == "" {
+			return "", skip("no stream uri")
+		}
+		url, err := creds.NewURL(streamURI, username, password)
+		if err != nil {
+			return "", err
+		}
+		streams, err := rtsp.ProbeStreams(url.Secret(), 5*time.Second)
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("%d streams", len(streams))
+		for _, s := range streams {
+			if s.CodecType == "video" {
+				detail += fmt.Sprintf(", %s %dx%d", s.CodecName, s.Width, s.Height)
+				break
+			}
+		}
+		return detail, nil
+	})
+
+	return report
+}
@@ -0,0 +1,90 @@
+package creds
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Authorization builds an Authorization header answering the passed in WWW-Authenticate challenge, which may be for
+// basic or digest auth, as sent by both RTSP and HTTP servers on cameras
+func Authorization(challenge string, method string, uri string, username string, password string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+
+	case "digest":
+		p := parseAuthParams(params)
+		realm, nonce := p["realm"], p["nonce"]
+
+		ha1 := md5Hex(username + ":" + realm + ":" + password)
+		ha2 := md5Hex(method + ":" + uri)
+
+		// HTTP servers usually want qop=auth, RTSP servers rarely offer it
+		qop := ""
+		for _, q := range strings.Split(p["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+
+		if qop == "" {
+			response := md5Hex(ha1 + ":" + nonce + ":" + ha2)
+			header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, username, realm, nonce, uri, response)
+			if opaque, ok := p["opaque"]; ok {
+				header += fmt.Sprintf(`, opaque="%s"`, opaque)
+			}
+			return header, nil
+		}
+
+		cnonce := make([]byte, 8)
+		rand.Read(cnonce)
+		cn, nc := hex.EncodeToString(cnonce), "00000001"
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cn + ":" + qop + ":" + ha2)
+
+		header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=%s, nc=%s, cnonce="%s", response="%s"`, username, realm, nonce, uri, qop, nc, cn, response)
+		if opaque, ok := p["opaque"]; ok {
+			header += fmt.Sprintf(`, opaque="%s"`, opaque)
+		}
+		return header, nil
+	}
+
+	return "", fmt.Errorf("unsupported auth challenge: %q", challenge)
+}
+
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range splitAuthParams(s) {
+		k, v, found := strings.Cut(strings.TrimSpace(part), "=")
+		if found {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return params
+}
+
+// splits the passed in auth params on commas outside of quotes, as qop="auth,auth-int" has one inside them
+func splitAuthParams(s string) []string {
+	parts := []string{}
+	quoted, start := false, 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,110 @@
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+const redacted = "xxxxx"
+
+// query parameters which carry credentials on some cameras
+var secretParams = []string{"password", "pwd", "pass", "passwd"}
+
+// URL is a stream or snapshot URL which may carry credentials. Its String, slog and JSON forms are always redacted,
+// the credentials are only available by explicitly calling Secret when handing the URL to something that needs them.
+type URL struct {
+	u *url.URL
+}
+
+// NewURL parses the passed in URL, adding the passed in credentials as userinfo if username is set
+func NewURL(raw string, username string, password string) (*URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %q: %w", Redact(raw), err)
+	}
+	if username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+	return &URL{u: u}, nil
+}
+
+// WithQueryCredentials returns a copy of this URL with credentials passed as user and password query parameters
+// rather than userinfo
+func (u *URL) WithQueryCredentials(username string, password string) *URL {
+	copied := *u.u
+	copied.User = nil
+	q := copied.Query()
+	q.Set("user", username)
+	q.Set("password", password)
+	copied.RawQuery = q.Encode()
+	return &URL{u: &copied}
+}
+
+// WithoutCredentials returns a copy of this URL with any userinfo removed
+func (u *URL) WithoutCredentials() *URL {
+	copied := *u.u
+	copied.User = nil
+	return &URL{u: &copied}
+}
+
+// Secret returns the full URL including any credentials, never log this
+func (u *URL) Secret() string {
+	return u.u.String()
+}
+
+// Host returns the host and port of the URL
+func (u *URL) Host() string {
+	return u.u.Host
+}
+
+// String returns the redacted form of the URL
+func (u *URL) String() string {
+	return Redact(u.u.String())
+}
+
+func (u *URL) LogValue() slog.Value {
+	return slog.StringValue(u.String())
+}
+
+func (u *URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.String())
+}
+
+// Redact removes the password from the userinfo and any credential query parameters of the passed in URL
+func Redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// we can't parse it so can't safely pick out the credentials, redact everything before any @
+		if i := strings.LastIndex(raw, "@"); i >= 0 {
+			return redacted + raw[i:]
+		}
+		return raw
+	}
+
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+	}
+
+	if u.RawQuery != "" {
+		q := u.Query()
+		changed := false
+		for key := range q {
+			for _, secret := range secretParams {
+				if strings.EqualFold(key, secret) {
+					q.Set(key, redacted)
+					changed = true
+				}
+			}
+		}
+		if changed {
+			u.RawQuery = q.Encode()
+		}
+	}
+
+	return u.String()
+}
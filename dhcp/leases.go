@@ -0,0 +1,255 @@
+package dhcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is an address a DHCP server has assigned to a device
+type Lease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`
+
+	// when we learned of the lease, from its file or from the traffic which assigned it
+	Seen time.Time `json:"seen"`
+}
+
+// Expired returns whether the lease has expired by the passed in time, leases without an expiry never do
+func (l *Lease) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// Format is the format of a DHCP server's lease file
+type Format string
+
+const (
+	FormatDnsmasq Format = "dnsmasq"
+	FormatKea     Format = "kea"
+	FormatWindows Format = "windows"
+)
+
+// ErrUnknownFormat is returned when a lease file isn't in any format we can read
+var ErrUnknownFormat = errors.New("unknown lease file format")
+
+// DetectFormat returns the format of the passed in lease file contents from their first line
+func DetectFormat(b []byte) (Format, error) {
+	first, _, _ := bytes.Cut(b, []byte("\n"))
+	first = bytes.ToLower(bytes.TrimSpace(first))
+	switch {
+	case len(first) == 0:
+		// an empty file is an empty dnsmasq file as the others always have a header
+		return FormatDnsmasq, nil
+	case bytes.HasPrefix(first, []byte("address,hwaddr")):
+		return FormatKea, nil
+	case bytes.HasPrefix(first, []byte("#type")) || bytes.Contains(first, []byte(`"ipaddress"`)):
+		return FormatWindows, nil
+	}
+	if fields := strings.Fields(string(first)); len(fields) >= 3 {
+		if _, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			return FormatDnsmasq, nil
+		}
+	}
+	return "", ErrUnknownFormat
+}
+
+// ReadFile reads the leases in the lease file at the passed in path, detecting its format
+func ReadFile(path string, now time.Time) ([]Lease, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lease file %q: %w", path, err)
+	}
+	format, err := DetectFormat(b)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lease file %q: %w", path, err)
+	}
+	leases, err := Parse(bytes.NewReader(b), format, now)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lease file %q: %w", path, err)
+	}
+	return leases, nil
+}
+
+// Parse reads the leases in the passed in format, skipping any which aren't IPv4 leases of a hardware address. Leases
+// are returned in the order the file has them, which for Kea is the order they were written in so later ones replace
+// earlier ones for the same address.
+func Parse(r io.Reader, format Format, now time.Time) ([]Lease, error) {
+	switch format {
+	case FormatDnsmasq:
+		return parseDnsmasq(r, now)
+	case FormatKea:
+		return parseKea(r, now)
+	case FormatWindows:
+		return parseWindows(r, now)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// dnsmasq leases are lines of expiry, MAC, IP, hostname and client ID, with * for an unknown hostname and an expiry
+// of 0 for infinite leases, e.g. "1760729090 ec:71:db:12:34:56 192.168.1.40 front-door 01:ec:71:db:12:34:56"
+func parseDnsmasq(r io.Reader, now time.Time) ([]Lease, error) {
+	leases := []Lease{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		lease, ok := newLease(fields[1], fields[2], now)
+		if !ok {
+			continue
+		}
+		if expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		if len(fields) > 3 && fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading dnsmasq leases: %w", err)
+	}
+	return leases, nil
+}
+
+// Kea's memfile is a CSV with a header, which later versions add columns to, and rows appended as leases change. A
+// lease with a valid lifetime of zero or a state other than default (0) has been released, declined or reclaimed, so
+// is returned already expired.
+func parseKea(r io.Reader, now time.Time) ([]Lease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading kea leases: %w", err)
+	}
+	column := columns(header)
+
+	leases := []Lease{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading kea leases: %w", err)
+		}
+
+		lease, ok := newLease(column(row, "hwaddr"), column(row, "address"), now)
+		if !ok {
+			continue
+		}
+		lease.Hostname = strings.TrimSuffix(column(row, "hostname"), ".")
+		if expire, err := strconv.ParseInt(column(row, "expire"), 10, 64); err == nil {
+			lease.Expires = time.Unix(expire, 0)
+		}
+		if state := column(row, "state"); column(row, "valid_lifetime") == "0" || (state != "" && state != "0") {
+			lease.Expires = time.Unix(0, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// the layouts Windows exports lease expiry times in, which depend on the locale of the server
+var windowsTimeLayouts = []string{
+	"1/2/2006 3:04:05 PM",
+	"2/1/2006 15:04:05",
+	"2006-01-02 15:04:05",
+	"02.01.2006 15:04:05",
+	time.RFC3339,
+}
+
+// Windows leases are exported with Get-DhcpServerv4Scope | Get-DhcpServerv4Lease | Export-Csv, which writes a #TYPE
+// line followed by a header naming the lease's properties, client IDs being MACs such as ec-71-db-12-34-56. Expiry
+// times are in the local time of the server, which we assume is ours, and are empty for reservations.
+func parseWindows(r io.Reader, now time.Time) ([]Lease, error) {
+	br := bufio.NewReader(r)
+	if peek, err := br.Peek(5); err == nil && strings.EqualFold(string(peek), "#type") {
+		br.ReadString('\n')
+	}
+
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading windows leases: %w", err)
+	}
+	column := columns(header)
+
+	leases := []Lease{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading windows leases: %w", err)
+		}
+
+		// inactive and declined addresses aren't assigned to anything
+		if state := strings.ToLower(column(row, "addressstate")); state != "" && !strings.HasPrefix(state, "active") {
+			continue
+		}
+		lease, ok := newLease(column(row, "clientid"), column(row, "ipaddress"), now)
+		if !ok {
+			continue
+		}
+		lease.Hostname, _, _ = strings.Cut(column(row, "hostname"), ".")
+		if expiry := column(row, "leaseexpirytime"); expiry != "" {
+			for _, layout := range windowsTimeLayouts {
+				if t, err := time.ParseInLocation(layout, expiry, time.Local); err == nil {
+					lease.Expires = t
+					break
+				}
+			}
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// returns a lease of the passed in IPv4 address to the passed in MAC, false if either isn't valid
+func newLease(mac string, ip string, now time.Time) (Lease, bool) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil || len(hw) != 6 {
+		return Lease{}, false
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil || !addr.Is4() {
+		return Lease{}, false
+	}
+	return Lease{MAC: hw.String(), IP: addr.String(), Seen: now}, true
+}
+
+// returns a function which looks up the value of a column of a row by its name in the passed in header, empty if the
+// header or row doesn't have it
+func columns(header []string) func(row []string, name string) string {
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return func(row []string, name string) string {
+		if i, found := index[name]; found && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+}
@@ -0,0 +1,132 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// the DHCP message types we learn leases from
+const (
+	messageRequest = 3
+	messageAck     = 5
+)
+
+// DHCP options we read
+const (
+	optionPad         = 0
+	optionHostname    = 12
+	optionRequestedIP = 50
+	optionLeaseTime   = 51
+	optionMessageType = 53
+	optionEnd         = 255
+)
+
+// the fixed part of a BOOTP message, which options follow after a magic cookie
+const (
+	headerLength = 236
+	magicCookie  = 0x63825363
+)
+
+// Listen listens for DHCP traffic on the passed in UDP address, usually :67 which needs to be run as root and can't be
+// shared with a DHCP server on this host, calling found with each lease it sees assigned. Clients broadcast their
+// requests so we hear those for any server on our network segment, and acknowledgements when they are broadcast too.
+// A request can still be refused but clients which are refused ask again, so their next request corrects us.
+func Listen(ctx context.Context, addr string, found func(Lease)) error {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for dhcp on %s: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error reading dhcp message: %w", err)
+		}
+		if lease, ok := parseMessage(buf[:n], time.Now()); ok {
+			found(lease)
+		}
+	}
+}
+
+// returns the lease described by the passed in DHCP request or acknowledgement, false if it isn't one or doesn't
+// describe an IPv4 address for an ethernet address
+func parseMessage(b []byte, now time.Time) (Lease, bool) {
+	// we want clients' messages to servers (1) and servers' replies (2) with 6 byte ethernet addresses
+	if len(b) < headerLength+4 || (b[0] != 1 && b[0] != 2) || b[1] != 1 || b[2] != 6 {
+		return Lease{}, false
+	}
+	if binary.BigEndian.Uint32(b[headerLength:]) != magicCookie {
+		return Lease{}, false
+	}
+
+	var messageType byte
+	var hostname string
+	var requested, leaseTime []byte
+	options := b[headerLength+4:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == optionEnd {
+			break
+		}
+		if code == optionPad {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return Lease{}, false
+		}
+		value := options[2 : 2+options[1]]
+		options = options[2+options[1]:]
+
+		switch code {
+		case optionMessageType:
+			if len(value) == 1 {
+				messageType = value[0]
+			}
+		case optionHostname:
+			hostname = string(value)
+		case optionRequestedIP:
+			requested = value
+		case optionLeaseTime:
+			leaseTime = value
+		}
+	}
+
+	// acknowledgements assign their client's address, requests ask for one or renew the one the client has
+	var ip []byte
+	switch messageType {
+	case messageAck:
+		ip = b[16:20]
+	case messageRequest:
+		ip = requested
+		if ip == nil {
+			ip = b[12:16]
+		}
+	default:
+		return Lease{}, false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !addr.Is4() || addr.IsUnspecified() {
+		return Lease{}, false
+	}
+	lease := Lease{MAC: net.HardwareAddr(b[28:34]).String(), IP: addr.String(), Hostname: hostname, Seen: now}
+	if len(leaseTime) == 4 {
+		if seconds := binary.BigEndian.Uint32(leaseTime); seconds != 0xffffffff {
+			lease.Expires = now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	return lease, true
+}
@@ -0,0 +1,153 @@
+package dhcp
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Table keeps the current lease of each MAC, from lease files which it rereads whenever they change and from leases
+// it is told of, such as those Listen hears assigned
+type Table struct {
+	log      *slog.Logger
+	files    []string
+	interval time.Duration
+
+	// if set, called with each lease which gives a MAC an address it didn't have before, including those already in
+	// our files when we start
+	OnLease func(Lease)
+
+	mu     sync.Mutex
+	leases map[string]Lease
+
+	// when we last read each file, and the files we failed to which we only warn about until we can read them again
+	modified map[string]time.Time
+	failed   map[string]bool
+}
+
+// NewTable creates a new table of the leases in the passed in files, checked for changes on the passed in interval
+func NewTable(log *slog.Logger, files []string, interval time.Duration) *Table {
+	return &Table{
+		log:      log.With("subsystem", "dhcp"),
+		files:    files,
+		interval: interval,
+		leases:   make(map[string]Lease),
+		modified: make(map[string]time.Time),
+		failed:   make(map[string]bool),
+	}
+}
+
+// Add records the passed in lease, replacing any previous lease of its MAC and any lease of its address to another
+func (t *Table) Add(lease Lease) {
+	t.mu.Lock()
+	previous, found := t.leases[lease.MAC]
+	for mac, other := range t.leases {
+		if other.IP == lease.IP && mac != lease.MAC {
+			delete(t.leases, mac)
+		}
+	}
+	if lease.Expired(lease.Seen) {
+		if found && previous.IP == lease.IP {
+			delete(t.leases, lease.MAC)
+		}
+		t.mu.Unlock()
+		return
+	}
+	t.leases[lease.MAC] = lease
+	t.mu.Unlock()
+
+	if !found || previous.IP != lease.IP || previous.Expired(lease.Seen) {
+		t.log.Debug("lease assigned", slog.String("mac", lease.MAC), slog.String("ip", lease.IP), slog.String("hostname", lease.Hostname))
+		if t.OnLease != nil {
+			t.OnLease(lease)
+		}
+	}
+}
+
+// Lookup returns the current lease of the passed in MAC, false if it doesn't have one
+func (t *Table) Lookup(mac string) (Lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lease, found := t.leases[strings.ToLower(mac)]
+	if !found || lease.Expired(time.Now()) {
+		return Lease{}, false
+	}
+	return lease, true
+}
+
+// MACOf returns the MAC currently leased the passed in IP, empty if none is
+func (t *Table) MACOf(ip string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for mac, lease := range t.leases {
+		if lease.IP == ip && !lease.Expired(now) {
+			return mac
+		}
+	}
+	return ""
+}
+
+// All returns every current lease, sorted by MAC
+func (t *Table) All() []Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	leases := make([]Lease, 0, len(t.leases))
+	for _, lease := range t.leases {
+		if !lease.Expired(now) {
+			leases = append(leases, lease)
+		}
+	}
+	slices.SortFunc(leases, func(a, b Lease) int { return strings.Compare(a.MAC, b.MAC) })
+	return leases
+}
+
+// Run reads our files immediately and then again whenever they are modified, until the passed in context is done
+func (t *Table) Run(ctx context.Context) {
+	t.read()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.read()
+		}
+	}
+}
+
+// reads any of our files which have been modified since we last read them
+func (t *Table) read() {
+	for _, path := range t.files {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().Equal(t.modified[path]) {
+			continue
+		}
+
+		var leases []Lease
+		if err == nil {
+			leases, err = ReadFile(path, time.Now())
+		}
+		if err != nil {
+			if !t.failed[path] {
+				t.log.Warn("unable to read lease file", slog.String("path", path), slog.String("error", err.Error()))
+				t.failed[path] = true
+			}
+			continue
+		}
+		t.modified[path], t.failed[path] = info.ModTime(), false
+		for _, lease := range leases {
+			t.Add(lease)
+		}
+	}
+}
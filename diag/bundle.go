@@ -0,0 +1,243 @@
+package diag
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// Options configures what goes into a diagnostics bundle
+type Options struct {
+	// configuration to include, will be redacted
+	Config any
+
+	// the log file to include the tail of and how many lines
+	LogFile  string
+	LogLines int
+
+	// the data directory whose probe reports and disk usage to include
+	DataDir string
+
+	// the ffmpeg and ffprobe binaries whose versions to include
+	FFmpegPath  string
+	FFprobePath string
+}
+
+// config fields whose values are always redacted
+var secretFieldRegex = regexp.MustCompile(`(?i)(password|secret|token|key)`)
+
+// credentials embedded in URLs within free text such as log lines
+var textURLRegex = regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s"']+`)
+
+// WriteBundle writes a gzipped tar archive of diagnostics to the passed in writer
+func WriteBundle(w io.Writer, opts Options) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+	add := func(name string, content []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	sections := []struct {
+		name string
+		fn   func() ([]byte, error)
+	}{
+		{"system.json", systemInfo},
+		{"config.json", func() ([]byte, error) { return redactedConfig(opts.Config) }},
+		{"logs.txt", func() ([]byte, error) { return tailLog(opts.LogFile, opts.LogLines) }},
+		{"ffmpeg.txt", func() ([]byte, error) { return versions(opts.FFmpegPath, opts.FFprobePath) }},
+		{"ffmpeg.json", func() ([]byte, error) { return capabilities(opts.FFmpegPath) }},
+		{"disk.json", func() ([]byte, error) { return diskInfo(opts.DataDir) }},
+		{"probes.json", func() ([]byte, error) { return probeReports(opts.DataDir) }},
+	}
+
+	for _, section := range sections {
+		content, err := section.fn()
+		if err != nil {
+			// a failing section shouldn't stop us collecting the rest, so record the error in its place
+			content = []byte(fmt.Sprintf("error collecting %s: %s\n", section.name, err))
+		}
+		if err := add(section.name, content); err != nil {
+			return fmt.Errorf("error writing %s to bundle: %w", section.name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error closing bundle: %w", err)
+	}
+	return gz.Close()
+}
+
+func systemInfo() ([]byte, error) {
+	hostname, _ := os.Hostname()
+	return json.MarshalIndent(map[string]any{
+		"time":       time.Now().UTC(),
+		"hostname":   hostname,
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"go_version": runtime.Version(),
+		"num_cpu":    runtime.NumCPU(),
+	}, "", "  ")
+}
+
+// round trips the config through JSON, replacing the value of any secret looking field
+func redactedConfig(config any) ([]byte, error) {
+	if config == nil {
+		return []byte("{}"), nil
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic any
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redactValue("", generic), "", "  ")
+}
+
+func redactValue(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = redactValue(k, item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(key, item)
+		}
+		return v
+	case string:
+		if v != "" && secretFieldRegex.MatchString(key) {
+			return "xxxxx"
+		}
+		return RedactText(v)
+	}
+	return v
+}
+
+// RedactText redacts credentials from any URLs within the passed in text
+func RedactText(s string) string {
+	return textURLRegex.ReplaceAllStringFunc(s, creds.Redact)
+}
+
+func tailLog(path string, lines int) ([]byte, error) {
+	if path == "" {
+		return []byte("no log file configured\n"), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tail := make([]string, 0, lines)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(tail) == lines {
+			tail = tail[1:]
+		}
+		tail = append(tail, RedactText(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(tail, "\n") + "\n"), nil
+}
+
+func versions(binaries ...string) ([]byte, error) {
+	out := &strings.Builder{}
+	for _, bin := range binaries {
+		if bin == "" {
+			continue
+		}
+		version, err := exec.Command(bin, "-version").Output()
+		if err != nil {
+			fmt.Fprintf(out, "%s: error: %s\n\n", bin, err)
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n%s\n", bin, version)
+	}
+	return []byte(out.String()), nil
+}
+
+// the hardware acceleration methods, encoders and decoders the passed in ffmpeg was built with
+func capabilities(ffmpegPath string) ([]byte, error) {
+	if ffmpegPath == "" {
+		return []byte("{}"), nil
+	}
+	host, err := ffmpeg.ProbeHost(context.Background(), ffmpegPath)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(host, "", "  ")
+}
+
+func diskInfo(dir string) ([]byte, error) {
+	if dir == "" {
+		return []byte("{}"), nil
+	}
+
+	info := map[string]any{"data_dir": dir}
+
+	if total, free, err := diskUsage(dir); err == nil {
+		info["disk_total_bytes"] = total
+		info["disk_free_bytes"] = free
+	} else {
+		info["disk_error"] = err.Error()
+	}
+
+	files, size := 0, int64(0)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			files++
+			size += fi.Size()
+		}
+		return nil
+	})
+	info["data_files"] = files
+	info["data_bytes"] = size
+
+	return json.MarshalIndent(info, "", "  ")
+}
+
+// includes the persisted probe results, these never contain passwords
+func probeReports(dir string) ([]byte, error) {
+	if dir == "" {
+		return []byte("{}"), nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "probes.json"))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(RedactText(string(b))), nil
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package diag
+
+import "golang.org/x/sys/unix"
+
+// returns the total and free bytes on the filesystem containing the passed in path
+func diskUsage(path string) (uint64, uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
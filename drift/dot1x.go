@@ -0,0 +1,238 @@
+package drift
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// the token of the 802.1X configuration we create on cameras if the desired state doesn't name one
+const defaultDot1XToken = "govr"
+
+// Dot1XState is how a camera should authenticate itself to the network with 802.1X, for sites with port based network
+// access control
+type Dot1XState struct {
+	// the token of the configuration on the camera, defaults to govr
+	Token string `json:"token,omitempty"`
+
+	Identity    string `json:"identity"`
+	AnonymousID string `json:"anonymous_id,omitempty"`
+
+	// the EAP method to authenticate with, md5, tls, ttls or peap
+	EAPMethod string `json:"eap_method"`
+
+	// the password of methods which use one, which cameras never give back so is only set along with other changes
+	Password string `json:"password,omitempty"`
+
+	// the CA certificates the camera should trust to authenticate the network, uploaded if it doesn't have them
+	CACertificates []CertificateState `json:"ca_certificates,omitempty"`
+
+	// the certificate the camera should identify itself with for EAP-TLS, uploaded if it doesn't have it
+	Certificate *CertificateState `json:"certificate,omitempty"`
+}
+
+// CertificateState is a certificate a camera should have, PEM encoded, which for a certificate the camera identifies
+// itself with is followed by its private key
+type CertificateState struct {
+	ID  string `json:"id"`
+	PEM string `json:"pem"`
+}
+
+// returns the token of the desired configuration
+func (s *Dot1XState) token() string {
+	if s.Token == "" {
+		return defaultDot1XToken
+	}
+	return s.Token
+}
+
+// returns the desired configuration as the camera describes it
+func (s *Dot1XState) configuration() (onvif.Dot1XConfiguration, error) {
+	method, err := onvif.ParseEAPMethod(s.EAPMethod)
+	if err != nil {
+		return onvif.Dot1XConfiguration{}, err
+	}
+	c := onvif.Dot1XConfiguration{Token: s.token(), Identity: s.Identity, AnonymousID: s.AnonymousID, EAPMethod: method}
+	for _, ca := range s.CACertificates {
+		c.CACertificateIDs = append(c.CACertificateIDs, ca.ID)
+	}
+	if s.Certificate != nil {
+		c.CertificateID = s.Certificate.ID
+	}
+	return c, nil
+}
+
+// returns a description of each way the 802.1X configuration of the device differs from that desired
+func checkDot1X(log *slog.Logger, d *onvif.Device, desired *Dot1XState) ([]string, error) {
+	want, err := desired.configuration()
+	if err != nil {
+		return nil, err
+	}
+	diffs := []string{}
+
+	missing, err := missingCertificates(log, d, desired)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range missing {
+		diffs = append(diffs, fmt.Sprintf("certificate %s: missing", c.ID))
+	}
+
+	configs, err := d.GetDot1XConfigurations(log)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(configs, func(c onvif.Dot1XConfiguration) bool { return c.Token == want.Token })
+	if i < 0 {
+		return append(diffs, fmt.Sprintf("configuration %s: missing", want.Token)), nil
+	}
+	got := configs[i]
+	if got.Identity != want.Identity {
+		diffs = append(diffs, fmt.Sprintf("identity: want %q, got %q", want.Identity, got.Identity))
+	}
+	if got.AnonymousID != want.AnonymousID {
+		diffs = append(diffs, fmt.Sprintf("anonymous_id: want %q, got %q", want.AnonymousID, got.AnonymousID))
+	}
+	if got.EAPMethod != want.EAPMethod {
+		diffs = append(diffs, fmt.Sprintf("eap_method: want %s, got %s", onvif.EAPMethodName(want.EAPMethod), onvif.EAPMethodName(got.EAPMethod)))
+	}
+	if !slices.Equal(got.CACertificateIDs, want.CACertificateIDs) {
+		diffs = append(diffs, fmt.Sprintf("ca_certificates: want %s, got %s", strings.Join(want.CACertificateIDs, ","), strings.Join(got.CACertificateIDs, ",")))
+	}
+	if got.CertificateID != want.CertificateID {
+		diffs = append(diffs, fmt.Sprintf("certificate: want %q, got %q", want.CertificateID, got.CertificateID))
+	}
+
+	iface, err := dot1XInterface(log, d)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Dot1X != want.Token {
+		diffs = append(diffs, fmt.Sprintf("interface %s: want configuration %s, got %q", iface.Token, want.Token, iface.Dot1X))
+	}
+	return diffs, nil
+}
+
+// uploads any certificates the device is missing, creates or updates its 802.1X configuration and has its network
+// interface use it. The device may have to be rebooted for that to take effect, which is left to whoever manages it
+// as it is only reachable afterwards if its switch port accepts it.
+func correctDot1X(log *slog.Logger, d *onvif.Device, desired *Dot1XState) error {
+	want, err := desired.configuration()
+	if err != nil {
+		return err
+	}
+
+	missing, err := missingCertificates(log, d, desired)
+	if err != nil {
+		return err
+	}
+	for _, c := range missing {
+		if err := loadCertificate(log, d, c, desired.Certificate != nil && c.ID == desired.Certificate.ID); err != nil {
+			return err
+		}
+	}
+
+	configs, err := d.GetDot1XConfigurations(log)
+	if err != nil {
+		return err
+	}
+	create := !slices.ContainsFunc(configs, func(c onvif.Dot1XConfiguration) bool { return c.Token == want.Token })
+	if err := d.SetDot1XConfiguration(log, want, desired.Password, create); err != nil {
+		return err
+	}
+
+	iface, err := dot1XInterface(log, d)
+	if err != nil {
+		return err
+	}
+	if iface.Dot1X == want.Token {
+		return nil
+	}
+	reboot, err := d.SetNetworkInterfaceDot1X(log, iface.Token, want.Token)
+	if err != nil {
+		return err
+	}
+	if reboot {
+		log.Warn("device needs rebooting for 802.1x to take effect", slog.String("address", d.Address))
+	}
+	return nil
+}
+
+// returns the desired certificates the device doesn't have, both the CA certificates and its own
+func missingCertificates(log *slog.Logger, d *onvif.Device, desired *Dot1XState) ([]CertificateState, error) {
+	missing := []CertificateState{}
+	has := func(certs []onvif.Certificate, id string) bool {
+		return slices.ContainsFunc(certs, func(c onvif.Certificate) bool { return c.ID == id })
+	}
+
+	if len(desired.CACertificates) > 0 {
+		cas, err := d.GetCACertificates(log)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range desired.CACertificates {
+			if !has(cas, c.ID) {
+				missing = append(missing, c)
+			}
+		}
+	}
+
+	if desired.Certificate != nil {
+		certs, err := d.GetCertificates(log)
+		if err != nil {
+			return nil, err
+		}
+		if !has(certs, desired.Certificate.ID) {
+			missing = append(missing, *desired.Certificate)
+		}
+	}
+	return missing, nil
+}
+
+// uploads the passed in certificate to the device, as a CA certificate or with its private key as its own
+func loadCertificate(log *slog.Logger, d *onvif.Device, c CertificateState, own bool) error {
+	var cert, key []byte
+	rest := []byte(c.PEM)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			cert = block.Bytes
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+			key = block.Bytes
+		}
+	}
+
+	if cert == nil {
+		return fmt.Errorf("certificate %q has no PEM encoded certificate", c.ID)
+	}
+	if !own {
+		return d.LoadCACertificate(log, c.ID, cert)
+	}
+	if key == nil {
+		return fmt.Errorf("certificate %q has no PEM encoded private key", c.ID)
+	}
+	return d.LoadCertificateWithPrivateKey(log, c.ID, cert, key)
+}
+
+// returns the network interface of the device which 802.1X is configured on, its first enabled one
+func dot1XInterface(log *slog.Logger, d *onvif.Device) (onvif.NetworkInterface, error) {
+	ifaces, err := d.GetNetworkInterfaces(log)
+	if err != nil {
+		return onvif.NetworkInterface{}, err
+	}
+	for _, iface := range ifaces {
+		if iface.Enabled {
+			return iface, nil
+		}
+	}
+	return onvif.NetworkInterface{}, errors.New("device has no enabled network interface")
+}
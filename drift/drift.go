@@ -0,0 +1,363 @@
+package drift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// areas of a camera's configuration we check for drift
+const (
+	AreaEncoder = "encoder"
+	AreaOSD     = "osd"
+	AreaNTP     = "ntp"
+	AreaUsers   = "users"
+	AreaDot1X   = "dot1x"
+)
+
+// UserState is an account a camera should have, the password is only used when creating it
+type UserState struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Level    string `json:"level"`
+}
+
+// DesiredState is how a camera should be configured, nil or empty areas aren't checked
+type DesiredState struct {
+	Camera string `json:"camera"`
+
+	// the profile whose encoder is checked, defaults to the first profile which is usually the main stream
+	Profile string                 `json:"profile,omitempty"`
+	Encoder *onvif.EncoderSettings `json:"encoder,omitempty"`
+
+	// the text of the first plain text overlay on the profile's video source
+	OSDText *string `json:"osd_text,omitempty"`
+
+	NTP *onvif.NTPSettings `json:"ntp,omitempty"`
+
+	// accounts which should exist, if exclusive any others are drift and are removed on correction, the account we
+	// connect with is never removed
+	Users          []UserState `json:"users,omitempty"`
+	ExclusiveUsers bool        `json:"exclusive_users,omitempty"`
+
+	// how the camera authenticates itself to the network with 802.1X, along with the certificates it needs for that
+	Dot1X *Dot1XState `json:"dot1x,omitempty"`
+}
+
+// Drift is a single difference between a camera and its desired state
+type Drift struct {
+	Area   string `json:"area"`
+	Detail string `json:"detail"`
+}
+
+func (d Drift) String() string {
+	return d.Area + ": " + d.Detail
+}
+
+// Check reads back the configuration of a probed device and returns how it differs from the desired state
+func Check(log *slog.Logger, d *onvif.Device, desired *DesiredState) ([]Drift, error) {
+	drifts := []Drift{}
+	add := func(area string, details ...string) {
+		for _, detail := range details {
+			drifts = append(drifts, Drift{Area: area, Detail: detail})
+		}
+	}
+
+	profile, err := findProfile(d, desired.Profile)
+	if err != nil && (desired.Encoder != nil || desired.OSDText != nil) {
+		return nil, err
+	}
+
+	if desired.Encoder != nil {
+		current, err := readEncoder(log, d, profile)
+		if err != nil {
+			return nil, err
+		}
+		add(AreaEncoder, desired.Encoder.Diff(current)...)
+	}
+
+	if desired.OSDText != nil {
+		osd, err := findTextOSD(log, d, profile)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case osd == nil:
+			add(AreaOSD, fmt.Sprintf("text: want %q, got no text overlay", *desired.OSDText))
+		case osd.TextString.PlainText != *desired.OSDText:
+			add(AreaOSD, fmt.Sprintf("text: want %q, got %q", *desired.OSDText, osd.TextString.PlainText))
+		}
+	}
+
+	if desired.NTP != nil {
+		current, err := d.GetNTP(log)
+		if err != nil {
+			return nil, err
+		}
+		if current.FromDHCP != desired.NTP.FromDHCP {
+			add(AreaNTP, fmt.Sprintf("from_dhcp: want %v, got %v", desired.NTP.FromDHCP, current.FromDHCP))
+		}
+		if !desired.NTP.FromDHCP && !slices.Equal(current.Servers, desired.NTP.Servers) {
+			add(AreaNTP, fmt.Sprintf("servers: want %s, got %s", strings.Join(desired.NTP.Servers, ","), strings.Join(current.Servers, ",")))
+		}
+	}
+
+	if len(desired.Users) > 0 || desired.ExclusiveUsers {
+		users, err := d.GetUsers(log)
+		if err != nil {
+			return nil, err
+		}
+		add(AreaUsers, diffUsers(d, desired, users)...)
+	}
+
+	if desired.Dot1X != nil {
+		diffs, err := checkDot1X(log, d, desired.Dot1X)
+		if err != nil {
+			return nil, err
+		}
+		add(AreaDot1X, diffs...)
+	}
+
+	return drifts, nil
+}
+
+// Correct changes the configuration of a probed device to match the desired state in each area which has drifted
+func Correct(log *slog.Logger, d *onvif.Device, desired *DesiredState, drifts []Drift) error {
+	areas := map[string]bool{}
+	for _, drift := range drifts {
+		areas[drift.Area] = true
+	}
+
+	errs := []error{}
+	if areas[AreaEncoder] {
+		errs = append(errs, correctEncoder(log, d, desired))
+	}
+	if areas[AreaOSD] {
+		errs = append(errs, correctOSD(log, d, desired))
+	}
+	if areas[AreaNTP] {
+		errs = append(errs, d.SetNTP(log, *desired.NTP))
+	}
+	if areas[AreaUsers] {
+		errs = append(errs, correctUsers(log, d, desired))
+	}
+	if areas[AreaDot1X] {
+		errs = append(errs, correctDot1X(log, d, desired.Dot1X))
+	}
+	return errors.Join(errs...)
+}
+
+func correctEncoder(log *slog.Logger, d *onvif.Device, desired *DesiredState) error {
+	profile, err := findProfile(d, desired.Profile)
+	if err != nil {
+		return err
+	}
+	current, err := readEncoder(log, d, profile)
+	if err != nil {
+		return err
+	}
+	return d.SetVideoEncoderConfiguration(log, profile.Token, desired.Encoder.ApplyTo(current))
+}
+
+func correctOSD(log *slog.Logger, d *onvif.Device, desired *DesiredState) error {
+	profile, err := findProfile(d, desired.Profile)
+	if err != nil {
+		return err
+	}
+	osd, err := findTextOSD(log, d, profile)
+	if err != nil {
+		return err
+	}
+	if osd == nil {
+		return fmt.Errorf("no text overlay on profile %q to set", profile.Token)
+	}
+	return d.SetOSDText(log, osd, *desired.OSDText)
+}
+
+func correctUsers(log *slog.Logger, d *onvif.Device, desired *DesiredState) error {
+	users, err := d.GetUsers(log)
+	if err != nil {
+		return err
+	}
+	existing := map[string]onvif.User{}
+	for _, u := range users {
+		existing[u.Username] = u
+	}
+
+	errs := []error{}
+	for _, want := range desired.Users {
+		got, ok := existing[want.Username]
+		switch {
+		case !ok && want.Password == "":
+			errs = append(errs, fmt.Errorf("no password to create user %q with", want.Username))
+		case !ok:
+			errs = append(errs, d.CreateUser(log, onvif.User{Username: want.Username, UserLevel: want.Level}, want.Password))
+		case !strings.EqualFold(got.UserLevel, want.Level):
+			errs = append(errs, d.SetUserLevel(log, onvif.User{Username: want.Username, UserLevel: want.Level}))
+		}
+	}
+
+	for _, username := range extraUsers(d, desired, users) {
+		errs = append(errs, d.DeleteUser(log, username))
+	}
+	return errors.Join(errs...)
+}
+
+// returns a description of each way the passed in accounts differ from those desired
+func diffUsers(d *onvif.Device, desired *DesiredState, users []onvif.User) []string {
+	diffs := []string{}
+	for _, want := range desired.Users {
+		i := slices.IndexFunc(users, func(u onvif.User) bool { return u.Username == want.Username })
+		if i < 0 {
+			diffs = append(diffs, fmt.Sprintf("%s: missing", want.Username))
+			continue
+		}
+		if !strings.EqualFold(users[i].UserLevel, want.Level) {
+			diffs = append(diffs, fmt.Sprintf("%s: want level %s, got %s", want.Username, want.Level, users[i].UserLevel))
+		}
+	}
+	for _, username := range extraUsers(d, desired, users) {
+		diffs = append(diffs, fmt.Sprintf("%s: unexpected user", username))
+	}
+	return diffs
+}
+
+// returns the accounts on the device which shouldn't be there, always empty unless users are exclusive
+func extraUsers(d *onvif.Device, desired *DesiredState, users []onvif.User) []string {
+	if !desired.ExclusiveUsers {
+		return nil
+	}
+	extra := []string{}
+	for _, u := range users {
+		if u.Username == d.Username {
+			continue
+		}
+		if !slices.ContainsFunc(desired.Users, func(w UserState) bool { return w.Username == u.Username }) {
+			extra = append(extra, u.Username)
+		}
+	}
+	return extra
+}
+
+func findProfile(d *onvif.Device, token string) (*onvif.Profile, error) {
+	if len(d.Profiles) == 0 {
+		return nil, fmt.Errorf("device has no profiles")
+	}
+	if token == "" {
+		return &d.Profiles[0], nil
+	}
+	for i := range d.Profiles {
+		if d.Profiles[i].Token == token {
+			return &d.Profiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no profile with token %q", token)
+}
+
+func readEncoder(log *slog.Logger, d *onvif.Device, profile *onvif.Profile) (*onvif.VideoEncoderConfiguration, error) {
+	if profile.VideoEncoderConfiguration == nil {
+		return nil, fmt.Errorf("profile %q has no video encoder", profile.Token)
+	}
+	return d.GetVideoEncoderConfiguration(log, profile.VideoEncoderConfiguration.Token)
+}
+
+// returns the first plain text overlay on the video source of the passed in profile, nil if there are none
+func findTextOSD(log *slog.Logger, d *onvif.Device, profile *onvif.Profile) (*onvif.OSD, error) {
+	osds, err := d.GetOSDs(log, profile.VideoSourceConfiguration.Token)
+	if err != nil {
+		return nil, err
+	}
+	for i := range osds {
+		if osds[i].IsPlainText() {
+			return &osds[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Report is the result of checking a camera for drift
+type Report struct {
+	Camera    string    `json:"camera"`
+	Checked   time.Time `json:"checked"`
+	Drifts    []Drift   `json:"drifts"`
+	Corrected bool      `json:"corrected"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Detector periodically checks a camera for drift from its desired state
+type Detector struct {
+	log     *slog.Logger
+	device  *onvif.Device
+	desired *DesiredState
+
+	// how often we check
+	Interval time.Duration
+
+	// whether to correct drift once found
+	AutoCorrect bool
+
+	// if set, called with each report which found drift or failed
+	OnDrift func(Report)
+}
+
+func NewDetector(log *slog.Logger, d *onvif.Device, desired *DesiredState) *Detector {
+	return &Detector{
+		log:      log.With("subsystem", "drift", "camera", desired.Camera),
+		device:   d,
+		desired:  desired,
+		Interval: 15 * time.Minute,
+	}
+}
+
+// Check checks our camera for drift once, correcting it if we are set to
+func (dt *Detector) Check() Report {
+	report := Report{Camera: dt.desired.Camera, Checked: time.Now()}
+
+	drifts, err := Check(dt.log, dt.device, dt.desired)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Drifts = drifts
+	if len(drifts) == 0 || !dt.AutoCorrect {
+		return report
+	}
+
+	if err := Correct(dt.log, dt.device, dt.desired, drifts); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Corrected = true
+	return report
+}
+
+// Run checks our camera every interval until the passed in context is done
+func (dt *Detector) Run(ctx context.Context) {
+	ticker := time.NewTicker(dt.Interval)
+	defer ticker.Stop()
+
+	for {
+		report := dt.Check()
+		if report.Error != "" {
+			dt.log.Error("error checking for drift", slog.String("error", report.Error))
+		}
+		for _, drift := range report.Drifts {
+			dt.log.Warn("configuration drift", slog.String("area", drift.Area), slog.String("detail", drift.Detail), slog.Bool("corrected", report.Corrected))
+		}
+		if dt.OnDrift != nil && (report.Error != "" || len(report.Drifts) > 0) {
+			dt.OnDrift(report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+)
+
+// G.711 formats cameras accept for playback through their speakers
+const (
+	FormatMulaw = "mulaw"
+	FormatAlaw  = "alaw"
+)
+
+// EncodeG711 transcodes the audio file at the passed in path to raw 8kHz mono G.711 in the passed in format
+func EncodeG711(ctx context.Context, path string, format string) ([]byte, error) {
+	if format != FormatMulaw && format != FormatAlaw {
+		return nil, fmt.Errorf("unsupported g711 format: %q", format)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", path, "-ar", "8000", "-ac", "1", "-f", format, "-")
+	cmd.Stderr = stderr
+
+	audio, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %q: %w", path, NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return audio, nil
+}
+
+// G711Stream is audio being transcoded live to G.711, read from it as it is produced
+type G711Stream struct {
+	io.Reader
+
+	cmd    *exec.Cmd
+	ctx    context.Context
+	stderr *bytes.Buffer
+}
+
+// StreamG711 transcodes audio from the passed in reader to raw 8kHz mono G.711 in the passed in format as it
+// arrives, for talkback where the audio is still being spoken. The input format is one ffmpeg understands, such as
+// s16le, and empty if ffmpeg should work it out from the audio itself, which works for containers such as WebM or
+// Ogg. Raw inputs take the passed in sample rate and channels.
+func StreamG711(ctx context.Context, in io.Reader, inputFormat string, sampleRate int, channels int, format string) (*G711Stream, error) {
+	if format != FormatMulaw && format != FormatAlaw {
+		return nil, fmt.Errorf("unsupported g711 format: %q", format)
+	}
+
+	// keep what ffmpeg holds back to a minimum, every buffer is delay between speaking and being heard
+	args := []string{"-v", "error", "-fflags", "nobuffer", "-flags", "low_delay"}
+	if inputFormat != "" {
+		args = append(args, "-f", inputFormat, "-ar", strconv.Itoa(sampleRate), "-ac", strconv.Itoa(channels))
+	}
+	args = append(args, "-i", "pipe:0", "-ar", "8000", "-ac", "1", "-f", format, "-flush_packets", "1", "pipe:1")
+
+	s := &G711Stream{ctx: ctx, stderr: &bytes.Buffer{}}
+	s.cmd = exec.CommandContext(ctx, "ffmpeg", args...)
+	s.cmd.Stdin = in
+	s.cmd.Stderr = s.stderr
+
+	out, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating ffmpeg pipe: %w", err)
+	}
+	if err := s.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+	s.Reader = out
+	return s, nil
+}
+
+// Close stops transcoding early, such as when whatever we're sending the audio to has gone away
+func (s *G711Stream) Close() error {
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+	return nil
+}
+
+// Wait waits for transcoding to finish, which it does once the input is exhausted, returning any error from ffmpeg.
+// All output must have been read first.
+func (s *G711Stream) Wait() error {
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("error transcoding audio: %w", NewExecError(s.ctx, err, s.stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// ErrorKind is what went wrong when ffmpeg or ffprobe failed, as far as we can tell from what it wrote
+type ErrorKind string
+
+const (
+	KindUnknown      ErrorKind = "unknown"
+	KindNotInstalled ErrorKind = "not_installed"
+	KindAuth         ErrorKind = "auth"
+	KindTimeout      ErrorKind = "timeout"
+	KindRefused      ErrorKind = "connection_refused"
+	KindNotFound     ErrorKind = "not_found"
+	KindUnsupported  ErrorKind = "unsupported_codec"
+)
+
+// how much of what ffmpeg wrote we keep, its last lines are those which explain why it gave up
+const maxStderr = 2048
+
+// phrases in ffmpeg's output which tell us what went wrong, the first to match wins so more specific ones are first
+var errorPhrases = []struct {
+	phrase string
+	kind   ErrorKind
+}{
+	{"401 unauthorized", KindAuth},
+	{"403 forbidden", KindAuth},
+	{"authorization failed", KindAuth},
+	{"connection refused", KindRefused},
+	{"connection timed out", KindTimeout},
+	{"operation timed out", KindTimeout},
+	{"timeout", KindTimeout},
+	{"404 not found", KindNotFound},
+	{"no such file or directory", KindNotFound},
+	{"unsupported codec", KindUnsupported},
+	{"decoder not found", KindUnsupported},
+	{"could not find codec parameters", KindUnsupported},
+	{"not supported", KindUnsupported},
+	{"invalid data found when processing input", KindUnsupported},
+}
+
+// ExecError is returned when ffmpeg or ffprobe fails, with the tail of what it wrote to stderr and what kind of
+// failure that looks like
+type ExecError struct {
+	Err    error
+	Stderr string
+	Kind   ErrorKind
+}
+
+// NewExecError returns the error for a run of ffmpeg or ffprobe with the passed in context which failed with the
+// passed in error after writing the passed in stderr
+func NewExecError(ctx context.Context, err error, stderr []byte) *ExecError {
+	stderr = bytes.TrimSpace(stderr)
+	if len(stderr) > maxStderr {
+		stderr = stderr[len(stderr)-maxStderr:]
+	}
+	e := &ExecError{Err: err, Stderr: string(stderr), Kind: KindUnknown}
+
+	switch {
+	case errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist):
+		// not on our path, or not at the path we were given
+		e.Kind = KindNotInstalled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		e.Kind = KindTimeout
+	default:
+		lower := strings.ToLower(e.Stderr)
+		for _, p := range errorPhrases {
+			if strings.Contains(lower, p.phrase) {
+				e.Kind = p.kind
+				break
+			}
+		}
+	}
+	return e
+}
+
+func (e *ExecError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ": " + e.Stderr
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of failure the passed in error is, unknown if it isn't from ffmpeg or ffprobe
+func KindOf(err error) ErrorKind {
+	e := &ExecError{}
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindUnknown
+}
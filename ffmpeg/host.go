@@ -0,0 +1,173 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMissingCodec is returned when the ffmpeg we use wasn't built with an encoder or decoder we need
+var ErrMissingCodec = errors.New("ffmpeg is missing a codec")
+
+// how long ffmpeg is given to list what it was built with
+const hostProbeTimeout = 10 * time.Second
+
+// Codec is an encoder or decoder ffmpeg was built with
+type Codec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// Host is what the ffmpeg on this host can do, the hardware acceleration methods, encoders and decoders it was built
+// with. Hardware methods being built in doesn't mean the hardware they need is present.
+type Host struct {
+	Path     string   `json:"path"`
+	Version  string   `json:"version"`
+	HWAccels []string `json:"hwaccels"`
+	Encoders []Codec  `json:"encoders"`
+	Decoders []Codec  `json:"decoders"`
+}
+
+// HasEncoder returns whether ffmpeg has the encoder with the passed in name, such as libx264 or h264_nvenc
+func (h *Host) HasEncoder(name string) bool {
+	return slices.ContainsFunc(h.Encoders, func(c Codec) bool { return c.Name == name })
+}
+
+// HasDecoder returns whether ffmpeg has the decoder with the passed in name, such as hevc
+func (h *Host) HasDecoder(name string) bool {
+	return slices.ContainsFunc(h.Decoders, func(c Codec) bool { return c.Name == name })
+}
+
+// HasHWAccel returns whether ffmpeg has the hardware acceleration method with the passed in name, such as cuda
+func (h *Host) HasHWAccel(name string) bool {
+	return slices.Contains(h.HWAccels, name)
+}
+
+// RequireEncoder returns ErrMissingCodec if ffmpeg doesn't have the encoder with the passed in name
+func (h *Host) RequireEncoder(name string) error {
+	if !h.HasEncoder(name) {
+		return fmt.Errorf("%w: %s has no %s encoder", ErrMissingCodec, h.Path, name)
+	}
+	return nil
+}
+
+// RequireDecoder returns ErrMissingCodec if ffmpeg doesn't have the decoder with the passed in name
+func (h *Host) RequireDecoder(name string) error {
+	if !h.HasDecoder(name) {
+		return fmt.Errorf("%w: %s has no %s decoder", ErrMissingCodec, h.Path, name)
+	}
+	return nil
+}
+
+var (
+	hostsMu sync.Mutex
+	hosts   = map[string]*Host{}
+)
+
+// ProbeHost returns what the passed in ffmpeg binary can do, empty for ffmpeg on our path. What it was built with
+// doesn't change while we run so it is only asked once, unless asking fails.
+func ProbeHost(ctx context.Context, ffmpegPath string) (*Host, error) {
+	ffmpegPath = cmp.Or(ffmpegPath, "ffmpeg")
+
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+
+	if host, found := hosts[ffmpegPath]; found {
+		return host, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hostProbeTimeout)
+	defer cancel()
+
+	host := &Host{Path: ffmpegPath}
+	version, err := runHost(ctx, ffmpegPath, "-version")
+	if err != nil {
+		return nil, err
+	}
+	host.Version = parseVersion(version)
+
+	hwaccels, err := runHost(ctx, ffmpegPath, "-hwaccels")
+	if err != nil {
+		return nil, err
+	}
+	host.HWAccels = parseHWAccels(hwaccels)
+
+	encoders, err := runHost(ctx, ffmpegPath, "-encoders")
+	if err != nil {
+		return nil, err
+	}
+	host.Encoders = parseCodecs(encoders)
+
+	decoders, err := runHost(ctx, ffmpegPath, "-decoders")
+	if err != nil {
+		return nil, err
+	}
+	host.Decoders = parseCodecs(decoders)
+
+	hosts[ffmpegPath] = host
+	return host, nil
+}
+
+// runs ffmpeg with the passed in listing flag and returns what it lists
+func runHost(ctx context.Context, ffmpegPath string, flag string) ([]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", flag)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %s %s: %w", ffmpegPath, flag, NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// returns the version from the output of ffmpeg -version, whose first line looks like
+// "ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023 the FFmpeg developers"
+func parseVersion(out []byte) string {
+	first, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(first))
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2]
+	}
+	return ""
+}
+
+// returns the methods in the output of ffmpeg -hwaccels, which lists one per line after a heading
+func parseHWAccels(out []byte) []string {
+	hwaccels := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		hwaccels = append(hwaccels, line)
+	}
+	return hwaccels
+}
+
+// returns the codecs in the output of ffmpeg -encoders or -decoders, which list a legend then lines which look like
+// " V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)", the first flag being the type of codec
+func parseCodecs(out []byte) []Codec {
+	types := map[byte]string{'V': "video", 'A': "audio", 'S': "subtitle"}
+
+	codecs := []Codec{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields[0]) != 6 || types[fields[0][0]] == "" || fields[1] == "=" {
+			continue
+		}
+		codecs = append(codecs, Codec{
+			Name:        fields[1],
+			Type:        types[fields[0][0]],
+			Description: strings.Join(fields[2:], " "),
+		})
+	}
+	return codecs
+}
@@ -1,41 +1,225 @@
 package ffmpeg
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/media"
 )
 
-type Stream struct {
-	Index         int    `json:"index"`
-	CodecType     string `json:"codec_type"`
-	CodecName     string `json:"codec_name"`
-	CodecLongName string `json:"codec_long_name"`
-	Width         int    `json:"width"`
-	Height        int    `json:"height"`
-	FrameRate     string `json:"avg_frame_rate"`
-}
+// Stream is a stream as described by ffprobe
+//
+// Deprecated: use media.StreamInfo
+type Stream = media.StreamInfo
 
 type StreamProbe struct {
-	Streams []Stream `json:"streams"`
+	Streams []media.StreamInfo `json:"streams"`
+	Format  Format             `json:"format"`
 }
 
-func ProbeRTSP(log *slog.Logger, url string) ([]Stream, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
-	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", url)
-	stout, err := cmd.Output()
+// Video returns the first video stream of this probe
+func (p *StreamProbe) Video() (media.StreamInfo, bool) {
+	for _, s := range p.Streams {
+		if s.IsVideo() {
+			return s, true
+		}
+	}
+	return media.StreamInfo{}, false
+}
+
+// Audio returns the first audio stream of this probe
+func (p *StreamProbe) Audio() (media.StreamInfo, bool) {
+	for _, s := range p.Streams {
+		if s.IsAudio() {
+			return s, true
+		}
+	}
+	return media.StreamInfo{}, false
+}
+
+// Format is the container of a probed file or stream as described by ffprobe, duration and size are only known for
+// files
+type Format struct {
+	Name      string            `json:"format_name"`
+	LongName  string            `json:"format_long_name,omitempty"`
+	Streams   int               `json:"nb_streams,omitempty"`
+	StartTime string            `json:"start_time,omitempty"`
+	Duration  string            `json:"duration"`
+	Size      media.Number      `json:"size,omitempty"`
+	BitRate   media.Number      `json:"bit_rate,omitempty"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// Container returns the container of this format, ffprobe names formats by every container they demux such as
+// mov,mp4,m4a so this is the first of those
+func (f Format) Container() string {
+	name, _, _ := strings.Cut(f.Name, ",")
+	return name
+}
+
+// Seconds returns the duration of this format, zero if it is unknown
+func (f Format) Seconds() float64 {
+	seconds, _ := strconv.ParseFloat(f.Duration, 64)
+	return seconds
+}
+
+// how long probes take at most by default, files are local so we can afford to wait on large ones
+const (
+	defaultURLTimeout  = 15 * time.Second
+	defaultFileTimeout = 30 * time.Second
+)
+
+// Prober runs ffprobe, any fields left empty are taken from the environment and otherwise defaulted:
+//
+//   - GOVR_FFPROBE_PATH, the ffprobe binary, defaulting to ffprobe on our path
+//   - GOVR_FFPROBE_TIMEOUT, such as 30s, how long a probe takes at most
+//   - GOVR_FFPROBE_TRANSPORT, tcp or udp, the transport used to probe RTSP streams
+//   - GOVR_FFPROBE_ARGS, space separated arguments added before the input, such as -analyzeduration 10M
+//
+// Invalid values in the environment are ignored.
+type Prober struct {
+	BinaryPath string
+
+	// how long a probe takes at most, defaults to 15s for streams and 30s for files
+	Timeout time.Duration
+
+	// the transport used for RTSP streams, left to ffprobe if empty which tries UDP before TCP
+	Transport string
+
+	// arguments added before the input, for options we don't otherwise expose
+	AdditionalArgs []string
+}
+
+// defaultProber is used by our package level functions, so is entirely configured by the environment
+var defaultProber = &Prober{}
+
+// Available returns whether our ffprobe binary can be found
+func (p *Prober) Available() bool {
+	_, err := exec.LookPath(p.binary())
+	return err == nil
+}
+
+// ProbeURL probes the stream at the passed in URL, returning its streams and format
+func (p *Prober) ProbeURL(ctx context.Context, log *slog.Logger, url *creds.URL) (*StreamProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout(defaultURLTimeout))
+	defer cancel()
+
+	args := []string{}
+	if transport := p.transport(); transport != "" && strings.HasPrefix(strings.ToLower(url.Secret()), "rtsp") {
+		args = append(args, "-rtsp_transport", transport)
+	}
+	stout, err := p.run(ctx, args, url.Secret())
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debug("ffprobe complete", slog.String("url", url), slog.String("stout", string(stout)))
+	log.Debug("ffprobe complete", slog.Any("url", url), slog.String("stout", string(stout)))
 
 	probe := &StreamProbe{}
 	err = json.Unmarshal(stout, probe)
 	if err != nil {
 		return nil, err
 	}
+	return probe, nil
+}
+
+// ProbeFile probes the local video file at the passed in path
+func (p *Prober) ProbeFile(ctx context.Context, log *slog.Logger, path string) (*StreamProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout(defaultFileTimeout))
+	defer cancel()
+
+	stout, err := p.run(ctx, nil, path)
+	if err != nil {
+		return nil, fmt.Errorf("error probing %q: %w", path, err)
+	}
+
+	log.Debug("ffprobe complete", slog.String("path", path), slog.String("stout", string(stout)))
+
+	probe := &StreamProbe{}
+	if err := json.Unmarshal(stout, probe); err != nil {
+		return nil, fmt.Errorf("error parsing probe of %q: %w", path, err)
+	}
+	return probe, nil
+}
+
+// runs ffprobe on the passed in input with the passed in input options, returning its JSON output or an ExecError
+func (p *Prober) run(ctx context.Context, options []string, input string) ([]byte, error) {
+	args := []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams"}
+	args = append(args, options...)
+	args = append(args, p.additionalArgs()...)
+	args = append(args, input)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, p.binary(), args...)
+	cmd.Stderr = stderr
+	stout, err := cmd.Output()
+	if err != nil {
+		return nil, NewExecError(ctx, err, stderr.Bytes())
+	}
+	return stout, nil
+}
+
+func (p *Prober) binary() string {
+	return cmp.Or(p.BinaryPath, os.Getenv("GOVR_FFPROBE_PATH"), "ffprobe")
+}
+
+func (p *Prober) timeout(fallback time.Duration) time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("GOVR_FFPROBE_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return fallback
+}
+
+func (p *Prober) transport() string {
+	if p.Transport != "" {
+		return p.Transport
+	}
+	if transport := strings.ToLower(os.Getenv("GOVR_FFPROBE_TRANSPORT")); transport == "tcp" || transport == "udp" {
+		return transport
+	}
+	return ""
+}
+
+func (p *Prober) additionalArgs() []string {
+	if p.AdditionalArgs != nil {
+		return p.AdditionalArgs
+	}
+	return strings.Fields(os.Getenv("GOVR_FFPROBE_ARGS"))
+}
+
+// FFprobeAvailable returns whether the ffprobe binary is on our path
+func FFprobeAvailable() bool {
+	return defaultProber.Available()
+}
+
+// ProbeRTSP returns the streams of the RTSP stream at the passed in URL
+func ProbeRTSP(log *slog.Logger, url *creds.URL) ([]media.StreamInfo, error) {
+	probe, err := ProbeURL(context.Background(), log, url)
+	if err != nil {
+		return nil, err
+	}
 	return probe.Streams, nil
 }
+
+// ProbeURL probes the stream at the passed in URL, returning its streams and format
+func ProbeURL(ctx context.Context, log *slog.Logger, url *creds.URL) (*StreamProbe, error) {
+	return defaultProber.ProbeURL(ctx, log, url)
+}
+
+// ProbeFile probes the local video file at the passed in path
+func ProbeFile(ctx context.Context, log *slog.Logger, path string) (*StreamProbe, error) {
+	return defaultProber.ProbeFile(ctx, log, path)
+}
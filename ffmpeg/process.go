@@ -0,0 +1,343 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrExited is the error a process which exited without an error stopped with, ffmpeg reading a live stream is only
+// expected to stop when we stop it
+var ErrExited = errors.New("ffmpeg exited")
+
+// Progress is what ffmpeg last reported about how it is getting on
+type Progress struct {
+	// the frames written so far and how quickly, and any duplicated or dropped to keep to the output frame rate
+	Frame      int64   `json:"frame"`
+	FPS        float64 `json:"fps"`
+	DupFrames  int64   `json:"dup_frames"`
+	DropFrames int64   `json:"drop_frames"`
+
+	// the kilobits per second being written, the bytes written so far and how far into the output they go
+	BitRate   float64       `json:"bit_rate"`
+	TotalSize int64         `json:"total_size"`
+	OutTime   time.Duration `json:"out_time"`
+
+	// how many times faster than real time ffmpeg is running, around 1 for a live stream which is keeping up
+	Speed float64 `json:"speed"`
+
+	// when ffmpeg reported this
+	Time time.Time `json:"time"`
+}
+
+// ProcessConfig configures a long running ffmpeg process
+type ProcessConfig struct {
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+
+	// returns the arguments to run ffmpeg with, called before each start so they can change between them. We read
+	// its progress on a pipe of our own and stop it with its stdin so these mustn't include -progress or -nostdin.
+	Args func() []string
+
+	// any variables to add to our environment for ffmpeg
+	Env []string
+
+	// if set, called with ffmpeg's stdout each time it starts, which it should read until it is closed
+	Output func(io.Reader)
+
+	// if set, called before each start of ffmpeg, and with each progress report ffmpeg makes
+	OnStart    func()
+	OnProgress func(Progress)
+
+	// how long ffmpeg is given to finish what it is writing once asked to stop, before it is killed
+	StopTimeout time.Duration
+
+	// how long to wait before restarting after ffmpeg exits, doubled on each consecutive failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Process runs ffmpeg, restarting it with a backoff whenever it exits, and keeps track of how it is progressing.
+// Stopping it asks ffmpeg to quit, as if q had been pressed, so that it finishes the files it is writing.
+type Process struct {
+	log *slog.Logger
+	cfg ProcessConfig
+
+	mu           sync.Mutex
+	progress     Progress
+	lastProgress time.Time
+	restarts     int
+	lastErr      error
+	restart      context.CancelFunc
+}
+
+// NewProcess creates a new process which logs to the passed in logger, that of whatever the process is for
+func NewProcess(log *slog.Logger, cfg ProcessConfig) *Process {
+	cfg.FFmpegPath = cmp.Or(cfg.FFmpegPath, "ffmpeg")
+	if cfg.StopTimeout <= 0 {
+		cfg.StopTimeout = 10 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	return &Process{log: log, cfg: cfg}
+}
+
+// Progress returns the last progress report ffmpeg made
+func (p *Process) Progress() Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.progress
+}
+
+// LastProgress returns when ffmpeg last made any progress, or when we first started it if it hasn't yet
+func (p *Process) LastProgress() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastProgress
+}
+
+// Status returns how many times we've had to restart ffmpeg and the last error that caused it
+func (p *Process) Status() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.restarts, p.lastErr
+}
+
+// Restart stops ffmpeg, which is restarted after the usual backoff, used when it has stalled without noticing
+func (p *Process) Restart() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.restart != nil {
+		p.restart()
+	}
+}
+
+// Progressed records that whatever ffmpeg is reading moved on at the passed in time, for callers which can tell from
+// its output sooner than its progress reports
+func (p *Process) Progressed(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastProgress = now
+}
+
+// Run runs ffmpeg until the passed in context is done, restarting it whenever it exits with a backoff which doubles
+// on each consecutive failure
+func (p *Process) Run(ctx context.Context) {
+	backoff := p.cfg.MinBackoff
+	for {
+		started := time.Now()
+		runCtx, cancel := context.WithCancel(ctx)
+		p.started(started, cancel)
+		err := p.RunOnce(runCtx)
+		restarted := runCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = ErrExited
+		}
+		if restarted {
+			err = fmt.Errorf("restarted: %w", err)
+		}
+
+		// ffmpeg which ran for a good while before failing gets a fresh backoff, one which stalled doesn't
+		if p.LastProgress().Sub(started) > p.cfg.MaxBackoff {
+			backoff = p.cfg.MinBackoff
+		}
+
+		p.failed(err)
+		p.log.Warn("ffmpeg stopped, restarting", slog.Any("error", err), slog.String("kind", string(KindOf(err))), slog.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, p.cfg.MaxBackoff)
+	}
+}
+
+// RunOnce runs ffmpeg once, until it exits or the passed in context is done, returning nil if it exited cleanly
+func (p *Process) RunOnce(ctx context.Context) error {
+	if p.cfg.OnStart != nil {
+		p.cfg.OnStart()
+	}
+
+	cmd := exec.CommandContext(ctx, p.cfg.FFmpegPath, append([]string{"-progress", "pipe:3"}, p.cfg.Args()...)...)
+	if len(p.cfg.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.cfg.Env...)
+	}
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+
+	// ffmpeg quits when q is pressed, finishing what it is writing, and is killed if it hasn't by our stop timeout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("error creating ffmpeg stdin pipe: %w", err)
+	}
+	cmd.Cancel = func() error {
+		_, err := io.WriteString(stdin, "q")
+		return err
+	}
+	cmd.WaitDelay = p.cfg.StopTimeout
+
+	var stdout io.Reader
+	if p.cfg.Output != nil {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return fmt.Errorf("error creating ffmpeg stdout pipe: %w", err)
+		}
+	}
+
+	// progress is reported on the first of ffmpeg's extra files, leaving stdout free for output
+	progress, progressWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error creating ffmpeg progress pipe: %w", err)
+	}
+	defer progress.Close()
+	cmd.ExtraFiles = []*os.File{progressWriter}
+
+	err = cmd.Start()
+	progressWriter.Close()
+	if err != nil {
+		return fmt.Errorf("error starting ffmpeg: %w", NewExecError(ctx, err, nil))
+	}
+	go p.trackProgress(progress)
+
+	if stdout != nil {
+		p.cfg.Output(stdout)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg exited: %w", NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return nil
+}
+
+// records the start of an attempt at running ffmpeg which can be stopped with the passed in cancel func, a restart
+// doesn't count as progress so ffmpeg which stays stalled across restarts still looks stalled
+func (p *Process) started(now time.Time, cancel context.CancelFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastProgress.IsZero() {
+		p.lastProgress = now
+	}
+	p.restart = cancel
+}
+
+func (p *Process) failed(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.restarts++
+	p.lastErr = err
+}
+
+// reads ffmpeg's progress reports, blocks of key=value lines which each end with a progress line, noting each time
+// the frame count or the time written up to moves on
+func (p *Process) trackProgress(r io.Reader) {
+	var report, last Progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if key != "progress" {
+			parseProgress(&report, key, value)
+			continue
+		}
+
+		now := time.Now()
+		report.Time = now
+		p.mu.Lock()
+		p.progress = report
+		if report.Frame != last.Frame || report.OutTime != last.OutTime {
+			p.lastProgress = now
+		}
+		p.mu.Unlock()
+
+		if p.cfg.OnProgress != nil {
+			p.cfg.OnProgress(report)
+		}
+		last = report
+	}
+}
+
+// sets the field of the passed in report named by the passed in key from a progress line, values ffmpeg doesn't know
+// are N/A and leave the field as it was
+func parseProgress(report *Progress, key string, value string) {
+	value = strings.TrimSpace(value)
+	integer := func() int64 {
+		i, _ := strconv.ParseInt(value, 10, 64)
+		return i
+	}
+	float := func(suffix string) float64 {
+		f, _ := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, suffix)), 64)
+		return f
+	}
+	if value == "" || value == "N/A" {
+		return
+	}
+
+	switch key {
+	case "frame":
+		report.Frame = integer()
+	case "fps":
+		report.FPS = float("")
+	case "bitrate":
+		report.BitRate = float("kbits/s")
+	case "total_size":
+		report.TotalSize = integer()
+	case "out_time_us":
+		report.OutTime = time.Duration(integer()) * time.Microsecond
+	case "dup_frames":
+		report.DupFrames = integer()
+	case "drop_frames":
+		report.DropFrames = integer()
+	case "speed":
+		report.Speed = float("x")
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it, enough to report why ffmpeg exited
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf
+}
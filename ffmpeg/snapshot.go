@@ -0,0 +1,38 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// KeyframeJPEG decodes the passed in keyframe, raw Annex B H.264 or H.265 along with its parameter sets, to a JPEG
+// at the passed in quality from 2, the best, to 31, using the ffmpeg binary at the passed in path
+func KeyframeJPEG(ctx context.Context, ffmpegPath string, codec string, frame []byte, quality int) ([]byte, error) {
+	if codec != CodecH264 && codec != CodecH265 {
+		return nil, fmt.Errorf("unsupported keyframe codec: %q", codec)
+	}
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", codec, "-i", "pipe:0",
+		"-frames:v", "1",
+		"-q:v", strconv.Itoa(min(max(quality, 2), 31)),
+		"-f", "image2", "-c:v", "mjpeg",
+		"pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(frame)
+	cmd.Stderr = stderr
+
+	jpeg, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding keyframe: %w", NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return jpeg, nil
+}
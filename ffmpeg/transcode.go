@@ -0,0 +1,332 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Accel is how video is encoded, in software or with one of the hardware encoders ffmpeg supports
+type Accel string
+
+const (
+	AccelSoftware     Accel = "software"
+	AccelNVENC        Accel = "nvenc"
+	AccelQSV          Accel = "qsv"
+	AccelVAAPI        Accel = "vaapi"
+	AccelVideoToolbox Accel = "videotoolbox"
+)
+
+// Codecs we can transcode to, or copy to remux without transcoding
+const (
+	CodecH264 = "h264"
+	CodecH265 = "hevc"
+	CodecCopy = "copy"
+)
+
+// the render node VAAPI encodes on when none is configured, the first GPU
+const defaultVAAPIDevice = "/dev/dri/renderD128"
+
+// how long each hardware encoder is given to prove it works
+const accelTestTimeout = 10 * time.Second
+
+// DefaultAccels returns the hardware encoders to try on this platform, best first
+func DefaultAccels() []Accel {
+	if runtime.GOOS == "darwin" {
+		return []Accel{AccelVideoToolbox}
+	}
+	return []Accel{AccelNVENC, AccelQSV, AccelVAAPI}
+}
+
+// Video is how video is transcoded
+type Video struct {
+	// the codec to transcode to, one of CodecH264, CodecH265 or CodecCopy to remux without transcoding
+	Codec string
+
+	// the size to scale to, zero to keep the size of the input, setting only one keeps the aspect ratio
+	Width  int
+	Height int
+
+	// the bits per second to encode at, zero for a constant quality
+	BitRate int
+
+	// the frames between keyframes, zero to leave to the encoder
+	GOP int
+
+	// any filter applied before scaling, such as one burning in a timestamp
+	Filter string
+}
+
+// TranscodeRequest is a single transcode or remux from an input to an output
+type TranscodeRequest struct {
+	// the file or URL to read, and any options to read it with such as -rtsp_transport tcp
+	Input     string
+	InputArgs []string
+
+	Video Video
+
+	// the audio codec to use, such as aac or none to drop the audio, empty to copy it
+	Audio string
+
+	// the container format and the file to write
+	Format string
+	Output string
+}
+
+// Transcoder transcodes or remuxes video, selecting the best hardware encoder which works on this host and falling
+// back to software encoding if there are none or they fail
+type Transcoder struct {
+	log *slog.Logger
+
+	// the ffmpeg binary to use
+	FFmpegPath string
+
+	// the hardware encoders to try, best first, empty to always encode in software
+	Accels []Accel
+
+	// the render node used by VAAPI
+	VAAPIDevice string
+
+	mu     sync.Mutex
+	probed map[string]Accel
+	failed map[Accel]bool
+}
+
+// NewTranscoder creates a new transcoder using the passed in ffmpeg binary, empty for ffmpeg on our path, which tries
+// the hardware encoders of this platform
+func NewTranscoder(log *slog.Logger, ffmpegPath string) *Transcoder {
+	return &Transcoder{
+		log:         log.With("subsystem", "transcode"),
+		FFmpegPath:  cmp.Or(ffmpegPath, "ffmpeg"),
+		Accels:      DefaultAccels(),
+		VAAPIDevice: defaultVAAPIDevice,
+		probed:      make(map[string]Accel),
+		failed:      make(map[Accel]bool),
+	}
+}
+
+// Select returns the best encoder for the passed in codec which works on this host, the first time for each codec
+// this tries each of our hardware encoders in turn with a short test encode
+func (t *Transcoder) Select(ctx context.Context, codec string) Accel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if accel, found := t.probed[codec]; found && !t.failed[accel] {
+		return accel
+	}
+
+	// hardware encoders need to have been built in, along with the method of decoding on the same hardware we use
+	host, err := ProbeHost(ctx, t.FFmpegPath)
+	if err != nil {
+		t.log.Warn("unable to probe ffmpeg, encoding in software", slog.String("error", err.Error()))
+	}
+
+	accel := AccelSoftware
+	for _, candidate := range t.Accels {
+		if t.failed[candidate] || host == nil || !host.HasEncoder(encoderName(candidate, codec)) {
+			continue
+		}
+		if hwaccel := decodeAccel(candidate); hwaccel != "" && !host.HasHWAccel(hwaccel) {
+			continue
+		}
+		if err := t.test(ctx, candidate, codec); err != nil {
+			t.log.Debug("hardware encoder unavailable", slog.String("accel", string(candidate)), slog.String("codec", codec), slog.String("error", err.Error()))
+			continue
+		}
+		accel = candidate
+		break
+	}
+
+	t.log.Info("selected video encoder", slog.String("codec", codec), slog.String("accel", string(accel)))
+	t.probed[codec] = accel
+	return accel
+}
+
+// Failed marks the passed in hardware encoder as not working, such as when a transcode using it failed, so that it
+// isn't selected again
+func (t *Transcoder) Failed(accel Accel) {
+	if accel == AccelSoftware {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.failed[accel] {
+		t.log.Warn("hardware encoder failed, no longer using it", slog.String("accel", string(accel)))
+		t.failed[accel] = true
+	}
+}
+
+// Args returns the arguments which transcode video as described with the passed in encoder, those which go before
+// the input and those which go after it
+func (t *Transcoder) Args(accel Accel, v Video) ([]string, []string) {
+	if v.Codec == CodecCopy || v.Codec == "" {
+		return nil, []string{"-c:v", "copy"}
+	}
+
+	input := []string{}
+	filters := []string{}
+	if v.Filter != "" {
+		filters = append(filters, v.Filter)
+	}
+	if v.Width > 0 || v.Height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", cmp.Or(v.Width, -2), cmp.Or(v.Height, -2)))
+	}
+	output := []string{}
+
+	switch accel {
+	case AccelNVENC:
+		// frames are decoded on the GPU too, and copied back for any filters
+		input = append(input, "-hwaccel", decodeAccel(accel))
+		output = append(output, "-c:v", encoderName(accel, v.Codec), "-preset", "p4")
+		if v.BitRate == 0 {
+			output = append(output, "-cq", "23")
+		}
+	case AccelQSV:
+		filters = append(filters, "format=nv12")
+		output = append(output, "-c:v", encoderName(accel, v.Codec), "-preset", "veryfast")
+		if v.BitRate == 0 {
+			output = append(output, "-global_quality", "23")
+		}
+	case AccelVAAPI:
+		input = append(input, "-vaapi_device", cmp.Or(t.VAAPIDevice, defaultVAAPIDevice))
+		filters = append(filters, "format=nv12", "hwupload")
+		output = append(output, "-c:v", encoderName(accel, v.Codec))
+		if v.BitRate == 0 {
+			output = append(output, "-qp", "23")
+		}
+	case AccelVideoToolbox:
+		input = append(input, "-hwaccel", decodeAccel(accel))
+		output = append(output, "-c:v", encoderName(accel, v.Codec))
+		if v.BitRate == 0 {
+			output = append(output, "-q:v", "60")
+		}
+	default:
+		output = append(output, "-c:v", encoderName(AccelSoftware, v.Codec), "-preset", "veryfast", "-pix_fmt", "yuv420p")
+		if v.BitRate == 0 {
+			output = append(output, "-crf", "23")
+		}
+	}
+
+	if len(filters) > 0 {
+		output = append(output, "-vf", strings.Join(filters, ","))
+	}
+	if v.BitRate > 0 {
+		output = append(output, "-b:v", strconv.Itoa(v.BitRate))
+	}
+	if v.GOP > 0 {
+		output = append(output, "-g", strconv.Itoa(v.GOP))
+	}
+	return input, output
+}
+
+// Transcode runs the passed in request, with the best encoder for its codec, falling back to software if the
+// hardware encoder fails
+func (t *Transcoder) Transcode(ctx context.Context, req TranscodeRequest) error {
+	accel := AccelSoftware
+	if req.Video.Codec != CodecCopy && req.Video.Codec != "" {
+		accel = t.Select(ctx, req.Video.Codec)
+
+		// without a hardware encoder we need a software one, which minimal builds of ffmpeg can lack
+		if host, err := ProbeHost(ctx, t.FFmpegPath); err == nil && accel == AccelSoftware {
+			if err := host.RequireEncoder(encoderName(accel, req.Video.Codec)); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := t.run(ctx, accel, req)
+	if err != nil && accel != AccelSoftware && ctx.Err() == nil {
+		t.Failed(accel)
+		t.log.Warn("hardware transcode failed, retrying in software", slog.String("accel", string(accel)), slog.String("error", err.Error()))
+		err = t.run(ctx, AccelSoftware, req)
+	}
+	return err
+}
+
+// runs the passed in request once with the passed in encoder
+func (t *Transcoder) run(ctx context.Context, accel Accel, req TranscodeRequest) error {
+	input, output := t.Args(accel, req.Video)
+
+	args := []string{"-hide_banner", "-nostdin", "-loglevel", "error", "-y"}
+	args = append(args, input...)
+	args = append(args, req.InputArgs...)
+	args = append(args, "-i", req.Input, "-map", "0:v")
+	switch req.Audio {
+	case "none":
+		args = append(args, "-an")
+	case "":
+		args = append(args, "-map", "0:a?", "-c:a", "copy")
+	default:
+		args = append(args, "-map", "0:a?", "-c:a", req.Audio)
+	}
+	args = append(args, output...)
+	if req.Format != "" {
+		args = append(args, "-f", req.Format)
+	}
+	args = append(args, req.Output)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.FFmpegPath, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(req.Output)
+		return fmt.Errorf("error transcoding %q: %w", req.Input, NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return nil
+}
+
+// encodes a few frames of a test pattern with the passed in encoder, as an encoder being built in doesn't mean the
+// hardware it needs is present
+func (t *Transcoder) test(ctx context.Context, accel Accel, codec string) error {
+	ctx, cancel := context.WithTimeout(ctx, accelTestTimeout)
+	defer cancel()
+
+	input, output := t.Args(accel, Video{Codec: codec})
+	args := []string{"-hide_banner", "-nostdin", "-loglevel", "error"}
+	args = append(args, input...)
+	args = append(args, "-f", "lavfi", "-i", "testsrc2=size=320x240:rate=10:duration=1")
+	args = append(args, output...)
+	args = append(args, "-frames:v", "5", "-f", "null", "-")
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.FFmpegPath, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return NewExecError(ctx, err, stderr.Bytes())
+	}
+	return nil
+}
+
+// returns the name of the ffmpeg encoder for the passed in codec with the passed in acceleration
+func encoderName(accel Accel, codec string) string {
+	if accel == AccelSoftware {
+		if codec == CodecH265 {
+			return "libx265"
+		}
+		return "libx264"
+	}
+	return codec + "_" + string(accel)
+}
+
+// returns the hardware acceleration method used to decode input for the passed in encoder, empty if input is decoded
+// in software
+func decodeAccel(accel Accel) string {
+	switch accel {
+	case AccelNVENC:
+		return "cuda"
+	case AccelVideoToolbox:
+		return "videotoolbox"
+	}
+	return ""
+}
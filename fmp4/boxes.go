@@ -0,0 +1,69 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// returns an ISO BMFF box of the passed in type whose payload is the passed in parts one after another
+func box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// returns a full box, one whose payload starts with a version and flags
+func fullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return box(typ, append([][]byte{header}, parts...)...)
+}
+
+// appends each of the passed in values big endian, sized by their type
+func fields(values ...any) []byte {
+	b := []byte{}
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = binary.BigEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case []byte:
+			b = append(b, v...)
+		case string:
+			b = append(b, v...)
+		default:
+			panic("unsupported field type")
+		}
+	}
+	return b
+}
+
+// returns the passed in NAL unit with emulation prevention bytes removed, 00 00 03 => 00 00
+func unescapeRBSP(nal []byte) []byte {
+	b := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		b = append(b, c)
+	}
+	return b
+}
@@ -0,0 +1,297 @@
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// the IDs of our tracks and the timescale of our video, that of RTP video
+const (
+	videoTrackID   = 1
+	audioTrackID   = 2
+	videoTimescale = 90000
+)
+
+// ErrMissingParameterSets is returned for video whose parameter sets we don't have, without which it can't be
+// described to players
+var ErrMissingParameterSets = errors.New("missing parameter sets")
+
+// VideoTrack is H.264 or H.265 video along with its parameter sets, the H.264 SPS and PPS or the H.265 VPS, SPS and
+// PPS, as NAL units without start codes
+type VideoTrack struct {
+	Encoding      string
+	ParameterSets [][]byte
+}
+
+// AudioTrack is AAC audio described by its AudioSpecificConfig, as given by the config parameter of an mpeg4-generic
+// SDP, each of its frames holding 1024 samples
+type AudioTrack struct {
+	Config []byte
+}
+
+// the parameter sets of a video track by NAL unit type, and its dimensions
+type videoConfig struct {
+	encoding string
+	vps      [][]byte
+	sps      [][]byte
+	pps      [][]byte
+	width    int
+	height   int
+}
+
+// sorts the parameter sets of the passed in track and reads its dimensions from its SPS
+func parseVideo(t VideoTrack) (*videoConfig, error) {
+	c := &videoConfig{encoding: strings.ToUpper(t.Encoding)}
+	if c.encoding != "H264" && c.encoding != "H265" {
+		return nil, fmt.Errorf("unsupported video encoding %s", t.Encoding)
+	}
+
+	for _, nal := range t.ParameterSets {
+		if len(nal) < 2 {
+			continue
+		}
+		if c.encoding == "H265" {
+			switch (nal[0] >> 1) & 0x3f {
+			case 32:
+				c.vps = append(c.vps, nal)
+			case 33:
+				c.sps = append(c.sps, nal)
+			case 34:
+				c.pps = append(c.pps, nal)
+			}
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case 7:
+			c.sps = append(c.sps, nal)
+		case 8:
+			c.pps = append(c.pps, nal)
+		}
+	}
+	if len(c.sps) == 0 || len(c.pps) == 0 || (c.encoding == "H265" && len(c.vps) == 0) {
+		return nil, ErrMissingParameterSets
+	}
+
+	var params *rtsp.VideoParams
+	var err error
+	if c.encoding == "H265" {
+		params, err = rtsp.ParseH265SPS(c.sps[0])
+	} else {
+		params, err = rtsp.ParseH264SPS(c.sps[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing sps: %w", err)
+	}
+	if c.encoding == "H264" && len(c.sps[0]) < 4 || c.encoding == "H265" && len(unescapeRBSP(c.sps[0])) < 15 {
+		return nil, errors.New("error parsing sps: too short")
+	}
+	c.width, c.height = params.Width, params.Height
+	return c, nil
+}
+
+// returns the codec of the video as HLS playlists and MSE describe it, such as avc1.64001f
+func (c *videoConfig) codec() string {
+	if c.encoding == "H264" {
+		return fmt.Sprintf("avc1.%02x%02x%02x", c.sps[0][1], c.sps[0][2], c.sps[0][3])
+	}
+
+	// the profile, its compatibility flags in reverse bit order, the tier and level then the constraint flags
+	// without trailing zero bytes, as in ISO/IEC 14496-15 annex E
+	ptl := c.profileTierLevel()
+	space := []string{"", "A", "B", "C"}[ptl[0]>>6]
+	compat := bits.Reverse32(uint32(ptl[1])<<24 | uint32(ptl[2])<<16 | uint32(ptl[3])<<8 | uint32(ptl[4]))
+	tier := "L"
+	if ptl[0]&0x20 != 0 {
+		tier = "H"
+	}
+	codec := fmt.Sprintf("hvc1.%s%d.%X.%s%d", space, ptl[0]&0x1f, compat, tier, ptl[11])
+	constraints := ptl[5:11]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		codec += fmt.Sprintf(".%X", b)
+	}
+	return codec
+}
+
+// returns the 12 bytes of the general profile, tier and level of an H.265 SPS, which follow its NAL unit header and
+// a byte holding its VPS ID, sub-layer count and temporal ID nesting flag
+func (c *videoConfig) profileTierLevel() []byte {
+	return unescapeRBSP(c.sps[0])[3:15]
+}
+
+// returns the sample entry describing the video, avc1 or hvc1 with the parameter sets in its configuration
+func (c *videoConfig) sampleEntry() []byte {
+	visual := fields(
+		make([]byte, 6), uint16(1), // reserved, data reference index
+		make([]byte, 16), // pre-defined and reserved
+		uint16(c.width), uint16(c.height),
+		uint32(0x00480000), uint32(0x00480000), // 72 dpi
+		uint32(0), uint16(1), // reserved, frame count
+		make([]byte, 32), // compressor name
+		uint16(0x0018), uint16(0xffff),
+	)
+
+	if c.encoding == "H264" {
+		config := fields(uint8(1), c.sps[0][1], c.sps[0][2], c.sps[0][3], uint8(0xff), uint8(0xe0|len(c.sps)))
+		for _, sps := range c.sps {
+			config = append(fields(config, uint16(len(sps))), sps...)
+		}
+		config = append(config, uint8(len(c.pps)))
+		for _, pps := range c.pps {
+			config = append(fields(config, uint16(len(pps))), pps...)
+		}
+		return box("avc1", visual, box("avcC", config))
+	}
+
+	// cameras stream 8 bit 4:2:0 which is what we declare, players take anything else from the parameter sets
+	rbsp := unescapeRBSP(c.sps[0])
+	layers, nested := (rbsp[2]>>1)&0x07+1, rbsp[2]&0x01
+	config := fields(
+		uint8(1), c.profileTierLevel(),
+		uint16(0xf000), uint8(0xfc), uint8(0xfd), uint8(0xf8), uint8(0xf8), // segmentation, parallelism, chroma, depths
+		uint16(0), layers<<3|nested<<2|0x03, // frame rate, temporal layers and 4 byte NAL unit lengths
+		uint8(3),
+	)
+	for i, sets := range [][][]byte{c.vps, c.sps, c.pps} {
+		config = fields(config, uint8(0x80|(32+i)), uint16(len(sets)))
+		for _, nal := range sets {
+			config = append(fields(config, uint16(len(nal))), nal...)
+		}
+	}
+	return box("hvc1", visual, box("hvcC", config))
+}
+
+// what we need to know about AAC audio from its AudioSpecificConfig
+type audioConfig struct {
+	config     []byte
+	objectType int
+	sampleRate int
+	channels   int
+}
+
+// the sample rates of AAC audio by their index in an AudioSpecificConfig
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// reads the object type, sample rate and channels from the AudioSpecificConfig of the passed in track
+func parseAudio(t AudioTrack) (*audioConfig, error) {
+	c := &audioConfig{config: t.Config}
+	if len(t.Config) < 2 {
+		return nil, errors.New("audio specific config too short")
+	}
+
+	pos := 0
+	read := func(n int) int {
+		v := 0
+		for range n {
+			if pos/8 < len(t.Config) {
+				v = v<<1 | int(t.Config[pos/8]>>(7-pos%8))&1
+			} else {
+				v <<= 1
+			}
+			pos++
+		}
+		return v
+	}
+
+	if c.objectType = read(5); c.objectType == 31 {
+		c.objectType = 32 + read(6)
+	}
+	if index := read(4); index == 15 {
+		c.sampleRate = read(24)
+	} else if index < len(aacSampleRates) {
+		c.sampleRate = aacSampleRates[index]
+	}
+	c.channels = read(4)
+	if pos > len(t.Config)*8 || c.sampleRate == 0 {
+		return nil, errors.New("invalid audio specific config")
+	}
+	return c, nil
+}
+
+// returns the codec of the audio as HLS playlists and MSE describe it, such as mp4a.40.2 for AAC-LC
+func (c *audioConfig) codec() string {
+	return fmt.Sprintf("mp4a.40.%d", c.objectType)
+}
+
+// returns the mp4a sample entry describing the audio, with its AudioSpecificConfig in an elementary stream descriptor
+func (c *audioConfig) sampleEntry() []byte {
+	channels := c.channels
+	if channels == 0 {
+		channels = 2
+	}
+	audio := fields(
+		make([]byte, 6), uint16(1), // reserved, data reference index
+		make([]byte, 8),              // reserved
+		uint16(channels), uint16(16), // channels, sample size
+		uint32(0), uint32(c.sampleRate<<16), // pre-defined and reserved, sample rate as 16.16
+	)
+
+	descriptor := func(tag byte, parts ...[]byte) []byte {
+		payload := fields()
+		for _, p := range parts {
+			payload = append(payload, p...)
+		}
+		return append([]byte{tag, byte(len(payload))}, payload...)
+	}
+	decoderConfig := descriptor(0x04,
+		fields(uint8(0x40), uint8(0x15), make([]byte, 3), uint32(0), uint32(0)), // AAC, audio stream, buffer, bitrates
+		descriptor(0x05, c.config),
+	)
+	es := descriptor(0x03, fields(uint16(0), uint8(0)), decoderConfig, descriptor(0x06, []byte{0x02}))
+	return box("mp4a", audio, fullBox("esds", 0, 0, es))
+}
+
+// returns the initialization segment describing the passed in tracks, audio being optional
+func initSegment(video *videoConfig, audio *audioConfig) []byte {
+	matrix := fields(uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x40000000))
+	nextTrack := uint32(videoTrackID + 1)
+	if audio != nil {
+		nextTrack = audioTrackID + 1
+	}
+
+	trak := func(id uint32, timescale int, width int, height int, volume uint16, handler string, name string, header []byte, entry []byte) []byte {
+		return box("trak",
+			fullBox("tkhd", 0, 0x03, fields(uint32(0), uint32(0), id, uint32(0), uint32(0), make([]byte, 8),
+				uint16(0), uint16(0), volume, uint16(0), matrix, uint32(width<<16), uint32(height<<16))),
+			box("mdia",
+				fullBox("mdhd", 0, 0, fields(uint32(0), uint32(0), uint32(timescale), uint32(0), uint16(0x55c4), uint16(0))),
+				fullBox("hdlr", 0, 0, fields(uint32(0), handler, make([]byte, 12), name, uint8(0))),
+				box("minf",
+					header,
+					box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1))),
+					box("stbl",
+						fullBox("stsd", 0, 0, fields(uint32(1)), entry),
+						fullBox("stts", 0, 0, fields(uint32(0))),
+						fullBox("stsc", 0, 0, fields(uint32(0))),
+						fullBox("stsz", 0, 0, fields(uint32(0), uint32(0))),
+						fullBox("stco", 0, 0, fields(uint32(0))),
+					),
+				),
+			),
+		)
+	}
+	trex := func(id uint32) []byte {
+		return fullBox("trex", 0, 0, fields(id, uint32(1), uint32(0), uint32(0), uint32(0)))
+	}
+
+	moov := [][]byte{
+		fullBox("mvhd", 0, 0, fields(uint32(0), uint32(0), uint32(1000), uint32(0), uint32(0x00010000), uint16(0x0100),
+			make([]byte, 10), matrix, make([]byte, 24), nextTrack)),
+		trak(videoTrackID, videoTimescale, video.width, video.height, 0, "vide", "Video", fullBox("vmhd", 0, 1, make([]byte, 8)), video.sampleEntry()),
+	}
+	mvex := [][]byte{trex(videoTrackID)}
+	if audio != nil {
+		moov = append(moov, trak(audioTrackID, audio.sampleRate, 0, 0, 0x0100, "soun", "Audio", fullBox("smhd", 0, 0, make([]byte, 4)), audio.sampleEntry()))
+		mvex = append(mvex, trex(audioTrackID))
+	}
+	moov = append(moov, box("mvex", mvex...))
+
+	ftyp := box("ftyp", fields("iso5", uint32(512), "iso5", "iso6", "mp41", "cmfc"))
+	return append(ftyp, box("moov", moov...)...)
+}
@@ -0,0 +1,205 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// a 1080p high profile SPS and its PPS from a camera
+var (
+	h264SPS = mustDecode("Z2QAKKwbGoB4AiflQA==")
+	h264PPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// a 1080p main profile H.265 VPS, SPS with emulation prevention bytes in its profile and PPS
+var (
+	h265VPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0x95, 0x98, 0x09}
+	h265SPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5}
+	h265PPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+func mustDecode(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// returns the payload of the first box of the passed in type in b, which holds boxes one after another
+func findBox(t *testing.T, b []byte, typ string) []byte {
+	t.Helper()
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("invalid size %d of %s box", size, b[4:8])
+		}
+		if string(b[4:8]) == typ {
+			return b[8:size]
+		}
+		b = b[size:]
+	}
+	t.Fatalf("no %s box", typ)
+	return nil
+}
+
+// returns the payload of the box at the passed in path of container boxes
+func boxAt(t *testing.T, b []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		b = findBox(t, b, typ)
+	}
+	return b
+}
+
+// returns the payloads of every box of the passed in type in b
+func findBoxes(t *testing.T, b []byte, typ string) [][]byte {
+	t.Helper()
+	boxes := [][]byte{}
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("invalid size %d of %s box", size, b[4:8])
+		}
+		if string(b[4:8]) == typ {
+			boxes = append(boxes, b[8:size])
+		}
+		b = b[size:]
+	}
+	return boxes
+}
+
+func TestInitSegment(t *testing.T) {
+	aac := []byte{0x11, 0x90} // AAC-LC, 48kHz, stereo
+
+	tcs := []struct {
+		name   string
+		video  VideoTrack
+		audio  *AudioTrack
+		codecs string
+		entry  string
+		config string
+		width  int
+		height int
+	}{
+		{
+			name:   "h264",
+			video:  VideoTrack{Encoding: "H264", ParameterSets: [][]byte{h264SPS, h264PPS}},
+			codecs: "avc1.640028",
+			entry:  "avc1",
+			config: "avcC",
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "h264 with aac",
+			video:  VideoTrack{Encoding: "h264", ParameterSets: [][]byte{h264PPS, h264SPS}},
+			audio:  &AudioTrack{Config: aac},
+			codecs: "avc1.640028,mp4a.40.2",
+			entry:  "avc1",
+			config: "avcC",
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "h265",
+			video:  VideoTrack{Encoding: "H265", ParameterSets: [][]byte{h265VPS, h265SPS, h265PPS}},
+			codecs: "hvc1.1.6.L120.90",
+			entry:  "hvc1",
+			config: "hvcC",
+			width:  1920,
+			height: 1080,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewMuxer(tc.video, tc.audio, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Codecs() != tc.codecs {
+				t.Errorf("expected codecs %s, got %s", tc.codecs, m.Codecs())
+			}
+
+			init := m.Init()
+			if brand := findBox(t, init, "ftyp")[:4]; string(brand) != "iso5" {
+				t.Errorf("expected iso5 brand, got %s", brand)
+			}
+
+			moov := findBox(t, init, "moov")
+			traks := findBoxes(t, moov, "trak")
+			trexes := findBoxes(t, findBox(t, moov, "mvex"), "trex")
+			expected := 1
+			if tc.audio != nil {
+				expected = 2
+			}
+			if len(traks) != expected || len(trexes) != expected {
+				t.Fatalf("expected %d tracks, got %d traks and %d trexes", expected, len(traks), len(trexes))
+			}
+
+			// the track header ends with the width and height as 16.16
+			tkhd := findBox(t, traks[0], "tkhd")
+			width, height := binary.BigEndian.Uint32(tkhd[len(tkhd)-8:])>>16, binary.BigEndian.Uint32(tkhd[len(tkhd)-4:])>>16
+			if int(width) != tc.width || int(height) != tc.height {
+				t.Errorf("expected %dx%d track, got %dx%d", tc.width, tc.height, width, height)
+			}
+			if id := binary.BigEndian.Uint32(tkhd[12:]); id != videoTrackID {
+				t.Errorf("expected video track id %d, got %d", videoTrackID, id)
+			}
+
+			// the sample description holds a single entry whose visual fields are followed by its configuration
+			stsd := boxAt(t, traks[0], "mdia", "minf", "stbl", "stsd")
+			entry := findBox(t, stsd[8:], tc.entry)
+			config := findBox(t, entry[78:], tc.config)
+			for _, nal := range tc.video.ParameterSets {
+				if !bytes.Contains(config, nal) {
+					t.Errorf("expected %s to contain parameter set %x", tc.config, nal)
+				}
+			}
+
+			if tc.audio != nil {
+				stsd := boxAt(t, traks[1], "mdia", "minf", "stbl", "stsd")
+				mp4a := findBox(t, stsd[8:], "mp4a")
+				if rate := binary.BigEndian.Uint32(mp4a[24:]) >> 16; rate != 48000 {
+					t.Errorf("expected 48000Hz audio, got %d", rate)
+				}
+				if esds := findBox(t, mp4a[28:], "esds"); !bytes.Contains(esds, aac) {
+					t.Errorf("expected esds to contain audio config %x", aac)
+				}
+			}
+		})
+	}
+}
+
+func TestInitSegmentErrors(t *testing.T) {
+	tcs := []struct {
+		name  string
+		video VideoTrack
+		audio *AudioTrack
+		err   error
+	}{
+		{name: "unsupported encoding", video: VideoTrack{Encoding: "MP4V-ES", ParameterSets: [][]byte{h264SPS, h264PPS}}},
+		{name: "missing pps", video: VideoTrack{Encoding: "H264", ParameterSets: [][]byte{h264SPS}}, err: ErrMissingParameterSets},
+		{name: "missing vps", video: VideoTrack{Encoding: "H265", ParameterSets: [][]byte{h265SPS, h265PPS}}, err: ErrMissingParameterSets},
+		{name: "no parameter sets", video: VideoTrack{Encoding: "H264"}, err: ErrMissingParameterSets},
+		{name: "truncated sps", video: VideoTrack{Encoding: "H264", ParameterSets: [][]byte{h264SPS[:5], h264PPS}}},
+		{name: "short audio config", video: VideoTrack{Encoding: "H264", ParameterSets: [][]byte{h264SPS, h264PPS}}, audio: &AudioTrack{Config: []byte{0x11}}},
+		{name: "invalid sample rate", video: VideoTrack{Encoding: "H264", ParameterSets: [][]byte{h264SPS, h264PPS}}, audio: &AudioTrack{Config: []byte{0x16, 0x90}}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewMuxer(tc.video, tc.audio, 0)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// sample flags for keyframes, which depend on nothing else, and for the frames which depend on them
+const (
+	keyframeFlags    = 0x02000000
+	nonKeyframeFlags = 0x01010000
+)
+
+// how many samples each AAC frame holds
+const aacFrameSamples = 1024
+
+// Segment is a fragment of fragmented MP4, a moof and mdat which starts with a keyframe so that playback can start
+// from it, to be served after the initialization segment as an HLS or MSE media segment
+type Segment struct {
+	Sequence int
+	Data     []byte
+
+	// how far into the stream the segment starts and how long it lasts
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// a single frame of video or audio waiting to be written to a fragment
+type sample struct {
+	pts      time.Duration
+	data     []byte
+	keyframe bool
+}
+
+// Muxer packages H.264 or H.265 access units and optionally AAC audio frames into CMAF fragmented MP4, an init
+// segment followed by segments which each start with a keyframe, for HLS and MSE players without any ffmpeg
+type Muxer struct {
+	video *videoConfig
+	audio *audioConfig
+
+	// how long segments should be, each being cut at the first keyframe after this
+	fragment time.Duration
+
+	init     []byte
+	sequence int
+
+	// the samples of the segment being built, and the duration of the last video sample written to guess at that of
+	// the final one
+	videoSamples []sample
+	audioSamples []sample
+	lastDuration int64
+}
+
+// NewMuxer creates a new muxer for the passed in video and audio, which may be nil, cutting segments at the first
+// keyframe after the passed in duration
+func NewMuxer(video VideoTrack, audio *AudioTrack, fragment time.Duration) (*Muxer, error) {
+	v, err := parseVideo(video)
+	if err != nil {
+		return nil, err
+	}
+	var a *audioConfig
+	if audio != nil {
+		if a, err = parseAudio(*audio); err != nil {
+			return nil, err
+		}
+	}
+	if fragment <= 0 {
+		fragment = time.Second
+	}
+	return &Muxer{video: v, audio: a, fragment: fragment, init: initSegment(v, a)}, nil
+}
+
+// Init returns the initialization segment which describes our tracks, to be loaded by players before any segment
+func (m *Muxer) Init() []byte {
+	return m.init
+}
+
+// Codecs returns our codecs as HLS playlists and MSE describe them, such as avc1.64001f,mp4a.40.2
+func (m *Muxer) Codecs() string {
+	codecs := []string{m.video.codec()}
+	if m.audio != nil {
+		codecs = append(codecs, m.audio.codec())
+	}
+	return strings.Join(codecs, ",")
+}
+
+// WriteVideo adds the passed in access unit, returning the segment it completes if it is a keyframe far enough
+// into the current one. Units before the first keyframe are dropped as they can't be decoded.
+func (m *Muxer) WriteVideo(unit rtsp.AccessUnit) *Segment {
+	if len(m.videoSamples) == 0 && !unit.Keyframe {
+		return nil
+	}
+
+	var segment *Segment
+	if unit.Keyframe && len(m.videoSamples) > 0 && unit.PTS-m.videoSamples[0].pts >= m.fragment {
+		segment = m.cut(unit.PTS)
+	}
+
+	// samples hold their NAL units each preceded by its length rather than a start code
+	size := 0
+	for _, nal := range unit.NALUs {
+		size += 4 + len(nal)
+	}
+	data := make([]byte, 0, size)
+	for _, nal := range unit.NALUs {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+		data = append(data, nal...)
+	}
+	m.videoSamples = append(m.videoSamples, sample{pts: unit.PTS, data: data, keyframe: unit.Keyframe})
+	return segment
+}
+
+// WriteAudio adds the passed in raw AAC frame, without any ADTS header, presented at the passed in time on the same
+// timeline as our video. Frames before the first keyframe are dropped, as are all frames if we have no audio track.
+func (m *Muxer) WriteAudio(pts time.Duration, frame []byte) {
+	if m.audio == nil || len(m.videoSamples) == 0 || pts < m.videoSamples[0].pts {
+		return
+	}
+	m.audioSamples = append(m.audioSamples, sample{pts: pts, data: frame})
+}
+
+// Flush returns whatever has been written since the last segment as a final segment, nil if there is nothing
+func (m *Muxer) Flush() *Segment {
+	if len(m.videoSamples) == 0 {
+		return nil
+	}
+	last := m.videoSamples[len(m.videoSamples)-1].pts
+	return m.cut(last + time.Duration(m.lastDuration*int64(time.Second)/videoTimescale))
+}
+
+// returns the samples written so far as a segment which ends at the passed in time, leaving any audio after it for
+// the next
+func (m *Muxer) cut(end time.Duration) *Segment {
+	video := m.videoSamples
+	m.videoSamples = nil
+
+	audio := m.audioSamples
+	m.audioSamples = nil
+	for i, s := range audio {
+		if s.pts >= end {
+			audio, m.audioSamples = audio[:i], append([]sample{}, audio[i:]...)
+			break
+		}
+	}
+
+	// each video sample lasts until the next, the last until the end of the segment
+	durations := make([]uint32, len(video))
+	for i, s := range video {
+		next := end
+		if i+1 < len(video) {
+			next = video[i+1].pts
+		}
+		d := max(ticks(next, videoTimescale)-ticks(s.pts, videoTimescale), 0)
+		durations[i] = uint32(d)
+		m.lastDuration = d
+	}
+
+	m.sequence++
+	start := video[0].pts
+	return &Segment{
+		Sequence: m.sequence,
+		Data:     m.fragmentBoxes(video, durations, audio),
+		Start:    start,
+		Duration: end - start,
+	}
+}
+
+// returns the moof and mdat of a fragment holding the passed in video samples and audio frames
+func (m *Muxer) fragmentBoxes(video []sample, durations []uint32, audio []sample) []byte {
+	videoSize := 0
+	for _, s := range video {
+		videoSize += len(s.data)
+	}
+
+	// the data offsets of each run are from the start of the moof so depend on its size, which doesn't depend on them
+	moof := func(videoOffset uint32, audioOffset uint32) []byte {
+		run := fields(uint32(len(video)), videoOffset)
+		for i, s := range video {
+			flags := uint32(nonKeyframeFlags)
+			if s.keyframe {
+				flags = keyframeFlags
+			}
+			run = fields(run, durations[i], uint32(len(s.data)), flags)
+		}
+		trafs := [][]byte{fullBox("mfhd", 0, 0, fields(uint32(m.sequence)))}
+		trafs = append(trafs, box("traf",
+			fullBox("tfhd", 0, 0x020000, fields(uint32(videoTrackID))),
+			fullBox("tfdt", 1, 0, fields(uint64(ticks(video[0].pts, videoTimescale)))),
+			fullBox("trun", 0, 0x000701, run),
+		))
+
+		if len(audio) > 0 {
+			run := fields(uint32(len(audio)), audioOffset)
+			for _, s := range audio {
+				run = fields(run, uint32(aacFrameSamples), uint32(len(s.data)), uint32(keyframeFlags))
+			}
+			trafs = append(trafs, box("traf",
+				fullBox("tfhd", 0, 0x020000, fields(uint32(audioTrackID))),
+				fullBox("tfdt", 1, 0, fields(uint64(ticks(audio[0].pts, m.audio.sampleRate)))),
+				fullBox("trun", 0, 0x000701, run),
+			))
+		}
+		return box("moof", trafs...)
+	}
+	size := uint32(len(moof(0, 0)))
+
+	data := make([][]byte, 0, len(video)+len(audio))
+	for _, s := range video {
+		data = append(data, s.data)
+	}
+	for _, s := range audio {
+		data = append(data, s.data)
+	}
+	return append(moof(size+8, size+8+uint32(videoSize)), box("mdat", data...)...)
+}
+
+// returns the passed in time in units of the passed in timescale, rounded to the nearest, whole seconds being
+// converted apart so that long running streams don't overflow
+func ticks(t time.Duration, timescale int) int64 {
+	seconds, rest := int64(t/time.Second), int64(t%time.Second)
+	return seconds*int64(timescale) + (rest*int64(timescale)+int64(time.Second)/2)/int64(time.Second)
+}
@@ -0,0 +1,176 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for operations on a camera which are being held back after repeated failures
+var ErrCircuitOpen = errors.New("circuit open")
+
+type BreakerState string
+
+const (
+	// operations go through as normal
+	BreakerClosed BreakerState = "closed"
+
+	// operations are held back until the backoff has passed
+	BreakerOpen BreakerState = "open"
+
+	// a single operation has been let through to see whether the camera has recovered
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerConfig configures the circuit breakers of cameras
+type BreakerConfig struct {
+	// how many operations in a row may fail before a camera's breaker opens
+	MaxFailures int
+
+	// how long a breaker stays open before a single operation is let through to try the camera again, doubled each
+	// time that fails up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// BreakerStatus is the state of a camera's breaker along with the failures which led to it
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	Since time.Time    `json:"since"`
+
+	// how many operations of each kind have failed since the last one succeeded, and the last of those failures
+	Failures      map[string]int `json:"failures,omitempty"`
+	LastOperation string         `json:"last_operation,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+
+	// when an operation will next be let through, if the breaker is open
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// Breakers guards the operations we repeat against each camera, such as probing it or fetching its snapshots, so that
+// once enough of them fail in a row the camera is left alone for a backoff rather than being hammered every interval.
+// After the backoff a single operation is let through, closing the breaker if it succeeds.
+type Breakers struct {
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	status  BreakerStatus
+	backoff time.Duration
+}
+
+func NewBreakers(cfg BreakerConfig) *Breakers {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 30 * time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 10 * time.Minute
+	}
+	return &Breakers{cfg: cfg, breakers: make(map[string]*breaker)}
+}
+
+// Do runs the passed in operation against the passed in camera unless its breaker is open, in which case it returns
+// ErrCircuitOpen without running it. Operations cancelled by their context count as neither success nor failure.
+func (b *Breakers) Do(camera string, operation string, fn func() error) error {
+	if err := b.allow(camera, time.Now()); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(camera, operation, err, time.Now())
+	return err
+}
+
+// Status returns the state of the breaker of the passed in camera
+func (b *Breakers) Status(camera string) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if br, found := b.breakers[camera]; found {
+		status := br.status
+		status.Failures = make(map[string]int, len(br.status.Failures))
+		for operation, failures := range br.status.Failures {
+			status.Failures[operation] = failures
+		}
+		return status
+	}
+	return BreakerStatus{State: BreakerClosed}
+}
+
+// returns an error if operations on the passed in camera are being held back, letting a single one through once the
+// backoff of an open breaker has passed
+func (b *Breakers) allow(camera string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, found := b.breakers[camera]
+	if !found {
+		return nil
+	}
+	switch br.status.State {
+	case BreakerOpen:
+		if now.Before(*br.status.RetryAt) {
+			return fmt.Errorf("%w, retrying at %s", ErrCircuitOpen, br.status.RetryAt.Format(time.RFC3339))
+		}
+		br.status.State, br.status.Since, br.status.RetryAt = BreakerHalfOpen, now, nil
+	case BreakerHalfOpen:
+		return fmt.Errorf("%w, retrying now", ErrCircuitOpen)
+	}
+	return nil
+}
+
+// records the outcome of an operation on the passed in camera, opening or closing its breaker as needed
+func (b *Breakers) record(camera string, operation string, err error, now time.Time) {
+	if errors.Is(err, context.Canceled) {
+		b.mu.Lock()
+		if br, found := b.breakers[camera]; found && br.status.State == BreakerHalfOpen {
+			// the trial never finished so the next operation gets to try
+			br.status.State, br.status.RetryAt = BreakerOpen, &now
+		}
+		b.mu.Unlock()
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, found := b.breakers[camera]
+	if err == nil {
+		if found {
+			delete(b.breakers, camera)
+			breakerOpen.With(camera).Set(0)
+		}
+		return
+	}
+	if !found {
+		br = &breaker{status: BreakerStatus{State: BreakerClosed, Since: now, Failures: map[string]int{}}}
+		b.breakers[camera] = br
+	}
+	br.status.Failures[operation]++
+	br.status.LastOperation, br.status.LastError = operation, err.Error()
+	operationFailures.With(camera, operation).Inc()
+
+	failures := 0
+	for _, count := range br.status.Failures {
+		failures += count
+	}
+
+	switch {
+	case br.status.State == BreakerHalfOpen:
+		br.backoff = min(br.backoff*2, b.cfg.MaxBackoff)
+	case br.status.State == BreakerClosed && failures >= b.cfg.MaxFailures:
+		br.backoff = b.cfg.MinBackoff
+	default:
+		return
+	}
+	retryAt := now.Add(br.backoff)
+	br.status.State, br.status.Since, br.status.RetryAt = BreakerOpen, now, &retryAt
+	breakerOpen.With(camera).Set(1)
+}
@@ -0,0 +1,14 @@
+package health
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+var (
+	checkHealthy   = metrics.NewGauge("govr_camera_healthy", "Whether each health check of a camera is passing, 1 if it is.", "camera", "check")
+	clockDrift     = metrics.NewGauge("govr_camera_clock_drift_seconds", "How far a camera's clock is ahead of ours.", "camera")
+	streamRestarts = metrics.NewCounter("govr_camera_stream_restarts_total", "Pipelines restarted because their stream stalled.", "camera")
+
+	breakerOpen       = metrics.NewGauge("govr_camera_circuit_open", "Whether operations on a camera are being held back after repeated failures, 1 if they are.", "camera")
+	operationFailures = metrics.NewCounter("govr_camera_operation_failures_total", "Operations on a camera which failed, by operation.", "camera", "operation")
+)
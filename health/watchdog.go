@@ -0,0 +1,343 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// Check is one aspect of a camera's health which is watched
+type Check string
+
+const (
+	// whether the camera's stream is still delivering frames
+	CheckStream Check = "stream"
+
+	// whether the camera is answering ONVIF requests
+	CheckSOAP Check = "soap"
+
+	// whether the camera's clock is close to ours
+	CheckClock Check = "clock"
+
+	// whether the camera is running firmware without known problems
+	CheckFirmware Check = "firmware"
+
+	// whether operations on the camera are going through rather than being held back after repeated failures
+	CheckBreaker Check = "breaker"
+)
+
+// how far back what a camera logged is attached to an alert of it becoming unhealthy
+const cameraLogWindow = 2 * time.Minute
+
+type State string
+
+const (
+	StateHealthy   State = "healthy"
+	StateUnhealthy State = "unhealthy"
+
+	// the camera is being left alone for a while after repeated failures
+	StateDegraded State = "degraded"
+)
+
+// Alert is a change in the state of one of a camera's checks
+type Alert struct {
+	Camera string    `json:"camera"`
+	Check  Check     `json:"check"`
+	State  State     `json:"state"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// what the camera itself logged around when it became unhealthy, which may say why
+	CameraLog []string `json:"camera_log,omitempty"`
+}
+
+// Stream is a pipeline consuming a camera's stream, such as a recorder, which can be restarted when it stalls
+type Stream interface {
+	// when the pipeline last received any of the stream
+	LastFrame() time.Time
+
+	// stops the current attempt at consuming the stream, which the pipeline is expected to retry
+	Restart()
+}
+
+// Config configures a watchdog for a single camera
+type Config struct {
+	Camera string
+
+	// the camera's device, nil for cameras which don't speak ONVIF whose SOAP and clock checks are skipped
+	Device *onvif.Device
+
+	// the camera's pipeline, nil if nothing consumes its stream in which case the stream check is skipped
+	Stream Stream
+
+	// how often the camera is checked
+	Interval time.Duration
+
+	// how long a stream may go without frames before it is considered stalled and restarted
+	StallTimeout time.Duration
+
+	// how many consecutive failed ONVIF requests make the camera unhealthy
+	MaxSOAPFailures int
+
+	// how far the camera's clock may be from ours before it is considered wrong
+	MaxClockDrift time.Duration
+
+	// if set, returns whether the firmware the camera is running is free of known problems, and if not why
+	Firmware func() (bool, string)
+
+	// how long to wait before restarting a stream which is still stalled after a restart, doubled on each
+	// consecutive restart up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// if set, returns the problems the camera logged between the passed in times, which are attached to alerts of it
+	// becoming unhealthy
+	CameraLog func(from time.Time, to time.Time) []string
+
+	// if set, the circuit breakers our ONVIF requests go through, and whose state for the camera is reported as its
+	// breaker check
+	Breakers *Breakers
+}
+
+// CheckStatus is the current state of one of a camera's checks
+type CheckStatus struct {
+	State  State     `json:"state"`
+	Detail string    `json:"detail,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Watchdog watches a single camera for stalled streams, ONVIF failures and clock drift, restarting stalled streams
+// and alerting whenever a check changes state
+type Watchdog struct {
+	log *slog.Logger
+	cfg Config
+
+	// if set, called whenever a check changes state, e.g. to send a webhook or an email
+	OnAlert func(Alert)
+
+	mu           sync.Mutex
+	checks       map[Check]CheckStatus
+	soapFailures int
+	restarts     int
+	nextRestart  time.Time
+}
+
+func NewWatchdog(log *slog.Logger, cfg Config) *Watchdog {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.StallTimeout <= 0 {
+		cfg.StallTimeout = 30 * time.Second
+	}
+	if cfg.MaxSOAPFailures <= 0 {
+		cfg.MaxSOAPFailures = 3
+	}
+	if cfg.MaxClockDrift <= 0 {
+		cfg.MaxClockDrift = 10 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 10 * time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	return &Watchdog{log: log.With("subsystem", "health", "camera", cfg.Camera), cfg: cfg, checks: make(map[Check]CheckStatus)}
+}
+
+// Run checks the camera at our interval until the passed in context is done
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(time.Now())
+		}
+	}
+}
+
+// Status returns the current state of each of the camera's checks, checks which haven't run yet are absent
+func (w *Watchdog) Status() map[Check]CheckStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	checks := make(map[Check]CheckStatus, len(w.checks))
+	for check, status := range w.checks {
+		checks[check] = status
+	}
+	return checks
+}
+
+// Healthy returns whether every check of the camera is healthy
+func (w *Watchdog) Healthy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, status := range w.checks {
+		if status.State != StateHealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// runs each of our checks once
+func (w *Watchdog) check(now time.Time) {
+	if w.cfg.Stream != nil {
+		w.checkStream(now)
+	}
+	if w.cfg.Device != nil {
+		w.checkDevice(now)
+	}
+	if w.cfg.Firmware != nil {
+		w.checkFirmware(now)
+	}
+	if w.cfg.Breakers != nil {
+		w.checkBreaker(now)
+	}
+}
+
+// restarts the stream if it has stalled, backing off between restarts while it stays stalled
+func (w *Watchdog) checkStream(now time.Time) {
+	stalled := now.Sub(w.cfg.Stream.LastFrame())
+	if stalled < w.cfg.StallTimeout {
+		w.mu.Lock()
+		w.restarts, w.nextRestart = 0, time.Time{}
+		w.mu.Unlock()
+
+		w.set(CheckStream, StateHealthy, "", now)
+		return
+	}
+
+	w.set(CheckStream, StateUnhealthy, fmt.Sprintf("no frames for %s", stalled.Truncate(time.Second)), now)
+
+	w.mu.Lock()
+	restart := !now.Before(w.nextRestart)
+	if restart {
+		backoff := w.cfg.MinBackoff << min(w.restarts, 16)
+		w.restarts++
+		w.nextRestart = now.Add(min(backoff, w.cfg.MaxBackoff))
+	}
+	w.mu.Unlock()
+
+	if restart {
+		w.log.Warn("stream stalled, restarting", slog.Duration("stalled", stalled))
+		streamRestarts.With(w.cfg.Camera).Inc()
+		w.cfg.Stream.Restart()
+	}
+}
+
+// checks the device answers and that its clock is close to ours, both with a single request for its time
+func (w *Watchdog) checkDevice(now time.Time) {
+	var deviceTime time.Time
+	err := w.do("soap", func() (err error) {
+		deviceTime, err = w.cfg.Device.GetSystemDateAndTime(w.log)
+		return err
+	})
+
+	// the device is being left alone for now, which the breaker check reports
+	if errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+
+	w.mu.Lock()
+	if err != nil {
+		w.soapFailures++
+	} else {
+		w.soapFailures = 0
+	}
+	failures := w.soapFailures
+	w.mu.Unlock()
+
+	if err != nil {
+		if failures >= w.cfg.MaxSOAPFailures {
+			w.set(CheckSOAP, StateUnhealthy, err.Error(), now)
+		}
+		return
+	}
+	w.set(CheckSOAP, StateHealthy, "", now)
+
+	// the device only reports whole seconds, and takes a moment to answer
+	drift := deviceTime.Sub(time.Now().Truncate(time.Second))
+	clockDrift.With(w.cfg.Camera).Set(drift.Seconds())
+	if drift.Abs() > w.cfg.MaxClockDrift {
+		w.set(CheckClock, StateUnhealthy, fmt.Sprintf("clock is off by %s", drift), now)
+	} else {
+		w.set(CheckClock, StateHealthy, "", now)
+	}
+}
+
+// marks the camera degraded while its breaker is holding back operations on it
+func (w *Watchdog) checkBreaker(now time.Time) {
+	status := w.cfg.Breakers.Status(w.cfg.Camera)
+	switch status.State {
+	case BreakerClosed:
+		w.set(CheckBreaker, StateHealthy, "", now)
+	case BreakerOpen:
+		w.set(CheckBreaker, StateDegraded, fmt.Sprintf("%s failed: %s, retrying at %s", status.LastOperation, status.LastError, status.RetryAt.Format(time.RFC3339)), now)
+	default:
+		w.set(CheckBreaker, StateDegraded, fmt.Sprintf("%s failed: %s, retrying now", status.LastOperation, status.LastError), now)
+	}
+}
+
+// runs the passed in operation on the camera through our breakers if we have them
+func (w *Watchdog) do(operation string, fn func() error) error {
+	if w.cfg.Breakers == nil {
+		return fn()
+	}
+	return w.cfg.Breakers.Do(w.cfg.Camera, operation, fn)
+}
+
+// flags the camera if it is running firmware with known problems
+func (w *Watchdog) checkFirmware(now time.Time) {
+	if ok, detail := w.cfg.Firmware(); ok {
+		w.set(CheckFirmware, StateHealthy, detail, now)
+	} else {
+		w.set(CheckFirmware, StateUnhealthy, detail, now)
+	}
+}
+
+// sets the state of the passed in check, alerting if it has changed. Checks start out healthy so the first state
+// only alerts if it is unhealthy.
+func (w *Watchdog) set(check Check, state State, detail string, now time.Time) {
+	w.mu.Lock()
+	previous, found := w.checks[check]
+	changed := (found && previous.State != state) || (!found && state != StateHealthy)
+	since := previous.Since
+	if !found || previous.State != state {
+		since = now
+	}
+	w.checks[check] = CheckStatus{State: state, Detail: detail, Since: since}
+	onAlert := w.OnAlert
+	w.mu.Unlock()
+
+	healthy := 0.0
+	if state == StateHealthy {
+		healthy = 1
+	}
+	checkHealthy.With(w.cfg.Camera, string(check)).Set(healthy)
+
+	if !changed {
+		return
+	}
+	alert := Alert{Camera: w.cfg.Camera, Check: check, State: state, Detail: detail, Time: now}
+	if state != StateHealthy && w.cfg.CameraLog != nil {
+		alert.CameraLog = w.cfg.CameraLog(now.Add(-cameraLogWindow), now)
+	}
+	level := slog.LevelInfo
+	if state != StateHealthy {
+		level = slog.LevelWarn
+	}
+	w.log.Log(context.Background(), level, "camera health changed", slog.String("check", string(check)), slog.String("state", string(state)), slog.String("detail", detail))
+	if onAlert != nil {
+		onAlert(alert)
+	}
+}
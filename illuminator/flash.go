@@ -0,0 +1,91 @@
+package illuminator
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// FlashAction flashes the white light of a camera, rules trigger it as a deterrent such as when a person is
+// detected at night
+type FlashAction struct {
+	Camera string `json:"camera"`
+
+	// how many times to flash and how long each flash and gap lasts
+	Times      int `json:"times"`
+	IntervalMS int `json:"interval_ms"`
+
+	// if set, the hours of the day, in camera local time, between which we flash, wrapping past midnight
+	NightStart int `json:"night_start"`
+	NightEnd   int `json:"night_end"`
+}
+
+// IsNight returns whether the passed in time falls within the night hours of this action, which is always true if
+// no hours are set
+func (a *FlashAction) IsNight(t time.Time) bool {
+	if a.NightStart == a.NightEnd {
+		return true
+	}
+	hour := t.Hour()
+	if a.NightStart < a.NightEnd {
+		return hour >= a.NightStart && hour < a.NightEnd
+	}
+	return hour >= a.NightStart || hour < a.NightEnd
+}
+
+// Flash flashes the white light on the passed in device per the action, doing nothing outside of night hours, the
+// light is always left off when we return
+func Flash(ctx context.Context, log *slog.Logger, d *onvif.Device, quirks onvif.IlluminatorQuirks, action FlashAction, now time.Time) error {
+	if !action.IsNight(now) {
+		log.Debug("not flashing light outside of night hours", slog.String("camera", action.Camera))
+		return nil
+	}
+
+	interval := time.Duration(max(action.IntervalMS, 100)) * time.Millisecond
+	times := max(action.Times, 1)
+
+	// whatever happens, don't leave the light on
+	lit := false
+	defer func() {
+		if lit {
+			if err := d.SetWhiteLight(log, quirks, false); err != nil {
+				log.Error("error turning off white light", slog.String("camera", action.Camera), slog.String("error", err.Error()))
+			}
+		}
+	}()
+
+	for i := range times {
+		if i > 0 {
+			if err := sleep(ctx, interval); err != nil {
+				return err
+			}
+		}
+
+		lit = true
+		if err := d.SetWhiteLight(log, quirks, true); err != nil {
+			return fmt.Errorf("error flashing white light on %q: %w", action.Camera, err)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		if err := d.SetWhiteLight(log, quirks, false); err != nil {
+			return fmt.Errorf("error flashing white light on %q: %w", action.Camera, err)
+		}
+		lit = false
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
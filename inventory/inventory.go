@@ -0,0 +1,185 @@
+package inventory
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/health"
+	"github.com/incrementventures/govr/registry"
+)
+
+// Item is a single camera of our inventory, what we know of it as a device, as a piece of equipment and of its
+// recording
+type Item struct {
+	ID string `json:"id"`
+
+	// the name the camera is declared with, empty if it isn't declared
+	Name string `json:"name,omitempty"`
+
+	// whether the camera is adopted, pending or rejected, and whether it answered our last scan
+	Status string `json:"status"`
+	Online bool   `json:"online"`
+
+	Address      string   `json:"address"`
+	MAC          string   `json:"mac,omitempty"`
+	Vendor       string   `json:"vendor,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Firmware     string   `json:"firmware,omitempty"`
+	Hardware     string   `json:"hardware,omitempty"`
+	Serial       string   `json:"serial,omitempty"`
+	Streams      []string `json:"streams,omitempty"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// the health checks of each of the camera's recordings keyed by recording name, empty if it isn't recorded
+	Health map[string]map[health.Check]health.CheckStatus `json:"health,omitempty"`
+
+	// how much of the camera's recording is on disk and the span it covers
+	RecordedBytes int64     `json:"recorded_bytes"`
+	RecordedFrom  time.Time `json:"recorded_from"`
+	RecordedTo    time.Time `json:"recorded_to"`
+
+	Asset registry.Asset `json:"asset"`
+}
+
+// Status returns the status of the passed in camera as written in an inventory
+func Status(c registry.Camera) string {
+	switch {
+	case c.Rejected:
+		return "rejected"
+	case c.Pending:
+		return "pending"
+	}
+	return "adopted"
+}
+
+// HealthSummary returns a summary of the health of this camera, healthy if every check of every recording is, and
+// otherwise the checks which aren't, empty if none are watched
+func (i *Item) HealthSummary() string {
+	failing := []string{}
+	checked := false
+	for _, checks := range i.Health {
+		for check, status := range checks {
+			checked = true
+			if status.State != health.StateHealthy {
+				failing = append(failing, string(check))
+			}
+		}
+	}
+	if !checked {
+		return ""
+	}
+	if len(failing) == 0 {
+		return string(health.StateHealthy)
+	}
+	slices.Sort(failing)
+	return string(health.StateUnhealthy) + ": " + strings.Join(slices.Compact(failing), ", ")
+}
+
+// a value in a row of the inventory, numbers are kept apart so that spreadsheets can sum them
+type cell struct {
+	text   string
+	number bool
+}
+
+// the fixed columns of the inventory, custom asset fields follow these
+var columns = []string{
+	"id", "name", "status", "online", "address", "mac", "vendor", "manufacturer", "model", "firmware", "hardware",
+	"serial", "streams", "first_seen", "last_seen", "health", "recorded_bytes", "recorded_from", "recorded_to",
+	"location", "switch", "switch_port", "installed_on", "warranty_until", "warranty_expired", "notes",
+}
+
+// returns the header and rows of the passed in items, with a column for each custom field any of them has
+func table(items []Item, now time.Time) ([]string, [][]cell) {
+	fields := map[string]bool{}
+	for _, item := range items {
+		for name := range item.Asset.Fields {
+			fields[name] = true
+		}
+	}
+	custom := make([]string, 0, len(fields))
+	for name := range fields {
+		custom = append(custom, name)
+	}
+	slices.Sort(custom)
+
+	header := slices.Clone(columns)
+	for _, name := range custom {
+		header = append(header, "field:"+name)
+	}
+
+	rows := make([][]cell, len(items))
+	for i, item := range items {
+		text := func(s string) cell { return cell{text: s} }
+		rows[i] = []cell{
+			text(item.ID), text(item.Name), text(item.Status), text(strconv.FormatBool(item.Online)), text(item.Address),
+			text(item.MAC), text(item.Vendor), text(item.Manufacturer), text(item.Model), text(item.Firmware),
+			text(item.Hardware), text(item.Serial), text(strings.Join(item.Streams, " ")), text(formatTime(item.FirstSeen)),
+			text(formatTime(item.LastSeen)), text(item.HealthSummary()),
+			{text: strconv.FormatInt(item.RecordedBytes, 10), number: true},
+			text(formatTime(item.RecordedFrom)), text(formatTime(item.RecordedTo)), text(item.Asset.Location),
+			text(item.Asset.Switch), text(item.Asset.SwitchPort), text(item.Asset.InstalledOn),
+			text(item.Asset.WarrantyUntil), text(warrantyExpired(item.Asset, now)), text(item.Asset.Notes),
+		}
+		for _, name := range custom {
+			rows[i] = append(rows[i], text(item.Asset.Fields[name]))
+		}
+	}
+	return header, rows
+}
+
+// WriteCSV writes the passed in items as CSV with a header row
+func WriteCSV(w io.Writer, items []Item, now time.Time) error {
+	header, rows := table(items, now)
+
+	out := csv.NewWriter(w)
+	out.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, c := range row {
+			record[i] = c.text
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return fmt.Errorf("error writing inventory: %w", err)
+	}
+	return nil
+}
+
+// Sort sorts the passed in items by name, with cameras which aren't declared last by ID
+func Sort(items []Item) {
+	slices.SortStableFunc(items, func(a, b Item) int {
+		if (a.Name == "") != (b.Name == "") {
+			if a.Name != "" {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+}
+
+// returns whether the warranty of the passed in asset has expired, empty if we don't know when it ends
+func warrantyExpired(a registry.Asset, now time.Time) string {
+	if a.WarrantyUntil == "" {
+		return ""
+	}
+	return strconv.FormatBool(a.WarrantyExpired(now))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
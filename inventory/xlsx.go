@@ -0,0 +1,102 @@
+package inventory
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the parts of a workbook which don't depend on its contents, a single sheet with no styles is all Excel and the
+// spreadsheets which import its files need
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Cameras" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// WriteXLSX writes the passed in items as an Excel workbook with a single sheet, laid out the same as our CSV
+func WriteXLSX(w io.Writer, items []Item, now time.Time) error {
+	header, rows := table(items, now)
+
+	out := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := out.Create(part.name)
+		if err != nil {
+			return fmt.Errorf("error writing inventory: %w", err)
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return fmt.Errorf("error writing inventory: %w", err)
+		}
+	}
+
+	sheet, err := out.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return fmt.Errorf("error writing inventory: %w", err)
+	}
+	b := &strings.Builder{}
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	headerRow := make([]cell, len(header))
+	for i, name := range header {
+		headerRow[i] = cell{text: name}
+	}
+	for r, row := range append([][]cell{headerRow}, rows...) {
+		fmt.Fprintf(b, `<row r="%d">`, r+1)
+		for c, value := range row {
+			if value.text == "" {
+				continue
+			}
+			ref := columnName(c) + strconv.Itoa(r+1)
+			if value.number {
+				fmt.Fprintf(b, `<c r="%s"><v>%s</v></c>`, ref, value.text)
+				continue
+			}
+			fmt.Fprintf(b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(b, []byte(value.text))
+			b.WriteString(`</t></is></c>`)
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+
+	if _, err := io.WriteString(sheet, b.String()); err != nil {
+		return fmt.Errorf("error writing inventory: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error writing inventory: %w", err)
+	}
+	return nil
+}
+
+// returns the name of the zero based column, A through Z then AA and so on
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
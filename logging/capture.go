@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Record is a captured log record
+type Record struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs"`
+}
+
+func newRecord(r slog.Record, attrs []slog.Attr) Record {
+	rec := Record{Time: r.Time, Level: r.Level.String(), Message: r.Message, Attrs: make(map[string]string)}
+	for _, a := range attrs {
+		rec.Attrs[a.Key] = a.Value.String()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.Attrs[a.Key] = a.Value.String()
+		return true
+	})
+	return rec
+}
+
+// ring is a fixed size buffer of the most recent records
+type ring struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{records: make([]Record, max(size, 1))}
+}
+
+func (r *ring) add(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) all() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]Record{}, r.records[:r.next]...)
+	}
+	return append(append([]Record{}, r.records[r.next:]...), r.records[:r.next]...)
+}
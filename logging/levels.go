@@ -0,0 +1,204 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// attributes which can have their own log level, e.g. subsystem=scan or camera=abc123
+const (
+	KeySubsystem = "subsystem"
+	KeyCamera    = "camera"
+)
+
+type override struct {
+	Level   slog.Level `json:"level"`
+	Expires time.Time  `json:"expires,omitempty"`
+}
+
+// Levels holds the global log level and any per subsystem or per camera overrides, all of which can be changed
+// at runtime
+type Levels struct {
+	global slog.LevelVar
+
+	mu        sync.RWMutex
+	overrides map[string]override
+	capture   *ring
+}
+
+func NewLevels(global slog.Level, captureSize int) *Levels {
+	l := &Levels{overrides: make(map[string]override), capture: newRing(captureSize)}
+	l.global.Set(global)
+	return l
+}
+
+// SetGlobal sets the default log level
+func (l *Levels) SetGlobal(level slog.Level) {
+	l.global.Set(level)
+}
+
+// Set overrides the level for the passed in key (e.g. camera=abc123) until it is cleared or, if ttl is non-zero,
+// until ttl has elapsed
+func (l *Levels) Set(key string, level slog.Level, ttl time.Duration) error {
+	if _, _, found := strings.Cut(key, "="); !found {
+		return fmt.Errorf("invalid level key %q, must be of the form name=value", key)
+	}
+
+	o := override{Level: level}
+	if ttl > 0 {
+		o.Expires = time.Now().Add(ttl)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides[key] = o
+	return nil
+}
+
+// Clear removes any override for the passed in key
+func (l *Levels) Clear(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides, key)
+}
+
+// Trace temporarily enables debug logging for the passed in key, capturing its records so they can be retrieved
+// via Captured without needing access to the log output
+func (l *Levels) Trace(key string, ttl time.Duration) error {
+	return l.Set(key, slog.LevelDebug, ttl)
+}
+
+// Captured returns the most recent records logged while tracing
+func (l *Levels) Captured() []Record {
+	return l.capture.all()
+}
+
+// returns the level for the passed in keys, camera overrides win over subsystem overrides which win over global
+func (l *Levels) level(keys []string) (slog.Level, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	level, traced, best := l.global.Level(), false, -1
+	for _, key := range keys {
+		o, found := l.overrides[key]
+		if !found || (!o.Expires.IsZero() && now.After(o.Expires)) {
+			continue
+		}
+
+		rank := 0
+		if strings.HasPrefix(key, KeyCamera+"=") {
+			rank = 1
+		}
+		if rank > best {
+			level, best = o.Level, rank
+			traced = o.Level <= slog.LevelDebug && !o.Expires.IsZero()
+		}
+	}
+	return level, traced
+}
+
+// ServeHTTP exposes the levels as an admin API, GET returns the current levels and the records captured while tracing,
+// POST sets one with a body like
+// {"key": "camera=abc123", "level": "DEBUG", "ttl": "10m"} where an empty key sets the global level and DELETE
+// with a key query parameter clears an override
+func (l *Levels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.mu.RLock()
+		state := struct {
+			Global    slog.Level          `json:"global"`
+			Overrides map[string]override `json:"overrides"`
+			Captured  []Record            `json:"captured"`
+		}{l.global.Level(), l.overrides, l.Captured()}
+		b, err := json.Marshal(state)
+		l.mu.RUnlock()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case http.MethodPost:
+		req := struct {
+			Key   string     `json:"key"`
+			Level slog.Level `json:"level"`
+			TTL   string     `json:"ttl"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.Key == "" {
+			l.SetGlobal(req.Level)
+		} else if err := l.Set(req.Key, req.Level, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		l.Clear(r.URL.Query().Get("key"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler is a slog handler which filters records using runtime adjustable Levels
+type Handler struct {
+	next   slog.Handler
+	levels *Levels
+	keys   []string
+	attrs  []slog.Attr
+}
+
+// NewHandler wraps the passed in handler, which should itself be configured to allow all levels
+func NewHandler(next slog.Handler, levels *Levels) *Handler {
+	return &Handler{next: next, levels: levels}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	min, _ := h.levels.level(h.keys)
+	return level >= min
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if _, traced := h.levels.level(h.keys); traced {
+		h.levels.capture.add(newRecord(r, h.attrs))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	keys := append([]string{}, h.keys...)
+	for _, a := range attrs {
+		if a.Key == KeySubsystem || a.Key == KeyCamera {
+			keys = append(keys, a.Key+"="+a.Value.String())
+		}
+	}
+	return &Handler{next: h.next.WithAttrs(attrs), levels: h.levels, keys: keys, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), levels: h.levels, keys: h.keys, attrs: h.attrs}
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	levels := NewLevels(slog.LevelInfo, 10)
+	out := &bytes.Buffer{}
+	log := slog.New(NewHandler(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}), levels))
+	scan := log.With(KeySubsystem, "scan")
+	camera := scan.With(KeyCamera, "abc123")
+
+	if err := levels.Set("subsystem=scan", slog.LevelWarn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := levels.Set("camera=abc123", slog.LevelDebug, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name   string
+		log    *slog.Logger
+		level  slog.Level
+		logged bool
+	}{
+		{name: "global info", log: log, level: slog.LevelInfo, logged: true},
+		{name: "global debug", log: log, level: slog.LevelDebug},
+		{name: "subsystem info", log: scan, level: slog.LevelInfo},
+		{name: "subsystem warn", log: scan, level: slog.LevelWarn, logged: true},
+		{name: "camera over subsystem", log: camera, level: slog.LevelDebug, logged: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			out.Reset()
+			tc.log.Log(context.Background(), tc.level, "hello")
+			if logged := out.Len() > 0; logged != tc.logged {
+				t.Errorf("expected logged %t, got %t", tc.logged, logged)
+			}
+		})
+	}
+
+	// overrides without a ttl don't capture, traced ones do until they expire
+	if len(levels.Captured()) != 0 {
+		t.Errorf("expected nothing captured, got %v", levels.Captured())
+	}
+	if err := levels.Trace("camera=abc123", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	camera.Debug("traced", "frame", 1)
+	captured := levels.Captured()
+	if len(captured) != 1 || captured[0].Message != "traced" || captured[0].Attrs["camera"] != "abc123" || captured[0].Attrs["frame"] != "1" {
+		t.Errorf("expected the traced record, got %+v", captured)
+	}
+
+	if err := levels.Set("abc123", slog.LevelDebug, 0); err == nil {
+		t.Error("expected error for a key without a name")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	levels := NewLevels(slog.LevelInfo, 10)
+	log := slog.New(NewHandler(slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelDebug}), levels))
+
+	serve := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		levels.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	tcs := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{name: "global", method: http.MethodPost, target: "/", body: `{"level": "WARN"}`, status: http.StatusNoContent},
+		{name: "trace", method: http.MethodPost, target: "/", body: `{"key": "camera=abc123", "level": "DEBUG", "ttl": "10m"}`, status: http.StatusNoContent},
+		{name: "subsystem", method: http.MethodPost, target: "/", body: `{"key": "subsystem=scan", "level": "ERROR"}`, status: http.StatusNoContent},
+		{name: "clear", method: http.MethodDelete, target: "/?key=subsystem=scan", status: http.StatusNoContent},
+		{name: "invalid key", method: http.MethodPost, target: "/", body: `{"key": "scan", "level": "DEBUG"}`, status: http.StatusBadRequest},
+		{name: "invalid ttl", method: http.MethodPost, target: "/", body: `{"key": "camera=abc123", "level": "DEBUG", "ttl": "soon"}`, status: http.StatusBadRequest},
+		{name: "invalid level", method: http.MethodPost, target: "/", body: `{"level": "LOUD"}`, status: http.StatusBadRequest},
+		{name: "invalid method", method: http.MethodPut, target: "/", status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(tc.method, tc.target, tc.body); w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+
+	log.With(KeyCamera, "abc123").Debug("traced")
+	w := serve(http.MethodGet, "/", "")
+	state := struct {
+		Global    slog.Level          `json:"global"`
+		Overrides map[string]override `json:"overrides"`
+		Captured  []Record            `json:"captured"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Global != slog.LevelWarn {
+		t.Errorf("expected global level WARN, got %s", state.Global)
+	}
+	if len(state.Overrides) != 1 || state.Overrides["camera=abc123"].Level != slog.LevelDebug {
+		t.Errorf("expected only the camera override, got %+v", state.Overrides)
+	}
+	if len(state.Captured) != 1 || state.Captured[0].Message != "traced" {
+		t.Errorf("expected the traced record, got %+v", state.Captured)
+	}
+}
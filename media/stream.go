@@ -0,0 +1,178 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamInfo describes an audio or video stream, it is shaped like an ffprobe stream so that streams we describe
+// natively and those described by ffprobe are interchangeable
+type StreamInfo struct {
+	Index         int       `json:"index"`
+	CodecType     string    `json:"codec_type"`
+	CodecName     string    `json:"codec_name"`
+	CodecLongName string    `json:"codec_long_name"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	FrameRate     FrameRate `json:"avg_frame_rate"`
+
+	// the lowest frame rate all timestamps can be represented at, this only matches the average for constant frame
+	// rate streams
+	RealFrameRate FrameRate `json:"r_frame_rate"`
+
+	// the codec profile and level, such as High and 41 for H.264 level 4.1, ffprobe gives unknown levels as -99
+	Profile string `json:"profile,omitempty"`
+	Level   int    `json:"level,omitempty"`
+
+	// the pixel format of video streams, such as yuv420p
+	PixelFormat string `json:"pix_fmt,omitempty"`
+
+	// the bits per second of this stream, zero if unknown which is usual for live streams
+	BitRate Number `json:"bit_rate,omitempty"`
+
+	// the samples per second, channels and sample format of audio streams
+	SampleRate    Number `json:"sample_rate,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channel_layout,omitempty"`
+	SampleFormat  string `json:"sample_fmt,omitempty"`
+}
+
+// IsVideo returns whether this is a video stream
+func (s StreamInfo) IsVideo() bool {
+	return s.CodecType == "video"
+}
+
+// IsAudio returns whether this is an audio stream
+func (s StreamInfo) IsAudio() bool {
+	return s.CodecType == "audio"
+}
+
+// FPS returns the frame rate of this stream in frames per second, zero if unknown
+func (s StreamInfo) FPS() float64 {
+	return s.FrameRate.FPS()
+}
+
+// IsVariable returns whether this stream has a variable frame rate, which is the case when its average frame rate
+// differs from its real one, streams where either is unknown are assumed to be constant
+func (s StreamInfo) IsVariable() bool {
+	if s.FrameRate.IsZero() || s.RealFrameRate.IsZero() {
+		return false
+	}
+	return !s.FrameRate.Equal(s.RealFrameRate)
+}
+
+// FrameRate is a frame rate as a rational, serialized as num/den the way ffprobe does, 0/0 when unknown
+type FrameRate struct {
+	Num int
+	Den int
+}
+
+// ParseFrameRate parses a frame rate written as num/den or as a plain number
+func ParseFrameRate(s string) (FrameRate, error) {
+	s = strings.TrimSpace(s)
+	num, den, found := strings.Cut(s, "/")
+	if !found {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return FrameRate{}, fmt.Errorf("invalid frame rate %q", s)
+		}
+		return FrameRateFromFPS(f), nil
+	}
+
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return FrameRate{}, fmt.Errorf("invalid frame rate %q", s)
+	}
+	d, err := strconv.Atoi(den)
+	if err != nil {
+		return FrameRate{}, fmt.Errorf("invalid frame rate %q", s)
+	}
+	return FrameRate{Num: n, Den: d}, nil
+}
+
+// FrameRateFromFPS returns the rational for the passed in frames per second, to a thousandth of a frame
+func FrameRateFromFPS(fps float64) FrameRate {
+	if fps <= 0 || math.IsNaN(fps) || math.IsInf(fps, 0) {
+		return FrameRate{}
+	}
+	if fps == math.Trunc(fps) {
+		return FrameRate{Num: int(fps), Den: 1}
+	}
+	return FrameRate{Num: int(math.Round(fps * 1000)), Den: 1000}
+}
+
+// FPS returns this frame rate in frames per second, zero if unknown
+func (r FrameRate) FPS() float64 {
+	if r.Num <= 0 || r.Den <= 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+// IsZero returns whether this frame rate is unknown
+func (r FrameRate) IsZero() bool {
+	return r.FPS() == 0
+}
+
+// Equal returns whether this frame rate is the same as the passed in one, regardless of how each is written
+func (r FrameRate) Equal(o FrameRate) bool {
+	if r.IsZero() || o.IsZero() {
+		return r.IsZero() && o.IsZero()
+	}
+	return int64(r.Num)*int64(o.Den) == int64(o.Num)*int64(r.Den)
+}
+
+// FrameDuration returns how long each frame is shown for at this frame rate, zero if unknown
+func (r FrameRate) FrameDuration() time.Duration {
+	if r.IsZero() {
+		return 0
+	}
+	return time.Duration(int64(time.Second) * int64(r.Den) / int64(r.Num))
+}
+
+func (r FrameRate) String() string {
+	return fmt.Sprintf("%d/%d", r.Num, r.Den)
+}
+
+func (r FrameRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *FrameRate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("error reading frame rate: %w", err)
+	}
+	parsed, err := ParseFrameRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// Number is an integer which ffprobe writes as a string, such as a bit rate, serialized the same way so that it reads
+// like ffprobe's output, zero when unknown
+type Number int64
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(n), 10))
+}
+
+func (n *Number) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" || s == "N/A" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*n = Number(v)
+	return nil
+}
@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets suited to latencies in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics which can be written in the Prometheus text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry metrics are added to by the New functions and served by Handler
+var Default = &Registry{}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric %s registered twice", m.name()))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in this registry in the Prometheus text format, sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the metrics in the default registry, mount it at /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		Default.Write(buf)
+		buf.Flush()
+	})
+}
+
+// the name, help and label names shared by every kind of metric along with its series keyed by label values
+type family[S any] struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*S
+	values map[string][]string
+	create func() *S
+}
+
+func (f *family[S]) name() string { return f.metricName }
+
+// returns the series for the passed in label values, creating it if needed
+func (f *family[S]) with(values []string) *S {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, found := f.series[key]
+	if !found {
+		s = f.create()
+		f.series[key] = s
+		f.values[key] = slices.Clone(values)
+	}
+	return s
+}
+
+// calls the passed in func with the labels and value of each series, in a stable order
+func (f *family[S]) each(fn func(labels string, s *S)) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	type entry struct {
+		labels string
+		s      *S
+	}
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		entries[i] = entry{formatLabels(f.labels, f.values[k]), f.series[k]}
+	}
+	f.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labels, e.s)
+	}
+}
+
+func (f *family[S]) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, escapeHelp(f.help), f.metricName, f.kind)
+}
+
+func newFamily[S any](name string, help string, kind string, labels []string, create func() *S) *family[S] {
+	return &family[S]{metricName: name, help: help, kind: kind, labels: labels, series: make(map[string]*S), values: make(map[string][]string), create: create}
+}
+
+// a float64 which can be updated atomically
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) { f.bits.Store(math.Float64bits(v)) }
+func (f *atomicFloat) get() float64  { return math.Float64frombits(f.bits.Load()) }
+
+// Counter is a value which only goes up
+type Counter struct {
+	v atomicFloat
+}
+
+func (c *Counter) Inc()           { c.v.add(1) }
+func (c *Counter) Add(v float64)  { c.v.add(v) }
+func (c *Counter) Value() float64 { return c.v.get() }
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	*family[Counter]
+}
+
+// NewCounter creates and registers a counter with the passed in label names
+func NewCounter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter for the passed in label values, in the order the labels were declared
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, s *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, labels, formatFloat(s.Value()))
+	})
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64)  { g.v.set(v) }
+func (g *Gauge) Add(v float64)  { g.v.add(v) }
+func (g *Gauge) Value() float64 { return g.v.get() }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	*family[Gauge]
+}
+
+// NewGauge creates and registers a gauge with the passed in label names
+func NewGauge(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newFamily(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	Default.register(g)
+	return g
+}
+
+// With returns the gauge for the passed in label values, in the order the labels were declared
+func (g *GaugeVec) With(values ...string) *Gauge { return g.with(values) }
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, s *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, labels, formatFloat(s.Value()))
+	})
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomicFloat
+}
+
+// Observe records a single observation
+func (h *Histogram) Observe(v float64) {
+	for i, upper := range h.upper {
+		if v <= upper {
+			h.counts[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	h.sum.add(v)
+}
+
+// Since observes the seconds elapsed since the passed in time
+func (h *Histogram) Since(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	*family[Histogram]
+}
+
+// NewHistogram creates and registers a histogram with the passed in buckets and label names
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &HistogramVec{newFamily(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	})}
+	Default.register(h)
+	return h
+}
+
+// With returns the histogram for the passed in label values, in the order the labels were declared
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, s *Histogram) {
+		for i, upper := range s.upper {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", formatFloat(upper)), s.counts[i].Load())
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", "+Inf"), s.count.Load())
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, labels, formatFloat(s.sum.get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, labels, s.count.Load())
+	})
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	b := &strings.Builder{}
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, `%s="%s"`, name, escapeLabel(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// adds a label to the passed in formatted labels
+func withLabel(labels string, name string, value string) string {
+	if labels == "" {
+		return fmt.Sprintf(`{%s="%s"}`, name, value)
+	}
+	return fmt.Sprintf(`%s,%s="%s"}`, labels[:len(labels)-1], name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,307 @@
+package motion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// the size frames are scaled down to before they are compared, small enough that sensor noise mostly averages out
+const (
+	gridWidth  = 64
+	gridHeight = 36
+)
+
+// Region is a rectangle of the frame watched for motion, as fractions of the frame's width and height from its top
+// left corner
+type Region struct {
+	X      float64 `yaml:"x" json:"x"`
+	Y      float64 `yaml:"y" json:"y"`
+	Width  float64 `yaml:"width" json:"width"`
+	Height float64 `yaml:"height" json:"height"`
+}
+
+// Config configures motion detection on a single camera
+type Config struct {
+	Camera string
+
+	// where frames come from
+	Source Source
+
+	// how often a frame is compared with the one before it
+	Interval time.Duration
+
+	// how much, out of 255, the brightness of part of the frame must change for it to count as changed, lower is more
+	// sensitive
+	Threshold int
+
+	// the fraction of the watched area which must change for it to be motion, lower is more sensitive
+	MinArea float64
+
+	// the parts of the frame watched for motion, the whole frame if empty
+	Regions []Region
+
+	// how long motion stays active after the last frame which changed
+	Hold time.Duration
+
+	// if set, whether to detect motion at the passed in time, such as by time of day. Frames are ignored while this
+	// is false.
+	Active func(time.Time) bool
+
+	// how long to wait before restarting a source which failed, doubled on each consecutive failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Detector detects motion by differencing frames of a camera, for cameras whose own motion events we can't use
+type Detector struct {
+	log  *slog.Logger
+	cfg  Config
+	mask []bool
+
+	// if set, called with each frame which changed, suitable for use with record.MotionRecorder.Trigger
+	OnTrigger func(at time.Time)
+
+	// if set, called when motion starts and when it stops, which is once Hold has passed since the last change
+	OnMotion func(active bool, at time.Time)
+
+	mu       sync.Mutex
+	previous *image.Gray
+	motion   bool
+	until    time.Time
+}
+
+func NewDetector(log *slog.Logger, cfg Config) (*Detector, error) {
+	if cfg.Source == nil {
+		return nil, errors.New("no source of frames")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 25
+	}
+	if cfg.MinArea <= 0 {
+		cfg.MinArea = 0.01
+	}
+	if cfg.Hold <= 0 {
+		cfg.Hold = 10 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = time.Minute
+	}
+	for _, r := range cfg.Regions {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Detector{log: log.With("subsystem", "motion", "camera", cfg.Camera), cfg: cfg, mask: mask(cfg.Regions)}, nil
+}
+
+// Validate checks that the region lies within the frame
+func (r Region) Validate() error {
+	if r.X < 0 || r.Y < 0 || r.Width <= 0 || r.Height <= 0 || r.X+r.Width > 1 || r.Y+r.Height > 1 {
+		return fmt.Errorf("invalid motion region %v,%v %vx%v, regions are fractions of the frame", r.X, r.Y, r.Width, r.Height)
+	}
+	return nil
+}
+
+// Active returns whether there is currently motion
+func (d *Detector) Active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.motion
+}
+
+// Run compares frames from our source until the passed in context is done, restarting the source with a backoff
+// whenever it fails
+func (d *Detector) Run(ctx context.Context) error {
+	backoff := d.cfg.MinBackoff
+	for {
+		started := time.Now()
+		err := d.cfg.Source.Run(ctx, d.cfg.Interval, d.frame)
+		if ctx.Err() != nil {
+			d.stop(time.Now())
+			return nil
+		}
+
+		// a source which ran for a good while before failing starts its backoff over
+		if time.Since(started) > d.cfg.MaxBackoff {
+			backoff = d.cfg.MinBackoff
+		}
+		d.log.Warn("motion source failed, retrying", slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		// we can't see any motion while the source is down, and frames either side of the gap aren't comparable
+		d.stop(time.Now())
+		d.mu.Lock()
+		d.previous = nil
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			d.stop(time.Now())
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, d.cfg.MaxBackoff)
+	}
+}
+
+// compares the passed in frame with the one before it, triggering if enough of it changed
+func (d *Detector) frame(img image.Image, now time.Time) {
+	if d.cfg.Active != nil && !d.cfg.Active(now) {
+		d.stop(now)
+		d.mu.Lock()
+		d.previous = nil
+		d.mu.Unlock()
+		return
+	}
+
+	current := downscale(img, gridWidth, gridHeight)
+
+	d.mu.Lock()
+	previous := d.previous
+	d.previous = current
+	d.mu.Unlock()
+
+	if previous != nil && d.changed(previous, current) {
+		d.trigger(now)
+	} else {
+		d.expire(now)
+	}
+}
+
+// returns whether enough of the watched area differs between the two passed in frames
+func (d *Detector) changed(a, b *image.Gray) bool {
+	watched, changed := 0, 0
+	for i := range a.Pix {
+		if !d.mask[i] {
+			continue
+		}
+		watched++
+		diff := int(a.Pix[i]) - int(b.Pix[i])
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff >= d.cfg.Threshold {
+			changed++
+		}
+	}
+	return watched > 0 && float64(changed)/float64(watched) >= d.cfg.MinArea
+}
+
+// records motion at the passed in time, starting it if there wasn't any
+func (d *Detector) trigger(now time.Time) {
+	d.mu.Lock()
+	started := !d.motion
+	d.motion = true
+	d.until = now.Add(d.cfg.Hold)
+	d.mu.Unlock()
+
+	if started {
+		d.log.Debug("motion started")
+		if d.OnMotion != nil {
+			d.OnMotion(true, now)
+		}
+	}
+	if d.OnTrigger != nil {
+		d.OnTrigger(now)
+	}
+}
+
+// stops motion if it has been held long enough since the last change
+func (d *Detector) expire(now time.Time) {
+	d.mu.Lock()
+	stopped := d.motion && !now.Before(d.until)
+	if stopped {
+		d.motion = false
+	}
+	until := d.until
+	d.mu.Unlock()
+
+	if stopped {
+		d.log.Debug("motion stopped")
+		if d.OnMotion != nil {
+			d.OnMotion(false, until)
+		}
+	}
+}
+
+// stops any motion as we're no longer watching
+func (d *Detector) stop(now time.Time) {
+	d.mu.Lock()
+	stopped := d.motion
+	d.motion = false
+	d.mu.Unlock()
+
+	if stopped && d.OnMotion != nil {
+		d.OnMotion(false, now)
+	}
+}
+
+// returns which cells of our grid lie within the passed in regions, all of them if there are none
+func mask(regions []Region) []bool {
+	m := make([]bool, gridWidth*gridHeight)
+	for y := 0; y < gridHeight; y++ {
+		for x := 0; x < gridWidth; x++ {
+			cx, cy := (float64(x)+0.5)/gridWidth, (float64(y)+0.5)/gridHeight
+			inside := len(regions) == 0
+			for _, r := range regions {
+				if cx >= r.X && cx < r.X+r.Width && cy >= r.Y && cy < r.Y+r.Height {
+					inside = true
+					break
+				}
+			}
+			m[y*gridWidth+x] = inside
+		}
+	}
+	return m
+}
+
+// returns the passed in image as grayscale at the passed in size, each pixel the average brightness of the part of
+// the image it covers
+func downscale(img image.Image, width, height int) *image.Gray {
+	bounds := img.Bounds()
+	if g, ok := img.(*image.Gray); ok && bounds.Dx() == width && bounds.Dy() == height {
+		return g
+	}
+
+	// JPEGs decode to YCbCr whose Y is already the brightness, anything else is converted pixel by pixel
+	luma := func(x, y int) uint32 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return (19595*r + 38470*g + 7471*b + 1<<15) >> 24
+	}
+	if ycc, ok := img.(*image.YCbCr); ok {
+		luma = func(x, y int) uint32 {
+			return uint32(ycc.Y[ycc.YOffset(x, y)])
+		}
+	}
+
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+
+			sum, n := uint32(0), uint32(0)
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sum += luma(sx, sy)
+					n++
+				}
+			}
+			out.Pix[y*out.Stride+x] = uint8(sum / n)
+		}
+	}
+	return out
+}
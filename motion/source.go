@@ -0,0 +1,124 @@
+package motion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// how many snapshots in a row may fail before a snapshot source gives up and is restarted with a backoff
+const maxSnapshotFailures = 3
+
+// Source delivers frames of a camera
+type Source interface {
+	// Run passes a frame, and when it was taken, to the passed in function about once per interval until the passed
+	// in context is done or the source fails
+	Run(ctx context.Context, interval time.Duration, frame func(image.Image, time.Time)) error
+}
+
+// SnapshotSource polls a camera for JPEG snapshots, which works with any camera that has a snapshot URI but is only
+// suitable for intervals of a second or more
+type SnapshotSource struct {
+	// fetches a single JPEG snapshot, such as onvif.Device.Snapshot for a profile
+	Fetch func(ctx context.Context) ([]byte, error)
+}
+
+func (s *SnapshotSource) Run(ctx context.Context, interval time.Duration, frame func(image.Image, time.Time)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		img, err := s.snapshot(ctx)
+		if err != nil {
+			if failures++; failures >= maxSnapshotFailures || ctx.Err() != nil {
+				return err
+			}
+		} else {
+			failures = 0
+			frame(img, time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *SnapshotSource) snapshot(ctx context.Context) (image.Image, error) {
+	b, err := s.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	return img, nil
+}
+
+// StreamSource decodes a camera stream with ffmpeg, scaled down and at our interval, best used with a low resolution
+// substream as ffmpeg has to decode every frame of it
+type StreamSource struct {
+	URL *creds.URL
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+}
+
+func (s *StreamSource) Run(ctx context.Context, interval time.Duration, frame func(image.Image, time.Time)) error {
+	ffmpeg := s.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+
+	// frames are scaled straight to our grid, as raw grayscale, so there is nothing for us to decode
+	fps := strconv.FormatFloat(float64(time.Second)/float64(interval), 'f', -1, 64)
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-rtsp_transport", "tcp",
+		"-i", s.URL.Secret(),
+		"-an",
+		"-vf", fmt.Sprintf("fps=%s,scale=%d:%d,format=gray", fps, gridWidth, gridHeight),
+		"-f", "rawvideo",
+		"pipe:1",
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating ffmpeg pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+
+	reader := bufio.NewReaderSize(stdout, gridWidth*gridHeight)
+	for {
+		img := image.NewGray(image.Rect(0, 0, gridWidth, gridHeight))
+		if _, err = io.ReadFull(reader, img.Pix); err != nil {
+			break
+		}
+		frame(img, time.Now())
+	}
+
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if waitErr != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", waitErr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return fmt.Errorf("stream ended: %w", err)
+}
@@ -0,0 +1,242 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/incrementventures/govr/notify"
+	"github.com/incrementventures/govr/scan"
+)
+
+// how long we wait for the broker to acknowledge a publish before giving up on it
+const publishTimeout = 10 * time.Second
+
+// Config configures our connection to an MQTT broker
+type Config struct {
+	// the broker to connect to, e.g. tcp://localhost:1883 or ssl://broker:8883
+	Broker   string `yaml:"broker"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	ClientID string `yaml:"client_id"`
+
+	// the prefix of every topic we publish to, defaults to govr
+	Prefix string `yaml:"prefix"`
+
+	// the prefix Home Assistant reads discovery payloads from, defaults to homeassistant, discovery payloads aren't
+	// published if this is set to -
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+// Publisher publishes the state of cameras and our notifications to an MQTT broker, along with Home Assistant
+// discovery payloads so cameras show up in its dashboards without any configuration there.
+//
+// Topics are under our prefix:
+//
+//	<prefix>/status                   online or offline, retained, our availability
+//	<prefix>/<camera>/state           online or offline, retained
+//	<prefix>/<camera>/info            the camera's scan record as JSON, retained
+//	<prefix>/<camera>/motion          ON or OFF, retained
+//	<prefix>/<camera>/events/<type>   each notification for the camera as JSON
+type Publisher struct {
+	log    *slog.Logger
+	cfg    Config
+	client paho.Client
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+func NewPublisher(log *slog.Logger, cfg Config) (*Publisher, error) {
+	if cfg.Broker == "" {
+		return nil, errors.New("no mqtt broker configured")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "govr"
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "govr"
+	}
+	cfg.Prefix = strings.TrimSuffix(cfg.Prefix, "/")
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = "homeassistant"
+	}
+
+	p := &Publisher{log: log.With("subsystem", "mqtt"), cfg: cfg, announced: make(map[string]bool)}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(p.connected).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			p.log.Warn("lost connection to mqtt broker", slog.String("error", err.Error()))
+		})
+	p.client = paho.NewClient(opts)
+	return p, nil
+}
+
+// Run connects to the broker, reconnecting whenever the connection is lost, until the passed in context is done
+func (p *Publisher) Run(ctx context.Context) {
+	p.log.Info("connecting to mqtt broker", slog.String("broker", p.cfg.Broker))
+	p.client.Connect()
+
+	<-ctx.Done()
+
+	p.client.Publish(p.statusTopic(), 1, true, "offline").WaitTimeout(time.Second)
+	p.client.Disconnect(250)
+}
+
+// called each time we connect to the broker, a broker without persistence forgets our retained messages when it
+// restarts so everything is published again
+func (p *Publisher) connected(paho.Client) {
+	p.log.Info("connected to mqtt broker", slog.String("broker", p.cfg.Broker))
+
+	p.mu.Lock()
+	p.announced = make(map[string]bool)
+	p.mu.Unlock()
+
+	p.publish(p.statusTopic(), true, "online")
+}
+
+// Device publishes the state of the passed in device, known to us by the passed in camera ID, announcing it to Home
+// Assistant the first time we see it
+func (p *Publisher) Device(camera string, record scan.Record, online bool) {
+	p.announce(camera, record)
+
+	state := "offline"
+	if online {
+		state = "online"
+	}
+	p.publish(p.topic(camera, "state"), true, state)
+	p.publishJSON(p.topic(camera, "info"), true, record)
+}
+
+// Notify publishes the passed in notification under the topic of its camera, also updating the camera's state for
+// notifications which change it, suitable for use as notify.Dispatcher.OnNotification
+func (p *Publisher) Notify(n notify.Notification) {
+	if n.Camera == "" {
+		p.publishJSON(p.cfg.Prefix+"/events/"+n.Type, false, n)
+		return
+	}
+
+	switch n.Type {
+	case notify.TypeDeviceOnline, notify.TypeDeviceOffline:
+		if record, ok := n.Data.(scan.Record); ok {
+			p.Device(n.Camera, record, n.Type == notify.TypeDeviceOnline)
+		}
+	case notify.TypeMotionStart:
+		p.publish(p.topic(n.Camera, "motion"), true, "ON")
+	case notify.TypeMotionStop:
+		p.publish(p.topic(n.Camera, "motion"), true, "OFF")
+	}
+	p.publishJSON(p.topic(n.Camera, "events/"+n.Type), false, n)
+}
+
+// publishes the Home Assistant discovery payloads for the passed in camera, once per connection
+func (p *Publisher) announce(camera string, record scan.Record) {
+	if p.cfg.DiscoveryPrefix == "-" {
+		return
+	}
+
+	p.mu.Lock()
+	announced := p.announced[camera]
+	p.announced[camera] = true
+	p.mu.Unlock()
+	if announced {
+		return
+	}
+
+	device := map[string]any{
+		"identifiers":  []string{"govr_" + camera},
+		"name":         cameraName(camera, record),
+		"manufacturer": record.Manufacturer,
+		"model":        record.Model,
+		"sw_version":   record.Firmware,
+	}
+	if record.MAC != "" {
+		device["connections"] = [][]string{{"mac", strings.ToLower(record.MAC)}}
+	}
+	availability := []map[string]string{{"topic": p.statusTopic()}}
+
+	p.publishJSON(p.discoveryTopic(camera, "connectivity"), true, map[string]any{
+		"name":                  "Connectivity",
+		"unique_id":             "govr_" + camera + "_connectivity",
+		"device_class":          "connectivity",
+		"state_topic":           p.topic(camera, "state"),
+		"payload_on":            "online",
+		"payload_off":           "offline",
+		"json_attributes_topic": p.topic(camera, "info"),
+		"availability":          availability,
+		"device":                device,
+	})
+	p.publishJSON(p.discoveryTopic(camera, "motion"), true, map[string]any{
+		"name":         "Motion",
+		"unique_id":    "govr_" + camera + "_motion",
+		"device_class": "motion",
+		"state_topic":  p.topic(camera, "motion"),
+		"availability": availability,
+		"device":       device,
+	})
+}
+
+func (p *Publisher) publishJSON(topic string, retain bool, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		p.log.Error("error marshalling mqtt payload", slog.String("topic", topic), slog.String("error", err.Error()))
+		return
+	}
+	p.publish(topic, retain, b)
+}
+
+// publishes the passed in payload at least once, in the background as the client queues it while we're disconnected
+func (p *Publisher) publish(topic string, retain bool, payload any) {
+	token := p.client.Publish(topic, 1, retain, payload)
+	go func() {
+		if !token.WaitTimeout(publishTimeout) {
+			p.log.Debug("mqtt publish not yet acknowledged", slog.String("topic", topic))
+			return
+		}
+		if err := token.Error(); err != nil {
+			p.log.Error("error publishing to mqtt", slog.String("topic", topic), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.cfg.Prefix + "/status"
+}
+
+func (p *Publisher) topic(camera string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", p.cfg.Prefix, topicSafe(camera), name)
+}
+
+func (p *Publisher) discoveryTopic(camera string, object string) string {
+	return fmt.Sprintf("%s/binary_sensor/govr_%s/%s/config", p.cfg.DiscoveryPrefix, topicSafe(camera), object)
+}
+
+// camera IDs are safe in topics but keys, used for devices not yet assigned an ID, can contain separators and
+// wildcards
+func topicSafe(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_").Replace(s)
+}
+
+// returns the name shown for a camera in Home Assistant
+func cameraName(camera string, record scan.Record) string {
+	if name := strings.TrimSpace(record.Manufacturer + " " + record.Model); name != "" {
+		return name + " (" + camera + ")"
+	}
+	return camera
+}
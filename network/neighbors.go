@@ -0,0 +1,81 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Neighbor is an entry in the system ARP/neighbor table
+type Neighbor struct {
+	IP    string
+	MAC   string
+	IFace IFace
+}
+
+// the port ARP sweeps send to, overridden in tests which listen for what is sent
+var discardPort = 9
+
+// ARPSweep prompts the kernel to ARP for each of the passed in addresses on the passed in network by sending each a
+// single UDP datagram, waits for replies, then returns the neighbors among them which answered. This finds live hosts
+// without needing raw sockets or root. Only the passed in addresses are sent to, so callers leave out any they mustn't
+// touch. Datagrams are paced by the passed in bucket, which can be nil.
+func ARPSweep(cidr CIDR, ips []string, wait time.Duration, limiter *TokenBucket) ([]Neighbor, error) {
+	p, err := netip.ParsePrefix(string(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %q: %w", cidr, err)
+	}
+	p = p.Masked()
+
+	swept := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		swept[ip] = true
+	}
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sweep socket: %w", err)
+	}
+	defer c.Close()
+
+	// the discard port, we only care about the ARP request this triggers, not whether anything is listening
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !p.Contains(addr) {
+			continue
+		}
+		limiter.Wait(context.Background())
+		c.WriteTo([]byte{0}, &net.UDPAddr{IP: net.ParseIP(ip), Port: discardPort})
+	}
+
+	time.Sleep(wait)
+
+	neighbors, err := GetNeighbors()
+	if err != nil {
+		return nil, err
+	}
+
+	live := []Neighbor{}
+	for _, n := range neighbors {
+		if swept[n.IP] {
+			live = append(live, n)
+		}
+	}
+	return live, nil
+}
+
+// LookupMAC returns the MAC address for the passed in IP from the neighbor table, or an empty string if unknown
+func LookupMAC(ip string) (string, error) {
+	neighbors, err := GetNeighbors()
+	if err != nil {
+		return "", err
+	}
+	for _, n := range neighbors {
+		if n.IP == ip {
+			return n.MAC, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,41 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GetNeighbors reads the kernel ARP table, returning only complete entries
+func GetNeighbors() ([]Neighbor, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, fmt.Errorf("error reading arp table: %w", err)
+	}
+	defer f.Close()
+
+	neighbors := []Neighbor{}
+	scanner := bufio.NewScanner(f)
+
+	// skip the header line
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+
+		// flag 0x2 is ATF_COM, meaning the entry is complete
+		ip, flags, mac, iface := fields[0], fields[2], fields[3], fields[5]
+		if flags == "0x0" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		neighbors = append(neighbors, Neighbor{IP: ip, MAC: strings.ToLower(mac), IFace: IFace(iface)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading arp table: %w", err)
+	}
+	return neighbors, nil
+}
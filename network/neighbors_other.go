@@ -0,0 +1,45 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var arpLineRegex = regexp.MustCompile(`\(([0-9.]+)\) at ([0-9a-fA-F:]+) on (\S+)`)
+
+// GetNeighbors parses the output of arp -an, returning only complete entries
+func GetNeighbors() ([]Neighbor, error) {
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("arp table not available: %w", err)
+		}
+		return nil, fmt.Errorf("error reading arp table: %w", err)
+	}
+
+	neighbors := []Neighbor{}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := arpLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		neighbors = append(neighbors, Neighbor{IP: m[1], MAC: normalizeMAC(m[2]), IFace: IFace(m[3])})
+	}
+	return neighbors, nil
+}
+
+// BSD arp drops leading zeros from each octet, e.g. 0:1c:42:2:3:4
+func normalizeMAC(mac string) string {
+	parts := strings.Split(strings.ToLower(mac), ":")
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":")
+}
@@ -1,10 +1,12 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -36,14 +38,51 @@ func GetPrivateIP4Interfaces() (map[IFace]CIDR, error) {
 	return found, nil
 }
 
+// Looks through all network interfaces and returns the names of those that have a link-local or unique local IP6
+// address, link-local addresses are only used if the interface has no unique local address
+func GetPrivateIP6Interfaces() (map[IFace]CIDR, error) {
+	found := make(map[IFace]CIDR)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error getting interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("error getting address for interface %q: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() != nil {
+				continue
+			}
+
+			ones, _ := ipNet.Mask.Size()
+			cidr := CIDR(fmt.Sprintf("%s/%d", ipNet.IP.String(), ones))
+
+			// unique local addresses (fc00::/7) are preferred over link-local
+			if ipNet.IP.IsPrivate() {
+				found[IFace(iface.Name)] = cidr
+				break
+			}
+			if ipNet.IP.IsLinkLocalUnicast() {
+				found[IFace(iface.Name)] = cidr
+			}
+		}
+	}
+	return found, nil
+}
+
 // returns all the IP addresses on the network
 func GetIPsOnNetwork(cidr CIDR) ([]string, error) {
-	p, err := netip.ParsePrefix(string(cidr))
+	p, err := ParsePrefix(cidr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid cidr: %q: %w", cidr, err)
+		return nil, err
 	}
-	// 8.8.8.8/24 => 8.8.8.0/24
-	p = p.Masked()
 
 	ips := []string{}
 	addr := p.Addr()
@@ -57,12 +96,74 @@ func GetIPsOnNetwork(cidr CIDR) ([]string, error) {
 	return ips, nil
 }
 
+// parses a CIDR or a bare IP, which is treated as a network containing just that address, and masks it
+// so that 8.8.8.8/24 => 8.8.8.0/24
+func ParsePrefix(cidr CIDR) (netip.Prefix, error) {
+	s := strings.TrimSpace(string(cidr))
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid ip: %q: %w", cidr, err)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr: %q: %w", cidr, err)
+	}
+	return p.Masked(), nil
+}
+
+// ErrTooManyTargets is returned when targets expand to more addresses than we are allowed to probe
+var ErrTooManyTargets = errors.New("too many targets")
+
+// expands a list of IPs and CIDRs into the individual IP addresses they contain, returning ErrTooManyTargets if they
+// hold more than limit addresses in total, which is checked before expanding so an IPv6 /64 doesn't exhaust memory
+func ExpandTargets(targets []string, limit int) ([]string, error) {
+	ips := []string{}
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		if strings.Contains(target, "/") {
+			p, err := ParsePrefix(CIDR(target))
+			if err != nil {
+				return nil, err
+			}
+			hostBits := p.Addr().BitLen() - p.Bits()
+			if hostBits >= 31 || len(ips)+1<<hostBits > limit {
+				return nil, fmt.Errorf("%w: %q would take us past %d addresses", ErrTooManyTargets, target, limit)
+			}
+
+			cidrIPs, err := GetIPsOnNetwork(CIDR(target))
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, cidrIPs...)
+			continue
+		}
+
+		addr, err := netip.ParseAddr(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip: %q: %w", target, err)
+		}
+		if len(ips)+1 > limit {
+			return nil, fmt.Errorf("%w: %q would take us past %d addresses", ErrTooManyTargets, target, limit)
+		}
+		ips = append(ips, addr.String())
+	}
+	return ips, nil
+}
+
 // checks if a port is open on the given target
 func IsPortOpen(address string, timeout time.Duration) (bool, error) {
 	conn, err := net.DialTimeout("tcp", address, timeout)
 
 	if err != nil {
-		if strings.Contains(err.Error(), "too many open files") {
+		if IsTooManyOpenFiles(err) {
 			return false, fmt.Errorf("error opening %q: %w", address, err)
 		}
 		return false, nil
@@ -71,3 +172,9 @@ func IsPortOpen(address string, timeout time.Duration) (bool, error) {
 	conn.Close()
 	return true, nil
 }
+
+// IsTooManyOpenFiles returns whether the passed in error is because we've run out of file descriptors, which is
+// temporary and worth retrying once some of our other connections have closed
+func IsTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || strings.Contains(err.Error(), "too many open files")
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpandTargets(t *testing.T) {
+	tcs := []struct {
+		name    string
+		targets []string
+		limit   int
+		ips     []string
+		err     error
+		invalid bool
+	}{
+		{
+			name:    "ips",
+			targets: []string{"192.168.1.10", " 192.168.1.11 ", ""},
+			limit:   256,
+			ips:     []string{"192.168.1.10", "192.168.1.11"},
+		},
+		{
+			name:    "masked cidr",
+			targets: []string{"192.168.1.5/30"},
+			limit:   256,
+			ips:     []string{"192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7"},
+		},
+		{
+			name:    "ipv6",
+			targets: []string{"fd00::1", "fe80::1%eth0", "fd00::10/127"},
+			limit:   256,
+			ips:     []string{"fd00::1", "fe80::1%eth0", "fd00::10", "fd00::11"},
+		},
+		{
+			name:    "at limit",
+			targets: []string{"10.0.0.0/24"},
+			limit:   256,
+			ips:     nil,
+		},
+		{
+			name:    "cidr past limit",
+			targets: []string{"10.0.0.0/23"},
+			limit:   256,
+			err:     ErrTooManyTargets,
+		},
+		{
+			name:    "ipv6 network",
+			targets: []string{"fd00::/64"},
+			limit:   1 << 16,
+			err:     ErrTooManyTargets,
+		},
+		{
+			name:    "everything",
+			targets: []string{"0.0.0.0/0"},
+			limit:   1 << 16,
+			err:     ErrTooManyTargets,
+		},
+		{
+			name:    "total past limit",
+			targets: []string{"10.0.0.0/31", "10.0.1.0/31", "10.0.2.1"},
+			limit:   4,
+			err:     ErrTooManyTargets,
+		},
+		{
+			name:    "invalid ip",
+			targets: []string{"192.168.1.300"},
+			limit:   256,
+			invalid: true,
+		},
+		{
+			name:    "invalid cidr",
+			targets: []string{"192.168.1.0/33"},
+			limit:   256,
+			invalid: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ips, err := ExpandTargets(tc.targets, tc.limit)
+			if tc.invalid {
+				if err == nil || errors.Is(err, ErrTooManyTargets) {
+					t.Errorf("expected invalid target error, got %v", err)
+				}
+				return
+			}
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("expected %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.ips == nil {
+				if len(ips) != tc.limit {
+					t.Errorf("expected %d ips, got %d", tc.limit, len(ips))
+				}
+				return
+			}
+			if !slices.Equal(ips, tc.ips) {
+				t.Errorf("expected %v, got %v", tc.ips, ips)
+			}
+		})
+	}
+}
+
+func TestARPSweep(t *testing.T) {
+	// listeners on an address we sweep and one we don't, on the same port so one sweep reaches either
+	swept, err := net.ListenPacket("udp4", "127.0.0.3:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer swept.Close()
+	port := swept.LocalAddr().(*net.UDPAddr).Port
+	skipped, err := net.ListenPacket("udp4", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("unable to listen on a second loopback address: %v", err)
+	}
+	defer skipped.Close()
+
+	defer func(port int) { discardPort = port }(discardPort)
+	discardPort = port
+
+	if _, err := ARPSweep("127.0.0.0/29", []string{"127.0.0.3", "127.0.0.9"}, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 16)
+	swept.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := swept.ReadFrom(b); err != nil {
+		t.Errorf("expected a datagram at the swept address, got %v", err)
+	}
+	skipped.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, src, err := skipped.ReadFrom(b); err == nil {
+		t.Errorf("expected no datagram at an address we didn't sweep, got one from %s", src)
+	}
+}
+
+func TestPingSweep(t *testing.T) {
+	if _, _, err := Ping("127.0.0.1", time.Second); err != nil {
+		t.Skipf("unable to ping: %v", err)
+	}
+
+	// only the passed in addresses on the network are pinged, even though every loopback address answers
+	results, err := PingSweep("127.0.0.0/30", []string{"127.0.0.2", "10.0.0.1"}, time.Second, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].IP != "127.0.0.2" {
+		t.Errorf("expected only 127.0.0.2 to answer, got %+v", results)
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// builtin prefixes for the vendors we most commonly see on camera networks, a full IEEE registry can be loaded
+// with LoadOUIFile
+var ouiVendors = map[string]string{
+	"28:57:be": "Hikvision", "44:19:b6": "Hikvision", "54:c4:15": "Hikvision", "4c:bd:8f": "Hikvision",
+	"c0:56:e3": "Hikvision", "bc:ad:28": "Hikvision", "a4:14:37": "Hikvision", "18:68:cb": "Hikvision",
+	"c4:2f:90": "Hikvision",
+	"3c:ef:8c": "Dahua", "90:02:a9": "Dahua", "e0:50:8b": "Dahua", "4c:11:bf": "Dahua", "14:a7:8b": "Dahua",
+	"38:af:29": "Dahua", "a0:bd:1d": "Dahua", "bc:32:5f": "Dahua",
+	"00:40:8c": "Axis", "ac:cc:8e": "Axis", "b8:a4:4f": "Axis", "e8:27:25": "Axis",
+	"9c:8e:cd": "Amcrest",
+	"ec:71:db": "Reolink",
+	"00:09:18": "Hanwha", "00:16:6c": "Hanwha",
+	"48:ea:63": "Uniview",
+	"00:02:d1": "Vivotek",
+	"00:03:c5": "Mobotix",
+	"00:07:5f": "Bosch", "00:04:63": "Bosch",
+	"00:1a:07": "Arecont Vision",
+	"00:18:85": "Avigilon",
+	"00:04:7d": "Pelco",
+	"00:13:e2": "GeoVision",
+	"00:0f:7c": "ACTi",
+	"2c:aa:8e": "Wyze", "d0:3f:27": "Wyze",
+	"24:a4:3c": "Ubiquiti", "68:72:51": "Ubiquiti", "78:8a:20": "Ubiquiti", "fc:ec:da": "Ubiquiti",
+	"74:83:c2": "Ubiquiti", "e0:63:da": "Ubiquiti",
+}
+
+var ouiMu sync.RWMutex
+
+// LookupVendor returns the vendor for the passed in MAC address, or an empty string if unknown
+func LookupVendor(mac string) string {
+	mac = strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
+	if len(mac) < 8 {
+		return ""
+	}
+
+	ouiMu.RLock()
+	defer ouiMu.RUnlock()
+	return ouiVendors[mac[:8]]
+}
+
+// LoadOUIFile adds the vendors from an IEEE oui.txt registry file to our lookup table, lines look like:
+// 28-57-BE   (hex)		Hangzhou Hikvision Digital Technology Co.,Ltd.
+func LoadOUIFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening oui file: %w", err)
+	}
+	defer f.Close()
+
+	loaded := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		prefix, vendor, found := strings.Cut(scanner.Text(), "(hex)")
+		if !found {
+			continue
+		}
+		prefix = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(prefix), "-", ":"))
+		if len(prefix) != 8 {
+			continue
+		}
+		loaded[prefix] = strings.TrimSpace(vendor)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading oui file: %w", err)
+	}
+
+	ouiMu.Lock()
+	defer ouiMu.Unlock()
+	for prefix, vendor := range loaded {
+		ouiVendors[prefix] = vendor
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// PingResult is a host which answered a ping and how long it took to answer
+type PingResult struct {
+	IP      string
+	Latency time.Duration
+}
+
+// PingMethod is how we ping hosts, which depends on what privileges we have
+type PingMethod string
+
+const (
+	// ICMP echo over a raw socket, requires root or CAP_NET_RAW
+	PingRaw = PingMethod("raw")
+
+	// ICMP echo over an unprivileged datagram socket, requires net.ipv4.ping_group_range on Linux
+	PingDatagram = PingMethod("datagram")
+
+	// a UDP datagram to a closed port, hosts are alive if they answer with port unreachable
+	PingUDP = PingMethod("udp")
+)
+
+// the port we send UDP pings to, the traceroute base port which is almost never open
+const udpPingPort = 33434
+
+// DetectPingMethod returns the best ping method available to this process
+func DetectPingMethod() PingMethod {
+	for _, method := range []PingMethod{PingRaw, PingDatagram} {
+		c, err := icmp.ListenPacket(method.network(), "0.0.0.0")
+		if err == nil {
+			c.Close()
+			return method
+		}
+	}
+	return PingUDP
+}
+
+func (m PingMethod) network() string {
+	if m == PingRaw {
+		return "ip4:icmp"
+	}
+	return "udp4"
+}
+
+// PingSweep pings each of the passed in addresses on the passed in IPv4 network, with up to concurrency pings in
+// flight, and returns the hosts which answered within timeout ordered by latency, fastest first. Only the passed in
+// addresses are pinged, so callers leave out any they mustn't touch.
+func PingSweep(cidr CIDR, ips []string, timeout time.Duration, concurrency int) ([]PingResult, error) {
+	p, err := ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Addr().Is4() {
+		return nil, fmt.Errorf("ping sweeps only support IP4 networks: %q", cidr)
+	}
+
+	ips = slices.DeleteFunc(slices.Clone(ips), func(ip string) bool {
+		addr, err := netip.ParseAddr(ip)
+		return err != nil || !p.Contains(addr)
+	})
+
+	method := DetectPingMethod()
+	results := []PingResult{}
+	errs := []error{}
+	mu := sync.Mutex{}
+
+	wp := pool.New().WithMaxGoroutines(max(concurrency, 1))
+	for i, ip := range ips {
+		wp.Go(func() {
+			latency, alive, err := ping(method, ip, i, timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			} else if alive {
+				results = append(results, PingResult{IP: ip, Latency: latency})
+			}
+		})
+	}
+	wp.Wait()
+
+	// every ping failing means we can't ping at all, otherwise individual failures are just unreachable hosts
+	if len(errs) == len(ips) && len(errs) > 0 {
+		return nil, fmt.Errorf("error pinging network %q: %w", cidr, errs[0])
+	}
+
+	slices.SortFunc(results, func(a, b PingResult) int {
+		if c := cmp.Compare(a.Latency, b.Latency); c != 0 {
+			return c
+		}
+		return compareIPs(a.IP, b.IP)
+	})
+	return results, nil
+}
+
+// Ping pings a single IPv4 host using the best method available, returning whether it answered and how long it took
+func Ping(ip string, timeout time.Duration) (time.Duration, bool, error) {
+	return ping(DetectPingMethod(), ip, 0, timeout)
+}
+
+func ping(method PingMethod, ip string, seq int, timeout time.Duration) (time.Duration, bool, error) {
+	dst := net.ParseIP(ip).To4()
+	if dst == nil {
+		return 0, false, fmt.Errorf("invalid ip4 address: %q", ip)
+	}
+	if method == PingUDP {
+		return pingUDP(dst, timeout)
+	}
+	return pingICMP(method, dst, seq&0xffff, timeout)
+}
+
+func pingICMP(method PingMethod, dst net.IP, seq int, timeout time.Duration) (time.Duration, bool, error) {
+	c, err := icmp.ListenPacket(method.network(), "0.0.0.0")
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to open icmp socket: %w", err)
+	}
+	defer c.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("govr")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error building echo request: %w", err)
+	}
+
+	var addr net.Addr = &net.IPAddr{IP: dst}
+	if method == PingDatagram {
+		addr = &net.UDPAddr{IP: dst}
+	}
+
+	start := time.Now()
+	c.SetReadDeadline(start.Add(timeout))
+	if _, err := c.WriteTo(b, addr); err != nil {
+		return 0, false, fmt.Errorf("error sending echo request to %s: %w", dst, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				return 0, false, nil
+			}
+			return 0, false, fmt.Errorf("error reading echo reply from %s: %w", dst, err)
+		}
+		if !peerIP(peer).Equal(dst) {
+			continue
+		}
+
+		reply, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+
+		// raw sockets see every reply on the host so we need to check it is ours, datagram sockets have their id
+		// rewritten by the kernel which already filters replies for us
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (method == PingRaw && echo.ID != id) {
+			continue
+		}
+		return time.Since(start), true, nil
+	}
+}
+
+func pingUDP(dst net.IP, timeout time.Duration) (time.Duration, bool, error) {
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: udpPingPort})
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to open udp socket: %w", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	c.SetDeadline(start.Add(timeout))
+	if _, err := c.Write([]byte{0}); err != nil {
+		return 0, false, fmt.Errorf("error sending udp ping to %s: %w", dst, err)
+	}
+
+	// a port unreachable comes back to connected sockets as connection refused, either that or an actual answer
+	// means the host is up
+	_, err = c.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+		return time.Since(start), true, nil
+	}
+	if isTimeout(err) {
+		return 0, false, nil
+	}
+	return 0, false, fmt.Errorf("error reading udp ping reply from %s: %w", dst, err)
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func compareIPs(a, b string) int {
+	aa, _ := netip.ParseAddr(a)
+	ba, _ := netip.ParseAddr(b)
+	return aa.Compare(ba)
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"crypto/sha256"
+)
+
+// limits on the responses processed for a single discovery probe, far more than any real network produces
+const (
+	DefaultMaxResponses  = 1024
+	DefaultMaxPerSource  = 16
+	DefaultResponseRate  = 500
+	defaultResponseBurst = 256
+)
+
+// ResponseGuard bounds the responses processed for a single discovery probe, so that a misbehaving or malicious
+// device flooding us with responses can't stall discovery, it isn't safe for concurrent use
+type ResponseGuard struct {
+	maxResponses int
+	maxPerSource int
+	rate         *TokenBucket
+
+	seen      map[[sha256.Size]byte]bool
+	perSource map[string]int
+	accepted  int
+	dropped   int
+}
+
+// NewResponseGuard returns a guard accepting at most maxResponses in total, maxPerSource from each source and rate
+// per second, zero values use our defaults
+func NewResponseGuard(maxResponses int, maxPerSource int, rate float64) *ResponseGuard {
+	if maxResponses <= 0 {
+		maxResponses = DefaultMaxResponses
+	}
+	if maxPerSource <= 0 {
+		maxPerSource = DefaultMaxPerSource
+	}
+	if rate <= 0 {
+		rate = DefaultResponseRate
+	}
+	return &ResponseGuard{
+		maxResponses: maxResponses,
+		maxPerSource: maxPerSource,
+		rate:         NewTokenBucket(rate, defaultResponseBurst),
+		seen:         make(map[[sha256.Size]byte]bool),
+		perSource:    make(map[string]int),
+	}
+}
+
+// Allow returns whether the passed in response from the passed in source should be processed, duplicates of a
+// response already seen from the same source are never processed
+func (g *ResponseGuard) Allow(source string, payload []byte) bool {
+	h := sha256.New()
+	h.Write([]byte(source))
+	h.Write([]byte{0})
+	h.Write(payload)
+	key := [sha256.Size]byte(h.Sum(nil))
+
+	switch {
+	case g.seen[key],
+		g.accepted >= g.maxResponses,
+		g.perSource[source] >= g.maxPerSource,
+		!g.rate.Allow():
+		g.dropped++
+		return false
+	}
+
+	g.seen[key] = true
+	g.perSource[source]++
+	g.accepted++
+	return true
+}
+
+// Exhausted returns whether we've accepted as many responses as we will, at which point reading can stop
+func (g *ResponseGuard) Exhausted() bool {
+	return g.accepted >= g.maxResponses
+}
+
+// Dropped returns how many responses we've refused
+func (g *ResponseGuard) Dropped() int {
+	return g.dropped
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ErrVLANsUnsupported is returned when creating VLAN sub-interfaces on a platform we can't create them on
+var ErrVLANsUnsupported = errors.New("vlan sub-interfaces not supported")
+
+// VLAN is a tagged sub-interface of a physical interface, named like eth0.20 for VLAN 20 on eth0, with the address
+// we use on it
+type VLAN struct {
+	Parent  IFace
+	ID      int
+	Address CIDR
+}
+
+// Name returns the name of the sub-interface, its parent and VLAN ID joined by a dot
+func (v VLAN) Name() IFace {
+	return IFace(fmt.Sprintf("%s.%d", v.Parent, v.ID))
+}
+
+// ParseVLAN parses a VLAN sub-interface and the address to use on it, such as eth0.20=192.168.20.250/24, the address
+// being optional for sub-interfaces which already exist
+func ParseVLAN(s string) (VLAN, error) {
+	name, address, _ := strings.Cut(strings.TrimSpace(s), "=")
+	parent, id, found := strings.Cut(name, ".")
+	if !found || parent == "" {
+		return VLAN{}, fmt.Errorf("invalid vlan %q, expected an interface and vlan id such as eth0.20", s)
+	}
+	vlan, err := strconv.Atoi(id)
+	if err != nil || vlan < 1 || vlan > 4094 {
+		return VLAN{}, fmt.Errorf("invalid vlan id in %q, must be between 1 and 4094", s)
+	}
+	if address != "" {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil || !prefix.Addr().Is4() {
+			return VLAN{}, fmt.Errorf("invalid address in %q, expected an IPv4 address and prefix length", s)
+		}
+	}
+	return VLAN{Parent: IFace(parent), ID: vlan, Address: CIDR(address)}, nil
+}
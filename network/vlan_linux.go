@@ -0,0 +1,79 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GetVLANs returns the VLAN sub-interfaces which exist on this host, as the kernel lists them, without their
+// addresses
+func GetVLANs() ([]VLAN, error) {
+	f, err := os.Open("/proc/net/vlan/config")
+	if err != nil {
+		// the 8021q module isn't loaded so there can't be any
+		if errors.Is(err, os.ErrNotExist) {
+			return []VLAN{}, nil
+		}
+		return nil, fmt.Errorf("error reading vlan config: %w", err)
+	}
+	defer f.Close()
+
+	vlans := []VLAN{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// after two header lines each is the sub-interface, its VLAN ID and its parent, separated by pipes
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			continue
+		}
+		vlans = append(vlans, VLAN{Parent: IFace(strings.TrimSpace(fields[2])), ID: id})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading vlan config: %w", err)
+	}
+	return vlans, nil
+}
+
+// CreateVLAN creates the passed in VLAN sub-interface with its address and brings it up, returning a func which
+// removes it again. This uses ip from iproute2 and needs to be run as root.
+func CreateVLAN(v VLAN) (func() error, error) {
+	if v.Address == "" {
+		return nil, fmt.Errorf("vlan %s needs an address to be created", v.Name())
+	}
+	name := string(v.Name())
+	remove := func() error { return ip("link", "del", name) }
+
+	if err := ip("link", "add", "link", string(v.Parent), "name", name, "type", "vlan", "id", strconv.Itoa(v.ID)); err != nil {
+		return nil, err
+	}
+	if err := ip("addr", "add", string(v.Address), "dev", name); err != nil {
+		remove()
+		return nil, err
+	}
+	if err := ip("link", "set", name, "up"); err != nil {
+		remove()
+		return nil, err
+	}
+	return remove, nil
+}
+
+// runs ip with the passed in arguments, including anything it printed in the error if it fails
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("error running ip %s: %s: %w", strings.Join(args, " "), msg, err)
+		}
+		return fmt.Errorf("error running ip %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+// GetVLANs returns the VLAN sub-interfaces which exist on this host, without their addresses. Only those named like
+// eth0.20 can be recognized, as there is no portable way of asking for the VLAN of an interface.
+func GetVLANs() ([]VLAN, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error getting interfaces: %w", err)
+	}
+	vlans := []VLAN{}
+	for _, iface := range ifaces {
+		if v, err := ParseVLAN(iface.Name); err == nil {
+			vlans = append(vlans, v)
+		}
+	}
+	return vlans, nil
+}
+
+// CreateVLAN creates the passed in VLAN sub-interface, which is only supported on Linux
+func CreateVLAN(v VLAN) (func() error, error) {
+	return nil, fmt.Errorf("%w: can't create %s", ErrVLANsUnsupported, v.Name())
+}
@@ -0,0 +1,11 @@
+package notify
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+var (
+	notificationsSent    = metrics.NewCounter("govr_notifications_sent_total", "Notifications delivered to webhooks.", "type")
+	notificationsFailed  = metrics.NewCounter("govr_notifications_failed_total", "Notifications which couldn't be delivered after retrying.", "type")
+	notificationsDropped = metrics.NewCounter("govr_notifications_dropped_total", "Notifications dropped because deliveries were backed up.", "type")
+)
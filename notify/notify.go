@@ -0,0 +1,273 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// the types of notification we send
+const (
+	TypeDeviceOnline  = "device.online"
+	TypeDeviceOffline = "device.offline"
+	TypeMotionStart   = "motion.start"
+	TypeMotionStop    = "motion.stop"
+	TypeRecordingGap  = "recording.gap"
+	TypeCameraHealth  = "camera.health"
+	TypeEvent         = "event"
+
+	// devices have started or stopped conflicting over an address
+	TypeConflict         = "device.conflict"
+	TypeConflictResolved = "device.conflict_resolved"
+)
+
+// Notification is the JSON payload POSTed to webhooks
+type Notification struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Camera string    `json:"camera,omitempty"`
+	Time   time.Time `json:"time"`
+	Data   any       `json:"data,omitempty"`
+}
+
+// Webhook is a URL notifications are POSTed to
+type Webhook struct {
+	URL string `yaml:"url"`
+
+	// if set, each payload is signed with an HMAC-SHA256 using this secret, sent as X-Govr-Signature: sha256=<hex>
+	Secret string `yaml:"secret"`
+
+	// the notification types sent to this webhook, all of them if empty
+	Types []string `yaml:"types"`
+}
+
+// wants returns whether this webhook should be sent notifications of the passed in type
+func (w *Webhook) wants(typ string) bool {
+	return len(w.Types) == 0 || slices.Contains(w.Types, typ)
+}
+
+// Config configures a dispatcher
+type Config struct {
+	Webhooks []Webhook
+
+	// how many times a delivery is attempted before it is dropped, and how long to wait between attempts, doubled on
+	// each failure up to MaxBackoff
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	// how long each attempt is given
+	Timeout time.Duration
+
+	// how many notifications can wait to be delivered before new ones are dropped
+	QueueSize int
+}
+
+// a notification on its way to a single webhook
+type delivery struct {
+	webhook Webhook
+	body    []byte
+	n       Notification
+}
+
+// Dispatcher POSTs notifications to webhooks in the background, retrying failed deliveries with a backoff so that a
+// slow or unreachable webhook never holds up the caller
+type Dispatcher struct {
+	log    *slog.Logger
+	cfg    Config
+	client *http.Client
+	queue  chan delivery
+
+	// if set, called with every notification whether or not any webhook wants it, e.g. to also publish it to MQTT
+	OnNotification func(Notification)
+
+	mu       sync.Mutex
+	webhooks []Webhook
+}
+
+func NewDispatcher(log *slog.Logger, cfg Config) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 256
+	}
+	return &Dispatcher{
+		log:      log.With("subsystem", "notify"),
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan delivery, cfg.QueueSize),
+		webhooks: slices.Clone(cfg.Webhooks),
+	}
+}
+
+// SetWebhooks replaces the webhooks notifications are sent to, deliveries already queued still go to their webhook
+func (d *Dispatcher) SetWebhooks(webhooks []Webhook) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.webhooks = slices.Clone(webhooks)
+}
+
+// Notify queues a notification of the passed in type for each webhook which wants it, dropping it if our queue is
+// full rather than blocking. The passed in data is sent as is, so should be a value rather than a pointer.
+func (d *Dispatcher) Notify(typ string, camera string, at time.Time, data any) {
+	n := Notification{ID: uuid.NewString(), Type: typ, Camera: camera, Time: at.UTC(), Data: data}
+	body, err := json.Marshal(n)
+	if err != nil {
+		d.log.Error("error marshalling notification", slog.String("type", typ), slog.String("error", err.Error()))
+		return
+	}
+
+	d.mu.Lock()
+	webhooks := d.webhooks
+	d.mu.Unlock()
+
+	if d.OnNotification != nil {
+		d.OnNotification(n)
+	}
+
+	for _, w := range webhooks {
+		if !w.wants(typ) {
+			continue
+		}
+		select {
+		case d.queue <- delivery{webhook: w, body: body, n: n}:
+		default:
+			notificationsDropped.With(typ).Inc()
+			d.log.Warn("notification queue full, dropping notification", slog.String("type", typ), slog.String("url", w.URL))
+		}
+	}
+}
+
+// Run delivers queued notifications until the passed in context is done, deliveries are made one at a time per
+// webhook but webhooks are delivered to concurrently
+func (d *Dispatcher) Run(ctx context.Context) {
+	workers := map[string]chan delivery{}
+	wg := sync.WaitGroup{}
+	defer func() {
+		for _, w := range workers {
+			close(w)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case del := <-d.queue:
+			worker, found := workers[del.webhook.URL]
+			if !found {
+				worker = make(chan delivery, d.cfg.QueueSize)
+				workers[del.webhook.URL] = worker
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for del := range worker {
+						d.deliver(ctx, del)
+					}
+				}()
+			}
+			select {
+			case worker <- del:
+			default:
+				notificationsDropped.With(del.n.Type).Inc()
+				d.log.Warn("webhook backed up, dropping notification", slog.String("type", del.n.Type), slog.String("url", del.webhook.URL))
+			}
+		}
+	}
+}
+
+// delivers a notification to its webhook, retrying with a backoff until it is accepted, rejected outright or we run
+// out of attempts
+func (d *Dispatcher) deliver(ctx context.Context, del delivery) {
+	log := d.log.With("type", del.n.Type, "url", del.webhook.URL, "id", del.n.ID)
+
+	backoff := d.cfg.MinBackoff
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		retry, err := d.post(ctx, del, attempt)
+		if err == nil {
+			notificationsSent.With(del.n.Type).Inc()
+			return
+		}
+		if !retry || attempt >= d.cfg.MaxAttempts {
+			notificationsFailed.With(del.n.Type).Inc()
+			log.Error("giving up on webhook delivery", slog.Int("attempts", attempt), slog.String("error", err.Error()))
+			return
+		}
+
+		log.Warn("webhook delivery failed, retrying", slog.Int("attempt", attempt), slog.Duration("backoff", backoff), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, d.cfg.MaxBackoff)
+	}
+}
+
+// makes a single attempt at a delivery, returning whether a failure is worth retrying
+func (d *Dispatcher) post(ctx context.Context, del delivery, attempt int) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.webhook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "govr")
+	req.Header.Set("X-Govr-Event", del.n.Type)
+	req.Header.Set("X-Govr-Delivery", del.n.ID)
+	req.Header.Set("X-Govr-Attempt", strconv.Itoa(attempt))
+	if del.webhook.Secret != "" {
+		req.Header.Set("X-Govr-Signature", Sign(del.webhook.Secret, del.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		// anything else is the webhook telling us it doesn't want this, which won't change if we ask again
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// Sign returns the signature of the passed in payload, as sent in X-Govr-Signature, which receivers can compute
+// themselves with their secret to check a payload came from us
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,28 @@
+package onvif
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+type AudioOutput struct {
+	Token string `xml:"token,attr"`
+}
+
+type getAudioOutputsResponse struct {
+	AudioOutputs []AudioOutput `xml:"Body>GetAudioOutputsResponse>AudioOutputs"`
+}
+
+const getAudioOutputsBody = `<trt:GetAudioOutputs xmlns:trt="http://www.onvif.org/ver10/media/wsdl"/>`
+
+// GetAudioOutputs returns the audio outputs, such as speakers, the device has
+func (d *Device) GetAudioOutputs(log *slog.Logger) ([]AudioOutput, error) {
+	resp := &getAudioOutputsResponse{}
+	_, err := d.makeRequest(log, d.Capabilities.Media.Address, getAudioOutputsBody, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audio outputs: %w", err)
+	}
+
+	log.Debug("got audio outputs", slog.String("response", fmt.Sprintf("%+v", resp.AudioOutputs)))
+	return resp.AudioOutputs, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/xml"
 	"fmt"
 	"log/slog"
 	"net"
@@ -13,30 +12,32 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/media"
 	"github.com/nyaruka/gocommon/httpx"
 )
 
 type Device struct {
 	Address  string
 	Username string
-	Password string
+	Password string `json:"-"`
 
 	// cameras often have a clock that is off by some amount which then causes auth to fail, this is the offset
 	// to apply from our system clock to the camera clock to account for that
 	ClockOffset time.Duration
 
+	// the WS-Addressing endpoint reference of the device, a GUID which stays the same when its address changes, empty
+	// if the device doesn't report one
+	Endpoint string `json:",omitempty"`
+
+	// how long requests to this device are given, nil uses DefaultTimeouts
+	Timeouts *Timeouts `json:"-"`
+
+	// how requests to this device are sent, nil sends them over the network, set to answer them from fixtures
+	Transport http.RoundTripper `json:"-"`
+
 	Capabilities      Capabilities
 	DeviceInformation DeviceInformation
 	Profiles          []Profile
-	MediaProfiles     []MediaProfile
-}
-
-type MediaProfile struct {
-	Token         string
-	URI           string
-	SourceStreams []Stream
-	RTSPStreams   []ffmpeg.Stream
 }
 
 type DeviceInformation struct {
@@ -47,16 +48,6 @@ type DeviceInformation struct {
 	HardwareID      string `xml:"Body>GetDeviceInformationResponse>HardwareID"`
 }
 
-type Stream struct {
-	Index         int    `json:"index"`
-	CodecType     string `json:"codec_type"`
-	CodecName     string `json:"codec_name"`
-	CodecLongName string `json:"codec_long_name"`
-	Width         int    `json:"width"`
-	Height        int    `json:"height"`
-	FrameRate     string `json:"avg_frame_rate"`
-}
-
 type GetStreamUriResponse struct {
 	MediaURI struct {
 		URI                 string `xml:"Uri"`
@@ -108,8 +99,36 @@ type Capabilities struct {
 		WSPausableSubscriptionManagerInterfaceSupport bool   `xml:"WSPausableSubscriptionManagerInterfaceSupport"`
 	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Events"`
 	Media struct {
-		Address string `xml:"XAddr"`
+		Address               string `xml:"XAddr"`
+		StreamingCapabilities struct {
+			RTPMulticast bool `xml:"RTPMulticast"`
+			RTPTCP       bool `xml:"RTP_TCP"`
+			RTPRTSPTCP   bool `xml:"RTP_RTSP_TCP"`
+		} `xml:"StreamingCapabilities"`
 	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Media"`
+	Imaging struct {
+		Address string `xml:"XAddr"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Imaging"`
+	DeviceIO struct {
+		Address      string `xml:"XAddr"`
+		RelayOutputs int    `xml:"RelayOutputs"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Extension>DeviceIO"`
+
+	// the Profile G services of devices which record to their own storage
+	Recording struct {
+		Address string `xml:"XAddr"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Extension>Recording"`
+	Search struct {
+		Address string `xml:"XAddr"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Extension>Search"`
+	Replay struct {
+		Address string `xml:"XAddr"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Extension>Replay"`
+
+	// the security features of the device service, such as whether the device can authenticate itself with 802.1X
+	Security struct {
+		Dot1X bool `xml:"Extension>Extension>Dot1X"`
+	} `xml:"Body>GetCapabilitiesResponse>Capabilities>Device>Security"`
 }
 
 type GetProfileResponse struct {
@@ -120,13 +139,21 @@ type Profile struct {
 	Token                    string `xml:"token,attr"`
 	Name                     string `xml:"Name"`
 	URI                      string
+	URIInvalidAfterConnect   bool
+	URIInvalidAfterReboot    bool
+	URITimeout               string
+	URIExpires               time.Time
+	Endpoint                 StreamEndpoint
 	VideoSourceConfiguration struct {
-		Bounds struct {
+		Token       string `xml:"token,attr"`
+		SourceToken string `xml:"SourceToken"`
+		Bounds      struct {
 			Width  int `xml:"width,attr"`
 			Height int `xml:"height,attr"`
 		} `xml:"Bounds"`
 	} `xml:"VideoSourceConfiguration"`
-	Streams []ffmpeg.Stream
+	VideoEncoderConfiguration *VideoEncoderConfiguration `xml:"VideoEncoderConfiguration"`
+	Streams                   []media.StreamInfo
 }
 
 type GetSystemDateAndTimeResponse struct {
@@ -156,8 +183,8 @@ func NewDevice(address string, username string, password string) *Device {
 const getStreamUriBody = `
 <trt:GetStreamUri xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
 	<trt:StreamSetup>
-		<tt:Stream>RTP-Unicast</tt:Stream>
-		<tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport>
+		<tt:Stream>{{stream}}</tt:Stream>
+		<tt:Transport><tt:Protocol>{{protocol}}</tt:Protocol></tt:Transport>
 	</trt:StreamSetup>
 	<trt:ProfileToken>{{token}}</trt:ProfileToken>
 </trt:GetStreamUri>`
@@ -173,20 +200,93 @@ func (d *Device) GetProfiles(log *slog.Logger) ([]Profile, error) {
 
 	// for each profile, populate the stream information
 	profiles := resp.Profiles
-	for i, profile := range profiles {
-		body := strings.ReplaceAll(getStreamUriBody, "{{token}}", profile.Token)
-		uri := &GetStreamUriResponse{}
-		_, err := d.makeRequest(log, d.Capabilities.Media.Address, body, uri)
-		if err != nil {
+	for i := range profiles {
+		if err := d.refreshStreamURI(log, &profiles[i]); err != nil {
 			return nil, err
 		}
-		profiles[i].URI = uri.MediaURI.URI
 	}
 
 	log.Debug("got profiles", slog.String("response", fmt.Sprintf("%+v", profiles)))
 	return profiles, nil
 }
 
+// requests a fresh stream URI for the passed in profile
+func (d *Device) refreshStreamURI(log *slog.Logger, profile *Profile) error {
+	transport := StreamTransport{Stream: StreamUnicast, Protocol: ProtocolRTSP}
+	body := strings.NewReplacer(
+		"{{token}}", xmlEscape(profile.Token),
+		"{{stream}}", transport.Stream,
+		"{{protocol}}", transport.Protocol,
+	).Replace(getStreamUriBody)
+	uri := &GetStreamUriResponse{}
+	_, err := d.makeRequest(log, d.Capabilities.Media.Address, body, uri)
+	if err != nil {
+		return err
+	}
+
+	profile.URI = uri.MediaURI.URI
+	profile.URIInvalidAfterConnect = uri.MediaURI.InvalidAfterConnect
+	profile.URIInvalidAfterReboot = uri.MediaURI.InvalidAfterReboot
+	profile.URITimeout = uri.MediaURI.Timeout
+	profile.URIExpires = time.Time{}
+	profile.Endpoint = StreamEndpoint{}
+
+	// consumers use the endpoint rather than parsing the URI themselves, but a URI we can't parse can still be handed
+	// to ffmpeg as is, so that isn't fatal
+	if endpoint, err := ParseStreamEndpoint(uri.MediaURI.URI, transport); err == nil {
+		profile.Endpoint = endpoint
+	} else {
+		log.Warn("unable to parse stream uri", slog.String("profile", profile.Token), slog.String("error", err.Error()))
+	}
+
+	// a timeout of zero means the URI never expires
+	if timeout, err := ParseDuration(uri.MediaURI.Timeout); err == nil && timeout > 0 {
+		profile.URIExpires = time.Now().Add(timeout)
+	}
+	return nil
+}
+
+// StreamURI returns a stream URI for the profile with the passed in token which is valid to connect to, requesting
+// a fresh one from the device if the current one has expired or can only be used for a single connection
+func (d *Device) StreamURI(log *slog.Logger, token string) (string, error) {
+	for i := range d.Profiles {
+		profile := &d.Profiles[i]
+		if profile.Token != token {
+			continue
+		}
+
+		if profile.URI == "" || profile.URIInvalidAfterConnect || profile.StreamURIExpired(time.Now()) {
+			if err := d.refreshStreamURI(log, profile); err != nil {
+				return "", fmt.Errorf("error refreshing stream uri for profile %q: %w", token, err)
+			}
+		}
+		return profile.URI, nil
+	}
+	return "", fmt.Errorf("no profile with token %q", token)
+}
+
+// InvalidateStreamURI forgets the stream URI for the profile with the passed in token, the next call to StreamURI
+// will request a new one. Callers should do this when connecting to a URI fails, since that is how a URI flagged
+// InvalidAfterReboot presents after the camera restarts.
+func (d *Device) InvalidateStreamURI(token string) {
+	for i := range d.Profiles {
+		if d.Profiles[i].Token == token {
+			d.Profiles[i].clearStreamURI()
+		}
+	}
+}
+
+// forgets our stream URI and everything derived from it
+func (p *Profile) clearStreamURI() {
+	p.URI = ""
+	p.Endpoint = StreamEndpoint{}
+}
+
+// StreamURIExpired returns whether the stream URI for this profile has passed its timeout
+func (p *Profile) StreamURIExpired(now time.Time) bool {
+	return !p.URIExpires.IsZero() && !now.Before(p.URIExpires)
+}
+
 func (d *Device) Probe(log *slog.Logger) (bool, error) {
 	capabilities, err := d.GetCapabilities(log)
 	if err != nil {
@@ -214,6 +314,13 @@ func (d *Device) Probe(log *slog.Logger) (bool, error) {
 	}
 	d.DeviceInformation = *info
 
+	// not every device supports this, but those that do give us an identity which survives address changes
+	if endpoint, err := d.GetEndpointReference(log); err == nil {
+		d.Endpoint = endpoint
+	} else {
+		log.Debug("unable to get endpoint reference", slog.String("address", d.Address), slog.String("error", err.Error()))
+	}
+
 	// then get our media profiles
 	profiles, err := d.GetProfiles(log)
 	if err != nil {
@@ -224,6 +331,25 @@ func (d *Device) Probe(log *slog.Logger) (bool, error) {
 	return true, nil
 }
 
+const getEndpointReferenceBody = `<tds:GetEndpointReference xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+
+type getEndpointReferenceResponse struct {
+	GUID string `xml:"Body>GetEndpointReferenceResponse>GUID"`
+}
+
+// GetEndpointReference returns the endpoint reference GUID of the device, the same one it answers discovery with
+func (d *Device) GetEndpointReference(log *slog.Logger) (string, error) {
+	resp := &getEndpointReferenceResponse{}
+	if _, err := d.makeRequest(log, d.Address, getEndpointReferenceBody, resp); err != nil {
+		return "", fmt.Errorf("failed to get endpoint reference: %w", err)
+	}
+	guid := strings.TrimSpace(resp.GUID)
+	if guid == "" {
+		return "", fmt.Errorf("empty endpoint reference")
+	}
+	return guid, nil
+}
+
 const getCapabilitiesBody = `
 <tds:GetCapabilities xmlns:tds="http://www.onvif.org/ver10/device/wsdl">
 	<tds:Category>All</tds:Category>
@@ -295,10 +421,22 @@ const authTemplate = `<s:Header>
 </wsse:Security>
 </s:Header>`
 
+// only bounds resolving the device host, how long requests take is bounded by our Timeouts
 var accessPolicy = httpx.NewAccessConfig(time.Second*5, []net.IP{}, []*net.IPNet{})
 var retryPolicy = httpx.NewFixedRetries(1*time.Second, 1*time.Second, 1*time.Second)
 
 func (d *Device) makeRequest(log *slog.Logger, url string, body string, resp interface{}) (*httpx.Trace, error) {
+	host, operation := hostOf(url), operationOf(body)
+	start := time.Now()
+	trace, err := d.doRequest(log, url, body, d.timeouts().For(operation), resp)
+	soapDuration.With(host, operation).Since(start)
+	if err != nil {
+		soapErrors.With(host, operation).Inc()
+	}
+	return trace, err
+}
+
+func (d *Device) doRequest(log *slog.Logger, url string, body string, timeout time.Duration, resp interface{}) (*httpx.Trace, error) {
 	buf := bytes.NewBuffer(nil)
 
 	header := ""
@@ -324,19 +462,24 @@ func (d *Device) makeRequest(log *slog.Logger, url string, body string, resp int
 		return nil, fmt.Errorf("failed to create request for url %q: %w", url, err)
 	}
 
-	trace, err := httpx.DoTrace(http.DefaultClient, req, retryPolicy, accessPolicy, 1024*1024)
+	// the client timeout applies to each attempt rather than across retries
+	client := &http.Client{Timeout: timeout, Transport: d.Transport}
+	trace, err := httpx.DoTrace(client, req, retryPolicy, accessPolicy, 1024*1024)
 	log.Debug("onvif request", slog.String("url", url), slog.String("trace", trace.String()))
 	if err != nil {
 		return trace, fmt.Errorf("failed to make request to URL %q: %w", url, err)
 	}
 
 	if trace.Response.StatusCode != http.StatusOK {
+		if fault := parseFault(trace.ResponseBody); fault != nil {
+			return trace, fmt.Errorf("non 200 status %d for %q: %w", trace.Response.StatusCode, url, fault)
+		}
 		return trace, fmt.Errorf("non 200 status %d for %q", trace.Response.StatusCode, url)
 	}
 
-	err = xml.Unmarshal(trace.ResponseBody, resp)
+	err = UnmarshalXML(trace.ResponseBody, resp)
 	if err != nil {
-		return trace, fmt.Errorf("failed to unmarshal response %q: %w", trace.ResponseBody[:128], err)
+		return trace, fmt.Errorf("failed to unmarshal response %q: %w", trace.ResponseBody[:min(len(trace.ResponseBody), 128)], err)
 	}
 
 	return trace, nil
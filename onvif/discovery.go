@@ -1,18 +1,24 @@
 package onvif
 
 import (
-	"encoding/xml"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/incrementventures/govr/network"
+	"github.com/sourcegraph/conc/pool"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // From https://www.onvif.org/wp-content/uploads/2021/01/ONVIF_Device_Feature_Discovery_Specification_20.12.pdf
@@ -64,9 +70,94 @@ type ProbeResponse struct {
 	} `xml:"Body>ProbeMatches>ProbeMatch"`
 }
 
-func GetONVIFVideoTransmitters(log *slog.Logger, ifaceName string) ([]string, error) {
+// DiscoveryConfig is where WS-Discovery probes are sent to and from, for networks with relays on non-standard groups
+// or ports, or ACLs which only let discovery through from a specific source port. Anything left unset is as the
+// WS-Discovery spec has it.
+type DiscoveryConfig struct {
+	// the IPv4 and IPv6 multicast groups probes are sent to, 239.255.255.250 and ff02::c by default
+	Group  string
+	Group6 string
+
+	// the port probes are sent to, 3702 by default
+	Port int
+
+	// the port probes are sent from and so replies come back to, any free port if zero
+	SourcePort int
+}
+
+// Validate returns an error if our groups aren't multicast addresses or our ports are out of range
+func (c DiscoveryConfig) Validate() error {
+	if _, err := c.group(false); err != nil {
+		return err
+	}
+	if _, err := c.group(true); err != nil {
+		return err
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid discovery port %d", c.Port)
+	}
+	if c.SourcePort < 0 || c.SourcePort > 65535 {
+		return fmt.Errorf("invalid discovery source port %d", c.SourcePort)
+	}
+	return nil
+}
+
+// returns the multicast group probes are sent to over IPv4, or IPv6 if v6 is set
+func (c DiscoveryConfig) group(v6 bool) (net.IP, error) {
+	group, fallback := c.Group, "239.255.255.250"
+	if v6 {
+		group, fallback = c.Group6, "ff02::c"
+	}
+	if group == "" {
+		group = fallback
+	}
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() || (ip.To4() == nil) != v6 {
+		return nil, fmt.Errorf("invalid discovery multicast group %q", group)
+	}
+	return ip, nil
+}
+
+// returns the port probes are sent to
+func (c DiscoveryConfig) port() int {
+	if c.Port == 0 {
+		return 3702
+	}
+	return c.Port
+}
+
+// returns the local address probes are sent from over IPv4, or IPv6 if v6 is set
+func (c DiscoveryConfig) source(v6 bool) string {
+	if v6 {
+		return net.JoinHostPort("::", strconv.Itoa(c.SourcePort))
+	}
+	return net.JoinHostPort("0.0.0.0", strconv.Itoa(c.SourcePort))
+}
+
+// DiscoveredDevice is an ONVIF video transmitter found via WS-Discovery along with the metadata parsed from its scopes
+type DiscoveredDevice struct {
+	Address  string
+	Endpoint string
+	Types    []string
+	Scopes   []string
+	Name     string
+	Hardware string
+	Location []string
+	Profiles []string
+	MAC      string
+	SourceIP string
+}
+
+// GetONVIFVideoTransmitters sends a WS-Discovery probe to the IPv4 multicast group on the passed in interface,
+// returning the video transmitters which answer
+func GetONVIFVideoTransmitters(log *slog.Logger, ifaceName string, cfg DiscoveryConfig) ([]DiscoveredDevice, error) {
 	log = log.With("iface", ifaceName)
 
+	group, err := cfg.group(false)
+	if err != nil {
+		return nil, err
+	}
+
 	// build our message
 	msgID := uuid.NewString()
 	msg := strings.ReplaceAll(probeTemplate, "{{UUID}}", msgID)
@@ -74,14 +165,13 @@ func GetONVIFVideoTransmitters(log *slog.Logger, ifaceName string) ([]string, er
 	log = log.With("msgID", msgID)
 
 	// start listening for responses before sending our probe
-	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	c, err := net.ListenPacket("udp4", cfg.source(false))
 	if err != nil {
 		return nil, fmt.Errorf("unable to starting discovery listen: %w", err)
 	}
 	defer c.Close()
 
-	group := net.IPv4(239, 255, 255, 250)
-	dest := &net.UDPAddr{IP: group, Port: 3702}
+	dest := &net.UDPAddr{IP: group, Port: cfg.port()}
 
 	p := ipv4.NewPacketConn(c)
 	iface, err := net.InterfaceByName(string(ifaceName))
@@ -106,29 +196,169 @@ func GetONVIFVideoTransmitters(log *slog.Logger, ifaceName string) ([]string, er
 		return nil, fmt.Errorf("unable to send discovery probe on interface %q: %w", ifaceName, err)
 	}
 
-	if err = p.SetReadDeadline(time.Now().Add(time.Second * 3)); err != nil {
+	return readProbeMatches(log, c, msgID, time.Second*3)
+}
+
+// GetONVIFVideoTransmitters6 is the IPv6 equivalent of GetONVIFVideoTransmitters, sending our probe to the link-local
+// WS-Discovery multicast group FF02::C on the passed in interface
+func GetONVIFVideoTransmitters6(log *slog.Logger, ifaceName string, cfg DiscoveryConfig) ([]DiscoveredDevice, error) {
+	log = log.With("iface", ifaceName)
+
+	group, err := cfg.group(true)
+	if err != nil {
+		return nil, err
+	}
+
+	msgID := uuid.NewString()
+	msg := strings.ReplaceAll(probeTemplate, "{{UUID}}", msgID)
+
+	log = log.With("msgID", msgID)
+
+	c, err := net.ListenPacket("udp6", cfg.source(true))
+	if err != nil {
+		return nil, fmt.Errorf("unable to starting discovery listen: %w", err)
+	}
+	defer c.Close()
+
+	dest := &net.UDPAddr{IP: group, Port: cfg.port(), Zone: ifaceName}
+
+	p := ipv6.NewPacketConn(c)
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %q: %w", ifaceName, err)
+	}
+
+	err = p.JoinGroup(iface, &net.UDPAddr{IP: group})
+	if err != nil {
+		return nil, fmt.Errorf("interface %q unable to join multicast group: %w", ifaceName, err)
+	}
+
+	err = p.SetMulticastInterface(iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q unable to set multicast interface: %w", ifaceName, err)
+	}
+
+	p.SetMulticastHopLimit(1)
+
+	_, err = p.WriteTo([]byte(msg), nil, dest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send discovery probe on interface %q: %w", ifaceName, err)
+	}
+
+	return readProbeMatches(log, c, msgID, time.Second*3)
+}
+
+// ProbeONVIFVideoTransmitters sends a WS-Discovery probe directly to each of the passed in IPs via unicast UDP rather
+// than multicast, this lets us find cameras on routed subnets or VLANs which multicast doesn't reach. Probes are paced
+// by the passed in limiter, which may be nil, and IPv6 targets are skipped with a warning if we can't listen over IPv6.
+func ProbeONVIFVideoTransmitters(log *slog.Logger, ips []string, cfg DiscoveryConfig, limiter *network.TokenBucket) ([]DiscoveredDevice, error) {
+	msgID := uuid.NewString()
+	msg := strings.ReplaceAll(probeTemplate, "{{UUID}}", msgID)
+
+	log = log.With("msgID", msgID)
+
+	// each address family is probed from a socket of its own
+	var ips4, ips6 []string
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe target %q: %w", ip, err)
+		}
+		if addr.Unmap().Is4() {
+			ips4 = append(ips4, ip)
+		} else {
+			ips6 = append(ips6, ip)
+		}
+	}
+
+	conns := []net.PacketConn{}
+	sent := 0
+	for _, family := range []struct {
+		network string
+		ips     []string
+		v6      bool
+	}{{"udp4", ips4, false}, {"udp6", ips6, true}} {
+		if len(family.ips) == 0 {
+			continue
+		}
+
+		c, err := net.ListenPacket(family.network, cfg.source(family.v6))
+		if err != nil && family.v6 {
+			log.Warn("unable to listen for ipv6 discovery, skipping ipv6 probe targets", slog.Int("count", len(family.ips)), slog.String("error", err.Error()))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to starting discovery listen: %w", err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+
+		for _, ip := range family.ips {
+			addr, err := net.ResolveUDPAddr(family.network, net.JoinHostPort(ip, strconv.Itoa(cfg.port())))
+			if err != nil {
+				return nil, fmt.Errorf("invalid probe target %q: %w", ip, err)
+			}
+
+			limiter.Wait(context.Background())
+			_, err = c.WriteTo([]byte(msg), addr)
+			if err != nil {
+				log.Debug("unable to send unicast discovery probe", slog.String("ip", ip), slog.String("error", err.Error()))
+				continue
+			}
+			sent++
+		}
+	}
+
+	log.Info("sent unicast discovery probes", slog.Int("count", sent))
+
+	p := pool.NewWithResults[[]DiscoveredDevice]().WithErrors()
+	for _, c := range conns {
+		p.Go(func() ([]DiscoveredDevice, error) {
+			return readProbeMatches(log, c, msgID, time.Second*3)
+		})
+	}
+	results, err := p.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	transmitters := []DiscoveredDevice{}
+	for _, result := range results {
+		transmitters = append(transmitters, result...)
+	}
+	return DedupeDevices(transmitters), nil
+}
+
+// reads probe matches from the passed in connection until the timeout elapses
+func readProbeMatches(log *slog.Logger, c net.PacketConn, msgID string, timeout time.Duration) ([]DiscoveredDevice, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, fmt.Errorf("unable to set read deadline: %w", err)
 	}
 
-	transmitters := []string{}
+	transmitters := []DiscoveredDevice{}
+	guard := network.NewResponseGuard(0, 0, 0)
 
 	b := make([]byte, 32768)
-	for {
-		n, _, src, err := p.ReadFrom(b)
+	for !guard.Exhausted() {
+		n, src, err := c.ReadFrom(b)
 
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				break
 			} else {
-				log.Error("error reading discovery response", err)
+				log.Error("error reading discovery response", slog.String("error", err.Error()))
 				return nil, fmt.Errorf("error reading discovery response: %w", err)
 			}
 		}
 
+		if !guard.Allow(ipFromAddr(src), b[:n]) {
+			continue
+		}
+
 		log.Debug("discovery response", slog.String("src", src.String()), slog.String("msg", string(b[:n])))
 
 		var resp ProbeResponse
-		err = xml.Unmarshal(b[:n], &resp)
+		err = UnmarshalXML(b[:n], &resp)
 		if err != nil {
 			log.Warn("error unmarshalling discovery response, skipping", slog.String("msg", string(b[:n])), slog.String("error", err.Error()))
 			continue
@@ -140,39 +370,175 @@ func GetONVIFVideoTransmitters(log *slog.Logger, ifaceName string) ([]string, er
 			continue
 		}
 
-		// run through our matches looking for one that streams
-		for _, match := range resp.Matches {
-			if strings.Contains(match.Types, "NetworkVideoTransmitter") {
-				// replace the IP with the source IP (some cameras return the wrong one)
-				endpoint, err := url.Parse(match.XAddrs)
-				if err != nil {
-					log.Warn("error parsing xaddrs, skipping",
-						slog.String("xaddrs", match.XAddrs),
-						slog.String("error", err.Error()))
-					continue
-				}
+		transmitters = append(transmitters, resp.Transmitters(log, ipFromAddr(src))...)
+	}
+
+	if guard.Dropped() > 0 {
+		log.Warn("dropped excess or duplicate discovery responses", slog.Int("dropped", guard.Dropped()))
+	}
+	return DedupeDevices(transmitters), nil
+}
 
-				// default to port 80 if not specified
-				port := endpoint.Port()
-				if port == "" {
-					port = "80"
-				}
+// Transmitters returns the network video transmitters among our matches, with their addresses pointed at the passed
+// in source IP as some cameras report the wrong one, or left as reported if it is empty. Matches answering an IPv6
+// probe with an IPv4 address keep it, as that is the one we can reach without knowing the interface.
+func (r *ProbeResponse) Transmitters(log *slog.Logger, srcIP string) []DiscoveredDevice {
+	transmitters := []DiscoveredDevice{}
+	for _, match := range r.Matches {
+		if !strings.Contains(match.Types, "NetworkVideoTransmitter") {
+			continue
+		}
 
-				endpoint.Host = fmt.Sprintf("%s:%s", ipFromAddr(src), port)
+		endpoint, err := chooseXAddr(match.XAddrs, srcIP)
+		if err != nil {
+			log.Warn("error parsing xaddrs, skipping",
+				slog.String("xaddrs", match.XAddrs),
+				slog.String("error", err.Error()))
+			continue
+		}
 
-				log.Info("discovered onvif video transmitter",
-					slog.String("endpoint", endpoint.String()),
-					slog.String("scopes", match.Scopes))
+		// default to port 80 if not specified
+		port := endpoint.Port()
+		if port == "" {
+			port = "80"
+		}
 
-				transmitters = append(transmitters, endpoint.String())
-			}
+		// replace the IP with the source IP (some cameras return the wrong one)
+		host := endpoint.Hostname()
+		if srcIP != "" && !(isIPv4(host) && !isIPv4(srcIP)) {
+			host = srcIP
 		}
+		endpoint.Host = net.JoinHostPort(host, port)
+
+		device := DiscoveredDevice{
+			Address:  endpoint.String(),
+			Endpoint: match.EndpointReference,
+			Types:    strings.Fields(match.Types),
+			SourceIP: srcIP,
+		}
+		device.parseScopes(match.Scopes)
+
+		log.Info("discovered onvif video transmitter",
+			slog.String("endpoint", endpoint.String()),
+			slog.String("name", device.Name),
+			slog.String("hardware", device.Hardware),
+			slog.String("scopes", match.Scopes))
+
+		transmitters = append(transmitters, device)
 	}
+	return transmitters
+}
 
-	return transmitters, nil
+// returns the device service address to use out of the space separated ones of a probe match, cameras listing one for
+// each of their addresses. The one the match came from is preferred, then IPv4 addresses, then host names, then IPv6
+// addresses which aren't link-local and so can be reached without a zone.
+func chooseXAddr(xaddrs string, srcIP string) (*url.URL, error) {
+	var best *url.URL
+	bestRank := -1
+	for _, xaddr := range strings.Fields(xaddrs) {
+		u, err := url.Parse(xaddr)
+		if err != nil || u.Host == "" {
+			continue
+		}
+
+		ip, rank := net.ParseIP(u.Hostname()), 0
+		switch {
+		case srcIP != "" && u.Hostname() == srcIP:
+			rank = 4
+		case ip == nil:
+			rank = 2
+		case ip.IsLoopback() || ip.IsLinkLocalUnicast():
+			rank = 0
+		case ip.To4() != nil:
+			rank = 3
+		default:
+			rank = 1
+		}
+		if rank > bestRank {
+			best, bestRank = u, rank
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid address in %q", xaddrs)
+	}
+	return best, nil
+}
+
+// returns whether the passed in host is an IPv4 address
+func isIPv4(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
+
+// DedupeDevices returns the passed in devices with those which answered more than once, such as to both our IPv4 and
+// IPv6 probes, appearing only once. Devices are told apart by their endpoint reference, which stays the same whichever
+// address they answer from, and those answering from more than one keep their IPv4 address.
+func DedupeDevices(devices []DiscoveredDevice) []DiscoveredDevice {
+	deduped := []DiscoveredDevice{}
+	found := map[string]int{}
+	for _, device := range devices {
+		key := cmp.Or(device.Endpoint, device.Address)
+		i, ok := found[key]
+		if !ok {
+			found[key] = len(deduped)
+			deduped = append(deduped, device)
+			continue
+		}
+		if !deduped[i].isIPv4() && device.isIPv4() {
+			deduped[i] = device
+		}
+	}
+	return deduped
+}
+
+// returns whether the device service address of the device is an IPv4 one
+func (d DiscoveredDevice) isIPv4() bool {
+	u, err := url.Parse(d.Address)
+	return err == nil && isIPv4(u.Hostname())
 }
 
 func ipFromAddr(addr net.Addr) string {
-	parts := strings.Split(addr.String(), ":")
-	return parts[0]
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ip := udp.IP.String()
+		if udp.Zone != "" {
+			ip += "%" + udp.Zone
+		}
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// parses the space separated scopes of a probe match, scopes look like onvif://www.onvif.org/name/Amcrest
+func (d *DiscoveredDevice) parseScopes(scopes string) {
+	for _, scope := range strings.Fields(scopes) {
+		d.Scopes = append(d.Scopes, scope)
+
+		u, err := url.Parse(scope)
+		if err != nil || u.Scheme != "onvif" {
+			continue
+		}
+
+		category, value, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+
+		switch strings.ToLower(category) {
+		case "name":
+			d.Name = value
+		case "hardware":
+			d.Hardware = value
+		case "location":
+			d.Location = append(d.Location, value)
+		case "profile":
+			d.Profiles = append(d.Profiles, value)
+		case "mac", "macaddress":
+			d.MAC = strings.ToLower(value)
+		}
+	}
 }
@@ -0,0 +1,232 @@
+package onvif
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/incrementventures/govr/network"
+)
+
+// returns a probe response with a single match with the passed in types and xaddrs
+func probeMatch(endpoint string, types string, xaddrs string) ProbeResponse {
+	var resp ProbeResponse
+	resp.Matches = append(resp.Matches, struct {
+		EndpointReference string `xml:"EndpointReference>Address"`
+		Types             string `xml:"Types"`
+		Scopes            string `xml:"Scopes"`
+		XAddrs            string `xml:"XAddrs"`
+	}{
+		EndpointReference: endpoint,
+		Types:             types,
+		Scopes:            "onvif://www.onvif.org/name/Amcrest onvif://www.onvif.org/hardware/IP5M-T1179E onvif://www.onvif.org/location/country/china",
+		XAddrs:            xaddrs,
+	})
+	return resp
+}
+
+func TestTransmitters(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const nvt = "dn:NetworkVideoTransmitter tds:Device"
+
+	tcs := []struct {
+		name      string
+		resp      ProbeResponse
+		srcIP     string
+		addresses []string
+	}{
+		{
+			name:      "single xaddr",
+			resp:      probeMatch("uuid:1", nvt, "http://192.168.10.108/onvif/device_service"),
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service"},
+		},
+		{
+			name:      "replaced by source ip",
+			resp:      probeMatch("uuid:1", nvt, "http://10.0.0.5:8000/onvif/device_service"),
+			srcIP:     "192.168.10.108",
+			addresses: []string{"http://192.168.10.108:8000/onvif/device_service"},
+		},
+		{
+			name:      "prefers ipv4",
+			resp:      probeMatch("uuid:1", nvt, "http://[fe80::1]/onvif/device_service http://[fd00::108]/onvif/device_service http://192.168.10.108/onvif/device_service"),
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service"},
+		},
+		{
+			name:      "prefers the source",
+			resp:      probeMatch("uuid:1", nvt, "http://192.168.10.108/onvif/device_service https://192.168.20.108:443/onvif/device_service"),
+			srcIP:     "192.168.20.108",
+			addresses: []string{"https://192.168.20.108:443/onvif/device_service"},
+		},
+		{
+			name:      "ipv6 source keeps ipv4 xaddr",
+			resp:      probeMatch("uuid:1", nvt, "http://[fe80::1]/onvif/device_service http://192.168.10.108/onvif/device_service"),
+			srcIP:     "fe80::1%eth0",
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service"},
+		},
+		{
+			name:      "prefers host names to link-local",
+			resp:      probeMatch("uuid:1", nvt, "http://[fe80::1]/onvif/device_service http://camera.local/onvif/device_service"),
+			addresses: []string{"http://camera.local:80/onvif/device_service"},
+		},
+		{
+			name:      "skips invalid xaddrs",
+			resp:      probeMatch("uuid:1", nvt, "://bad http://192.168.10.108/onvif/device_service"),
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service"},
+		},
+		{
+			name:      "no valid xaddrs",
+			resp:      probeMatch("uuid:1", nvt, "://bad /onvif/device_service"),
+			addresses: []string{},
+		},
+		{
+			name:      "not a transmitter",
+			resp:      probeMatch("uuid:1", "dn:NetworkVideoDisplay", "http://192.168.10.108/onvif/device_service"),
+			addresses: []string{},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			addresses := []string{}
+			for _, device := range tc.resp.Transmitters(log, tc.srcIP) {
+				addresses = append(addresses, device.Address)
+			}
+			if !slices.Equal(addresses, tc.addresses) {
+				t.Errorf("expected %v, got %v", tc.addresses, addresses)
+			}
+		})
+	}
+}
+
+func TestTransmittersScopes(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	resp := probeMatch("uuid:b1fc8184", "dn:NetworkVideoTransmitter", "http://192.168.10.108/onvif/device_service")
+	devices := resp.Transmitters(log, "")
+	if len(devices) != 1 {
+		t.Fatalf("expected a device, got %d", len(devices))
+	}
+	d := devices[0]
+	if d.Endpoint != "uuid:b1fc8184" || d.Name != "Amcrest" || d.Hardware != "IP5M-T1179E" || !slices.Equal(d.Location, []string{"country/china"}) {
+		t.Errorf("unexpected device %+v", d)
+	}
+}
+
+func TestDedupeDevices(t *testing.T) {
+	tcs := []struct {
+		name      string
+		devices   []DiscoveredDevice
+		addresses []string
+	}{
+		{
+			name: "ipv6 then ipv4",
+			devices: []DiscoveredDevice{
+				{Endpoint: "uuid:1", Address: "http://[fd00::108]:80/onvif/device_service"},
+				{Endpoint: "uuid:1", Address: "http://192.168.10.108:80/onvif/device_service"},
+			},
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service"},
+		},
+		{
+			name: "ipv4 then ipv6",
+			devices: []DiscoveredDevice{
+				{Endpoint: "uuid:1", Address: "http://192.168.10.108:80/onvif/device_service"},
+				{Endpoint: "uuid:2", Address: "http://192.168.10.109:80/onvif/device_service"},
+				{Endpoint: "uuid:1", Address: "http://[fd00::108]:80/onvif/device_service"},
+			},
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service", "http://192.168.10.109:80/onvif/device_service"},
+		},
+		{
+			name: "without endpoints",
+			devices: []DiscoveredDevice{
+				{Address: "http://192.168.10.108:80/onvif/device_service"},
+				{Address: "http://192.168.10.109:80/onvif/device_service"},
+				{Address: "http://192.168.10.108:80/onvif/device_service"},
+			},
+			addresses: []string{"http://192.168.10.108:80/onvif/device_service", "http://192.168.10.109:80/onvif/device_service"},
+		},
+		{
+			name:      "none",
+			addresses: []string{},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			addresses := []string{}
+			for _, device := range DedupeDevices(tc.devices) {
+				addresses = append(addresses, device.Address)
+			}
+			if !slices.Equal(addresses, tc.addresses) {
+				t.Errorf("expected %v, got %v", tc.addresses, addresses)
+			}
+		})
+	}
+}
+
+// answers each probe sent to the passed in connection with a match for a device with the passed in endpoint reference
+func answerProbes(t *testing.T, c net.PacketConn, endpoint string) {
+	b := make([]byte, 4096)
+	for {
+		n, src, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		msgID := regexp.MustCompile(`<a:MessageID>([^<]+)<`).FindSubmatch(b[:n])
+		if msgID == nil {
+			t.Errorf("probe without message id: %s", b[:n])
+			return
+		}
+		resp := fmt.Sprintf(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+<s:Header><a:RelatesTo>%s</a:RelatesTo></s:Header>
+<s:Body><d:ProbeMatches><d:ProbeMatch>
+<a:EndpointReference><a:Address>%s</a:Address></a:EndpointReference>
+<d:Types>dn:NetworkVideoTransmitter</d:Types>
+<d:XAddrs>http://%s/onvif/device_service</d:XAddrs>
+</d:ProbeMatch></d:ProbeMatches></s:Body></s:Envelope>`, msgID[1], endpoint, net.JoinHostPort(ipFromAddr(src), "80"))
+		c.WriteTo([]byte(resp), src)
+	}
+}
+
+func TestProbeONVIFVideoTransmitters(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	c4, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c4.Close()
+	port := c4.LocalAddr().(*net.UDPAddr).Port
+	go answerProbes(t, c4, "uuid:camera4")
+
+	targets, expected := []string{"127.0.0.1"}, []string{"http://127.0.0.1:80/onvif/device_service"}
+	if c6, err := net.ListenPacket("udp6", net.JoinHostPort("::1", strconv.Itoa(port))); err == nil {
+		defer c6.Close()
+		go answerProbes(t, c6, "uuid:camera6")
+		targets, expected = append(targets, "::1"), append(expected, "http://[::1]:80/onvif/device_service")
+	} else {
+		t.Logf("unable to listen on ipv6 loopback, only probing ipv4: %v", err)
+	}
+
+	devices, err := ProbeONVIFVideoTransmitters(log, targets, DiscoveryConfig{Port: port}, network.NewTokenBucket(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := []string{}
+	for _, device := range devices {
+		addresses = append(addresses, device.Address)
+	}
+	slices.Sort(addresses)
+	slices.Sort(expected)
+	if !slices.Equal(addresses, expected) {
+		t.Errorf("expected %v, got %v", expected, addresses)
+	}
+
+	if _, err := ProbeONVIFVideoTransmitters(log, []string{"camera.local"}, DiscoveryConfig{Port: port}, nil); err == nil {
+		t.Error("expected error probing a host name")
+	}
+}
@@ -0,0 +1,265 @@
+package onvif
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ErrNoDot1X is returned when asked to configure 802.1X on a device which doesn't support it
+var ErrNoDot1X = errors.New("device doesn't support 802.1X")
+
+// ErrNoCertificates is returned when asked to manage the certificates of a device which doesn't let us
+var ErrNoCertificates = errors.New("device doesn't support certificate management")
+
+// EAP methods a device can authenticate with, numbered as assigned by IANA which is how ONVIF refers to them
+const (
+	EAPMethodMD5  = 4
+	EAPMethodTLS  = 13
+	EAPMethodTTLS = 21
+	EAPMethodPEAP = 25
+)
+
+var eapMethodNames = map[int]string{EAPMethodMD5: "md5", EAPMethodTLS: "tls", EAPMethodTTLS: "ttls", EAPMethodPEAP: "peap"}
+
+// EAPMethodName returns the name of the passed in EAP method, such as tls, or its number if it isn't one we know
+func EAPMethodName(method int) string {
+	if name, found := eapMethodNames[method]; found {
+		return name
+	}
+	return fmt.Sprint(method)
+}
+
+// ParseEAPMethod returns the EAP method with the passed in name, such as tls, or number
+func ParseEAPMethod(name string) (int, error) {
+	for method, n := range eapMethodNames {
+		if strings.EqualFold(name, n) {
+			return method, nil
+		}
+	}
+	var method int
+	if _, err := fmt.Sscan(name, &method); err != nil || method <= 0 {
+		return 0, fmt.Errorf("unknown eap method %q", name)
+	}
+	return method, nil
+}
+
+// Dot1XConfiguration is how a device authenticates itself to the network with 802.1X, passwords are never read back
+type Dot1XConfiguration struct {
+	Token       string `xml:"Dot1XConfigurationToken" json:"token"`
+	Identity    string `xml:"Identity" json:"identity"`
+	AnonymousID string `xml:"AnonymousID" json:"anonymous_id,omitempty"`
+	EAPMethod   int    `xml:"EAPMethod" json:"eap_method"`
+
+	// the CA certificates the device trusts to authenticate the network, and the certificate it authenticates
+	// itself with for EAP-TLS, by their IDs on the device
+	CACertificateIDs []string `xml:"CACertificateID" json:"ca_certificates,omitempty"`
+	CertificateID    string   `xml:"EAPMethodConfiguration>TLSConfiguration>CertificateID" json:"certificate,omitempty"`
+}
+
+type getDot1XConfigurationsResponse struct {
+	Configurations []Dot1XConfiguration `xml:"Body>GetDot1XConfigurationsResponse>Dot1XConfiguration"`
+}
+
+const getDot1XConfigurationsBody = `<tds:GetDot1XConfigurations xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+
+// GetDot1XConfigurations returns the 802.1X configurations of the device, ErrNoDot1X if it doesn't support 802.1X
+func (d *Device) GetDot1XConfigurations(log *slog.Logger) ([]Dot1XConfiguration, error) {
+	if !d.Capabilities.Security.Dot1X {
+		return nil, ErrNoDot1X
+	}
+	resp := &getDot1XConfigurationsResponse{}
+	if _, err := d.makeRequest(log, d.Address, getDot1XConfigurationsBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get 802.1x configurations: %w", notSupported(err, ErrNoDot1X))
+	}
+	return resp.Configurations, nil
+}
+
+const setDot1XConfigurationBody = `
+<tds:{{operation}} xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:Dot1XConfiguration>
+		<tt:Dot1XConfigurationToken>{{token}}</tt:Dot1XConfigurationToken>
+		<tt:Identity>{{identity}}</tt:Identity>{{anonymous}}{{cas}}
+		<tt:EAPMethod>{{method}}</tt:EAPMethod>
+		<tt:EAPMethodConfiguration>{{certificate}}{{password}}</tt:EAPMethodConfiguration>
+	</tds:Dot1XConfiguration>
+</tds:{{operation}}>`
+
+// SetDot1XConfiguration creates or replaces the 802.1X configuration with the token of the passed in one, along with
+// the password of methods which use one
+func (d *Device) SetDot1XConfiguration(log *slog.Logger, c Dot1XConfiguration, password string, create bool) error {
+	if !d.Capabilities.Security.Dot1X {
+		return ErrNoDot1X
+	}
+
+	operation := "SetDot1XConfiguration"
+	if create {
+		operation = "CreateDot1XConfiguration"
+	}
+	optional := func(format string, value string) string {
+		if value == "" {
+			return ""
+		}
+		return fmt.Sprintf(format, xmlEscape(value))
+	}
+	cas := &strings.Builder{}
+	for _, id := range c.CACertificateIDs {
+		fmt.Fprintf(cas, "<tt:CACertificateID>%s</tt:CACertificateID>", xmlEscape(id))
+	}
+
+	body := strings.NewReplacer(
+		"{{operation}}", operation,
+		"{{token}}", xmlEscape(c.Token),
+		"{{identity}}", xmlEscape(c.Identity),
+		"{{anonymous}}", optional("<tt:AnonymousID>%s</tt:AnonymousID>", c.AnonymousID),
+		"{{cas}}", cas.String(),
+		"{{method}}", fmt.Sprint(c.EAPMethod),
+		"{{certificate}}", optional("<tt:TLSConfiguration><tt:CertificateID>%s</tt:CertificateID></tt:TLSConfiguration>", c.CertificateID),
+		"{{password}}", optional("<tt:Password>%s</tt:Password>", password),
+	).Replace(setDot1XConfigurationBody)
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set 802.1x configuration %q: %w", c.Token, notSupported(err, ErrNoDot1X))
+	}
+	return nil
+}
+
+// NetworkInterface is a network interface of a device, along with the 802.1X configuration it uses if any
+type NetworkInterface struct {
+	Token   string `xml:"token,attr" json:"token"`
+	Enabled bool   `xml:"Enabled" json:"enabled"`
+	Name    string `xml:"Info>Name" json:"name,omitempty"`
+	MAC     string `xml:"Info>HwAddress" json:"mac,omitempty"`
+	Dot1X   string `xml:"Extension>Dot1X" json:"dot1x,omitempty"`
+}
+
+type getNetworkInterfacesResponse struct {
+	Interfaces []NetworkInterface `xml:"Body>GetNetworkInterfacesResponse>NetworkInterfaces"`
+}
+
+const getNetworkInterfacesBody = `<tds:GetNetworkInterfaces xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+
+// GetNetworkInterfaces returns the network interfaces of the device
+func (d *Device) GetNetworkInterfaces(log *slog.Logger) ([]NetworkInterface, error) {
+	resp := &getNetworkInterfacesResponse{}
+	if _, err := d.makeRequest(log, d.Address, getNetworkInterfacesBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get network interfaces: %w", err)
+	}
+	return resp.Interfaces, nil
+}
+
+const setNetworkInterfaceDot1XBody = `
+<tds:SetNetworkInterfaces xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:InterfaceToken>{{interface}}</tds:InterfaceToken>
+	<tds:NetworkInterface>
+		<tt:Extension><tt:Dot1X>{{token}}</tt:Dot1X></tt:Extension>
+	</tds:NetworkInterface>
+</tds:SetNetworkInterfaces>`
+
+type setNetworkInterfacesResponse struct {
+	RebootNeeded bool `xml:"Body>SetNetworkInterfacesResponse>RebootNeeded"`
+}
+
+// SetNetworkInterfaceDot1X has the network interface with the passed in token authenticate with the 802.1X
+// configuration with the passed in token, returning whether the device must be rebooted for it to take effect. Once
+// it does the device is only reachable if its switch port accepts it.
+func (d *Device) SetNetworkInterfaceDot1X(log *slog.Logger, interfaceToken string, token string) (bool, error) {
+	if !d.Capabilities.Security.Dot1X {
+		return false, ErrNoDot1X
+	}
+	body := strings.NewReplacer("{{interface}}", xmlEscape(interfaceToken), "{{token}}", xmlEscape(token)).Replace(setNetworkInterfaceDot1XBody)
+	resp := &setNetworkInterfacesResponse{}
+	if _, err := d.makeRequest(log, d.Address, body, resp); err != nil {
+		return false, fmt.Errorf("failed to set 802.1x configuration of interface %q: %w", interfaceToken, notSupported(err, ErrNoDot1X))
+	}
+	return resp.RebootNeeded, nil
+}
+
+// Certificate is an X.509 certificate held by a device, DER encoded
+type Certificate struct {
+	ID   string `xml:"CertificateID" json:"id"`
+	Data []byte `xml:"Certificate>Data" json:"-"`
+}
+
+type getCertificatesResponse struct {
+	Certificates []Certificate `xml:"Body>GetCertificatesResponse>NvtCertificate"`
+}
+
+type getCACertificatesResponse struct {
+	Certificates []Certificate `xml:"Body>GetCACertificatesResponse>CACertificate"`
+}
+
+const (
+	getCertificatesBody   = `<tds:GetCertificates xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+	getCACertificatesBody = `<tds:GetCACertificates xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+)
+
+// GetCertificates returns the certificates the device can identify itself with, ErrNoCertificates if it doesn't
+// let us manage them
+func (d *Device) GetCertificates(log *slog.Logger) ([]Certificate, error) {
+	resp := &getCertificatesResponse{}
+	if _, err := d.makeRequest(log, d.Address, getCertificatesBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get certificates: %w", notSupported(err, ErrNoCertificates))
+	}
+	return resp.Certificates, nil
+}
+
+// GetCACertificates returns the CA certificates the device trusts, ErrNoCertificates if it doesn't let us manage them
+func (d *Device) GetCACertificates(log *slog.Logger) ([]Certificate, error) {
+	resp := &getCACertificatesResponse{}
+	if _, err := d.makeRequest(log, d.Address, getCACertificatesBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get ca certificates: %w", notSupported(err, ErrNoCertificates))
+	}
+	return resp.Certificates, nil
+}
+
+const loadCACertificatesBody = `
+<tds:LoadCACertificates xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:CACertificate>
+		<tt:CertificateID>{{id}}</tt:CertificateID>
+		<tt:Certificate><tt:Data>{{data}}</tt:Data></tt:Certificate>
+	</tds:CACertificate>
+</tds:LoadCACertificates>`
+
+// LoadCACertificate uploads the passed in DER encoded CA certificate to the device, under the passed in ID
+func (d *Device) LoadCACertificate(log *slog.Logger, id string, der []byte) error {
+	body := strings.NewReplacer("{{id}}", xmlEscape(id), "{{data}}", base64.StdEncoding.EncodeToString(der)).Replace(loadCACertificatesBody)
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to load ca certificate %q: %w", id, notSupported(err, ErrNoCertificates))
+	}
+	return nil
+}
+
+const loadCertificateWithPrivateKeyBody = `
+<tds:LoadCertificateWithPrivateKey xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:CertificateWithPrivateKey>
+		<tt:CertificateID>{{id}}</tt:CertificateID>
+		<tt:Certificate><tt:Data>{{data}}</tt:Data></tt:Certificate>
+		<tt:PrivateKey><tt:Data>{{key}}</tt:Data></tt:PrivateKey>
+	</tds:CertificateWithPrivateKey>
+</tds:LoadCertificateWithPrivateKey>`
+
+// LoadCertificateWithPrivateKey uploads the passed in DER encoded certificate and private key to the device, under the
+// passed in ID, for it to identify itself with such as with EAP-TLS
+func (d *Device) LoadCertificateWithPrivateKey(log *slog.Logger, id string, der []byte, key []byte) error {
+	body := strings.NewReplacer(
+		"{{id}}", xmlEscape(id),
+		"{{data}}", base64.StdEncoding.EncodeToString(der),
+		"{{key}}", base64.StdEncoding.EncodeToString(key),
+	).Replace(loadCertificateWithPrivateKeyBody)
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to load certificate %q: %w", id, notSupported(err, ErrNoCertificates))
+	}
+	return nil
+}
+
+// returns the passed in error from a request as the passed in sentinel if the device faulted as it doesn't implement
+// the operation, so callers can tell that apart from a failure
+func notSupported(err error, sentinel error) error {
+	var fault *Fault
+	if errors.As(err, &fault) && strings.HasSuffix(fault.Subcode, "ActionNotSupported") {
+		return fmt.Errorf("%w: %w", sentinel, err)
+	}
+	return err
+}
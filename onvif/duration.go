@@ -0,0 +1,45 @@
+package onvif
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var durationRegex = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ParseDuration parses an xs:duration such as PT60S or P1DT2H as used by ONVIF, years and months are approximated
+// as 365 and 30 days respectively
+func ParseDuration(s string) (time.Duration, error) {
+	m := durationRegex.FindStringSubmatch(s)
+	if m == nil || s == "P" || s[len(s)-1] == 'T' {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+
+	units := []time.Duration{0, 365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+
+	var d time.Duration
+	for i := 2; i <= 6; i++ {
+		if m[i] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		d += time.Duration(n) * units[i-1]
+	}
+	if m[7] != "" {
+		secs, err := strconv.ParseFloat(m[7], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		d += time.Duration(secs * float64(time.Second))
+	}
+
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,286 @@
+package onvif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// ErrEncoderLimit is returned when an operation would use more video encoders than the camera guarantees it can
+// run at once, which cameras otherwise handle by silently degrading or dropping another stream
+var ErrEncoderLimit = errors.New("not enough video encoder instances")
+
+type VideoEncoderConfiguration struct {
+	Token      string `xml:"token,attr"`
+	Name       string `xml:"Name"`
+	UseCount   int    `xml:"UseCount"`
+	Encoding   string `xml:"Encoding"`
+	Resolution struct {
+		Width  int `xml:"Width"`
+		Height int `xml:"Height"`
+	} `xml:"Resolution"`
+	Quality     float64 `xml:"Quality"`
+	RateControl struct {
+		FrameRateLimit   int `xml:"FrameRateLimit"`
+		EncodingInterval int `xml:"EncodingInterval"`
+		BitrateLimit     int `xml:"BitrateLimit"`
+	} `xml:"RateControl"`
+	H264 struct {
+		GovLength   int    `xml:"GovLength"`
+		H264Profile string `xml:"H264Profile"`
+	} `xml:"H264"`
+	Multicast struct {
+		Address struct {
+			Type        string `xml:"Type"`
+			IPv4Address string `xml:"IPv4Address"`
+		} `xml:"Address"`
+		Port      int  `xml:"Port"`
+		TTL       int  `xml:"TTL"`
+		AutoStart bool `xml:"AutoStart"`
+	} `xml:"Multicast"`
+	SessionTimeout string `xml:"SessionTimeout"`
+}
+
+// EncoderInstances is the number of video encoders a camera guarantees it can run at once for a video source, in
+// total and per encoding, a per encoding limit of zero means only the total applies
+type EncoderInstances struct {
+	Total int `xml:"Body>GetGuaranteedNumberOfVideoEncoderInstancesResponse>TotalNumber"`
+	JPEG  int `xml:"Body>GetGuaranteedNumberOfVideoEncoderInstancesResponse>JPEG"`
+	H264  int `xml:"Body>GetGuaranteedNumberOfVideoEncoderInstancesResponse>H264"`
+	MPEG4 int `xml:"Body>GetGuaranteedNumberOfVideoEncoderInstancesResponse>MPEG4"`
+}
+
+// returns the limit for the passed in encoding, zero if there isn't one
+func (e *EncoderInstances) limitFor(encoding string) int {
+	switch strings.ToUpper(encoding) {
+	case "JPEG":
+		return e.JPEG
+	case "H264":
+		return e.H264
+	case "MPEG4":
+		return e.MPEG4
+	}
+	return 0
+}
+
+const getGuaranteedEncodersBody = `
+<trt:GetGuaranteedNumberOfVideoEncoderInstances xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ConfigurationToken>{{token}}</trt:ConfigurationToken>
+</trt:GetGuaranteedNumberOfVideoEncoderInstances>`
+
+// GetGuaranteedNumberOfVideoEncoderInstances returns how many encoders the camera can run at once for the video
+// source configuration with the passed in token
+func (d *Device) GetGuaranteedNumberOfVideoEncoderInstances(log *slog.Logger, sourceToken string) (*EncoderInstances, error) {
+	body := strings.ReplaceAll(getGuaranteedEncodersBody, "{{token}}", xmlEscape(sourceToken))
+	instances := &EncoderInstances{}
+	_, err := d.makeRequest(log, d.Capabilities.Media.Address, body, instances)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guaranteed encoder instances: %w", err)
+	}
+
+	log.Debug("got guaranteed encoder instances", slog.String("source", sourceToken), slog.String("response", fmt.Sprintf("%+v", instances)))
+	return instances, nil
+}
+
+// CheckEncoderInstances returns an ErrEncoderLimit error if running the passed in encoder on the video source would
+// exceed the passed in limits given the encoders our profiles already use. Profiles sharing an encoder configuration
+// share a single instance. The profile with the passed in token, if any, is not counted as its encoder is the one
+// being replaced.
+func (d *Device) CheckEncoderInstances(limits *EncoderInstances, sourceToken string, replacing string, encoder *VideoEncoderConfiguration) error {
+	encodings := map[string]string{encoder.Token: encoder.Encoding}
+	for _, p := range d.Profiles {
+		if p.Token == replacing || p.VideoSourceConfiguration.Token != sourceToken || p.VideoEncoderConfiguration == nil {
+			continue
+		}
+		if _, seen := encodings[p.VideoEncoderConfiguration.Token]; !seen {
+			encodings[p.VideoEncoderConfiguration.Token] = p.VideoEncoderConfiguration.Encoding
+		}
+	}
+
+	matching := 0
+	for _, encoding := range encodings {
+		if strings.EqualFold(encoding, encoder.Encoding) {
+			matching++
+		}
+	}
+
+	if limits.Total > 0 && len(encodings) > limits.Total {
+		return fmt.Errorf("%w: video source %q guarantees %d encoders and %d would be in use", ErrEncoderLimit, sourceToken, limits.Total, len(encodings))
+	}
+	if limit := limits.limitFor(encoder.Encoding); limit > 0 && matching > limit {
+		return fmt.Errorf("%w: video source %q guarantees %d %s encoders and %d would be in use", ErrEncoderLimit, sourceToken, limit, encoder.Encoding, matching)
+	}
+	return nil
+}
+
+const createProfileBody = `
+<trt:CreateProfile xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:Name>{{name}}</trt:Name>
+</trt:CreateProfile>`
+
+const addVideoSourceConfigurationBody = `
+<trt:AddVideoSourceConfiguration xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ProfileToken>{{profile}}</trt:ProfileToken>
+	<trt:ConfigurationToken>{{token}}</trt:ConfigurationToken>
+</trt:AddVideoSourceConfiguration>`
+
+const addVideoEncoderConfigurationBody = `
+<trt:AddVideoEncoderConfiguration xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ProfileToken>{{profile}}</trt:ProfileToken>
+	<trt:ConfigurationToken>{{token}}</trt:ConfigurationToken>
+</trt:AddVideoEncoderConfiguration>`
+
+type createProfileResponse struct {
+	Profile Profile `xml:"Body>CreateProfileResponse>Profile"`
+}
+
+type emptyResponse struct{}
+
+// CreateProfile creates a new media profile using the passed in video source and encoder configurations, checking
+// first that the camera guarantees it can run another encoder on that source
+func (d *Device) CreateProfile(log *slog.Logger, name string, sourceToken string, encoder *VideoEncoderConfiguration) (*Profile, error) {
+	limits, err := d.GetGuaranteedNumberOfVideoEncoderInstances(log, sourceToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.CheckEncoderInstances(limits, sourceToken, "", encoder); err != nil {
+		return nil, err
+	}
+
+	created := &createProfileResponse{}
+	body := strings.ReplaceAll(createProfileBody, "{{name}}", xmlEscape(name))
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, created); err != nil {
+		return nil, fmt.Errorf("failed to create profile: %w", err)
+	}
+	token := created.Profile.Token
+
+	for _, add := range []struct{ body, token string }{
+		{addVideoSourceConfigurationBody, sourceToken},
+		{addVideoEncoderConfigurationBody, encoder.Token},
+	} {
+		body := strings.ReplaceAll(add.body, "{{profile}}", xmlEscape(token))
+		body = strings.ReplaceAll(body, "{{token}}", xmlEscape(add.token))
+		if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, &emptyResponse{}); err != nil {
+			return nil, fmt.Errorf("failed to configure profile %q: %w", token, err)
+		}
+	}
+
+	profile := created.Profile
+	profile.VideoSourceConfiguration.Token = sourceToken
+	profile.VideoEncoderConfiguration = encoder
+	if err := d.refreshStreamURI(log, &profile); err != nil {
+		return nil, err
+	}
+	d.Profiles = append(d.Profiles, profile)
+
+	log.Info("created profile", slog.String("token", token), slog.String("name", name), slog.String("encoding", encoder.Encoding))
+	return &d.Profiles[len(d.Profiles)-1], nil
+}
+
+const setVideoEncoderConfigurationBody = `
+<trt:SetVideoEncoderConfiguration xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<trt:Configuration token="{{token}}">
+		<tt:Name>{{name}}</tt:Name>
+		<tt:UseCount>{{usecount}}</tt:UseCount>
+		<tt:Encoding>{{encoding}}</tt:Encoding>
+		<tt:Resolution><tt:Width>{{width}}</tt:Width><tt:Height>{{height}}</tt:Height></tt:Resolution>
+		<tt:Quality>{{quality}}</tt:Quality>
+		<tt:RateControl>
+			<tt:FrameRateLimit>{{framerate}}</tt:FrameRateLimit>
+			<tt:EncodingInterval>{{interval}}</tt:EncodingInterval>
+			<tt:BitrateLimit>{{bitrate}}</tt:BitrateLimit>
+		</tt:RateControl>{{h264}}
+		<tt:Multicast>
+			<tt:Address><tt:Type>{{mtype}}</tt:Type><tt:IPv4Address>{{maddress}}</tt:IPv4Address></tt:Address>
+			<tt:Port>{{mport}}</tt:Port>
+			<tt:TTL>{{mttl}}</tt:TTL>
+			<tt:AutoStart>{{mautostart}}</tt:AutoStart>
+		</tt:Multicast>
+		<tt:SessionTimeout>{{timeout}}</tt:SessionTimeout>
+	</trt:Configuration>
+	<trt:ForcePersistence>true</trt:ForcePersistence>
+</trt:SetVideoEncoderConfiguration>`
+
+const h264ConfigurationBody = `
+		<tt:H264><tt:GovLength>{{govlength}}</tt:GovLength><tt:H264Profile>{{profile}}</tt:H264Profile></tt:H264>`
+
+// SetVideoEncoderConfiguration updates the encoder used by the profile with the passed in token, checking first
+// that a change of encoding won't exceed the number of encoders the camera guarantees for the profile's source
+func (d *Device) SetVideoEncoderConfiguration(log *slog.Logger, profileToken string, config *VideoEncoderConfiguration) error {
+	var profile *Profile
+	for i := range d.Profiles {
+		if d.Profiles[i].Token == profileToken {
+			profile = &d.Profiles[i]
+		}
+	}
+	if profile == nil {
+		return fmt.Errorf("no profile with token %q", profileToken)
+	}
+
+	sourceToken := profile.VideoSourceConfiguration.Token
+	limits, err := d.GetGuaranteedNumberOfVideoEncoderInstances(log, sourceToken)
+	if err != nil {
+		return err
+	}
+	if err := d.CheckEncoderInstances(limits, sourceToken, profileToken, config); err != nil {
+		return err
+	}
+
+	h264 := ""
+	if strings.EqualFold(config.Encoding, "H264") {
+		h264 = strings.NewReplacer(
+			"{{govlength}}", strconv.Itoa(config.H264.GovLength),
+			"{{profile}}", xmlEscape(config.H264.H264Profile),
+		).Replace(h264ConfigurationBody)
+	}
+
+	mtype := config.Multicast.Address.Type
+	if mtype == "" {
+		mtype = "IPv4"
+	}
+	timeout := config.SessionTimeout
+	if timeout == "" {
+		timeout = "PT60S"
+	}
+
+	body := strings.NewReplacer(
+		"{{token}}", xmlEscape(config.Token),
+		"{{name}}", xmlEscape(config.Name),
+		"{{usecount}}", strconv.Itoa(config.UseCount),
+		"{{encoding}}", xmlEscape(config.Encoding),
+		"{{width}}", strconv.Itoa(config.Resolution.Width),
+		"{{height}}", strconv.Itoa(config.Resolution.Height),
+		"{{quality}}", strconv.FormatFloat(config.Quality, 'f', -1, 64),
+		"{{framerate}}", strconv.Itoa(config.RateControl.FrameRateLimit),
+		"{{interval}}", strconv.Itoa(config.RateControl.EncodingInterval),
+		"{{bitrate}}", strconv.Itoa(config.RateControl.BitrateLimit),
+		"{{h264}}", h264,
+		"{{mtype}}", xmlEscape(mtype),
+		"{{maddress}}", xmlEscape(config.Multicast.Address.IPv4Address),
+		"{{mport}}", strconv.Itoa(config.Multicast.Port),
+		"{{mttl}}", strconv.Itoa(config.Multicast.TTL),
+		"{{mautostart}}", strconv.FormatBool(config.Multicast.AutoStart),
+		"{{timeout}}", xmlEscape(timeout),
+	).Replace(setVideoEncoderConfigurationBody)
+
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set video encoder configuration %q: %w", config.Token, err)
+	}
+
+	// the stream for this profile has changed so any URI we have for it may no longer be valid
+	profile.VideoEncoderConfiguration = config
+	profile.clearStreamURI()
+
+	log.Info("set video encoder configuration", slog.String("profile", profileToken), slog.String("encoding", config.Encoding))
+	return nil
+}
+
+func xmlEscape(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,109 @@
+package onvif
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// the stream setup we request stream URIs with, RTP over the RTSP connection is the one transport every camera supports
+const (
+	StreamUnicast   = "RTP-Unicast"
+	StreamMulticast = "RTP-Multicast"
+
+	ProtocolUDP  = "UDP"
+	ProtocolTCP  = "TCP"
+	ProtocolRTSP = "RTSP"
+	ProtocolHTTP = "HTTP"
+)
+
+// StreamTransport is how RTP for a stream URI has to be carried, as requested from and agreed to by the device
+type StreamTransport struct {
+	// RTP-Unicast or RTP-Multicast
+	Stream string
+
+	// UDP, TCP, RTSP when RTP is interleaved on the RTSP connection or HTTP when that is in turn tunneled over HTTP
+	Protocol string
+
+	// whether the RTSP connection itself is over TLS
+	Secure bool
+}
+
+// Interleaved returns whether RTP is carried on the RTSP connection rather than separate ports
+func (t StreamTransport) Interleaved() bool {
+	return t.Protocol == ProtocolRTSP || t.Protocol == ProtocolHTTP
+}
+
+// FFmpegTransport returns the value of ffmpeg's rtsp_transport option which matches this transport
+func (t StreamTransport) FFmpegTransport() string {
+	switch {
+	case t.Stream == StreamMulticast:
+		return "udp_multicast"
+	case t.Protocol == ProtocolHTTP:
+		return "http"
+	case t.Protocol == ProtocolUDP:
+		return "udp"
+	default:
+		return "tcp"
+	}
+}
+
+// StreamEndpoint is a stream URI broken into its components
+type StreamEndpoint struct {
+	Host string
+	Port int
+
+	// the path including any query, this is what gets sent in RTSP requests
+	Path string
+
+	Transport StreamTransport
+}
+
+// ParseStreamEndpoint parses the passed in RTSP URI, filling in the default port for its scheme when it has none
+func ParseStreamEndpoint(uri string, transport StreamTransport) (StreamEndpoint, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return StreamEndpoint{}, fmt.Errorf("error parsing stream uri: %w", err)
+	}
+
+	port := 0
+	switch strings.ToLower(u.Scheme) {
+	case "rtsp":
+		port = 554
+	case "rtsps":
+		port = 322
+		transport.Secure = true
+	case "rtspu":
+		port = 554
+		transport.Protocol = ProtocolUDP
+	default:
+		return StreamEndpoint{}, fmt.Errorf("unsupported stream uri scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return StreamEndpoint{}, fmt.Errorf("stream uri has no host")
+	}
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return StreamEndpoint{}, fmt.Errorf("invalid stream uri port %q", p)
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	return StreamEndpoint{Host: u.Hostname(), Port: port, Path: path, Transport: transport}, nil
+}
+
+// Address returns the host and port to connect to
+func (e StreamEndpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
@@ -0,0 +1,53 @@
+package onvif
+
+import "strings"
+
+// Fault is a SOAP fault returned by a device, such as ter:ActionNotSupported for an operation it doesn't implement
+type Fault struct {
+	Code    string
+	Subcode string
+	Reason  string
+}
+
+func (f *Fault) Error() string {
+	code := f.Code
+	if f.Subcode != "" {
+		code = f.Subcode
+	}
+	if f.Reason == "" {
+		return "soap fault " + code
+	}
+	return "soap fault " + code + ": " + f.Reason
+}
+
+type faultEnvelope struct {
+	Code struct {
+		Value   string `xml:"Value"`
+		Subcode struct {
+			Value   string `xml:"Value"`
+			Subcode struct {
+				Value string `xml:"Value"`
+			} `xml:"Subcode"`
+		} `xml:"Subcode"`
+	} `xml:"Body>Fault>Code"`
+	Reason string `xml:"Body>Fault>Reason>Text"`
+}
+
+// parses a SOAP fault from the passed in response body, returning nil if it doesn't contain one
+func parseFault(body []byte) *Fault {
+	env := &faultEnvelope{}
+	if err := UnmarshalXML(body, env); err != nil || env.Code.Value == "" {
+		return nil
+	}
+
+	// the most specific subcode is the most useful, ter:NotAuthorized rather than ter:OperationProhibited
+	subcode := env.Code.Subcode.Subcode.Value
+	if subcode == "" {
+		subcode = env.Code.Subcode.Value
+	}
+	return &Fault{
+		Code:    strings.TrimSpace(env.Code.Value),
+		Subcode: strings.TrimSpace(subcode),
+		Reason:  strings.TrimSpace(env.Reason),
+	}
+}
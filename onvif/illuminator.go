@@ -0,0 +1,127 @@
+package onvif
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// ErrNoIlluminator is returned when we don't know how to control an illuminator on a device
+var ErrNoIlluminator = errors.New("no controllable illuminator")
+
+// IlluminatorMode is the state to put an illuminator in
+type IlluminatorMode string
+
+const (
+	IlluminatorOn   = IlluminatorMode("On")
+	IlluminatorOff  = IlluminatorMode("Off")
+	IlluminatorAuto = IlluminatorMode("Auto")
+)
+
+// IlluminatorQuirks describes how to control the illuminators on devices which don't do it the standard way, the
+// zero value uses the standard IRLamp auxiliary command and has no white light
+type IlluminatorQuirks struct {
+	// the relay output wired to the white light, if any, controlled through the DeviceIO service
+	WhiteLightRelay string `json:"white_light_relay,omitempty"`
+
+	// auxiliary commands which turn the white light on and off, used if there is no relay
+	WhiteLightOn  string `json:"white_light_on,omitempty"`
+	WhiteLightOff string `json:"white_light_off,omitempty"`
+
+	// an auxiliary command to set IR intensity, with {{level}} replaced by a percentage
+	IRIntensity string `json:"ir_intensity,omitempty"`
+}
+
+const sendAuxiliaryCommandBody = `
+<tds:SendAuxiliaryCommand xmlns:tds="http://www.onvif.org/ver10/device/wsdl">
+	<tds:AuxiliaryCommand>{{command}}</tds:AuxiliaryCommand>
+</tds:SendAuxiliaryCommand>`
+
+// SendAuxiliaryCommand sends an auxiliary command such as tt:IRLamp|On to the device
+func (d *Device) SendAuxiliaryCommand(log *slog.Logger, command string) error {
+	body := strings.ReplaceAll(sendAuxiliaryCommandBody, "{{command}}", xmlEscape(command))
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to send auxiliary command %q: %w", command, err)
+	}
+	return nil
+}
+
+const setRelayOutputStateBody = `
+<tmd:SetRelayOutputState xmlns:tmd="http://www.onvif.org/ver10/deviceIO/wsdl">
+	<tmd:RelayOutputToken>{{token}}</tmd:RelayOutputToken>
+	<tmd:LogicalState>{{state}}</tmd:LogicalState>
+</tmd:SetRelayOutputState>`
+
+// SetRelayOutputState sets the relay output with the passed in token active or inactive
+func (d *Device) SetRelayOutputState(log *slog.Logger, token string, active bool) error {
+	address := d.Capabilities.DeviceIO.Address
+	if address == "" {
+		address = d.Address
+	}
+
+	state := "inactive"
+	if active {
+		state = "active"
+	}
+
+	body := strings.ReplaceAll(setRelayOutputStateBody, "{{token}}", xmlEscape(token))
+	body = strings.ReplaceAll(body, "{{state}}", state)
+	if _, err := d.makeRequest(log, address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set relay output %q %s: %w", token, state, err)
+	}
+	return nil
+}
+
+// SetIRLamp sets the mode of the IR illuminator using the standard auxiliary command
+func (d *Device) SetIRLamp(log *slog.Logger, mode IlluminatorMode) error {
+	return d.SendAuxiliaryCommand(log, "tt:IRLamp|"+string(mode))
+}
+
+// SetIRIntensity sets the IR illuminator to the passed in percentage, which has no standard command so needs quirks
+func (d *Device) SetIRIntensity(log *slog.Logger, quirks IlluminatorQuirks, percent int) error {
+	if quirks.IRIntensity == "" {
+		return fmt.Errorf("%w: no ir intensity command for device", ErrNoIlluminator)
+	}
+	percent = max(0, min(percent, 100))
+	return d.SendAuxiliaryCommand(log, strings.ReplaceAll(quirks.IRIntensity, "{{level}}", strconv.Itoa(percent)))
+}
+
+// SetWhiteLight turns the white light on or off, using a relay output or auxiliary commands as per the quirks
+func (d *Device) SetWhiteLight(log *slog.Logger, quirks IlluminatorQuirks, on bool) error {
+	if quirks.WhiteLightRelay != "" {
+		return d.SetRelayOutputState(log, quirks.WhiteLightRelay, on)
+	}
+
+	command := quirks.WhiteLightOff
+	if on {
+		command = quirks.WhiteLightOn
+	}
+	if command == "" {
+		return fmt.Errorf("%w: no white light command for device", ErrNoIlluminator)
+	}
+	return d.SendAuxiliaryCommand(log, command)
+}
+
+const setIrCutFilterBody = `
+<timg:SetImagingSettings xmlns:timg="http://www.onvif.org/ver20/imaging/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<timg:VideoSourceToken>{{token}}</timg:VideoSourceToken>
+	<timg:ImagingSettings><tt:IrCutFilter>{{mode}}</tt:IrCutFilter></timg:ImagingSettings>
+	<timg:ForcePersistence>false</timg:ForcePersistence>
+</timg:SetImagingSettings>`
+
+// SetIrCutFilter sets the IR cut filter on the passed in video source, turning it off switches the camera to night
+// mode which on most cameras also turns on the IR illuminator
+func (d *Device) SetIrCutFilter(log *slog.Logger, sourceToken string, mode IlluminatorMode) error {
+	if d.Capabilities.Imaging.Address == "" {
+		return fmt.Errorf("%w: device has no imaging service", ErrNoIlluminator)
+	}
+
+	body := strings.ReplaceAll(setIrCutFilterBody, "{{token}}", xmlEscape(sourceToken))
+	body = strings.ReplaceAll(body, "{{mode}}", strings.ToUpper(string(mode)))
+	if _, err := d.makeRequest(log, d.Capabilities.Imaging.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set ir cut filter %s: %w", mode, err)
+	}
+	return nil
+}
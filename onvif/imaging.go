@@ -0,0 +1,202 @@
+package onvif
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImagingSettings are the image settings of a video source, nil fields are left unchanged when setting them
+type ImagingSettings struct {
+	Brightness       *float64          `xml:"Brightness" json:"brightness,omitempty"`
+	ColorSaturation  *float64          `xml:"ColorSaturation" json:"color_saturation,omitempty"`
+	Contrast         *float64          `xml:"Contrast" json:"contrast,omitempty"`
+	Exposure         *Exposure         `xml:"Exposure" json:"exposure,omitempty"`
+	Focus            *Focus            `xml:"Focus" json:"focus,omitempty"`
+	Sharpness        *float64          `xml:"Sharpness" json:"sharpness,omitempty"`
+	IrCutFilter      string            `xml:"IrCutFilter" json:"ir_cut_filter,omitempty"`
+	WideDynamicRange *WideDynamicRange `xml:"WideDynamicRange" json:"wide_dynamic_range,omitempty"`
+}
+
+// Exposure is how a video source exposes its image. In AUTO mode the camera reports the exposure time, in
+// microseconds, and gain, in dB, it has settled on which tells us how dark the scene is.
+type Exposure struct {
+	Mode         string   `xml:"Mode" json:"mode"`
+	ExposureTime *float64 `xml:"ExposureTime" json:"exposure_time,omitempty"`
+	Gain         *float64 `xml:"Gain" json:"gain,omitempty"`
+}
+
+// Focus is how a video source focuses, either AUTO or MANUAL
+type Focus struct {
+	AutoFocusMode string `xml:"AutoFocusMode" json:"auto_focus_mode"`
+}
+
+type WideDynamicRange struct {
+	Mode  string   `xml:"Mode" json:"mode"`
+	Level *float64 `xml:"Level" json:"level,omitempty"`
+}
+
+type getImagingSettingsResponse struct {
+	Settings ImagingSettings `xml:"Body>GetImagingSettingsResponse>ImagingSettings"`
+}
+
+const getImagingSettingsBody = `
+<timg:GetImagingSettings xmlns:timg="http://www.onvif.org/ver20/imaging/wsdl">
+	<timg:VideoSourceToken>{{token}}</timg:VideoSourceToken>
+</timg:GetImagingSettings>`
+
+// GetImagingSettings returns the imaging settings of the video source with the passed in token
+func (d *Device) GetImagingSettings(log *slog.Logger, sourceToken string) (*ImagingSettings, error) {
+	if d.Capabilities.Imaging.Address == "" {
+		return nil, fmt.Errorf("device has no imaging service")
+	}
+
+	resp := &getImagingSettingsResponse{}
+	body := strings.ReplaceAll(getImagingSettingsBody, "{{token}}", xmlEscape(sourceToken))
+	if _, err := d.makeRequest(log, d.Capabilities.Imaging.Address, body, resp); err != nil {
+		return nil, fmt.Errorf("failed to get imaging settings: %w", err)
+	}
+	return &resp.Settings, nil
+}
+
+const setImagingSettingsBody = `
+<timg:SetImagingSettings xmlns:timg="http://www.onvif.org/ver20/imaging/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<timg:VideoSourceToken>{{token}}</timg:VideoSourceToken>
+	<timg:ImagingSettings>{{settings}}</timg:ImagingSettings>
+	<timg:ForcePersistence>true</timg:ForcePersistence>
+</timg:SetImagingSettings>`
+
+// SetImagingSettings sets the non nil imaging settings on the video source with the passed in token
+func (d *Device) SetImagingSettings(log *slog.Logger, sourceToken string, settings *ImagingSettings) error {
+	if d.Capabilities.Imaging.Address == "" {
+		return fmt.Errorf("device has no imaging service")
+	}
+
+	// elements must be in schema order
+	b := &strings.Builder{}
+	writeFloat := func(name string, v *float64) {
+		if v != nil {
+			fmt.Fprintf(b, "<tt:%s>%s</tt:%s>", name, strconv.FormatFloat(*v, 'f', -1, 64), name)
+		}
+	}
+	writeFloat("Brightness", settings.Brightness)
+	writeFloat("ColorSaturation", settings.ColorSaturation)
+	writeFloat("Contrast", settings.Contrast)
+	if e := settings.Exposure; e != nil {
+		fmt.Fprintf(b, "<tt:Exposure><tt:Mode>%s</tt:Mode>", xmlEscape(e.Mode))
+		writeFloat("ExposureTime", e.ExposureTime)
+		writeFloat("Gain", e.Gain)
+		b.WriteString("</tt:Exposure>")
+	}
+	if f := settings.Focus; f != nil {
+		fmt.Fprintf(b, "<tt:Focus><tt:AutoFocusMode>%s</tt:AutoFocusMode></tt:Focus>", xmlEscape(f.AutoFocusMode))
+	}
+	if settings.IrCutFilter != "" {
+		fmt.Fprintf(b, "<tt:IrCutFilter>%s</tt:IrCutFilter>", xmlEscape(settings.IrCutFilter))
+	}
+	writeFloat("Sharpness", settings.Sharpness)
+	if wdr := settings.WideDynamicRange; wdr != nil {
+		fmt.Fprintf(b, "<tt:WideDynamicRange><tt:Mode>%s</tt:Mode>", xmlEscape(wdr.Mode))
+		writeFloat("Level", wdr.Level)
+		b.WriteString("</tt:WideDynamicRange>")
+	}
+
+	body := strings.ReplaceAll(setImagingSettingsBody, "{{token}}", xmlEscape(sourceToken))
+	body = strings.ReplaceAll(body, "{{settings}}", b.String())
+	if _, err := d.makeRequest(log, d.Capabilities.Imaging.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set imaging settings: %w", err)
+	}
+	return nil
+}
+
+// FocusStatus is where a video source's focus is and whether it is moving, MoveStatus is one of IDLE, MOVING or
+// UNKNOWN
+type FocusStatus struct {
+	Position   float64 `xml:"Position" json:"position"`
+	MoveStatus string  `xml:"MoveStatus" json:"move_status"`
+	Error      string  `xml:"Error" json:"error,omitempty"`
+}
+
+type getImagingStatusResponse struct {
+	Focus FocusStatus `xml:"Body>GetStatusResponse>Status>FocusStatus20"`
+}
+
+const getImagingStatusBody = `
+<timg:GetStatus xmlns:timg="http://www.onvif.org/ver20/imaging/wsdl">
+	<timg:VideoSourceToken>{{token}}</timg:VideoSourceToken>
+</timg:GetStatus>`
+
+// GetFocusStatus returns the focus status of the video source with the passed in token
+func (d *Device) GetFocusStatus(log *slog.Logger, sourceToken string) (*FocusStatus, error) {
+	if d.Capabilities.Imaging.Address == "" {
+		return nil, fmt.Errorf("device has no imaging service")
+	}
+
+	resp := &getImagingStatusResponse{}
+	body := strings.ReplaceAll(getImagingStatusBody, "{{token}}", xmlEscape(sourceToken))
+	if _, err := d.makeRequest(log, d.Capabilities.Imaging.Address, body, resp); err != nil {
+		return nil, fmt.Errorf("failed to get imaging status: %w", err)
+	}
+	return &resp.Focus, nil
+}
+
+// how long we wait for a one shot auto focus to settle, and how often we check whether it has
+const (
+	autofocusTimeout = 10 * time.Second
+	autofocusPoll    = 500 * time.Millisecond
+)
+
+// Autofocus focuses the video source with the passed in token once, such as after switching between day and night
+// when the IR cut filter moving shifts the focal plane. There's no one shot focus in ONVIF so a source in manual
+// focus is switched to auto focus until it settles then back to manual, a source already in auto focus is left to
+// refocus itself.
+func (d *Device) Autofocus(log *slog.Logger, sourceToken string) error {
+	current, err := d.GetImagingSettings(log, sourceToken)
+	if err != nil {
+		return err
+	}
+	if current.Focus == nil || !strings.EqualFold(current.Focus.AutoFocusMode, "MANUAL") {
+		return nil
+	}
+
+	if err := d.SetImagingSettings(log, sourceToken, &ImagingSettings{Focus: &Focus{AutoFocusMode: "AUTO"}}); err != nil {
+		return fmt.Errorf("failed to start auto focus: %w", err)
+	}
+
+	// give the lens a moment to start moving, then wait for it to stop
+	deadline := time.Now().Add(autofocusTimeout)
+	time.Sleep(autofocusPoll)
+	for time.Now().Before(deadline) {
+		status, err := d.GetFocusStatus(log, sourceToken)
+		if err != nil || !strings.EqualFold(status.MoveStatus, "MOVING") {
+			break
+		}
+		time.Sleep(autofocusPoll)
+	}
+
+	if err := d.SetImagingSettings(log, sourceToken, &ImagingSettings{Focus: &Focus{AutoFocusMode: "MANUAL"}}); err != nil {
+		return fmt.Errorf("failed to restore manual focus: %w", err)
+	}
+	return nil
+}
+
+type getVideoEncoderConfigurationResponse struct {
+	Configuration VideoEncoderConfiguration `xml:"Body>GetVideoEncoderConfigurationResponse>Configuration"`
+}
+
+const getVideoEncoderConfigurationBody = `
+<trt:GetVideoEncoderConfiguration xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ConfigurationToken>{{token}}</trt:ConfigurationToken>
+</trt:GetVideoEncoderConfiguration>`
+
+// GetVideoEncoderConfiguration reads the video encoder configuration with the passed in token from the device
+func (d *Device) GetVideoEncoderConfiguration(log *slog.Logger, token string) (*VideoEncoderConfiguration, error) {
+	resp := &getVideoEncoderConfigurationResponse{}
+	body := strings.ReplaceAll(getVideoEncoderConfigurationBody, "{{token}}", xmlEscape(token))
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, resp); err != nil {
+		return nil, fmt.Errorf("failed to get video encoder configuration %q: %w", token, err)
+	}
+	return &resp.Configuration, nil
+}
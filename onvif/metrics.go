@@ -0,0 +1,32 @@
+package onvif
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/incrementventures/govr/metrics"
+)
+
+var (
+	soapDuration = metrics.NewHistogram("govr_onvif_request_duration_seconds", "Latency of ONVIF SOAP requests.", metrics.DefaultBuckets, "host", "operation")
+	soapErrors   = metrics.NewCounter("govr_onvif_request_errors_total", "ONVIF SOAP requests which failed.", "host", "operation")
+)
+
+// matches the first element of a request body, e.g. trt:GetProfiles, capturing its local name
+var operationRegex = regexp.MustCompile(`<(?:[\w-]+:)?(\w+)`)
+
+// returns the operation of the passed in request body, the name of its first element
+func operationOf(body string) string {
+	if m := operationRegex.FindStringSubmatch(body); m != nil {
+		return m[1]
+	}
+	return "unknown"
+}
+
+// returns the host of the passed in service URL, which labels requests by device
+func hostOf(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return address
+}
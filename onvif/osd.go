@@ -0,0 +1,83 @@
+package onvif
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// OSD is an on screen display overlaid on a video source
+type OSD struct {
+	Token                         string `xml:"token,attr"`
+	VideoSourceConfigurationToken string `xml:"VideoSourceConfigurationToken"`
+	Type                          string `xml:"Type"`
+	Position                      struct {
+		Type string `xml:"Type"`
+		Pos  *struct {
+			X float64 `xml:"x,attr"`
+			Y float64 `xml:"y,attr"`
+		} `xml:"Pos"`
+	} `xml:"Position"`
+	TextString struct {
+		Type      string `xml:"Type"`
+		PlainText string `xml:"PlainText"`
+	} `xml:"TextString"`
+}
+
+// IsPlainText returns whether this is a plain text overlay, as opposed to the date, time or an image
+func (o *OSD) IsPlainText() bool {
+	return o.Type == "Text" && o.TextString.Type == "Plain"
+}
+
+type getOSDsResponse struct {
+	OSDs []OSD `xml:"Body>GetOSDsResponse>OSDs"`
+}
+
+const getOSDsBody = `
+<trt:GetOSDs xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ConfigurationToken>{{token}}</trt:ConfigurationToken>
+</trt:GetOSDs>`
+
+// GetOSDs returns the on screen displays on the video source configuration with the passed in token
+func (d *Device) GetOSDs(log *slog.Logger, configurationToken string) ([]OSD, error) {
+	resp := &getOSDsResponse{}
+	body := strings.ReplaceAll(getOSDsBody, "{{token}}", xmlEscape(configurationToken))
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, resp); err != nil {
+		return nil, fmt.Errorf("failed to get osds: %w", err)
+	}
+	return resp.OSDs, nil
+}
+
+const setOSDBody = `
+<trt:SetOSD xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<trt:OSD token="{{token}}">
+		<tt:VideoSourceConfigurationToken>{{source}}</tt:VideoSourceConfigurationToken>
+		<tt:Type>Text</tt:Type>
+		<tt:Position><tt:Type>{{position}}</tt:Type>{{pos}}</tt:Position>
+		<tt:TextString><tt:Type>Plain</tt:Type><tt:PlainText>{{text}}</tt:PlainText></tt:TextString>
+	</trt:OSD>
+</trt:SetOSD>`
+
+// SetOSDText changes the text of a plain text on screen display, keeping its position
+func (d *Device) SetOSDText(log *slog.Logger, osd *OSD, text string) error {
+	if !osd.IsPlainText() {
+		return fmt.Errorf("osd %q is not plain text", osd.Token)
+	}
+
+	pos := ""
+	if osd.Position.Pos != nil {
+		pos = fmt.Sprintf(`<tt:Pos x="%g" y="%g"/>`, osd.Position.Pos.X, osd.Position.Pos.Y)
+	}
+
+	body := strings.NewReplacer(
+		"{{token}}", xmlEscape(osd.Token),
+		"{{source}}", xmlEscape(osd.VideoSourceConfigurationToken),
+		"{{position}}", xmlEscape(osd.Position.Type),
+		"{{pos}}", pos,
+		"{{text}}", xmlEscape(text),
+	).Replace(setOSDBody)
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set osd %q text: %w", osd.Token, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package onvif
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrNoRecordingService is returned when asked about on device recordings of a device which doesn't support Profile G
+var ErrNoRecordingService = errors.New("device doesn't record to its own storage")
+
+// how long a search on the device is kept alive between our requests for its results, how long each request waits
+// for results and the most we fetch with each
+const (
+	searchKeepAlive  = "PT30S"
+	searchWaitTime   = "PT5S"
+	searchMaxResults = 100
+
+	// a search which hasn't completed after this many requests for results is given up on
+	maxSearchRequests = 50
+)
+
+// Recording is footage the device has recorded to its own storage, such as an SD card
+type Recording struct {
+	Token        string           `xml:"RecordingToken" json:"token"`
+	Source       RecordingSource  `xml:"Source" json:"source"`
+	Content      string           `xml:"Content" json:"content,omitempty"`
+	Earliest     time.Time        `xml:"EarliestRecording" json:"earliest"`
+	Latest       time.Time        `xml:"LatestRecording" json:"latest"`
+	Tracks       []RecordingTrack `xml:"Track" json:"tracks"`
+	Status       string           `xml:"RecordingStatus" json:"status,omitempty"`
+	MaxRetention string           `xml:"-" json:"max_retention,omitempty"`
+}
+
+// RecordingSource is what a recording was recorded from
+type RecordingSource struct {
+	SourceID    string `xml:"SourceId" json:"source_id"`
+	Name        string `xml:"Name" json:"name"`
+	Location    string `xml:"Location" json:"location,omitempty"`
+	Description string `xml:"Description" json:"description,omitempty"`
+	Address     string `xml:"Address" json:"address,omitempty"`
+}
+
+// RecordingTrack is a single video, audio or metadata track of a recording, along with the span of it which is held
+type RecordingTrack struct {
+	Token       string    `xml:"TrackToken" json:"token"`
+	Type        string    `xml:"TrackType" json:"type"`
+	Description string    `xml:"Description" json:"description,omitempty"`
+	From        time.Time `xml:"DataFrom" json:"from"`
+	To          time.Time `xml:"DataTo" json:"to"`
+}
+
+// the recordings as described by the recording service, which gives their configuration but not what they hold
+type getRecordingsResponse struct {
+	Items []struct {
+		Token         string `xml:"RecordingToken"`
+		Configuration struct {
+			Source               RecordingSource `xml:"Source"`
+			Content              string          `xml:"Content"`
+			MaximumRetentionTime string          `xml:"MaximumRetentionTime"`
+		} `xml:"Configuration"`
+		Tracks []struct {
+			Token         string `xml:"TrackToken"`
+			Configuration struct {
+				Type        string `xml:"TrackType"`
+				Description string `xml:"Description"`
+			} `xml:"Configuration"`
+		} `xml:"Tracks>Track"`
+	} `xml:"Body>GetRecordingsResponse>RecordingItem"`
+}
+
+const getRecordingsBody = `<trc:GetRecordings xmlns:trc="http://www.onvif.org/ver10/recording/wsdl"/>`
+
+// GetRecordings returns the recordings the device has configured from its recording service, which doesn't know
+// what span of time each holds, use FindRecordings for that
+func (d *Device) GetRecordings(log *slog.Logger) ([]Recording, error) {
+	if d.Capabilities.Recording.Address == "" {
+		return nil, ErrNoRecordingService
+	}
+
+	resp := &getRecordingsResponse{}
+	if _, err := d.makeRequest(log, d.Capabilities.Recording.Address, getRecordingsBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get recordings: %w", err)
+	}
+
+	recordings := make([]Recording, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		r := Recording{
+			Token:        item.Token,
+			Source:       item.Configuration.Source,
+			Content:      item.Configuration.Content,
+			MaxRetention: item.Configuration.MaximumRetentionTime,
+		}
+		for _, t := range item.Tracks {
+			r.Tracks = append(r.Tracks, RecordingTrack{Token: t.Token, Type: t.Configuration.Type, Description: t.Configuration.Description})
+		}
+		recordings = append(recordings, r)
+	}
+	return recordings, nil
+}
+
+type findRecordingsResponse struct {
+	SearchToken string `xml:"Body>FindRecordingsResponse>SearchToken"`
+}
+
+type getRecordingSearchResultsResponse struct {
+	State      string      `xml:"Body>GetRecordingSearchResultsResponse>ResultList>SearchState"`
+	Recordings []Recording `xml:"Body>GetRecordingSearchResultsResponse>ResultList>RecordingInformation"`
+}
+
+const findRecordingsBody = `
+<tse:FindRecordings xmlns:tse="http://www.onvif.org/ver10/search/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tse:Scope>{{sources}}</tse:Scope>
+	<tse:KeepAliveTime>{{keepalive}}</tse:KeepAliveTime>
+</tse:FindRecordings>`
+
+const getRecordingSearchResultsBody = `
+<tse:GetRecordingSearchResults xmlns:tse="http://www.onvif.org/ver10/search/wsdl">
+	<tse:SearchToken>{{token}}</tse:SearchToken>
+	<tse:MinResults>1</tse:MinResults>
+	<tse:MaxResults>{{max}}</tse:MaxResults>
+	<tse:WaitTime>{{wait}}</tse:WaitTime>
+</tse:GetRecordingSearchResults>`
+
+const endSearchBody = `
+<tse:EndSearch xmlns:tse="http://www.onvif.org/ver10/search/wsdl">
+	<tse:SearchToken>{{token}}</tse:SearchToken>
+</tse:EndSearch>`
+
+// FindRecordings searches the device's storage for recordings, of the video sources with the passed in tokens or of
+// all of them if none are passed in, returning each along with the span of time each of its tracks holds
+func (d *Device) FindRecordings(log *slog.Logger, sourceTokens ...string) ([]Recording, error) {
+	if d.Capabilities.Search.Address == "" {
+		return nil, ErrNoRecordingService
+	}
+
+	sources := &strings.Builder{}
+	for _, token := range sourceTokens {
+		fmt.Fprintf(sources, "<tt:IncludedSources><tt:Token>%s</tt:Token></tt:IncludedSources>", xmlEscape(token))
+	}
+	body := strings.ReplaceAll(findRecordingsBody, "{{sources}}", sources.String())
+	body = strings.ReplaceAll(body, "{{keepalive}}", searchKeepAlive)
+
+	find := &findRecordingsResponse{}
+	if _, err := d.makeRequest(log, d.Capabilities.Search.Address, body, find); err != nil {
+		return nil, fmt.Errorf("failed to find recordings: %w", err)
+	}
+
+	// searches run in the background on the device, we collect results until it tells us it has finished
+	recordings := []Recording{}
+	completed := false
+	for range maxSearchRequests {
+		body := strings.ReplaceAll(getRecordingSearchResultsBody, "{{token}}", xmlEscape(find.SearchToken))
+		body = strings.ReplaceAll(body, "{{max}}", fmt.Sprint(searchMaxResults))
+		body = strings.ReplaceAll(body, "{{wait}}", searchWaitTime)
+
+		results := &getRecordingSearchResultsResponse{}
+		if _, err := d.makeRequest(log, d.Capabilities.Search.Address, body, results); err != nil {
+			return nil, fmt.Errorf("failed to get recording search results: %w", err)
+		}
+		recordings = append(recordings, results.Recordings...)
+		if results.State == "Completed" {
+			completed = true
+			break
+		}
+	}
+
+	// the search ends itself once completed, otherwise we end it so the device can free it
+	if !completed {
+		body := strings.ReplaceAll(endSearchBody, "{{token}}", xmlEscape(find.SearchToken))
+		if _, err := d.makeRequest(log, d.Capabilities.Search.Address, body, &emptyResponse{}); err != nil {
+			log.Debug("error ending recording search", slog.String("error", err.Error()))
+		}
+		return nil, errors.New("recording search didn't complete")
+	}
+	return recordings, nil
+}
+
+type getReplayUriResponse struct {
+	URI string `xml:"Body>GetReplayUriResponse>Uri"`
+}
+
+const getReplayUriBody = `
+<trp:GetReplayUri xmlns:trp="http://www.onvif.org/ver10/replay/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<trp:StreamSetup>
+		<tt:Stream>RTP-Unicast</tt:Stream>
+		<tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport>
+	</trp:StreamSetup>
+	<trp:RecordingToken>{{token}}</trp:RecordingToken>
+</trp:GetReplayUri>`
+
+// GetReplayURI returns the RTSP URI the recording with the passed in token can be replayed from. Replaying requires
+// the Require: onvif-replay header and a Range header giving the time to start from, see rtsp.OpenReplay.
+func (d *Device) GetReplayURI(log *slog.Logger, recordingToken string) (string, error) {
+	if d.Capabilities.Replay.Address == "" {
+		return "", ErrNoRecordingService
+	}
+
+	resp := &getReplayUriResponse{}
+	body := strings.ReplaceAll(getReplayUriBody, "{{token}}", xmlEscape(recordingToken))
+	if _, err := d.makeRequest(log, d.Capabilities.Replay.Address, body, resp); err != nil {
+		return "", fmt.Errorf("failed to get replay uri: %w", err)
+	}
+	if resp.URI == "" {
+		return "", fmt.Errorf("no replay uri for recording %q", recordingToken)
+	}
+	return resp.URI, nil
+}
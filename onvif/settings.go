@@ -0,0 +1,137 @@
+package onvif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncoderSettings is a partial video encoder configuration, zero fields are left as the camera has them
+type EncoderSettings struct {
+	Encoding     string   `json:"encoding,omitempty"`
+	Width        int      `json:"width,omitempty"`
+	Height       int      `json:"height,omitempty"`
+	Quality      *float64 `json:"quality,omitempty"`
+	FrameRate    int      `json:"frame_rate,omitempty"`
+	BitrateLimit int      `json:"bitrate_limit,omitempty"`
+	GovLength    int      `json:"gov_length,omitempty"`
+	H264Profile  string   `json:"h264_profile,omitempty"`
+}
+
+// ApplyTo returns a copy of the passed in configuration with our settings applied
+func (s *EncoderSettings) ApplyTo(cfg *VideoEncoderConfiguration) *VideoEncoderConfiguration {
+	applied := *cfg
+	if s.Encoding != "" {
+		applied.Encoding = s.Encoding
+	}
+	if s.Width > 0 && s.Height > 0 {
+		applied.Resolution.Width, applied.Resolution.Height = s.Width, s.Height
+	}
+	if s.Quality != nil {
+		applied.Quality = *s.Quality
+	}
+	if s.FrameRate > 0 {
+		applied.RateControl.FrameRateLimit = s.FrameRate
+	}
+	if s.BitrateLimit > 0 {
+		applied.RateControl.BitrateLimit = s.BitrateLimit
+	}
+	if s.GovLength > 0 {
+		applied.H264.GovLength = s.GovLength
+	}
+	if s.H264Profile != "" {
+		applied.H264.H264Profile = s.H264Profile
+	}
+	return &applied
+}
+
+// Diff returns a description of each of our settings which the passed in configuration doesn't match
+func (s *EncoderSettings) Diff(cfg *VideoEncoderConfiguration) []string {
+	diffs := []string{}
+	add := func(name string, want, got any) {
+		diffs = append(diffs, fmt.Sprintf("%s: want %v, got %v", name, want, got))
+	}
+
+	if s.Encoding != "" && !strings.EqualFold(s.Encoding, cfg.Encoding) {
+		add("encoding", s.Encoding, cfg.Encoding)
+	}
+	if s.Width > 0 && s.Height > 0 && (s.Width != cfg.Resolution.Width || s.Height != cfg.Resolution.Height) {
+		add("resolution", fmt.Sprintf("%dx%d", s.Width, s.Height), fmt.Sprintf("%dx%d", cfg.Resolution.Width, cfg.Resolution.Height))
+	}
+	if s.Quality != nil && *s.Quality != cfg.Quality {
+		add("quality", *s.Quality, cfg.Quality)
+	}
+	if s.FrameRate > 0 && s.FrameRate != cfg.RateControl.FrameRateLimit {
+		add("frame_rate", s.FrameRate, cfg.RateControl.FrameRateLimit)
+	}
+	if s.BitrateLimit > 0 && s.BitrateLimit != cfg.RateControl.BitrateLimit {
+		add("bitrate_limit", s.BitrateLimit, cfg.RateControl.BitrateLimit)
+	}
+	if s.GovLength > 0 && s.GovLength != cfg.H264.GovLength {
+		add("gov_length", s.GovLength, cfg.H264.GovLength)
+	}
+	if s.H264Profile != "" && !strings.EqualFold(s.H264Profile, cfg.H264.H264Profile) {
+		add("h264_profile", s.H264Profile, cfg.H264.H264Profile)
+	}
+	return diffs
+}
+
+// Diff returns a description of each of our set imaging settings which the passed in settings don't match
+func (s *ImagingSettings) Diff(actual *ImagingSettings) []string {
+	diffs := []string{}
+	floats := []struct {
+		name      string
+		want, got *float64
+	}{
+		{"brightness", s.Brightness, actual.Brightness},
+		{"color_saturation", s.ColorSaturation, actual.ColorSaturation},
+		{"contrast", s.Contrast, actual.Contrast},
+		{"sharpness", s.Sharpness, actual.Sharpness},
+	}
+	for _, f := range floats {
+		if f.want != nil && (f.got == nil || *f.want != *f.got) {
+			diffs = append(diffs, fmt.Sprintf("%s: want %v, got %s", f.name, *f.want, formatOptional(f.got)))
+		}
+	}
+
+	if s.Exposure != nil {
+		got := actual.Exposure
+		if got == nil {
+			got = &Exposure{}
+		}
+		if !strings.EqualFold(s.Exposure.Mode, got.Mode) {
+			diffs = append(diffs, fmt.Sprintf("exposure_mode: want %s, got %s", s.Exposure.Mode, got.Mode))
+		}
+	}
+	if s.Focus != nil {
+		got := actual.Focus
+		if got == nil {
+			got = &Focus{}
+		}
+		if !strings.EqualFold(s.Focus.AutoFocusMode, got.AutoFocusMode) {
+			diffs = append(diffs, fmt.Sprintf("auto_focus_mode: want %s, got %s", s.Focus.AutoFocusMode, got.AutoFocusMode))
+		}
+	}
+	if s.IrCutFilter != "" && !strings.EqualFold(s.IrCutFilter, actual.IrCutFilter) {
+		diffs = append(diffs, fmt.Sprintf("ir_cut_filter: want %s, got %s", s.IrCutFilter, actual.IrCutFilter))
+	}
+	if s.WideDynamicRange != nil {
+		got := actual.WideDynamicRange
+		if got == nil {
+			got = &WideDynamicRange{}
+		}
+		if !strings.EqualFold(s.WideDynamicRange.Mode, got.Mode) {
+			diffs = append(diffs, fmt.Sprintf("wdr_mode: want %s, got %s", s.WideDynamicRange.Mode, got.Mode))
+		}
+		if want := s.WideDynamicRange.Level; want != nil && (got.Level == nil || *want != *got.Level) {
+			diffs = append(diffs, fmt.Sprintf("wdr_level: want %v, got %s", *want, formatOptional(got.Level)))
+		}
+	}
+	return diffs
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*v)
+}
@@ -0,0 +1,100 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// snapshots are a few hundred KB, anything much larger isn't one
+const maxSnapshotSize = 16 * 1024 * 1024
+
+type getSnapshotUriResponse struct {
+	URI string `xml:"Body>GetSnapshotUriResponse>MediaUri>Uri"`
+}
+
+const getSnapshotUriBody = `
+<trt:GetSnapshotUri xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+	<trt:ProfileToken>{{token}}</trt:ProfileToken>
+</trt:GetSnapshotUri>`
+
+// GetSnapshotURI returns the HTTP URI a JPEG snapshot of the profile with the passed in token can be fetched from
+func (d *Device) GetSnapshotURI(log *slog.Logger, profileToken string) (string, error) {
+	resp := &getSnapshotUriResponse{}
+	body := strings.ReplaceAll(getSnapshotUriBody, "{{token}}", xmlEscape(profileToken))
+	if _, err := d.makeRequest(log, d.Capabilities.Media.Address, body, resp); err != nil {
+		return "", fmt.Errorf("failed to get snapshot uri: %w", err)
+	}
+	if resp.URI == "" {
+		return "", fmt.Errorf("no snapshot uri for profile %q", profileToken)
+	}
+	return resp.URI, nil
+}
+
+// Snapshot fetches a JPEG snapshot of the profile with the passed in token, answering basic or digest auth
+// challenges with our credentials
+func (d *Device) Snapshot(ctx context.Context, log *slog.Logger, profileToken string) ([]byte, error) {
+	uri, err := d.GetSnapshotURI(log, profileToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := d.getSnapshot(ctx, uri, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && d.Username != "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot uri %q: %w", creds.Redact(uri), err)
+		}
+		authorization, err := creds.Authorization(challenge, http.MethodGet, u.RequestURI(), d.Username, d.Password)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = d.getSnapshot(ctx, uri, authorization); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 status %d fetching snapshot from %q", resp.StatusCode, creds.Redact(uri))
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	log.Debug("fetched snapshot", slog.String("uri", creds.Redact(uri)), slog.Int("bytes", len(b)))
+	return b, nil
+}
+
+func (d *Device) getSnapshot(ctx context.Context, uri string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot uri %q: %w", creds.Redact(uri), err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching snapshot from %q: %w", creds.Redact(uri), err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,173 @@
+package onvif
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+)
+
+// NTPSettings are the time servers a device synchronizes its clock with
+type NTPSettings struct {
+	FromDHCP bool     `json:"from_dhcp"`
+	Servers  []string `json:"servers,omitempty"`
+}
+
+type ntpHost struct {
+	Type        string `xml:"Type"`
+	IPv4Address string `xml:"IPv4Address"`
+	IPv6Address string `xml:"IPv6Address"`
+	DNSname     string `xml:"DNSname"`
+}
+
+func (h ntpHost) address() string {
+	for _, a := range []string{h.DNSname, h.IPv4Address, h.IPv6Address} {
+		if a != "" {
+			return a
+		}
+	}
+	return ""
+}
+
+type getNTPResponse struct {
+	FromDHCP    bool      `xml:"Body>GetNTPResponse>NTPInformation>FromDHCP"`
+	NTPManual   []ntpHost `xml:"Body>GetNTPResponse>NTPInformation>NTPManual"`
+	NTPFromDHCP []ntpHost `xml:"Body>GetNTPResponse>NTPInformation>NTPFromDHCP"`
+}
+
+const getNTPBody = `<tds:GetNTP xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+
+// GetNTP returns the NTP settings of the device, the servers are those in use, whether set manually or from DHCP
+func (d *Device) GetNTP(log *slog.Logger) (*NTPSettings, error) {
+	resp := &getNTPResponse{}
+	if _, err := d.makeRequest(log, d.Address, getNTPBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get ntp settings: %w", err)
+	}
+
+	hosts := resp.NTPManual
+	if resp.FromDHCP {
+		hosts = resp.NTPFromDHCP
+	}
+
+	settings := &NTPSettings{FromDHCP: resp.FromDHCP, Servers: []string{}}
+	for _, h := range hosts {
+		if a := h.address(); a != "" {
+			settings.Servers = append(settings.Servers, a)
+		}
+	}
+	return settings, nil
+}
+
+const setNTPBody = `
+<tds:SetNTP xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:FromDHCP>{{dhcp}}</tds:FromDHCP>{{servers}}
+</tds:SetNTP>`
+
+// SetNTP sets the NTP settings of the device, servers are ignored if they come from DHCP
+func (d *Device) SetNTP(log *slog.Logger, settings NTPSettings) error {
+	servers := &strings.Builder{}
+	if !settings.FromDHCP {
+		for _, s := range settings.Servers {
+			addr, err := netip.ParseAddr(s)
+			switch {
+			case err != nil:
+				fmt.Fprintf(servers, "<tds:NTPManual><tt:Type>DNS</tt:Type><tt:DNSname>%s</tt:DNSname></tds:NTPManual>", xmlEscape(s))
+			case addr.Is4():
+				fmt.Fprintf(servers, "<tds:NTPManual><tt:Type>IPv4</tt:Type><tt:IPv4Address>%s</tt:IPv4Address></tds:NTPManual>", addr)
+			default:
+				fmt.Fprintf(servers, "<tds:NTPManual><tt:Type>IPv6</tt:Type><tt:IPv6Address>%s</tt:IPv6Address></tds:NTPManual>", addr)
+			}
+		}
+	}
+
+	body := strings.ReplaceAll(setNTPBody, "{{dhcp}}", fmt.Sprint(settings.FromDHCP))
+	body = strings.ReplaceAll(body, "{{servers}}", servers.String())
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set ntp settings: %w", err)
+	}
+	return nil
+}
+
+// user levels defined by ONVIF
+const (
+	UserLevelAdministrator = "Administrator"
+	UserLevelOperator      = "Operator"
+	UserLevelUser          = "User"
+)
+
+// User is an account on a device
+type User struct {
+	Username  string `xml:"Username" json:"username"`
+	UserLevel string `xml:"UserLevel" json:"level"`
+}
+
+type getUsersResponse struct {
+	Users []User `xml:"Body>GetUsersResponse>User"`
+}
+
+const getUsersBody = `<tds:GetUsers xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/>`
+
+// GetUsers returns the accounts on the device
+func (d *Device) GetUsers(log *slog.Logger) ([]User, error) {
+	resp := &getUsersResponse{}
+	if _, err := d.makeRequest(log, d.Address, getUsersBody, resp); err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	return resp.Users, nil
+}
+
+const createUsersBody = `
+<tds:CreateUsers xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:User>
+		<tt:Username>{{username}}</tt:Username>
+		<tt:Password>{{password}}</tt:Password>
+		<tt:UserLevel>{{level}}</tt:UserLevel>
+	</tds:User>
+</tds:CreateUsers>`
+
+// CreateUser creates an account on the device
+func (d *Device) CreateUser(log *slog.Logger, user User, password string) error {
+	body := strings.NewReplacer(
+		"{{username}}", xmlEscape(user.Username),
+		"{{password}}", xmlEscape(password),
+		"{{level}}", xmlEscape(user.UserLevel),
+	).Replace(createUsersBody)
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to create user %q: %w", user.Username, err)
+	}
+	return nil
+}
+
+const setUserBody = `
+<tds:SetUser xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+	<tds:User>
+		<tt:Username>{{username}}</tt:Username>
+		<tt:UserLevel>{{level}}</tt:UserLevel>
+	</tds:User>
+</tds:SetUser>`
+
+// SetUserLevel changes the level of an existing account on the device, leaving its password unchanged
+func (d *Device) SetUserLevel(log *slog.Logger, user User) error {
+	body := strings.NewReplacer(
+		"{{username}}", xmlEscape(user.Username),
+		"{{level}}", xmlEscape(user.UserLevel),
+	).Replace(setUserBody)
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to set level of user %q: %w", user.Username, err)
+	}
+	return nil
+}
+
+const deleteUsersBody = `
+<tds:DeleteUsers xmlns:tds="http://www.onvif.org/ver10/device/wsdl">
+	<tds:Username>{{username}}</tds:Username>
+</tds:DeleteUsers>`
+
+// DeleteUser removes an account from the device
+func (d *Device) DeleteUser(log *slog.Logger, username string) error {
+	body := strings.ReplaceAll(deleteUsersBody, "{{username}}", xmlEscape(username))
+	if _, err := d.makeRequest(log, d.Address, body, &emptyResponse{}); err != nil {
+		return fmt.Errorf("failed to delete user %q: %w", username, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package onvif
+
+import (
+	"time"
+)
+
+// Timeouts are how long SOAP requests are given to complete, by operation, as a quick answer is expected from some
+// operations while others can take a while on larger devices such as NVRs with many channels
+type Timeouts struct {
+	// the timeout of operations without their own
+	Default time.Duration
+
+	// timeouts keyed by operation name, e.g. GetProfiles
+	Operations map[string]time.Duration
+}
+
+// DefaultTimeouts are the timeouts used by devices which haven't been given their own
+var DefaultTimeouts = &Timeouts{
+	Default: 5 * time.Second,
+	Operations: map[string]time.Duration{
+		// answered from memory, a device slow to answer these is unlikely to answer anything
+		"GetSystemDateAndTime": 2 * time.Second,
+		"GetDeviceInformation": 3 * time.Second,
+
+		// proportional to the number of channels, an 8 or 16 channel NVR can take several seconds
+		"GetProfiles":                   20 * time.Second,
+		"GetVideoEncoderConfigurations": 15 * time.Second,
+		"GetVideoSources":               10 * time.Second,
+		"GetStreamUri":                  10 * time.Second,
+		"GetSnapshotUri":                10 * time.Second,
+
+		// these write to flash or restart services before answering
+		"SetVideoEncoderConfiguration": 15 * time.Second,
+		"SetImagingSettings":           10 * time.Second,
+		"CreateProfile":                10 * time.Second,
+		"SetNTP":                       10 * time.Second,
+		"CreateUsers":                  10 * time.Second,
+		"SetUser":                      10 * time.Second,
+		"DeleteUsers":                  10 * time.Second,
+		"SetSystemFactoryDefault":      30 * time.Second,
+		"StartFirmwareUpgrade":         30 * time.Second,
+		"UpgradeSystemFirmware":        5 * time.Minute,
+		"RestoreSystem":                2 * time.Minute,
+		"GetSystemBackup":              time.Minute,
+	},
+}
+
+// For returns the timeout of the passed in operation
+func (t *Timeouts) For(operation string) time.Duration {
+	if timeout, found := t.Operations[operation]; found {
+		return timeout
+	}
+	return t.Default
+}
+
+// returns the timeouts of this device, which are the defaults unless it has been given its own
+func (d *Device) timeouts() *Timeouts {
+	if d.Timeouts != nil {
+		return d.Timeouts
+	}
+	return DefaultTimeouts
+}
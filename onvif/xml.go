@@ -0,0 +1,78 @@
+package onvif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// limits on the XML we'll parse from devices, generous for any real response but small enough that a hostile or
+// broken device can't make us do unbounded work
+const (
+	maxXMLBytes      = 1024 * 1024
+	maxXMLDepth      = 64
+	maxXMLAttrs      = 64
+	maxXMLTokenBytes = 64 * 1024
+)
+
+// ErrInvalidXML is returned when XML from a device exceeds our limits or uses features no device response needs
+var ErrInvalidXML = errors.New("invalid xml")
+
+// UnmarshalXML unmarshals XML received from a device into v, first checking it against our limits, DTDs are
+// rejected outright as no SOAP or discovery response should contain one
+func UnmarshalXML(data []byte, v any) error {
+	if err := checkXML(data); err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// walks the tokens of the passed in XML checking each is within our limits
+func checkXML(data []byte) error {
+	if len(data) > maxXMLBytes {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrInvalidXML, len(data), maxXMLBytes)
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidXML, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.Directive:
+			return fmt.Errorf("%w: directives are not allowed", ErrInvalidXML)
+		case xml.StartElement:
+			depth++
+			if depth > maxXMLDepth {
+				return fmt.Errorf("%w: nesting exceeds depth of %d", ErrInvalidXML, maxXMLDepth)
+			}
+			if len(t.Attr) > maxXMLAttrs {
+				return fmt.Errorf("%w: element %s has %d attributes", ErrInvalidXML, t.Name.Local, len(t.Attr))
+			}
+			for _, a := range t.Attr {
+				if len(a.Value) > maxXMLTokenBytes {
+					return fmt.Errorf("%w: attribute %s of element %s is too long", ErrInvalidXML, a.Name.Local, t.Name.Local)
+				}
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if len(t) > maxXMLTokenBytes {
+				return fmt.Errorf("%w: text of %d bytes is too long", ErrInvalidXML, len(t))
+			}
+		}
+	}
+
+	if depth != 0 {
+		return fmt.Errorf("%w: truncated document", ErrInvalidXML)
+	}
+	return nil
+}
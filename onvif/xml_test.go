@@ -0,0 +1,154 @@
+package onvif
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalXML(t *testing.T) {
+	tcs := []struct {
+		name  string
+		xml   string
+		valid bool
+	}{
+		{name: "envelope", xml: `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body/></s:Envelope>`, valid: true},
+		{name: "doctype", xml: `<?xml version="1.0"?><!DOCTYPE a [<!ENTITY b "c">]><a>&b;</a>`},
+		{name: "too deep", xml: strings.Repeat("<a>", maxXMLDepth+1) + strings.Repeat("</a>", maxXMLDepth+1)},
+		{name: "at depth", xml: strings.Repeat("<a>", maxXMLDepth) + strings.Repeat("</a>", maxXMLDepth), valid: true},
+		{name: "too many attributes", xml: "<a" + strings.Repeat(` b="c"`, maxXMLAttrs+1) + "/>"},
+		{name: "long attribute", xml: `<a b="` + strings.Repeat("c", maxXMLTokenBytes+1) + `"/>`},
+		{name: "long text", xml: "<a>" + strings.Repeat("b", maxXMLTokenBytes+1) + "</a>"},
+		{name: "too big", xml: "<a>" + strings.Repeat("<b>c</b>", maxXMLBytes/8) + "</a>"},
+		{name: "truncated", xml: "<a><b>"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var v struct{}
+			err := UnmarshalXML([]byte(tc.xml), &v)
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidXML) {
+				t.Errorf("expected invalid xml error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	tcs := []struct {
+		name  string
+		body  string
+		fault *Fault
+	}{
+		{
+			name:  "subcode",
+			body:  `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault><env:Code><env:Value>env:Sender</env:Value><env:Subcode><env:Value>ter:NotAuthorized</env:Value></env:Subcode></env:Code><env:Reason><env:Text xml:lang="en">Sender not Authorized</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>`,
+			fault: &Fault{Code: "env:Sender", Subcode: "ter:NotAuthorized", Reason: "Sender not Authorized"},
+		},
+		{
+			name:  "nested subcode",
+			body:  `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault><s:Code><s:Value> s:Receiver </s:Value><s:Subcode><s:Value>ter:ActionNotSupported</s:Value><s:Subcode><s:Value>ter:NoSuchService</s:Value></s:Subcode></s:Subcode></s:Code></s:Fault></s:Body></s:Envelope>`,
+			fault: &Fault{Code: "s:Receiver", Subcode: "ter:NoSuchService"},
+		},
+		{
+			name: "not a fault",
+			body: `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><tds:GetDeviceInformationResponse xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/></s:Body></s:Envelope>`,
+		},
+		{
+			name: "not xml",
+			body: `<html><body>401 Unauthorized`,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fault := parseFault([]byte(tc.body))
+			if tc.fault == nil {
+				if fault != nil {
+					t.Errorf("expected no fault, got %v", fault)
+				}
+				return
+			}
+			if fault == nil || *fault != *tc.fault {
+				t.Errorf("expected %+v, got %+v", tc.fault, fault)
+			}
+		})
+	}
+}
+
+// device responses are untrusted input, so whatever a device sends we must neither panic nor exceed our limits
+func FuzzUnmarshalXML(f *testing.F) {
+	f.Add([]byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body/></s:Envelope>`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v struct {
+			Body struct {
+				Any []struct {
+					Text  string   `xml:",chardata"`
+					Attrs []string `xml:",any,attr"`
+				} `xml:",any"`
+			} `xml:"Body"`
+		}
+		err := UnmarshalXML(data, &v)
+		if err != nil {
+			return
+		}
+		if len(data) > maxXMLBytes {
+			t.Errorf("accepted %d bytes of xml", len(data))
+		}
+		if err := checkXML(data); err != nil {
+			t.Errorf("accepted xml which fails our checks: %v", err)
+		}
+	})
+}
+
+func FuzzProbeResponse(f *testing.F) {
+	f.Add([]byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><d:ProbeMatches xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery"><d:ProbeMatch><d:Types>NetworkVideoTransmitter</d:Types><d:XAddrs>http://192.168.1.10/onvif/device_service</d:XAddrs></d:ProbeMatch></d:ProbeMatches></s:Body></s:Envelope>`))
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var resp ProbeResponse
+		if err := UnmarshalXML(data, &resp); err != nil {
+			return
+		}
+
+		for _, srcIP := range []string{"", "192.168.1.10", "fe80::1%eth0"} {
+			devices := resp.Transmitters(log, srcIP)
+			if len(devices) > len(resp.Matches) {
+				t.Fatalf("found %d devices in %d matches", len(devices), len(resp.Matches))
+			}
+			for _, d := range devices {
+				u, err := url.Parse(d.Address)
+				if err != nil || u.Hostname() == "" || u.Port() == "" {
+					t.Errorf("device address %q isn't a url with a host and port", d.Address)
+				}
+			}
+			if deduped := DedupeDevices(devices); len(deduped) > len(devices) {
+				t.Errorf("deduping %d devices gave us %d", len(devices), len(deduped))
+			}
+		}
+	})
+}
+
+func FuzzParseFault(f *testing.F) {
+	f.Add([]byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault><s:Code><s:Value>s:Sender</s:Value></s:Code></s:Fault></s:Body></s:Envelope>`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fault := parseFault(data)
+		if fault == nil {
+			return
+		}
+		if fault.Code == "" && fault.Subcode == "" {
+			t.Errorf("fault without a code from %q", data)
+		}
+		if !strings.HasPrefix(fault.Error(), "soap fault ") {
+			t.Errorf("unexpected fault error %q", fault.Error())
+		}
+	})
+}
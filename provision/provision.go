@@ -0,0 +1,232 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/drift"
+	"github.com/incrementventures/govr/onvif"
+)
+
+// Match selects which cameras a template applies to, a camera matches if it is in one of the groups or its model
+// matches one of the model patterns
+type Match struct {
+	Groups []string `json:"groups,omitempty"`
+
+	// glob patterns matched case insensitively against "<manufacturer> <model>" and the bare model
+	Models []string `json:"models,omitempty"`
+}
+
+// Template is the desired state of the cameras it matches
+type Template struct {
+	Name  string             `json:"name"`
+	Match Match              `json:"match"`
+	State drift.DesiredState `json:"state"`
+}
+
+// Templates is a set of templates along with the groups cameras are assigned to
+type Templates struct {
+	// the addresses of the cameras in each group, addresses can be the device service URL or just its host
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	// templates in priority order, the first one matching a camera is used
+	Templates []Template `json:"templates"`
+}
+
+// LoadTemplates reads templates from the JSON file at the passed in path
+func LoadTemplates(file string) (*Templates, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading templates %q: %w", file, err)
+	}
+
+	t := &Templates{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("error unmarshalling templates %q: %w", file, err)
+	}
+
+	for _, tmpl := range t.Templates {
+		if tmpl.Name == "" {
+			return nil, fmt.Errorf("template without a name in %q", file)
+		}
+		for _, pattern := range tmpl.Match.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid model pattern %q in template %q: %w", pattern, tmpl.Name, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// For returns the first template matching the passed in device, nil if none do
+func (t *Templates) For(d *onvif.Device) *Template {
+	for i := range t.Templates {
+		if t.matches(&t.Templates[i].Match, d) {
+			return &t.Templates[i]
+		}
+	}
+	return nil
+}
+
+func (t *Templates) matches(m *Match, d *onvif.Device) bool {
+	host := hostOf(d.Address)
+	for _, group := range m.Groups {
+		for _, member := range t.Groups[group] {
+			if member == d.Address || member == host {
+				return true
+			}
+		}
+	}
+
+	info := d.DeviceInformation
+	names := []string{
+		strings.ToLower(strings.TrimSpace(info.Manufacturer + " " + info.Model)),
+		strings.ToLower(info.Model),
+	}
+	for _, pattern := range m.Models {
+		for _, name := range names {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the host of a device service URL, or the address unchanged if it isn't one
+func hostOf(address string) string {
+	host := address
+	if _, rest, found := strings.Cut(host, "://"); found {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if h, _, found := strings.Cut(host, ":"); found && !strings.Contains(h, "[") {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// Result is the outcome of provisioning a single camera
+type Result struct {
+	Address  string `json:"address"`
+	Template string `json:"template"`
+
+	// the drift found before and remaining after provisioning
+	Found     []drift.Drift `json:"found"`
+	Remaining []drift.Drift `json:"remaining"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Compliant returns whether the camera matched its template once we were done
+func (r *Result) Compliant() bool {
+	return r.Error == "" && len(r.Remaining) == 0
+}
+
+// Provision checks a probed device against the passed in template, applying it if apply is set and checking again
+func Provision(log *slog.Logger, d *onvif.Device, tmpl *Template, apply bool) Result {
+	result := Result{Address: d.Address, Template: tmpl.Name}
+
+	found, err := drift.Check(log, d, &tmpl.State)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Found = found
+	result.Remaining = found
+	if len(found) == 0 || !apply {
+		return result
+	}
+
+	log.Info("provisioning device", slog.String("address", d.Address), slog.String("template", tmpl.Name), slog.Int("drift", len(found)))
+	correctErr := drift.Correct(log, d, &tmpl.State, found)
+
+	remaining, err := drift.Check(log, d, &tmpl.State)
+	if err != nil {
+		result.Error = errors.Join(correctErr, err).Error()
+		return result
+	}
+	result.Remaining = remaining
+	if correctErr != nil {
+		result.Error = correctErr.Error()
+	}
+	return result
+}
+
+// Entry records when a camera was provisioned and with which template
+type Entry struct {
+	Template      string    `json:"template"`
+	ProvisionedAt time.Time `json:"provisioned_at"`
+	Compliant     bool      `json:"compliant"`
+}
+
+// Ledger persists which cameras have been provisioned so that only newly adopted ones are provisioned by default
+type Ledger struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// OpenLedger loads the ledger at the passed in path, creating an empty one if it doesn't exist
+func OpenLedger(path string) (*Ledger, error) {
+	l := &Ledger{path: path, entries: make(map[string]Entry)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading provisioning ledger %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, &l.entries); err != nil {
+		return nil, fmt.Errorf("error unmarshalling provisioning ledger %q: %w", path, err)
+	}
+	return l, nil
+}
+
+// Provisioned returns whether the camera at the passed in address has been successfully provisioned
+func (l *Ledger) Provisioned(address string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, found := l.entries[address]
+	return found && e.Compliant
+}
+
+// Record saves the passed in result, writing the ledger to disk
+func (l *Ledger) Record(result Result, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[result.Address] = Entry{Template: result.Template, ProvisionedAt: now, Compliant: result.Compliant()}
+
+	b, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling provisioning ledger: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".provisioned-*")
+	if err != nil {
+		return fmt.Errorf("error creating provisioning ledger temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing provisioning ledger: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing provisioning ledger: %w", err)
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
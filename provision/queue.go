@@ -0,0 +1,211 @@
+package provision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/incrementventures/govr/drift"
+	"github.com/incrementventures/govr/onvif"
+)
+
+// how many times we try to apply a change before giving up on it, a camera which is online but won't take a change
+// isn't going to start taking it
+const maxChangeAttempts = 3
+
+type ChangeStatus string
+
+const (
+	ChangePending   ChangeStatus = "pending"
+	ChangeApplying  ChangeStatus = "applying"
+	ChangeApplied   ChangeStatus = "applied"
+	ChangeFailed    ChangeStatus = "failed"
+	ChangeCancelled ChangeStatus = "cancelled"
+)
+
+// Change is a configuration change queued for a camera, applied as soon as the camera is online
+type Change struct {
+	ID     string             `json:"id"`
+	Camera string             `json:"camera"`
+	State  drift.DesiredState `json:"state"`
+
+	Status   ChangeStatus `json:"status"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error,omitempty"`
+
+	// the drift found when the change was applied and any left afterwards
+	Found     []drift.Drift `json:"found,omitempty"`
+	Remaining []drift.Drift `json:"remaining,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Queue persists configuration changes for cameras until they can be applied, so changes requested while a camera is
+// offline are applied when it returns
+type Queue struct {
+	path string
+
+	mu      sync.Mutex
+	changes []*Change
+}
+
+// OpenQueue loads the change queue at the passed in path, creating an empty one if it doesn't exist. Changes which
+// were being applied when we stopped are pending again.
+func OpenQueue(path string) (*Queue, error) {
+	q := &Queue{path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading change queue %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, &q.changes); err != nil {
+		return nil, fmt.Errorf("error unmarshalling change queue %q: %w", path, err)
+	}
+	for _, c := range q.changes {
+		if c.Status == ChangeApplying {
+			c.Status = ChangePending
+		}
+	}
+	return q, nil
+}
+
+// Submit queues the passed in desired state to be applied to the camera with the passed in ID
+func (q *Queue) Submit(camera string, state drift.DesiredState, now time.Time) (Change, error) {
+	if state.Encoder == nil && state.OSDText == nil && state.NTP == nil && len(state.Users) == 0 && !state.ExclusiveUsers {
+		return Change{}, errors.New("change has nothing to apply")
+	}
+
+	state.Camera = camera
+	c := &Change{ID: uuid.NewString(), Camera: camera, State: state, Status: ChangePending, Created: now, Updated: now}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.changes = append(q.changes, c)
+	return *c, q.save()
+}
+
+// Get returns the change with the passed in ID
+func (q *Queue) Get(id string) (Change, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.changes {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return Change{}, false
+}
+
+// Changes returns the changes for the camera with the passed in ID, oldest first
+func (q *Queue) Changes(camera string) []Change {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changes := []Change{}
+	for _, c := range q.changes {
+		if c.Camera == camera {
+			changes = append(changes, *c)
+		}
+	}
+	return changes
+}
+
+// Cancel cancels the pending change with the passed in ID, returning whether it was still pending
+func (q *Queue) Cancel(id string, now time.Time) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.changes {
+		if c.ID == id && c.Status == ChangePending {
+			c.Status, c.Updated = ChangeCancelled, now
+			return true, q.save()
+		}
+	}
+	return false, nil
+}
+
+// Pending returns whether the camera with the passed in ID has changes waiting to be applied
+func (q *Queue) Pending(camera string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return slices.ContainsFunc(q.changes, func(c *Change) bool { return c.Camera == camera && c.Status == ChangePending })
+}
+
+// Apply applies the pending changes of the camera with the passed in ID, in the order they were queued, to the
+// passed in device which should be online. A change which can't be applied stays pending to be tried again the next
+// time the camera returns, until it has been tried too many times.
+func (q *Queue) Apply(log *slog.Logger, camera string, d *onvif.Device) {
+	q.mu.Lock()
+	changes := []*Change{}
+	for _, c := range q.changes {
+		if c.Camera == camera && c.Status == ChangePending {
+			c.Status = ChangeApplying
+			changes = append(changes, c)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, c := range changes {
+		log.Info("applying queued change", slog.String("camera", camera), slog.String("change", c.ID))
+		result := Provision(log, d, &Template{Name: "change " + c.ID, State: c.State}, true)
+
+		q.mu.Lock()
+		c.Attempts++
+		c.Found, c.Remaining, c.Error, c.Updated = result.Found, result.Remaining, result.Error, time.Now()
+		switch {
+		case result.Compliant():
+			c.Status = ChangeApplied
+		case c.Attempts >= maxChangeAttempts:
+			c.Status = ChangeFailed
+		default:
+			c.Status = ChangePending
+		}
+		err := q.save()
+		q.mu.Unlock()
+
+		if err != nil {
+			log.Error("error saving change queue", slog.String("error", err.Error()))
+		}
+		if !result.Compliant() {
+			log.Warn("queued change not applied", slog.String("camera", camera), slog.String("change", c.ID), slog.String("status", string(c.Status)), slog.String("error", result.Error))
+		}
+	}
+}
+
+// save writes the queue to disk atomically, must be called with the lock held
+func (q *Queue) save() error {
+	b, err := json.MarshalIndent(q.changes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling change queue: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".changes-*")
+	if err != nil {
+		return fmt.Errorf("error creating change queue temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing change queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing change queue: %w", err)
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
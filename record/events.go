@@ -0,0 +1,308 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event is something which happened on a camera, such as motion or an alarm, along with the parts of the recording
+// it overlaps so that its footage can be found without searching the index by time
+type Event struct {
+	ID     string    `json:"id"`
+	Camera string    `json:"camera"`
+	Type   string    `json:"type"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+
+	// the segments the event overlaps, oldest first
+	Segments []EventSegment `json:"segments"`
+}
+
+// EventSegment is the part of a segment an event overlaps
+type EventSegment struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+
+	// when the overlap starts, where in the segment that is and how much of the segment the event covers
+	Start    time.Time     `json:"start"`
+	Offset   time.Duration `json:"offset"`
+	Duration time.Duration `json:"duration"`
+}
+
+// returns the part of the passed in segment the event overlaps, false if it doesn't overlap it
+func (e *Event) overlap(s Segment) (EventSegment, bool) {
+	from, to := e.Start, e.End
+	if s.Start.After(from) {
+		from = s.Start
+	}
+	if s.End.Before(to) {
+		to = s.End
+	}
+
+	// an event without a duration is in the segment it happened during
+	instant := e.End.Equal(e.Start) && !e.Start.Before(s.Start) && e.Start.Before(s.End)
+	if !instant && !to.After(from) {
+		return EventSegment{}, false
+	}
+	return EventSegment{ID: s.ID(), Path: s.Path, Start: from, Offset: from.Sub(s.Start), Duration: to.Sub(from)}, true
+}
+
+// links the passed in segment to the event if it overlaps it, returning whether the event changed
+func (e *Event) link(s Segment) bool {
+	linked, found := e.overlap(s)
+	if !found {
+		return false
+	}
+	// segment file names are their start times so a camera's segments sort by path in time order
+	i, exists := slices.BinarySearchFunc(e.Segments, s.Path, func(es EventSegment, path string) int {
+		return strings.Compare(es.Path, path)
+	})
+	if exists {
+		if e.Segments[i] == linked {
+			return false
+		}
+		e.Segments[i] = linked
+		return true
+	}
+	e.Segments = slices.Insert(e.Segments, i, linked)
+	return true
+}
+
+// an entry in the events journal, either storing or removing an event
+type eventEntry struct {
+	Op    string `json:"op"`
+	Event Event  `json:"event"`
+}
+
+const opPut = "put"
+
+// Events stores camera events linked to the segments they overlap, persisted as an append only journal which is
+// compacted each time it is opened. Events are linked to segments already in the index when they are added and to
+// later segments as they complete, so clips for events are a single lookup.
+type Events struct {
+	path  string
+	index *Index
+
+	mu      sync.Mutex
+	journal *os.File
+	events  map[string]*Event
+}
+
+// OpenEvents loads the events at the passed in path, creating an empty store if it doesn't exist. Events are linked
+// to the segments in the passed in index.
+func OpenEvents(path string, index *Index) (*Events, error) {
+	events := &Events{path: path, index: index, events: make(map[string]*Event)}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error opening events %q: %w", path, err)
+	}
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := eventEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// a line cut off by a crash mid write is the only one that can be bad, so stop there
+				break
+			}
+			events.apply(entry)
+		}
+		f.Close()
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	if err := events.compactLocked(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Close closes the events journal
+func (e *Events) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.journal.Close()
+}
+
+// Add stores the passed in event, linking it to the segments of its camera it overlaps, and returns it. An ID is
+// assigned if it has none and an event without an end is taken to be an instant.
+func (e *Events) Add(event Event) (Event, error) {
+	if err := checkCamera(event.Camera); err != nil {
+		return Event{}, err
+	}
+	if event.Start.IsZero() {
+		return Event{}, errors.New("event has no start")
+	}
+	if event.End.IsZero() {
+		event.End = event.Start
+	}
+	if event.End.Before(event.Start) {
+		return Event{}, errors.New("event ends before it starts")
+	}
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	event.Start, event.End = event.Start.UTC(), event.End.UTC()
+
+	// held while we look in the index so a segment completing meanwhile is either found there or linked by Link
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	event.Segments = nil
+	for _, s := range e.index.Segments(event.Camera, event.Start, event.End) {
+		event.link(s.Segment)
+	}
+
+	if err := e.write(eventEntry{Op: opPut, Event: event}); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// Link links the passed in segment to the events of its camera it overlaps, suitable for use as Recorder.OnSegment
+// alongside Index.Add as events are usually added before the segments covering them are complete
+func (e *Events) Link(segment Segment) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, event := range e.events {
+		if event.Camera != segment.Camera {
+			continue
+		}
+		updated := *event
+		updated.Segments = slices.Clone(event.Segments)
+		if !updated.link(segment) {
+			continue
+		}
+		if err := e.write(eventEntry{Op: opPut, Event: updated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlink removes the passed in segment from the events it is linked to, suitable for use as Retention.OnRemove
+// alongside Index.Remove. Events outlive their footage so can still be listed.
+func (e *Events) Unlink(segment Segment) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, event := range e.events {
+		i := slices.IndexFunc(event.Segments, func(es EventSegment) bool { return es.Path == segment.Path })
+		if i < 0 {
+			continue
+		}
+		updated := *event
+		updated.Segments = slices.Delete(slices.Clone(event.Segments), i, i+1)
+		if err := e.write(eventEntry{Op: opPut, Event: updated}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the event with the passed in ID
+func (e *Events) Get(id string) (Event, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	event, found := e.events[id]
+	if !found {
+		return Event{}, false
+	}
+	return *event, true
+}
+
+// List returns the events which overlap the passed in time range, of the passed in camera or all cameras if it is
+// empty, oldest first
+func (e *Events) List(camera string, from, to time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	events := []Event{}
+	for _, event := range e.events {
+		if camera != "" && event.Camera != camera {
+			continue
+		}
+		if event.Start.Before(to) && !event.End.Before(from) {
+			events = append(events, *event)
+		}
+	}
+	slices.SortFunc(events, func(a, b Event) int { return a.Start.Compare(b.Start) })
+	return events
+}
+
+// appends the passed in entry to the journal and applies it, must be called with the lock held
+func (e *Events) write(entry eventEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+	if _, err := e.journal.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing events: %w", err)
+	}
+	e.apply(entry)
+	return nil
+}
+
+// applies the passed in journal entry, must be called with the lock held or before we're shared
+func (e *Events) apply(entry eventEntry) {
+	switch entry.Op {
+	case opPut:
+		event := entry.Event
+		e.events[event.ID] = &event
+	case opRemove:
+		delete(e.events, entry.Event.ID)
+	}
+}
+
+// rewrites the journal as just the events we have, must be called with the lock held
+func (e *Events) compactLocked() error {
+	tmp, err := os.CreateTemp(filepath.Dir(e.path), ".events-*")
+	if err != nil {
+		return fmt.Errorf("error creating events temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, event := range e.events {
+		if err := enc.Encode(eventEntry{Op: opPut, Event: *event}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing events: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing events: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing events: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return fmt.Errorf("error replacing events: %w", err)
+	}
+
+	if e.journal != nil {
+		e.journal.Close()
+	}
+	e.journal, err = os.OpenFile(e.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening events %q: %w", e.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// ErrNoRecording is returned when there is no recording for a camera in a requested time range
+var ErrNoRecording = errors.New("no recording in range")
+
+// ExportRequest describes a clip to export
+type ExportRequest struct {
+	Camera string
+	From   time.Time
+	To     time.Time
+
+	// the MP4 file to write
+	Output string
+
+	// whether to burn the recording time into the video, which means re-encoding it rather than copying
+	Timestamp bool
+}
+
+// Export stitches the segments covering the requested time range into a single MP4, trimmed to the range, gaps in
+// the recording are skipped over rather than filled
+func Export(ctx context.Context, log *slog.Logger, idx *Index, ffmpegPath string, req ExportRequest) error {
+	if !req.To.After(req.From) {
+		return fmt.Errorf("invalid export range %s to %s", req.From, req.To)
+	}
+	segments := idx.Segments(req.Camera, req.From, req.To)
+	if len(segments) == 0 {
+		return ErrNoRecording
+	}
+	start := segments[0].Start
+	if req.From.After(start) {
+		start = req.From
+	}
+	return export(ctx, log, ffmpegPath, req, segmentPaths(segments), start, start.Sub(segments[0].Start), req.To.Sub(start))
+}
+
+// ExportEvent exports the footage of the event with the passed in ID into a single MP4, from the segments it is
+// linked to rather than searching the index, the From and To of the request are ignored
+func ExportEvent(ctx context.Context, log *slog.Logger, events *Events, ffmpegPath string, id string, req ExportRequest) error {
+	event, found := events.Get(id)
+	if !found {
+		return fmt.Errorf("no such event %q", id)
+	}
+	if len(event.Segments) == 0 {
+		return ErrNoRecording
+	}
+
+	paths := make([]string, len(event.Segments))
+	var duration time.Duration
+	for i, s := range event.Segments {
+		paths[i] = s.Path
+		duration += s.Duration
+	}
+
+	// instant events get a little footage either side of them, from within the segment they happened in
+	first := event.Segments[0]
+	offset := first.Offset
+	if duration == 0 {
+		offset = max(offset-instantEventPadding, 0)
+		duration = first.Offset - offset + instantEventPadding
+	}
+
+	req.Camera = event.Camera
+	return export(ctx, log, ffmpegPath, req, paths, first.Start.Add(offset-first.Offset), offset, duration)
+}
+
+// how much footage either side of an event without a duration is exported
+const instantEventPadding = 5 * time.Second
+
+// stitches the segments at the passed in paths into a single MP4, starting at the passed in offset into the first of
+// them, which is the passed in time, and lasting the passed in duration
+func export(ctx context.Context, log *slog.Logger, ffmpegPath string, req ExportRequest, paths []string, start time.Time, offset time.Duration, duration time.Duration) error {
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if req.Timestamp {
+		if err := requireEncoder(ctx, ffmpegPath, "libx264"); err != nil {
+			return err
+		}
+	}
+
+	list, err := writeConcatList(paths)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+
+	// write next to the output and move it into place once complete, so a failed export doesn't leave a broken file
+	tmp := filepath.Join(filepath.Dir(req.Output), "."+filepath.Base(req.Output)+".partial.mp4")
+	defer os.Remove(tmp)
+
+	args := []string{
+		"-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-f", "concat", "-safe", "0",
+		"-ss", formatSeconds(offset),
+		"-i", list,
+		"-t", formatSeconds(duration),
+		"-map", "0:v", "-map", "0:a?",
+	}
+	if req.Timestamp {
+		args = append(args, "-vf", timestampFilter(start), "-c:v", "libx264", "-preset", "veryfast", "-crf", "23")
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+	args = append(args, "-c:a", "aac", "-movflags", "+faststart", "-f", "mp4", tmp)
+
+	log.Info("exporting clip", slog.String("camera", req.Camera), slog.Time("from", start), slog.Duration("duration", duration), slog.Int("segments", len(paths)))
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error exporting clip: %w", ffmpeg.NewExecError(ctx, err, stderr.Bytes()))
+	}
+
+	if err := os.Rename(tmp, req.Output); err != nil {
+		return fmt.Errorf("error moving export into place: %w", err)
+	}
+	return nil
+}
+
+// returns ffmpeg.ErrMissingCodec if the passed in ffmpeg was built without the passed in encoder, which minimal builds
+// can be, so that we say so rather than failing part way through. An ffmpeg we can't probe is left to fail when run.
+func requireEncoder(ctx context.Context, ffmpegPath string, name string) error {
+	host, err := ffmpeg.ProbeHost(ctx, ffmpegPath)
+	if err != nil {
+		return nil
+	}
+	return host.RequireEncoder(name)
+}
+
+// writes a list of the segments at the passed in paths for the concat demuxer to a temporary file and returns its path
+func writeConcatList(paths []string) (string, error) {
+	list, err := os.CreateTemp("", "govr-concat-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating segment list: %w", err)
+	}
+
+	for _, path := range paths {
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	if err := list.Close(); err != nil {
+		os.Remove(list.Name())
+		return "", fmt.Errorf("error writing segment list: %w", err)
+	}
+	return list.Name(), nil
+}
+
+func segmentPaths(segments []IndexedSegment) []string {
+	paths := make([]string, len(segments))
+	for i, s := range segments {
+		paths[i] = s.Path
+	}
+	return paths
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// returns a drawtext filter which shows the UTC time of each frame, counting from the passed in start
+func timestampFilter(start time.Time) string {
+	return fmt.Sprintf(`drawtext=text='%%{pts\:gmtime\:%d}':x=10:y=10:fontsize=24:fontcolor=white:box=1:boxcolor=black@0.5`, start.Unix())
+}
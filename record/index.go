@@ -0,0 +1,279 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// IndexedSegment is a segment in the index along with its size
+type IndexedSegment struct {
+	Segment
+	Bytes int64 `json:"bytes"`
+}
+
+// Gap is a period during which a camera has no recording
+type Gap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// an entry in the index journal, either adding or removing a segment
+type journalEntry struct {
+	Op      string         `json:"op"`
+	Segment IndexedSegment `json:"segment"`
+}
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+)
+
+// Index is an index of recorded segments by camera and time, persisted as an append only journal which is compacted
+// each time it is opened
+type Index struct {
+	path string
+
+	// gaps between segments shorter than this aren't reported, segments are cut on keyframes so rarely line up exactly
+	GapTolerance time.Duration
+
+	mu      sync.Mutex
+	journal *os.File
+	cameras map[string][]IndexedSegment
+}
+
+// OpenIndex loads the index at the passed in path, creating an empty one if it doesn't exist
+func OpenIndex(path string) (*Index, error) {
+	idx := &Index{path: path, GapTolerance: 2 * time.Second, cameras: make(map[string][]IndexedSegment)}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error opening index %q: %w", path, err)
+	}
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := journalEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// a line cut off by a crash mid write is the only one that can be bad, so stop there
+				break
+			}
+			idx.apply(entry)
+		}
+		f.Close()
+	}
+
+	if err := idx.compact(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Rebuild replaces the contents of the index with the segments found in the passed in recording directory
+func (idx *Index) Rebuild(log *slog.Logger, dir string) error {
+	found, err := listSegments(log, dir)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.cameras = make(map[string][]IndexedSegment)
+	for camera, segments := range found {
+		for _, s := range segments {
+			idx.cameras[camera] = append(idx.cameras[camera], IndexedSegment{Segment: s.Segment, Bytes: s.size})
+		}
+	}
+	return idx.compactLocked()
+}
+
+// Close closes the index journal
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.journal.Close()
+}
+
+// Add adds a completed segment to the index, suitable for use as Recorder.OnSegment
+func (idx *Index) Add(segment Segment) error {
+	entry := journalEntry{Op: opAdd, Segment: IndexedSegment{Segment: segment}}
+	if info, err := os.Stat(segment.Path); err == nil {
+		entry.Segment.Bytes = info.Size()
+	}
+	if entry.Segment.End.IsZero() {
+		entry.Segment.End = entry.Segment.Start
+	}
+	return idx.write(entry)
+}
+
+// Remove removes a segment from the index, suitable for use as Retention.OnRemove
+func (idx *Index) Remove(segment Segment) error {
+	return idx.write(journalEntry{Op: opRemove, Segment: IndexedSegment{Segment: segment}})
+}
+
+// Cameras returns the cameras which have segments in the index, sorted
+func (idx *Index) Cameras() []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	cameras := make([]string, 0, len(idx.cameras))
+	for camera, segments := range idx.cameras {
+		if len(segments) > 0 {
+			cameras = append(cameras, camera)
+		}
+	}
+	slices.Sort(cameras)
+	return cameras
+}
+
+// Segments returns the segments of the passed in camera which overlap the passed in time range, oldest first
+func (idx *Index) Segments(camera string, from, to time.Time) []IndexedSegment {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	segments := idx.cameras[camera]
+
+	// segments are sorted by start, so skip straight to the first that starts at or after the range, backing up one
+	// as the segment before it may run into the range
+	i, _ := slices.BinarySearchFunc(segments, from, func(s IndexedSegment, t time.Time) int { return s.Start.Compare(t) })
+	i = max(i-1, 0)
+
+	found := []IndexedSegment{}
+	for ; i < len(segments) && segments[i].Start.Before(to); i++ {
+		if segments[i].End.After(from) || segments[i].Start.Equal(from) {
+			found = append(found, segments[i])
+		}
+	}
+	return found
+}
+
+// Last returns the most recent segment of the passed in camera
+func (idx *Index) Last(camera string) (IndexedSegment, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	segments := idx.cameras[camera]
+	if len(segments) == 0 {
+		return IndexedSegment{}, false
+	}
+	return segments[len(segments)-1], true
+}
+
+// Gaps returns the periods within the passed in time range during which the passed in camera has no recording
+func (idx *Index) Gaps(camera string, from, to time.Time) []Gap {
+	gaps := []Gap{}
+	cursor := from
+	for _, s := range idx.Segments(camera, from, to) {
+		if s.Start.Sub(cursor) > idx.GapTolerance {
+			gaps = append(gaps, Gap{Start: cursor, End: s.Start})
+		}
+		if s.End.After(cursor) {
+			cursor = s.End
+		}
+	}
+	if to.Sub(cursor) > idx.GapTolerance {
+		gaps = append(gaps, Gap{Start: cursor, End: to})
+	}
+	return gaps
+}
+
+// appends the passed in entry to the journal and applies it
+func (idx *Index) write(entry journalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling index entry: %w", err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, err := idx.journal.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	idx.apply(entry)
+	return nil
+}
+
+// applies the passed in journal entry to our in memory index, must be called with the lock held or before we're shared
+func (idx *Index) apply(entry journalEntry) {
+	s := entry.Segment
+	segments := idx.cameras[s.Camera]
+
+	// segments are sorted by start, so any existing entry for this segment is among those with the same start
+	i, _ := slices.BinarySearchFunc(segments, s.Start, func(e IndexedSegment, t time.Time) int { return e.Start.Compare(t) })
+	existing := -1
+	for j := i; j < len(segments) && segments[j].Start.Equal(s.Start); j++ {
+		if segments[j].Path == s.Path {
+			existing = j
+		}
+	}
+
+	switch entry.Op {
+	case opAdd:
+		if existing >= 0 {
+			segments[existing] = s
+			return
+		}
+		idx.cameras[s.Camera] = slices.Insert(segments, i, s)
+	case opRemove:
+		if existing >= 0 {
+			idx.cameras[s.Camera] = slices.Delete(segments, existing, existing+1)
+		}
+	}
+}
+
+func (idx *Index) compact() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.compactLocked()
+}
+
+// rewrites the journal as just the segments currently in the index, must be called with the lock held
+func (idx *Index) compactLocked() error {
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), ".index-*")
+	if err != nil {
+		return fmt.Errorf("error creating index temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, segments := range idx.cameras {
+		for _, s := range segments {
+			if err := enc.Encode(journalEntry{Op: opAdd, Segment: s}); err != nil {
+				tmp.Close()
+				return fmt.Errorf("error writing index: %w", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), idx.path); err != nil {
+		return fmt.Errorf("error replacing index: %w", err)
+	}
+
+	if idx.journal != nil {
+		idx.journal.Close()
+	}
+	idx.journal, err = os.OpenFile(idx.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening index %q: %w", idx.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// files which can't be ingested are moved here, inside the watch directory, so they aren't retried
+const failedDir = ".failed"
+
+// uploads are written with this prefix until complete so the watcher doesn't pick them up half written
+const uploadPrefix = ".upload-"
+
+// the largest upload we accept unless configured otherwise
+const defaultMaxUploadBytes = 4 << 30
+
+// IngestConfig configures ingest of externally produced footage
+type IngestConfig struct {
+	// the directory watched for footage, files in a sub directory are assigned to the camera it is named after
+	Dir string
+
+	// the recording directory ingested footage is moved into
+	RecordDir string
+
+	// the camera footage directly in the watch directory is assigned to, if empty such footage isn't ingested
+	Camera string
+
+	// how often the watch directory is checked and how long a file must go unchanged before we ingest it, so we
+	// don't take files which are still being copied in
+	Interval time.Duration
+	Settle   time.Duration
+
+	// the largest upload accepted over HTTP, 4GiB by default which is hours of body cam footage
+	MaxUploadBytes int64
+
+	// the ffmpeg binary used to remux footage we can't index as is, defaults to ffmpeg on our path
+	FFmpegPath string
+
+	// the ffprobe used to find out what footage holds, nil for one configured by the environment
+	Prober *ffmpeg.Prober
+}
+
+// Ingester watches a directory for video files from other systems, such as body cams, and moves them into the
+// recording directory as segments of a camera so they appear on the same timeline as our own recordings
+type Ingester struct {
+	log *slog.Logger
+	cfg IngestConfig
+
+	// if set, called with each segment once it is ingested and in place
+	OnSegment func(Segment)
+
+	// files waiting to settle, keyed by path
+	pending map[string]pendingFile
+}
+
+type pendingFile struct {
+	size     int64
+	modified time.Time
+	since    time.Time
+}
+
+func NewIngester(log *slog.Logger, cfg IngestConfig) (*Ingester, error) {
+	if cfg.Camera != "" {
+		if err := checkCamera(cfg.Camera); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.Settle <= 0 {
+		cfg.Settle = 10 * time.Second
+	}
+	if cfg.MaxUploadBytes <= 0 {
+		cfg.MaxUploadBytes = defaultMaxUploadBytes
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	if cfg.Prober == nil {
+		cfg.Prober = &ffmpeg.Prober{}
+	}
+	return &Ingester{log: log.With("subsystem", "ingest"), cfg: cfg, pending: make(map[string]pendingFile)}, nil
+}
+
+// Run checks the watch directory for settled files and ingests them until the passed in context is done
+func (i *Ingester) Run(ctx context.Context) error {
+	if err := os.MkdirAll(i.cfg.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating ingest directory: %w", err)
+	}
+
+	ticker := time.NewTicker(i.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, path := range i.settled(time.Now()) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := i.ingestFile(ctx, path); err != nil && ctx.Err() == nil {
+				i.log.Error("error ingesting footage", slog.String("path", path), slog.String("error", err.Error()))
+				i.fail(path)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// returns the files in the watch directory which haven't changed for our settle time
+func (i *Ingester) settled(now time.Time) []string {
+	found := map[string]bool{}
+	ready := []string{}
+
+	check := func(path string) {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		found[path] = true
+
+		p, seen := i.pending[path]
+		if !seen || p.size != info.Size() || !p.modified.Equal(info.ModTime()) {
+			i.pending[path] = pendingFile{size: info.Size(), modified: info.ModTime(), since: now}
+			return
+		}
+		if now.Sub(p.since) >= i.cfg.Settle {
+			ready = append(ready, path)
+			delete(i.pending, path)
+		}
+	}
+
+	entries, err := os.ReadDir(i.cfg.Dir)
+	if err != nil {
+		i.log.Error("error reading ingest directory", slog.String("error", err.Error()))
+		return nil
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(i.cfg.Dir, e.Name())
+		if !e.IsDir() {
+			if i.cfg.Camera != "" {
+				check(path)
+			}
+			continue
+		}
+		if checkCamera(e.Name()) != nil {
+			continue
+		}
+		files, err := os.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+				check(filepath.Join(path, f.Name()))
+			}
+		}
+	}
+
+	// forget files which have gone away
+	for path := range i.pending {
+		if !found[path] {
+			delete(i.pending, path)
+		}
+	}
+	return ready
+}
+
+// returns the camera the file at the passed in path in the watch directory belongs to
+func (i *Ingester) cameraOf(path string) string {
+	if dir := filepath.Dir(path); filepath.Clean(dir) != filepath.Clean(i.cfg.Dir) {
+		return filepath.Base(dir)
+	}
+	return i.cfg.Camera
+}
+
+// ingests the file at the passed in path in the watch directory
+func (i *Ingester) ingestFile(ctx context.Context, path string) error {
+	segment, err := i.Ingest(ctx, i.cameraOf(path), path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		i.log.Warn("error removing ingested footage", slog.String("path", path), slog.String("error", err.Error()))
+	}
+	if i.OnSegment != nil {
+		i.OnSegment(segment)
+	}
+	return nil
+}
+
+// moves a file which couldn't be ingested aside so we don't keep trying
+func (i *Ingester) fail(path string) {
+	dir := filepath.Join(i.cfg.Dir, failedDir)
+	if err := os.MkdirAll(dir, 0755); err == nil {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+		if err == nil {
+			return
+		}
+	}
+	i.log.Error("error moving failed footage aside, removing it", slog.String("path", path))
+	os.Remove(path)
+}
+
+// Ingest probes the video file at the passed in path and copies it into the recording directory as a segment of
+// the passed in camera, leaving the original in place. The time range of the footage is taken from its creation
+// time tag, its name if it is named like one of our segments, or otherwise assumed to end when it was last modified.
+func (i *Ingester) Ingest(ctx context.Context, camera string, path string) (Segment, error) {
+	if err := checkCamera(camera); err != nil {
+		return Segment{}, err
+	}
+
+	probe, err := i.cfg.Prober.ProbeFile(ctx, i.log, path)
+	if err != nil {
+		return Segment{}, err
+	}
+	hasVideo := false
+	for _, s := range probe.Streams {
+		hasVideo = hasVideo || s.CodecType == "video"
+	}
+	if !hasVideo {
+		return Segment{}, fmt.Errorf("no video in %q", path)
+	}
+	duration := time.Duration(probe.Format.Seconds() * float64(time.Second))
+	if duration <= 0 {
+		return Segment{}, fmt.Errorf("unknown duration of %q", path)
+	}
+
+	start, found := footageStart(path, probe.Format.Tags)
+	if !found {
+		start = lastWritten(path, time.Now()).Add(-duration)
+	}
+	start = start.UTC().Truncate(time.Second)
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "."+FormatMP4 && ext != "."+FormatMKV && ext != "."+FormatTS {
+		ext = "." + FormatMKV
+	}
+
+	dir := filepath.Join(i.cfg.RecordDir, camera)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Segment{}, fmt.Errorf("error creating recording directory: %w", err)
+	}
+
+	name := start.Format(segmentLayout) + ext
+	to := filepath.Join(dir, name)
+	if _, err := os.Stat(to); err == nil {
+		return Segment{}, fmt.Errorf("camera %s already has a segment starting at %s", camera, start.Format(time.RFC3339))
+	}
+
+	// hidden until complete, as the recorder's partial directory is its own
+	tmp := filepath.Join(dir, "."+name+".ingest")
+	defer os.Remove(tmp)
+
+	if ext == strings.ToLower(filepath.Ext(path)) {
+		err = copyFile(path, tmp)
+	} else {
+		err = i.remux(ctx, path, tmp)
+	}
+	if err != nil {
+		return Segment{}, err
+	}
+
+	segment, err := PlaceSegment(i.cfg.RecordDir, camera, tmp, ext, start, start.Add(duration))
+	if err != nil {
+		return Segment{}, err
+	}
+
+	i.log.Info("ingested footage", slog.String("camera", camera), slog.String("path", path), slog.Time("start", start), slog.Duration("duration", duration))
+	return segment, nil
+}
+
+// PlaceSegment moves the complete footage at the passed in path into the recording directory as the segment of the
+// passed in camera covering the passed in times, with the passed in extension, named and timestamped like one we
+// recorded ourselves. The footage should already be hidden in the camera's directory so the move is atomic.
+func PlaceSegment(dir string, camera string, path string, ext string, start time.Time, end time.Time) (Segment, error) {
+	if err := checkCamera(camera); err != nil {
+		return Segment{}, err
+	}
+
+	start = start.UTC().Truncate(time.Second)
+	to := filepath.Join(dir, camera, start.Format(segmentLayout)+ext)
+	if _, err := os.Stat(to); err == nil {
+		return Segment{}, fmt.Errorf("camera %s already has a segment starting at %s", camera, start.Format(time.RFC3339))
+	}
+
+	// segment ends are read back from modification times when the index is rebuilt
+	os.Chtimes(path, end, end)
+
+	if err := os.Rename(path, to); err != nil {
+		return Segment{}, fmt.Errorf("error moving segment into place: %w", err)
+	}
+	return Segment{Camera: camera, Path: to, Start: start, End: end}, nil
+}
+
+// remuxes the passed in file into matroska, which takes just about any codec, without transcoding it
+func (i *Ingester) remux(ctx context.Context, from string, to string) error {
+	cmd := exec.CommandContext(ctx, i.cfg.FFmpegPath, "-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-i", from, "-map", "0:v", "-map", "0:a?", "-c", "copy", "-f", "matroska", to)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error remuxing %q: %w", from, ffmpeg.NewExecError(ctx, err, stderr.Bytes()))
+	}
+	return nil
+}
+
+// returns when the footage at the passed in path starts, from its creation time tag or its name
+func footageStart(path string, tags map[string]string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, tags["creation_time"]); err == nil && t.Year() > 1970 {
+		return t, true
+	}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if t, err := time.Parse(segmentLayout, base); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %w", from, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return fmt.Errorf("error creating %q: %w", to, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %q: %w", from, err)
+	}
+	return out.Close()
+}
+
+// ServeHTTP accepts uploads of footage with PUT /<camera>/<filename>, writing them into the watch directory to be
+// ingested like any other file dropped there
+func (i *Ingester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	camera, name, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !found || checkCamera(camera) != nil || name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		http.Error(w, "expected /<camera>/<filename>", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > i.cfg.MaxUploadBytes {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	dir := filepath.Join(i.cfg.Dir, camera)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, "error creating camera directory", http.StatusInternalServerError)
+		return
+	}
+
+	tmp := filepath.Join(dir, uploadPrefix+name)
+	defer os.Remove(tmp)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		http.Error(w, "error creating upload", http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, i.cfg.MaxUploadBytes))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		i.log.Error("error receiving upload", slog.String("camera", camera), slog.String("name", name), slog.String("error", err.Error()))
+		http.Error(w, "error receiving upload", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		http.Error(w, "error moving upload into place", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,68 @@
+package record
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIngesterUpload(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tcs := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		chunked bool
+		status  int
+		file    string
+	}{
+		{name: "upload", method: http.MethodPut, path: "/bodycam/clip.mp4", body: "footage", status: http.StatusAccepted, file: "bodycam/clip.mp4"},
+		{name: "at limit", method: http.MethodPut, path: "/bodycam/clip.mp4", body: strings.Repeat("x", 16), status: http.StatusAccepted, file: "bodycam/clip.mp4"},
+		{name: "declared too large", method: http.MethodPut, path: "/bodycam/clip.mp4", body: strings.Repeat("x", 17), status: http.StatusRequestEntityTooLarge},
+		{name: "streamed too large", method: http.MethodPut, path: "/bodycam/clip.mp4", body: strings.Repeat("x", 17), chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "wrong method", method: http.MethodPost, path: "/bodycam/clip.mp4", body: "footage", status: http.StatusMethodNotAllowed},
+		{name: "no camera", method: http.MethodPut, path: "/clip.mp4", body: "footage", status: http.StatusBadRequest},
+		{name: "hidden file", method: http.MethodPut, path: "/bodycam/.clip.mp4", body: "footage", status: http.StatusBadRequest},
+		{name: "nested", method: http.MethodPut, path: "/bodycam/a/clip.mp4", body: "footage", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ingester, err := NewIngester(log, IngestConfig{Dir: dir, RecordDir: t.TempDir(), MaxUploadBytes: 16})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			ingester.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+
+			// nothing is left behind but a completed upload
+			files := []string{}
+			filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dir, path)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if tc.file == "" && len(files) > 0 || tc.file != "" && (len(files) != 1 || files[0] != tc.file) {
+				t.Errorf("expected file %q, got %v", tc.file, files)
+			}
+		})
+	}
+}
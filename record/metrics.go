@@ -0,0 +1,11 @@
+package record
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+var (
+	segmentLatency = metrics.NewHistogram("govr_record_segment_latency_seconds", "Time between a segment's last write and it being moved into place.", metrics.DefaultBuckets, "camera")
+	segmentsTotal  = metrics.NewCounter("govr_record_segments_total", "Segments written.", "camera")
+	segmentErrors  = metrics.NewCounter("govr_record_segment_errors_total", "Segments which couldn't be moved into place.", "camera")
+)
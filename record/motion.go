@@ -0,0 +1,363 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// FormatTS is the container motion recordings are written in, as it can be cut at any packet and still play
+const FormatTS = "ts"
+
+// the size of an MPEG-TS packet, we read and buffer whole packets
+const tsPacketSize = 188
+
+// MotionConfig configures recording of a single camera only around motion
+type MotionConfig struct {
+	// Format is ignored, SegmentDuration is the longest a single recording gets before it is split in two
+	Config
+
+	// how much of the stream before and after motion to include in a recording
+	PreRoll  time.Duration
+	PostRoll time.Duration
+
+	// the most memory the pre-roll buffer will use, at high bitrates this limits the pre-roll we can keep
+	MaxBufferBytes int
+}
+
+// chunk is a run of stream packets along with when we received them
+type chunk struct {
+	at   time.Time
+	data []byte
+}
+
+// MotionRecorder keeps a rolling buffer of a camera stream in memory and writes it to disk, along with what follows,
+// only once motion is triggered
+type MotionRecorder struct {
+	log *slog.Logger
+	cfg MotionConfig
+
+	// if set, called with each recording once it is complete and in place
+	OnSegment func(Segment)
+
+	// if set, called when motion starts and when it stops, which is once the post-roll after the last trigger is over
+	OnMotion func(active bool, at time.Time)
+
+	process *ffmpeg.Process
+
+	mu       sync.Mutex
+	motion   bool
+	buffer   []chunk
+	buffered int
+	until    time.Time
+	file     *os.File
+	segment  Segment
+	pat, pmt []byte
+	pmtPID   int
+}
+
+func NewMotionRecorder(log *slog.Logger, cfg MotionConfig) (*MotionRecorder, error) {
+	if err := checkCamera(cfg.Camera); err != nil {
+		return nil, err
+	}
+	if cfg.PreRoll <= 0 {
+		cfg.PreRoll = 5 * time.Second
+	}
+	if cfg.PostRoll <= 0 {
+		cfg.PostRoll = 10 * time.Second
+	}
+	if cfg.MaxBufferBytes <= 0 {
+		cfg.MaxBufferBytes = 64 << 20
+	}
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = 5 * time.Minute
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	cfg.Format = FormatTS
+
+	r := &MotionRecorder{log: log.With("subsystem", "record", "camera", cfg.Camera, "mode", "motion"), cfg: cfg, pmtPID: -1}
+	r.process = ffmpeg.NewProcess(r.log, ffmpeg.ProcessConfig{
+		FFmpegPath: cfg.FFmpegPath,
+		Args:       r.args,
+		Output:     r.read,
+		OnStart: func() {
+			r.log.Info("starting motion buffering", slog.Any("url", r.cfg.URL), slog.Duration("pre_roll", r.cfg.PreRoll), slog.Duration("post_roll", r.cfg.PostRoll))
+		},
+		MinBackoff: cfg.MinBackoff,
+		MaxBackoff: cfg.MaxBackoff,
+	})
+	return r, nil
+}
+
+// CameraDir returns the directory recordings for our camera are written to
+func (r *MotionRecorder) CameraDir() string {
+	return filepath.Join(r.cfg.Dir, r.cfg.Camera)
+}
+
+// Trigger starts a recording, including the pre-roll, or extends the one in progress so that it continues for the
+// post-roll after the passed in time, called for each motion or analytics event
+func (r *MotionRecorder) Trigger(now time.Time) {
+	r.mu.Lock()
+	if until := now.Add(r.cfg.PostRoll); until.After(r.until) {
+		r.until = until
+	}
+	started := !r.motion
+	r.motion = true
+	r.mu.Unlock()
+
+	if started && r.OnMotion != nil {
+		r.OnMotion(true, now)
+	}
+}
+
+// Recording returns whether we are currently writing a recording
+func (r *MotionRecorder) Recording() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file != nil
+}
+
+// Run buffers the stream until the passed in context is done, restarting ffmpeg with a backoff whenever it fails
+func (r *MotionRecorder) Run(ctx context.Context) error {
+	partial := filepath.Join(r.CameraDir(), partialDir)
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return fmt.Errorf("error creating recording directory: %w", err)
+	}
+
+	// anything left over is from a crash, as we always finish our recording when the stream breaks
+	r.recoverPartials()
+
+	r.process.Run(ctx)
+	return nil
+}
+
+// Status returns how many times we've had to restart buffering and the last error that caused it
+func (r *MotionRecorder) Status() (int, error) {
+	return r.process.Status()
+}
+
+// LastFrame returns when we last received any of the stream, or when we first started buffering if nothing has been
+// received yet
+func (r *MotionRecorder) LastFrame() time.Time {
+	return r.process.LastProgress()
+}
+
+// Restart stops the current attempt at buffering, which is restarted after the usual backoff, used when the stream
+// has stalled without ffmpeg noticing
+func (r *MotionRecorder) Restart() {
+	r.process.Restart()
+}
+
+// returns the arguments which have ffmpeg remux the stream to MPEG-TS on its stdout
+func (r *MotionRecorder) args() []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-rtsp_transport", "tcp",
+		"-i", r.cfg.URL.Secret(),
+		"-map", "0:v", "-map", "0:a?",
+		"-c", "copy",
+		"-f", "mpegts",
+		"pipe:1",
+	}
+}
+
+// buffers the stream ffmpeg writes to the passed in stdout until it exits, the buffer is stale once the stream breaks
+// so we start afresh after, closing any recording at the point it broke
+func (r *MotionRecorder) read(stdout io.Reader) {
+	defer r.reset()
+
+	// pass on whole packets as soon as we have them, keeping any partial packet for the next read
+	buf := make([]byte, tsPacketSize*64)
+	pending := 0
+	for {
+		n, err := stdout.Read(buf[pending:])
+		pending += n
+		if whole := pending - pending%tsPacketSize; whole > 0 {
+			r.write(bytes.Clone(buf[:whole]), time.Now())
+			pending = copy(buf, buf[whole:pending])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handles a chunk of packets received at the passed in time, adding it to the buffer and the recording if there is one
+func (r *MotionRecorder) write(data []byte, now time.Time) {
+	// motion stopping is reported once we've let go of our lock
+	var stopped time.Time
+	defer func() {
+		if !stopped.IsZero() && r.OnMotion != nil {
+			r.OnMotion(false, stopped)
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.motion && !now.Before(r.until) {
+		r.motion, stopped = false, r.until
+	}
+
+	r.trackTables(data)
+	r.process.Progressed(now)
+
+	r.buffer = append(r.buffer, chunk{at: now, data: data})
+	r.buffered += len(data)
+	for len(r.buffer) > 1 && (now.Sub(r.buffer[0].at) > r.cfg.PreRoll || r.buffered > r.cfg.MaxBufferBytes) {
+		r.buffered -= len(r.buffer[0].data)
+		r.buffer = r.buffer[1:]
+	}
+
+	// long recordings are split, the next one continuing straight on without a pre-roll
+	if r.file != nil && now.Sub(r.segment.Start) >= r.cfg.SegmentDuration {
+		r.finish()
+		if now.Before(r.until) {
+			r.start(now, []chunk{{at: now, data: data}})
+		}
+		return
+	}
+
+	switch {
+	case r.file != nil && !now.Before(r.until):
+		r.finish()
+	case r.file != nil:
+		r.append(data)
+	case now.Before(r.until):
+		r.start(now, r.buffer)
+	}
+}
+
+// opens a new recording, writing the passed in chunks to it, must be called with the lock held
+func (r *MotionRecorder) start(now time.Time, chunks []chunk) {
+	start := now
+	if len(chunks) > 0 {
+		start = chunks[0].at
+	}
+	name := start.UTC().Format(segmentLayout) + "." + FormatTS
+
+	f, err := os.Create(filepath.Join(r.CameraDir(), partialDir, name))
+	if err != nil {
+		r.log.Error("error creating recording", slog.String("segment", name), slog.String("error", err.Error()))
+		return
+	}
+	r.file = f
+	r.segment = Segment{Camera: r.cfg.Camera, Path: filepath.Join(r.CameraDir(), name), Start: start.UTC()}
+	r.log.Info("motion recording started", slog.String("segment", name))
+
+	// the stream tables come first so that players can make sense of the packets before they repeat
+	r.append(r.pat)
+	r.append(r.pmt)
+	for _, c := range chunks {
+		r.append(c.data)
+	}
+}
+
+// writes to the current recording, must be called with the lock held
+func (r *MotionRecorder) append(data []byte) {
+	if r.file == nil || len(data) == 0 {
+		return
+	}
+	if _, err := r.file.Write(data); err != nil {
+		r.log.Error("error writing recording", slog.String("error", err.Error()))
+		r.finish()
+	}
+}
+
+// closes the current recording and moves it into place, must be called with the lock held
+func (r *MotionRecorder) finish() {
+	if r.file == nil {
+		return
+	}
+	f, segment := r.file, r.segment
+	r.file = nil
+
+	if err := f.Close(); err != nil {
+		r.log.Error("error closing recording", slog.String("error", err.Error()))
+	}
+	if err := os.Rename(f.Name(), segment.Path); err != nil {
+		r.log.Error("error moving recording into place", slog.String("segment", segment.Path), slog.String("error", err.Error()))
+		return
+	}
+	segment.End = lastWritten(segment.Path, time.Now())
+	r.log.Info("motion recording complete", slog.String("segment", filepath.Base(segment.Path)))
+
+	if r.OnSegment != nil {
+		r.OnSegment(segment)
+	}
+}
+
+// finishes any recording in progress and empties the buffer
+func (r *MotionRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.finish()
+	r.buffer = nil
+	r.buffered = 0
+	r.pat, r.pmt, r.pmtPID = nil, nil, -1
+}
+
+// keeps the latest PAT and PMT packets from the passed in packets, must be called with the lock held
+func (r *MotionRecorder) trackTables(data []byte) {
+	for i := 0; i+tsPacketSize <= len(data); i += tsPacketSize {
+		packet := data[i : i+tsPacketSize]
+		if packet[0] != 0x47 {
+			continue
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		switch {
+		case pid == 0:
+			r.pat = bytes.Clone(packet)
+			if p := patPMTPID(packet); p >= 0 {
+				r.pmtPID = p
+			}
+		case pid == r.pmtPID:
+			r.pmt = bytes.Clone(packet)
+		}
+	}
+}
+
+// returns the PID of the first program map table in the passed in PAT packet, -1 if there isn't one
+func patPMTPID(packet []byte) int {
+	// skip the header and any adaptation field, then the pointer field
+	offset := 4
+	if packet[3]&0x20 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if offset >= len(packet) {
+		return -1
+	}
+	offset += 1 + int(packet[offset])
+
+	// the section header is 8 bytes, followed by 4 byte program entries and a 4 byte CRC
+	if offset+3 > len(packet) {
+		return -1
+	}
+	sectionLength := int(packet[offset+1]&0x0f)<<8 | int(packet[offset+2])
+	end := min(offset+3+sectionLength-4, len(packet))
+	for i := offset + 8; i+4 <= end; i += 4 {
+		program := int(packet[i])<<8 | int(packet[i+1])
+		if program != 0 {
+			return int(packet[i+2]&0x1f)<<8 | int(packet[i+3])
+		}
+	}
+	return -1
+}
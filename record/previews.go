@@ -0,0 +1,196 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// previews are written here, inside the camera directory, named after their segment
+const previewDir = ".previews"
+
+// PreviewConfig configures generation of preview sprites
+type PreviewConfig struct {
+	// how often to take a thumbnail, each is taken from the nearest keyframe
+	Interval time.Duration
+
+	// the size of each thumbnail and how many are in each row of the sprite
+	Width   int
+	Height  int
+	Columns int
+
+	// how many segments to generate previews for at once
+	Workers int
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+}
+
+// Previews generates a sprite of thumbnails for each recorded segment along with a WebVTT file mapping times to
+// thumbnails within it, so that timeline scrubbers can show previews when hovering
+type Previews struct {
+	log   *slog.Logger
+	cfg   PreviewConfig
+	queue chan Segment
+}
+
+func NewPreviews(log *slog.Logger, cfg PreviewConfig) *Previews {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		cfg.Width, cfg.Height = 160, 90
+	}
+	if cfg.Columns <= 0 {
+		cfg.Columns = 10
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	return &Previews{log: log.With("subsystem", "previews"), cfg: cfg, queue: make(chan Segment, 256)}
+}
+
+// Paths returns where the sprite and VTT file for the passed in segment are written
+func (p *Previews) Paths(segment Segment) (string, string) {
+	base := strings.TrimSuffix(filepath.Base(segment.Path), filepath.Ext(segment.Path))
+	dir := filepath.Join(filepath.Dir(segment.Path), previewDir)
+	return filepath.Join(dir, base+".jpg"), filepath.Join(dir, base+".vtt")
+}
+
+// Enqueue queues the passed in segment to have its preview generated, suitable for use as Recorder.OnSegment, if
+// we are too far behind the segment is dropped rather than holding up the recorder
+func (p *Previews) Enqueue(segment Segment) {
+	select {
+	case p.queue <- segment:
+	default:
+		p.log.Warn("preview queue full, skipping segment", slog.String("segment", segment.Path))
+	}
+}
+
+// Remove removes the preview of the passed in segment, suitable for use as Retention.OnRemove
+func (p *Previews) Remove(segment Segment) {
+	sprite, vtt := p.Paths(segment)
+	for _, path := range []string{sprite, vtt} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.log.Error("error removing preview", slog.String("path", path), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Run generates previews for queued segments until the passed in context is done
+func (p *Previews) Run(ctx context.Context) {
+	done := make(chan struct{})
+	for range p.cfg.Workers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case segment := <-p.queue:
+					if err := p.Generate(ctx, segment); err != nil && ctx.Err() == nil {
+						p.log.Error("error generating preview", slog.String("segment", segment.Path), slog.String("error", err.Error()))
+					}
+				}
+			}
+		}()
+	}
+	for range p.cfg.Workers {
+		<-done
+	}
+}
+
+// Generate writes the sprite and VTT file for the passed in segment
+func (p *Previews) Generate(ctx context.Context, segment Segment) error {
+	sprite, vtt := p.Paths(segment)
+	if err := os.MkdirAll(filepath.Dir(sprite), 0755); err != nil {
+		return fmt.Errorf("error creating preview directory: %w", err)
+	}
+
+	// one thumbnail per interval, rounding up so the end of the segment has one
+	duration := segment.End.Sub(segment.Start)
+	count := max(1, int((duration+p.cfg.Interval-1)/p.cfg.Interval))
+	columns := min(count, p.cfg.Columns)
+	rows := (count + columns - 1) / columns
+
+	filter := fmt.Sprintf(
+		"fps=1/%g,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		p.cfg.Interval.Seconds(), p.cfg.Width, p.cfg.Height, p.cfg.Width, p.cfg.Height, columns, rows,
+	)
+
+	// written to a temporary name and moved into place so readers never see a partial sprite
+	tmp := sprite + ".partial.jpg"
+	defer os.Remove(tmp)
+
+	cmd := exec.CommandContext(ctx, p.cfg.FFmpegPath,
+		"-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-skip_frame", "nokey",
+		"-i", segment.Path,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "5",
+		tmp,
+	)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error extracting thumbnails: %w", ffmpeg.NewExecError(ctx, err, stderr.Bytes()))
+	}
+	if err := os.Rename(tmp, sprite); err != nil {
+		return fmt.Errorf("error moving sprite into place: %w", err)
+	}
+
+	if err := writeFileAtomic(vtt, []byte(p.vtt(filepath.Base(sprite), count, columns, duration))); err != nil {
+		return fmt.Errorf("error writing preview vtt: %w", err)
+	}
+
+	p.log.Debug("preview generated", slog.String("segment", segment.Path), slog.Int("thumbnails", count))
+	return nil
+}
+
+// returns a WebVTT file with a cue for each thumbnail pointing at its region of the sprite
+func (p *Previews) vtt(sprite string, count int, columns int, duration time.Duration) string {
+	b := &strings.Builder{}
+	b.WriteString("WEBVTT\n")
+	for i := range count {
+		start := time.Duration(i) * p.cfg.Interval
+		end := min(start+p.cfg.Interval, max(duration, start+time.Second))
+		x, y := (i%columns)*p.cfg.Width, (i/columns)*p.cfg.Height
+		fmt.Fprintf(b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", formatVTTTime(start), formatVTTTime(end), sprite, x, y, p.cfg.Width, p.cfg.Height)
+	}
+	return b.String()
+}
+
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// writes the passed in data to a temporary file next to path and moves it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
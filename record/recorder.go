@@ -0,0 +1,311 @@
+package record
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// container formats we can record to, fragmented MP4 is written with a .mp4 extension
+const (
+	FormatMP4  = "mp4"
+	FormatFMP4 = "fmp4"
+	FormatMKV  = "mkv"
+)
+
+// the movflags which make ffmpeg write MP4 as a series of self contained fragments, each starting on a keyframe, so
+// a segment cut off mid write loses only its last fragment
+const fragmentedMovflags = "movflags=+frag_keyframe+empty_moov+default_base_moof"
+
+// segments are written here, inside the camera directory, until they are complete
+const partialDir = ".partial"
+
+// the layout of segment file names, which sort in time order
+const segmentLayout = "20060102T150405Z"
+
+// Config configures recording of a single camera
+type Config struct {
+	// the camera we are recording, used as the name of its directory
+	Camera string
+
+	// the stream to record, including credentials
+	URL *creds.URL
+
+	// if set, called before each start of recording for the URL to record in place of URL, for streams whose URL
+	// can't be reused. Restarts pass the error recording stopped with. URL is recorded if this fails.
+	Resolve func(failed error) (*creds.URL, error)
+
+	// the directory camera directories are created in
+	Dir string
+
+	// how long each segment is, segments are cut on the first keyframe after this
+	SegmentDuration time.Duration
+
+	// FormatMP4, FormatFMP4 or FormatMKV, MP4 only records video as cameras rarely send MP4 compatible audio. MP4
+	// segments are lost if we crash while writing them, fragmented MP4 and matroska segments are playable up to the
+	// point we crashed.
+	Format string
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+
+	// how long to wait before restarting after the stream fails, doubled on each consecutive failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Segment is a completed recording segment
+type Segment struct {
+	Camera string    `json:"camera"`
+	Path   string    `json:"path"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// ID returns the identifier of this segment, its camera and file name, which is unique across the recording directory
+func (s Segment) ID() string {
+	return s.Camera + "/" + filepath.Base(s.Path)
+}
+
+// Recorder continuously records a camera stream to fixed duration segments on disk
+type Recorder struct {
+	log *slog.Logger
+	cfg Config
+
+	// if set, called with each segment once it is complete and in place
+	OnSegment func(Segment)
+
+	// the URL being recorded, resolved before each start
+	url *creds.URL
+
+	process *ffmpeg.Process
+}
+
+func NewRecorder(log *slog.Logger, cfg Config) (*Recorder, error) {
+	if err := checkCamera(cfg.Camera); err != nil {
+		return nil, err
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatMP4
+	}
+	if cfg.Format != FormatMP4 && cfg.Format != FormatFMP4 && cfg.Format != FormatMKV {
+		return nil, fmt.Errorf("unsupported recording format: %q", cfg.Format)
+	}
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = time.Minute
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+
+	r := &Recorder{log: log.With("subsystem", "record", "camera", cfg.Camera), cfg: cfg, url: cfg.URL}
+	r.process = ffmpeg.NewProcess(r.log, ffmpeg.ProcessConfig{
+		FFmpegPath: cfg.FFmpegPath,
+		Args:       r.args,
+
+		// segment names are formatted by ffmpeg in local time, so make that UTC
+		Env: []string{"TZ=UTC"},
+
+		// ffmpeg writes the name of each segment to its segment list, which is its stdout, once it is complete
+		Output: func(stdout io.Reader) {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				r.complete(strings.TrimSpace(scanner.Text()))
+			}
+		},
+
+		// anything left over from a previous run is either complete or was cut off mid write
+		OnStart: func() {
+			r.recoverPartials()
+			r.url = r.resolve()
+			r.log.Info("starting recording", slog.Any("url", r.url), slog.Duration("segment", r.cfg.SegmentDuration))
+		},
+		MinBackoff: cfg.MinBackoff,
+		MaxBackoff: cfg.MaxBackoff,
+	})
+	return r, nil
+}
+
+// returns the URL to record this time, resolving it if we can and falling back to the one we were configured with
+func (r *Recorder) resolve() *creds.URL {
+	if r.cfg.Resolve == nil {
+		return r.cfg.URL
+	}
+
+	// every start but the first follows recording stopping
+	var failed error
+	if restarts, err := r.process.Status(); restarts > 0 {
+		failed = err
+	}
+	url, err := r.cfg.Resolve(failed)
+	if err != nil {
+		r.log.Warn("unable to resolve stream url, using the last known", slog.String("error", err.Error()))
+		return r.cfg.URL
+	}
+	return url
+}
+
+// camera names are used as directory names so can't be empty, hidden or contain path separators
+func checkCamera(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid camera name: %q", name)
+	}
+	return nil
+}
+
+// CameraDir returns the directory segments for our camera are written to
+func (r *Recorder) CameraDir() string {
+	return filepath.Join(r.cfg.Dir, r.cfg.Camera)
+}
+
+// Run records until the passed in context is done, restarting ffmpeg with a backoff whenever the stream fails
+func (r *Recorder) Run(ctx context.Context) error {
+	partial := filepath.Join(r.CameraDir(), partialDir)
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return fmt.Errorf("error creating recording directory: %w", err)
+	}
+
+	// there's no point retrying without an ffmpeg to run
+	if _, err := ffmpeg.ProbeHost(ctx, r.cfg.FFmpegPath); ffmpeg.KindOf(err) == ffmpeg.KindNotInstalled {
+		return fmt.Errorf("error starting recording: %w", err)
+	}
+
+	r.process.Run(ctx)
+	r.recoverPartials()
+	return nil
+}
+
+// Status returns how many times we've had to restart recording and the last error that caused it
+func (r *Recorder) Status() (int, error) {
+	return r.process.Status()
+}
+
+// LastFrame returns when we last received any of the stream, or when we first started recording if nothing has been
+// received yet
+func (r *Recorder) LastFrame() time.Time {
+	return r.process.LastProgress()
+}
+
+// Restart stops the current attempt at recording, which is restarted after the usual backoff, used when the stream
+// has stalled without ffmpeg noticing
+func (r *Recorder) Restart() {
+	r.process.Restart()
+}
+
+func (r *Recorder) args() []string {
+	partial := filepath.Join(r.CameraDir(), partialDir)
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-rtsp_transport", "tcp",
+		"-i", r.url.Secret(),
+	}
+
+	if r.cfg.Format == FormatMP4 || r.cfg.Format == FormatFMP4 {
+		args = append(args, "-map", "0:v")
+		if r.cfg.Format == FormatFMP4 || r.fragmented() {
+			args = append(args, "-segment_format_options", fragmentedMovflags)
+		}
+	} else {
+		args = append(args, "-map", "0:v", "-map", "0:a?")
+	}
+
+	return append(args,
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(r.cfg.SegmentDuration.Seconds(), 'f', -1, 64),
+		"-segment_format", map[string]string{FormatMP4: "mp4", FormatFMP4: "mp4", FormatMKV: "matroska"}[r.cfg.Format],
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		"-segment_list", "pipe:1",
+		"-segment_list_type", "flat",
+		filepath.Join(partial, "%Y%m%dT%H%M%SZ."+r.ext()),
+	)
+}
+
+// returns the file extension of our segments
+func (r *Recorder) ext() string {
+	if r.cfg.Format == FormatFMP4 {
+		return FormatMP4
+	}
+	return r.cfg.Format
+}
+
+// moves the passed in complete segment from our partial directory into the camera directory, the rename is atomic
+// so readers of the camera directory never see a segment which is still being written
+func (r *Recorder) complete(name string) {
+	name = filepath.Base(name)
+	if name == "." || name == "" {
+		return
+	}
+
+	from := filepath.Join(r.CameraDir(), partialDir, name)
+	to := filepath.Join(r.CameraDir(), name)
+	if err := os.Rename(from, to); err != nil {
+		segmentErrors.With(r.cfg.Camera).Inc()
+		r.log.Error("error moving segment into place", slog.String("segment", name), slog.String("error", err.Error()))
+		return
+	}
+
+	segment := Segment{Camera: r.cfg.Camera, Path: to}
+	segment.Start, _ = time.Parse(segmentLayout, strings.TrimSuffix(name, filepath.Ext(name)))
+	segment.End = lastWritten(to, time.Now())
+	segmentLatency.With(r.cfg.Camera).Since(segment.End)
+	segmentsTotal.With(r.cfg.Camera).Inc()
+	r.log.Debug("segment complete", slog.String("segment", name))
+
+	if r.OnSegment != nil {
+		r.OnSegment(segment)
+	}
+}
+
+// returns when the file at the passed in path was last written, which for a segment is when it ends
+func lastWritten(path string, fallback time.Time) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fallback.UTC()
+	}
+	return info.ModTime().UTC()
+}
+
+// tailBuffer keeps the last max bytes written to it, enough to report why ffmpeg exited
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf
+}
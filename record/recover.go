@@ -0,0 +1,144 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// partial segments which can't be repaired are moved here, inside the camera directory, rather than being discarded
+const damagedDir = ".damaged"
+
+// the presence of this file in a camera directory means its MP4 segments are written fragmented, which is switched
+// to once a segment has been lost to a crash so that the next one can be salvaged, cameras recorded as FormatFMP4 are
+// always fragmented
+const fragmentedMarker = ".fragmented"
+
+// how long a single repair is given, segments are short so this is generous
+const repairTimeout = 2 * time.Minute
+
+// deals with segments left in our partial directory when ffmpeg exited or we crashed. Matroska segments are playable
+// up to where they were cut off so are kept as they are, MP4 segments are remuxed which works for fragmented segments
+// and any which were finished but not yet moved into place. Those which can't be salvaged are moved aside and further
+// segments are recorded fragmented.
+func (r *Recorder) recoverPartials() {
+	partial := filepath.Join(r.CameraDir(), partialDir)
+	entries, err := os.ReadDir(partial)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || e.Name()[0] == '.' {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case "." + FormatMKV:
+			r.complete(e.Name())
+
+		case "." + FormatMP4:
+			path := filepath.Join(partial, e.Name())
+			if err := r.repair(path); err != nil {
+				r.log.Warn("unable to repair partial segment", slog.String("segment", e.Name()), slog.String("error", err.Error()))
+				r.damaged(path)
+				continue
+			}
+			r.log.Info("repaired partial segment", slog.String("segment", e.Name()))
+			r.complete(e.Name())
+
+		default:
+			os.Remove(filepath.Join(partial, e.Name()))
+		}
+	}
+}
+
+// remuxes the MP4 segment at the passed in path in place, which gives it the index it was missing if it was written
+// fragmented, keeping its modification time as that is when it ends
+func (r *Recorder) repair(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return errors.New("segment is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+	defer cancel()
+
+	tmp := filepath.Join(filepath.Dir(path), ".repair-"+filepath.Base(path))
+	defer os.Remove(tmp)
+
+	cmd := exec.CommandContext(ctx, r.cfg.FFmpegPath, "-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-i", path, "-map", "0", "-c", "copy", "-movflags", "+faststart", "-f", "mp4", tmp)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error remuxing segment: %w", ffmpeg.NewExecError(ctx, err, stderr.Bytes()))
+	}
+
+	if repaired, err := os.Stat(tmp); err != nil || repaired.Size() == 0 {
+		return errors.New("remuxed segment is empty")
+	}
+	os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	return os.Rename(tmp, path)
+}
+
+// moves a partial segment which can't be salvaged aside and switches to recording fragmented segments
+func (r *Recorder) damaged(path string) {
+	dir := filepath.Join(r.CameraDir(), damagedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil || os.Rename(path, filepath.Join(dir, filepath.Base(path))) != nil {
+		r.log.Error("error moving damaged segment aside, removing it", slog.String("segment", filepath.Base(path)))
+		os.Remove(path)
+	}
+
+	if r.cfg.Format == FormatMP4 && !r.fragmented() {
+		r.log.Warn("segment lost to a crash, recording fragmented segments from now on")
+		if err := os.WriteFile(filepath.Join(r.CameraDir(), fragmentedMarker), nil, 0644); err != nil {
+			r.log.Error("error marking camera as fragmented", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// returns whether our MP4 segments are written fragmented
+func (r *Recorder) fragmented() bool {
+	_, err := os.Stat(filepath.Join(r.CameraDir(), fragmentedMarker))
+	return err == nil
+}
+
+// moves recordings left in our partial directory by a crash into place, MPEG-TS is playable up to where it was cut off
+func (r *MotionRecorder) recoverPartials() {
+	partial := filepath.Join(r.CameraDir(), partialDir)
+	entries, err := os.ReadDir(partial)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != "."+FormatTS {
+			continue
+		}
+		segment := Segment{Camera: r.cfg.Camera, Path: filepath.Join(r.CameraDir(), e.Name())}
+		if segment.Start, err = time.Parse(segmentLayout, strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))); err != nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(partial, e.Name()), segment.Path); err != nil {
+			r.log.Error("error moving recovered recording into place", slog.String("segment", e.Name()), slog.String("error", err.Error()))
+			continue
+		}
+		segment.End = lastWritten(segment.Path, time.Now())
+		r.log.Info("recovered motion recording", slog.String("segment", e.Name()))
+
+		if r.OnSegment != nil {
+			r.OnSegment(segment)
+		}
+	}
+}
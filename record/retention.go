@@ -0,0 +1,272 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota limits how much recording is kept, zero fields are unlimited
+type Quota struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+}
+
+// RetentionConfig configures which recordings are kept
+type RetentionConfig struct {
+	// the directory camera directories are in, the same as recorders write to
+	Dir string
+
+	// the limit across all cameras, and the default age limit for each camera
+	Global Quota
+
+	// limits for individual cameras, a zero max age falls back to the global one
+	Cameras map[string]Quota
+
+	// how often we enforce our quotas
+	Interval time.Duration
+}
+
+// Usage is the disk space used by the recordings of a camera
+type Usage struct {
+	Camera   string    `json:"camera"`
+	Bytes    int64     `json:"bytes"`
+	Segments int       `json:"segments"`
+	Oldest   time.Time `json:"oldest"`
+	Newest   time.Time `json:"newest"`
+}
+
+// Retention deletes the oldest recording segments to keep within per camera and global quotas
+type Retention struct {
+	log *slog.Logger
+	cfg RetentionConfig
+
+	// if set, called with each segment we remove
+	OnRemove func(Segment)
+
+	mu      sync.Mutex
+	usage   []Usage
+	deleted int
+}
+
+func NewRetention(log *slog.Logger, cfg RetentionConfig) *Retention {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	return &Retention{log: log.With("subsystem", "retention"), cfg: cfg}
+}
+
+// SetQuotas replaces our global and per camera quotas from the next enforcement on
+func (r *Retention) SetQuotas(global Quota, cameras map[string]Quota) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cfg.Global, r.cfg.Cameras = global, cameras
+}
+
+// Usage returns the disk usage of each camera, sorted by camera, as of our last enforcement
+func (r *Retention) Usage() []Usage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.usage)
+}
+
+// Deleted returns how many segments we've deleted since we started
+func (r *Retention) Deleted() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deleted
+}
+
+// Run enforces our quotas every interval until the passed in context is done
+func (r *Retention) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Enforce(time.Now()); err != nil {
+			r.log.Error("error enforcing retention", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type segmentFile struct {
+	Segment
+	size int64
+}
+
+// Enforce deletes segments older than their age limit, then the oldest segments of each camera over its byte
+// limit, then the oldest segments across all cameras until we are within the global byte limit
+func (r *Retention) Enforce(now time.Time) error {
+	cameras, err := listSegments(r.log, r.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	global, quotas := r.cfg.Global, r.cfg.Cameras
+	r.mu.Unlock()
+
+	errs := []error{}
+	deleted := 0
+	remove := func(s segmentFile) bool {
+		if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("error removing segment: %w", err))
+			return false
+		}
+		r.log.Debug("removed segment", slog.String("camera", s.Camera), slog.String("segment", s.Path))
+		deleted++
+		if r.OnRemove != nil {
+			r.OnRemove(s.Segment)
+		}
+		return true
+	}
+
+	kept := []segmentFile{}
+	for camera, segments := range cameras {
+		quota := quotas[camera]
+		if quota.MaxAge <= 0 {
+			quota.MaxAge = global.MaxAge
+		}
+
+		total := int64(0)
+		for _, s := range segments {
+			total += s.size
+		}
+
+		// segments are sorted oldest first, so we delete from the front until the rest are within quota
+		i := 0
+		for ; i < len(segments); i++ {
+			s := segments[i]
+			expired := quota.MaxAge > 0 && now.Sub(s.Start) > quota.MaxAge
+			oversize := quota.MaxBytes > 0 && total > quota.MaxBytes
+			if !expired && !oversize {
+				break
+			}
+			if !remove(s) {
+				break
+			}
+			total -= s.size
+		}
+		kept = append(kept, segments[i:]...)
+	}
+
+	if global.MaxBytes > 0 {
+		slices.SortFunc(kept, func(a, b segmentFile) int { return a.Start.Compare(b.Start) })
+
+		total := int64(0)
+		for _, s := range kept {
+			total += s.size
+		}
+
+		i := 0
+		for ; i < len(kept) && total > global.MaxBytes; i++ {
+			if !remove(kept[i]) {
+				break
+			}
+			total -= kept[i].size
+		}
+		kept = kept[i:]
+	}
+
+	r.mu.Lock()
+	r.usage = usageOf(kept)
+	r.deleted += deleted
+	r.mu.Unlock()
+
+	if deleted > 0 {
+		r.log.Info("removed segments over retention", slog.Int("segments", deleted))
+	}
+	return errors.Join(errs...)
+}
+
+// returns the complete segments of each camera in the passed in recording directory, oldest first
+func listSegments(log *slog.Logger, dir string) (map[string][]segmentFile, error) {
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording directory: %w", err)
+	}
+
+	cameras := map[string][]segmentFile{}
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+
+		camera := d.Name()
+		entries, err := os.ReadDir(filepath.Join(dir, camera))
+		if err != nil {
+			log.Error("error reading camera directory", slog.String("camera", camera), slog.String("error", err.Error()))
+			continue
+		}
+
+		segments := []segmentFile{}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			ext := filepath.Ext(e.Name())
+			if ext != "."+FormatMP4 && ext != "."+FormatMKV && ext != "."+FormatTS {
+				continue
+			}
+			start, err := time.Parse(segmentLayout, strings.TrimSuffix(e.Name(), ext))
+			if err != nil {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			segments = append(segments, segmentFile{
+				Segment: Segment{Camera: camera, Path: filepath.Join(dir, camera, e.Name()), Start: start, End: info.ModTime().UTC()},
+				size:    info.Size(),
+			})
+		}
+
+		slices.SortFunc(segments, func(a, b segmentFile) int { return a.Start.Compare(b.Start) })
+		cameras[camera] = segments
+	}
+	return cameras, nil
+}
+
+// returns the usage of each camera with segments in the passed in list, sorted by camera
+func usageOf(segments []segmentFile) []Usage {
+	byCamera := map[string]*Usage{}
+	for _, s := range segments {
+		u := byCamera[s.Camera]
+		if u == nil {
+			u = &Usage{Camera: s.Camera, Oldest: s.Start, Newest: s.Start}
+			byCamera[s.Camera] = u
+		}
+		u.Bytes += s.size
+		u.Segments++
+		if s.Start.Before(u.Oldest) {
+			u.Oldest = s.Start
+		}
+		if s.Start.After(u.Newest) {
+			u.Newest = s.Start
+		}
+	}
+
+	usage := []Usage{}
+	for _, u := range byCamera {
+		usage = append(usage, *u)
+	}
+	slices.SortFunc(usage, func(a, b Usage) int { return strings.Compare(a.Camera, b.Camera) })
+	return usage
+}
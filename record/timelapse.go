@@ -0,0 +1,261 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/incrementventures/govr/ffmpeg"
+)
+
+// ErrQueueFull is returned when a job can't be queued as too many are already waiting
+var ErrQueueFull = errors.New("queue full")
+
+// TimelapseRequest describes a time-lapse to generate
+type TimelapseRequest struct {
+	Camera string    `json:"camera"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+
+	// how many times faster than real time the time-lapse plays, 60 turns an hour into a minute
+	Speed float64 `json:"speed"`
+
+	// the MP4 file to write
+	Output string `json:"output"`
+
+	// whether to burn the recording time into the video
+	Timestamp bool `json:"timestamp"`
+}
+
+// TimelapseConfig configures time-lapse generation
+type TimelapseConfig struct {
+	// the frame rate of generated time-lapses
+	FPS int
+
+	// how many time-lapses to generate at once and how many can be waiting
+	Workers   int
+	QueueSize int
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+}
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// TimelapseJob is a queued time-lapse and its progress
+type TimelapseJob struct {
+	ID       string           `json:"id"`
+	Request  TimelapseRequest `json:"request"`
+	Status   JobStatus        `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Created  time.Time        `json:"created"`
+	Finished time.Time        `json:"finished"`
+}
+
+// Timelapses generates time-lapses from recorded segments on demand, queueing requests for a fixed pool of workers
+// as each one means decoding the whole range
+type Timelapses struct {
+	log   *slog.Logger
+	cfg   TimelapseConfig
+	idx   *Index
+	queue chan string
+
+	mu   sync.Mutex
+	jobs map[string]*TimelapseJob
+}
+
+func NewTimelapses(log *slog.Logger, cfg TimelapseConfig, idx *Index) *Timelapses {
+	if cfg.FPS <= 0 {
+		cfg.FPS = 30
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 16
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	return &Timelapses{log: log.With("subsystem", "timelapse"), cfg: cfg, idx: idx, queue: make(chan string, cfg.QueueSize), jobs: make(map[string]*TimelapseJob)}
+}
+
+// Submit queues the passed in request, returning its job which can be followed with Job
+func (t *Timelapses) Submit(req TimelapseRequest) (TimelapseJob, error) {
+	if !req.To.After(req.From) {
+		return TimelapseJob{}, fmt.Errorf("invalid time-lapse range %s to %s", req.From, req.To)
+	}
+	if req.Speed <= 1 {
+		return TimelapseJob{}, fmt.Errorf("invalid time-lapse speed %g, must be greater than 1", req.Speed)
+	}
+	if len(t.idx.Segments(req.Camera, req.From, req.To)) == 0 {
+		return TimelapseJob{}, ErrNoRecording
+	}
+
+	job := &TimelapseJob{ID: uuid.NewString(), Request: req, Status: JobQueued, Created: time.Now()}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case t.queue <- job.ID:
+	default:
+		return TimelapseJob{}, ErrQueueFull
+	}
+	t.jobs[job.ID] = job
+	return *job, nil
+}
+
+// Job returns the job with the passed in id
+func (t *Timelapses) Job(id string) (TimelapseJob, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	job, found := t.jobs[id]
+	if !found {
+		return TimelapseJob{}, false
+	}
+	return *job, true
+}
+
+// Forget removes a finished job, it is up to callers whether they also remove its output
+func (t *Timelapses) Forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if job, found := t.jobs[id]; found && (job.Status == JobDone || job.Status == JobFailed) {
+		delete(t.jobs, id)
+	}
+}
+
+// Run generates queued time-lapses until the passed in context is done
+func (t *Timelapses) Run(ctx context.Context) {
+	done := make(chan struct{})
+	for range t.cfg.Workers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-t.queue:
+					t.process(ctx, id)
+				}
+			}
+		}()
+	}
+	for range t.cfg.Workers {
+		<-done
+	}
+}
+
+// generates the time-lapse for the job with the passed in id, recording how it went
+func (t *Timelapses) process(ctx context.Context, id string) {
+	t.mu.Lock()
+	job := t.jobs[id]
+	job.Status = JobRunning
+	req := job.Request
+	t.mu.Unlock()
+
+	err := Timelapse(ctx, t.log, t.idx, t.cfg.FFmpegPath, t.cfg.FPS, req)
+	if err != nil && ctx.Err() == nil {
+		t.log.Error("error generating time-lapse", slog.String("camera", req.Camera), slog.String("job", id), slog.String("error", err.Error()))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job.Finished = time.Now()
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+	} else {
+		job.Status = JobDone
+	}
+}
+
+// Timelapse speeds up the segments covering the requested time range into a single silent MP4 at the passed in
+// frame rate, gaps in the recording are skipped over
+func Timelapse(ctx context.Context, log *slog.Logger, idx *Index, ffmpegPath string, fps int, req TimelapseRequest) error {
+	if !req.To.After(req.From) {
+		return fmt.Errorf("invalid time-lapse range %s to %s", req.From, req.To)
+	}
+	segments := idx.Segments(req.Camera, req.From, req.To)
+	if len(segments) == 0 {
+		return ErrNoRecording
+	}
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if err := requireEncoder(ctx, ffmpegPath, "libx264"); err != nil {
+		return err
+	}
+
+	list, err := writeConcatList(segmentPaths(segments))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+
+	start := segments[0].Start
+	if req.From.After(start) {
+		start = req.From
+	}
+	offset := start.Sub(segments[0].Start)
+	duration := req.To.Sub(start)
+
+	tmp := filepath.Join(filepath.Dir(req.Output), "."+filepath.Base(req.Output)+".partial.mp4")
+	defer os.Remove(tmp)
+
+	args := []string{"-hide_banner", "-nostdin", "-loglevel", "error", "-y"}
+
+	// once sped up enough that only a frame or two per keyframe interval survives, decoding the rest is wasted
+	if req.Speed/float64(fps) >= 2 {
+		args = append(args, "-skip_frame", "nokey")
+	}
+
+	// the timestamp is drawn before speeding up so it shows the time each frame was recorded
+	filter := fmt.Sprintf("setpts=(PTS-STARTPTS)/%s,fps=%d", strconv.FormatFloat(req.Speed, 'f', -1, 64), fps)
+	if req.Timestamp {
+		filter = timestampFilter(start) + "," + filter
+	}
+
+	args = append(args,
+		"-f", "concat", "-safe", "0",
+		"-ss", formatSeconds(offset),
+		// limits what we read rather than what we write, which is sped up
+		"-t", formatSeconds(duration),
+		"-i", list,
+		"-map", "0:v", "-an",
+		"-vf", filter,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart", "-f", "mp4", tmp,
+	)
+
+	log.Info("generating time-lapse", slog.String("camera", req.Camera), slog.Time("from", start), slog.Duration("duration", duration), slog.Float64("speed", req.Speed))
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error generating time-lapse: %w", ffmpeg.NewExecError(ctx, err, stderr.Bytes()))
+	}
+
+	if err := os.Rename(tmp, req.Output); err != nil {
+		return fmt.Errorf("error moving time-lapse into place: %w", err)
+	}
+	return nil
+}
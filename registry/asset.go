@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the layout of the dates of an asset, which are days rather than instants
+const dateLayout = time.DateOnly
+
+// ErrInvalidAsset is returned when asset details can't be saved as given, such as for a date which isn't one
+var ErrInvalidAsset = errors.New("invalid asset")
+
+// Asset is what we know of a camera as a piece of equipment, entered by hand so that we can double as the inventory of
+// the cameras we record. Dates are in the form 2006-01-02.
+type Asset struct {
+	Notes    string `json:"notes,omitempty"`
+	Location string `json:"location,omitempty"`
+
+	// the switch and port the camera is plugged into, which is also where it gets its power from
+	Switch     string `json:"switch,omitempty"`
+	SwitchPort string `json:"switch_port,omitempty"`
+
+	InstalledOn   string `json:"installed_on,omitempty"`
+	WarrantyUntil string `json:"warranty_until,omitempty"`
+
+	// anything else worth keeping, such as an asset tag or the contractor who installed it
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// Validate returns an error wrapping ErrInvalidAsset if the asset has a malformed date or a custom field without a name
+func (a *Asset) Validate() error {
+	for name, date := range map[string]string{"installed_on": a.InstalledOn, "warranty_until": a.WarrantyUntil} {
+		if _, err := time.Parse(dateLayout, date); date != "" && err != nil {
+			return fmt.Errorf("%w: %s must be a date such as 2024-01-31", ErrInvalidAsset, name)
+		}
+	}
+	for name := range a.Fields {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("%w: custom fields must have a name", ErrInvalidAsset)
+		}
+	}
+	return nil
+}
+
+// WarrantyExpired returns whether the camera's warranty ended before the passed in time, false if we don't know when
+// it ends
+func (a *Asset) WarrantyExpired(now time.Time) bool {
+	until, err := time.ParseInLocation(dateLayout, a.WarrantyUntil, now.Location())
+	if err != nil {
+		return false
+	}
+	return !now.Before(until.AddDate(0, 0, 1))
+}
+
+// empty returns whether nothing is known of the asset
+func (a *Asset) empty() bool {
+	return a.Notes == "" && a.Location == "" && a.Switch == "" && a.SwitchPort == "" && a.InstalledOn == "" &&
+		a.WarrantyUntil == "" && len(a.Fields) == 0
+}
@@ -0,0 +1,369 @@
+package registry
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/incrementventures/govr/scan"
+)
+
+// Camera is a device we've seen along with the stable ID we've assigned it, which stays the same as its address
+// changes so that recordings and API links keep pointing at the same camera
+type Camera struct {
+	ID string `json:"id"`
+
+	// what identifies the device regardless of its address, any of which matching means it is the same device
+	Serial   string `json:"serial,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+
+	// where we last saw the device and the key the monitor knows it by, which for devices without a serial or MAC
+	// changes with its address
+	Key     string `json:"key"`
+	Address string `json:"address"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// whether the camera is waiting to be adopted, or has been rejected, either of which means it is never recorded
+	Pending  bool `json:"pending,omitempty"`
+	Rejected bool `json:"rejected,omitempty"`
+
+	// the firmware versions the camera has reported, oldest first, so the last is what it is running now
+	Firmware []FirmwareVersion `json:"firmware,omitempty"`
+
+	// what we've been told of the camera as a piece of equipment, replaced as a whole rather than changed in place
+	// as copies of cameras share it
+	Asset *Asset `json:"asset,omitempty"`
+}
+
+// FirmwareVersion is a firmware version a camera has run and when we first saw it running it
+type FirmwareVersion struct {
+	Version string    `json:"version"`
+	Seen    time.Time `json:"seen"`
+}
+
+// CurrentFirmware returns the firmware version the camera last reported, empty if it never has
+func (c *Camera) CurrentFirmware() string {
+	if len(c.Firmware) == 0 {
+		return ""
+	}
+	return c.Firmware[len(c.Firmware)-1].Version
+}
+
+// Adopted returns whether the camera has been approved for use
+func (c *Camera) Adopted() bool {
+	return !c.Pending && !c.Rejected
+}
+
+// matches returns whether the passed in record is the same device as this camera
+func (c *Camera) matches(r scan.Record) bool {
+	switch {
+	case c.Serial != "" && r.Serial != "":
+		// serials are only unique per manufacturer but a clash on one network is vanishingly rare
+		return c.Serial == r.Serial
+	case c.Endpoint != "" && r.Endpoint != "":
+		return strings.EqualFold(c.Endpoint, r.Endpoint)
+	case c.MAC != "" && r.MAC != "":
+		return strings.EqualFold(c.MAC, r.MAC)
+	}
+	// with nothing better to go on we can only assume a device at the same address is the same one
+	return c.Address == r.Address
+}
+
+// Cameras assigns stable IDs to devices, persisted to a JSON file
+type Cameras struct {
+	path string
+
+	mu      sync.Mutex
+	cameras []*Camera
+}
+
+// OpenCameras loads the camera registry at the passed in path, creating an empty one if it doesn't exist
+func OpenCameras(path string) (*Cameras, error) {
+	c := &Cameras{path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading camera registry %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, &c.cameras); err != nil {
+		return nil, fmt.Errorf("error unmarshalling camera registry %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// Observe records that the passed in device has been seen, returning its camera which is created with a new ID,
+// pending adoption, if we haven't seen it before, and otherwise updated with its current address
+func (c *Cameras) Observe(r scan.Record, now time.Time) (Camera, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var camera *Camera
+	for _, existing := range c.cameras {
+		if existing.matches(r) {
+			camera = existing
+			break
+		}
+	}
+
+	if camera == nil {
+		camera = &Camera{ID: c.newID(), FirstSeen: now, Pending: true}
+		c.cameras = append(c.cameras, camera)
+	}
+
+	before := *camera
+	camera.Key, camera.Address, camera.LastSeen = r.Key, r.Address, now
+	camera.Serial = cmp.Or(r.Serial, camera.Serial)
+	camera.Endpoint = cmp.Or(r.Endpoint, camera.Endpoint)
+	camera.MAC = cmp.Or(r.MAC, camera.MAC)
+	upgraded := r.Firmware != "" && r.Firmware != camera.CurrentFirmware()
+	if upgraded {
+		camera.Firmware = append(slices.Clip(camera.Firmware), FirmwareVersion{Version: r.Firmware, Seen: now})
+	}
+
+	// last seen times alone aren't worth a write, they are saved along with the next real change
+	if upgraded || camera.Key != before.Key || camera.Address != before.Address ||
+		camera.Serial != before.Serial || camera.Endpoint != before.Endpoint || camera.MAC != before.MAC {
+		if err := c.save(); err != nil {
+			return *camera, err
+		}
+	}
+	return *camera, nil
+}
+
+// AddPending adds the passed in device as a camera pending adoption if we haven't seen it before, returning its
+// camera and whether it was added. Devices we already know are left as they are.
+func (c *Cameras) AddPending(r scan.Record, now time.Time) (Camera, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, existing := range c.cameras {
+		if existing.matches(r) {
+			return *existing, false, nil
+		}
+	}
+
+	camera := &Camera{
+		ID:        c.newID(),
+		Serial:    r.Serial,
+		Endpoint:  r.Endpoint,
+		MAC:       r.MAC,
+		Key:       r.Key,
+		Address:   r.Address,
+		FirstSeen: now,
+		LastSeen:  now,
+		Pending:   true,
+	}
+	if r.Firmware != "" {
+		camera.Firmware = []FirmwareVersion{{Version: r.Firmware, Seen: now}}
+	}
+	c.cameras = append(c.cameras, camera)
+	return *camera, true, c.save()
+}
+
+// Adopt approves the camera with the passed in ID for use, whether it was pending or rejected, returning false if
+// there is no such camera
+func (c *Cameras) Adopt(id string) (bool, error) {
+	return c.setAdoption(id, false, false)
+}
+
+// Reject marks the camera with the passed in ID as one we should never use, such as a neighbor's which answers
+// discovery, returning false if there is no such camera
+func (c *Cameras) Reject(id string) (bool, error) {
+	return c.setAdoption(id, false, true)
+}
+
+func (c *Cameras) setAdoption(id string, pending bool, rejected bool) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, camera := range c.cameras {
+		if camera.ID == id {
+			if camera.Pending == pending && camera.Rejected == rejected {
+				return true, nil
+			}
+			camera.Pending, camera.Rejected = pending, rejected
+			return true, c.save()
+		}
+	}
+	return false, nil
+}
+
+// SetAsset replaces the asset details of the camera with the passed in ID, returning false if there is no such camera
+func (c *Cameras) SetAsset(id string, asset Asset) (bool, error) {
+	if err := asset.Validate(); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, camera := range c.cameras {
+		if camera.ID == id {
+			asset.Fields = maps.Clone(asset.Fields)
+			camera.Asset = &asset
+			if asset.empty() {
+				camera.Asset = nil
+			}
+			return true, c.save()
+		}
+	}
+	return false, nil
+}
+
+// Relocate moves the camera with the passed in MAC to the passed in IP, such as when its DHCP lease changes, keeping
+// the port and path of its address. Returns the camera and whether it moved, false if there is no such camera or it
+// was already there.
+func (c *Cameras) Relocate(mac string, ip string, now time.Time) (Camera, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, camera := range c.cameras {
+		if camera.MAC == "" || !strings.EqualFold(camera.MAC, mac) {
+			continue
+		}
+		if hostOf(camera.Address) == ip {
+			return *camera, false, nil
+		}
+		camera.Address, camera.LastSeen = withHost(camera.Address, ip), now
+		return *camera, true, c.save()
+	}
+	return Camera{}, false, nil
+}
+
+// Pending returns the cameras waiting to be adopted, sorted by ID
+func (c *Cameras) Pending() []Camera {
+	return slices.DeleteFunc(c.All(), func(camera Camera) bool { return !camera.Pending })
+}
+
+// Get returns the camera with the passed in ID
+func (c *Cameras) Get(id string) (Camera, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, camera := range c.cameras {
+		if camera.ID == id {
+			return *camera, true
+		}
+	}
+	return Camera{}, false
+}
+
+// ByKey returns the camera the monitor currently knows by the passed in key
+func (c *Cameras) ByKey(key string) (Camera, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, camera := range c.cameras {
+		if camera.Key == key {
+			return *camera, true
+		}
+	}
+	return Camera{}, false
+}
+
+// AtHost returns the camera last seen at the passed in host, which may be given as an address or URL
+func (c *Cameras) AtHost(host string) (Camera, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host = hostOf(host)
+	for _, camera := range c.cameras {
+		if host != "" && hostOf(camera.Address) == host {
+			return *camera, true
+		}
+	}
+	return Camera{}, false
+}
+
+// All returns every camera, sorted by ID
+func (c *Cameras) All() []Camera {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cameras := make([]Camera, len(c.cameras))
+	for i, camera := range c.cameras {
+		cameras[i] = *camera
+	}
+	slices.SortFunc(cameras, func(a, b Camera) int { return strings.Compare(a.ID, b.ID) })
+	return cameras
+}
+
+// returns a short ID not used by any camera, IDs are used in URLs and as directory names so are kept plain
+func (c *Cameras) newID() string {
+	for {
+		id := "cam-" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+		if !slices.ContainsFunc(c.cameras, func(camera *Camera) bool { return camera.ID == id }) {
+			return id
+		}
+	}
+}
+
+// save writes the registry to disk atomically, must be called with the lock held
+func (c *Cameras) save() error {
+	b, err := json.MarshalIndent(c.cameras, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling camera registry: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".cameras-*")
+	if err != nil {
+		return fmt.Errorf("error creating camera registry temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing camera registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing camera registry: %w", err)
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// returns the host of an address which may be a URL, host:port or bare host
+func hostOf(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// returns the passed in address, which may be a URL, host:port or bare host, with its host replaced
+func withHost(address string, host string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		} else {
+			u.Host = host
+		}
+		return u.String()
+	}
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
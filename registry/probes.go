@@ -0,0 +1,242 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/scan"
+)
+
+// ProbeRecord is the persisted result of probing a device
+type ProbeRecord struct {
+	Address   string       `json:"address"`
+	Device    onvif.Device `json:"device"`
+	ProbedAt  time.Time    `json:"probed_at"`
+	LastError string       `json:"last_error,omitempty"`
+
+	// set when a consumer of the device has seen errors suggesting our results are stale, such as a stream URI
+	// flagged InvalidAfterReboot no longer working
+	Stale bool `json:"stale,omitempty"`
+}
+
+// ReprobePolicy decides when persisted probe results should be refreshed
+type ReprobePolicy struct {
+	// how long probe results are trusted for, zero means forever
+	Interval time.Duration
+}
+
+var DefaultReprobePolicy = ReprobePolicy{Interval: 24 * time.Hour}
+
+// NeedsReprobe returns whether the passed in record should be reprobed and why
+func (p ReprobePolicy) NeedsReprobe(r *ProbeRecord, now time.Time) (bool, string) {
+	switch {
+	case r.Stale:
+		return true, "marked stale"
+	case r.LastError != "":
+		return true, "last probe failed"
+	case p.Interval > 0 && now.Sub(r.ProbedAt) >= p.Interval:
+		return true, "interval elapsed"
+	}
+	return false, ""
+}
+
+// ProbeStore persists probe results to a JSON file so that we don't need to reprobe every device on startup
+type ProbeStore struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]*ProbeRecord
+}
+
+// OpenProbeStore loads the probe store at the passed in path, creating an empty one if it doesn't exist
+func OpenProbeStore(path string) (*ProbeStore, error) {
+	s := &ProbeStore{path: path, records: make(map[string]*ProbeRecord)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading probe store %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, &s.records); err != nil {
+		return nil, fmt.Errorf("error unmarshalling probe store %q: %w", path, err)
+	}
+	return s, nil
+}
+
+// Get returns a copy of the record for the passed in device address
+func (s *ProbeStore) Get(address string) (*ProbeRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, found := s.records[address]
+	if !found {
+		return nil, false
+	}
+	copied := *r
+	return &copied, true
+}
+
+// Records returns a copy of every record in the store, sorted by address
+func (s *ProbeStore) Records() []*ProbeRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]*ProbeRecord, 0, len(s.records))
+	for _, r := range s.records {
+		copied := *r
+		records = append(records, &copied)
+	}
+	slices.SortFunc(records, func(a, b *ProbeRecord) int { return strings.Compare(a.Address, b.Address) })
+	return records
+}
+
+// Put saves the passed in record, writing the store to disk
+func (s *ProbeStore) Put(r *ProbeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *r
+	s.records[r.Address] = &copied
+	return s.save()
+}
+
+// MarkStale flags the record for the passed in address as needing a reprobe, for example after its stream URI
+// stopped working
+func (s *ProbeStore) MarkStale(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, found := s.records[address]
+	if !found {
+		return nil
+	}
+	r.Stale = true
+	return s.save()
+}
+
+// Probe returns the persisted results for the passed in device, only reprobing it if the policy says to
+func (s *ProbeStore) Probe(log *slog.Logger, address string, opts scan.Options, policy ReprobePolicy) (*ProbeRecord, error) {
+	if r, found := s.Get(address); found {
+		reprobe, reason := policy.NeedsReprobe(r, time.Now())
+		if !reprobe {
+			log.Debug("using persisted probe results", slog.String("address", address), slog.Time("probed_at", r.ProbedAt))
+			return r, nil
+		}
+		log.Info("reprobing device", slog.String("address", address), slog.String("reason", reason))
+	}
+
+	r := &ProbeRecord{Address: address, ProbedAt: time.Now()}
+
+	result, probeErr := scan.ProbeDevice(log, address, opts)
+	if probeErr != nil {
+		r.LastError = probeErr.Error()
+		if previous, found := s.Get(address); found {
+			r.Device = previous.Device
+		}
+	} else {
+		r.Device = *result.Device
+	}
+
+	if err := s.Put(r); err != nil {
+		return nil, err
+	}
+	return r, probeErr
+}
+
+// ProbeOnWake returns a callback for scan.Monitor.OnWake which probes low power devices while they are awake, since
+// unlike other devices they can't be reprobed whenever the policy says to
+func (s *ProbeStore) ProbeOnWake(log *slog.Logger, opts scan.Options, policy ReprobePolicy) func(context.Context, scan.Record) {
+	return func(ctx context.Context, record scan.Record) {
+		// the monitor calls us inline so don't hold it up, the device won't stay awake for long
+		go func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := s.Probe(log, record.Address, opts, policy); err != nil {
+				log.Warn("unable to probe device while awake", slog.String("address", record.Address), slog.String("error", err.Error()))
+			}
+		}()
+	}
+}
+
+// Cache returns the store as a cache of probe results for a scan or monitor, whose results are used until the passed
+// in policy says to reprobe them
+func (s *ProbeStore) Cache(policy ReprobePolicy) scan.ProbeCache {
+	return &probeCache{store: s, policy: policy}
+}
+
+// probeCache is a probe store as a scan.ProbeCache, keyed by device service URL
+type probeCache struct {
+	store  *ProbeStore
+	policy ReprobePolicy
+}
+
+func (c *probeCache) Cached(address string) (*onvif.Device, bool) {
+	r, found := c.store.Get(address)
+	if !found {
+		return nil, false
+	}
+	if reprobe, _ := c.policy.NeedsReprobe(r, time.Now()); reprobe {
+		return nil, false
+	}
+
+	// the device is handed to consumers which refresh its stream URIs, so it mustn't share profiles with our record
+	d := r.Device
+	d.Profiles = slices.Clone(d.Profiles)
+	return &d, true
+}
+
+func (c *probeCache) Addresses() []string {
+	records := c.store.Records()
+	addresses := make([]string, len(records))
+	for i, r := range records {
+		addresses[i] = r.Address
+	}
+	return addresses
+}
+
+func (c *probeCache) Save(d *onvif.Device) error {
+	device := *d
+	device.Profiles = slices.Clone(d.Profiles)
+	return c.store.Put(&ProbeRecord{Address: d.Address, Device: device, ProbedAt: time.Now()})
+}
+
+func (c *probeCache) MarkStale(address string) error {
+	return c.store.MarkStale(address)
+}
+
+// save writes the store to disk atomically, must be called with the lock held
+func (s *ProbeStore) save() error {
+	b, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling probe store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".probes-*")
+	if err != nil {
+		return fmt.Errorf("error creating probe store temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing probe store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing probe store: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+func TestProbeCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.json")
+	store, err := OpenProbeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := store.Cache(DefaultReprobePolicy)
+
+	address := "http://192.168.1.10/onvif/device_service"
+	d := &onvif.Device{Address: address, Username: "admin", Password: "secret", Profiles: []onvif.Profile{{Token: "main", URI: "rtsp://192.168.1.10/main"}}}
+	if err := cache.Save(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// results survive reopening the store, without the password
+	store, err = OpenProbeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = store.Cache(DefaultReprobePolicy)
+	if addresses := cache.Addresses(); !slices.Equal(addresses, []string{address}) {
+		t.Errorf("expected %v, got %v", []string{address}, addresses)
+	}
+	cached, found := cache.Cached(address)
+	if !found || cached.Username != "admin" || cached.Password != "" || len(cached.Profiles) != 1 {
+		t.Fatalf("expected the saved device without its password, got %+v", cached)
+	}
+
+	// consumers refreshing stream URIs don't change what we've saved
+	cached.Profiles[0].URI = "rtsp://192.168.1.10/other"
+	if again, _ := cache.Cached(address); again.Profiles[0].URI != "rtsp://192.168.1.10/main" {
+		t.Errorf("expected the saved stream uri, got %q", again.Profiles[0].URI)
+	}
+
+	if _, found := cache.Cached("http://192.168.1.11/onvif/device_service"); found {
+		t.Error("expected nothing cached for an unknown device")
+	}
+
+	// results past the reprobe interval aren't used
+	r, _ := store.Get(address)
+	r.ProbedAt = time.Now().Add(-2 * DefaultReprobePolicy.Interval)
+	if err := store.Put(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := cache.Cached(address); found {
+		t.Error("expected results past the reprobe interval not to be used")
+	}
+
+	// nor are results marked stale until they are saved again
+	if err := cache.Save(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.MarkStale(address); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := cache.Cached(address); found {
+		t.Error("expected stale results not to be used")
+	}
+	if err := cache.Save(d); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := cache.Cached(address); !found {
+		t.Error("expected fresh results to be used")
+	}
+}
@@ -0,0 +1,134 @@
+package rtsp
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// CredentialStrategy is how credentials are passed to a camera when opening a stream
+type CredentialStrategy string
+
+const (
+	// no credentials needed
+	StrategyNone CredentialStrategy = "none"
+
+	// credentials go in the URL userinfo and are sent using RTSP Basic or Digest auth in response to a 401, this is
+	// what ffmpeg does with credentials in the URL
+	StrategyHeader CredentialStrategy = "header"
+
+	// credentials are passed as user and password query parameters, which some cameras expect instead of RTSP auth
+	StrategyQuery CredentialStrategy = "query"
+)
+
+// Apply returns the URL to open for the passed in stream using this strategy
+func (s CredentialStrategy) Apply(rawURL string, username string, password string) (*creds.URL, error) {
+	u, err := creds.NewURL(rawURL, "", "")
+	if err != nil {
+		return nil, err
+	}
+	u = u.WithoutCredentials()
+
+	switch s {
+	case StrategyHeader:
+		return creds.NewURL(u.Secret(), username, password)
+	case StrategyQuery:
+		return u.WithQueryCredentials(username, password), nil
+	}
+	return u, nil
+}
+
+// DescribeAuth sends a DESCRIBE request using the passed in strategy, answering any Basic or Digest challenge when
+// using the header strategy
+func DescribeAuth(rawURL string, strategy CredentialStrategy, username string, password string, timeout time.Duration) (*Response, error) {
+	if strategy == StrategyQuery {
+		applied, err := strategy.Apply(rawURL, username, password)
+		if err != nil {
+			return nil, err
+		}
+		return Describe(applied.Secret(), timeout)
+	}
+
+	resp, err := Describe(rawURL, timeout)
+	if err != nil || resp.StatusCode != 401 || strategy != StrategyHeader {
+		return resp, err
+	}
+
+	authorization, err := creds.Authorization(resp.Header.Get("WWW-Authenticate"), "DESCRIBE", stripUser(rawURL), username, password)
+	if err != nil {
+		return nil, err
+	}
+	return Do("DESCRIBE", rawURL, map[string]string{"Accept": "application/sdp", "Authorization": authorization}, timeout)
+}
+
+func stripUser(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// StrategyCache remembers which credential strategy works for each host so we only need to work it out once
+type StrategyCache struct {
+	mu         sync.Mutex
+	strategies map[string]CredentialStrategy
+}
+
+func NewStrategyCache() *StrategyCache {
+	return &StrategyCache{strategies: make(map[string]CredentialStrategy)}
+}
+
+// Resolve returns the credential strategy which works for the passed in stream, trying each in turn the first
+// time a host is seen
+func (c *StrategyCache) Resolve(rawURL string, username string, password string, timeout time.Duration) (CredentialStrategy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid rtsp url %q: %w", creds.Redact(rawURL), err)
+	}
+
+	c.mu.Lock()
+	strategy, found := c.strategies[u.Host]
+	c.mu.Unlock()
+	if found {
+		return strategy, nil
+	}
+
+	candidates := []CredentialStrategy{StrategyNone}
+	if username != "" {
+		candidates = []CredentialStrategy{StrategyHeader, StrategyQuery}
+	}
+
+	var lastStatus string
+	for _, candidate := range candidates {
+		resp, err := DescribeAuth(rawURL, candidate, username, password, timeout)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode == 200 {
+			c.Set(u.Host, candidate)
+			return candidate, nil
+		}
+		lastStatus = resp.Status
+	}
+
+	return "", fmt.Errorf("no credential strategy accepted by %q: %s", u.Host, lastStatus)
+}
+
+// Set records the strategy to use for the passed in host
+func (c *StrategyCache) Set(host string, strategy CredentialStrategy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strategies[host] = strategy
+}
+
+// Forget clears the strategy for the passed in host, for example after it stops working
+func (c *StrategyCache) Forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.strategies, host)
+}
@@ -0,0 +1,179 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// the Require header value cameras need to see before they'll offer their audio backchannel
+const backchannelRequire = "www.onvif.org/ver20/backchannel"
+
+// ErrNoBackchannel is returned when a camera doesn't offer an audio backchannel we can send to
+var ErrNoBackchannel = errors.New("no supported audio backchannel")
+
+// G.711 is the only codec every backchannel supports, these are its static RTP payload types
+const (
+	PayloadPCMU = 0
+	PayloadPCMA = 8
+)
+
+// we send 20ms of 8kHz G.711 audio per packet, one byte per sample
+const (
+	backchannelSampleRate    = 8000
+	backchannelPacketSamples = 160
+	backchannelPacketTime    = 20 * time.Millisecond
+)
+
+// Backchannel is an ONVIF audio backchannel set up on a camera that we can play audio through its speaker with
+type Backchannel struct {
+	session *Session
+	channel int
+
+	// the RTP payload type the camera accepts, one of PayloadPCMU or PayloadPCMA
+	PayloadType int
+}
+
+// OpenBackchannel sets up the audio backchannel on the camera at the passed in URL, which may include credentials
+func OpenBackchannel(rawURL string, timeout time.Duration) (*Backchannel, error) {
+	session, err := Dial(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := setupBackchannel(session)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func setupBackchannel(session *Session) (*Backchannel, error) {
+	require := map[string]string{"Require": backchannelRequire}
+
+	describe, err := session.Do("DESCRIBE", "", map[string]string{"Accept": "application/sdp", "Require": backchannelRequire})
+	if err != nil {
+		return nil, err
+	}
+	if describe.StatusCode != 200 {
+		return nil, fmt.Errorf("%w: describe failed with status %q", ErrNoBackchannel, describe.Status)
+	}
+
+	control, payload, found := findBackchannelMedia(string(describe.Body))
+	if !found {
+		return nil, ErrNoBackchannel
+	}
+
+	base := session.URL()
+	if cb := describe.Header.Get("Content-Base"); cb != "" {
+		base = cb
+	}
+
+	setupHeaders := map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1", "Require": backchannelRequire}
+	setup, err := session.Do("SETUP", resolveControl(base, control), setupHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if setup.StatusCode != 200 {
+		return nil, fmt.Errorf("backchannel setup failed with status %q", setup.Status)
+	}
+
+	play, err := session.Do("PLAY", "", require)
+	if err != nil {
+		return nil, err
+	}
+	if play.StatusCode != 200 {
+		return nil, fmt.Errorf("backchannel play failed with status %q", play.Status)
+	}
+
+	return &Backchannel{session: session, channel: interleavedChannel(setup.Header.Get("Transport"), 0), PayloadType: payload}, nil
+}
+
+// returns the control and payload type of the first sendonly audio media in the passed in SDP using G.711, the
+// backchannel is flagged sendonly as it is from the point of view of the camera
+func findBackchannelMedia(sdp string) (string, int, bool) {
+	for _, m := range ParseSDP(sdp).Media {
+		if m.Type != "audio" || m.Direction != "sendonly" {
+			continue
+		}
+		for _, pt := range m.Payloads {
+			if pt == PayloadPCMU || pt == PayloadPCMA {
+				return m.Control, pt, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// Play sends the passed in 8kHz G.711 audio, encoded as our PayloadType, in real time, returning when it has all
+// been sent or the passed in context is done
+func (b *Backchannel) Play(ctx context.Context, audio []byte) error {
+	return b.Stream(ctx, bytes.NewReader(audio))
+}
+
+// Stream sends 8kHz G.711 audio, encoded as our PayloadType, from the passed in reader as it arrives, such as live
+// from a microphone for talkback, returning once the reader is exhausted or the passed in context is done. Audio
+// which arrives faster than real time is paced out to the camera.
+func (b *Backchannel) Stream(ctx context.Context, audio io.Reader) error {
+	ssrc := rand.Uint32()
+	seq := uint16(rand.Uint32())
+	timestamp := rand.Uint32()
+
+	ticker := time.NewTicker(backchannelPacketTime)
+	defer ticker.Stop()
+
+	chunk := make([]byte, backchannelPacketSamples)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(audio, chunk)
+		if n == 0 {
+			if err == io.EOF || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error reading audio: %w", err)
+		}
+
+		packet := make([]byte, 12, 12+n)
+		packet[0] = 0x80 // version 2, no padding, extensions or csrcs
+		packet[1] = byte(b.PayloadType)
+		if first {
+			packet[1] |= 0x80 // marker on the first packet of a talkspurt
+		}
+		binary.BigEndian.PutUint16(packet[2:], seq)
+		binary.BigEndian.PutUint32(packet[4:], timestamp)
+		binary.BigEndian.PutUint32(packet[8:], ssrc)
+		packet = append(packet, chunk[:n]...)
+
+		if err := b.session.WriteInterleaved(b.channel, packet); err != nil {
+			return err
+		}
+		seq++
+		timestamp += uint32(n)
+
+		// live audio can go on for longer than the camera keeps a session it doesn't hear requests on
+		if err := b.session.KeepAlive(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// AudioDuration returns how long the passed in G.711 audio takes to play
+func AudioDuration(audio []byte) time.Duration {
+	return time.Duration(len(audio)) * time.Second / backchannelSampleRate
+}
+
+// Close tears down the backchannel
+func (b *Backchannel) Close() error {
+	return b.session.Close()
+}
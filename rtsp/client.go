@@ -0,0 +1,112 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+const userAgent = "govr"
+
+// Response is a parsed RTSP response
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// Describe sends an RTSP DESCRIBE request for the passed in URL and returns the response
+func Describe(rawURL string, timeout time.Duration) (*Response, error) {
+	return Do("DESCRIBE", rawURL, map[string]string{"Accept": "application/sdp"}, timeout)
+}
+
+// Do opens a connection to the host in the passed in URL, sends a single request and reads the response
+func Do(method string, rawURL string, headers map[string]string, timeout time.Duration) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtsp url %q: %w", creds.Redact(rawURL), err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %q: %w", host, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("error setting deadline: %w", err)
+	}
+
+	// credentials never go on the request line
+	u.User = nil
+
+	req := &strings.Builder{}
+	fmt.Fprintf(req, "%s %s RTSP/1.0\r\n", method, u.String())
+	fmt.Fprintf(req, "CSeq: 1\r\n")
+	fmt.Fprintf(req, "User-Agent: %s\r\n", userAgent)
+	for k, v := range headers {
+		fmt.Fprintf(req, "%s: %s\r\n", k, v)
+	}
+	req.WriteString("\r\n")
+
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		return nil, fmt.Errorf("error writing request: %w", err)
+	}
+
+	return ReadResponse(bufio.NewReader(conn))
+}
+
+// ReadResponse reads a single RTSP response from the passed in reader
+func ReadResponse(r *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("error reading status line: %w", err)
+	}
+
+	proto, status, found := strings.Cut(line, " ")
+	if !found || !strings.HasPrefix(proto, "RTSP/") {
+		return nil, fmt.Errorf("invalid rtsp status line: %q", line)
+	}
+
+	codeStr, _, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtsp status code: %q", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading headers: %w", err)
+	}
+
+	resp := &Response{StatusCode: code, Status: status, Header: header}
+
+	if cl := header.Get("Content-Length"); cl != "" {
+		length, err := strconv.Atoi(cl)
+		if err != nil || length < 0 || length > 1024*1024 {
+			return nil, fmt.Errorf("invalid content length: %q", cl)
+		}
+		resp.Body = make([]byte, length)
+		if _, err := io.ReadFull(r, resp.Body); err != nil {
+			return nil, fmt.Errorf("error reading body: %w", err)
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,401 @@
+package rtsp
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPacket is returned for RTP packets which are too short for what their headers say they hold
+var ErrInvalidPacket = errors.New("invalid rtp packet")
+
+// H.264 NAL unit types, RFC 6184
+const (
+	h264NALIDR   = 5
+	h264NALSPS   = 7
+	h264NALPPS   = 8
+	h264NALSTAPA = 24
+	h264NALFUA   = 28
+)
+
+// H.265 NAL unit types, RFC 7798, those from 16 to 23 being the random access points a decoder can start from
+const (
+	h265NALIRAPFirst = 16
+	h265NALIRAPLast  = 23
+	h265NALVPS       = 32
+	h265NALSPS       = 33
+	h265NALPPS       = 34
+	h265NALAP        = 48
+	h265NALFU        = 49
+)
+
+// AccessUnit is a single picture of H.264 or H.265 video, the NAL units which make it up without start codes
+type AccessUnit struct {
+	NALUs [][]byte
+
+	// the RTP timestamp of the picture, and how far into the stream it is going by the timestamps
+	Timestamp uint32
+	PTS       time.Duration
+
+	// whether a decoder can start from this picture, keyframes always carry the parameter sets needed to decode them
+	Keyframe bool
+
+	// when we received the last of the picture
+	Received time.Time
+}
+
+// AnnexB returns the NAL units of the picture each preceded by a start code, as decoders reading a raw stream expect
+func (u AccessUnit) AnnexB() []byte {
+	size := 0
+	for _, nal := range u.NALUs {
+		size += 4 + len(nal)
+	}
+	b := make([]byte, 0, size)
+	for _, nal := range u.NALUs {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nal...)
+	}
+	return b
+}
+
+// Depacketizer reassembles the RTP packets of an H.264 or H.265 stream into access units. Pictures missing a packet
+// are dropped, along with those after them until the next keyframe, so that every unit it returns can be decoded.
+type Depacketizer struct {
+	encoding  string
+	clockRate int
+
+	// the latest parameter set of each type and ID the stream has used, from its SDP until it sends its own
+	parameterSets [][]byte
+
+	// the NAL units of the picture being reassembled, and of any NAL unit fragmented across packets
+	nalus     [][]byte
+	fragment  []byte
+	timestamp uint32
+	pending   bool
+
+	// the sequence number we expect next, and whether we've lost a packet of the current picture or since a keyframe
+	seq          uint16
+	started      bool
+	broken       bool
+	waitKeyframe bool
+
+	// the timestamp of the last picture and how many clock ticks into the stream it was
+	lastTimestamp uint32
+	elapsed       int64
+	first         bool
+}
+
+// NewDepacketizer creates a new depacketizer for video with the passed in encoding, H264 or H265, and clock rate,
+// keyframes which don't carry their own parameter sets being given the passed in ones from the SDP
+func NewDepacketizer(encoding string, clockRate int, parameterSets [][]byte) (*Depacketizer, error) {
+	encoding = strings.ToUpper(encoding)
+	if encoding != "H264" && encoding != "H265" {
+		return nil, fmt.Errorf("%w: can't depacketize %s", ErrNoVideo, encoding)
+	}
+	if clockRate <= 0 {
+		clockRate = 90000
+	}
+	d := &Depacketizer{encoding: encoding, clockRate: clockRate, waitKeyframe: true, first: true}
+	d.mergeParameterSets(parameterSets)
+	return d, nil
+}
+
+// Push adds the passed in RTP packet, received at the passed in time, returning any access units it completes. A unit
+// is complete at the packet marking its end, or for cameras which don't mark them at the first packet of the next.
+// Units refer to the packets they came from, so those mustn't be reused.
+func (d *Depacketizer) Push(packet []byte, now time.Time) ([]AccessUnit, error) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return nil, ErrInvalidPacket
+	}
+	marker := packet[1]&0x80 != 0
+	seq := binary.BigEndian.Uint16(packet[2:])
+	timestamp := binary.BigEndian.Uint32(packet[4:])
+
+	// the payload follows the fixed header, any CSRCs and any header extension, and is followed by any padding
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return nil, ErrInvalidPacket
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > offset {
+		end -= int(packet[end-1])
+	}
+	if offset > end {
+		return nil, ErrInvalidPacket
+	}
+	payload := packet[offset:end]
+
+	// a lost packet may have been the end of the last picture or the start of this one, so we can trust neither
+	lost := d.started && seq != d.seq
+	var units []AccessUnit
+	if d.pending && timestamp != d.timestamp {
+		d.broken = d.broken || lost
+		units = d.flush(units, now)
+	}
+	if lost {
+		d.broken = true
+		d.fragment = nil
+	}
+	d.seq, d.started = seq+1, true
+	d.timestamp, d.pending = timestamp, true
+
+	if err := d.depacketize(payload); err != nil {
+		d.broken = true
+		d.fragment = nil
+	}
+
+	if marker {
+		units = d.flush(units, now)
+	}
+	return units, nil
+}
+
+// appends the NAL units in the passed in payload to the picture being reassembled
+func (d *Depacketizer) depacketize(payload []byte) error {
+	if d.encoding == "H265" {
+		return d.depacketizeH265(payload)
+	}
+	return d.depacketizeH264(payload)
+}
+
+func (d *Depacketizer) depacketizeH264(payload []byte) error {
+	if len(payload) < 1 {
+		return ErrInvalidPacket
+	}
+
+	switch typ := payload[0] & 0x1f; {
+	case typ >= 1 && typ <= 23:
+		d.nalus = append(d.nalus, payload)
+	case typ == h264NALSTAPA:
+		return d.aggregated(payload[1:])
+	case typ == h264NALFUA:
+		if len(payload) < 2 {
+			return ErrInvalidPacket
+		}
+		header := payload[0]&0xe0 | payload[1]&0x1f
+		return d.fragmented(payload[1]&0x80 != 0, payload[1]&0x40 != 0, []byte{header}, payload[2:])
+	}
+
+	// STAP-B, MTAP and FU-B are only used with interleaved packetization which we never ask for
+	return nil
+}
+
+func (d *Depacketizer) depacketizeH265(payload []byte) error {
+	if len(payload) < 2 {
+		return ErrInvalidPacket
+	}
+
+	switch typ := (payload[0] >> 1) & 0x3f; {
+	case typ < h265NALAP:
+		d.nalus = append(d.nalus, payload)
+	case typ == h265NALAP:
+		return d.aggregated(payload[2:])
+	case typ == h265NALFU:
+		if len(payload) < 3 {
+			return ErrInvalidPacket
+		}
+		header := []byte{payload[0]&0x81 | (payload[2]&0x3f)<<1, payload[1]}
+		return d.fragmented(payload[2]&0x80 != 0, payload[2]&0x40 != 0, header, payload[3:])
+	}
+
+	// PACI packets only carry extra information about the NAL unit they wrap
+	return nil
+}
+
+// appends each NAL unit of an aggregation packet, each preceded by its two byte size
+func (d *Depacketizer) aggregated(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return ErrInvalidPacket
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		if size == 0 || len(b) < 2+size {
+			return ErrInvalidPacket
+		}
+		d.nalus = append(d.nalus, b[2:2+size])
+		b = b[2+size:]
+	}
+	return nil
+}
+
+// adds a fragment of a NAL unit, whose own header is rebuilt from those of its fragments, appending it once complete
+func (d *Depacketizer) fragmented(start bool, end bool, header []byte, b []byte) error {
+	if start {
+		d.fragment = append(append([]byte{}, header...), b...)
+	} else if d.fragment == nil {
+		// we missed its start, which a gap in sequence numbers has already noted
+		return nil
+	} else {
+		d.fragment = append(d.fragment, b...)
+	}
+
+	if end {
+		d.nalus = append(d.nalus, d.fragment)
+		d.fragment = nil
+	}
+	return nil
+}
+
+// appends the picture being reassembled to the passed in units, unless we lost any of it or haven't had a keyframe
+// since we last lost something, and starts on the next
+func (d *Depacketizer) flush(units []AccessUnit, now time.Time) []AccessUnit {
+	nalus, broken := d.nalus, d.broken || d.fragment != nil
+	d.nalus, d.fragment, d.pending, d.broken = nil, nil, false, false
+	if broken {
+		d.waitKeyframe = true
+		return units
+	}
+	if len(nalus) == 0 {
+		return units
+	}
+
+	keyframe, hasParameterSets := d.classify(nalus)
+	if d.waitKeyframe && !keyframe {
+		return units
+	}
+	d.waitKeyframe = false
+
+	if keyframe && !hasParameterSets && len(d.parameterSets) > 0 {
+		nalus = append(append([][]byte{}, d.parameterSets...), nalus...)
+	}
+
+	// timestamps wrap around, so each picture moves the stream on by how far it is from the last
+	if d.first {
+		d.first = false
+	} else {
+		d.elapsed += int64(int32(d.timestamp - d.lastTimestamp))
+	}
+	d.lastTimestamp = d.timestamp
+
+	return append(units, AccessUnit{
+		NALUs:     nalus,
+		Timestamp: d.timestamp,
+		PTS:       time.Duration(d.elapsed * int64(time.Second) / int64(d.clockRate)),
+		Keyframe:  keyframe,
+		Received:  now,
+	})
+}
+
+// returns whether the passed in NAL units make up a keyframe and whether they include parameter sets, which replace
+// those we have of the same type and ID
+func (d *Depacketizer) classify(nalus [][]byte) (bool, bool) {
+	keyframe := false
+	parameterSets := [][]byte{}
+	for _, nal := range nalus {
+		if d.encoding == "H265" {
+			switch typ := (nal[0] >> 1) & 0x3f; {
+			case typ >= h265NALIRAPFirst && typ <= h265NALIRAPLast:
+				keyframe = true
+			case typ == h265NALVPS, typ == h265NALSPS, typ == h265NALPPS:
+				parameterSets = append(parameterSets, nal)
+			}
+			continue
+		}
+
+		switch nal[0] & 0x1f {
+		case h264NALIDR:
+			keyframe = true
+		case h264NALSPS, h264NALPPS:
+			parameterSets = append(parameterSets, nal)
+		}
+	}
+
+	d.mergeParameterSets(parameterSets)
+	return keyframe, len(parameterSets) > 0
+}
+
+// merges the passed in parameter sets into ours, cameras with several PPSs or SPSs only sending those which changed,
+// and keeps them in the order decoders need them, VPS then SPS then PPS
+func (d *Depacketizer) mergeParameterSets(parameterSets [][]byte) {
+	for _, nal := range parameterSets {
+		if len(nal) == 0 {
+			continue
+		}
+		typ, id := d.nalType(nal), d.parameterSetID(nal)
+		i := slices.IndexFunc(d.parameterSets, func(p []byte) bool {
+			return d.nalType(p) == typ && d.parameterSetID(p) == id
+		})
+		if i >= 0 {
+			d.parameterSets[i] = nal
+		} else {
+			d.parameterSets = append(d.parameterSets, nal)
+		}
+	}
+	slices.SortStableFunc(d.parameterSets, func(a, b []byte) int {
+		return cmp.Compare(d.nalType(a), d.nalType(b))
+	})
+}
+
+// returns the type of the passed in NAL unit
+func (d *Depacketizer) nalType(nal []byte) byte {
+	if d.encoding == "H265" {
+		return (nal[0] >> 1) & 0x3f
+	}
+	return nal[0] & 0x1f
+}
+
+// returns the ID of the passed in parameter set, which is unique among those of its type
+func (d *Depacketizer) parameterSetID(nal []byte) uint {
+	r := newBitReader(nal)
+	if d.encoding == "H265" {
+		r.skip(16) // nal header
+		switch d.nalType(nal) {
+		case h265NALVPS:
+			return r.bits(4)
+		case h265NALSPS:
+			r.skip(4) // sps_video_parameter_set_id
+			maxSubLayers := int(r.bits(3))
+			r.skip(1) // sps_temporal_id_nesting_flag
+			skipH265ProfileTierLevel(r, maxSubLayers)
+		}
+		return r.ue()
+	}
+
+	r.skip(8) // nal header
+	if d.nalType(nal) == h264NALSPS {
+		r.skip(24) // profile, constraint flags and level
+	}
+	return r.ue()
+}
+
+// IsKeyframeStart returns whether the passed in H.264 or H.265 RTP payload starts a keyframe, either with the slice
+// itself or the parameter sets ahead of it, somewhere a viewer can start decoding
+func IsKeyframeStart(encoding string, payload []byte) bool {
+	if strings.EqualFold(encoding, "H265") {
+		if len(payload) < 3 {
+			return false
+		}
+		isStart := func(typ byte) bool {
+			return (typ >= h265NALIRAPFirst && typ <= h265NALIRAPLast) || typ == h265NALVPS
+		}
+		switch typ := (payload[0] >> 1) & 0x3f; typ {
+		case h265NALAP:
+			// the first aggregated unit follows its two byte size
+			return len(payload) > 4 && isStart((payload[4]>>1)&0x3f)
+		case h265NALFU:
+			return payload[2]&0x80 != 0 && isStart(payload[2]&0x3f)
+		default:
+			return isStart(typ)
+		}
+	}
+
+	if len(payload) < 2 {
+		return false
+	}
+	switch typ := payload[0] & 0x1f; typ {
+	case h264NALIDR, h264NALSPS:
+		return true
+	case h264NALSTAPA:
+		return len(payload) > 3 && (payload[3]&0x1f == h264NALSPS || payload[3]&0x1f == h264NALIDR)
+	case h264NALFUA:
+		return payload[1]&0x80 != 0 && payload[1]&0x1f == h264NALIDR
+	}
+	return false
+}
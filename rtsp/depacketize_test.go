@@ -0,0 +1,277 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// builds an RTP packet with the passed in sequence number, timestamp, marker and payload
+func rtpPacket(seq uint16, timestamp uint32, marker bool, payload ...byte) []byte {
+	packet := make([]byte, 12, 12+len(payload))
+	packet[0] = 0x80
+	packet[1] = 96
+	if marker {
+		packet[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	return append(packet, payload...)
+}
+
+// builds an aggregation packet payload with the passed in header from the passed in NAL units
+func aggregate(header []byte, nalus ...[]byte) []byte {
+	payload := append([]byte{}, header...)
+	for _, nal := range nalus {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(nal)))
+		payload = append(payload, nal...)
+	}
+	return payload
+}
+
+func h264PPS(id uint) []byte {
+	return (&bitWriter{}).bits(8, 0x68).ue(id).ue(0).bytes()
+}
+
+func h264SPSWithID(id uint) []byte {
+	return (&bitWriter{}).bits(8, 0x67).bits(8, 66).bits(16, 0x001e).ue(id).ue(0).ue(2).bytes()
+}
+
+var (
+	testSPS   = h264SPS{widthMbs: 40, heightMbs: 30, frameMbsOnly: 1}.encode()
+	testPPS   = h264PPS(0)
+	testIDR   = []byte{0x65, 0x88, 0x84, 0x00}
+	testSlice = []byte{0x41, 0x9a, 0x02, 0x00}
+)
+
+func TestDepacketizeH264(t *testing.T) {
+	now := time.Now()
+
+	tcs := []struct {
+		name          string
+		parameterSets [][]byte
+		packets       [][]byte
+
+		// the NAL units of each unit we expect, and which of them are keyframes
+		units     [][][]byte
+		keyframes []bool
+	}{
+		{
+			name: "single nal units",
+			packets: [][]byte{
+				rtpPacket(1, 0, false, testSPS...),
+				rtpPacket(2, 0, false, testPPS...),
+				rtpPacket(3, 0, true, testIDR...),
+				rtpPacket(4, 3000, true, testSlice...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}, {testSlice}},
+			keyframes: []bool{true, false},
+		},
+		{
+			name: "stap-a",
+			packets: [][]byte{
+				rtpPacket(1, 0, true, aggregate([]byte{h264NALSTAPA}, testSPS, testPPS, testIDR)...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}},
+			keyframes: []bool{true},
+		},
+		{
+			name:          "fu-a",
+			parameterSets: [][]byte{testSPS, testPPS},
+			packets: [][]byte{
+				rtpPacket(1, 0, false, 0x7c, 0x85, 0x88),
+				rtpPacket(2, 0, false, 0x7c, 0x05, 0x84),
+				rtpPacket(3, 0, true, 0x7c, 0x45, 0x00),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}},
+			keyframes: []bool{true},
+		},
+		{
+			name:          "unmarked pictures end at the next timestamp",
+			parameterSets: [][]byte{testSPS, testPPS},
+			packets: [][]byte{
+				rtpPacket(1, 0, false, testIDR...),
+				rtpPacket(2, 3000, false, testSlice...),
+				rtpPacket(3, 6000, false, testSlice...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}, {testSlice}},
+			keyframes: []bool{true, false},
+		},
+		{
+			name: "waits for a keyframe",
+			packets: [][]byte{
+				rtpPacket(1, 0, true, testSlice...),
+				rtpPacket(2, 3000, true, aggregate([]byte{h264NALSTAPA}, testSPS, testPPS, testIDR)...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}},
+			keyframes: []bool{true},
+		},
+		{
+			name:          "drops pictures after a loss until the next keyframe",
+			parameterSets: [][]byte{testSPS, testPPS},
+			packets: [][]byte{
+				rtpPacket(1, 0, true, testIDR...),
+				rtpPacket(3, 3000, true, testSlice...),
+				rtpPacket(4, 6000, true, testSlice...),
+				rtpPacket(5, 9000, true, testIDR...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}, {testSPS, testPPS, testIDR}},
+			keyframes: []bool{true, true},
+		},
+		{
+			name:          "drops fragments missing their start",
+			parameterSets: [][]byte{testSPS, testPPS},
+			packets: [][]byte{
+				rtpPacket(1, 0, true, testIDR...),
+				rtpPacket(2, 3000, false, 0x5c, 0x01, 0x9a),
+				rtpPacket(4, 3000, true, 0x5c, 0x41, 0x00),
+				rtpPacket(5, 6000, true, testSlice...),
+			},
+			units:     [][][]byte{{testSPS, testPPS, testIDR}},
+			keyframes: []bool{true},
+		},
+		{
+			name:          "merges parameter sets by id",
+			parameterSets: [][]byte{testSPS, testPPS},
+			packets: [][]byte{
+				rtpPacket(1, 0, true, aggregate([]byte{h264NALSTAPA}, h264PPS(1), testIDR)...),
+				rtpPacket(2, 3000, true, testIDR...),
+			},
+			units:     [][][]byte{{h264PPS(1), testIDR}, {testSPS, testPPS, h264PPS(1), testIDR}},
+			keyframes: []bool{true, true},
+		},
+		{
+			name:          "replaces parameter sets with the same id",
+			parameterSets: [][]byte{testSPS, testPPS, h264SPSWithID(1)},
+			packets: [][]byte{
+				rtpPacket(1, 0, true, aggregate([]byte{h264NALSTAPA}, testSPS, h264PPS(0)[:2], testIDR)...),
+				rtpPacket(2, 3000, true, testIDR...),
+			},
+			units: [][][]byte{
+				{testSPS, h264PPS(0)[:2], testIDR},
+				{testSPS, h264SPSWithID(1), h264PPS(0)[:2], testIDR},
+			},
+			keyframes: []bool{true, true},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := NewDepacketizer("h264", 90000, tc.parameterSets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var units []AccessUnit
+			for _, packet := range tc.packets {
+				got, err := d.Push(packet, now)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				units = append(units, got...)
+			}
+
+			if len(units) != len(tc.units) {
+				t.Fatalf("expected %d units, got %d", len(tc.units), len(units))
+			}
+			for i, unit := range units {
+				if !equalNALUs(unit.NALUs, tc.units[i]) {
+					t.Errorf("unit %d: expected %x, got %x", i, tc.units[i], unit.NALUs)
+				}
+				if unit.Keyframe != tc.keyframes[i] {
+					t.Errorf("unit %d: expected keyframe %t, got %t", i, tc.keyframes[i], unit.Keyframe)
+				}
+			}
+		})
+	}
+}
+
+func TestDepacketizeH265(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c, 0x01}
+	sps := h265SPS(1, 1920, 1080, [4]uint{})
+	pps := (&bitWriter{}).bits(16, 0x4401).ue(0).ue(0).bytes()
+	idr := []byte{0x26, 0x01, 0xaf, 0x00}
+	trail := []byte{0x02, 0x01, 0xd0, 0x00}
+
+	d, err := NewDepacketizer("H265", 90000, [][]byte{pps, sps, vps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := [][]byte{
+		// an IDR fragmented over two packets, then a trailing picture
+		rtpPacket(1, 0, false, 0x62, 0x01, 0x93, 0xaf),
+		rtpPacket(2, 0, true, 0x62, 0x01, 0x53, 0x00),
+		rtpPacket(3, 3000, true, trail...),
+
+		// new parameter sets aggregated ahead of the next IDR
+		rtpPacket(4, 6000, false, aggregate([]byte{0x60, 0x01}, vps, sps, pps)...),
+		rtpPacket(5, 6000, true, idr...),
+	}
+	var units []AccessUnit
+	for _, packet := range packets {
+		got, err := d.Push(packet, time.Now())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		units = append(units, got...)
+	}
+
+	expected := [][][]byte{{vps, sps, pps, idr}, {trail}, {vps, sps, pps, idr}}
+	if len(units) != len(expected) {
+		t.Fatalf("expected %d units, got %d", len(expected), len(units))
+	}
+	for i, unit := range units {
+		if !equalNALUs(unit.NALUs, expected[i]) {
+			t.Errorf("unit %d: expected %x, got %x", i, expected[i], unit.NALUs)
+		}
+	}
+	if units[2].PTS != 6000*time.Second/90000 {
+		t.Errorf("expected pts of %v, got %v", 6000*time.Second/90000, units[2].PTS)
+	}
+	if len(d.parameterSets) != 3 {
+		t.Errorf("expected parameter sets to be replaced, got %d of them", len(d.parameterSets))
+	}
+}
+
+func TestDepacketizeInvalid(t *testing.T) {
+	tcs := []struct {
+		name   string
+		packet []byte
+	}{
+		{name: "short", packet: []byte{0x80, 0x60, 0x00}},
+		{name: "wrong version", packet: append([]byte{0x40}, rtpPacket(1, 0, true, testIDR...)[1:]...)},
+		{name: "csrcs past the end", packet: append([]byte{0x8f}, rtpPacket(1, 0, true, testIDR...)[1:]...)},
+		{name: "padding past the end", packet: append(append([]byte{0xa0}, rtpPacket(1, 0, true, testIDR...)[1:]...), 0xff)},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := NewDepacketizer("H264", 90000, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Push(tc.packet, time.Now()); !errors.Is(err, ErrInvalidPacket) {
+				t.Errorf("expected invalid packet error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewDepacketizer("MP4V-ES", 90000, nil); !errors.Is(err, ErrNoVideo) {
+		t.Errorf("expected no video error, got %v", err)
+	}
+}
+
+func equalNALUs(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package rtsp
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// how many access units are queued for a slow reader of a frame stream before we start dropping them
+const frameBuffer = 30
+
+// FrameStream plays the H.264 or H.265 video of a camera over interleaved TCP and reassembles it into access units,
+// without any ffmpeg between the camera and whatever reads them
+type FrameStream struct {
+	video        *VideoStream
+	depacketizer *Depacketizer
+	frames       chan AccessUnit
+
+	// how many units were dropped because our reader fell behind
+	dropped atomic.Int64
+}
+
+// OpenFrames sets up and plays the first H.264 or H.265 video stream at the passed in URL, which may include
+// credentials
+func OpenFrames(rawURL string, timeout time.Duration) (*FrameStream, error) {
+	video, err := OpenVideo(rawURL, timeout, "H264", "H265")
+	if err != nil {
+		return nil, err
+	}
+	depacketizer, err := NewDepacketizer(video.Encoding, video.ClockRate, video.ParameterSets())
+	if err != nil {
+		video.Close()
+		return nil, err
+	}
+	return &FrameStream{video: video, depacketizer: depacketizer, frames: make(chan AccessUnit, frameBuffer)}, nil
+}
+
+// Encoding returns the encoding of our video, H264 or H265
+func (f *FrameStream) Encoding() string {
+	return f.depacketizer.encoding
+}
+
+// ParameterSets returns the parameter sets the camera described its video with
+func (f *FrameStream) ParameterSets() [][]byte {
+	return f.video.ParameterSets()
+}
+
+// Frames returns the channel access units are delivered on, which is closed once Run returns
+func (f *FrameStream) Frames() <-chan AccessUnit {
+	return f.frames
+}
+
+// Dropped returns how many access units have been dropped because our reader fell behind
+func (f *FrameStream) Dropped() int64 {
+	return f.dropped.Load()
+}
+
+// Run reads the stream, delivering each complete access unit on our channel, until the passed in context is done or
+// the stream fails. A reader which falls behind has units dropped until the next keyframe so that it never sees a
+// unit it can't decode, rather than holding up the camera.
+func (f *FrameStream) Run(ctx context.Context) error {
+	defer close(f.frames)
+
+	stop := context.AfterFunc(ctx, func() { f.video.Close() })
+	defer stop()
+
+	dropping := false
+	for {
+		packet, err := f.video.ReadRTP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		units, err := f.depacketizer.Push(packet, time.Now())
+		if err != nil {
+			continue
+		}
+		for _, unit := range units {
+			if dropping && !unit.Keyframe {
+				f.dropped.Add(1)
+				continue
+			}
+			select {
+			case f.frames <- unit:
+				dropping = false
+			default:
+				f.dropped.Add(1)
+				dropping = true
+			}
+		}
+	}
+}
+
+// Close tears down the stream
+func (f *FrameStream) Close() error {
+	return f.video.Close()
+}
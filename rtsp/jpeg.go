@@ -0,0 +1,249 @@
+package rtsp
+
+import (
+	"encoding/binary"
+)
+
+// the quantization tables of RFC 2435 in zigzag order, which are scaled by the Q of packets not carrying their own
+var (
+	jpegLumaQuantizer = [64]byte{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	}
+	jpegChromaQuantizer = [64]byte{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+	}
+)
+
+// the standard Huffman tables of the JPEG spec, annex K.3, which RTP JPEG always uses, as the count of codes of each
+// length followed by their symbols
+var (
+	jpegLumaDCCodeLens   = []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+	jpegLumaDCSymbols    = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	jpegChromaDCCodeLens = []byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}
+	jpegChromaDCSymbols  = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	jpegLumaACCodeLens   = []byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}
+	jpegLumaACSymbols    = []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+	jpegChromaACCodeLens = []byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}
+	jpegChromaACSymbols  = []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}
+)
+
+// JPEGDepacketizer reassembles the RTP packets of a Motion JPEG stream, RFC 2435, into complete JPEG images. RTP
+// strips the headers from each image so these are rebuilt from the few parameters sent along with it.
+type JPEGDepacketizer struct {
+	// the scan data of the image being reassembled, and the parameters its headers are rebuilt from
+	data      []byte
+	timestamp uint32
+	typ       byte
+	q         byte
+	width     int
+	height    int
+	restart   uint16
+	tables    []byte
+
+	// the tables of the last image sent with a Q from 128 up, which may leave them out when they don't change
+	dynamicQ      byte
+	dynamicTables []byte
+
+	// the sequence number we expect next, and whether we've lost a packet of the current image
+	seq     uint16
+	started bool
+	broken  bool
+}
+
+// NewJPEGDepacketizer creates a new depacketizer for Motion JPEG
+func NewJPEGDepacketizer() *JPEGDepacketizer {
+	return &JPEGDepacketizer{broken: true}
+}
+
+// Push adds the passed in RTP packet, returning the JPEG image it completes if any. Images missing a packet are
+// dropped.
+func (d *JPEGDepacketizer) Push(packet []byte) ([]byte, error) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return nil, ErrInvalidPacket
+	}
+	marker := packet[1]&0x80 != 0
+	seq := binary.BigEndian.Uint16(packet[2:])
+	timestamp := binary.BigEndian.Uint32(packet[4:])
+
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return nil, ErrInvalidPacket
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > offset {
+		end -= int(packet[end-1])
+	}
+	if offset+8 > end {
+		return nil, ErrInvalidPacket
+	}
+	payload := packet[offset:end]
+
+	if d.started && seq != d.seq {
+		d.broken = true
+	}
+	d.seq, d.started = seq+1, true
+
+	// the main header, the fragment offset then the type, Q and dimensions in blocks of 8 pixels
+	fragment := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+	typ, q := payload[4], payload[5]
+	width, height := int(payload[6])*8, int(payload[7])*8
+	payload = payload[8:]
+
+	// the first packet of an image starts it afresh, anything else must follow on from what we have
+	if fragment == 0 {
+		d.data, d.broken = d.data[:0], false
+		d.timestamp, d.typ, d.q, d.width, d.height, d.restart, d.tables = timestamp, typ, q, width, height, 0, nil
+	} else if d.broken || timestamp != d.timestamp || fragment != len(d.data) {
+		d.broken = true
+		return nil, nil
+	}
+
+	// types from 64 carry a restart marker header
+	if typ >= 64 && typ < 128 {
+		if len(payload) < 4 {
+			return nil, ErrInvalidPacket
+		}
+		if fragment == 0 {
+			d.restart = binary.BigEndian.Uint16(payload)
+		}
+		payload = payload[4:]
+	}
+
+	// Q from 128 means the first packet carries the quantization tables themselves
+	if q >= 128 && fragment == 0 {
+		if len(payload) < 4 {
+			return nil, ErrInvalidPacket
+		}
+		length := int(binary.BigEndian.Uint16(payload[2:]))
+		if len(payload) < 4+length {
+			return nil, ErrInvalidPacket
+		}
+		d.tables = append([]byte{}, payload[4:4+length]...)
+		payload = payload[4+length:]
+	}
+
+	d.data = append(d.data, payload...)
+	if !marker || d.broken {
+		return nil, nil
+	}
+	d.broken = true
+	return d.image()
+}
+
+// returns the image we've reassembled, the scan data preceded by its rebuilt headers
+func (d *JPEGDepacketizer) image() ([]byte, error) {
+	tables := d.tables
+	switch {
+	case d.q < 128:
+		tables = jpegScaledTables(d.q)
+	case len(tables) > 0:
+		d.dynamicQ, d.dynamicTables = d.q, tables
+	case d.dynamicQ == d.q && len(d.dynamicTables) > 0:
+		tables = d.dynamicTables
+	}
+
+	// we only understand the two baseline types, 4:2:2 and 4:2:0, each with one or two 8 bit tables
+	if d.typ&0x3f > 1 || (len(tables) != 64 && len(tables) != 128) || d.width == 0 || d.height == 0 {
+		return nil, ErrInvalidPacket
+	}
+
+	b := make([]byte, 0, len(d.data)+1024)
+	b = append(b, 0xff, 0xd8)
+
+	for i := 0; i < len(tables)/64; i++ {
+		b = append(b, 0xff, 0xdb, 0, 67, byte(i))
+		b = append(b, tables[i*64:(i+1)*64]...)
+	}
+	chromaTable := byte(len(tables)/64 - 1)
+
+	if d.restart > 0 {
+		b = append(b, 0xff, 0xdd, 0, 4)
+		b = binary.BigEndian.AppendUint16(b, d.restart)
+	}
+
+	// the luma component is sampled at twice the chroma horizontally, and for type 1 vertically too
+	lumaSampling := byte(0x21)
+	if d.typ&0x3f == 1 {
+		lumaSampling = 0x22
+	}
+	b = append(b, 0xff, 0xc0, 0, 17, 8)
+	b = binary.BigEndian.AppendUint16(b, uint16(d.height))
+	b = binary.BigEndian.AppendUint16(b, uint16(d.width))
+	b = append(b, 3, 1, lumaSampling, 0, 2, 0x11, chromaTable, 3, 0x11, chromaTable)
+
+	b = jpegHuffmanTable(b, 0x00, jpegLumaDCCodeLens, jpegLumaDCSymbols)
+	b = jpegHuffmanTable(b, 0x10, jpegLumaACCodeLens, jpegLumaACSymbols)
+	b = jpegHuffmanTable(b, 0x01, jpegChromaDCCodeLens, jpegChromaDCSymbols)
+	b = jpegHuffmanTable(b, 0x11, jpegChromaACCodeLens, jpegChromaACSymbols)
+
+	b = append(b, 0xff, 0xda, 0, 12, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0)
+	b = append(b, d.data...)
+
+	// the scan data may already end with an end of image marker
+	if len(d.data) < 2 || d.data[len(d.data)-2] != 0xff || d.data[len(d.data)-1] != 0xd9 {
+		b = append(b, 0xff, 0xd9)
+	}
+	return b, nil
+}
+
+// appends a DHT segment holding the passed in Huffman table
+func jpegHuffmanTable(b []byte, class byte, codeLens []byte, symbols []byte) []byte {
+	b = append(b, 0xff, 0xc4)
+	b = binary.BigEndian.AppendUint16(b, uint16(3+len(codeLens)+len(symbols)))
+	b = append(b, class)
+	b = append(b, codeLens...)
+	return append(b, symbols...)
+}
+
+// returns the luma and chroma quantization tables for the passed in Q, from 1 to 99, as RFC 2435 derives them
+func jpegScaledTables(q byte) []byte {
+	var factor int
+	switch {
+	case q == 0:
+		factor = 5000
+	case q < 50:
+		factor = 5000 / int(q)
+	default:
+		factor = 200 - 2*int(q)
+	}
+
+	tables := make([]byte, 128)
+	for i := range 64 {
+		tables[i] = byte(min(max((int(jpegLumaQuantizer[i])*factor+50)/100, 1), 255))
+		tables[64+i] = byte(min(max((int(jpegChromaQuantizer[i])*factor+50)/100, 1), 255))
+	}
+	return tables
+}
@@ -0,0 +1,106 @@
+package rtsp
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// Playback is every audio and video stream of a camera played over interleaved TCP, media i of its SDP is carried
+// on channel 2i for RTP and 2i+1 for RTCP
+type Playback struct {
+	session *Session
+
+	// the SDP the camera described its streams with and the media we set up from it
+	SDP   string
+	Media []Media
+}
+
+// OpenPlayback sets up and plays every audio and video stream at the passed in URL, which may include credentials
+func OpenPlayback(rawURL string, timeout time.Duration) (*Playback, error) {
+	session, err := Dial(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := setupPlayback(session, nil, map[string]string{"Range": "npt=0.000-"})
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error playing %q: %w", creds.Redact(rawURL), err)
+	}
+	return p, nil
+}
+
+// sets up and plays every stream of the session, sending the passed in headers with every request and the passed in
+// play headers with the PLAY
+func setupPlayback(session *Session, headers map[string]string, playHeaders map[string]string) (*Playback, error) {
+	with := func(extra map[string]string) map[string]string {
+		h := maps.Clone(headers)
+		if h == nil {
+			h = map[string]string{}
+		}
+		maps.Copy(h, extra)
+		return h
+	}
+
+	describe, err := session.Do("DESCRIBE", "", with(map[string]string{"Accept": "application/sdp"}))
+	if err != nil {
+		return nil, err
+	}
+	if describe.StatusCode != 200 {
+		return nil, fmt.Errorf("describe failed with status %q", describe.Status)
+	}
+
+	base := session.URL()
+	if cb := describe.Header.Get("Content-Base"); cb != "" {
+		base = cb
+	}
+
+	p := &Playback{session: session, SDP: string(describe.Body)}
+	for _, m := range ParseSDP(p.SDP).Media {
+		if m.Type != "video" && m.Type != "audio" {
+			continue
+		}
+
+		channel := len(p.Media) * 2
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		setup, err := session.Do("SETUP", resolveControl(base, m.Control), with(map[string]string{"Transport": transport}))
+		if err != nil {
+			return nil, err
+		}
+		if setup.StatusCode != 200 {
+			return nil, fmt.Errorf("setup of %s failed with status %q", m.Type, setup.Status)
+		}
+		if got := interleavedChannel(setup.Header.Get("Transport"), channel); got != channel {
+			return nil, fmt.Errorf("setup of %s gave us channel %d instead of %d", m.Type, got, channel)
+		}
+		p.Media = append(p.Media, m)
+	}
+	if len(p.Media) == 0 {
+		return nil, ErrNoVideo
+	}
+
+	play, err := session.Do("PLAY", "", with(playHeaders))
+	if err != nil {
+		return nil, err
+	}
+	if play.StatusCode != 200 {
+		return nil, fmt.Errorf("play failed with status %q", play.Status)
+	}
+	return p, nil
+}
+
+// ReadPacket returns the channel and payload of the next RTP or RTCP packet, keeping the session alive as it goes
+func (p *Playback) ReadPacket() (int, []byte, error) {
+	if err := p.session.KeepAlive(); err != nil {
+		return 0, nil, err
+	}
+	return p.session.ReadInterleaved()
+}
+
+// Close tears down the playback
+func (p *Playback) Close() error {
+	return p.session.Close()
+}
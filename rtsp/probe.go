@@ -0,0 +1,125 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/media"
+)
+
+// codec names and descriptions for SDP encodings, named as ffprobe names them so results are interchangeable
+var sdpCodecs = map[string][2]string{
+	"H264":          {"h264", "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"},
+	"H265":          {"hevc", "H.265 / HEVC (High Efficiency Video Coding)"},
+	"JPEG":          {"mjpeg", "Motion JPEG"},
+	"MP4V-ES":       {"mpeg4", "MPEG-4 part 2"},
+	"PCMU":          {"pcm_mulaw", "PCM mu-law / G.711 mu-law"},
+	"PCMA":          {"pcm_alaw", "PCM A-law / G.711 A-law"},
+	"MPEG4-GENERIC": {"aac", "AAC (Advanced Audio Coding)"},
+	"MP4A-LATM":     {"aac_latm", "AAC LATM (Advanced Audio Coding LATM syntax)"},
+	"OPUS":          {"opus", "Opus (Opus Interactive Audio Codec)"},
+	"L16":           {"pcm_s16be", "PCM signed 16-bit big-endian"},
+}
+
+// ProbeStreams describes the stream at the passed in URL, which may include credentials, and returns its audio and
+// video streams in the same form as ffprobe, reading video dimensions and frame rates from the SDP parameter sets
+func ProbeStreams(rawURL string, timeout time.Duration) ([]media.StreamInfo, error) {
+	session, err := Dial(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// some cameras won't answer a DESCRIBE until they've seen OPTIONS, we don't care what they support
+	if _, err := session.Do("OPTIONS", "", nil); err != nil {
+		return nil, fmt.Errorf("error sending options to %q: %w", creds.Redact(rawURL), err)
+	}
+
+	resp, err := session.Do("DESCRIBE", "", map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, fmt.Errorf("error describing %q: %w", creds.Redact(rawURL), err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("describe of %q failed with status %q", creds.Redact(rawURL), resp.Status)
+	}
+
+	return StreamsFromSDP(ParseSDP(string(resp.Body))), nil
+}
+
+// StreamsFromSDP converts the audio and video media in the passed in SDP to streams
+func StreamsFromSDP(desc *SessionDescription) []media.StreamInfo {
+	streams := []media.StreamInfo{}
+	for _, m := range desc.Media {
+		if m.Type != "video" && m.Type != "audio" {
+			continue
+		}
+
+		pt, encoding := m.Encoding()
+		stream := media.StreamInfo{Index: len(streams), CodecType: m.Type, CodecName: strings.ToLower(encoding)}
+		if codec, found := sdpCodecs[encoding]; found {
+			stream.CodecName, stream.CodecLongName = codec[0], codec[1]
+		}
+
+		if m.Type == "audio" {
+			stream.SampleRate, stream.Channels = audioParams(encoding, m.RTPMaps[pt])
+		}
+
+		frameRate := m.FrameRate
+		if params := videoParams(encoding, m.FMTPs[pt]); params != nil {
+			stream.Width, stream.Height = params.Width, params.Height
+			if params.FrameRate > 0 {
+				frameRate = params.FrameRate
+			}
+		}
+		// an SDP can only declare a constant frame rate
+		stream.FrameRate = media.FrameRateFromFPS(frameRate)
+		stream.RealFrameRate = stream.FrameRate
+
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// returns the sample rate and channels of audio with the passed in encoding and rtpmap, zero if we can't tell
+func audioParams(encoding string, rtpmap RTPMap) (media.Number, int) {
+	switch {
+	case encoding == "G722":
+		// G.722 is declared with an 8kHz clock for historical reasons but is sampled at 16kHz
+		return 16000, max(rtpmap.Channels, 1)
+	case rtpmap.ClockRate > 0:
+		return media.Number(rtpmap.ClockRate), max(rtpmap.Channels, 1)
+	case encoding == "PCMU" || encoding == "PCMA":
+		return 8000, 1
+	}
+	return 0, 0
+}
+
+// returns the video parameters from the SPS in the passed in fmtp parameters, nil if there isn't one we can read
+func videoParams(encoding string, fmtp map[string]string) *VideoParams {
+	var sps string
+	var parse func([]byte) (*VideoParams, error)
+
+	switch encoding {
+	case "H264":
+		sps, _, _ = strings.Cut(fmtp["sprop-parameter-sets"], ",")
+		parse = ParseH264SPS
+	case "H265":
+		sps = fmtp["sprop-sps"]
+		parse = ParseH265SPS
+	default:
+		return nil
+	}
+
+	nal, err := base64.StdEncoding.DecodeString(sps)
+	if err != nil || len(nal) == 0 {
+		return nil
+	}
+	params, err := parse(nal)
+	if err != nil {
+		return nil
+	}
+	return params
+}
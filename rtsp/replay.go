@@ -0,0 +1,62 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// the Require header value cameras need to see before they'll replay recordings from their storage
+const replayRequire = "onvif-replay"
+
+// the RTP header extension profile ONVIF replay uses to carry the time each packet was recorded
+const replayExtensionProfile = 0xABAC
+
+// the offset between the NTP epoch of 1900 and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// OpenReplay replays the recording at the passed in replay URI, as returned by onvif.Device.GetReplayURI, from the
+// passed in time. Packets are sent as fast as the camera can rather than in real time, and carry the time they were
+// recorded which ReplayTime reads.
+func OpenReplay(rawURL string, timeout time.Duration, from time.Time) (*Playback, error) {
+	session, err := Dial(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{"Require": replayRequire}
+	play := map[string]string{
+		"Range":        "clock=" + from.UTC().Format("20060102T150405.000Z") + "-",
+		"Rate-Control": "no",
+	}
+	p, err := setupPlayback(session, headers, play)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error replaying %q: %w", creds.Redact(rawURL), err)
+	}
+	return p, nil
+}
+
+// ReplayTime returns the time the passed in RTP packet of a replay was recorded, from its ONVIF replay header
+// extension, false if it doesn't have one
+func ReplayTime(packet []byte) (time.Time, bool) {
+	if len(packet) < 12 || packet[0]>>6 != 2 || packet[0]&0x10 == 0 {
+		return time.Time{}, false
+	}
+
+	// the extension follows the fixed header and any CSRCs
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if len(packet) < offset+4+8 {
+		return time.Time{}, false
+	}
+	if binary.BigEndian.Uint16(packet[offset:]) != replayExtensionProfile || binary.BigEndian.Uint16(packet[offset+2:]) < 3 {
+		return time.Time{}, false
+	}
+
+	seconds := binary.BigEndian.Uint32(packet[offset+4:])
+	fraction := binary.BigEndian.Uint32(packet[offset+8:])
+	nanos := (int64(fraction) * int64(time.Second)) >> 32
+	return time.Unix(int64(seconds)-ntpEpochOffset, nanos).UTC(), true
+}
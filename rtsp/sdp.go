@@ -0,0 +1,186 @@
+package rtsp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media is a single media section of an SDP
+type Media struct {
+	Type      string
+	Payloads  []int
+	Control   string
+	Direction string
+
+	// rtpmap encodings and fmtp parameters keyed by payload type
+	RTPMaps map[int]RTPMap
+	FMTPs   map[int]map[string]string
+
+	// the frame rate from an a=framerate attribute, zero if not present
+	FrameRate float64
+}
+
+// RTPMap is the encoding of an RTP payload type
+type RTPMap struct {
+	Encoding  string
+	ClockRate int
+	Channels  int
+}
+
+// SessionDescription is the subset of an SDP we care about
+type SessionDescription struct {
+	Control string
+	Media   []Media
+}
+
+// ParseSDP parses the passed in session description, ignoring anything it doesn't understand
+func ParseSDP(sdp string) *SessionDescription {
+	desc := &SessionDescription{}
+	var current *Media
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+
+		if key == "m" {
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				current = nil
+				continue
+			}
+			desc.Media = append(desc.Media, Media{Type: fields[0], Direction: "sendrecv", RTPMaps: map[int]RTPMap{}, FMTPs: map[int]map[string]string{}})
+			current = &desc.Media[len(desc.Media)-1]
+			for _, f := range fields[3:] {
+				if pt, err := strconv.Atoi(f); err == nil {
+					current.Payloads = append(current.Payloads, pt)
+				}
+			}
+			continue
+		}
+		if key != "a" {
+			continue
+		}
+
+		attr, attrValue, _ := strings.Cut(value, ":")
+		if current == nil {
+			if attr == "control" {
+				desc.Control = attrValue
+			}
+			continue
+		}
+
+		switch attr {
+		case "control":
+			current.Control = attrValue
+		case "sendonly", "recvonly", "sendrecv", "inactive":
+			current.Direction = attr
+		case "framerate":
+			current.FrameRate, _ = strconv.ParseFloat(strings.TrimSpace(attrValue), 64)
+		case "rtpmap":
+			pt, encoding, ok := payloadAttr(attrValue)
+			if !ok {
+				continue
+			}
+			parts := strings.Split(encoding, "/")
+			m := RTPMap{Encoding: parts[0]}
+			if len(parts) > 1 {
+				m.ClockRate, _ = strconv.Atoi(parts[1])
+			}
+			if len(parts) > 2 {
+				m.Channels, _ = strconv.Atoi(parts[2])
+			}
+			current.RTPMaps[pt] = m
+		case "fmtp":
+			pt, params, ok := payloadAttr(attrValue)
+			if !ok {
+				continue
+			}
+			fmtp := map[string]string{}
+			for _, param := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if k != "" {
+					fmtp[strings.ToLower(k)] = v
+				}
+			}
+			current.FMTPs[pt] = fmtp
+		}
+	}
+	return desc
+}
+
+// returns the payload type and remaining value of an rtpmap or fmtp attribute
+func payloadAttr(value string) (int, string, bool) {
+	ptStr, rest, found := strings.Cut(strings.TrimSpace(value), " ")
+	if !found {
+		return 0, "", false
+	}
+	pt, err := strconv.Atoi(ptStr)
+	if err != nil {
+		return 0, "", false
+	}
+	return pt, strings.TrimSpace(rest), true
+}
+
+// Encoding returns the encoding of the first payload of this media, using the static payload types if there is no
+// rtpmap for it
+func (m *Media) Encoding() (int, string) {
+	if len(m.Payloads) == 0 {
+		return 0, ""
+	}
+	pt := m.Payloads[0]
+	if rtpmap, found := m.RTPMaps[pt]; found {
+		return pt, strings.ToUpper(rtpmap.Encoding)
+	}
+	switch pt {
+	case PayloadPCMU:
+		return pt, "PCMU"
+	case PayloadPCMA:
+		return pt, "PCMA"
+	case 26:
+		return pt, "JPEG"
+	}
+	return pt, ""
+}
+
+// RewriteControls returns the passed in SDP with its session control set to * and its audio and video media
+// controlled by trackID=0, trackID=1 and so on, in order, any other media are dropped
+func RewriteControls(sdp string) string {
+	out := &strings.Builder{}
+	track := 0
+	inSession, skipping := true, false
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "m=") {
+			if inSession {
+				out.WriteString("a=control:*\r\n")
+				inSession = false
+			}
+			mediaType, _, _ := strings.Cut(strings.TrimPrefix(line, "m="), " ")
+			skipping = mediaType != "video" && mediaType != "audio"
+			if skipping {
+				continue
+			}
+			out.WriteString(line + "\r\n")
+			fmt.Fprintf(out, "a=control:trackID=%d\r\n", track)
+			track++
+			continue
+		}
+		if skipping || strings.HasPrefix(line, "a=control:") {
+			continue
+		}
+		out.WriteString(line + "\r\n")
+	}
+	if inSession {
+		out.WriteString("a=control:*\r\n")
+	}
+	return out.String()
+}
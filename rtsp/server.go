@@ -0,0 +1,109 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Request is a parsed RTSP request as received by a server
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// ReadRequest reads a single RTSP request from the passed in reader
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("error reading request line: %w", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid rtsp request line: %q", line)
+	}
+
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtsp request url: %q", fields[1])
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading headers: %w", err)
+	}
+
+	req := &Request{Method: fields[0], URL: u, Header: header}
+
+	if cl := header.Get("Content-Length"); cl != "" {
+		length, err := strconv.Atoi(cl)
+		if err != nil || length < 0 || length > 64*1024 {
+			return nil, fmt.Errorf("invalid content length: %q", cl)
+		}
+		req.Body = make([]byte, length)
+		if _, err := io.ReadFull(r, req.Body); err != nil {
+			return nil, fmt.Errorf("error reading body: %w", err)
+		}
+	}
+
+	return req, nil
+}
+
+// WriteResponse writes a response to the passed in request with the passed in status, headers and body
+func WriteResponse(w io.Writer, req *Request, code int, status string, headers map[string]string, body []byte) error {
+	resp := &strings.Builder{}
+	fmt.Fprintf(resp, "RTSP/1.0 %d %s\r\n", code, status)
+	if req != nil {
+		fmt.Fprintf(resp, "CSeq: %s\r\n", req.Header.Get("CSeq"))
+	}
+	fmt.Fprintf(resp, "Server: %s\r\n", userAgent)
+
+	// sorted so our responses are stable
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(resp, "%s: %s\r\n", k, headers[k])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(resp, "Content-Length: %d\r\n", len(body))
+	}
+	resp.WriteString("\r\n")
+	resp.Write(body)
+
+	if _, err := io.WriteString(w, resp.String()); err != nil {
+		return fmt.Errorf("error writing response: %w", err)
+	}
+	return nil
+}
+
+// ParseTransport returns the parameters of the passed in Transport header keyed by name, flags like unicast have an
+// empty value, the protocol itself is under the empty key
+func ParseTransport(transport string) map[string]string {
+	// clients may list several transports in preference order, we only look at the first
+	first, _, _ := strings.Cut(transport, ",")
+
+	params := map[string]string{}
+	for i, param := range strings.Split(first, ";") {
+		param = strings.TrimSpace(param)
+		if i == 0 {
+			params[""] = param
+			continue
+		}
+		k, v, _ := strings.Cut(param, "=")
+		params[strings.ToLower(k)] = v
+	}
+	return params
+}
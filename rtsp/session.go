@@ -0,0 +1,279 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// servers expire sessions after 60 seconds by default, so we keep ours alive well within that while playing
+const keepaliveInterval = 20 * time.Second
+
+// Session is a persistent RTSP connection which can send several requests in sequence and interleave RTP data
+// with them, as needed to set up and play a stream
+type Session struct {
+	url      *url.URL
+	username string
+	password string
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	cseq     int
+	lastSent time.Time
+
+	// the session id given to us by the server on SETUP, and the auth challenge we answer on every request, if any
+	id        string
+	challenge string
+}
+
+// Dial opens a session to the host in the passed in URL, any credentials in the URL are used to answer challenges
+func Dial(rawURL string, timeout time.Duration) (*Session, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rtsp url %q: %w", creds.Redact(rawURL), err)
+	}
+
+	s := &Session{url: u, timeout: timeout}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+		u.User = nil
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	s.conn, err = net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %q: %w", host, err)
+	}
+	s.reader = bufio.NewReader(s.conn)
+	return s, nil
+}
+
+// URL returns the URL of this session without credentials
+func (s *Session) URL() string {
+	return s.url.String()
+}
+
+// Do sends a request for the passed in URI, which defaults to the session URL, retrying once with credentials if
+// the server challenges us
+func (s *Session) Do(method string, uri string, headers map[string]string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uri == "" {
+		uri = s.url.String()
+	}
+
+	resp, err := s.roundTrip(method, uri, headers)
+	if err != nil || resp.StatusCode != 401 || s.username == "" {
+		return resp, err
+	}
+
+	s.challenge = resp.Header.Get("WWW-Authenticate")
+	return s.roundTrip(method, uri, headers)
+}
+
+// WriteInterleaved sends the passed in payload on the passed in interleaved channel
+func (s *Session) WriteInterleaved(channel int, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frame := make([]byte, 4, 4+len(payload))
+	frame[0], frame[1] = '$', byte(channel)
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return fmt.Errorf("error setting deadline: %w", err)
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		return fmt.Errorf("error writing interleaved data: %w", err)
+	}
+	return nil
+}
+
+// Close sends a TEARDOWN if we have a session and closes the connection
+func (s *Session) Close() error {
+	if s.id != "" {
+		s.Do("TEARDOWN", "", nil)
+	}
+	return s.conn.Close()
+}
+
+// Send sends a request for the session URL without waiting for its response, as needed to keep a session alive
+// while it is playing, the response is skipped over by ReadInterleaved
+func (s *Session) Send(method string, headers map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return fmt.Errorf("error setting deadline: %w", err)
+	}
+	return s.writeRequest(method, s.url.String(), headers)
+}
+
+// KeepAlive sends a GET_PARAMETER if we haven't sent anything for a while, as servers expire playing sessions
+// which they don't hear from, call it regularly while reading interleaved data
+func (s *Session) KeepAlive() error {
+	s.mu.Lock()
+	idle := time.Since(s.lastSent) > keepaliveInterval
+	s.mu.Unlock()
+
+	if !idle {
+		return nil
+	}
+	return s.Send("GET_PARAMETER", nil)
+}
+
+// sends a single request and reads its response, must be called with the lock held
+func (s *Session) roundTrip(method string, uri string, headers map[string]string) (*Response, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, fmt.Errorf("error setting deadline: %w", err)
+	}
+
+	if err := s.writeRequest(method, uri, headers); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.readResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	// remember our session, dropping any timeout parameter
+	if id := resp.Header.Get("Session"); id != "" {
+		s.id, _, _ = strings.Cut(id, ";")
+	}
+	return resp, nil
+}
+
+// writes a single request, must be called with the lock held
+func (s *Session) writeRequest(method string, uri string, headers map[string]string) error {
+	s.cseq++
+	req := &strings.Builder{}
+	fmt.Fprintf(req, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(req, "CSeq: %d\r\n", s.cseq)
+	fmt.Fprintf(req, "User-Agent: %s\r\n", userAgent)
+	if s.id != "" {
+		fmt.Fprintf(req, "Session: %s\r\n", s.id)
+	}
+	if s.challenge != "" {
+		authorization, err := creds.Authorization(s.challenge, method, uri, s.username, s.password)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(req, "Authorization: %s\r\n", authorization)
+	}
+	for k, v := range headers {
+		fmt.Fprintf(req, "%s: %s\r\n", k, v)
+	}
+	req.WriteString("\r\n")
+
+	if _, err := io.WriteString(s.conn, req.String()); err != nil {
+		return fmt.Errorf("error writing request: %w", err)
+	}
+	s.lastSent = time.Now()
+	return nil
+}
+
+// reads the next response, skipping over any interleaved data the server sends us in the meantime
+func (s *Session) readResponse() (*Response, error) {
+	for {
+		b, err := s.reader.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %w", err)
+		}
+		if b[0] != '$' {
+			return ReadResponse(s.reader)
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return nil, fmt.Errorf("error reading interleaved header: %w", err)
+		}
+		if _, err := s.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, fmt.Errorf("error reading interleaved data: %w", err)
+		}
+	}
+}
+
+// resolves a control attribute from an SDP against the passed in base URL
+func resolveControl(base string, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
+		return control
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return control
+	}
+	if !strings.HasSuffix(b.Path, "/") {
+		b.Path += "/"
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return control
+	}
+	return b.ResolveReference(ref).String()
+}
+
+// parses the interleaved channel numbers from a Transport header, returning the passed in default if not present
+func interleavedChannel(transport string, def int) int {
+	for _, param := range strings.Split(transport, ";") {
+		if v, found := strings.CutPrefix(strings.TrimSpace(param), "interleaved="); found {
+			first, _, _ := strings.Cut(v, "-")
+			if ch, err := strconv.Atoi(first); err == nil {
+				return ch
+			}
+		}
+	}
+	return def
+}
+
+// ReadInterleaved returns the channel and payload of the next interleaved frame the server sends, skipping over any
+// responses to requests sent with Send in the meantime, it fails if nothing arrives within our timeout
+func (s *Session) ReadInterleaved() (int, []byte, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return 0, nil, fmt.Errorf("error setting deadline: %w", err)
+	}
+
+	for {
+		b, err := s.reader.Peek(1)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error reading interleaved data: %w", err)
+		}
+		if b[0] != '$' {
+			if _, err := ReadResponse(s.reader); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return 0, nil, fmt.Errorf("error reading interleaved header: %w", err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			return 0, nil, fmt.Errorf("error reading interleaved data: %w", err)
+		}
+		return int(header[1]), payload, nil
+	}
+}
@@ -0,0 +1,307 @@
+package rtsp
+
+import (
+	"errors"
+)
+
+var (
+	errShortSPS   = errors.New("sps truncated")
+	errInvalidSPS = errors.New("sps invalid")
+)
+
+// the most reference frames a picture order count cycle can have
+const maxRefFramesInPOCCycle = 255
+
+// VideoParams are what we can learn about a video stream from its sequence parameter set
+type VideoParams struct {
+	Width  int
+	Height int
+
+	// the frame rate from the VUI timing info, zero if not present
+	FrameRate float64
+}
+
+// bitReader reads exp-golomb coded values from a NAL unit with emulation prevention bytes removed
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(nal []byte) *bitReader {
+	// strip emulation prevention bytes, 00 00 03 => 00 00
+	data := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		data = append(data, b)
+	}
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) bit() uint {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortSPS
+		return 0
+	}
+	b := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	v := uint(0)
+	for range n {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	for range n {
+		r.bit()
+	}
+}
+
+// reads an unsigned exp-golomb value
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errShortSPS
+			return 0
+		}
+	}
+	return (1 << zeros) - 1 + r.bits(zeros)
+}
+
+// reads a signed exp-golomb value
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int(v / 2)
+	}
+	return int(v+1) / 2
+}
+
+// ParseH264SPS parses the dimensions and frame rate from the passed in H.264 SPS NAL unit
+func ParseH264SPS(nal []byte) (*VideoParams, error) {
+	r := newBitReader(nal)
+	r.skip(8) // nal header
+
+	profile := r.bits(8)
+	r.skip(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+
+		// seq_scaling_matrix_present_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if r.bit() == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	// pic_order_cnt_type
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+
+		// num_ref_frames_in_pic_order_cnt_cycle, bounded so a corrupt SPS can't keep us reading
+		cycle := r.ue()
+		if cycle > maxRefFramesInPOCCycle {
+			return nil, errInvalidSPS
+		}
+		for range cycle {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+
+	// crop units depend on chroma subsampling
+	cropX, cropY := uint(1), 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX, cropY = 2, 2-frameMbsOnly
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// a crop as large as the frame would leave nothing, or wrap around to an enormous frame
+	width, height := widthMbs*16, (2-frameMbsOnly)*heightMapUnits*16
+	cropWidth, cropHeight := (cropLeft+cropRight)*cropX, (cropTop+cropBottom)*cropY
+	if cropWidth >= width || cropHeight >= height {
+		return nil, errInvalidSPS
+	}
+	params := &VideoParams{Width: int(width - cropWidth), Height: int(height - cropHeight)}
+
+	// frame rate is optional and deep in the VUI, so failing to read it isn't an error
+	if r.bit() == 1 {
+		params.FrameRate = parseH264VUIFrameRate(r)
+	}
+	return params, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for range size {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// reads through the VUI parameters to the timing info, returning the frame rate or zero
+func parseH264VUIFrameRate(r *bitReader) float64 {
+	if r.bit() == 1 { // aspect_ratio_info_present_flag
+		if r.bits(8) == 255 { // Extended_SAR
+			r.skip(32)
+		}
+	}
+	if r.bit() == 1 { // overscan_info_present_flag
+		r.skip(1)
+	}
+	if r.bit() == 1 { // video_signal_type_present_flag
+		r.skip(4)
+		if r.bit() == 1 { // colour_description_present_flag
+			r.skip(24)
+		}
+	}
+	if r.bit() == 1 { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if r.bit() == 0 { // timing_info_present_flag
+		return 0
+	}
+
+	unitsInTick := r.bits(32)
+	timeScale := r.bits(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// ParseH265SPS parses the dimensions from the passed in H.265 SPS NAL unit, the frame rate isn't read as it is
+// rarely present and comes after a great deal of other parameters
+func ParseH265SPS(nal []byte) (*VideoParams, error) {
+	r := newBitReader(nal)
+	r.skip(16) // nal header
+	r.skip(4)  // sps_video_parameter_set_id
+	maxSubLayers := int(r.bits(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	skipH265ProfileTierLevel(r, maxSubLayers)
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	if chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width := r.ue()
+	height := r.ue()
+
+	if r.bit() == 1 { // conformance_window_flag
+		subWidth, subHeight := uint(1), uint(1)
+		switch chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropWidth, cropHeight := (left+right)*subWidth, (top+bottom)*subHeight
+		if r.err == nil && (cropWidth >= width || cropHeight >= height) {
+			return nil, errInvalidSPS
+		}
+		width -= cropWidth
+		height -= cropHeight
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &VideoParams{Width: int(width), Height: int(height)}, nil
+}
+
+// skips the profile_tier_level of an H.265 VPS or SPS, the general profile is 88 bits then level 8
+func skipH265ProfileTierLevel(r *bitReader, maxSubLayers int) {
+	r.skip(96)
+	subProfile := make([]bool, maxSubLayers)
+	subLevel := make([]bool, maxSubLayers)
+	for i := range maxSubLayers {
+		subProfile[i] = r.bit() == 1
+		subLevel[i] = r.bit() == 1
+	}
+	if maxSubLayers > 0 {
+		r.skip(2 * (8 - maxSubLayers))
+	}
+	for i := range maxSubLayers {
+		if subProfile[i] {
+			r.skip(88)
+		}
+		if subLevel[i] {
+			r.skip(8)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// bitWriter builds parameter sets bit by bit so tests can describe exactly the SPS they need
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bit(b uint) *bitWriter {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if b != 0 {
+		w.data[len(w.data)-1] |= 1 << (7 - w.n%8)
+	}
+	w.n++
+	return w
+}
+
+func (w *bitWriter) bits(n int, v uint) *bitWriter {
+	for i := n - 1; i >= 0; i-- {
+		w.bit((v >> i) & 1)
+	}
+	return w
+}
+
+func (w *bitWriter) ue(v uint) *bitWriter {
+	v++
+	size := 0
+	for x := v; x > 1; x >>= 1 {
+		size++
+	}
+	return w.bits(size, 0).bits(size+1, v)
+}
+
+func (w *bitWriter) se(v int) *bitWriter {
+	if v > 0 {
+		return w.ue(uint(2*v - 1))
+	}
+	return w.ue(uint(-2 * v))
+}
+
+// returns what has been written with the trailing bits set, as an encoder would
+func (w *bitWriter) bytes() []byte {
+	w.bit(1)
+	for w.n%8 != 0 {
+		w.bit(0)
+	}
+	return w.data
+}
+
+// h264SPS describes a baseline H.264 SPS
+type h264SPS struct {
+	widthMbs, heightMbs uint
+	frameMbsOnly        uint
+	pocType             uint
+	pocCycle            uint
+	crop                [4]uint // left, right, top, bottom
+}
+
+func (s h264SPS) encode() []byte {
+	w := &bitWriter{}
+	w.bits(8, 0x67).bits(8, 66).bits(16, 0x001e) // nal header, baseline profile, constraints and level
+	w.ue(0)                                      // seq_parameter_set_id
+	w.ue(0)                                      // log2_max_frame_num_minus4
+	w.ue(s.pocType)
+	switch s.pocType {
+	case 0:
+		w.ue(0)
+	case 1:
+		w.bit(0).se(0).se(0).ue(s.pocCycle)
+		for range min(s.pocCycle, 300) {
+			w.se(1)
+		}
+	}
+	w.ue(1).bit(0) // max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	w.ue(s.widthMbs - 1).ue(s.heightMbs - 1).bit(s.frameMbsOnly)
+	if s.frameMbsOnly == 0 {
+		w.bit(0)
+	}
+	w.bit(1) // direct_8x8_inference_flag
+	if s.crop != [4]uint{} {
+		w.bit(1).ue(s.crop[0]).ue(s.crop[1]).ue(s.crop[2]).ue(s.crop[3])
+	} else {
+		w.bit(0)
+	}
+	w.bit(0) // vui_parameters_present_flag
+	return w.bytes()
+}
+
+func TestParseH264SPS(t *testing.T) {
+	camera, err := base64.StdEncoding.DecodeString("Z2QAKKwbGoB4AiflQA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name   string
+		sps    []byte
+		width  int
+		height int
+		err    error
+	}{
+		{name: "camera 1080p", sps: camera, width: 1920, height: 1080},
+		{name: "720p", sps: h264SPS{widthMbs: 80, heightMbs: 45, frameMbsOnly: 1}.encode(), width: 1280, height: 720},
+		{name: "1080p cropped", sps: h264SPS{widthMbs: 120, heightMbs: 68, frameMbsOnly: 1, crop: [4]uint{0, 0, 0, 4}}.encode(), width: 1920, height: 1080},
+		{name: "interlaced", sps: h264SPS{widthMbs: 45, heightMbs: 18, frameMbsOnly: 0}.encode(), width: 720, height: 576},
+		{name: "poc cycle", sps: h264SPS{widthMbs: 40, heightMbs: 30, frameMbsOnly: 1, pocType: 1, pocCycle: 3}.encode(), width: 640, height: 480},
+		{name: "poc cycle at limit", sps: h264SPS{widthMbs: 40, heightMbs: 30, frameMbsOnly: 1, pocType: 1, pocCycle: 255}.encode(), width: 640, height: 480},
+		{name: "poc cycle over limit", sps: h264SPS{widthMbs: 40, heightMbs: 30, frameMbsOnly: 1, pocType: 1, pocCycle: 256}.encode(), err: errInvalidSPS},
+		{name: "huge poc cycle", sps: (&bitWriter{}).bits(8, 0x67).bits(8, 66).bits(16, 0x1e).ue(0).ue(0).ue(1).bit(0).se(0).se(0).ue(1 << 30).bytes(), err: errInvalidSPS},
+		{name: "crop wider than frame", sps: h264SPS{widthMbs: 1, heightMbs: 1, frameMbsOnly: 1, crop: [4]uint{5, 5, 0, 0}}.encode(), err: errInvalidSPS},
+		{name: "crop taller than frame", sps: h264SPS{widthMbs: 1, heightMbs: 1, frameMbsOnly: 1, crop: [4]uint{0, 0, 4, 4}}.encode(), err: errInvalidSPS},
+		{name: "truncated", sps: camera[:6], err: errShortSPS},
+		{name: "empty", sps: []byte{}, err: errShortSPS},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := ParseH264SPS(tc.sps)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) || params != nil {
+					t.Fatalf("expected error %v, got %+v, %v", tc.err, params, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if params.Width != tc.width || params.Height != tc.height {
+				t.Errorf("expected %dx%d, got %dx%d", tc.width, tc.height, params.Width, params.Height)
+			}
+		})
+	}
+}
+
+// encodes an H.265 SPS with a single sub layer and the passed in dimensions and conformance window
+func h265SPS(chromaFormat uint, width uint, height uint, crop [4]uint) []byte {
+	w := &bitWriter{}
+	w.bits(16, 0x4201)         // nal header
+	w.bits(4, 0).bits(3, 0)    // sps_video_parameter_set_id, sps_max_sub_layers_minus1
+	w.bit(1)                   // sps_temporal_id_nesting_flag
+	w.bits(32, 0x01600000)     // general profile space, tier, idc and compatibility flags
+	w.bits(48, 0).bits(8, 120) // general constraint flags and level
+	w.bits(8, 0)               // padding out the 96 bits of profile_tier_level
+	w.ue(0).ue(chromaFormat)
+	if chromaFormat == 3 {
+		w.bit(0)
+	}
+	w.ue(width).ue(height)
+	if crop != [4]uint{} {
+		w.bit(1).ue(crop[0]).ue(crop[1]).ue(crop[2]).ue(crop[3])
+	} else {
+		w.bit(0)
+	}
+	return w.bytes()
+}
+
+func TestParseH265SPS(t *testing.T) {
+	tcs := []struct {
+		name   string
+		sps    []byte
+		width  int
+		height int
+		err    error
+	}{
+		{name: "1080p", sps: h265SPS(1, 1920, 1080, [4]uint{}), width: 1920, height: 1080},
+		{name: "1080p from 1088", sps: h265SPS(1, 1920, 1088, [4]uint{0, 0, 0, 4}), width: 1920, height: 1080},
+		{name: "4:4:4 cropped", sps: h265SPS(3, 1280, 720, [4]uint{2, 2, 0, 0}), width: 1276, height: 720},
+		{name: "crop wider than frame", sps: h265SPS(1, 64, 64, [4]uint{16, 16, 0, 0}), err: errInvalidSPS},
+		{name: "crop taller than frame", sps: h265SPS(1, 64, 64, [4]uint{0, 0, 40, 0}), err: errInvalidSPS},
+		{name: "truncated", sps: h265SPS(1, 1920, 1080, [4]uint{})[:10], err: errShortSPS},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := ParseH265SPS(tc.sps)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) || params != nil {
+					t.Fatalf("expected error %v, got %+v, %v", tc.err, params, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if params.Width != tc.width || params.Height != tc.height {
+				t.Errorf("expected %dx%d, got %dx%d", tc.width, tc.height, params.Width, params.Height)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+)
+
+// ErrNoVideo is returned when a camera doesn't offer a video stream we can play
+var ErrNoVideo = errors.New("no supported video stream")
+
+// VideoStream is the video of a camera played over interleaved TCP, which RTP packets can be read from
+type VideoStream struct {
+	session *Session
+	channel int
+
+	// the RTP payload type, encoding and clock rate of the video as described by the camera
+	PayloadType int
+	Encoding    string
+	ClockRate   int
+
+	// the fmtp parameters of the video, these carry the parameter sets for H.264 and H.265
+	FMTP map[string]string
+}
+
+// OpenVideo sets up and plays the first video stream at the passed in URL, which may include credentials, with one
+// of the passed in encodings, any encoding if none are passed in
+func OpenVideo(rawURL string, timeout time.Duration, encodings ...string) (*VideoStream, error) {
+	session, err := Dial(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := setupVideo(session, encodings)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error playing %q: %w", creds.Redact(rawURL), err)
+	}
+	return v, nil
+}
+
+func setupVideo(session *Session, encodings []string) (*VideoStream, error) {
+	describe, err := session.Do("DESCRIBE", "", map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	if describe.StatusCode != 200 {
+		return nil, fmt.Errorf("describe failed with status %q", describe.Status)
+	}
+
+	m := findVideoMedia(ParseSDP(string(describe.Body)), encodings)
+	if m == nil {
+		return nil, ErrNoVideo
+	}
+	pt, encoding := m.Encoding()
+
+	base := session.URL()
+	if cb := describe.Header.Get("Content-Base"); cb != "" {
+		base = cb
+	}
+
+	setup, err := session.Do("SETUP", resolveControl(base, m.Control), map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"})
+	if err != nil {
+		return nil, err
+	}
+	if setup.StatusCode != 200 {
+		return nil, fmt.Errorf("setup failed with status %q", setup.Status)
+	}
+
+	play, err := session.Do("PLAY", "", map[string]string{"Range": "npt=0.000-"})
+	if err != nil {
+		return nil, err
+	}
+	if play.StatusCode != 200 {
+		return nil, fmt.Errorf("play failed with status %q", play.Status)
+	}
+
+	return &VideoStream{
+		session:     session,
+		channel:     interleavedChannel(setup.Header.Get("Transport"), 0),
+		PayloadType: pt,
+		Encoding:    encoding,
+		ClockRate:   m.RTPMaps[pt].ClockRate,
+		FMTP:        m.FMTPs[pt],
+	}, nil
+}
+
+// returns the first video media in the passed in SDP with one of the passed in encodings, nil if there isn't one
+func findVideoMedia(desc *SessionDescription, encodings []string) *Media {
+	for i, m := range desc.Media {
+		if m.Type != "video" {
+			continue
+		}
+		_, encoding := m.Encoding()
+		if len(encodings) == 0 {
+			return &desc.Media[i]
+		}
+		for _, e := range encodings {
+			if strings.EqualFold(e, encoding) {
+				return &desc.Media[i]
+			}
+		}
+	}
+	return nil
+}
+
+// ReadRTP returns the next RTP packet of our video, keeping the session alive as it goes
+func (v *VideoStream) ReadRTP() ([]byte, error) {
+	for {
+		if err := v.session.KeepAlive(); err != nil {
+			return nil, err
+		}
+
+		channel, payload, err := v.session.ReadInterleaved()
+		if err != nil {
+			return nil, err
+		}
+
+		// the odd channel after ours carries RTCP which we have no use for
+		if channel == v.channel {
+			return payload, nil
+		}
+	}
+}
+
+// ParameterSets returns the parameter set NAL units in our fmtp parameters, the H.264 SPS and PPS from its
+// sprop-parameter-sets or the H.265 VPS, SPS and PPS from its sprop-vps, sprop-sps and sprop-pps
+func (v *VideoStream) ParameterSets() [][]byte {
+	params := []string{v.FMTP["sprop-parameter-sets"]}
+	if strings.EqualFold(v.Encoding, "H265") {
+		params = []string{v.FMTP["sprop-vps"], v.FMTP["sprop-sps"], v.FMTP["sprop-pps"]}
+	}
+
+	sets := [][]byte{}
+	for _, param := range params {
+		for _, encoded := range strings.Split(param, ",") {
+			if nal, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(nal) > 0 {
+				sets = append(sets, nal)
+			}
+		}
+	}
+	return sets
+}
+
+// Close tears down the stream
+func (v *VideoStream) Close() error {
+	return v.session.Close()
+}
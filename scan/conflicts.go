@@ -0,0 +1,153 @@
+package scan
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ConflictKind is the kind of addressing conflict between devices
+type ConflictKind string
+
+const (
+	// different devices are answering at the same address, such as after a camera swap where the old one wasn't
+	// unplugged or both were given the same static IP
+	ConflictAddress ConflictKind = "address"
+
+	// the same device is answering at more than one address, or more likely two devices share a serial
+	ConflictSerial ConflictKind = "serial"
+)
+
+// Conflict is an addressing conflict between devices, devices are told apart by their serials so those without one
+// are never in conflict
+type Conflict struct {
+	Kind ConflictKind `json:"kind"`
+
+	// the address answered by more than one device, and the serials of those devices
+	Address string   `json:"address,omitempty"`
+	Serials []string `json:"serials,omitempty"`
+
+	// the serial seen at more than one address, and those addresses
+	Serial    string   `json:"serial,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+
+	// when we first saw the conflict
+	Since time.Time `json:"since"`
+}
+
+// returns what identifies this conflict for as long as it lasts, regardless of who else joins it
+func (c *Conflict) id() string {
+	if c.Kind == ConflictAddress {
+		return string(c.Kind) + ":" + c.Address
+	}
+	return string(c.Kind) + ":" + c.Serial
+}
+
+// describes this conflict for logging
+func (c *Conflict) describe() string {
+	if c.Kind == ConflictAddress {
+		return c.Address + " is answered by serials " + strings.Join(c.Serials, ", ")
+	}
+	return "serial " + c.Serial + " answers at " + strings.Join(c.Addresses, ", ")
+}
+
+// FindConflicts returns the addressing conflicts between the passed in records, sorted by kind then address or serial
+func FindConflicts(records []Record) []Conflict {
+	serialsAt := map[string][]string{}
+	addressesOf := map[string][]string{}
+	for _, r := range records {
+		host := hostOfAddress(r.Address)
+		if r.Serial == "" || host == "" {
+			continue
+		}
+		if !slices.Contains(serialsAt[host], r.Serial) {
+			serialsAt[host] = append(serialsAt[host], r.Serial)
+		}
+		if !slices.Contains(addressesOf[r.Serial], host) {
+			addressesOf[r.Serial] = append(addressesOf[r.Serial], host)
+		}
+	}
+
+	conflicts := []Conflict{}
+	for host, serials := range serialsAt {
+		if len(serials) > 1 {
+			slices.Sort(serials)
+			conflicts = append(conflicts, Conflict{Kind: ConflictAddress, Address: host, Serials: serials})
+		}
+	}
+	for serial, hosts := range addressesOf {
+		if len(hosts) > 1 {
+			slices.SortFunc(hosts, compareAddresses)
+			conflicts = append(conflicts, Conflict{Kind: ConflictSerial, Serial: serial, Addresses: hosts})
+		}
+	}
+	slices.SortFunc(conflicts, func(a, b Conflict) int {
+		if c := strings.Compare(string(a.Kind), string(b.Kind)); c != 0 {
+			return c
+		}
+		if c := compareAddresses(a.Address, b.Address); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Serial, b.Serial)
+	})
+	return conflicts
+}
+
+// Conflicts returns the addressing conflicts between the devices we currently know of
+func (m *Monitor) Conflicts() []Conflict {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conflicts := make([]Conflict, 0, len(m.conflicts))
+	for _, c := range m.conflicts {
+		conflicts = append(conflicts, c)
+	}
+	slices.SortFunc(conflicts, func(a, b Conflict) int { return strings.Compare(a.id(), b.id()) })
+	return conflicts
+}
+
+// looks for conflicts between the devices which are online and those found by our last scan, emitting events for
+// those which have started or ended. Our devices are keyed by serial, so a serial found at two addresses by the same
+// scan is only seen in its results.
+func (m *Monitor) checkConflicts(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	records := slices.Clone(m.scanned)
+	for _, d := range m.devices {
+		if d.online {
+			records = append(records, d.record)
+		}
+	}
+
+	found := map[string]Conflict{}
+	for _, c := range FindConflicts(records) {
+		found[c.id()] = c
+	}
+	started, ended := []Conflict{}, []Conflict{}
+	for id, c := range found {
+		if existing, ok := m.conflicts[id]; ok {
+			c.Since = existing.Since
+		} else {
+			c.Since = now
+			started = append(started, c)
+		}
+		found[id] = c
+	}
+	for id, c := range m.conflicts {
+		if _, ok := found[id]; !ok {
+			ended = append(ended, c)
+		}
+	}
+	m.conflicts = found
+	m.mu.Unlock()
+
+	for _, c := range started {
+		m.log.Warn("address conflict", slog.String("conflict", c.describe()))
+		m.emit(ctx, Event{Type: EventConflict, Time: now, Conflict: &c})
+	}
+	for _, c := range ended {
+		m.log.Info("address conflict resolved", slog.String("conflict", c.describe()))
+		m.emit(ctx, Event{Type: EventConflictResolved, Time: now, Conflict: &c})
+	}
+}
@@ -0,0 +1,103 @@
+package scan
+
+import (
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/incrementventures/govr/network"
+)
+
+// Filter decides which addresses a scan is allowed to touch. Excluded addresses are never touched, whether by
+// discovery, sweeps, port scans or probes, and when an allow list is set only addresses within it are.
+type Filter struct {
+	allow   []netip.Prefix
+	exclude []netip.Prefix
+}
+
+// NewFilter builds a filter from the allow and exclude lists in the passed in options
+func NewFilter(opts Options) (*Filter, error) {
+	allow, err := parsePrefixes(opts.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := parsePrefixes(opts.ExcludeCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{allow: allow, exclude: exclude}, nil
+}
+
+// Allows returns whether the passed in address, which can be an IP, host:port or URL, may be touched. Hostnames
+// we can't check are only allowed if there is no allow list.
+func (f *Filter) Allows(address string) bool {
+	addr, err := netip.ParseAddr(hostOfAddress(address))
+	if err != nil {
+		return len(f.allow) == 0
+	}
+	addr = addr.Unmap().WithZone("")
+
+	for _, p := range f.exclude {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the addresses the filter allows, logging the ones it drops
+func (f *Filter) filterAddresses(log *slog.Logger, addresses []string) []string {
+	allowed := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if !f.Allows(address) {
+			log.Debug("skipping filtered address", slog.String("address", address))
+			continue
+		}
+		allowed = append(allowed, address)
+	}
+	return allowed
+}
+
+// returns the sources the filter allows, logging the ones it drops
+func (f *Filter) filterSources(log *slog.Logger, sources []StreamSource) []StreamSource {
+	allowed := make([]StreamSource, 0, len(sources))
+	for _, source := range sources {
+		if !f.Allows(source.Address) {
+			log.Debug("skipping filtered stream source", slog.String("address", source.Address))
+			continue
+		}
+		allowed = append(allowed, source)
+	}
+	return allowed
+}
+
+// returns the host portion of an IP, host:port or URL
+func hostOfAddress(address string) string {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err == nil {
+			return u.Hostname()
+		}
+	}
+	return strings.Trim(hostOf(address), "[]")
+}
+
+func parsePrefixes(cidrs []network.CIDR) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := network.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,179 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/incrementventures/govr/media"
+	"github.com/incrementventures/govr/onvif"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// Fixtures are canned responses read from a directory which a scan uses instead of the network, for demos, testing
+// the adoption flow without any cameras and reproducing parsing bugs from the XML users send us. The directory holds:
+//
+//	discovery/*.xml                 ws-discovery ProbeMatches messages, each of which is discovered as is
+//	devices/<host>/<Operation>.xml  the SOAP response of the device at host to each operation, e.g. GetProfiles.xml
+//	devices/<host>/<token>.sdp      the session description of the stream of each media profile
+//
+// Responses to operations on a single profile, such as GetStreamUri, are read from <Operation>_<token>.xml if it
+// exists. Operations without a response fail as if the device didn't support them, and hosts without a directory
+// are unreachable.
+type Fixtures struct {
+	dir string
+}
+
+// matches the profile token of a request, capturing the token
+var profileTokenRegex = regexp.MustCompile(`<(?:[\w-]+:)?ProfileToken>\s*([^<\s]+)\s*<`)
+
+// NewFixtures returns the fixtures in the passed in directory
+func NewFixtures(dir string) (*Fixtures, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixtures: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("fixtures %q is not a directory", dir)
+	}
+	return &Fixtures{dir: dir}, nil
+}
+
+// Discover returns the device service addresses of the video transmitters in our discovery messages, as if they had
+// answered a probe
+func (f *Fixtures) Discover(log *slog.Logger) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(f.dir, "discovery", "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+
+	devices := []onvif.DiscoveredDevice{}
+	for _, file := range files {
+		msg, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading discovery fixture: %w", err)
+		}
+
+		var resp onvif.ProbeResponse
+		if err := onvif.UnmarshalXML(msg, &resp); err != nil {
+			log.Warn("error unmarshalling discovery fixture, skipping", slog.String("file", file), slog.String("error", err.Error()))
+			continue
+		}
+		devices = append(devices, resp.Transmitters(log, "")...)
+	}
+
+	candidates := []string{}
+	for _, device := range onvif.DedupeDevices(devices) {
+		candidates = append(candidates, device.Address)
+	}
+	return candidates, nil
+}
+
+// Has returns whether we have a device at the host of the passed in address
+func (f *Fixtures) Has(address string) bool {
+	info, err := os.Stat(f.deviceDir(address))
+	return err == nil && info.IsDir()
+}
+
+// Streams returns the streams of the profile with the passed in token on the device at the passed in address
+func (f *Fixtures) Streams(address string, token string) ([]media.StreamInfo, error) {
+	sdp, err := os.ReadFile(filepath.Join(f.deviceDir(address), fixtureName(token)+".sdp"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream fixture: %w", err)
+	}
+	return rtsp.StreamsFromSDP(rtsp.ParseSDP(string(sdp))), nil
+}
+
+// RoundTrip answers SOAP requests to our devices with the response to their operation
+func (f *Fixtures) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !f.Has(req.URL.String()) {
+		return nil, fmt.Errorf("no fixtures for host %q", req.URL.Hostname())
+	}
+
+	var body []byte
+	if req.Body != nil {
+		defer req.Body.Close()
+
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	operation := operationOfEnvelope(body)
+	names := []string{fixtureName(operation)}
+	if m := profileTokenRegex.FindSubmatch(body); m != nil {
+		names = slices.Insert(names, 0, fixtureName(operation+"_"+string(m[1])))
+	}
+
+	for _, name := range names {
+		response, err := os.ReadFile(filepath.Join(f.deviceDir(req.URL.String()), name+".xml"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fixtureResponse(req, http.StatusOK, response), nil
+	}
+	return fixtureResponse(req, http.StatusNotFound, []byte("no fixture for "+operation)), nil
+}
+
+// returns the directory of the device at the host of the passed in address
+func (f *Fixtures) deviceDir(address string) string {
+	host := hostOf(address)
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	return filepath.Join(f.dir, "devices", fixtureName(host))
+}
+
+// returns the local name of the first element of the body of the passed in SOAP envelope
+func operationOfEnvelope(envelope []byte) string {
+	var e struct {
+		Body struct {
+			Operation struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(bytes.TrimSpace(envelope), &e); err != nil || e.Body.Operation.XMLName.Local == "" {
+		return "unknown"
+	}
+	return e.Body.Operation.XMLName.Local
+}
+
+// returns the passed in name made safe to use as a file name, so nothing can be read from outside our directory
+func fixtureName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == '%' {
+			return '_'
+		}
+		return r
+	}, strings.TrimLeft(name, "."))
+}
+
+func fixtureResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/soap+xml; charset=utf-8"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
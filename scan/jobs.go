@@ -0,0 +1,166 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// how many finished jobs we remember so their results can still be fetched
+const maxFinishedJobs = 20
+
+// ErrJobRunning is returned when asked to start a scan while another is still running
+var ErrJobRunning = errors.New("a scan is already running")
+
+// JobStatus is where a scan job is in its life
+type JobStatus string
+
+const (
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a scan run on demand in the background, along with its progress so far
+type Job struct {
+	ID       string    `json:"id"`
+	Status   JobStatus `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// how many candidates have been probed out of how many there are, zero until discovery has finished
+	Candidates int `json:"candidates"`
+	Probed     int `json:"probed"`
+
+	// how many devices have been found, the IDs of those we hadn't seen before and how many candidates failed
+	Found    int      `json:"found"`
+	New      []string `json:"new"`
+	Failures int      `json:"failures"`
+}
+
+// Jobs runs scans on demand, one at a time, with their own options rather than those of the monitor
+type Jobs struct {
+	ctx context.Context
+	log *slog.Logger
+
+	// merges each device a job finds into wherever devices are kept, returning the ID it is known by and whether it
+	// is one we hadn't seen before
+	merge func(DeviceResult) (string, bool)
+
+	mu      sync.Mutex
+	jobs    []*Job
+	running bool
+	wg      sync.WaitGroup
+}
+
+// NewJobs creates a new job runner whose jobs run until the passed in context is done, merging the devices they find
+// with the passed in function
+func NewJobs(ctx context.Context, log *slog.Logger, merge func(DeviceResult) (string, bool)) *Jobs {
+	return &Jobs{ctx: ctx, log: log.With("subsystem", "scan_jobs"), merge: merge}
+}
+
+// Start starts a scan with the passed in options in the background, returning ErrJobRunning if one is already running
+func (j *Jobs) Start(opts Options) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running {
+		return Job{}, ErrJobRunning
+	}
+
+	job := &Job{ID: uuid.NewString(), Status: JobRunning, Started: time.Now(), New: []string{}}
+	j.jobs = append(j.jobs, job)
+	j.running = true
+
+	// forget the oldest finished jobs, only ever the one we just started is running
+	if len(j.jobs) > maxFinishedJobs+1 {
+		j.jobs = slices.Delete(j.jobs, 0, len(j.jobs)-maxFinishedJobs-1)
+	}
+
+	opts.Progress = func(probed int, candidates int) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		job.Probed, job.Candidates = probed, candidates
+	}
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.run(job, opts)
+	}()
+	return j.copy(job), nil
+}
+
+// Job returns the job with the passed in ID
+func (j *Jobs) Job(id string) (Job, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, job := range j.jobs {
+		if job.ID == id {
+			return j.copy(job), true
+		}
+	}
+	return Job{}, false
+}
+
+// All returns every job we remember, most recent first
+func (j *Jobs) All() []Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jobs := make([]Job, len(j.jobs))
+	for i, job := range j.jobs {
+		jobs[len(j.jobs)-1-i] = j.copy(job)
+	}
+	return jobs
+}
+
+// Wait waits for any running job to finish, which it does once our context is done
+func (j *Jobs) Wait() {
+	j.wg.Wait()
+}
+
+func (j *Jobs) run(job *Job, opts Options) {
+	log := j.log.With("job", job.ID)
+	log.Info("scan started")
+
+	summary, err := Scan(j.ctx, log, opts, func(result DeviceResult) {
+		id, added := j.merge(result)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		job.Found++
+		if added {
+			job.New = append(job.New, id)
+		}
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job.Finished = time.Now()
+	j.running = false
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+		log.Error("scan failed", slog.String("error", err.Error()))
+		return
+	}
+	job.Status, job.Failures = JobDone, len(summary.Failures)
+	log.Info("scan done", slog.Int("found", job.Found), slog.Int("new", len(job.New)))
+}
+
+// returns a copy of the passed in job which is safe to use without our lock, must be called with the lock held
+func (j *Jobs) copy(job *Job) Job {
+	c := *job
+	c.New = slices.Clone(job.New)
+	return c
+}
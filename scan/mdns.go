@@ -0,0 +1,157 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/network"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// services we browse for, cameras commonly announce one or both
+const (
+	MDNSServiceRTSP = "_rtsp._tcp.local."
+	MDNSServiceHTTP = "_http._tcp.local."
+)
+
+var mdnsGroup = net.IPv4(224, 0, 0, 251)
+
+// MDNSService is a service instance announced via mDNS
+type MDNSService struct {
+	Instance string
+	Service  string
+	Host     string
+	IP       string
+	Port     int
+	TXT      []string
+}
+
+// BrowseMDNS sends mDNS queries for the passed in service types on the passed in interface and collects the
+// instances that are announced before the timeout elapses
+func BrowseMDNS(log *slog.Logger, ifaceName string, services []string, timeout time.Duration) ([]MDNSService, error) {
+	log = log.With("iface", ifaceName)
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start mdns listen: %w", err)
+	}
+	defer c.Close()
+
+	p := ipv4.NewPacketConn(c)
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %q: %w", ifaceName, err)
+	}
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return nil, fmt.Errorf("interface %q unable to set multicast interface: %w", ifaceName, err)
+	}
+	p.SetMulticastTTL(255)
+
+	query, err := buildMDNSQuery(services)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.WriteTo(query, nil, &net.UDPAddr{IP: mdnsGroup, Port: 5353}); err != nil {
+		return nil, fmt.Errorf("unable to send mdns query on interface %q: %w", ifaceName, err)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("unable to set read deadline: %w", err)
+	}
+
+	// records are collected across all responses since devices may split them across packets
+	ptrs := make(map[string]string)
+	srvs := make(map[string]dnsmessage.SRVResource)
+	txts := make(map[string][]string)
+	addrs := make(map[string]string)
+
+	guard := network.NewResponseGuard(0, 0, 0)
+	b := make([]byte, 9000)
+	for !guard.Exhausted() {
+		n, src, err := c.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return nil, fmt.Errorf("error reading mdns response: %w", err)
+		}
+		if !guard.Allow(hostOf(src.String()), b[:n]) {
+			continue
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(b[:n]); err != nil {
+			log.Debug("error unpacking mdns response, skipping", slog.String("src", src.String()), slog.String("error", err.Error()))
+			continue
+		}
+
+		for _, rr := range append(append(msg.Answers, msg.Authorities...), msg.Additionals...) {
+			name := strings.ToLower(rr.Header.Name.String())
+			switch body := rr.Body.(type) {
+			case *dnsmessage.PTRResource:
+				ptrs[strings.ToLower(body.PTR.String())] = name
+			case *dnsmessage.SRVResource:
+				srvs[name] = *body
+			case *dnsmessage.TXTResource:
+				txts[name] = body.TXT
+			case *dnsmessage.AResource:
+				addrs[name] = net.IP(body.A[:]).String()
+			}
+		}
+	}
+
+	if guard.Dropped() > 0 {
+		log.Warn("dropped excess or duplicate mdns responses", slog.Int("dropped", guard.Dropped()))
+	}
+
+	found := []MDNSService{}
+	for instance, service := range ptrs {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+		host := strings.ToLower(srv.Target.String())
+		ip, ok := addrs[host]
+		if !ok {
+			continue
+		}
+
+		s := MDNSService{
+			Instance: strings.TrimSuffix(instance, "."+service),
+			Service:  service,
+			Host:     host,
+			IP:       ip,
+			Port:     int(srv.Port),
+			TXT:      txts[instance],
+		}
+		log.Info("discovered mdns service", slog.String("instance", s.Instance), slog.String("service", s.Service), slog.String("ip", s.IP), slog.Int("port", s.Port))
+		found = append(found, s)
+	}
+
+	return found, nil
+}
+
+func buildMDNSQuery(services []string) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		name, err := dnsmessage.NewName(service)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mdns service %q: %w", service, err)
+		}
+		if err := builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
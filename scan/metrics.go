@@ -0,0 +1,11 @@
+package scan
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+var (
+	scanDuration = metrics.NewHistogram("govr_scan_duration_seconds", "How long network scans take.", []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300})
+	scanDevices  = metrics.NewGauge("govr_scan_devices_found", "Devices found by the last scan, by kind.", "kind")
+	scanFailures = metrics.NewGauge("govr_scan_failures", "Candidates which failed to probe in the last scan.")
+)
@@ -0,0 +1,476 @@
+package scan
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/onvif"
+)
+
+type EventType string
+
+const (
+	EventOnline  EventType = "online"
+	EventOffline EventType = "offline"
+	EventChanged EventType = "changed"
+
+	// low power devices aren't reported offline when they stop answering, just asleep
+	EventAsleep EventType = "asleep"
+
+	// devices have started or stopped conflicting over an address, these events have no record
+	EventConflict         EventType = "conflict"
+	EventConflictResolved EventType = "conflict_resolved"
+)
+
+// how long a low power device is assumed to stay awake after we last heard from it
+const defaultWakeWindow = 30 * time.Second
+
+// Event is emitted by a Monitor when a device comes online, goes offline or changes, or when devices start or stop
+// conflicting over an address
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Record   Record
+	Changes  []Change
+	Conflict *Conflict
+}
+
+type monitored struct {
+	record   Record
+	result   DeviceResult
+	online   bool
+	lastSeen time.Time
+}
+
+// returns whether the passed in low power device is still within its wake window
+func (d *monitored) awake(now time.Time, window time.Duration) bool {
+	return d.online && now.Sub(d.lastSeen) < window
+}
+
+// Monitor continuously scans the network, tracks which devices are alive and emits events as that changes
+type Monitor struct {
+	log  *slog.Logger
+	opts Options
+
+	// how often to do a full rescan, and how often to check known devices are alive in between
+	rescanInterval   time.Duration
+	livenessInterval time.Duration
+	livenessTimeout  time.Duration
+
+	// low power devices, such as battery cameras, only wake rarely so they are never health checked, instead they
+	// are considered awake for this long whenever we hear from them
+	wakeWindow time.Duration
+
+	// called whenever a low power device wakes, this is the time to connect to it or probe it
+	OnWake func(ctx context.Context, record Record)
+
+	// if set, the devices with persisted probe results are known from the start and only probed again by rescans
+	// once their results need refreshing
+	Probes ProbeCache
+
+	events  chan Event
+	trigger chan struct{}
+
+	mu       sync.Mutex
+	devices  map[string]*monitored
+	lowPower map[string]bool
+
+	// the devices found by our last scan and the conflicts between those and the devices which are online, keyed
+	// by what they are over
+	scanned   []Record
+	conflicts map[string]Conflict
+}
+
+func NewMonitor(log *slog.Logger, opts Options, rescanInterval time.Duration, livenessInterval time.Duration) *Monitor {
+	return &Monitor{
+		log:              log.With("subsystem", "monitor"),
+		opts:             opts,
+		rescanInterval:   rescanInterval,
+		livenessInterval: livenessInterval,
+		livenessTimeout:  2 * time.Second,
+		wakeWindow:       defaultWakeWindow,
+		events:           make(chan Event, 64),
+		trigger:          make(chan struct{}, 1),
+		devices:          make(map[string]*monitored),
+		lowPower:         make(map[string]bool),
+		conflicts:        make(map[string]Conflict),
+	}
+}
+
+// SetLowPower sets whether the device with the passed in key is a low power device which we should leave alone
+// until it wakes up on its own
+func (m *Monitor) SetLowPower(key string, lowPower bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lowPower {
+		m.lowPower[key] = true
+	} else {
+		delete(m.lowPower, key)
+	}
+}
+
+// LowPower returns whether the device with the passed in key is a low power device
+func (m *Monitor) LowPower(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lowPower[key]
+}
+
+// Wake records that the device with the passed in host has been heard from, such as by an event it pushed to us,
+// marking it online and, for low power devices, calling OnWake. Returns whether the host is a device we know.
+func (m *Monitor) Wake(ctx context.Context, host string) bool {
+	now := time.Now()
+
+	m.mu.Lock()
+	var device *monitored
+	for _, d := range m.devices {
+		if hostOfAddress(d.record.Address) == host {
+			device = d
+			break
+		}
+	}
+	if device == nil {
+		m.mu.Unlock()
+		return false
+	}
+	wasOnline := device.online
+	device.online, device.lastSeen = true, now
+	record := device.record
+	lowPower := m.lowPower[record.Key]
+	m.mu.Unlock()
+
+	if !wasOnline {
+		m.emit(ctx, Event{Type: EventOnline, Time: now, Record: record})
+		m.woke(ctx, lowPower, record)
+	}
+	return true
+}
+
+// Events returns the channel events are emitted on, it is closed when Run returns
+func (m *Monitor) Events() <-chan Event {
+	return m.events
+}
+
+// Devices returns the records of all the devices we know about
+func (m *Monitor) Devices() []Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := make([]Record, 0, len(m.devices))
+	for _, d := range m.devices {
+		records = append(records, d.record)
+	}
+	slices.SortFunc(records, func(a, b Record) int { return strings.Compare(a.Key, b.Key) })
+	return records
+}
+
+// Result returns the result of the last scan which found the device with the passed in key, this includes its
+// credentials and profiles so it can be connected to
+func (m *Monitor) Result(key string) (DeviceResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, found := m.devices[key]
+	if !found {
+		return DeviceResult{}, false
+	}
+	return d.result, true
+}
+
+// Rescan asks for a full rescan as soon as possible rather than waiting for our interval, a rescan already asked for
+// but not yet started covers this one too
+func (m *Monitor) Rescan() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetOptions replaces the options used for rescans from the next one on, such as when our configuration is reloaded
+func (m *Monitor) SetOptions(opts Options) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.opts = opts
+}
+
+// Options returns the options currently used for rescans
+func (m *Monitor) Options() Options {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.opts
+}
+
+// Track starts tracking a device found outside of our own rescans, such as by a scan with different options, emitting
+// the same events as if we'd found it ourselves. Devices our rescans don't find are kept alive by liveness checks.
+func (m *Monitor) Track(ctx context.Context, result DeviceResult) {
+	m.observe(ctx, result, time.Now())
+}
+
+// Online returns whether the device with the passed in key is currently alive
+func (m *Monitor) Online(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, found := m.devices[key]
+	return found && d.online
+}
+
+// Run scans immediately and then on our intervals until the passed in context is cancelled
+func (m *Monitor) Run(ctx context.Context) error {
+	defer close(m.events)
+
+	if m.load() > 0 {
+		m.checkLiveness(ctx)
+	}
+	m.rescan(ctx)
+
+	rescan := time.NewTicker(m.rescanInterval)
+	defer rescan.Stop()
+	liveness := time.NewTicker(m.livenessInterval)
+	defer liveness.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-rescan.C:
+			m.rescan(ctx)
+		case <-m.trigger:
+			m.rescan(ctx)
+			rescan.Reset(m.rescanInterval)
+		case <-liveness.C:
+			m.checkLiveness(ctx)
+		}
+	}
+}
+
+func (m *Monitor) rescan(ctx context.Context) {
+	m.mu.Lock()
+	opts := m.opts
+	m.mu.Unlock()
+	opts.Probes = m.Probes
+
+	results := []DeviceResult{}
+	_, err := Scan(ctx, m.log, opts, func(result DeviceResult) {
+		results = append(results, result)
+	})
+	if err != nil {
+		m.log.Error("error rescanning network", slog.String("error", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	scanned := make([]Record, len(results))
+	for i, result := range results {
+		m.observe(ctx, result, now)
+		scanned[i] = NewRecord(result)
+	}
+	m.mu.Lock()
+	m.scanned = scanned
+	m.mu.Unlock()
+
+	// devices that weren't found by this scan get an immediate liveness check, some won't answer discovery
+	m.checkLiveness(ctx)
+}
+
+// starts tracking the devices with persisted probe results, returning how many. They are offline until a liveness check
+// finds them alive, which spares waiting for a rescan to probe them again.
+func (m *Monitor) load() int {
+	if m.Probes == nil {
+		return 0
+	}
+	opts := m.Options()
+	opts.Probes = m.Probes
+
+	loaded := 0
+	for _, address := range m.Probes.Addresses() {
+		d, found := opts.cached(address)
+		if !found {
+			continue
+		}
+		mac, vendor := opts.hardwareOf(address)
+		result := DeviceResult{Device: d, Credential: Credential{Username: d.Username, Password: d.Password}, MAC: mac, Vendor: vendor}
+		record := NewRecord(result)
+
+		m.mu.Lock()
+		if _, found := m.devices[record.Key]; !found {
+			m.devices[record.Key] = &monitored{record: record, result: result}
+			loaded++
+		}
+		m.mu.Unlock()
+
+		// we don't know whether it rebooted while we weren't watching
+		m.rebooted(d)
+	}
+	m.log.Info("loaded persisted probe results", slog.Int("devices", loaded))
+	return loaded
+}
+
+// marks the persisted probe results of the passed in device, which may have rebooted, as needing refreshing if its
+// stream URIs are only valid until it reboots, returning whether they were
+func (m *Monitor) rebooted(d *onvif.Device) bool {
+	if m.Probes == nil || d == nil || !slices.ContainsFunc(d.Profiles, func(p onvif.Profile) bool { return p.URIInvalidAfterReboot }) {
+		return false
+	}
+	if err := m.Probes.MarkStale(d.Address); err != nil {
+		m.log.Error("error marking probe results stale", slog.String("address", d.Address), slog.String("error", err.Error()))
+	}
+	return true
+}
+
+// records that the passed in device was found at the passed in time, emitting events if it is new, has come back
+// or has changed
+func (m *Monitor) observe(ctx context.Context, result DeviceResult, now time.Time) {
+	record := NewRecord(result)
+
+	m.mu.Lock()
+	existing, found := m.devices[record.Key]
+	lowPower := m.lowPower[record.Key]
+	if !found {
+		m.devices[record.Key] = &monitored{record: record, result: result, online: true, lastSeen: now}
+		m.mu.Unlock()
+		m.emit(ctx, Event{Type: EventOnline, Time: now, Record: record})
+		m.woke(ctx, lowPower, record)
+		return
+	}
+
+	previous := existing.record
+	wasOnline := existing.online
+	existing.record, existing.result, existing.online, existing.lastSeen = record, result, true, now
+	m.mu.Unlock()
+
+	diff := DiffSnapshots(&Snapshot{Devices: []Record{previous}}, &Snapshot{Devices: []Record{record}})
+	if len(diff.Changed) > 0 {
+		m.emit(ctx, Event{Type: EventChanged, Time: now, Record: record, Changes: diff.Changed})
+	}
+	if !wasOnline {
+		m.emit(ctx, Event{Type: EventOnline, Time: now, Record: record})
+		m.woke(ctx, lowPower, record)
+	}
+}
+
+func (m *Monitor) checkLiveness(ctx context.Context) {
+	m.mu.Lock()
+	devices := make([]*monitored, 0, len(m.devices))
+	for _, d := range m.devices {
+		devices = append(devices, d)
+	}
+	m.mu.Unlock()
+
+	for _, d := range devices {
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.mu.Lock()
+		address := d.record.Address
+		lowPower := m.lowPower[d.record.Key]
+		m.mu.Unlock()
+
+		// dialing a low power device would either fail or wake it and drain its battery, so we just let it fall
+		// asleep once it has been quiet for long enough
+		if lowPower {
+			m.checkAsleep(ctx, d)
+			continue
+		}
+
+		alive := m.isAlive(address)
+		now := time.Now()
+
+		m.mu.Lock()
+		changed := alive != d.online
+		returned := changed && alive && !d.lastSeen.IsZero()
+		d.online = alive
+		if alive {
+			d.lastSeen = now
+		}
+		record, result := d.record, d.result
+		m.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+		if alive {
+			m.emit(ctx, Event{Type: EventOnline, Time: now, Record: record})
+
+			// a device coming back has most likely rebooted, so stream URIs which don't survive that need probing again
+			if returned && m.rebooted(result.Device) {
+				m.Rescan()
+			}
+		} else {
+			m.log.Warn("device offline", slog.String("key", record.Key), slog.String("address", record.Address))
+			m.emit(ctx, Event{Type: EventOffline, Time: now, Record: record})
+		}
+	}
+
+	// devices going offline can resolve conflicts, and coming back can start them again
+	m.checkConflicts(ctx, time.Now())
+}
+
+// returns whether the device at the passed in address answers, devices in our fixtures always do
+func (m *Monitor) isAlive(address string) bool {
+	if fixtures := m.Options().Fixtures; fixtures != nil {
+		return fixtures.Has(address)
+	}
+	alive, _ := network.IsPortOpen(dialAddress(address), m.livenessTimeout)
+	return alive
+}
+
+// marks the passed in low power device asleep if we haven't heard from it within the wake window
+func (m *Monitor) checkAsleep(ctx context.Context, d *monitored) {
+	now := time.Now()
+
+	m.mu.Lock()
+	asleep := d.online && !d.awake(now, m.wakeWindow)
+	if asleep {
+		d.online = false
+	}
+	record := d.record
+	m.mu.Unlock()
+
+	if asleep {
+		m.log.Debug("device asleep", slog.String("key", record.Key), slog.String("address", record.Address))
+		m.emit(ctx, Event{Type: EventAsleep, Time: now, Record: record})
+	}
+}
+
+// calls OnWake if the passed in device is low power
+func (m *Monitor) woke(ctx context.Context, lowPower bool, record Record) {
+	if lowPower && m.OnWake != nil {
+		m.OnWake(ctx, record)
+	}
+}
+
+func (m *Monitor) emit(ctx context.Context, e Event) {
+	select {
+	case m.events <- e:
+	case <-ctx.Done():
+	}
+}
+
+// converts a device service URL or host:port into a host:port we can dial
+func dialAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return address
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "rtsp" {
+			port = "554"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,198 @@
+package scan
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// memoryProbes is a probe cache in memory which counts what it is asked
+type memoryProbes struct {
+	mu      sync.Mutex
+	devices map[string]onvif.Device
+	stale   map[string]int
+	saved   []string
+}
+
+func newMemoryProbes(devices ...onvif.Device) *memoryProbes {
+	p := &memoryProbes{devices: map[string]onvif.Device{}, stale: map[string]int{}}
+	for _, d := range devices {
+		p.devices[d.Address] = d
+	}
+	return p
+}
+
+func (p *memoryProbes) Cached(address string) (*onvif.Device, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, found := p.devices[address]
+	if !found || p.stale[address] > 0 {
+		return nil, false
+	}
+	return &d, true
+}
+
+func (p *memoryProbes) Addresses() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addresses := []string{}
+	for address := range p.devices {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+func (p *memoryProbes) Save(d *onvif.Device) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.devices[d.Address] = *d
+	p.saved = append(p.saved, d.Address)
+	return nil
+}
+
+func (p *memoryProbes) MarkStale(address string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stale[address]++
+	return nil
+}
+
+func (p *memoryProbes) staleCount(address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stale[address]
+}
+
+func TestProbeDeviceCached(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fixtures, err := NewFixtures(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	probes := newMemoryProbes(
+		onvif.Device{Address: "http://192.168.1.10/onvif/device_service", Username: "admin", DeviceInformation: onvif.DeviceInformation{SerialNumber: "cam-1"}},
+		onvif.Device{Address: "http://192.168.1.11/onvif/device_service", Username: "other"},
+	)
+
+	tcs := []struct {
+		name     string
+		address  string
+		found    bool
+		password string
+	}{
+		{name: "cached", address: "http://192.168.1.10/onvif/device_service", found: true, password: "secret"},
+		{name: "cached under a credential we no longer have", address: "http://192.168.1.11/onvif/device_service"},
+		{name: "not cached", address: "http://192.168.1.12/onvif/device_service"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Credentials = []Credential{{Username: "admin", Password: "secret"}}
+			opts.Fixtures = fixtures
+			opts.Probes = probes
+
+			// our fixtures have no devices, so anything actually probed isn't found
+			result, err := ProbeDevice(log, tc.address, opts)
+			if found := err == nil; found != tc.found {
+				t.Fatalf("expected found %t, got %t: %v", tc.found, found, err)
+			}
+			if tc.found && (result.Device.Password != tc.password || result.Credential.Password != tc.password) {
+				t.Errorf("expected the password of our credential, got %q", result.Device.Password)
+			}
+		})
+	}
+	if len(probes.saved) != 0 {
+		t.Errorf("expected nothing saved, got %v", probes.saved)
+	}
+}
+
+func TestMonitorProbes(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	fixtures, err := NewFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAlive := func(host string, alive bool) {
+		if alive {
+			if err := os.MkdirAll(filepath.Join(dir, "devices", host), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.RemoveAll(filepath.Join(dir, "devices", host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stable := "http://192.168.1.10/onvif/device_service"
+	rebooting := "http://192.168.1.11/onvif/device_service"
+	probes := newMemoryProbes(
+		onvif.Device{Address: stable, Username: "admin", DeviceInformation: onvif.DeviceInformation{SerialNumber: "cam-1"}, Profiles: []onvif.Profile{{Token: "main", URI: "rtsp://192.168.1.10/main"}}},
+		onvif.Device{Address: rebooting, Username: "admin", DeviceInformation: onvif.DeviceInformation{SerialNumber: "cam-2"}, Profiles: []onvif.Profile{{Token: "main", URI: "rtsp://192.168.1.11/session-1", URIInvalidAfterReboot: true}}},
+		onvif.Device{Address: "http://192.168.1.12/onvif/device_service", Username: "other", DeviceInformation: onvif.DeviceInformation{SerialNumber: "cam-3"}},
+	)
+
+	opts := DefaultOptions()
+	opts.Credentials = []Credential{{Username: "admin", Password: "secret"}}
+	opts.Fixtures = fixtures
+	m := NewMonitor(log, opts, time.Hour, time.Hour)
+	m.Probes = probes
+	ctx := context.Background()
+
+	// devices with results under credentials we have are known from the start, offline until found alive, with those
+	// whose stream URIs don't survive a reboot marked for probing again as they may have rebooted while we were down
+	if loaded := m.load(); loaded != 2 {
+		t.Fatalf("expected 2 devices loaded, got %d", loaded)
+	}
+	if result, found := m.Result("serial:cam-1"); !found || result.Device.Password != "secret" || m.Online("serial:cam-1") {
+		t.Errorf("expected the device loaded offline with its password, got %+v", result)
+	}
+	if probes.staleCount(stable) != 0 || probes.staleCount(rebooting) != 1 {
+		t.Errorf("expected only the device with stream uris invalid after reboot marked stale, got %v", probes.stale)
+	}
+
+	// and come online once they answer, without having been probed
+	setAlive("192.168.1.10", true)
+	setAlive("192.168.1.11", true)
+	m.checkLiveness(ctx)
+	for _, key := range []string{"serial:cam-1", "serial:cam-2"} {
+		if e := <-m.Events(); e.Type != EventOnline || !m.Online(key) {
+			t.Errorf("expected %s online, got %s", key, e.Type)
+		}
+	}
+	if probes.staleCount(rebooting) != 1 || len(m.trigger) != 0 {
+		t.Error("expected coming online for the first time not to count as a reboot")
+	}
+
+	// a device coming back after going offline has most likely rebooted
+	setAlive("192.168.1.11", false)
+	m.checkLiveness(ctx)
+	if e := <-m.Events(); e.Type != EventOffline {
+		t.Errorf("expected offline, got %s", e.Type)
+	}
+	setAlive("192.168.1.11", true)
+	m.checkLiveness(ctx)
+	if e := <-m.Events(); e.Type != EventOnline {
+		t.Errorf("expected online, got %s", e.Type)
+	}
+	if probes.staleCount(rebooting) != 2 || probes.staleCount(stable) != 0 {
+		t.Errorf("expected the rebooted device marked stale again, got %v", probes.stale)
+	}
+	if len(m.trigger) != 1 {
+		t.Error("expected a rescan to probe the rebooted device again")
+	}
+}
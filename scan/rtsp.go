@@ -0,0 +1,105 @@
+package scan
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/rtsp"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// RTSPPath is a stream path commonly used by a camera vendor
+type RTSPPath struct {
+	Vendor string
+	Path   string
+}
+
+// DefaultRTSPPaths is our dictionary of common stream paths by vendor, tried in order
+var DefaultRTSPPaths = []RTSPPath{
+	{"hikvision", "/Streaming/Channels/101"},
+	{"dahua", "/cam/realmonitor?channel=1&subtype=0"},
+	{"reolink", "/h264Preview_01_main"},
+	{"axis", "/axis-media/media.amp"},
+	{"foscam", "/videoMain"},
+	{"tp-link", "/stream1"},
+	{"uniview", "/media/video1"},
+	{"hanwha", "/profile2/media.smp"},
+	{"vivotek", "/live.sdp"},
+	{"generic", "/live"},
+	{"generic", "/h264"},
+	{"generic", "/"},
+}
+
+// StreamSource is a camera which exposes RTSP directly without speaking ONVIF
+type StreamSource struct {
+	Address string
+	URL     string
+	Vendor  string
+
+	// whether the camera required authentication to describe the stream, in which case the path is unconfirmed
+	RequiresAuth bool
+}
+
+// FindRTSPSources looks for hosts on the passed in networks with an open RTSP port, then tries our path dictionary
+// against each to find a working stream
+func FindRTSPSources(log *slog.Logger, networks []network.CIDR, opts Options) ([]StreamSource, error) {
+	scanOpts := opts
+	scanOpts.Ports = opts.RTSPPorts
+
+	// a partial port scan still gives us hosts worth describing, so we carry on and return the error with them
+	hosts, scanErr := FindHostsWithOpenPort(log, networks, scanOpts)
+
+	p := pool.New().WithMaxGoroutines(max(opts.ProbeWorkers, 1))
+	sources := []StreamSource{}
+	mu := sync.Mutex{}
+
+	for _, host := range hosts {
+		p.Go(func() {
+			source := describeHost(log, host, opts)
+			if source != nil {
+				mu.Lock()
+				sources = append(sources, *source)
+				mu.Unlock()
+			}
+		})
+	}
+	p.Wait()
+
+	return sources, scanErr
+}
+
+// tries each of our paths against the passed in host, returning the first that works
+func describeHost(log *slog.Logger, host string, opts Options) *StreamSource {
+	var unconfirmed *StreamSource
+
+	for _, path := range opts.RTSPPaths {
+		url := fmt.Sprintf("rtsp://%s%s", host, path.Path)
+		resp, err := rtsp.Describe(url, opts.RTSPTimeout)
+		if err != nil {
+			log.Debug("error describing rtsp stream", slog.String("url", url), slog.String("error", err.Error()))
+
+			// if we can't talk RTSP to this host at all there's no point trying other paths
+			if unconfirmed == nil {
+				return nil
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case 200:
+			log.Info("found rtsp stream", slog.String("url", url), slog.String("vendor", path.Vendor))
+			return &StreamSource{Address: host, URL: url, Vendor: path.Vendor}
+		case 401:
+			if unconfirmed == nil {
+				unconfirmed = &StreamSource{Address: host, URL: url, Vendor: path.Vendor, RequiresAuth: true}
+			}
+		}
+	}
+
+	if unconfirmed != nil {
+		log.Info("found rtsp server requiring authentication", slog.String("address", host))
+	}
+	return unconfirmed
+}
@@ -1,145 +1,1134 @@
 package scan
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/incrementventures/govr/creds"
 	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/media"
 	"github.com/incrementventures/govr/network"
 	"github.com/incrementventures/govr/onvif"
-	"github.com/sourcegraph/conc"
+	"github.com/incrementventures/govr/rtsp"
+	"github.com/sourcegraph/conc/pool"
 )
 
-func GetDevicesOnNetwork(log *slog.Logger, port int, username string, password string) ([]onvif.Device, error) {
-	// get all private IP4 interfaces
-	ifaces, err := network.GetPrivateIP4Interfaces()
+// Failure records a candidate which we were unable to fully probe
+type Failure struct {
+	Candidate string
+	Stage     string
+	Error     string
+
+	// the hardware address and vendor of the candidate if known, useful to identify devices we can't authenticate with
+	MAC    string
+	Vendor string
+}
+
+const (
+	StageONVIF = "onvif"
+	StageRTSP  = "rtsp"
+)
+
+// Summary describes the outcome of a scan
+type Summary struct {
+	Started       time.Time
+	Duration      time.Duration
+	Candidates    int
+	Found         int
+	StreamSources int
+	Failures      []Failure
+}
+
+// Credential is a username and password pair to try when connecting to devices
+type Credential struct {
+	Username string
+	Password string
+}
+
+// Options configures a scan
+type Options struct {
+	// credentials to try, in order, until one authenticates, an empty list connects anonymously
+	Credentials []Credential
+
+	// if set, returns the credentials to try for a specific host, overriding Credentials when non-empty
+	CredentialsFor func(host string) []Credential
+
+	// if set, returns the MAC of a host which isn't in our neighbor table, such as one beyond a router, from somewhere
+	// else such as DHCP leases
+	MACFor func(host string) string
+
+	// whether to find candidates using ws-discovery, port scanning or both
+	WSDiscovery bool
+	PortScan    bool
+
+	// the ports to check when port scanning
+	Ports []int
+
+	// how long to wait for each host to accept a connection when port scanning
+	DialTimeout time.Duration
+
+	// how many hosts to check in parallel when port scanning
+	Workers int
+
+	// how many candidates to probe in parallel, and how many RTSP streams to probe in parallel per device
+	ProbeWorkers  int
+	StreamWorkers int
+
+	// whether to ARP sweep networks and only port scan the hosts that answer, and how long to wait for answers
+	ARPSweep bool
+	ARPWait  time.Duration
+
+	// whether to ping sweep networks so hosts which answer are port scanned first, and how long to wait for each
+	// answer, found devices also have their latency measured when set
+	PingSweep   bool
+	PingTimeout time.Duration
+
+	// networks with more hosts than this are skipped unless explicitly included, a /24 by default so that a scan
+	// never sweeps a large network by surprise, this can be raised to at most MaxScanHosts
+	MaxHostsPerNetwork int
+
+	// the maximum number of packets per second to send when sweeping or port scanning networks, zero is unlimited
+	ScanRate int
+
+	// networks to scan in addition to those of our interfaces
+	IncludeCIDRs []network.CIDR
+
+	// IPs or networks never to touch, and if set, the only IPs or networks we may touch, applied to every way of
+	// finding devices
+	ExcludeCIDRs []network.CIDR
+	AllowCIDRs   []network.CIDR
+
+	// if set, the only interfaces we find devices from, which may be VLAN sub-interfaces such as eth0.20 as camera
+	// networks are usually on their own tagged VLAN
+	Interfaces []network.IFace
+
+	// VLAN sub-interfaces to create with their addresses for the duration of the scan, for reaching tagged camera
+	// networks we have no interface on, these are scanned from along with any Interfaces
+	VLANs []network.VLAN
+
+	// IPs or CIDRs to send unicast ws-discovery probes to
+	ProbeTargets []string
+
+	// if set, canned responses which discovery and probing read instead of the network, nothing else is found
+	Fixtures *Fixtures
+
+	// where ws-discovery probes are sent to and from, for relays on non-standard groups or ports and ACLs which only
+	// allow a specific source port
+	Discovery onvif.DiscoveryConfig
+
+	// device addresses always probed whether or not they are discovered, as an IP, host:port or device service URL,
+	// and RTSP streams always reported, for cameras which have been declared rather than found
+	Addresses []string
+	Sources   []StreamSource
+
+	// how long SOAP requests to devices are given by operation, nil uses onvif.DefaultTimeouts
+	SOAPTimeouts *onvif.Timeouts
+
+	// device service paths to try, in order, when probing a host found by port scanning
+	DeviceServicePaths []string
+
+	// whether to search for cameras via SSDP, which device types count as cameras and how long to wait for replies
+	SSDP            bool
+	SSDPDeviceTypes []string
+	SSDPTimeout     time.Duration
+
+	// whether to browse for cameras announcing themselves via mDNS and how long to wait for announcements
+	MDNS        bool
+	MDNSTimeout time.Duration
+
+	// whether to scan for cameras exposing RTSP without ONVIF, which ports to check and which paths to try
+	RTSPScan    bool
+	RTSPPorts   []int
+	RTSPPaths   []RTSPPath
+	RTSPTimeout time.Duration
+
+	// remembers how each camera wants RTSP credentials passed, shared with the stream resolvers of recordings and
+	// live streams so they don't need to work it out again, nil always puts credentials in the URL
+	RTSPStrategies *rtsp.StrategyCache
+
+	// whether to fall back to ffprobe for streams we can't describe natively, if it is installed
+	FFprobe bool
+
+	// the ffprobe to fall back to, nil for one configured by the environment
+	Prober *ffmpeg.Prober
+
+	// if set, called with how many candidates have been probed out of how many there are, once they've all been
+	// found and then as each is probed
+	Progress func(probed int, candidates int)
+
+	// if set, devices with persisted probe results which are still fresh aren't probed again, and devices we do probe
+	// have their results saved to it
+	Probes ProbeCache
+}
+
+// ProbeCache persists the results of probing devices so that they needn't all be probed again, such as each time we
+// start, see registry.ProbeStore
+type ProbeCache interface {
+	// returns the device last probed at the passed in device service URL, false if it has no results or they need
+	// refreshing
+	Cached(address string) (*onvif.Device, bool)
+
+	// returns the device service URLs of every device with results
+	Addresses() []string
+
+	// saves the results of probing the passed in device
+	Save(d *onvif.Device) error
+
+	// marks the results of the device at the passed in device service URL as needing refreshing
+	MarkStale(address string) error
+}
+
+// MaxScanHosts is the size of the largest network we will sweep, a /16
+const MaxScanHosts = 1 << 16
+
+// DefaultMaxHosts is the size of the largest network we sweep unless told otherwise, a /24
+const DefaultMaxHosts = 256
+
+// the kernel neighbor table only holds this many entries by default, so larger networks can't be ARP swept
+const maxARPSweepHosts = 1024
+
+// DefaultOptions returns the options used when none are specified
+func DefaultOptions() Options {
+	return Options{
+		WSDiscovery:        true,
+		PortScan:           true,
+		Ports:              []int{80, 8080, 2020, 8899},
+		DialTimeout:        50 * time.Millisecond,
+		Workers:            256,
+		ProbeWorkers:       8,
+		StreamWorkers:      2,
+		DeviceServicePaths: []string{"/onvif/device_service", "/onvif/services", "/device_service"},
+		SSDP:               true,
+		SSDPDeviceTypes:    DefaultSSDPDeviceTypes,
+		SSDPTimeout:        3 * time.Second,
+		MDNS:               true,
+		MDNSTimeout:        2 * time.Second,
+		RTSPScan:           false,
+		RTSPPorts:          []int{554},
+		RTSPPaths:          DefaultRTSPPaths,
+		RTSPTimeout:        2 * time.Second,
+		RTSPStrategies:     rtsp.NewStrategyCache(),
+		FFprobe:            true,
+		MaxHostsPerNetwork: DefaultMaxHosts,
+		ScanRate:           2000,
+		ARPSweep:           true,
+		ARPWait:            time.Second,
+		PingSweep:          false,
+		PingTimeout:        500 * time.Millisecond,
+	}
+}
+
+// DeviceResult is a single device found during a scan along with any failures probing its streams, for cameras
+// found by RTSP scanning which don't speak ONVIF, Device is nil and Source is set instead
+type DeviceResult struct {
+	Device   *onvif.Device
+	Source   *StreamSource
+	Failures []Failure
+
+	// the credential which successfully authenticated with the device
+	Credential Credential
+
+	// the hardware address of the device and the vendor it belongs to, from the neighbor table and OUI registry
+	MAC    string
+	Vendor string
+
+	// the round trip time to the device, only measured when ping sweeping
+	Latency time.Duration
+}
+
+// looks up the MAC and vendor for the host of the passed in address, we've always just connected to it so it
+// should be in the neighbor table if it is on a local network, and otherwise we ask MACFor
+func (o *Options) hardwareOf(address string) (string, string) {
+	host := hostOf(address)
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+
+	mac, err := network.LookupMAC(host)
+	if (err != nil || mac == "") && o.MACFor != nil {
+		mac, err = o.MACFor(host), nil
+	}
+	if err != nil || mac == "" {
+		return "", ""
+	}
+	return mac, network.LookupVendor(mac)
+}
+
+// pings the host of the passed in address if ping sweeping is enabled, returning zero if it doesn't answer
+func latencyOf(log *slog.Logger, address string, opts Options) time.Duration {
+	if !opts.PingSweep || opts.Fixtures != nil {
+		return 0
+	}
+	latency, _, err := network.Ping(hostOfAddress(address), opts.PingTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("error getting IP4 interfaces: %w", err)
+		log.Debug("unable to ping device", slog.String("address", address), slog.String("error", err.Error()))
 	}
+	return latency
+}
 
-	// first use ws-discovery to find ONVIF devices
-	candidates := []string{}
-	for iface := range ifaces {
-		log.Info("starting onvif ws-discovery", slog.Any("iface", iface))
-		ifaceCandidates, err := onvif.GetONVIFVideoTransmitters(log, string(iface))
+// returns the device cached for the passed in device service address along with the password of the first of our
+// credentials with the username it was probed with, false if it isn't cached or we have no such credential
+func (o *Options) cached(address string) (*onvif.Device, bool) {
+	if o.Probes == nil {
+		return nil, false
+	}
+	d, found := o.Probes.Cached(address)
+	if !found {
+		return nil, false
+	}
+	for _, cred := range o.credentialsFor(address) {
+		if cred.Username == d.Username {
+			d.Password = cred.Password
+			d.Timeouts = o.SOAPTimeouts
+			if o.Fixtures != nil {
+				d.Transport = o.Fixtures
+			}
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// returns the credentials to try for the passed in device service address
+func (o *Options) credentialsFor(address string) []Credential {
+	if o.CredentialsFor != nil {
+		if u, err := url.Parse(address); err == nil {
+			if creds := o.CredentialsFor(u.Hostname()); len(creds) > 0 {
+				return creds
+			}
+		}
+	}
+	if len(o.Credentials) == 0 {
+		return []Credential{{}}
+	}
+	return o.Credentials
+}
+
+func GetDevicesOnNetwork(log *slog.Logger, opts Options) ([]onvif.Device, *Summary, error) {
+	results := []DeviceResult{}
+
+	summary, err := Scan(context.Background(), log, opts, func(result DeviceResult) {
+		if result.Device != nil {
+			results = append(results, result)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	SortResults(results)
+
+	devices := make([]onvif.Device, len(results))
+	for i, result := range results {
+		devices[i] = *result.Device
+	}
+	return devices, summary, nil
+}
+
+// Scan looks for devices on the network, calling found with each device as soon as it has been probed rather than
+// waiting for the entire scan to complete
+func Scan(ctx context.Context, log *slog.Logger, opts Options, found func(DeviceResult)) (*Summary, error) {
+	summary := &Summary{Started: time.Now()}
+
+	// fixtures stand in for the network, so we don't need any interfaces to scan from
+	ifaces := map[network.IFace]network.CIDR{}
+	if opts.Fixtures == nil {
+		// create any VLAN sub-interfaces we've been asked to scan from, removing them once we're done
+		removeVLANs, err := createVLANs(log, opts.VLANs)
 		if err != nil {
-			return nil, fmt.Errorf("error finding candidates via ws discovery: %w", err)
+			return nil, err
 		}
-		for _, candidate := range ifaceCandidates {
-			candidates = append(candidates, candidate)
+		defer removeVLANs()
+
+		// get all private IP4 interfaces
+		ifaces, err = network.GetPrivateIP4Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("error getting IP4 interfaces: %w", err)
 		}
-		log.Info("onvif ws-discovery complete", slog.Any("iface", iface), slog.Int("count", len(ifaceCandidates)))
+		ifaces = selectInterfaces(log, ifaces, opts)
+		for _, iface := range opts.Interfaces {
+			if _, found := ifaces[iface]; !found {
+				log.Warn("interface has no private IPv4 address, skipping", slog.Any("iface", iface))
+			}
+		}
+	}
+
+	filter, err := NewFilter(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// then do a port scan to find anything with our port open
-	log.Info("starting ip scanning", slog.Int("port", port))
-	portCandidates, err := FindHostsWithOpenPort(log, ifaces, port)
+	candidates, sources, err := findCandidates(log, ifaces, opts, filter)
 	if err != nil {
-		return nil, fmt.Errorf("error finding candidates via scan: %w", err)
+		return nil, err
 	}
-	for _, candidate := range portCandidates {
-		candidates = append(candidates, fmt.Sprintf("http://%s/onvif/device_service", candidate))
+	for _, address := range opts.Addresses {
+		candidate, err := DeviceServiceURL(address)
+		if err != nil {
+			log.Warn("skipping invalid device address", slog.String("address", address), slog.String("error", err.Error()))
+			continue
+		}
+		candidates = append(candidates, candidate)
 	}
-	log.Info("ip scanning complete", slog.Int("port", port), slog.Int("count", len(portCandidates)))
+	sources = append(sources, opts.Sources...)
+
+	// discovery protocols can answer from anywhere so drop anything we aren't allowed to touch
+	candidates = filter.filterAddresses(log, candidates)
 
+	// hosts we already have a full device service URL for don't need to also be probed by path
 	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if u, err := url.Parse(candidate); err == nil && u.Path != "" {
+			seen[u.Scheme+"://"+u.Host] = true
+		}
+	}
 
-	// for each candidate see if it is an ONVIF device
+	p := pool.New().WithMaxGoroutines(max(opts.ProbeWorkers, 1))
+	mu := sync.Mutex{}
+	onvifHosts := make(map[string]bool)
+
+	probes := make([]string, 0, len(candidates))
 	for _, candidate := range candidates {
 		// we've already seen this candidate
-		if seen[candidate] {
+		if !seen[candidate] {
+			seen[candidate] = true
+			probes = append(probes, candidate)
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(0, len(probes))
+	}
+
+	// for each candidate see if it is an ONVIF device
+	for _, candidate := range probes {
+		p.Go(func() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			d, failures := probeCandidate(log, candidate, opts)
+			latency := latencyOf(log, candidate, opts)
+
+			// results are aggregated and reported one at a time so callers don't need to be thread safe
+			mu.Lock()
+			defer mu.Unlock()
+
+			mac, vendor := opts.hardwareOf(candidate)
+			for i := range failures {
+				failures[i].MAC, failures[i].Vendor = mac, vendor
+			}
+
+			summary.Candidates++
+			summary.Failures = append(summary.Failures, failures...)
+			if opts.Progress != nil {
+				opts.Progress(summary.Candidates, len(probes))
+			}
+			if d == nil {
+				return
+			}
+
+			summary.Found++
+			if u, err := url.Parse(d.Address); err == nil {
+				onvifHosts[u.Hostname()] = true
+			}
+			found(DeviceResult{Device: d, Failures: failures, Credential: Credential{Username: d.Username, Password: d.Password}, MAC: mac, Vendor: vendor, Latency: latency})
+		})
+	}
+	p.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// finally look for cameras which expose RTSP but aren't ONVIF devices
+	if opts.RTSPScan && opts.Fixtures == nil {
+		log.Info("starting rtsp scanning", slog.Any("ports", opts.RTSPPorts))
+		rtspSources, err := FindRTSPSources(log, networksOf(ifaces), opts)
+		if err != nil {
+			if len(rtspSources) == 0 {
+				return nil, fmt.Errorf("error finding rtsp sources: %w", err)
+			}
+			log.Warn("rtsp scanning incomplete, continuing with partial results", slog.String("error", err.Error()))
+		}
+		sources = append(sources, rtspSources...)
+		log.Info("rtsp scanning complete", slog.Int("count", len(rtspSources)))
+	}
+	sources = filter.filterSources(log, sources)
+
+	seenSources := make(map[string]bool)
+	for _, source := range sources {
+		if onvifHosts[hostOf(source.Address)] || seenSources[source.Address] {
 			continue
 		}
-		seen[candidate] = true
+		seenSources[source.Address] = true
+		summary.StreamSources++
 
-		// check if it is an ONVIF device
-		d := onvif.NewDevice(candidate, username, password)
-		valid, err := d.Probe(log)
+		mac, vendor := opts.hardwareOf(source.Address)
+		found(DeviceResult{Source: &source, MAC: mac, Vendor: vendor, Latency: latencyOf(log, source.Address, opts)})
+	}
+
+	SortFailures(summary.Failures)
+	summary.Duration = time.Since(summary.Started)
+
+	scanDuration.With().Observe(summary.Duration.Seconds())
+	scanDevices.With("onvif").Set(float64(summary.Found))
+	scanDevices.With("rtsp").Set(float64(summary.StreamSources))
+	scanFailures.With().Set(float64(len(summary.Failures)))
+
+	return summary, nil
+}
+
+// creates the passed in VLAN sub-interfaces, returning a function which removes them all again
+func createVLANs(log *slog.Logger, vlans []network.VLAN) (func(), error) {
+	removes := []func(){}
+	removeAll := func() {
+		for i := len(removes) - 1; i >= 0; i-- {
+			removes[i]()
+		}
+	}
+
+	for _, vlan := range vlans {
+		remove, err := network.CreateVLAN(vlan)
 		if err != nil {
-			log.Debug("error probing onvif device, ignoring", slog.String("candidate", candidate), slog.String("error", err.Error()))
+			removeAll()
+			return nil, fmt.Errorf("error creating vlan interface: %w", err)
+		}
+		log.Info("created vlan interface", slog.Any("iface", vlan.Name()), slog.Any("address", vlan.Address))
+		removes = append(removes, func() {
+			if err := remove(); err != nil {
+				log.Error("error removing vlan interface", slog.Any("iface", vlan.Name()), slog.String("error", err.Error()))
+			}
+		})
+	}
+	return removeAll, nil
+}
+
+// ProbeDevice probes a single device at a known address without doing any discovery. The address can be a bare IP
+// or host:port, in which case the standard device service path is used, or a full device service URL for cameras
+// which use a non-standard path.
+func ProbeDevice(log *slog.Logger, address string, opts Options) (*DeviceResult, error) {
+	candidate, err := DeviceServiceURL(address)
+	if err != nil {
+		return nil, err
+	}
+
+	d, failures := probeCandidate(log, candidate, opts)
+	if d == nil {
+		if len(failures) > 0 {
+			return nil, fmt.Errorf("error probing device %q: %s", candidate, failures[0].Error)
+		}
+		return nil, fmt.Errorf("%q is not a valid onvif device", candidate)
+	}
+	mac, vendor := opts.hardwareOf(candidate)
+	return &DeviceResult{Device: d, Failures: failures, Credential: Credential{Username: d.Username, Password: d.Password}, MAC: mac, Vendor: vendor}, nil
+}
+
+// DeviceServiceURL converts an IP, host:port or URL into a device service URL, addresses without a path are
+// returned without one so that each of our device service paths are tried when probing
+func DeviceServiceURL(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid device address %q: %w", address, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid device address %q: no host", address)
+	}
+	if u.Path == "/" {
+		u.Path = ""
+	}
+	return u.String(), nil
+}
+
+// finds candidate device service addresses via ws-discovery and port scanning
+func findCandidates(log *slog.Logger, ifaces map[network.IFace]network.CIDR, opts Options, filter *Filter) ([]string, []StreamSource, error) {
+	// our fixtures are all we can discover
+	if opts.Fixtures != nil {
+		candidates, err := opts.Fixtures.Discover(log)
+		return candidates, []StreamSource{}, err
+	}
+
+	candidates := []string{}
+	sources := []StreamSource{}
+	if opts.WSDiscovery {
+		wsCandidates, err := findWSDiscoveryCandidates(log, ifaces, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, wsCandidates...)
+	}
+
+	if opts.SSDP {
+		for iface := range ifaces {
+			log.Info("starting ssdp discovery", slog.Any("iface", iface))
+			devices, err := FindSSDPDevices(log, string(iface), opts.SSDPDeviceTypes, opts.SSDPTimeout, filter)
+			if err != nil {
+				log.Warn("error finding ssdp devices", slog.Any("iface", iface), slog.String("error", err.Error()))
+				continue
+			}
+			candidates = append(candidates, ssdpCandidates(log, devices, opts, filter)...)
+			log.Info("ssdp discovery complete", slog.Any("iface", iface), slog.Int("count", len(devices)))
+		}
+	}
+
+	if opts.MDNS {
+		for iface := range ifaces {
+			log.Info("starting mdns discovery", slog.Any("iface", iface))
+			services, err := BrowseMDNS(log, string(iface), []string{MDNSServiceRTSP, MDNSServiceHTTP}, opts.MDNSTimeout)
+			if err != nil {
+				log.Warn("error browsing mdns", slog.Any("iface", iface), slog.String("error", err.Error()))
+				continue
+			}
+			for _, service := range services {
+				address := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+				if service.Service == MDNSServiceRTSP {
+					sources = append(sources, StreamSource{Address: address, URL: fmt.Sprintf("rtsp://%s/", address), Vendor: service.Instance})
+				} else {
+					candidates = append(candidates, "http://"+address)
+				}
+			}
+			log.Info("mdns discovery complete", slog.Any("iface", iface), slog.Int("count", len(services)))
+		}
+	}
+
+	if opts.PortScan {
+		// then do a port scan to find anything with our ports open
+		log.Info("starting ip scanning", slog.Any("ports", opts.Ports))
+		portCandidates, err := FindHostsWithOpenPort(log, networksOf(ifaces), opts)
+		if err != nil {
+			if len(portCandidates) == 0 {
+				return nil, nil, fmt.Errorf("error finding candidates via scan: %w", err)
+			}
+			log.Warn("ip scanning incomplete, continuing with partial results", slog.String("error", err.Error()))
+		}
+		for _, candidate := range portCandidates {
+			candidates = append(candidates, fmt.Sprintf("http://%s", candidate))
+		}
+		log.Info("ip scanning complete", slog.Int("count", len(portCandidates)))
+	}
+
+	return candidates, sources, nil
+}
+
+// returns the device service candidates of the passed in SSDP devices, we don't know what port the device service is
+// on so we use whichever of our ports are open, only dialing those devices the filter allows
+func ssdpCandidates(log *slog.Logger, devices []SSDPDevice, opts Options, filter *Filter) []string {
+	candidates := []string{}
+	for _, device := range devices {
+		if !filter.Allows(device.IP) {
+			log.Debug("skipping filtered ssdp device", slog.String("ip", device.IP))
 			continue
 		}
-		if !valid {
-			log.Debug("not a valid onvif device, ignoring", slog.String("candidate", candidate))
+		for _, port := range opts.Ports {
+			address := net.JoinHostPort(device.IP, strconv.Itoa(port))
+			if open, _ := network.IsPortOpen(address, opts.DialTimeout); open {
+				candidates = append(candidates, "http://"+address)
+			}
+		}
+	}
+	return candidates
+}
+
+// returns the passed in interfaces narrowed down to those we've been asked to scan from, if any, logging any VLAN
+// sub-interfaces among them so it's clear which tagged networks are being scanned
+func selectInterfaces(log *slog.Logger, ifaces map[network.IFace]network.CIDR, opts Options) map[network.IFace]network.CIDR {
+	selected := ifaces
+	if len(opts.Interfaces) > 0 || len(opts.VLANs) > 0 {
+		selected = make(map[network.IFace]network.CIDR)
+		for iface, cidr := range ifaces {
+			if slices.Contains(opts.Interfaces, iface) || slices.ContainsFunc(opts.VLANs, func(v network.VLAN) bool { return v.Name() == iface }) {
+				selected[iface] = cidr
+			}
+		}
+	}
+
+	vlans, err := network.GetVLANs()
+	if err != nil {
+		log.Warn("unable to list vlan interfaces", slog.String("error", err.Error()))
+		return selected
+	}
+	for _, vlan := range vlans {
+		if cidr, found := selected[vlan.Name()]; found {
+			log.Debug("scanning from vlan interface", slog.Any("iface", vlan.Name()), slog.Int("vlan", vlan.ID), slog.Any("cidr", cidr))
+		}
+	}
+	return selected
+}
+
+func networksOf(ifaces map[network.IFace]network.CIDR) []network.CIDR {
+	networks := make([]network.CIDR, 0, len(ifaces))
+	for _, cidr := range ifaces {
+		networks = append(networks, cidr)
+	}
+	return networks
+}
+
+// returns the host portion of a host:port address
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// finds candidates using multicast ws-discovery on each interface, and unicast to any explicit probe targets
+func findWSDiscoveryCandidates(log *slog.Logger, ifaces map[network.IFace]network.CIDR, opts Options) ([]string, error) {
+	// first use ws-discovery to find ONVIF devices
+	devices := []onvif.DiscoveredDevice{}
+	for iface := range ifaces {
+		log.Info("starting onvif ws-discovery", slog.Any("iface", iface))
+		ifaceCandidates, err := onvif.GetONVIFVideoTransmitters(log, string(iface), opts.Discovery)
+		if err != nil {
+			return nil, fmt.Errorf("error finding candidates via ws discovery: %w", err)
+		}
+		devices = append(devices, ifaceCandidates...)
+		log.Info("onvif ws-discovery complete", slog.Any("iface", iface), slog.Int("count", len(ifaceCandidates)))
+	}
+
+	// then do the same over IPv6, we never port scan these as the networks are too large
+	ifaces6, err := network.GetPrivateIP6Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error getting IP6 interfaces: %w", err)
+	}
+	for iface := range selectInterfaces(log, ifaces6, opts) {
+		log.Info("starting onvif ws-discovery over ipv6", slog.Any("iface", iface))
+		ifaceCandidates, err := onvif.GetONVIFVideoTransmitters6(log, string(iface), opts.Discovery)
+		if err != nil {
+			log.Warn("error finding candidates via ipv6 ws discovery", slog.Any("iface", iface), slog.String("error", err.Error()))
 			continue
 		}
+		devices = append(devices, ifaceCandidates...)
+		log.Info("onvif ws-discovery over ipv6 complete", slog.Any("iface", iface), slog.Int("count", len(ifaceCandidates)))
+	}
+
+	// send unicast probes to any targets that multicast won't reach
+	if len(opts.ProbeTargets) > 0 {
+		ips, err := network.ExpandTargets(opts.ProbeTargets, MaxScanHosts)
+		if err != nil {
+			return nil, fmt.Errorf("error expanding probe targets: %w", err)
+		}
+
+		filter, err := NewFilter(opts)
+		if err != nil {
+			return nil, err
+		}
+		ips = filter.filterAddresses(log, ips)
+
+		log.Info("starting unicast ws-discovery", slog.Int("targets", len(ips)))
+		limiter := network.NewTokenBucket(float64(opts.ScanRate), max(opts.Workers, 1))
+		probeCandidates, err := onvif.ProbeONVIFVideoTransmitters(log, ips, opts.Discovery, limiter)
+		if err != nil {
+			return nil, fmt.Errorf("error finding candidates via unicast ws discovery: %w", err)
+		}
+		devices = append(devices, probeCandidates...)
+		log.Info("unicast ws-discovery complete", slog.Int("count", len(probeCandidates)))
+	}
+
+	// devices answering over both IPv4 and IPv6, or both multicast and unicast, are only scanned once
+	candidates := []string{}
+	for _, device := range onvif.DedupeDevices(devices) {
+		candidates = append(candidates, device.Address)
+	}
+	return candidates, nil
+}
+
+// describes the streams at the passed in URL natively, falling back to ffprobe if that fails or leaves us without
+// a video resolution
+func probeStreams(log *slog.Logger, uri *creds.URL, opts Options) ([]media.StreamInfo, error) {
+	streams, err := rtsp.ProbeStreams(uri.Secret(), opts.RTSPTimeout)
+	if err == nil && hasResolution(streams) {
+		return streams, nil
+	}
+	prober := opts.Prober
+	if prober == nil {
+		prober = &ffmpeg.Prober{}
+	}
+	if !opts.FFprobe || !prober.Available() {
+		return streams, err
+	}
+
+	log.Debug("unable to probe stream natively, falling back to ffprobe", slog.Any("url", uri), slog.Any("error", err))
+	probe, err := prober.ProbeURL(context.Background(), log, uri)
+	if err != nil {
+		return nil, err
+	}
+	return probe.Streams, nil
+}
+
+// describes the stream of the passed in profile of a device, from our fixtures if we have them
+func describeProfile(log *slog.Logger, d *onvif.Device, profile onvif.Profile, opts Options) ([]media.StreamInfo, error) {
+	if opts.Fixtures != nil {
+		return opts.Fixtures.Streams(d.Address, profile.Token)
+	}
+
+	uri, err := streamURL(log, profile.URI, d.Username, d.Password, opts)
+	if err != nil {
+		return nil, err
+	}
+	return probeStreams(log, uri, opts)
+}
 
-		for i, profile := range d.Profiles {
-			uri, _ := url.Parse(profile.URI)
-			if d.Username != "" {
-				uri.User = url.UserPassword(d.Username, d.Password)
+// returns whether every video stream in the passed in streams has a resolution, and there is at least one
+func hasResolution(streams []media.StreamInfo) bool {
+	video := 0
+	for _, s := range streams {
+		if s.CodecType == "video" {
+			if s.Width == 0 || s.Height == 0 {
+				return false
 			}
-			streams, err := ffmpeg.ProbeRTSP(log, uri.String())
+			video++
+		}
+	}
+	return video > 0
+}
+
+// returns the URL to open for the passed in stream with credentials applied according to the strategy that works
+// for the device, falling back to credentials in the URL if we couldn't work one out
+func streamURL(log *slog.Logger, uri string, username string, password string, opts Options) (*creds.URL, error) {
+	strategy := rtsp.StrategyHeader
+	if username == "" {
+		strategy = rtsp.StrategyNone
+	}
+
+	if opts.RTSPStrategies != nil {
+		resolved, err := opts.RTSPStrategies.Resolve(uri, username, password, opts.RTSPTimeout)
+		if err != nil {
+			log.Debug("unable to resolve rtsp credential strategy", slog.String("url", creds.Redact(uri)), slog.String("error", err.Error()))
+		} else {
+			strategy = resolved
+		}
+	}
+
+	return strategy.Apply(uri, username, password)
+}
+
+// probes a single device service address with each of our credentials, returning nil if it isn't a valid device
+func probeAddress(log *slog.Logger, address string, opts Options, failures *[]Failure) *onvif.Device {
+	for _, cred := range opts.credentialsFor(address) {
+		// check if it is an ONVIF device
+		device := onvif.NewDevice(address, cred.Username, cred.Password)
+		device.Timeouts = opts.SOAPTimeouts
+		if opts.Fixtures != nil {
+			device.Transport = opts.Fixtures
+		}
+		valid, err := device.Probe(log)
+		if err != nil {
+			log.Debug("error probing onvif device", slog.String("candidate", address), slog.String("username", cred.Username), slog.String("error", err.Error()))
+			*failures = append(*failures, Failure{Candidate: address, Stage: StageONVIF, Error: err.Error()})
+
+			// a valid device which errored most likely rejected our credentials, so try the next ones
+			if valid {
+				continue
+			}
+			return nil
+		}
+		if !valid {
+			log.Debug("not a valid onvif device, ignoring", slog.String("candidate", address))
+			return nil
+		}
+		return device
+	}
+	return nil
+}
+
+// probes a single candidate, returning the device if it is a valid ONVIF device along with any failures
+func probeCandidate(log *slog.Logger, candidate string, opts Options) (*onvif.Device, []Failure) {
+	failures := []Failure{}
+
+	// candidates without a path could be using any of our device service paths
+	addresses := []string{candidate}
+	if u, err := url.Parse(candidate); err == nil && u.Path == "" {
+		addresses = addresses[:0]
+		for _, path := range opts.DeviceServicePaths {
+			addresses = append(addresses, candidate+path)
+		}
+	}
+
+	for _, address := range addresses {
+		if d, found := opts.cached(address); found {
+			log.Debug("using persisted probe results", slog.String("address", address))
+			return d, failures
+		}
+	}
+
+	var d *onvif.Device
+	for _, address := range addresses {
+		d = probeAddress(log, address, opts, &failures)
+		if d != nil {
+			break
+		}
+	}
+
+	// none of our addresses were valid
+	if d == nil {
+		return nil, failures
+	}
+
+	// failures on paths we tried before finding the right one aren't interesting
+	failures = failures[:0]
+
+	p := pool.New().WithMaxGoroutines(max(opts.StreamWorkers, 1))
+	mu := sync.Mutex{}
+
+	for i, profile := range d.Profiles {
+		p.Go(func() {
+			streams, err := describeProfile(log, d, profile, opts)
 			if err != nil {
 				log.Debug("unable to open RTSP stream", slog.String("url", profile.URI))
-				continue
+				mu.Lock()
+				failures = append(failures, Failure{Candidate: profile.URI, Stage: StageRTSP, Error: err.Error()})
+				mu.Unlock()
+				return
 			}
 			log.Info("rtsp stream", slog.String("url", profile.URI), slog.String("profile", fmt.Sprintf("%+v", streams)))
+
+			// each goroutine writes only its own profile
 			d.Profiles[i].Streams = streams
+		})
+	}
+	p.Wait()
+
+	log.Info("onvif device found",
+		slog.String("address", d.Address),
+		slog.String("manufacturer", d.DeviceInformation.Manufacturer),
+		slog.String("model", d.DeviceInformation.Model),
+		slog.String("firmware", d.DeviceInformation.FirmwareVersion),
+		slog.String("serial", d.DeviceInformation.SerialNumber),
+		slog.String("hardware", d.DeviceInformation.HardwareID),
+		slog.String("profiles", fmt.Sprintf("%+v", d.Profiles)))
+
+	if opts.Probes != nil {
+		if err := opts.Probes.Save(d); err != nil {
+			log.Error("error saving probe results", slog.String("address", d.Address), slog.String("error", err.Error()))
 		}
+	}
+	return d, failures
+}
 
-		log.Info("onvif device found",
-			slog.String("address", d.Address),
-			slog.String("manufacturer", d.DeviceInformation.Manufacturer),
-			slog.String("model", d.DeviceInformation.Model),
-			slog.String("firmware", d.DeviceInformation.FirmwareVersion),
-			slog.String("serial", d.DeviceInformation.SerialNumber),
-			slog.String("hardware", d.DeviceInformation.HardwareID),
-			slog.String("profiles", fmt.Sprintf("%+v", d.Profiles)))
+func FindHostsWithOpenPort(log *slog.Logger, networks []network.CIDR, opts Options) ([]string, error) {
+	filter, err := NewFilter(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
-}
+	// everything we send is paced so that sweeping large networks doesn't flood them
+	limiter := network.NewTokenBucket(float64(opts.ScanRate), max(opts.Workers, 1))
+	maxHosts := min(opts.MaxHostsPerNetwork, MaxScanHosts)
+
+	// latencies of the hosts which answered a ping sweep, these are port scanned first
+	latencies := make(map[string]time.Duration)
+	pingSweep := func(cidr network.CIDR, ips []string) {
+		if !opts.PingSweep {
+			return
+		}
+		results, err := network.PingSweep(cidr, ips, opts.PingTimeout, opts.Workers)
+		if err != nil {
+			log.Warn("unable to ping sweep network", slog.Any("cidr", cidr), slog.String("error", err.Error()))
+			return
+		}
+		for _, r := range results {
+			latencies[r.IP] = r.Latency
+		}
+		log.Info("ping sweep complete", slog.Any("cidr", cidr), slog.Int("responsive", len(results)))
+	}
 
-func FindHostsWithOpenPort(log *slog.Logger, ifaces map[network.IFace]network.CIDR, port int) ([]string, error) {
 	// map of address candidates to scan
 	candidates := make(map[string]bool)
+	addCandidates := func(ips []string) {
+		for _, ip := range ips {
+			if !filter.Allows(ip) {
+				continue
+			}
+			for _, port := range opts.Ports {
+				candidates[net.JoinHostPort(ip, strconv.Itoa(port))] = true
+			}
+		}
+	}
 
-	// for each interface, get all candidate IPs
-	for iface, ip := range ifaces {
-		ips, err := network.GetIPsOnNetwork(ip)
+	// for each interface network, get all candidate IPs
+	for _, cidr := range networks {
+		size, err := networkSize(cidr)
 		if err != nil {
-			return nil, fmt.Errorf("error getting IPs for interface %q: %w", iface, err)
+			return nil, err
+		}
+		if size > maxHosts {
+			log.Warn("ignoring network with too many IPs, include it explicitly or raise the host limit to scan it", slog.Any("cidr", cidr), slog.Int("count", size), slog.Int("limit", maxHosts))
+			continue
 		}
-		if len(ips) <= 256 {
-			for _, ip := range ips {
-				candidates[fmt.Sprintf("%s:%d", ip, port)] = true
-			}
-			log.Info("scanning candidate IPs on interface",
-				slog.Any("interface", iface),
-				slog.Any("cidr", ip),
-				slog.Int("count", len(ips)))
 
-		} else {
-			log.Info("ignoring interface with too many IPs",
-				slog.Any("interface", iface),
-				slog.Any("cidr", ip),
-				slog.Int("count", len(ips)))
+		ips, err := network.GetIPsOnNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error getting IPs for network %q: %w", cidr, err)
 		}
+		ips = slices.DeleteFunc(ips, func(ip string) bool { return !filter.Allows(ip) })
+
+		// if we can, narrow down to the hosts that are actually alive before dialing them
+		if opts.ARPSweep {
+			ips = liveHosts(log, cidr, ips, limiter, opts)
+		}
+		pingSweep(cidr, ips)
+		addCandidates(ips)
+		log.Info("scanning candidate IPs on network", slog.Any("cidr", cidr), slog.Int("count", len(ips)))
 	}
 
-	wg := conc.WaitGroup{}
-	keepers := []string{}
+	// explicitly included networks are scanned regardless of our host limit, up to the largest we support
+	for _, cidr := range opts.IncludeCIDRs {
+		size, err := networkSize(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if size > MaxScanHosts {
+			log.Warn("ignoring included network larger than we can scan", slog.Any("cidr", cidr), slog.Int("count", size), slog.Int("limit", MaxScanHosts))
+			continue
+		}
+
+		ips, err := network.GetIPsOnNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error getting IPs for network %q: %w", cidr, err)
+		}
+		ips = slices.DeleteFunc(ips, func(ip string) bool { return !filter.Allows(ip) })
+		pingSweep(cidr, ips)
+		addCandidates(ips)
+		log.Info("scanning candidate IPs on included network", slog.Any("cidr", cidr), slog.Int("count", len(ips)))
+	}
+
+	// the semaphore bounds how many dials we have in flight and so how many file descriptors we use
+	sem := make(chan struct{}, max(opts.Workers, 1))
+	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
+	keepers := []string{}
+	errs := []error{}
+
+	ordered := prioritize(candidates, latencies)
+	for _, candidate := range ordered {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			limiter.Wait(context.Background())
+			open, err := dialWithRetry(candidate, opts.DialTimeout)
+
+			mu.Lock()
+			defer mu.Unlock()
 
-	for candidate := range candidates {
-		wg.Go(func() {
-			open, err := network.IsPortOpen(candidate, 50*time.Millisecond)
 			if err != nil {
-				log.Error("error checking port", slog.String("candidate", candidate), slog.String("error", err.Error()))
-				panic(err)
+				errs = append(errs, err)
+				return
 			}
 			if open {
 				log.Info("found open port", slog.String("candidate", candidate))
-				mu.Lock()
 				keepers = append(keepers, candidate)
-				mu.Unlock()
 			}
-		})
+		}()
 	}
 	wg.Wait()
+
+	SortAddresses(keepers)
+
+	// we still return whatever we found, callers can decide whether a partial scan is good enough
+	if len(errs) > 0 {
+		return keepers, fmt.Errorf("error checking %d of %d candidates: %w", len(errs), len(ordered), errors.Join(errs[:min(len(errs), maxReportedErrors)]...))
+	}
 	return keepers, nil
 }
+
+// how many individual errors are included when a port scan has failures, the rest are just counted
+const maxReportedErrors = 5
+
+// how many times we try to dial a candidate when we are out of file descriptors, and how long we wait before the
+// first retry, doubling each time
+const (
+	dialRetries      = 5
+	dialRetryBackoff = 50 * time.Millisecond
+)
+
+// checks whether the passed in port is open, retrying if we fail because we've run out of file descriptors
+func dialWithRetry(address string, timeout time.Duration) (bool, error) {
+	backoff := dialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		open, err := network.IsPortOpen(address, timeout)
+		if err == nil || !network.IsTooManyOpenFiles(err) || attempt == dialRetries {
+			return open, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// orders the passed in host:port candidates so that hosts which answered pings come first, fastest first
+func prioritize(candidates map[string]bool, latencies map[string]time.Duration) []string {
+	ordered := make([]string, 0, len(candidates))
+	for candidate := range candidates {
+		ordered = append(ordered, candidate)
+	}
+	SortAddresses(ordered)
+
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		la, aok := latencies[hostOf(a)]
+		lb, bok := latencies[hostOf(b)]
+		switch {
+		case aok && bok:
+			return cmp.Compare(la, lb)
+		case aok:
+			return -1
+		case bok:
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// returns the IPs on the passed in network which answer ARP, falling back to all of them if we can't tell
+func liveHosts(log *slog.Logger, cidr network.CIDR, ips []string, limiter *network.TokenBucket, opts Options) []string {
+	if len(ips) > maxARPSweepHosts {
+		log.Info("network too large to arp sweep, scanning all IPs", slog.Any("cidr", cidr), slog.Int("count", len(ips)))
+		return ips
+	}
+
+	neighbors, err := network.ARPSweep(cidr, ips, opts.ARPWait, limiter)
+	if err != nil {
+		log.Warn("unable to arp sweep network, scanning all IPs", slog.Any("cidr", cidr), slog.String("error", err.Error()))
+		return ips
+	}
+
+	live := make([]string, 0, len(neighbors))
+	for _, n := range neighbors {
+		live = append(live, n.IP)
+	}
+	log.Info("arp sweep complete", slog.Any("cidr", cidr), slog.Int("live", len(live)), slog.Int("total", len(ips)))
+	return live
+}
+
+// returns the number of addresses on the passed in network without enumerating them
+func networkSize(cidr network.CIDR) (int, error) {
+	p, err := network.ParsePrefix(cidr)
+	if err != nil {
+		return 0, err
+	}
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if hostBits >= 31 {
+		return math.MaxInt32, nil
+	}
+	return 1 << hostBits, nil
+}
@@ -0,0 +1,139 @@
+package scan
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/incrementventures/govr/network"
+)
+
+func TestFindHostsWithOpenPortLimit(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	address := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	if DefaultOptions().MaxHostsPerNetwork != DefaultMaxHosts {
+		t.Errorf("expected default host limit of %d, got %d", DefaultMaxHosts, DefaultOptions().MaxHostsPerNetwork)
+	}
+
+	tcs := []struct {
+		name     string
+		networks []network.CIDR
+		maxHosts int
+		include  []network.CIDR
+		found    []string
+	}{
+		{name: "within default", networks: []network.CIDR{"127.0.0.0/30"}, maxHosts: DefaultMaxHosts, found: []string{address}},
+		{name: "at default", networks: []network.CIDR{"127.0.0.0/24"}, maxHosts: DefaultMaxHosts, found: []string{address}},
+		{name: "past default", networks: []network.CIDR{"127.0.0.0/23"}, maxHosts: DefaultMaxHosts, found: []string{}},
+		{name: "raised", networks: []network.CIDR{"127.0.0.0/23"}, maxHosts: 512, found: []string{address}},
+		{name: "included", include: []network.CIDR{"127.0.0.0/23"}, maxHosts: DefaultMaxHosts, found: []string{address}},
+		{name: "raised past max", networks: []network.CIDR{"127.0.0.0/15"}, maxHosts: 1 << 20, found: []string{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Ports = []int{port}
+			opts.ARPSweep = false
+			opts.ScanRate = 0
+			opts.MaxHostsPerNetwork = tc.maxHosts
+			opts.IncludeCIDRs = tc.include
+
+			found, err := FindHostsWithOpenPort(log, tc.networks, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(found, tc.found) {
+				t.Errorf("expected %v, got %v", tc.found, found)
+			}
+		})
+	}
+}
+
+func TestFindHostsWithOpenPortExcluded(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// arp sweeps send to the discard port, listen there on an excluded address and one we may touch
+	excluded, err := net.ListenPacket("udp4", "127.0.0.2:9")
+	if err != nil {
+		t.Skipf("unable to listen on the discard port: %v", err)
+	}
+	defer excluded.Close()
+	allowed, err := net.ListenPacket("udp4", "127.0.0.3:9")
+	if err != nil {
+		t.Skipf("unable to listen on the discard port: %v", err)
+	}
+	defer allowed.Close()
+
+	opts := DefaultOptions()
+	opts.ARPSweep = true
+	opts.ARPWait = 0
+	opts.PingSweep = false
+	opts.ScanRate = 0
+	opts.DialTimeout = 100 * time.Millisecond
+	opts.ExcludeCIDRs = []network.CIDR{"127.0.0.2/32"}
+	if _, err := FindHostsWithOpenPort(log, []network.CIDR{"127.0.0.0/29"}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 16)
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := allowed.ReadFrom(b); err != nil {
+		t.Errorf("expected the sweep to reach an allowed address, got %v", err)
+	}
+	excluded.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, src, err := excluded.ReadFrom(b); err == nil {
+		t.Errorf("expected nothing sent to an excluded address, got a datagram from %s", src)
+	}
+}
+
+func TestSSDPCandidates(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// devices answering on the same port
+	allowed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	port := allowed.Addr().(*net.TCPAddr).Port
+	excluded, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("unable to listen on a second loopback address: %v", err)
+	}
+	defer excluded.Close()
+
+	opts := DefaultOptions()
+	opts.Ports = []int{port}
+	opts.ExcludeCIDRs = []network.CIDR{"127.0.0.2/32"}
+	filter, err := NewFilter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := []SSDPDevice{{IP: "127.0.0.1"}, {IP: "127.0.0.2"}}
+	candidates := ssdpCandidates(log, devices, opts, filter)
+	expected := []string{"http://" + allowed.Addr().String()}
+	if !slices.Equal(candidates, expected) {
+		t.Errorf("expected %v, got %v", expected, candidates)
+	}
+
+	// anything dialed is waiting to be accepted
+	excluded.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if c, err := excluded.Accept(); err == nil {
+		c.Close()
+		t.Error("expected the excluded device never dialed")
+	}
+}
@@ -0,0 +1,97 @@
+package scan
+
+import (
+	"cmp"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// SortResults sorts results by IP address, then port, then serial number so that output is stable regardless of
+// the order devices were found in
+func SortResults(results []DeviceResult) {
+	slices.SortStableFunc(results, func(a, b DeviceResult) int {
+		if c := compareAddresses(resultAddress(a), resultAddress(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(resultSerial(a), resultSerial(b))
+	})
+}
+
+// SortFailures sorts failures by candidate address then stage
+func SortFailures(failures []Failure) {
+	slices.SortStableFunc(failures, func(a, b Failure) int {
+		if c := compareAddresses(a.Candidate, b.Candidate); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Stage, b.Stage)
+	})
+}
+
+// SortAddresses sorts host:port or URL addresses numerically by IP then port
+func SortAddresses(addresses []string) {
+	slices.SortStableFunc(addresses, compareAddresses)
+}
+
+func resultAddress(r DeviceResult) string {
+	if r.Device != nil {
+		return r.Device.Address
+	}
+	if r.Source != nil {
+		return r.Source.Address
+	}
+	return ""
+}
+
+func resultSerial(r DeviceResult) string {
+	if r.Device != nil {
+		return r.Device.DeviceInformation.SerialNumber
+	}
+	return ""
+}
+
+// compares two addresses, which can be URLs, host:port or bare IPs, numerically by IP and then port, falling back
+// to string comparison for anything that isn't an IP
+func compareAddresses(a, b string) int {
+	hostA, portA := splitAddress(a)
+	hostB, portB := splitAddress(b)
+
+	ipA, errA := netip.ParseAddr(hostA)
+	ipB, errB := netip.ParseAddr(hostB)
+
+	switch {
+	case errA == nil && errB == nil:
+		if c := ipA.Compare(ipB); c != 0 {
+			return c
+		}
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		if c := strings.Compare(hostA, hostB); c != 0 {
+			return c
+		}
+	}
+
+	if c := cmp.Compare(len(portA), len(portB)); c != 0 {
+		return c
+	}
+	if c := strings.Compare(portA, portB); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func splitAddress(address string) (string, string) {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err == nil {
+			return u.Hostname(), u.Port()
+		}
+	}
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		return ap.Addr().String(), address[strings.LastIndex(address, ":")+1:]
+	}
+	return hostOf(address), ""
+}
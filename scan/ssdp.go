@@ -0,0 +1,191 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/incrementventures/govr/network"
+	"github.com/incrementventures/govr/onvif"
+	"golang.org/x/net/ipv4"
+)
+
+const ssdpSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n" +
+	"ST: upnp:rootdevice\r\n\r\n"
+
+// the most device descriptions we'll fetch for a single search, far more than any real network has
+const maxSSDPLocations = 128
+
+// DefaultSSDPDeviceTypes are the substrings of UPnP device types, models or names we consider to be cameras
+var DefaultSSDPDeviceTypes = []string{"camera", "networkvideo", "ipc", "nvr", "dvr"}
+
+// SSDPDevice is a UPnP device found via SSDP
+type SSDPDevice struct {
+	Location     string
+	IP           string
+	DeviceType   string
+	FriendlyName string
+	Manufacturer string
+	ModelName    string
+}
+
+type upnpDescription struct {
+	Device struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+	} `xml:"device"`
+}
+
+// FindSSDPDevices sends an SSDP M-SEARCH on the passed in interface, fetches the description of each responding
+// device the passed in filter allows and returns those whose type, model or name matches one of the passed in device
+// types
+func FindSSDPDevices(log *slog.Logger, ifaceName string, deviceTypes []string, timeout time.Duration, filter *Filter) ([]SSDPDevice, error) {
+	log = log.With("iface", ifaceName)
+
+	c, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start ssdp listen: %w", err)
+	}
+	defer c.Close()
+
+	p := ipv4.NewPacketConn(c)
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %q: %w", ifaceName, err)
+	}
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return nil, fmt.Errorf("interface %q unable to set multicast interface: %w", ifaceName, err)
+	}
+	p.SetMulticastTTL(2)
+
+	dest := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	if _, err := p.WriteTo([]byte(ssdpSearch), nil, dest); err != nil {
+		return nil, fmt.Errorf("unable to send ssdp search on interface %q: %w", ifaceName, err)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("unable to set read deadline: %w", err)
+	}
+
+	locations := make(map[string]bool)
+	guard := network.NewResponseGuard(0, 0, 0)
+	b := make([]byte, 8192)
+	for !guard.Exhausted() {
+		n, src, err := c.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return nil, fmt.Errorf("error reading ssdp response: %w", err)
+		}
+		if !guard.Allow(hostOf(src.String()), b[:n]) {
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+		if err != nil {
+			log.Debug("error parsing ssdp response, skipping", slog.String("src", src.String()), slog.String("error", err.Error()))
+			continue
+		}
+		resp.Body.Close()
+
+		// each location is fetched, so don't let a flood of them turn into a flood of requests, nor fetch any we may not
+		// touch
+		location := resp.Header.Get("Location")
+		if location != "" && !filter.Allows(location) {
+			log.Debug("skipping filtered ssdp location", slog.String("location", location))
+			continue
+		}
+		if location != "" && len(locations) < maxSSDPLocations {
+			locations[location] = true
+		}
+	}
+
+	if guard.Dropped() > 0 {
+		log.Warn("dropped excess or duplicate ssdp responses", slog.Int("dropped", guard.Dropped()))
+	}
+
+	client := &http.Client{Timeout: timeout}
+	devices := []SSDPDevice{}
+	for location := range locations {
+		device, err := fetchSSDPDescription(client, location)
+		if err != nil {
+			log.Debug("error fetching ssdp description, skipping", slog.String("location", location), slog.String("error", err.Error()))
+			continue
+		}
+
+		if !matchesDeviceType(device, deviceTypes) {
+			log.Debug("ignoring non camera ssdp device", slog.String("location", location), slog.String("type", device.DeviceType))
+			continue
+		}
+
+		log.Info("discovered ssdp device",
+			slog.String("location", location),
+			slog.String("type", device.DeviceType),
+			slog.String("name", device.FriendlyName),
+			slog.String("manufacturer", device.Manufacturer))
+		devices = append(devices, *device)
+	}
+
+	return devices, nil
+}
+
+func fetchSSDPDescription(client *http.Client, location string) (*SSDPDevice, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non 200 status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &upnpDescription{}
+	if err := onvif.UnmarshalXML(body, desc); err != nil {
+		return nil, err
+	}
+
+	return &SSDPDevice{
+		Location:     location,
+		IP:           u.Hostname(),
+		DeviceType:   desc.Device.DeviceType,
+		FriendlyName: desc.Device.FriendlyName,
+		Manufacturer: desc.Device.Manufacturer,
+		ModelName:    desc.Device.ModelName,
+	}, nil
+}
+
+func matchesDeviceType(d *SSDPDevice, deviceTypes []string) bool {
+	haystack := strings.ToLower(d.DeviceType + " " + d.ModelName + " " + d.FriendlyName)
+	for _, t := range deviceTypes {
+		if strings.Contains(haystack, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
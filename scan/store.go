@@ -0,0 +1,227 @@
+package scan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Record is the persisted summary of a single device found by a scan
+type Record struct {
+	Key          string   `json:"key"`
+	Address      string   `json:"address"`
+	MAC          string   `json:"mac,omitempty"`
+	Vendor       string   `json:"vendor,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Firmware     string   `json:"firmware,omitempty"`
+	Serial       string   `json:"serial,omitempty"`
+	Hardware     string   `json:"hardware,omitempty"`
+	Endpoint     string   `json:"endpoint,omitempty"`
+	Streams      []string `json:"streams,omitempty"`
+}
+
+// Snapshot is the set of devices found by a single scan
+type Snapshot struct {
+	Time    time.Time `json:"time"`
+	Devices []Record  `json:"devices"`
+}
+
+// NewSnapshot builds a snapshot from the passed in scan results
+func NewSnapshot(t time.Time, results []DeviceResult) *Snapshot {
+	s := &Snapshot{Time: t, Devices: make([]Record, 0, len(results))}
+	for _, result := range results {
+		s.Devices = append(s.Devices, NewRecord(result))
+	}
+	slices.SortStableFunc(s.Devices, func(a, b Record) int {
+		if c := compareAddresses(a.Address, b.Address); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return s
+}
+
+// NewRecord builds a record for the passed in result, devices are keyed by serial number, then MAC address, then
+// address so that we can recognize a device whose IP has changed
+func NewRecord(result DeviceResult) Record {
+	r := Record{MAC: result.MAC, Vendor: result.Vendor}
+
+	if d := result.Device; d != nil {
+		r.Address = d.Address
+		r.Manufacturer = d.DeviceInformation.Manufacturer
+		r.Model = d.DeviceInformation.Model
+		r.Firmware = d.DeviceInformation.FirmwareVersion
+		r.Serial = d.DeviceInformation.SerialNumber
+		r.Hardware = d.DeviceInformation.HardwareID
+		r.Endpoint = d.Endpoint
+		for _, p := range d.Profiles {
+			r.Streams = append(r.Streams, p.URI)
+		}
+	} else if s := result.Source; s != nil {
+		r.Address = s.Address
+		r.Streams = []string{s.URL}
+	}
+
+	switch {
+	case r.Serial != "":
+		r.Key = "serial:" + r.Serial
+	case r.MAC != "":
+		r.Key = "mac:" + r.MAC
+	default:
+		r.Key = "address:" + r.Address
+	}
+	return r
+}
+
+// Change is a single field which differs for a device between two scans
+type Change struct {
+	Key   string `json:"key"`
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Diff describes how the devices on the network changed between two scans
+type Diff struct {
+	New     []Record `json:"new"`
+	Missing []Record `json:"missing"`
+	Changed []Change `json:"changed"`
+}
+
+// Empty returns whether nothing changed
+func (d *Diff) Empty() bool {
+	return len(d.New) == 0 && len(d.Missing) == 0 && len(d.Changed) == 0
+}
+
+// DiffSnapshots compares two snapshots, a nil previous snapshot means every device is new
+func DiffSnapshots(previous *Snapshot, current *Snapshot) *Diff {
+	diff := &Diff{New: []Record{}, Missing: []Record{}, Changed: []Change{}}
+
+	before := make(map[string]Record)
+	if previous != nil {
+		for _, r := range previous.Devices {
+			before[r.Key] = r
+		}
+	}
+	after := make(map[string]Record)
+	for _, r := range current.Devices {
+		after[r.Key] = r
+	}
+
+	for key, r := range after {
+		old, found := before[key]
+		if !found {
+			diff.New = append(diff.New, r)
+			continue
+		}
+
+		fields := []struct{ name, old, new string }{
+			{"address", old.Address, r.Address},
+			{"mac", old.MAC, r.MAC},
+			{"manufacturer", old.Manufacturer, r.Manufacturer},
+			{"model", old.Model, r.Model},
+			{"firmware", old.Firmware, r.Firmware},
+			{"hardware", old.Hardware, r.Hardware},
+			{"streams", strings.Join(old.Streams, " "), strings.Join(r.Streams, " ")},
+		}
+		for _, f := range fields {
+			if f.old != f.new {
+				diff.Changed = append(diff.Changed, Change{Key: key, Field: f.name, Old: f.old, New: f.new})
+			}
+		}
+	}
+	for key, r := range before {
+		if _, found := after[key]; !found {
+			diff.Missing = append(diff.Missing, r)
+		}
+	}
+
+	byKey := func(a, b Record) int { return strings.Compare(a.Key, b.Key) }
+	slices.SortFunc(diff.New, byKey)
+	slices.SortFunc(diff.Missing, byKey)
+	slices.SortFunc(diff.Changed, func(a, b Change) int {
+		if c := strings.Compare(a.Key, b.Key); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Field, b.Field)
+	})
+
+	return diff
+}
+
+// Store saves scan snapshots as JSON files in a directory
+type Store struct {
+	dir string
+}
+
+const snapshotTimeFormat = "20060102T150405Z"
+
+// NewStore creates a store in the passed in directory, creating it if necessary
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating scan store directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Save writes the passed in snapshot to the store
+func (s *Store) Save(snapshot *Snapshot) error {
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling snapshot: %w", err)
+	}
+
+	name := filepath.Join(s.dir, "scan-"+snapshot.Time.UTC().Format(snapshotTimeFormat)+".json")
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// List returns the times of all saved snapshots, oldest first
+func (s *Store) List() ([]time.Time, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "scan-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	times := []time.Time{}
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "scan-"), ".json")
+		t, err := time.Parse(snapshotTimeFormat, name)
+		if err == nil {
+			times = append(times, t)
+		}
+	}
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	return times, nil
+}
+
+// Load reads the snapshot taken at the passed in time
+func (s *Store) Load(t time.Time) (*Snapshot, error) {
+	name := filepath.Join(s.dir, "scan-"+t.UTC().Format(snapshotTimeFormat)+".json")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return nil, fmt.Errorf("error unmarshalling snapshot %q: %w", name, err)
+	}
+	return snapshot, nil
+}
+
+// Latest returns the most recent snapshot, or nil if there are none
+func (s *Store) Latest() (*Snapshot, error) {
+	times, err := s.List()
+	if err != nil || len(times) == 0 {
+		return nil, err
+	}
+	return s.Load(times[len(times)-1])
+}
@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"slices"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/onvif"
+)
+
+// StreamResolver works out the URL to open a stream of a camera each time it is opened. Devices hand out stream
+// URIs which may only be good for a single connection, for a while or until they reboot, so rather than reusing the
+// URI we probed, one is requested afresh from the device whenever ours can't be used again or failed to connect.
+// Credentials are passed however our RTSP strategies have found the camera wants them.
+type StreamResolver struct {
+	log   *slog.Logger
+	opts  Options
+	cred  Credential
+	token string
+
+	// the stream of a camera without ONVIF, or our own copy of the device as the stream URIs of its profiles change
+	// under us
+	uri    string
+	device *onvif.Device
+}
+
+// NewStreamResolver creates a resolver for the profile with the passed in token of the passed in probe result, the
+// first profile if the token is empty, or for its stream if it isn't an ONVIF device
+func NewStreamResolver(log *slog.Logger, result DeviceResult, token string, opts Options) (*StreamResolver, error) {
+	if result.Source != nil {
+		return NewURLResolver(log, result.Source.URL, result.Credential, opts), nil
+	}
+	if result.Device == nil || len(result.Device.Profiles) == 0 {
+		return nil, errors.New("device has no streams")
+	}
+
+	device := *result.Device
+	device.Profiles = slices.Clone(device.Profiles)
+	if token == "" {
+		token = device.Profiles[0].Token
+	}
+	return &StreamResolver{log: log, opts: opts, cred: result.Credential, token: token, device: &device}, nil
+}
+
+// NewURLResolver creates a resolver for a stream whose URI doesn't change, such as that of a camera configured by URL,
+// which may include its credentials rather than them being passed in
+func NewURLResolver(log *slog.Logger, uri string, cred Credential, opts Options) *StreamResolver {
+	if u, err := url.Parse(uri); err == nil && u.User != nil && cred.Username == "" {
+		cred.Username = u.User.Username()
+		cred.Password, _ = u.User.Password()
+	}
+	return &StreamResolver{log: log, opts: opts, cred: cred, uri: uri}
+}
+
+// Resolve returns the URL to open the stream with, including credentials. The passed in error is why the last URL
+// we returned stopped working, if it did, in which case its URI and how the camera wants credentials are forgotten
+// and worked out again.
+func (r *StreamResolver) Resolve(failed error) (*creds.URL, error) {
+	if failed != nil {
+		r.log.Debug("stream failed, resolving it again", slog.String("profile", r.token), slog.String("error", failed.Error()))
+		r.forget()
+	}
+
+	uri := r.uri
+	if r.device != nil {
+		var err error
+		if uri, err = r.device.StreamURI(r.log, r.token); err != nil {
+			return nil, err
+		}
+	}
+	return streamURL(r.log, uri, r.cred.Username, r.cred.Password, r.opts)
+}
+
+// forgets what we know about our stream, it is worked out again the next time it is resolved
+func (r *StreamResolver) forget() {
+	uri := r.uri
+	if r.device != nil {
+		for _, p := range r.device.Profiles {
+			if p.Token == r.token {
+				uri = p.URI
+			}
+		}
+		r.device.InvalidateStreamURI(r.token)
+	}
+
+	if u, err := url.Parse(uri); err == nil && r.opts.RTSPStrategies != nil {
+		r.opts.RTSPStrategies.Forget(u.Host)
+	}
+}
@@ -0,0 +1,262 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// Phase is whether a camera is set up for day or night
+type Phase string
+
+const (
+	PhaseDay   Phase = "day"
+	PhaseNight Phase = "night"
+)
+
+// DayNightMode is how we decide whether it is day or night
+type DayNightMode string
+
+const (
+	// use the gain the camera's auto exposure settles on where it reports one, falling back to the sun
+	DayNightAuto DayNightMode = "auto"
+
+	// use sunrise and sunset at the site
+	DayNightSun DayNightMode = "sun"
+
+	// leave it to the camera's own light sensor by putting its IR cut filter in AUTO
+	DayNightCamera DayNightMode = "camera"
+)
+
+// DayNight configures switching a camera between day and night
+type DayNight struct {
+	Mode DayNightMode `json:"mode"`
+
+	// where the camera is, and how far from sunrise and sunset the day starts and ends
+	Site          Site          `json:"site"`
+	SunriseOffset time.Duration `json:"sunrise_offset"`
+	SunsetOffset  time.Duration `json:"sunset_offset"`
+
+	// the gain, in dB, at or above which auto exposure means it is night and at or below which it is day again,
+	// readouts are only used once either is set and the gap between them stops us flapping as the IR comes on
+	NightGain float64 `json:"night_gain"`
+	DayGain   float64 `json:"day_gain"`
+
+	// the exposure modes, AUTO or MANUAL, to use by day and by night, left as is if empty
+	DayExposure   string `json:"day_exposure,omitempty"`
+	NightExposure string `json:"night_exposure,omitempty"`
+
+	// whether to focus once after each switch, for lenses which lose focus as the IR cut filter moves
+	Autofocus bool `json:"autofocus"`
+}
+
+// Validate checks that we have what our mode needs to decide between day and night
+func (c *DayNight) Validate() error {
+	switch c.Mode {
+	case DayNightAuto, DayNightSun:
+		hasSite := !c.Site.IsZero()
+		if err := c.Site.Validate(); err != nil {
+			return err
+		}
+		if c.Mode == DayNightSun && !hasSite {
+			return errors.New("sun mode requires a site latitude and longitude")
+		}
+		if c.Mode == DayNightAuto && !hasSite && !c.usesReadouts() {
+			return errors.New("auto mode requires night and day gains or a site latitude and longitude")
+		}
+		if c.usesReadouts() && c.DayGain >= c.NightGain {
+			return errors.New("day gain must be below night gain")
+		}
+		manual := strings.EqualFold(c.DayExposure, "MANUAL") || strings.EqualFold(c.NightExposure, "MANUAL")
+		if c.usesReadouts() && manual && !hasSite {
+			return errors.New("manual exposure has no gain readout so requires a site latitude and longitude")
+		}
+	case DayNightCamera:
+	default:
+		return fmt.Errorf("unknown day/night mode %q", c.Mode)
+	}
+	for _, mode := range []string{c.DayExposure, c.NightExposure} {
+		if mode != "" && !strings.EqualFold(mode, "AUTO") && !strings.EqualFold(mode, "MANUAL") {
+			return fmt.Errorf("invalid exposure mode %q", mode)
+		}
+	}
+	return nil
+}
+
+// whether we decide using the gain readout of the camera when it has one
+func (c *DayNight) usesReadouts() bool {
+	return c.Mode == DayNightAuto && (c.NightGain != 0 || c.DayGain != 0)
+}
+
+// SunPhase returns the phase at the passed in time going by the sun at our site
+func (c *DayNight) SunPhase(t time.Time) Phase {
+	if Daylight(t, c.Site.Latitude, c.Site.Longitude, c.SunriseOffset, c.SunsetOffset) {
+		return PhaseDay
+	}
+	return PhaseNight
+}
+
+// GainPhase returns the phase going by the passed in gain readout, staying in the current phase while the gain is
+// between our day and night gains
+func (c *DayNight) GainPhase(current Phase, gain float64) Phase {
+	if gain >= c.NightGain {
+		return PhaseNight
+	}
+	if gain <= c.DayGain {
+		return PhaseDay
+	}
+	if current == "" {
+		return PhaseDay
+	}
+	return current
+}
+
+// Settings returns the imaging settings for the passed in phase
+func (c *DayNight) Settings(phase Phase) *onvif.ImagingSettings {
+	settings := &onvif.ImagingSettings{IrCutFilter: "ON"}
+	exposure := c.DayExposure
+	if phase == PhaseNight {
+		settings.IrCutFilter = "OFF"
+		exposure = c.NightExposure
+	}
+	if c.Mode == DayNightCamera {
+		settings.IrCutFilter = "AUTO"
+	}
+	if exposure != "" {
+		settings.Exposure = &onvif.Exposure{Mode: strings.ToUpper(exposure)}
+	}
+	return settings
+}
+
+// DayNightController switches a camera between day and night settings
+type DayNightController struct {
+	log    *slog.Logger
+	device *onvif.Device
+	cfg    DayNight
+
+	// how often we check whether it has become day or night
+	Interval time.Duration
+
+	// if set, called whenever the camera is switched
+	OnSwitch func(Phase)
+
+	mu      sync.Mutex
+	phase   Phase
+	lastErr error
+}
+
+func NewDayNightController(log *slog.Logger, camera string, d *onvif.Device, cfg DayNight) (*DayNightController, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = DayNightAuto
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid day/night config for %q: %w", camera, err)
+	}
+	if len(d.Profiles) == 0 || d.Profiles[0].VideoSourceConfiguration.SourceToken == "" {
+		return nil, fmt.Errorf("device %q has no video source", camera)
+	}
+	return &DayNightController{
+		log:      log.With("subsystem", "daynight", "camera", camera),
+		device:   d,
+		cfg:      cfg,
+		Interval: time.Minute,
+	}, nil
+}
+
+// Status returns the phase the camera was last switched to and the error from the last attempt, if any
+func (c *DayNightController) Status() (Phase, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.phase, c.lastErr
+}
+
+// Run switches the camera between day and night until the passed in context is done, switches which fail are
+// retried on the next check
+func (c *DayNightController) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// works out the phase at the passed in time and switches the camera to it if it isn't there already
+func (c *DayNightController) check(now time.Time) {
+	sourceToken := c.device.Profiles[0].VideoSourceConfiguration.SourceToken
+
+	c.mu.Lock()
+	current, lastErr := c.phase, c.lastErr
+	c.mu.Unlock()
+
+	phase, err := c.decide(now, current, sourceToken)
+	if err != nil {
+		c.setStatus(current, err)
+		c.log.Error("error deciding between day and night", slog.String("error", err.Error()))
+		return
+	}
+	if phase == current && lastErr == nil {
+		return
+	}
+
+	c.log.Info("switching camera", slog.String("phase", string(phase)))
+	if err := Apply(c.log, c.device, Settings{Imaging: c.cfg.Settings(phase)}); err != nil {
+		c.setStatus(current, err)
+		c.log.Error("error switching camera", slog.String("phase", string(phase)), slog.String("error", err.Error()))
+		return
+	}
+	if c.cfg.Autofocus {
+		if err := c.device.Autofocus(c.log, sourceToken); err != nil {
+			c.log.Warn("error focusing camera after switch", slog.String("error", err.Error()))
+		}
+	}
+	c.setStatus(phase, nil)
+
+	if c.OnSwitch != nil && phase != current {
+		c.OnSwitch(phase)
+	}
+}
+
+// returns the phase at the passed in time, by the camera's gain readout if we use it and it has one, otherwise by
+// the sun. The camera decides for itself in camera mode so it is always day to us.
+func (c *DayNightController) decide(now time.Time, current Phase, sourceToken string) (Phase, error) {
+	if c.cfg.Mode == DayNightCamera {
+		return PhaseDay, nil
+	}
+
+	if c.cfg.usesReadouts() {
+		settings, err := c.device.GetImagingSettings(c.log, sourceToken)
+		if err != nil {
+			return "", err
+		}
+
+		// a gain only means something when the camera is choosing it
+		if e := settings.Exposure; e != nil && e.Gain != nil && strings.EqualFold(e.Mode, "AUTO") {
+			return c.cfg.GainPhase(current, *e.Gain), nil
+		}
+		if c.cfg.Site.IsZero() {
+			return "", errors.New("camera reports no auto exposure gain and no site is configured")
+		}
+	}
+	return c.cfg.SunPhase(now), nil
+}
+
+func (c *DayNightController) setStatus(phase Phase, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.phase, c.lastErr = phase, err
+}
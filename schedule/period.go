@@ -0,0 +1,168 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the minutes in a day
+const day = 24 * 60
+
+// Site is where cameras are, in degrees east and north positive, used to work out sunrise and sunset
+type Site struct {
+	Latitude  float64 `yaml:"latitude" json:"latitude"`
+	Longitude float64 `yaml:"longitude" json:"longitude"`
+}
+
+// Validate checks that the site is a place on earth
+func (s *Site) Validate() error {
+	if s.Latitude < -90 || s.Latitude > 90 || s.Longitude < -180 || s.Longitude > 180 {
+		return fmt.Errorf("invalid site %v,%v", s.Latitude, s.Longitude)
+	}
+	return nil
+}
+
+// IsZero returns whether the site hasn't been set
+func (s *Site) IsZero() bool {
+	return s == nil || (s.Latitude == 0 && s.Longitude == 0)
+}
+
+// Period is a time of day during which something applies, periods with an end before their start wrap past
+// midnight. Start and end are either a time in 15:04 form, in camera local time, or sunrise or sunset with an
+// optional offset such as sunset-30m or sunrise+1h, which need a site.
+//
+// Where the sun doesn't rise or set, sunrise and sunset are midnight and the minute before it through a polar day
+// and both noon through a polar night.
+type Period struct {
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+}
+
+// Validate checks that our start and end parse, and that we have a site if either depends on the sun
+func (p *Period) Validate(site *Site) error {
+	for _, s := range []string{p.Start, p.End} {
+		t, err := parseTime(s)
+		if err != nil {
+			return err
+		}
+		if t.sun != "" && site.IsZero() {
+			return fmt.Errorf("%s requires a site latitude and longitude", s)
+		}
+	}
+	return nil
+}
+
+// Contains returns whether the passed in time falls within this period at the passed in site
+func (p *Period) Contains(t time.Time, site *Site) bool {
+	start, err := parseTime(p.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseTime(p.End)
+	if err != nil {
+		return false
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	from, to := start.on(t, site), end.on(t, site)
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// Periods are the times of day something applies, which is all day if there are none
+type Periods []Period
+
+// Validate checks each of our periods
+func (ps Periods) Validate(site *Site) error {
+	for i := range ps {
+		if err := ps[i].Validate(site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contains returns whether the passed in time falls within any of our periods, always true if we have none
+func (ps Periods) Contains(t time.Time, site *Site) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	for i := range ps {
+		if ps[i].Contains(t, site) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeOfDay is a parsed period start or end, either minutes since midnight or an offset from sunrise or sunset
+type timeOfDay struct {
+	sun     string
+	minutes int
+	offset  time.Duration
+}
+
+// parses a time of day in 15:04 form or sunrise or sunset with an optional offset
+func parseTime(s string) (timeOfDay, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, sun := range []string{"sunrise", "sunset"} {
+		rest, found := strings.CutPrefix(s, sun)
+		if !found {
+			continue
+		}
+		t := timeOfDay{sun: sun}
+		if rest = strings.TrimSpace(rest); rest != "" {
+			if !strings.HasPrefix(rest, "+") && !strings.HasPrefix(rest, "-") {
+				return timeOfDay{}, fmt.Errorf("invalid time of day %q, expected an offset such as %s-30m", s, sun)
+			}
+			offset, err := time.ParseDuration(strings.ReplaceAll(rest, " ", ""))
+			if err != nil {
+				return timeOfDay{}, fmt.Errorf("invalid time of day %q: %w", s, err)
+			}
+			if offset.Abs() >= 24*time.Hour {
+				return timeOfDay{}, errors.New("sunrise and sunset offsets must be less than a day")
+			}
+			t.offset = offset
+		}
+		return t, nil
+	}
+
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return timeOfDay{}, fmt.Errorf("invalid time of day %q, expected 15:04, sunrise or sunset: %w", s, err)
+	}
+	return timeOfDay{minutes: parsed.Hour()*60 + parsed.Minute()}, nil
+}
+
+// returns the minutes since midnight this time of day falls at on the day of the passed in time at the passed in site
+func (t timeOfDay) on(date time.Time, site *Site) int {
+	if t.sun == "" {
+		return t.minutes
+	}
+	if site == nil {
+		site = &Site{}
+	}
+
+	var minutes int
+	sunrise, sunset, polarDay := SunTimes(date, site.Latitude, site.Longitude)
+	switch {
+	case !sunrise.IsZero() && t.sun == "sunrise":
+		minutes = sunrise.Hour()*60 + sunrise.Minute()
+	case !sunrise.IsZero():
+		minutes = sunset.Hour()*60 + sunset.Minute()
+	case polarDay && t.sun == "sunrise":
+		minutes = 0
+	case polarDay:
+		minutes = day - 1
+	default:
+		minutes = day / 2
+	}
+
+	// offsets past midnight wrap around, as a period from sunset+2h to sunrise would expect
+	minutes += int(t.offset / time.Minute)
+	return ((minutes % day) + day) % day
+}
@@ -0,0 +1,219 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/onvif"
+)
+
+// ErrNotApplied is returned when a camera accepts settings but reading them back shows they didn't take
+var ErrNotApplied = errors.New("settings not applied")
+
+// Settings are encoder and imaging settings applied to a camera together, nil settings are left unchanged
+type Settings struct {
+	// the profile whose encoder is changed, defaults to the first profile which is usually the main stream
+	Profile string `json:"profile,omitempty"`
+
+	Encoder *onvif.EncoderSettings `json:"encoder,omitempty"`
+	Imaging *onvif.ImagingSettings `json:"imaging,omitempty"`
+}
+
+// Window is a period of the day during which the named settings apply
+type Window struct {
+	Period
+	Settings string `json:"settings"`
+}
+
+// Schedule is the settings a camera should have by time of day
+type Schedule struct {
+	Camera   string              `json:"camera"`
+	Settings map[string]Settings `json:"settings"`
+	Windows  []Window            `json:"windows"`
+
+	// the settings used outside of any window, if empty the camera is left as is
+	Default string `json:"default,omitempty"`
+
+	// where the camera is, required if any window starts or ends relative to sunrise or sunset
+	Site *Site `json:"site,omitempty"`
+}
+
+// Validate checks that all our windows parse and refer to settings which exist
+func (s *Schedule) Validate() error {
+	if s.Default != "" {
+		if _, ok := s.Settings[s.Default]; !ok {
+			return fmt.Errorf("default settings %q not found", s.Default)
+		}
+	}
+	if s.Site != nil {
+		if err := s.Site.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, w := range s.Windows {
+		if err := w.Validate(s.Site); err != nil {
+			return err
+		}
+		if _, ok := s.Settings[w.Settings]; !ok {
+			return fmt.Errorf("settings %q for window %s-%s not found", w.Settings, w.Start, w.End)
+		}
+	}
+	return nil
+}
+
+// Active returns the name of the settings which apply at the passed in time, the first matching window wins
+func (s *Schedule) Active(t time.Time) string {
+	for _, w := range s.Windows {
+		if w.Contains(t, s.Site) {
+			return w.Settings
+		}
+	}
+	return s.Default
+}
+
+// Apply applies the passed in settings to a probed device then reads them back, returning ErrNotApplied listing
+// each setting the camera didn't take
+func Apply(log *slog.Logger, d *onvif.Device, settings Settings) error {
+	if len(d.Profiles) == 0 {
+		return fmt.Errorf("device has no profiles")
+	}
+	profile := &d.Profiles[0]
+	if settings.Profile != "" {
+		profile = nil
+		for i := range d.Profiles {
+			if d.Profiles[i].Token == settings.Profile {
+				profile = &d.Profiles[i]
+			}
+		}
+		if profile == nil {
+			return fmt.Errorf("no profile with token %q", settings.Profile)
+		}
+	}
+
+	diffs := []string{}
+	if settings.Encoder != nil {
+		if profile.VideoEncoderConfiguration == nil {
+			return fmt.Errorf("profile %q has no video encoder", profile.Token)
+		}
+		token := profile.VideoEncoderConfiguration.Token
+
+		current, err := d.GetVideoEncoderConfiguration(log, token)
+		if err != nil {
+			return err
+		}
+		if len(settings.Encoder.Diff(current)) > 0 {
+			if err := d.SetVideoEncoderConfiguration(log, profile.Token, settings.Encoder.ApplyTo(current)); err != nil {
+				return err
+			}
+			if current, err = d.GetVideoEncoderConfiguration(log, token); err != nil {
+				return err
+			}
+		}
+		profile.VideoEncoderConfiguration = current
+		diffs = append(diffs, settings.Encoder.Diff(current)...)
+	}
+
+	if settings.Imaging != nil {
+		sourceToken := profile.VideoSourceConfiguration.SourceToken
+		current, err := d.GetImagingSettings(log, sourceToken)
+		if err != nil {
+			return err
+		}
+		if len(settings.Imaging.Diff(current)) > 0 {
+			if err := d.SetImagingSettings(log, sourceToken, settings.Imaging); err != nil {
+				return err
+			}
+			if current, err = d.GetImagingSettings(log, sourceToken); err != nil {
+				return err
+			}
+		}
+		diffs = append(diffs, settings.Imaging.Diff(current)...)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotApplied, strings.Join(diffs, ", "))
+	}
+	return nil
+}
+
+// Scheduler keeps a camera's settings in line with its schedule
+type Scheduler struct {
+	log      *slog.Logger
+	device   *onvif.Device
+	schedule Schedule
+
+	// how often we check whether the active settings changed
+	Interval time.Duration
+
+	mu      sync.Mutex
+	applied string
+	lastErr error
+}
+
+func NewScheduler(log *slog.Logger, d *onvif.Device, schedule Schedule) (*Scheduler, error) {
+	if err := schedule.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid schedule for %q: %w", schedule.Camera, err)
+	}
+	return &Scheduler{
+		log:      log.With("subsystem", "schedule", "camera", schedule.Camera),
+		device:   d,
+		schedule: schedule,
+		Interval: time.Minute,
+	}, nil
+}
+
+// Status returns the name of the settings last successfully applied and the error from the last attempt, if any
+func (s *Scheduler) Status() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applied, s.lastErr
+}
+
+// Run applies the active settings whenever they change until the passed in context is done, settings which fail
+// to apply are retried on the next check
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.check(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applies the settings active at the passed in time if they aren't what we last applied
+func (s *Scheduler) check(now time.Time) {
+	active := s.schedule.Active(now)
+
+	s.mu.Lock()
+	current, lastErr := s.applied, s.lastErr
+	s.mu.Unlock()
+
+	if active == "" || (active == current && lastErr == nil) {
+		return
+	}
+
+	s.log.Info("applying scheduled settings", slog.String("settings", active))
+	err := Apply(s.log, s.device, s.schedule.Settings[active])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastErr = err
+	if err != nil {
+		s.log.Error("error applying scheduled settings", slog.String("settings", active), slog.String("error", err.Error()))
+		return
+	}
+	s.applied = active
+}
@@ -0,0 +1,69 @@
+package schedule
+
+import (
+	"math"
+	"time"
+)
+
+// julian day of the J2000 epoch and of the unix epoch
+const (
+	j2000     = 2451545.0
+	unixEpoch = 2440587.5
+)
+
+// SunTimes returns the sunrise and sunset on the day of the passed in time, in its location, at the passed in
+// latitude and longitude in degrees, east and north positive. During a polar day or night the sun never crosses the
+// horizon so both are zero and polarDay is whether the sun stays up.
+//
+// This is the sunrise equation as used by NOAA, good to a minute or so which is plenty for switching cameras.
+func SunTimes(day time.Time, latitude, longitude float64) (sunrise, sunset time.Time, polarDay bool) {
+	y, m, d := day.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	n := math.Round(toJulian(noon) - j2000 + 0.0008)
+
+	// mean solar noon, the sun's mean anomaly and center, and the ecliptic longitude
+	meanNoon := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*ecliptic)
+
+	// the declination of the sun, then its hour angle when its upper limb touches the horizon allowing for refraction
+	declination := math.Asin(sin(ecliptic) * sin(23.4397))
+	cosHour := (sin(-0.833) - sin(latitude)*math.Sin(declination)) / (cos(latitude) * math.Cos(declination))
+	if cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	if cosHour < -1 {
+		return time.Time{}, time.Time{}, true
+	}
+	hour := math.Acos(cosHour) * 180 / math.Pi
+
+	return fromJulian(transit - hour/360).In(day.Location()), fromJulian(transit + hour/360).In(day.Location()), false
+}
+
+// Daylight returns whether the sun is up at the passed in time at the passed in latitude and longitude, with the
+// day starting the passed in offset from sunrise and ending the passed in offset from sunset
+func Daylight(t time.Time, latitude, longitude float64, sunriseOffset, sunsetOffset time.Duration) bool {
+	sunrise, sunset, polarDay := SunTimes(t, latitude, longitude)
+	if sunrise.IsZero() {
+		return polarDay
+	}
+	return !t.Before(sunrise.Add(sunriseOffset)) && t.Before(sunset.Add(sunsetOffset))
+}
+
+func toJulian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + unixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-unixEpoch)*86400)), 0)
+}
+
+func sin(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cos(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
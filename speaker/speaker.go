@@ -0,0 +1,177 @@
+package speaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// ErrBusy is returned when asked to play audio through a camera which is already playing some
+var ErrBusy = errors.New("already playing audio")
+
+// PlayAction plays an audio file, such as a siren or recorded warning, through the speaker of a camera, it is the
+// action rules trigger to use a camera speaker
+type PlayAction struct {
+	Camera string `json:"camera"`
+	File   string `json:"file"`
+}
+
+type clipKey struct {
+	path   string
+	format string
+}
+
+// Player plays audio files through camera speakers using the ONVIF audio backchannel, files are encoded once and
+// then reused as the same clips tend to be played over and over
+type Player struct {
+	log     *slog.Logger
+	timeout time.Duration
+
+	mu    sync.Mutex
+	clips map[clipKey][]byte
+
+	// only one clip can play through a camera at a time
+	playing map[string]bool
+}
+
+func NewPlayer(log *slog.Logger, timeout time.Duration) *Player {
+	return &Player{
+		log:     log.With("subsystem", "speaker"),
+		timeout: timeout,
+		clips:   make(map[clipKey][]byte),
+		playing: make(map[string]bool),
+	}
+}
+
+// Play plays the audio file at the passed in path through the speaker of the camera with the passed in stream URL,
+// returning once it has finished playing
+func (p *Player) Play(ctx context.Context, streamURL *creds.URL, path string) error {
+	host := streamURL.Host()
+	if err := p.acquire(host); err != nil {
+		return err
+	}
+	defer p.release(host)
+
+	backchannel, err := rtsp.OpenBackchannel(streamURL.Secret(), p.timeout)
+	if err != nil {
+		return fmt.Errorf("error opening audio backchannel on %q: %w", host, err)
+	}
+	defer backchannel.Close()
+
+	format := ffmpeg.FormatMulaw
+	if backchannel.PayloadType == rtsp.PayloadPCMA {
+		format = ffmpeg.FormatAlaw
+	}
+
+	audio, err := p.clip(ctx, path, format)
+	if err != nil {
+		return err
+	}
+
+	p.log.Info("playing audio", slog.String("host", host), slog.String("file", path), slog.Duration("duration", rtsp.AudioDuration(audio)))
+	if err := backchannel.Play(ctx, audio); err != nil {
+		return fmt.Errorf("error playing audio on %q: %w", host, err)
+	}
+	return nil
+}
+
+// TalkFormat is the format of live audio sent for talkback
+type TalkFormat struct {
+	// the ffmpeg name of a raw format, such as s16le, mulaw or alaw, empty for audio in a container such as WebM or
+	// Ogg which ffmpeg recognizes itself
+	Name string
+
+	// the sample rate and channels of raw audio
+	SampleRate int
+	Channels   int
+}
+
+// Talk plays live audio read from the passed in reader through the speaker of the camera with the passed in stream
+// URL as it arrives, such as from the microphone of a doorbell app, returning once the reader is exhausted. Audio
+// the camera can't take as is is transcoded on the fly.
+func (p *Player) Talk(ctx context.Context, streamURL *creds.URL, audio io.Reader, format TalkFormat) error {
+	host := streamURL.Host()
+	if err := p.acquire(host); err != nil {
+		return err
+	}
+	defer p.release(host)
+
+	backchannel, err := rtsp.OpenBackchannel(streamURL.Secret(), p.timeout)
+	if err != nil {
+		return fmt.Errorf("error opening audio backchannel on %q: %w", host, err)
+	}
+	defer backchannel.Close()
+
+	law := ffmpeg.FormatMulaw
+	if backchannel.PayloadType == rtsp.PayloadPCMA {
+		law = ffmpeg.FormatAlaw
+	}
+
+	p.log.Info("talking", slog.String("host", host), slog.String("format", format.Name))
+	if format.Name == law && format.SampleRate == 8000 && format.Channels == 1 {
+		if err := backchannel.Stream(ctx, audio); err != nil {
+			return fmt.Errorf("error talking on %q: %w", host, err)
+		}
+		return nil
+	}
+
+	transcoded, err := ffmpeg.StreamG711(ctx, audio, format.Name, format.SampleRate, format.Channels, law)
+	if err != nil {
+		return err
+	}
+	if err := backchannel.Stream(ctx, transcoded); err != nil {
+		transcoded.Close()
+		return fmt.Errorf("error talking on %q: %w", host, err)
+	}
+	return transcoded.Wait()
+}
+
+// marks the camera at the passed in host as playing, failing if it already is as only one clip or talker can use
+// its speaker at a time
+func (p *Player) acquire(host string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing[host] {
+		return fmt.Errorf("%w on %q", ErrBusy, host)
+	}
+	p.playing[host] = true
+	return nil
+}
+
+func (p *Player) release(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.playing, host)
+}
+
+// returns the passed in file encoded in the passed in format, encoding it if we haven't already
+func (p *Player) clip(ctx context.Context, path string, format string) ([]byte, error) {
+	key := clipKey{path: path, format: format}
+
+	p.mu.Lock()
+	audio, found := p.clips[key]
+	p.mu.Unlock()
+	if found {
+		return audio, nil
+	}
+
+	audio, err := ffmpeg.EncodeG711(ctx, path, format)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.clips[key] = audio
+	p.mu.Unlock()
+	return audio, nil
+}
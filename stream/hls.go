@@ -0,0 +1,362 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/media"
+	"github.com/incrementventures/govr/rtsp"
+	"github.com/incrementventures/govr/supervisor"
+)
+
+// the playlist players load, segments and the init segment are referenced relative to it
+const playlistName = "index.m3u8"
+
+// ErrUnknownCamera is returned by a Resolver for cameras it doesn't know about
+var ErrUnknownCamera = errors.New("unknown camera")
+
+// Resolver returns the stream URL, including credentials, for the passed in camera
+type Resolver func(camera string) (*creds.URL, error)
+
+// HLSConfig configures live HLS output
+type HLSConfig struct {
+	// the directory each camera's playlist and segments are written to while it is being watched
+	Dir string
+
+	// the target duration of each segment and how many are kept in the playlist, short segments mean lower latency
+	SegmentDuration time.Duration
+	ListSize        int
+
+	// how long a camera is restreamed for after its last request
+	IdleTimeout time.Duration
+
+	// how long a request for a playlist waits for a stream which is just starting
+	StartTimeout time.Duration
+
+	// the ffmpeg binary to use, defaults to ffmpeg on our path
+	FFmpegPath string
+
+	// if set, cameras streaming H.265, which most browsers can't play, are transcoded to H.264 with it
+	Transcoder *ffmpeg.Transcoder
+
+	// whether to package H.264 and H.265 video as HLS ourselves rather than with ffmpeg, which uses far less CPU per
+	// camera but leaves out any audio, cameras we can't package falling back to ffmpeg
+	Native bool
+}
+
+// HLS restreams cameras as HLS with fMP4 segments, starting ffmpeg for a camera when it is first requested and
+// stopping it once it hasn't been requested for a while
+type HLS struct {
+	log     *slog.Logger
+	cfg     HLSConfig
+	resolve Resolver
+
+	// if set, each camera's stream runs under it so that a panic restarts only that stream
+	Supervisor *supervisor.Supervisor
+
+	mu      sync.Mutex
+	streams map[string]*hlsStream
+}
+
+type hlsStream struct {
+	camera   string
+	dir      string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	lastUsed time.Time
+	err      error
+}
+
+func NewHLS(log *slog.Logger, cfg HLSConfig, resolve Resolver) *HLS {
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = time.Second
+	}
+	if cfg.ListSize <= 0 {
+		cfg.ListSize = 6
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30 * time.Second
+	}
+	if cfg.StartTimeout <= 0 {
+		cfg.StartTimeout = 10 * time.Second
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	return &HLS{log: log.With("subsystem", "hls"), cfg: cfg, resolve: resolve, streams: make(map[string]*hlsStream)}
+}
+
+// Camera returns the camera an HLS request is for, suitable for use with auth.RequireStreamToken
+func Camera(r *http.Request) string {
+	camera, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return camera
+}
+
+// ServeHTTP serves /<camera>/index.m3u8 and the segments it references, mount it with http.StripPrefix
+func (h *HLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	camera, file, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !found || camera == "" || file == "" || strings.ContainsAny(file, `/\`) || strings.HasPrefix(camera, ".") || strings.HasPrefix(file, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	s, err := h.stream(camera)
+	if errors.Is(err, ErrUnknownCamera) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	path := filepath.Join(s.dir, file)
+	if file == playlistName {
+		if err := h.waitForPlaylist(r.Context(), s); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch filepath.Ext(file) {
+	case ".m3u8":
+		// players resolve segments relative to the playlist without its query, so carry it over, it holds our token
+		b = propagateQuery(b, r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// Run stops streams which haven't been requested for our idle timeout until the passed in context is done, at which
+// point every stream is stopped
+func (h *HLS) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.stopIdle(time.Time{})
+			return
+		case now := <-ticker.C:
+			h.stopIdle(now.Add(-h.cfg.IdleTimeout))
+		}
+	}
+}
+
+// stops every stream last used before the passed in time, all of them if it is zero
+func (h *HLS) stopIdle(before time.Time) {
+	h.mu.Lock()
+	idle := []*hlsStream{}
+	for camera, s := range h.streams {
+		if before.IsZero() || s.lastUsed.Before(before) {
+			idle = append(idle, s)
+			delete(h.streams, camera)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range idle {
+		h.log.Info("stopping idle hls stream", slog.String("camera", s.camera))
+		s.cancel()
+		<-s.done
+		os.RemoveAll(s.dir)
+	}
+}
+
+// returns the running stream for the passed in camera, starting it if needed
+func (h *HLS) stream(camera string) (*hlsStream, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, found := h.streams[camera]; found {
+		select {
+		case <-s.done:
+			// ffmpeg exited, so report why once and start afresh on the next request
+			delete(h.streams, camera)
+			os.RemoveAll(s.dir)
+			return nil, fmt.Errorf("stream failed: %w", s.err)
+		default:
+			s.lastUsed = time.Now()
+			return s, nil
+		}
+	}
+
+	url, err := h.resolve(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(h.cfg.Dir, camera)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating hls directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &hlsStream{camera: camera, dir: dir, cancel: cancel, done: make(chan struct{}), lastUsed: time.Now()}
+	h.streams[camera] = s
+
+	h.log.Info("starting hls stream", slog.String("camera", camera), slog.Any("url", url))
+	go func() {
+		defer close(s.done)
+		if h.Supervisor == nil {
+			s.err = h.run(ctx, url, dir)
+			return
+		}
+
+		// a stream which fails is reported to the next request rather than restarted, only panics are restarted
+		h.Supervisor.Run(ctx, "hls:"+camera, func(ctx context.Context) error {
+			s.err = h.run(ctx, url, dir)
+			return nil
+		})
+	}()
+	return s, nil
+}
+
+// writes HLS to the passed in directory until the stream fails or the context is done, packaging it ourselves if
+// configured to and able, otherwise with ffmpeg
+func (h *HLS) run(ctx context.Context, url *creds.URL, dir string) error {
+	if h.cfg.Native {
+		err := h.runNative(ctx, url, dir)
+		if !errors.Is(err, errNotNative) {
+			return err
+		}
+	}
+	return h.runFFmpeg(ctx, url, dir)
+}
+
+// runs ffmpeg writing HLS to the passed in directory until it exits or the context is done
+func (h *HLS) runFFmpeg(ctx context.Context, url *creds.URL, dir string) error {
+	accel, input, video := h.videoArgs(ctx, url)
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, input...)
+	args = append(args, "-rtsp_transport", "tcp", "-i", url.Secret(), "-map", "0:v", "-map", "0:a?")
+	args = append(args, video...)
+	args = append(args,
+		"-c:a", "aac",
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(h.cfg.SegmentDuration.Seconds(), 'f', -1, 64),
+		"-hls_list_size", strconv.Itoa(h.cfg.ListSize),
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(dir, "segment%d.m4s"),
+		"-hls_flags", "delete_segments+independent_segments+omit_endlist+temp_file",
+		filepath.Join(dir, playlistName),
+	)
+
+	// each stream is run once, the next request for it after it fails starting it again
+	process := ffmpeg.NewProcess(h.log, ffmpeg.ProcessConfig{FFmpegPath: h.cfg.FFmpegPath, Args: func() []string { return args }})
+	if err := process.RunOnce(ctx); err != nil && ctx.Err() == nil {
+		// and without the encoder which failed
+		if accel != "" {
+			h.cfg.Transcoder.Failed(accel)
+		}
+		return err
+	}
+	return nil
+}
+
+// returns the arguments which have ffmpeg copy the video of the stream at the passed in URL, or if it is H.265 and
+// we have a transcoder, transcode it to H.264 along with the encoder used, those before the input and those after
+func (h *HLS) videoArgs(ctx context.Context, url *creds.URL) (ffmpeg.Accel, []string, []string) {
+	copyVideo := []string{"-c:v", "copy"}
+	if h.cfg.Transcoder == nil {
+		return "", nil, copyVideo
+	}
+	streams, err := rtsp.ProbeStreams(url.Secret(), h.cfg.StartTimeout)
+	i := slices.IndexFunc(streams, func(s media.StreamInfo) bool { return s.IsVideo() })
+	if err != nil || i < 0 || streams[i].CodecName != ffmpeg.CodecH265 {
+		return "", nil, copyVideo
+	}
+
+	// a keyframe starts every segment so that playback can start from any of them
+	fps := streams[i].FPS()
+	if fps == 0 {
+		fps = 25
+	}
+	video := ffmpeg.Video{Codec: ffmpeg.CodecH264, GOP: max(int(h.cfg.SegmentDuration.Seconds()*fps), 1)}
+
+	// without a decoder we can only pass the stream on as it is, for players which can play it
+	if host, err := ffmpeg.ProbeHost(ctx, h.cfg.FFmpegPath); err == nil {
+		if err := host.RequireDecoder(ffmpeg.CodecH265); err != nil {
+			h.log.Warn("unable to transcode stream", slog.String("error", err.Error()))
+			return "", nil, copyVideo
+		}
+	}
+	accel := h.cfg.Transcoder.Select(ctx, video.Codec)
+	input, output := h.cfg.Transcoder.Args(accel, video)
+	return accel, input, output
+}
+
+// waits for the playlist of the passed in stream to be written
+func (h *HLS) waitForPlaylist(ctx context.Context, s *hlsStream) error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.StartTimeout)
+	defer cancel()
+
+	path := filepath.Join(s.dir, playlistName)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-s.done:
+			return fmt.Errorf("stream failed: %w", s.err)
+		case <-ctx.Done():
+			return errors.New("timed out waiting for stream to start")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+var uriAttr = regexp.MustCompile(`URI="([^"?]*)"`)
+
+// appends the passed in query to each URI in the passed in playlist
+func propagateQuery(playlist []byte, query string) []byte {
+	if query == "" {
+		return playlist
+	}
+
+	out := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+			line = uriAttr.ReplaceAllString(line, `URI="${1}?`+query+`"`)
+		case strings.TrimSpace(line) != "" && !strings.Contains(line, "?"):
+			line += "?" + query
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/fmp4"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// errNotNative is returned for streams we can't package as HLS ourselves, which are left to ffmpeg
+var errNotNative = errors.New("stream can't be packaged natively")
+
+// packages the video of the stream at the passed in URL as HLS in the passed in directory ourselves, with no ffmpeg
+// between the camera and its viewers, until the context is done or the stream fails
+func (h *HLS) runNative(ctx context.Context, url *creds.URL, dir string) error {
+	frames, err := rtsp.OpenFrames(url.Secret(), h.cfg.StartTimeout)
+	if errors.Is(err, rtsp.ErrNoVideo) {
+		return errNotNative
+	}
+	if err != nil {
+		return err
+	}
+	defer frames.Close()
+
+	// H.265 is transcoded for the browsers which can't play it if we can, which takes ffmpeg
+	if frames.Encoding() == "H265" && h.cfg.Transcoder != nil {
+		return errNotNative
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- frames.Run(ctx) }()
+
+	playlist := &hlsPlaylist{dir: dir, size: h.cfg.ListSize}
+	var muxer *fmp4.Muxer
+	for unit := range frames.Frames() {
+		// keyframes carry the parameter sets the init segment needs, whether from the SDP or the stream itself
+		if muxer == nil {
+			if !unit.Keyframe {
+				continue
+			}
+			if muxer, err = fmp4.NewMuxer(fmp4.VideoTrack{Encoding: frames.Encoding(), ParameterSets: unit.NALUs}, nil, h.cfg.SegmentDuration); err != nil {
+				return err
+			}
+			if err := writeAtomic(filepath.Join(dir, "init.mp4"), muxer.Init()); err != nil {
+				return err
+			}
+		}
+
+		if segment := muxer.WriteVideo(unit); segment != nil {
+			if err := playlist.add(segment); err != nil {
+				return err
+			}
+		}
+	}
+	return <-done
+}
+
+// hlsPlaylist is the live playlist of a stream we package ourselves, along with the segments it lists
+type hlsPlaylist struct {
+	dir  string
+	size int
+
+	segments []*fmp4.Segment
+}
+
+// writes the passed in segment and adds it to the playlist, removing the oldest once we have more than we keep
+func (p *hlsPlaylist) add(segment *fmp4.Segment) error {
+	if err := writeAtomic(filepath.Join(p.dir, segmentName(segment)), segment.Data); err != nil {
+		return err
+	}
+	p.segments = append(p.segments, segment)
+	for len(p.segments) > p.size {
+		os.Remove(filepath.Join(p.dir, segmentName(p.segments[0])))
+		p.segments = p.segments[1:]
+	}
+
+	target := 1
+	for _, s := range p.segments {
+		target = max(target, int(math.Ceil(s.Duration.Seconds())))
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", target, p.segments[0].Sequence)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for _, s := range p.segments {
+		fmt.Fprintf(b, "#EXTINF:%.6f,\n%s\n", s.Duration.Seconds(), segmentName(s))
+	}
+	return writeAtomic(filepath.Join(p.dir, playlistName), []byte(b.String()))
+}
+
+// returns the file name of the passed in segment, named as ffmpeg names them
+func segmentName(s *fmp4.Segment) string {
+	return fmt.Sprintf("segment%d.m4s", s.Sequence)
+}
+
+// writes the passed in file via a temporary one so that it is never served half written
+func writeAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package stream
+
+import (
+	"github.com/incrementventures/govr/metrics"
+)
+
+// bitrate and frame rate are the rate of these counters, labelled by camera and the output restreaming it
+var (
+	streamBytes   = metrics.NewCounter("govr_stream_bytes_total", "Bytes of RTP read from each camera.", "camera", "output")
+	streamFrames  = metrics.NewCounter("govr_stream_frames_total", "Video frames read from each camera.", "camera", "output")
+	streamDropped = metrics.NewCounter("govr_stream_dropped_packets_total", "Packets which couldn't be sent to a client, usually because it couldn't keep up.", "camera", "output")
+)
@@ -0,0 +1,494 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// how long we tell clients their sessions last without a keepalive, we give them twice that before disconnecting
+const rtspSessionTimeout = 60 * time.Second
+
+// RTSPConfig configures the RTSP restreaming server
+type RTSPConfig struct {
+	// the address we listen on, defaults to :8554
+	Addr string
+
+	// how long we wait on a camera to start playing and then between its packets
+	ReadTimeout time.Duration
+
+	// how many packets are queued for each client before we start dropping them, so a slow client can't hold up the
+	// camera for everyone else
+	ClientBuffer int
+
+	// checks a client may view the passed in camera with the token in the query of its request URL, any client may
+	// view any camera if nil
+	Authorize func(camera string, token string) error
+}
+
+// RTSPServer republishes cameras on rtsp://<addr>/<camera>, each camera is played once no matter how many clients are
+// viewing it, starting when its first client connects and stopping when its last one leaves, as many cameras only
+// allow a handful of connections. Only interleaved TCP transport is offered to clients.
+type RTSPServer struct {
+	log     *slog.Logger
+	cfg     RTSPConfig
+	resolve Resolver
+
+	mu        sync.Mutex
+	upstreams map[string]*rtspUpstream
+}
+
+// a camera being played to one or more clients, mapped to whether each client is playing
+type rtspUpstream struct {
+	camera   string
+	playback *rtsp.Playback
+	clients  map[*rtspClient]bool
+	stopped  bool
+}
+
+// a connected client, a client views a single camera
+type rtspClient struct {
+	conn       net.Conn
+	addr       string
+	session    string
+	upstream   *rtspUpstream
+	authorized map[string]bool
+
+	// camera channels mapped to the interleaved channels the client asked for, guarded by the server lock
+	channels map[int]int
+
+	writeMu sync.Mutex
+	packets chan []byte
+	done    chan struct{}
+	writing bool
+	dropped int
+}
+
+func NewRTSPServer(log *slog.Logger, cfg RTSPConfig, resolve Resolver) *RTSPServer {
+	if cfg.Addr == "" {
+		cfg.Addr = ":8554"
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 10 * time.Second
+	}
+	if cfg.ClientBuffer <= 0 {
+		cfg.ClientBuffer = 512
+	}
+	return &RTSPServer{log: log.With("subsystem", "rtsp_server"), cfg: cfg, resolve: resolve, upstreams: make(map[string]*rtspUpstream)}
+}
+
+// Run listens on our address and serves clients until the passed in context is done, at which point every camera
+// is stopped and every client disconnected
+func (s *RTSPServer) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.cfg.Addr, err)
+	}
+	s.log.Info("rtsp server listening", slog.String("addr", listener.Addr().String()))
+
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, conn)
+		}()
+	}
+}
+
+// reads and handles requests from the passed in connection until it is closed or torn down
+func (s *RTSPServer) serve(ctx context.Context, conn net.Conn) {
+	c := &rtspClient{
+		conn:       conn,
+		addr:       conn.RemoteAddr().String(),
+		authorized: make(map[string]bool),
+		channels:   make(map[int]int),
+		packets:    make(chan []byte, s.cfg.ClientBuffer),
+		done:       make(chan struct{}),
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		stop()
+		close(c.done)
+		conn.Close()
+		s.detach(c)
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(2 * rtspSessionTimeout)); err != nil {
+			return
+		}
+
+		b, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+
+		// clients send RTCP receiver reports interleaved with their requests, we have no use for them
+		if b[0] == '$' {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				return
+			}
+			if _, err := reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+
+		req, err := rtsp.ReadRequest(reader)
+		if err != nil {
+			s.log.Debug("error reading rtsp request", slog.String("client", c.addr), slog.Any("error", err))
+			return
+		}
+		if !s.handle(c, req) {
+			return
+		}
+	}
+}
+
+// handles a single request from the passed in client, returning whether its connection should stay open
+func (s *RTSPServer) handle(c *rtspClient, req *rtsp.Request) bool {
+	camera, track := parseRTSPPath(req.URL.Path)
+	session := map[string]string{}
+	if c.session != "" {
+		session["Session"] = c.session + ";timeout=" + strconv.Itoa(int(rtspSessionTimeout.Seconds()))
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		c.respond(req, 200, "OK", map[string]string{"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, SET_PARAMETER"}, nil)
+
+	case "DESCRIBE":
+		up, ok := s.attachFor(c, req, camera)
+		if !ok {
+			return true
+		}
+		headers := map[string]string{"Content-Type": "application/sdp", "Content-Base": contentBase(req.URL)}
+		c.respond(req, 200, "OK", headers, []byte(rtsp.RewriteControls(up.playback.SDP)))
+
+	case "SETUP":
+		up, ok := s.attachFor(c, req, camera)
+		if !ok {
+			return true
+		}
+		if track < 0 || track >= len(up.playback.Media) {
+			c.respond(req, 404, "Not Found", nil, nil)
+			return true
+		}
+
+		params := rtsp.ParseTransport(req.Header.Get("Transport"))
+		if !strings.Contains(params[""], "TCP") {
+			c.respond(req, 461, "Unsupported Transport", nil, nil)
+			return true
+		}
+		rtpChannel, rtcpChannel := 2*track, 2*track+1
+		if interleaved, found := params["interleaved"]; found {
+			first, second, _ := strings.Cut(interleaved, "-")
+			rtpChannel, _ = strconv.Atoi(first)
+			rtcpChannel = rtpChannel + 1
+			if second != "" {
+				rtcpChannel, _ = strconv.Atoi(second)
+			}
+		}
+
+		s.mu.Lock()
+		c.channels[2*track], c.channels[2*track+1] = rtpChannel, rtcpChannel
+		s.mu.Unlock()
+
+		if c.session == "" {
+			c.session = strings.ReplaceAll(uuid.NewString(), "-", "")
+			session["Session"] = c.session + ";timeout=" + strconv.Itoa(int(rtspSessionTimeout.Seconds()))
+		}
+		session["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", rtpChannel, rtcpChannel)
+		c.respond(req, 200, "OK", session, nil)
+
+	case "PLAY":
+		if c.session == "" || c.upstream == nil {
+			c.respond(req, 455, "Method Not Valid in This State", nil, nil)
+			return true
+		}
+		session["Range"] = "npt=0.000-"
+		c.respond(req, 200, "OK", session, nil)
+		s.play(c)
+
+	case "TEARDOWN":
+		c.respond(req, 200, "OK", session, nil)
+		return false
+
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// used by clients as keepalives
+		c.respond(req, 200, "OK", session, nil)
+
+	default:
+		c.respond(req, 501, "Not Implemented", nil, nil)
+	}
+	return true
+}
+
+// attaches the passed in client to the camera it is requesting, responding with an error if it can't be
+func (s *RTSPServer) attachFor(c *rtspClient, req *rtsp.Request, camera string) (*rtspUpstream, bool) {
+	if camera == "" {
+		c.respond(req, 404, "Not Found", nil, nil)
+		return nil, false
+	}
+
+	if s.cfg.Authorize != nil && !c.authorized[camera] {
+		if err := s.cfg.Authorize(camera, req.URL.Query().Get("token")); err != nil {
+			c.respond(req, 401, "Unauthorized", nil, nil)
+			return nil, false
+		}
+		c.authorized[camera] = true
+	}
+
+	if c.upstream != nil {
+		if c.upstream.camera != camera {
+			c.respond(req, 459, "Aggregate Operation Not Allowed", nil, nil)
+			return nil, false
+		}
+		return c.upstream, true
+	}
+
+	up, err := s.attach(c, camera)
+	if errors.Is(err, ErrUnknownCamera) {
+		c.respond(req, 404, "Not Found", nil, nil)
+		return nil, false
+	}
+	if err != nil {
+		s.log.Error("error starting rtsp restream", slog.String("camera", camera), slog.Any("error", err))
+		c.respond(req, 502, "Bad Gateway", nil, nil)
+		return nil, false
+	}
+	return up, true
+}
+
+// attaches the passed in client to the upstream for the passed in camera, starting it if needed
+func (s *RTSPServer) attach(c *rtspClient, camera string) (*rtspUpstream, error) {
+	s.mu.Lock()
+	if up, found := s.upstreams[camera]; found {
+		up.clients[c] = false
+		c.upstream = up
+		s.mu.Unlock()
+		return up, nil
+	}
+	s.mu.Unlock()
+
+	url, err := s.resolve(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	// cameras can take a while to start playing so we don't hold our lock while they do
+	s.log.Info("starting rtsp restream", slog.String("camera", camera), slog.Any("url", url))
+	playback, err := rtsp.OpenPlayback(url.Secret(), s.cfg.ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// another client may have started this camera while we were, if so use theirs
+	up, found := s.upstreams[camera]
+	if found {
+		playback.Close()
+	} else {
+		up = &rtspUpstream{camera: camera, playback: playback, clients: make(map[*rtspClient]bool)}
+		s.upstreams[camera] = up
+		go s.forward(up)
+	}
+	up.clients[c] = false
+	c.upstream = up
+	return up, nil
+}
+
+// starts sending packets to the passed in client
+func (s *RTSPServer) play(c *rtspClient) {
+	s.mu.Lock()
+	if _, found := c.upstream.clients[c]; found {
+		c.upstream.clients[c] = true
+	}
+	writing := c.writing
+	c.writing = true
+	s.mu.Unlock()
+
+	if !writing {
+		go c.writePackets()
+	}
+}
+
+// detaches the passed in client from its upstream, stopping the upstream if it was the last client
+func (s *RTSPServer) detach(c *rtspClient) {
+	s.mu.Lock()
+	up := c.upstream
+	if up == nil {
+		s.mu.Unlock()
+		return
+	}
+	delete(up.clients, c)
+	last := len(up.clients) == 0 && !up.stopped
+	if last {
+		up.stopped = true
+		delete(s.upstreams, up.camera)
+	}
+	dropped := c.dropped
+	s.mu.Unlock()
+
+	s.log.Debug("rtsp client disconnected", slog.String("camera", up.camera), slog.String("client", c.addr), slog.Int("dropped", dropped))
+	if last {
+		s.log.Info("stopping rtsp restream", slog.String("camera", up.camera))
+		up.playback.Close()
+	}
+}
+
+// reads packets from the passed in upstream and queues them for each of its playing clients until it is stopped or
+// fails, in which case its clients are disconnected
+func (s *RTSPServer) forward(up *rtspUpstream) {
+	bytes, frames, dropped := streamBytes.With(up.camera, "rtsp"), streamFrames.With(up.camera, "rtsp"), streamDropped.With(up.camera, "rtsp")
+
+	for {
+		channel, payload, err := up.playback.ReadPacket()
+		if err != nil {
+			s.mu.Lock()
+			stopped := up.stopped
+			up.stopped = true
+			if !stopped {
+				delete(s.upstreams, up.camera)
+			}
+			clients := make([]*rtspClient, 0, len(up.clients))
+			for c := range up.clients {
+				clients = append(clients, c)
+			}
+			s.mu.Unlock()
+
+			if !stopped {
+				s.log.Error("rtsp restream failed", slog.String("camera", up.camera), slog.Any("error", err))
+				up.playback.Close()
+				for _, c := range clients {
+					c.conn.Close()
+				}
+			}
+			return
+		}
+
+		// even channels carry RTP, the marker bit of video RTP is set on the last packet of each frame
+		if channel%2 == 0 && len(payload) >= 2 {
+			bytes.Add(float64(len(payload)))
+			if m := channel / 2; m < len(up.playback.Media) && up.playback.Media[m].Type == "video" && payload[1]&0x80 != 0 {
+				frames.Inc()
+			}
+		}
+
+		s.mu.Lock()
+		for c, playing := range up.clients {
+			clientChannel, found := c.channels[channel]
+			if !playing || !found {
+				continue
+			}
+
+			frame := make([]byte, 4, 4+len(payload))
+			frame[0], frame[1] = '$', byte(clientChannel)
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+			frame = append(frame, payload...)
+
+			select {
+			case c.packets <- frame:
+			default:
+				c.dropped++
+				dropped.Inc()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writes queued packets to this client until it disconnects
+func (c *rtspClient) writePackets() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.packets:
+			if err := c.write(frame); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// writes a response to the passed in request to this client, errors are seen by our read loop as the connection
+// is closed
+func (c *rtspClient) respond(req *rtsp.Request, code int, status string, headers map[string]string, body []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(rtspSessionTimeout))
+	if err := rtsp.WriteResponse(c.conn, req, code, status, headers, body); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *rtspClient) write(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(rtspSessionTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// returns the camera and track index of the passed in request path, like /cam1/trackID=0, the track is -1 if the path
+// doesn't have one
+func parseRTSPPath(path string) (string, int) {
+	camera, rest, _ := strings.Cut(strings.Trim(path, "/"), "/")
+	if id, found := strings.CutPrefix(rest, "trackID="); found {
+		if track, err := strconv.Atoi(id); err == nil {
+			return camera, track
+		}
+	}
+	return camera, -1
+}
+
+// returns the base our track controls are resolved against for the passed in request URL, this leaves out any query
+// as clients append controls to it as is
+func contentBase(u *url.URL) string {
+	base := *u
+	base.RawQuery = ""
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return base.String()
+}
@@ -0,0 +1,348 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/incrementventures/govr/creds"
+	"github.com/incrementventures/govr/ffmpeg"
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// the boundary between the images of a Motion JPEG response
+const mjpegBoundary = "govrsnapshot"
+
+// SnapshotConfig configures live snapshots
+type SnapshotConfig struct {
+	// how often the snapshot of a camera being watched is refreshed, for H.264 and H.265 at its first keyframe after
+	Interval time.Duration
+
+	// how long a camera is read for after its last request
+	IdleTimeout time.Duration
+
+	// how long a request waits for the first snapshot of a camera which is just starting
+	StartTimeout time.Duration
+
+	// the quality keyframes are decoded at, from 2, the best, to 31
+	Quality int
+
+	// the ffmpeg binary keyframes are decoded with, defaults to ffmpeg on our path
+	FFmpegPath string
+}
+
+// Snapshots serves the latest picture of each camera as a JPEG, so that dashboards can show low rate previews without
+// a video player. A camera's stream is read while it is being requested, Motion JPEG frames being passed on as they
+// are and H.264 or H.265 keyframes being decoded with ffmpeg at most once per interval.
+type Snapshots struct {
+	log     *slog.Logger
+	cfg     SnapshotConfig
+	resolve Resolver
+
+	mu      sync.Mutex
+	cameras map[string]*liveSnapshot
+}
+
+type liveSnapshot struct {
+	camera   string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	lastUsed time.Time
+	err      error
+
+	// the latest snapshot and when it was taken, updated being closed and replaced each time there is a new one
+	mu      sync.Mutex
+	jpeg    []byte
+	taken   time.Time
+	updated chan struct{}
+}
+
+func NewSnapshots(log *slog.Logger, cfg SnapshotConfig, resolve Resolver) *Snapshots {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 2 * time.Second
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30 * time.Second
+	}
+	if cfg.StartTimeout <= 0 {
+		cfg.StartTimeout = 10 * time.Second
+	}
+	if cfg.Quality <= 0 {
+		cfg.Quality = 5
+	}
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	return &Snapshots{log: log.With("subsystem", "snapshots"), cfg: cfg, resolve: resolve, cameras: make(map[string]*liveSnapshot)}
+}
+
+// ServeHTTP serves /<camera>/snapshot.jpg, the latest snapshot of the camera, and /<camera>/snapshot.mjpg, each new
+// snapshot as it is taken as a Motion JPEG stream browsers show in an img tag. Mount it with http.StripPrefix and use
+// Camera with auth.RequireStreamToken.
+func (s *Snapshots) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	camera, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if camera == "" || strings.HasPrefix(camera, ".") || (file != "snapshot.jpg" && file != "snapshot.mjpg") {
+		http.NotFound(w, r)
+		return
+	}
+
+	live, err := s.snapshot(camera)
+	if errors.Is(err, ErrUnknownCamera) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.StartTimeout)
+	jpeg, taken, err := live.next(ctx, time.Time{})
+	cancel()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if file == "snapshot.jpg" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Last-Modified", taken.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(jpeg)))
+		w.Write(jpeg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(jpeg))
+		w.Write(jpeg)
+		if _, err := w.Write([]byte("\r\n")); err != nil {
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		// a viewer keeps the camera being read for as long as it is watching
+		s.touch(camera)
+		if jpeg, taken, err = live.next(r.Context(), taken); err != nil {
+			return
+		}
+	}
+}
+
+// Run stops reading cameras which haven't been requested for our idle timeout until the passed in context is done,
+// at which point every camera is stopped
+func (s *Snapshots) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stopIdle(time.Time{})
+			return
+		case now := <-ticker.C:
+			s.stopIdle(now.Add(-s.cfg.IdleTimeout))
+		}
+	}
+}
+
+// stops every camera last requested before the passed in time, all of them if it is zero
+func (s *Snapshots) stopIdle(before time.Time) {
+	s.mu.Lock()
+	idle := []*liveSnapshot{}
+	for camera, live := range s.cameras {
+		if before.IsZero() || live.lastUsed.Before(before) {
+			idle = append(idle, live)
+			delete(s.cameras, camera)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, live := range idle {
+		s.log.Info("stopping idle snapshots", slog.String("camera", live.camera))
+		live.cancel()
+		<-live.done
+	}
+}
+
+// marks the passed in camera as just requested
+func (s *Snapshots) touch(camera string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if live, found := s.cameras[camera]; found {
+		live.lastUsed = time.Now()
+	}
+}
+
+// returns the live snapshot of the passed in camera, starting to read it if needed
+func (s *Snapshots) snapshot(camera string) (*liveSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if live, found := s.cameras[camera]; found {
+		select {
+		case <-live.done:
+			// the stream failed, so report why once and start afresh on the next request
+			delete(s.cameras, camera)
+			return nil, fmt.Errorf("stream failed: %w", live.err)
+		default:
+			live.lastUsed = time.Now()
+			return live, nil
+		}
+	}
+
+	url, err := s.resolve(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	live := &liveSnapshot{camera: camera, cancel: cancel, done: make(chan struct{}), lastUsed: time.Now(), updated: make(chan struct{})}
+	s.cameras[camera] = live
+
+	s.log.Info("starting snapshots", slog.String("camera", camera), slog.Any("url", url))
+	go func() {
+		defer close(live.done)
+		live.err = s.run(ctx, url, live)
+	}()
+	return live, nil
+}
+
+// reads the stream at the passed in URL, updating the passed in snapshot, until the stream fails or the context is
+// done
+func (s *Snapshots) run(ctx context.Context, url *creds.URL, live *liveSnapshot) error {
+	video, err := rtsp.OpenVideo(url.Secret(), s.cfg.StartTimeout, "H264", "H265", "JPEG")
+	if err != nil {
+		return err
+	}
+	defer video.Close()
+
+	stop := context.AfterFunc(ctx, func() { video.Close() })
+	defer stop()
+
+	if strings.EqualFold(video.Encoding, "JPEG") {
+		err = s.passThrough(video, live)
+	} else {
+		err = s.decodeKeyframes(ctx, video, live)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// passes on the frames of a Motion JPEG stream as they are, one per interval
+func (s *Snapshots) passThrough(video *rtsp.VideoStream, live *liveSnapshot) error {
+	depacketizer := rtsp.NewJPEGDepacketizer()
+	for {
+		packet, err := video.ReadRTP()
+		if err != nil {
+			return err
+		}
+		jpeg, err := depacketizer.Push(packet)
+		if err != nil || jpeg == nil {
+			continue
+		}
+		if now := time.Now(); live.due(now, s.cfg.Interval) {
+			live.set(jpeg, now)
+		}
+	}
+}
+
+// decodes a keyframe of an H.264 or H.265 stream once per interval, skipping any which arrive while the last is
+// still being decoded
+func (s *Snapshots) decodeKeyframes(ctx context.Context, video *rtsp.VideoStream, live *liveSnapshot) error {
+	depacketizer, err := rtsp.NewDepacketizer(video.Encoding, video.ClockRate, video.ParameterSets())
+	if err != nil {
+		return err
+	}
+	codec := ffmpeg.CodecH264
+	if strings.EqualFold(video.Encoding, "H265") {
+		codec = ffmpeg.CodecH265
+	}
+
+	decoding := atomic.Bool{}
+	last := time.Time{}
+	for {
+		packet, err := video.ReadRTP()
+		if err != nil {
+			return err
+		}
+		units, err := depacketizer.Push(packet, time.Now())
+		if err != nil {
+			continue
+		}
+		for _, unit := range units {
+			if !unit.Keyframe || unit.Received.Sub(last) < s.cfg.Interval || !decoding.CompareAndSwap(false, true) {
+				continue
+			}
+			last = unit.Received
+
+			go func(frame []byte, received time.Time) {
+				defer decoding.Store(false)
+				jpeg, err := ffmpeg.KeyframeJPEG(ctx, s.cfg.FFmpegPath, codec, frame, s.cfg.Quality)
+				if err != nil {
+					if ctx.Err() == nil {
+						s.log.Warn("unable to decode keyframe", slog.String("camera", live.camera), slog.String("error", err.Error()))
+					}
+					return
+				}
+				live.set(jpeg, received)
+			}(unit.AnnexB(), unit.Received)
+		}
+	}
+}
+
+// returns whether a new snapshot is due at the passed in time given the passed in interval
+func (l *liveSnapshot) due(now time.Time, interval time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.Sub(l.taken) >= interval
+}
+
+// replaces our snapshot with the passed in one, waking anyone waiting for it
+func (l *liveSnapshot) set(jpeg []byte, taken time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.jpeg, l.taken = jpeg, taken
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// returns the first snapshot taken after the passed in time, waiting for it if need be until the context is done or
+// the stream fails
+func (l *liveSnapshot) next(ctx context.Context, after time.Time) ([]byte, time.Time, error) {
+	for {
+		l.mu.Lock()
+		jpeg, taken, updated := l.jpeg, l.taken, l.updated
+		l.mu.Unlock()
+
+		if jpeg != nil && taken.After(after) {
+			return jpeg, taken, nil
+		}
+
+		select {
+		case <-updated:
+		case <-l.done:
+			if l.err == nil {
+				return nil, time.Time{}, errors.New("stream stopped")
+			}
+			return nil, time.Time{}, fmt.Errorf("stream failed: %w", l.err)
+		case <-ctx.Done():
+			return nil, time.Time{}, errors.New("timed out waiting for snapshot")
+		}
+	}
+}
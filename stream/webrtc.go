@@ -0,0 +1,472 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/incrementventures/govr/rtsp"
+)
+
+// offers are a few KB at most, anything much bigger isn't one
+const maxOfferSize = 64 * 1024
+
+// ICEServer is a STUN or TURN server used to gather candidates, URLs are like stun:stun.l.google.com:19302
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+}
+
+// WebRTCConfig configures live WebRTC output
+type WebRTCConfig struct {
+	// the STUN and TURN servers we gather candidates with, these should be the same ones viewers are configured with
+	ICEServers []ICEServer
+
+	// the public addresses of this host if it is behind a 1:1 NAT, advertised in place of its local ones
+	PublicIPs []string
+
+	// a single UDP port every viewer connects to, which is easier to open in a firewall, a random port per viewer
+	// if zero
+	UDPPort int
+
+	// how long we gather candidates for before answering an offer
+	GatherTimeout time.Duration
+
+	// how long we wait on a camera to start playing and then between its packets
+	ReadTimeout time.Duration
+}
+
+// WebRTC restreams the H.264 video of cameras to WebRTC viewers using WHEP, each camera is played once no matter
+// how many viewers it has, starting when its first viewer connects and stopping when its last one leaves
+type WebRTC struct {
+	log     *slog.Logger
+	cfg     WebRTCConfig
+	resolve Resolver
+	api     *webrtc.API
+
+	mu      sync.Mutex
+	sources map[string]*rtcSource
+	viewers map[string]*rtcViewer
+}
+
+// a camera being played to one or more viewers
+type rtcSource struct {
+	camera  string
+	video   *rtsp.VideoStream
+	viewers map[string]*rtcViewer
+	stopped bool
+}
+
+type rtcViewer struct {
+	id     string
+	source *rtcSource
+	pc     *webrtc.PeerConnection
+	track  *webrtc.TrackLocalStaticRTP
+
+	// viewers start on a keyframe and have their own sequence numbers as we add parameter sets to what they're sent,
+	// both are only touched by the source's read loop
+	started bool
+	seq     uint16
+}
+
+func NewWebRTC(log *slog.Logger, cfg WebRTCConfig, resolve Resolver) (*WebRTC, error) {
+	if cfg.GatherTimeout <= 0 {
+		cfg.GatherTimeout = 2 * time.Second
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 10 * time.Second
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("error registering codecs: %w", err)
+	}
+
+	// gives us NACK responses and RTCP reports on the tracks we send
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, fmt.Errorf("error registering interceptors: %w", err)
+	}
+
+	se := webrtc.SettingEngine{}
+	if len(cfg.PublicIPs) > 0 {
+		se.SetNAT1To1IPs(cfg.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if cfg.UDPPort > 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(cfg.UDPPort)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on udp port %d: %w", cfg.UDPPort, err)
+		}
+		se.SetICEUDPMux(mux)
+	}
+
+	return &WebRTC{
+		log:     log.With("subsystem", "webrtc"),
+		cfg:     cfg,
+		resolve: resolve,
+		api:     webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se)),
+		sources: make(map[string]*rtcSource),
+		viewers: make(map[string]*rtcViewer),
+	}, nil
+}
+
+// ServeHTTP serves WHEP, a POST of an SDP offer to /<camera> is answered with a session at /<camera>/<id> which is
+// ended by a DELETE, mount it with http.StripPrefix and use Camera with auth.RequireStreamToken
+func (h *WebRTC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	camera, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if camera == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.offer(w, r, camera)
+	case id != "" && r.Method == http.MethodDelete:
+		if !h.hangup(camera, id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case id != "" && r.Method == http.MethodPatch:
+		// we answer with every candidate gathered so there's nothing to trickle
+		http.Error(w, "trickle ice not supported", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// answers the SDP offer in the passed in request with a new viewer of the passed in camera
+func (h *WebRTC) offer(w http.ResponseWriter, r *http.Request, camera string) {
+	if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) != "application/sdp" {
+		http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "error reading offer", http.StatusBadRequest)
+		return
+	}
+
+	source, err := h.source(camera)
+	if errors.Is(err, ErrUnknownCamera) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	v, answer, err := h.connect(r.Context(), source, string(offer))
+	if err != nil {
+		h.release(source)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.log.Info("webrtc viewer connected", slog.String("camera", camera), slog.String("viewer", v.id))
+
+	// the session is relative to the offer URL, carry over its query as it holds our token
+	location := camera + "/" + v.id
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// creates a peer connection for a new viewer of the passed in source and returns it along with our SDP answer
+func (h *WebRTC) connect(ctx context.Context, source *rtcSource, offer string) (*rtcViewer, string, error) {
+	iceServers := make([]webrtc.ICEServer, len(h.cfg.ICEServers))
+	for i, s := range h.cfg.ICEServers {
+		iceServers[i] = webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential}
+	}
+
+	pc, err := h.api.NewPeerConnection(webrtc.Configuration{ICEServers: iceServers})
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating peer connection: %w", err)
+	}
+
+	v := &rtcViewer{id: uuid.NewString(), source: source, pc: pc}
+	answer, err := h.negotiate(ctx, v, offer)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateDisconnected:
+			h.hangup(source.camera, v.id)
+		}
+	})
+
+	h.mu.Lock()
+	stopped := source.stopped
+	if !stopped {
+		h.viewers[v.id] = v
+		source.viewers[v.id] = v
+	}
+	h.mu.Unlock()
+
+	// the camera may have failed while we were negotiating
+	if stopped {
+		pc.Close()
+		return nil, "", errors.New("stream stopped")
+	}
+	return v, answer, nil
+}
+
+// adds our video track to the passed in viewer's peer connection and answers its offer once candidates are gathered
+func (h *WebRTC) negotiate(ctx context.Context, v *rtcViewer, offer string) (string, error) {
+	codec := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: h264FMTP(v.source.video.FMTP),
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "govr-"+v.source.camera)
+	if err != nil {
+		return "", fmt.Errorf("error creating track: %w", err)
+	}
+	v.track = track
+
+	sender, err := v.pc.AddTrack(track)
+	if err != nil {
+		return "", fmt.Errorf("error adding track: %w", err)
+	}
+
+	// RTCP has to be read for the interceptors to see it, there is nothing we can do with it ourselves as we can't
+	// ask the camera for a keyframe
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := v.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("invalid offer: %w", err)
+	}
+	answer, err := v.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating answer: %w", err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(v.pc)
+	if err := v.pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("error setting answer: %w", err)
+	}
+
+	// answer with whatever we have once our timeout is up, host candidates are gathered immediately
+	timer := time.NewTimer(h.cfg.GatherTimeout)
+	defer timer.Stop()
+	select {
+	case <-gathered:
+	case <-timer.C:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	return v.pc.LocalDescription().SDP, nil
+}
+
+// returns the fmtp line we offer for the passed in camera fmtp parameters, keeping the camera's profile so the
+// browser picks a matching decoder
+func h264FMTP(fmtp map[string]string) string {
+	profile := fmtp["profile-level-id"]
+	if len(profile) != 6 {
+		profile = "42e01f"
+	}
+	return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + strings.ToLower(profile)
+}
+
+// ends the passed in viewer session, returning whether it existed, the camera is stopped if it was the last viewer
+func (h *WebRTC) hangup(camera string, id string) bool {
+	h.mu.Lock()
+	v, found := h.viewers[id]
+	if !found || v.source.camera != camera {
+		h.mu.Unlock()
+		return false
+	}
+	delete(h.viewers, id)
+	delete(v.source.viewers, id)
+	h.mu.Unlock()
+
+	h.log.Info("webrtc viewer disconnected", slog.String("camera", camera), slog.String("viewer", id))
+	v.pc.Close()
+	h.release(v.source)
+	return true
+}
+
+// stops the passed in source if it has no viewers left
+func (h *WebRTC) release(s *rtcSource) {
+	h.mu.Lock()
+	if s.stopped || len(s.viewers) > 0 {
+		h.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	if h.sources[s.camera] == s {
+		delete(h.sources, s.camera)
+	}
+	h.mu.Unlock()
+
+	h.log.Info("stopping webrtc stream", slog.String("camera", s.camera))
+	s.video.Close()
+}
+
+// returns the playing source for the passed in camera, starting it if needed
+func (h *WebRTC) source(camera string) (*rtcSource, error) {
+	h.mu.Lock()
+	s, found := h.sources[camera]
+	h.mu.Unlock()
+	if found {
+		return s, nil
+	}
+
+	url, err := h.resolve(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	// cameras can take a while to start playing so we don't hold our lock while they do
+	h.log.Info("starting webrtc stream", slog.String("camera", camera), slog.Any("url", url))
+	video, err := rtsp.OpenVideo(url.Secret(), h.cfg.ReadTimeout, "H264")
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// another viewer may have started this camera while we were, if so use theirs
+	if existing, found := h.sources[camera]; found {
+		video.Close()
+		return existing, nil
+	}
+
+	s = &rtcSource{camera: camera, video: video, viewers: make(map[string]*rtcViewer)}
+	h.sources[camera] = s
+	go h.forward(s)
+	return s, nil
+}
+
+// reads RTP from the passed in source and writes it to each of its viewers until it is stopped or fails, in which
+// case its viewers are disconnected
+func (h *WebRTC) forward(s *rtcSource) {
+	parameterSets := s.video.ParameterSets()
+	viewers := []*rtcViewer{}
+	bytes, frames := streamBytes.With(s.camera, "webrtc"), streamFrames.With(s.camera, "webrtc")
+
+	for {
+		b, err := s.video.ReadRTP()
+		if err != nil {
+			h.mu.Lock()
+			stopped := s.stopped
+			h.mu.Unlock()
+			if !stopped {
+				h.log.Error("webrtc stream failed", slog.String("camera", s.camera), slog.Any("error", err))
+				h.stop(s)
+			}
+			return
+		}
+
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(b); err != nil {
+			continue
+		}
+		bytes.Add(float64(len(b)))
+		if p.Marker {
+			frames.Inc()
+		}
+
+		h.mu.Lock()
+		viewers = viewers[:0]
+		for _, v := range s.viewers {
+			viewers = append(viewers, v)
+		}
+		h.mu.Unlock()
+
+		for _, v := range viewers {
+			v.write(p, parameterSets)
+		}
+	}
+}
+
+// disconnects every viewer of the passed in source and stops it
+func (h *WebRTC) stop(s *rtcSource) {
+	h.mu.Lock()
+	viewers := []*rtcViewer{}
+	for id, v := range s.viewers {
+		viewers = append(viewers, v)
+		delete(h.viewers, id)
+		delete(s.viewers, id)
+	}
+	h.mu.Unlock()
+
+	for _, v := range viewers {
+		v.pc.Close()
+	}
+	h.release(s)
+}
+
+// Run stops every stream and disconnects its viewers once the passed in context is done
+func (h *WebRTC) Run(ctx context.Context) {
+	<-ctx.Done()
+
+	h.mu.Lock()
+	sources := []*rtcSource{}
+	for _, s := range h.sources {
+		sources = append(sources, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sources {
+		h.stop(s)
+	}
+}
+
+// writes the passed in packet to this viewer, holding off until the first keyframe and sending the passed in
+// parameter sets ahead of it so the browser can decode it
+func (v *rtcViewer) write(p *rtp.Packet, parameterSets [][]byte) {
+	if !v.started {
+		if !rtsp.IsKeyframeStart(v.source.video.Encoding, p.Payload) {
+			return
+		}
+		v.started = true
+
+		for _, nal := range parameterSets {
+			header := p.Header
+			header.Marker = false
+			v.send(header, nal)
+		}
+	}
+	v.send(p.Header, p.Payload)
+}
+
+func (v *rtcViewer) send(header rtp.Header, payload []byte) {
+	header.SequenceNumber = v.seq
+	v.seq++
+
+	// a viewer whose connection is gone is cleaned up when its state changes, so there's nothing more to do on error
+	if err := v.track.WriteRTP(&rtp.Packet{Header: header, Payload: payload}); err != nil {
+		streamDropped.With(v.source.camera, "webrtc").Inc()
+	}
+}
@@ -0,0 +1,211 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CrashReport describes a panic in a supervised task
+type CrashReport struct {
+	Task  string    `json:"task"`
+	Time  time.Time `json:"time"`
+	Panic string    `json:"panic"`
+	Stack string    `json:"stack"`
+}
+
+// Task is a long running function, such as a single camera's pipeline, it should return when its context is done
+type Task func(ctx context.Context) error
+
+// Supervisor runs tasks, recovering from panics and restarting only the task which failed
+type Supervisor struct {
+	log *slog.Logger
+
+	// how long to wait before restarting a failed task, doubled on each consecutive failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// if set, called with each crash report, e.g. to increment a metric or send an alert
+	OnCrash func(CrashReport)
+
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	crashes map[string]int
+	reports []CrashReport
+	maxKeep int
+	running map[string]*running
+}
+
+// a started task, kept by name until it stops
+type running struct {
+	cancel context.CancelFunc
+}
+
+func New(log *slog.Logger) *Supervisor {
+	return &Supervisor{
+		log:        log.With("subsystem", "supervisor"),
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		crashes:    make(map[string]int),
+		maxKeep:    100,
+		running:    make(map[string]*running),
+	}
+}
+
+// Go starts the passed in task in the background, see Run
+func (s *Supervisor) Go(ctx context.Context, name string, task Task) {
+	ctx, r := s.start(ctx, name)
+	go s.supervise(ctx, name, r, task)
+}
+
+// Run runs the passed in task, restarting it whenever it panics or returns an error until the context is done or the
+// task returns nil, which is when Run returns. Running a task with the name of one already running stops the old one
+// first.
+func (s *Supervisor) Run(ctx context.Context, name string, task Task) {
+	ctx, r := s.start(ctx, name)
+	s.supervise(ctx, name, r, task)
+}
+
+// keeps track of a task with the passed in name which is about to start, stopping any already running with that name
+func (s *Supervisor) start(ctx context.Context, name string) (context.Context, *running) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &running{cancel: cancel}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, found := s.running[name]; found {
+		existing.cancel()
+	}
+	s.running[name] = r
+	s.wg.Add(1)
+	return ctx, r
+}
+
+func (s *Supervisor) supervise(ctx context.Context, name string, r *running, task Task) {
+	defer s.wg.Done()
+	defer s.finished(name, r)
+
+	backoff := s.MinBackoff
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx, name, task)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		// a task which ran for a good while before failing gets a fresh backoff
+		if time.Since(started) > s.MaxBackoff {
+			backoff = s.MinBackoff
+		}
+
+		s.log.Error("task failed, restarting", slog.String("task", name), slog.String("error", err.Error()), slog.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+// forgets the passed in task once it has stopped, unless it has already been replaced by another with its name
+func (s *Supervisor) finished(name string, r *running) {
+	r.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[name] == r {
+		delete(s.running, name)
+	}
+}
+
+// Stop stops the task with the passed in name
+func (s *Supervisor) Stop(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, found := s.running[name]; found {
+		r.cancel()
+		delete(s.running, name)
+	}
+}
+
+// Wait blocks until all tasks have returned
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Running returns the names of the tasks which haven't stopped
+func (s *Supervisor) Running() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Crashes returns the number of times each task has panicked
+func (s *Supervisor) Crashes() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crashes := make(map[string]int, len(s.crashes))
+	for k, v := range s.crashes {
+		crashes[k] = v
+	}
+	return crashes
+}
+
+// Reports returns the most recent crash reports, oldest first
+func (s *Supervisor) Reports() []CrashReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]CrashReport{}, s.reports...)
+}
+
+// runs the task once, converting any panic into a crash report and an error
+func (s *Supervisor) runOnce(ctx context.Context, name string, task Task) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		report := CrashReport{Task: name, Time: time.Now(), Panic: fmt.Sprint(r), Stack: string(debug.Stack())}
+		s.recordCrash(report)
+		err = fmt.Errorf("panic: %v", r)
+	}()
+
+	return task(ctx)
+}
+
+func (s *Supervisor) recordCrash(report CrashReport) {
+	s.log.Error("task panicked",
+		slog.String("task", report.Task),
+		slog.String("panic", report.Panic),
+		slog.String("stack", report.Stack))
+
+	s.mu.Lock()
+	s.crashes[report.Task]++
+	s.reports = append(s.reports, report)
+	if len(s.reports) > s.maxKeep {
+		s.reports = s.reports[len(s.reports)-s.maxKeep:]
+	}
+	onCrash := s.OnCrash
+	s.mu.Unlock()
+
+	if onCrash != nil {
+		onCrash(report)
+	}
+}
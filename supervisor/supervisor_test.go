@@ -0,0 +1,117 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testSupervisor() *Supervisor {
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.MinBackoff, s.MaxBackoff = time.Millisecond, 10*time.Millisecond
+	return s
+}
+
+func TestRun(t *testing.T) {
+	tcs := []struct {
+		name    string
+		results []string
+		runs    int
+		crashes int
+	}{
+		{name: "returns", results: []string{"nil"}, runs: 1},
+		{name: "restarted after panic", results: []string{"panic", "nil"}, runs: 2, crashes: 1},
+		{name: "restarted after error", results: []string{"error", "error", "nil"}, runs: 3},
+		{name: "restarted after both", results: []string{"panic", "error", "panic", "nil"}, runs: 4, crashes: 2},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testSupervisor()
+			reports := []CrashReport{}
+			s.OnCrash = func(r CrashReport) { reports = append(reports, r) }
+
+			runs := 0
+			s.Run(context.Background(), "camera-1", func(ctx context.Context) error {
+				result := tc.results[runs]
+				runs++
+				switch result {
+				case "panic":
+					panic("bad frame")
+				case "error":
+					return errors.New("stream failed")
+				}
+				return nil
+			})
+
+			if runs != tc.runs {
+				t.Errorf("expected %d runs, got %d", tc.runs, runs)
+			}
+			if crashes := s.Crashes()["camera-1"]; crashes != tc.crashes {
+				t.Errorf("expected %d crashes, got %d", tc.crashes, crashes)
+			}
+			if len(reports) != tc.crashes || len(s.Reports()) != tc.crashes {
+				t.Fatalf("expected %d crash reports, got %d and %d", tc.crashes, len(reports), len(s.Reports()))
+			}
+			for _, r := range reports {
+				if r.Task != "camera-1" || r.Panic != "bad frame" || r.Stack == "" {
+					t.Errorf("expected a report of the panic, got %+v", r)
+				}
+			}
+			if running := s.Running(); len(running) != 0 {
+				t.Errorf("expected finished tasks to be forgotten, got %v", running)
+			}
+		})
+	}
+}
+
+func TestGo(t *testing.T) {
+	s := testSupervisor()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// tasks run until stopped, their context being done
+	blocked := func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}
+	s.Go(ctx, "camera-1", blocked)
+	s.Go(ctx, "camera-2", blocked)
+	if running := s.Running(); !slices.Equal(running, []string{"camera-1", "camera-2"}) {
+		t.Fatalf("expected both tasks running, got %v", running)
+	}
+
+	// starting a task with the name of one running replaces it, with the old one stopping and not forgetting the new
+	replaced := make(chan struct{})
+	go func() {
+		defer close(replaced)
+		s.Run(ctx, "camera-3", blocked)
+	}()
+	for !slices.Contains(s.Running(), "camera-3") {
+		time.Sleep(time.Millisecond)
+	}
+	s.Go(ctx, "camera-3", blocked)
+	select {
+	case <-replaced:
+	case <-time.After(time.Second):
+		t.Fatal("expected the replaced task to stop")
+	}
+	if running := s.Running(); !slices.Equal(running, []string{"camera-1", "camera-2", "camera-3"}) {
+		t.Errorf("expected the replacement to still be running, got %v", running)
+	}
+
+	s.Stop("camera-1")
+	if running := s.Running(); !slices.Equal(running, []string{"camera-2", "camera-3"}) {
+		t.Errorf("expected the stopped task to be forgotten, got %v", running)
+	}
+
+	cancel()
+	s.Wait()
+	if running := s.Running(); len(running) != 0 {
+		t.Errorf("expected every task to be forgotten, got %v", running)
+	}
+}
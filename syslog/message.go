@@ -0,0 +1,197 @@
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Severity is how serious a syslog message is, lower being more serious
+type Severity int
+
+const (
+	SeverityEmergency Severity = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+var severityNames = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return strconv.Itoa(int(s))
+	}
+	return severityNames[s]
+}
+
+// MarshalText marshals a severity as its name
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText unmarshals a severity from its name or number
+func (s *Severity) UnmarshalText(b []byte) error {
+	for i, name := range severityNames {
+		if strings.EqualFold(string(b), name) {
+			*s = Severity(i)
+			return nil
+		}
+	}
+	i, err := strconv.Atoi(string(b))
+	if err != nil || i < 0 || i >= len(severityNames) {
+		return fmt.Errorf("invalid severity: %q", b)
+	}
+	*s = Severity(i)
+	return nil
+}
+
+// Message is a single syslog message from a device
+type Message struct {
+	// when we received the message, and when the device says it sent it which is only as good as its clock
+	Received time.Time `json:"received"`
+	Time     time.Time `json:"time"`
+
+	// the address the message came from, and the hostname the device gave itself
+	Host     string `json:"host"`
+	Hostname string `json:"hostname,omitempty"`
+
+	Facility int      `json:"facility"`
+	Severity Severity `json:"severity"`
+	App      string   `json:"app,omitempty"`
+	Text     string   `json:"text"`
+}
+
+// ErrInvalidMessage is returned when a message doesn't start with a priority, which every syslog message must
+var ErrInvalidMessage = errors.New("invalid syslog message")
+
+// the layouts of the timestamps of RFC 3164 messages, which have no year or zone, and those cameras use instead
+var bsdTimeLayouts = []string{time.Stamp, "Jan _2 2006 15:04:05", "2006-01-02 15:04:05"}
+
+// Parse parses a syslog message received from the passed in host at the passed in time, either RFC 5424 or the older
+// BSD format of RFC 3164. Cameras are loose with the latter so whatever doesn't parse as its header is kept as text.
+func Parse(b []byte, host string, now time.Time) (Message, error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	if len(b) < 3 || b[0] != '<' {
+		return Message{}, ErrInvalidMessage
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return Message{}, ErrInvalidMessage
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri > 191 {
+		return Message{}, ErrInvalidMessage
+	}
+
+	m := Message{Received: now, Time: now, Host: host, Facility: pri / 8, Severity: Severity(pri % 8)}
+	rest := toText(b[end+1:])
+	if strings.HasPrefix(rest, "1 ") {
+		parse5424(&m, rest[2:])
+	} else {
+		parse3164(&m, rest, now)
+	}
+	return m, nil
+}
+
+// parses the header of an RFC 5424 message, "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG", where missing
+// fields are -
+func parse5424(m *Message, rest string) {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 5 {
+		m.Text = rest
+		return
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		m.Time = t
+	}
+	m.Hostname, m.App = nilValue(fields[1]), nilValue(fields[2])
+	if len(fields) < 6 {
+		return
+	}
+
+	// structured data is either - or a run of [elements], any quoted ] within them being escaped
+	text := fields[5]
+	if strings.HasPrefix(text, "- ") || text == "-" {
+		text = strings.TrimPrefix(text[1:], " ")
+	} else {
+		for strings.HasPrefix(text, "[") {
+			i := 1
+			for i < len(text) && text[i] != ']' {
+				if text[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			text = text[min(i+1, len(text)):]
+		}
+		text = strings.TrimPrefix(text, " ")
+	}
+	// messages may start with a byte order mark to say they are UTF-8
+	m.Text = strings.TrimPrefix(text, "\ufeff")
+}
+
+// parses the header of an RFC 3164 message, "Mmm dd hh:mm:ss HOSTNAME TAG: MSG", whose timestamp is in the local
+// time of the device which we assume is ours
+func parse3164(m *Message, rest string, now time.Time) {
+	for _, layout := range bsdTimeLayouts {
+		if len(rest) < len(layout) {
+			continue
+		}
+		t, err := time.ParseInLocation(layout, rest[:len(layout)], time.Local)
+		if err != nil {
+			continue
+		}
+
+		// timestamps without a year are from the last year, which around new year may not be this one
+		if t.Year() == 0 {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		m.Time = t
+		rest = strings.TrimPrefix(rest[len(layout):], " ")
+
+		// the hostname is a single word, but some devices go straight on to their tag
+		if hostname, after, found := strings.Cut(rest, " "); found && !strings.HasSuffix(hostname, ":") {
+			m.Hostname, rest = hostname, after
+		}
+		break
+	}
+
+	// the tag is the name of the app optionally followed by its [pid], ending with a colon
+	if tag, text, found := strings.Cut(rest, ": "); found && tag != "" && !strings.ContainsAny(tag, " ") {
+		app, _, _ := strings.Cut(tag, "[")
+		m.App, rest = app, text
+	}
+	m.Text = rest
+}
+
+// returns the passed in field of an RFC 5424 header, empty if it is the nil value -
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// returns the passed in bytes as text, devices don't always send UTF-8 so anything which isn't is taken as Latin-1
+func toText(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,40 @@
+package syslog
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Listen receives syslog messages over UDP on the passed in address, usually :514 which needs to be run as root,
+// calling received with each. Cameras only send syslog over UDP and messages which aren't syslog are ignored.
+func Listen(ctx context.Context, addr string, received func(Message)) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for syslog on %s: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error reading syslog message: %w", err)
+		}
+
+		host := from.String()
+		if udp, ok := from.(*net.UDPAddr); ok {
+			host = udp.IP.String()
+		}
+		if m, err := Parse(buf[:n], host, time.Now()); err == nil {
+			received(m)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package syslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the size a device's log grows to before it is rotated, if not otherwise configured
+const defaultMaxBytes = 1 << 20
+
+// Store keeps the messages of each device in a log of its own, a JSON line per message, which is rotated once it
+// reaches its maximum size so that a device keeps at most twice that
+type Store struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files map[string]*os.File
+	sizes map[string]int64
+}
+
+// OpenStore opens the store in the passed in directory, creating it if needed, whose logs are rotated once they reach
+// the passed in number of bytes, 1MB if zero
+func OpenStore(dir string, maxBytes int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating syslog directory: %w", err)
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	return &Store{dir: dir, maxBytes: maxBytes, files: make(map[string]*os.File), sizes: make(map[string]int64)}, nil
+}
+
+// Add appends the passed in message to the log of the passed in device
+func (s *Store) Add(device string, m Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("error marshalling syslog message: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fileName(device)
+	if s.files[name] != nil && s.sizes[name]+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(name); err != nil {
+			return err
+		}
+	}
+
+	f := s.files[name]
+	if f == nil {
+		if f, err = os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("error opening syslog of %s: %w", device, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error opening syslog of %s: %w", device, err)
+		}
+		s.files[name], s.sizes[name] = f, info.Size()
+	}
+
+	n, err := f.Write(line)
+	s.sizes[name] += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing syslog of %s: %w", device, err)
+	}
+	return nil
+}
+
+// moves the current log with the passed in file name aside, replacing the one moved aside before it
+func (s *Store) rotate(name string) error {
+	s.files[name].Close()
+	delete(s.files, name)
+	delete(s.sizes, name)
+
+	path := filepath.Join(s.dir, name)
+	if err := os.Rename(path, path+".1"); err != nil {
+		return fmt.Errorf("error rotating syslog %q: %w", path, err)
+	}
+	return nil
+}
+
+// Messages returns the messages of the passed in device received between the passed in times, oldest first, which
+// are at least as serious as the passed in severity
+func (s *Store) Messages(device string, from time.Time, to time.Time, severity Severity) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, fileName(device))
+	messages := []Message{}
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error opening syslog %q: %w", p, err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			m := Message{}
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				// only a line cut off by a crash mid write can be bad
+				continue
+			}
+			if m.Severity <= severity && !m.Received.Before(from) && m.Received.Before(to) {
+				messages = append(messages, m)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading syslog %q: %w", p, err)
+		}
+	}
+	return messages, nil
+}
+
+// Close closes the logs of every device
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, f := range s.files {
+		f.Close()
+		delete(s.files, name)
+	}
+	return nil
+}
+
+// returns the name of the log of the passed in device, which may be an IPv6 address or anything a camera calls
+// itself so is limited to characters safe in a file name
+func fileName(device string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, device)
+	return strings.TrimLeft(name, ".") + ".log"
+}